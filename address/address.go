@@ -0,0 +1,260 @@
+// Package address parses and compares email addresses as used in the SMTP
+// envelope (RFC 5321 mailboxes): a local part, which may be quoted, and a
+// domain, which may be internationalized or an address literal.
+//
+// Only the destination domain may interpret the local part, so it is kept as
+// it is by default. Key gives a case-insensitive form for lookups, as most
+// servers treat local parts, and Detail splits off subaddresses such as the
+// "tag" of "user+tag@example.com".
+package address
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalid is wrapped by the errors of Parse.
+var ErrInvalid = errors.New("invalid address")
+
+// DefaultDetailSeparator separates the user from the detail in a local part,
+// e.g. "user+tag".
+const DefaultDetailSeparator = "+"
+
+// Address is a parsed envelope address.
+type Address struct {
+	// Local is the unquoted local part.
+	Local string
+	// Domain is the domain as given, or an address literal such as
+	// "[192.0.2.1]".
+	Domain string
+}
+
+// Parse parses an envelope address such as "alice@example.com",
+// "<alice@example.com>" or "\"john doe\"@example.com". The null sender "<>"
+// is not an address.
+func Parse(s string) (Address, error) {
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		s = s[1 : len(s)-1]
+	}
+	local, domain, err := split(s)
+	if err != nil {
+		return Address{}, fmt.Errorf("%w %q: %v", ErrInvalid, s, err)
+	}
+	if err := checkDomain(domain); err != nil {
+		return Address{}, fmt.Errorf("%w %q: %v", ErrInvalid, s, err)
+	}
+	return Address{Local: local, Domain: domain}, nil
+}
+
+// String returns the address, quoting the local part if needed.
+func (a Address) String() string {
+	if isDotAtom(a.Local) {
+		return a.Local + "@" + a.Domain
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range a.Local {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteString(`"@`)
+	b.WriteString(a.Domain)
+	return b.String()
+}
+
+// Normalize returns the address with its domain normalized by
+// NormalizeDomain. The local part is kept as it is.
+func (a Address) Normalize() Address {
+	if !strings.HasPrefix(a.Domain, "[") {
+		a.Domain = NormalizeDomain(a.Domain)
+	}
+	return a
+}
+
+// Key returns the normalized address with a lower-cased local part, for
+// case-insensitive comparisons and map keys.
+func (a Address) Key() string {
+	a = a.Normalize()
+	a.Local = strings.ToLower(a.Local)
+	return a.String()
+}
+
+// Detail splits the local part at the first sep into the user and the
+// detail, e.g. "user" and "tag" for "user+tag". ok is false if the local part
+// has no detail.
+func (a Address) Detail(sep string) (user, detail string, ok bool) {
+	user, detail, ok = strings.Cut(a.Local, sep)
+	if !ok || user == "" {
+		return a.Local, "", false
+	}
+	return user, detail, true
+}
+
+// WithoutDetail returns the address with the detail removed from the local
+// part, e.g. "user@example.com" for "user+tag@example.com".
+func (a Address) WithoutDetail(sep string) Address {
+	a.Local, _, _ = a.Detail(sep)
+	return a
+}
+
+// Domain returns the domain of an address, or "" if it has none. Unlike
+// Parse, it does not validate the address.
+func Domain(s string) string {
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		return s[i+1:]
+	}
+	return ""
+}
+
+// LocalPart returns the local part of an address as given, without
+// unquoting it, or the whole string if it has no domain.
+func LocalPart(s string) string {
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// Normalize returns an address with its domain normalized by NormalizeDomain.
+// The local part is kept as it is, as is a string without a domain.
+func Normalize(s string) string {
+	i := strings.LastIndexByte(s, '@')
+	if i < 0 || strings.HasPrefix(s[i+1:], "[") {
+		return s
+	}
+	return s[:i+1] + NormalizeDomain(s[i+1:])
+}
+
+// Key returns the form of an address for case-insensitive comparisons and
+// map keys: lower case with A-label domain. Invalid addresses are only
+// lower-cased after normalizing the domain.
+func Key(s string) string {
+	if a, err := Parse(s); err == nil {
+		return a.Key()
+	}
+	return strings.ToLower(Normalize(s))
+}
+
+// Equal reports whether two addresses are the same, ignoring case and the
+// form of their domains.
+func Equal(a, b string) bool {
+	return Key(a) == Key(b)
+}
+
+// ToASCII converts the domain of an address to A-labels, keeping the address
+// as it is if it has no domain or it cannot be converted.
+func ToASCII(s string) string {
+	i := strings.LastIndexByte(s, '@')
+	if i < 0 || isASCII(s[i+1:]) {
+		return s
+	}
+	domain, err := DomainToASCII(s[i+1:])
+	if err != nil {
+		return s
+	}
+	return s[:i+1] + domain
+}
+
+// Quote returns an address with its local part quoted if it needs to be,
+// e.g. "\"john doe\"@example.com" for "john doe@example.com". go-smtp passes
+// envelope addresses with the local part unquoted. Valid addresses and
+// strings without a domain are returned as they are.
+func Quote(s string) string {
+	i := strings.LastIndexByte(s, '@')
+	if i <= 0 {
+		return s
+	}
+	if _, err := Parse(s); err == nil {
+		return s
+	}
+	return Address{Local: s[:i], Domain: s[i+1:]}.String()
+}
+
+// NeedsSMTPUTF8 reports whether an address can only be sent with the
+// SMTPUTF8 extension (RFC 6531): its local part is not ASCII. A UTF-8 domain
+// alone does not need it, as it can be sent as A-labels.
+func NeedsSMTPUTF8(s string) bool {
+	return !isASCII(ToASCII(s))
+}
+
+// split splits an address at the '@' after the local part and unquotes it.
+func split(s string) (local, domain string, err error) {
+	if strings.HasPrefix(s, `"`) {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; c {
+			case '\\':
+				i++
+				if i == len(s) {
+					return "", "", errors.New("unterminated quoted local part")
+				}
+				b.WriteByte(s[i])
+			case '"':
+				rest, ok := strings.CutPrefix(s[i+1:], "@")
+				if !ok {
+					return "", "", errors.New("missing domain")
+				}
+				return b.String(), rest, nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", "", errors.New("unterminated quoted local part")
+	}
+
+	i := strings.LastIndexByte(s, '@')
+	if i < 0 {
+		return "", "", errors.New("missing domain")
+	}
+	local, domain = s[:i], s[i+1:]
+	if !isDotAtom(local) {
+		return "", "", errors.New("invalid local part")
+	}
+	return local, domain, nil
+}
+
+func checkDomain(domain string) error {
+	if domain == "" {
+		return errors.New("missing domain")
+	}
+	if strings.HasPrefix(domain, "[") {
+		if !strings.HasSuffix(domain, "]") {
+			return errors.New("invalid address literal")
+		}
+		return nil
+	}
+	if !utf8.ValidString(domain) {
+		return errors.New("domain is not UTF-8")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if label == "" {
+			return errors.New("empty domain label")
+		}
+		if strings.ContainsAny(label, " @<>()[]\\,;:\"") {
+			return errors.New("invalid domain label")
+		}
+	}
+	return nil
+}
+
+// isDotAtom reports whether a local part needs no quoting: atoms of atext,
+// which includes UTF-8 (RFC 6531), separated by single dots.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= utf8.RuneSelf, c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-/=?^_`{|}~.", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
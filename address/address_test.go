@@ -0,0 +1,135 @@
+package address
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in            string
+		local, domain string
+		str           string
+	}{
+		{"alice@example.com", "alice", "example.com", "alice@example.com"},
+		{"<Alice@Example.com>", "Alice", "Example.com", "Alice@Example.com"},
+		{"first.last+tag@example.com", "first.last+tag", "example.com", "first.last+tag@example.com"},
+		{`"john doe"@example.com`, "john doe", "example.com", `"john doe"@example.com`},
+		{`"a\"b@c"@example.com`, `a"b@c`, "example.com", `"a\"b@c"@example.com`},
+		{"postmaster@[192.0.2.1]", "postmaster", "[192.0.2.1]", "postmaster@[192.0.2.1]"},
+		{"jörg@bücher.example", "jörg", "bücher.example", "jörg@bücher.example"},
+	}
+	for _, tt := range tests {
+		a, err := Parse(tt.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.in, err)
+		}
+		if a.Local != tt.local || a.Domain != tt.domain {
+			t.Errorf("Parse(%q) = %q, %q", tt.in, a.Local, a.Domain)
+		}
+		if got := a.String(); got != tt.str {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.in, got, tt.str)
+		}
+	}
+
+	for _, in := range []string{"", "<>", "alice", "alice@", "@example.com", ".alice@example.com",
+		"al..ice@example.com", "john doe@example.com", `"alice@example.com`, "alice@exa..mple.com", "alice@[192.0.2.1"} {
+		if _, err := Parse(in); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Parse(%q): expected ErrInvalid, got %v", in, err)
+		}
+	}
+}
+
+func TestAddress_Detail(t *testing.T) {
+	a, _ := Parse("user+tag+more@example.com")
+	user, detail, ok := a.Detail(DefaultDetailSeparator)
+	if !ok || user != "user" || detail != "tag+more" {
+		t.Errorf("unexpected detail %q %q %v", user, detail, ok)
+	}
+	if got := a.WithoutDetail("+").String(); got != "user@example.com" {
+		t.Errorf("unexpected address without detail %q", got)
+	}
+
+	// 没有子地址，或者以分隔符开头的本地部分
+	for _, in := range []string{"user@example.com", "+tag@example.com"} {
+		a, _ := Parse(in)
+		if _, _, ok := a.Detail("+"); ok {
+			t.Errorf("%q: expected no detail", in)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	if got := Key("Alice@Bücher.Example"); got != "alice@xn--bcher-kva.example" {
+		t.Errorf("unexpected key %q", got)
+	}
+	if !Equal("ALICE@xn--bcher-kva.example", "alice@BÜCHER.example") {
+		t.Error("expected equal addresses")
+	}
+	if Equal("alice@example.com", "alice@example.org") {
+		t.Error("expected different addresses")
+	}
+	if got := Domain("alice@example.com"); got != "example.com" {
+		t.Errorf("unexpected domain %q", got)
+	}
+	if got := LocalPart("alice@example.com"); got != "alice" {
+		t.Errorf("unexpected local part %q", got)
+	}
+	if got := ToASCII("anna@münchen.de"); got != "anna@xn--mnchen-3ya.de" {
+		t.Errorf("unexpected address %q", got)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"alice@example.com":      "alice@example.com",
+		"john doe@example.com":   `"john doe"@example.com`,
+		`"john doe"@example.com`: `"john doe"@example.com`,
+		`a"b@c@example.com`:      `"a\"b@c"@example.com`,
+		"postmaster":             "postmaster",
+	} {
+		if got := Quote(in); got != want {
+			t.Errorf("Quote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEAIFixtures(t *testing.T) {
+	data, err := os.ReadFile("testdata/eai.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 4 {
+			t.Fatalf("malformed fixture %q", line)
+		}
+		in, ascii, key, needs := f[0], f[1], f[2], f[3] == "true"
+		a, err := Parse(in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", in, err)
+			continue
+		}
+		// 解析后重新序列化不改变地址
+		if got := a.String(); got != in {
+			t.Errorf("Parse(%q).String() = %q", in, got)
+		}
+		if got := ToASCII(in); got != ascii {
+			t.Errorf("ToASCII(%q) = %q, want %q", in, got, ascii)
+		}
+		if got := Key(in); got != key {
+			t.Errorf("Key(%q) = %q, want %q", in, got, key)
+		}
+		if !Equal(in, ascii) {
+			t.Errorf("expected %q to equal %q", in, ascii)
+		}
+		if got := NeedsSMTPUTF8(in); got != needs {
+			t.Errorf("NeedsSMTPUTF8(%q) = %v, want %v", in, got, needs)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package address
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Internationalized domain names (IDN) have two forms: U-labels in Unicode,
+// e.g. "bücher.example", and A-labels in ASCII, e.g. "xn--bcher-kva.example",
+// encoded with Punycode (RFC 3492). Compare domains in either form with
+// NormalizeDomain or EqualDomains.
+
+// acePrefix marks an A-label.
+const acePrefix = "xn--"
+
+// Punycode parameters, RFC 3492 section 5.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errInvalidPunycode = errors.New("invalid punycode")
+
+// DomainToASCII converts the U-labels of a domain to A-labels. ASCII labels
+// are kept as they are. Unicode labels are lower-cased before encoding; no
+// further IDNA mapping is applied.
+func DomainToASCII(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+	// IDNA treats the ideographic full stops as label separators.
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if !utf8.ValidString(label) {
+			return "", fmt.Errorf("invalid domain %q: not UTF-8", domain)
+		}
+		enc, err := punycodeEncode(strings.ToLower(label))
+		if err != nil {
+			return "", fmt.Errorf("invalid domain %q: %w", domain, err)
+		}
+		if len(acePrefix)+len(enc) > 63 {
+			return "", fmt.Errorf("invalid domain %q: label too long", domain)
+		}
+		labels[i] = acePrefix + enc
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// DomainToUnicode converts the A-labels of a domain to U-labels, e.g. for
+// display. Labels that are not valid A-labels are kept as they are.
+func DomainToUnicode(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if len(label) <= len(acePrefix) || !strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			continue
+		}
+		if dec, err := punycodeDecode(strings.ToLower(label[len(acePrefix):])); err == nil {
+			labels[i] = dec
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// NormalizeDomain returns the canonical form of a domain for comparisons and
+// map keys: lower-case A-labels without a trailing dot. A domain that cannot
+// be converted is only lower-cased.
+func NormalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	if ascii, err := DomainToASCII(domain); err == nil {
+		domain = ascii
+	}
+	return strings.ToLower(domain)
+}
+
+// EqualDomains reports whether two domains are the same, in either form and
+// ignoring case.
+func EqualDomains(a, b string) bool {
+	return NormalizeDomain(a) == NormalizeDomain(b)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycodeEncode encodes a label as Punycode, without the ACE prefix.
+func punycodeEncode(label string) (string, error) {
+	input := []rune(label)
+	var out strings.Builder
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	b := out.Len()
+	h := b
+	if b > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h < len(input) {
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range input {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		if delta < 0 {
+			return "", errInvalidPunycode
+		}
+		n = m
+		for _, r := range input {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return out.String(), nil
+}
+
+// punycodeDecode decodes a Punycode label without the ACE prefix.
+func punycodeDecode(s string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(s, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if s[i] >= utf8.RuneSelf {
+				return "", errInvalidPunycode
+			}
+			output = append(output, rune(s[i]))
+		}
+		pos = b + 1
+	}
+
+	n, i, bias := rune(punyInitialN), 0, punyInitialBias
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", errInvalidPunycode
+			}
+			digit := punyDecodeDigit(s[pos])
+			pos++
+			if digit < 0 || digit > (1<<30-i)/w {
+				return "", errInvalidPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+			if w > 1<<30 {
+				return "", errInvalidPunycode
+			}
+		}
+		count := len(output) + 1
+		bias = punyAdapt(i-oldi, count, oldi == 0)
+		n += rune(i / count)
+		i %= count
+		if n > utf8.MaxRune || (n >= 0xd800 && n <= 0xdfff) {
+			return "", errInvalidPunycode
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+	return string(output), nil
+}
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	default:
+		return k - bias
+	}
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDecodeDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a')
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A')
+	default:
+		return -1
+	}
+}
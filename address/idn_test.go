@@ -0,0 +1,63 @@
+package address
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDomainToASCII(t *testing.T) {
+	tests := []struct {
+		unicode, ascii string
+	}{
+		{"example.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"Bücher.Example", "xn--bcher-kva.Example"},
+		{"münchen。de", "xn--mnchen-3ya.de"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+	}
+	for _, tt := range tests {
+		got, err := DomainToASCII(tt.unicode)
+		if err != nil {
+			t.Fatalf("DomainToASCII(%q): %v", tt.unicode, err)
+		}
+		if got != tt.ascii {
+			t.Errorf("DomainToASCII(%q) = %q, want %q", tt.unicode, got, tt.ascii)
+		}
+	}
+
+	// 标签超过 63 个字节
+	if _, err := DomainToASCII(strings.Repeat("ü", 64) + ".example"); err == nil {
+		t.Error("expected an error for a too long label")
+	}
+}
+
+func TestDomainToUnicode(t *testing.T) {
+	tests := []struct {
+		ascii, unicode string
+	}{
+		{"example.com", "example.com"},
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"XN--BCHER-KVA.example", "bücher.example"},
+		{"xn--r8jz45g.xn--zckzah", "例え.テスト"},
+		// 无效的 A-label 保持不变
+		{"xn--!!.example", "xn--!!.example"},
+	}
+	for _, tt := range tests {
+		if got := DomainToUnicode(tt.ascii); got != tt.unicode {
+			t.Errorf("DomainToUnicode(%q) = %q, want %q", tt.ascii, got, tt.unicode)
+		}
+	}
+}
+
+func TestEqualDomains(t *testing.T) {
+	if !EqualDomains("Bücher.example.", "xn--bcher-kva.EXAMPLE") {
+		t.Error("expected the U-label and A-label forms to be equal")
+	}
+	if EqualDomains("bucher.example", "bücher.example") {
+		t.Error("expected different domains")
+	}
+	if got := Normalize("Alice@Bücher.Example"); got != "Alice@xn--bcher-kva.example" {
+		t.Errorf("unexpected normalized address %q", got)
+	}
+}
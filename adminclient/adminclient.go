@@ -0,0 +1,119 @@
+// Package adminclient is a client of the debug endpoints of a Brisa server
+// meant for tools: the expvar variables and the operations under
+// /debug/ops/, as described by the OpenAPI document the server serves on
+// /debug/openapi.json.
+//
+// The operations are only served when the server configures debug.access,
+// and require a client with the operator role.
+package adminclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Error is returned for a response other than 200 OK.
+type Error struct {
+	StatusCode int
+	// Message is the reason given by the server.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client calls the debug endpoints of the server at BaseURL, e.g.
+// "https://127.0.0.1:6060".
+type Client struct {
+	BaseURL string
+	// Token is sent as a bearer token when set; see brisa.DebugAccess.
+	// Clients authenticating with a certificate set it in the TLS
+	// configuration of HTTPClient instead.
+	Token string
+	// HTTPClient sends the requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at baseURL authenticating with token.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token}
+}
+
+// Vars returns the expvar variables of the server, by name. The counters of
+// Brisa are under "brisa"; see brisa.ExpvarObserver.
+func (c *Client) Vars(ctx context.Context) (map[string]json.RawMessage, error) {
+	body, err := c.do(ctx, http.MethodGet, "/debug/vars", nil)
+	if err != nil {
+		return nil, err
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(body, &vars); err != nil {
+		return nil, fmt.Errorf("vars: %w", err)
+	}
+	return vars, nil
+}
+
+// Reload has the server reload its configuration, as on SIGHUP.
+func (c *Client) Reload(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodPost, "/debug/ops/reload", nil)
+	return err
+}
+
+// Purge removes the store keys holding data of the email address addr and
+// returns their number; see brisa.PurgeAddress.
+func (c *Client) Purge(ctx context.Context, addr string) (int, error) {
+	body, err := c.do(ctx, http.MethodPost, "/debug/ops/purge", url.Values{"address": {addr}})
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if _, err := fmt.Sscanf(string(body), "purged %d keys", &n); err != nil {
+		return 0, fmt.Errorf("purge: unexpected response %q", body)
+	}
+	return n, nil
+}
+
+// do sends a request to path, with form as its body if not nil, and returns
+// the body of the response.
+func (c *Client) do(ctx context.Context, method, path string, form url.Values) ([]byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	return data, nil
+}
@@ -0,0 +1,58 @@
+package adminclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	var reloads int
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"brisa": {"sessions_total": 2}}`)
+	})
+	mux.HandleFunc("POST /debug/ops/reload", func(w http.ResponseWriter, r *http.Request) {
+		reloads++
+		fmt.Fprintln(w, "reloaded")
+	})
+	mux.HandleFunc("POST /debug/ops/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("address") != "bob@example.com" {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "purged 3 keys")
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New(srv.URL+"/", "secret")
+	vars, err := c.Vars(ctx)
+	if err != nil || string(vars["brisa"]) != `{"sessions_total": 2}` {
+		t.Errorf("unexpected vars %q: %v", vars["brisa"], err)
+	}
+	if err := c.Reload(ctx); err != nil || reloads != 1 {
+		t.Errorf("expected a reload, got %d: %v", reloads, err)
+	}
+	if n, err := c.Purge(ctx, "bob@example.com"); err != nil || n != 3 {
+		t.Errorf("expected 3 keys purged, got %d: %v", n, err)
+	}
+
+	var apiErr *Error
+	if _, err := c.Purge(ctx, "bob"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Message != "invalid address" {
+		t.Errorf("expected a 400 error, got %v", err)
+	}
+	if err := New(srv.URL, "guess").Reload(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+}
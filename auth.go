@@ -0,0 +1,351 @@
+package brisa
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// ErrAuthFailed is returned for AUTH with invalid credentials (535).
+var ErrAuthFailed = &smtp.SMTPError{
+	Code:         535,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+	Message:      "Authentication credentials invalid",
+}
+
+// Authenticator checks the credentials of clients authenticating with AUTH
+// PLAIN or LOGIN. It returns nil for valid credentials; an *smtp.SMTPError is
+// sent to the client as is, other errors as ErrAuthFailed.
+type Authenticator interface {
+	Authenticate(ctx *Context, username, password string) error
+}
+
+// TokenAuthenticator is implemented by Authenticators that also accept OAuth
+// 2.0 bearer tokens, offered as AUTH OAUTHBEARER (RFC 7628) and XOAUTH2.
+// username is the user the client claims to be and may be empty.
+// AuthenticateToken returns the user the token was issued to, which becomes
+// the user name of the session, so that clients sending no authorization
+// identity are still known by name.
+type TokenAuthenticator interface {
+	Authenticator
+	AuthenticateToken(ctx *Context, username, token string) (string, error)
+}
+
+// SecretAuthenticator is implemented by Authenticators that can look up the
+// password of a user, as the challenge-response mechanisms CRAM-MD5 and
+// SCRAM-SHA-256 need: the client proves that it knows the password without
+// sending it. Secret returns an error for unknown users.
+type SecretAuthenticator interface {
+	Authenticator
+	Secret(ctx *Context, username string) (string, error)
+}
+
+// Names of the SASL mechanisms without a constant in go-sasl.
+const (
+	// XOAuth2 is the predecessor of OAUTHBEARER still used by many clients.
+	XOAuth2     = "XOAUTH2"
+	CramMD5     = "CRAM-MD5"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+// authMechanisms are the supported SASL mechanisms, in the order offered.
+var authMechanisms = []string{sasl.Plain, sasl.Login, CramMD5, ScramSHA256, sasl.OAuthBearer, XOAuth2}
+
+// ParseAuthMechanism returns the name of a supported SASL mechanism in upper
+// case, or an error if it is not supported.
+func ParseAuthMechanism(name string) (string, error) {
+	for _, mech := range authMechanisms {
+		if strings.EqualFold(name, mech) {
+			return mech, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported authentication mechanism: %s", name)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(ctx *Context, username, password string) error
+
+// Authenticate implements Authenticator.
+func (f AuthenticatorFunc) Authenticate(ctx *Context, username, password string) error {
+	return f(ctx, username, password)
+}
+
+// AuthInfo describes the latest AUTH attempt of a session.
+type AuthInfo struct {
+	Mechanism string
+	Username  string
+	// Err is the reason the credentials were refused, or nil if they were
+	// accepted.
+	Err error
+}
+
+// SetAuthenticator makes new sessions offer AUTH PLAIN and LOGIN, checking
+// the credentials with a, CRAM-MD5 and SCRAM-SHA-256 if a is a
+// SecretAuthenticator, and OAUTHBEARER and XOAUTH2 if a is a
+// TokenAuthenticator. nil disables AUTH. go-smtp only offers AUTH over
+// TLS unless the server allows insecure authentication.
+//
+// After each attempt the auth chain runs, with the attempt in Context.Auth,
+// and can refuse it. A successful authentication sets FlagAuthenticated.
+func (b *Brisa) SetAuthenticator(a Authenticator) {
+	if a == nil {
+		b.authenticator.Store(nil)
+		return
+	}
+	b.authenticator.Store(&a)
+}
+
+// SetAuthMechanisms restricts the SASL mechanisms offered to new sessions of
+// the listener with the given name (see Listener), e.g. to offer only
+// SCRAM-SHA-256 on a port without TLS. Mechanisms the authenticator does not
+// support are not offered either way. nil offers all mechanisms the
+// authenticator supports again.
+func (b *Brisa) SetAuthMechanisms(listener string, mechs []string) {
+	b.listenerMu.Lock()
+	defer b.listenerMu.Unlock()
+	all := make(map[string][]string)
+	if old := b.listenerMechs.Load(); old != nil {
+		maps.Copy(all, *old)
+	}
+	if mechs == nil {
+		delete(all, listener)
+	} else {
+		all[listener] = slices.Clone(mechs)
+	}
+	b.listenerMechs.Store(&all)
+}
+
+// authMechanismsFor returns the mechanisms allowed on listener, or nil if
+// all are.
+func (b *Brisa) authMechanismsFor(listener string) []string {
+	if all := b.listenerMechs.Load(); all != nil {
+		return (*all)[listener]
+	}
+	return nil
+}
+
+// AuthMechanisms implements smtp.AuthSession.
+func (s *Session) AuthMechanisms() []string {
+	if s.authenticator == nil {
+		return nil
+	}
+	_, secret := s.authenticator.(SecretAuthenticator)
+	_, token := s.authenticator.(TokenAuthenticator)
+	var mechs []string
+	for _, mech := range authMechanisms {
+		switch {
+		case (mech == CramMD5 || mech == ScramSHA256) && !secret,
+			(mech == sasl.OAuthBearer || mech == XOAuth2) && !token,
+			s.allowedMechs != nil && !slices.Contains(s.allowedMechs, mech):
+			continue
+		}
+		mechs = append(mechs, mech)
+	}
+	return mechs
+}
+
+// Auth implements smtp.AuthSession.
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if err := s.command("AUTH"); err != nil {
+		return nil, err
+	}
+	if s.authenticator == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	if !slices.Contains(s.AuthMechanisms(), mech) {
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return s.finishAuth(mech, username, errors.New("authorization identity differs from user name"))
+			}
+			return s.finishAuth(mech, username, s.authenticator.Authenticate(s.ctx, username, password))
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: func(username, password string) error {
+			return s.finishAuth(mech, username, s.authenticator.Authenticate(s.ctx, username, password))
+		}}, nil
+	case CramMD5, ScramSHA256:
+		sa := s.authenticator.(SecretAuthenticator)
+		secret := func(username string) (string, error) { return sa.Secret(s.ctx, username) }
+		finish := func(username string, err error) error { return s.finishAuth(mech, username, err) }
+		if mech == CramMD5 {
+			return newCramMD5Server(s.domain(), secret, finish), nil
+		}
+		return newScramServer(secret, finish), nil
+	case sasl.OAuthBearer, XOAuth2:
+		ta := s.authenticator.(TokenAuthenticator)
+		parse := parseOAuthBearer
+		if mech == XOAuth2 {
+			parse = parseXOAuth2
+		}
+		return &bearerServer{parse: parse, authenticate: func(username, token string) error {
+			subject, err := ta.AuthenticateToken(s.ctx, username, token)
+			if err == nil && subject != "" {
+				username = subject
+			}
+			return s.finishAuth(mech, username, err)
+		}}, nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// finishAuth records an AUTH attempt with the result err of the credential
+// check, runs the auth chain and returns the reply to the attempt.
+func (s *Session) finishAuth(mech, username string, err error) (reply error) {
+	defer func() { reply = s.refused(reply) }()
+	s.ctx.auth = AuthInfo{Mechanism: mech, Username: username, Err: err}
+	logger := s.ctx.Logger.With("mechanism", mech, "username", username)
+	if err != nil {
+		logger.Info("authentication failed", "error", err)
+	}
+
+	action := s.ctx.Action
+	s.ctx.Action = Pass
+	chainErr := s.execute(chainAuth)
+	s.ctx.Action = action
+	if chainErr != nil {
+		if err == nil {
+			logger.Info("authentication refused by policy")
+		}
+		s.ctx.auth.Err = chainErr
+		return chainErr
+	}
+	if err != nil {
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return smtpErr
+		}
+		return ErrAuthFailed
+	}
+
+	s.ctx.SetFlag(FlagAuthenticated)
+	logger.Info("authentication succeeded")
+	return nil
+}
+
+// Auth returns the latest AUTH attempt of the session.
+func (c *Context) Auth() AuthInfo {
+	return c.auth
+}
+
+// loginServer is the server side of the LOGIN mechanism, which go-sasl only
+// implements as a client.
+type loginServer struct {
+	step         int
+	username     string
+	authenticate func(username, password string) error
+}
+
+// Next implements sasl.Server. The client may send the user name as its
+// initial response.
+func (l *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch {
+	case l.step == 0 && len(response) == 0:
+		l.step = 1
+		return []byte("Username:"), false, nil
+	case l.step <= 1:
+		l.username = string(response)
+		l.step = 2
+		return []byte("Password:"), false, nil
+	case l.step == 2:
+		l.step = 3
+		return nil, true, l.authenticate(l.username, string(response))
+	}
+	return nil, false, sasl.ErrUnexpectedClientResponse
+}
+
+// bearerErrorChallenge is the challenge reporting a refused token, after
+// which the client sends a dummy response (RFC 7628, section 3.2.2).
+var bearerErrorChallenge = []byte(`{"status":"invalid_token","schemes":"bearer"}`)
+
+// bearerServer is the server side of the OAUTHBEARER and XOAUTH2 mechanisms.
+type bearerServer struct {
+	parse        func(response []byte) (username, token string, err error)
+	authenticate func(username, token string) error
+	started      bool
+	failErr      error
+}
+
+// Next implements sasl.Server.
+func (b *bearerServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if b.failErr != nil {
+		return nil, true, b.failErr
+	}
+	if !b.started && response == nil {
+		b.started = true
+		return []byte{}, false, nil
+	}
+	if b.started && response == nil {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+	b.started = true
+	username, token, err := b.parse(response)
+	if err != nil {
+		return nil, true, err
+	}
+	if err := b.authenticate(username, token); err != nil {
+		b.failErr = err
+		return bearerErrorChallenge, false, nil
+	}
+	return nil, true, nil
+}
+
+// parseOAuthBearer parses an OAUTHBEARER response,
+// "n,a=user,\x01host=...\x01auth=Bearer token\x01\x01".
+func parseOAuthBearer(response []byte) (username, token string, err error) {
+	gs2, params, ok := strings.Cut(string(response), "\x01")
+	flag, authzid, ok2 := strings.Cut(gs2, ",")
+	if !ok || !ok2 || flag != "n" {
+		return "", "", errInvalidBearerResponse
+	}
+	if authzid = strings.TrimSuffix(authzid, ","); authzid != "" {
+		user, found := strings.CutPrefix(authzid, "a=")
+		if !found {
+			return "", "", errInvalidBearerResponse
+		}
+		username = user
+	}
+	token, err = bearerToken(params)
+	return username, token, err
+}
+
+// parseXOAuth2 parses an XOAUTH2 response,
+// "user=someone\x01auth=Bearer token\x01\x01".
+func parseXOAuth2(response []byte) (username, token string, err error) {
+	for _, p := range strings.Split(string(response), "\x01") {
+		if user, ok := strings.CutPrefix(p, "user="); ok {
+			username = user
+		}
+	}
+	token, err = bearerToken(string(response))
+	return username, token, err
+}
+
+// bearerToken returns the token of the auth parameter of the key/value
+// pairs separated by \x01.
+func bearerToken(params string) (string, error) {
+	for _, p := range strings.Split(params, "\x01") {
+		if value, ok := strings.CutPrefix(p, "auth="); ok {
+			scheme, token, ok := strings.Cut(value, " ")
+			if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+				return "", errInvalidBearerResponse
+			}
+			return token, nil
+		}
+	}
+	return "", errInvalidBearerResponse
+}
+
+var errInvalidBearerResponse = &smtp.SMTPError{
+	Code:         501,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+	Message:      "Invalid bearer token response",
+}
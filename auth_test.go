@@ -0,0 +1,332 @@
+package brisa
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+func newAuthBrisa(router *Router) *Brisa {
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(router)
+	b.SetAuthenticator(AuthenticatorFunc(func(ctx *Context, username, password string) error {
+		if username == "alice" && password == "secret" {
+			return nil
+		}
+		return ErrAuthFailed
+	}))
+	return b
+}
+
+func TestBrisa_Auth(t *testing.T) {
+	var attempts []AuthInfo
+	router := Router{}
+	router.OnAuth(&Middleware{Handler: func(ctx *Context) Action {
+		attempts = append(attempts, ctx.Auth())
+		if ctx.Auth().Username == "mallory" {
+			return Reject
+		}
+		return Pass
+	}})
+	router.OnMailFrom(&Middleware{Handler: func(ctx *Context) Action {
+		if !ctx.HasFlag(FlagAuthenticated) || ctx.Auth().Username != "alice" {
+			return Reject
+		}
+		return Pass
+	}})
+	b := newAuthBrisa(&router)
+
+	env := Envelope{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")},
+		Username:   "alice",
+		Password:   "secret",
+		From:       "alice@example.com",
+		To:         []string{"bob@example.com"},
+	}
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Err != nil {
+		t.Fatalf("expected authenticated delivery, got %+v", res)
+	}
+
+	env.Password = "wrong"
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != ChainAuth || res.Err != ErrAuthFailed {
+		t.Errorf("expected ErrAuthFailed, got %+v", res)
+	}
+	if len(attempts) != 2 || attempts[1].Err == nil || attempts[1].Mechanism != sasl.Plain {
+		t.Errorf("expected the auth chain to see both attempts, got %+v", attempts)
+	}
+
+	// auth 链可以拒绝凭据有效的认证。
+	env.Username = "mallory"
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != ChainAuth || res.Err != ErrRejectedByPolicy {
+		t.Errorf("expected the auth chain to refuse, got %+v", res)
+	}
+
+	// 未认证的客户端被 mail_from 链拒绝。
+	env.Username = ""
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != ChainMailFrom {
+		t.Errorf("expected rejection without AUTH, got %+v", res)
+	}
+}
+
+func TestSession_AuthLogin(t *testing.T) {
+	b := newAuthBrisa(&Router{})
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	ctx.Logger = b.logger
+	s := NewDetachedSession(ctx, nil)
+	if mechs := s.AuthMechanisms(); mechs != nil {
+		t.Errorf("expected no mechanisms without an authenticator, got %v", mechs)
+	}
+	s.authenticator = *b.authenticator.Load()
+	if mechs := s.AuthMechanisms(); len(mechs) != 2 {
+		t.Errorf("expected PLAIN and LOGIN, got %v", mechs)
+	}
+
+	server, err := s.Auth(sasl.Login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct{ response, challenge string }{{"", "Username:"}, {"alice", "Password:"}} {
+		challenge, done, err := server.Next([]byte(step.response))
+		if err != nil || done || string(challenge) != step.challenge {
+			t.Fatalf("expected challenge %q, got %q, %v, %v", step.challenge, challenge, done, err)
+		}
+	}
+	if _, done, err := server.Next([]byte("secret")); !done || err != nil {
+		t.Fatalf("expected LOGIN to succeed, got %v, %v", done, err)
+	}
+	if !ctx.HasFlag(FlagAuthenticated) {
+		t.Error("expected FlagAuthenticated")
+	}
+
+	if _, err := s.Auth("CRAM-MD5"); err != smtp.ErrAuthUnknownMechanism {
+		t.Errorf("expected ErrAuthUnknownMechanism, got %v", err)
+	}
+}
+
+// tokenAuthenticator 只接受令牌 "valid"，且令牌属于 alice。
+type tokenAuthenticator struct{ AuthenticatorFunc }
+
+func (tokenAuthenticator) AuthenticateToken(ctx *Context, username, token string) (string, error) {
+	if token == "valid" && (username == "" || username == "alice") {
+		return "alice", nil
+	}
+	return "", ErrAuthFailed
+}
+
+func TestSession_AuthBearer(t *testing.T) {
+	b := newAuthBrisa(&Router{})
+	b.SetAuthenticator(tokenAuthenticator{})
+	newSession := func() *Session {
+		ctx := NewContext()
+		t.Cleanup(func() { FreeContext(ctx) })
+		ctx.Logger = b.logger
+		s := NewDetachedSession(ctx, nil)
+		s.authenticator = *b.authenticator.Load()
+		return s
+	}
+	if mechs := newSession().AuthMechanisms(); len(mechs) != 4 || mechs[2] != sasl.OAuthBearer || mechs[3] != XOAuth2 {
+		t.Errorf("expected the token mechanisms, got %v", mechs)
+	}
+
+	tests := []struct {
+		mech, response string
+		ok             bool
+	}{
+		{sasl.OAuthBearer, "n,a=alice,\x01host=mx.example.com\x01port=587\x01auth=Bearer valid\x01\x01", true},
+		{sasl.OAuthBearer, "n,,\x01auth=Bearer valid\x01\x01", true},
+		{sasl.OAuthBearer, "n,a=mallory,\x01auth=Bearer valid\x01\x01", false},
+		{XOAuth2, "user=alice\x01auth=Bearer valid\x01\x01", true},
+		{XOAuth2, "user=alice\x01auth=Bearer expired\x01\x01", false},
+	}
+	for _, tt := range tests {
+		s := newSession()
+		server, err := s.Auth(tt.mech)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 没有初始响应时，服务器先发送空挑战。
+		if challenge, done, err := server.Next(nil); err != nil || done || len(challenge) != 0 {
+			t.Fatalf("expected an empty challenge, got %q, %v, %v", challenge, done, err)
+		}
+		challenge, done, err := server.Next([]byte(tt.response))
+		if tt.ok {
+			if !done || err != nil || !s.ctx.HasFlag(FlagAuthenticated) {
+				t.Errorf("%s %q: expected success, got %v, %v", tt.mech, tt.response, done, err)
+			}
+			// 没有授权身份时，用户名取自令牌。
+			if got := s.ctx.Auth().Username; got != "alice" {
+				t.Errorf("%s %q: expected user alice, got %q", tt.mech, tt.response, got)
+			}
+			continue
+		}
+		// 失败时先发送错误挑战，客户端的哑响应之后返回错误。
+		if done || err != nil || string(challenge) != string(bearerErrorChallenge) {
+			t.Fatalf("%s %q: expected the error challenge, got %q, %v, %v", tt.mech, tt.response, challenge, done, err)
+		}
+		if _, done, err := server.Next([]byte("\x01")); !done || err != ErrAuthFailed {
+			t.Errorf("%s %q: expected ErrAuthFailed, got %v, %v", tt.mech, tt.response, done, err)
+		}
+		if s.ctx.HasFlag(FlagAuthenticated) || s.ctx.Auth().Mechanism != tt.mech {
+			t.Errorf("%s %q: unexpected auth state %+v", tt.mech, tt.response, s.ctx.Auth())
+		}
+	}
+
+	server, _ := newSession().Auth(sasl.OAuthBearer)
+	if _, _, err := server.Next([]byte("n,,\x01auth=Basic abc\x01\x01")); err != errInvalidBearerResponse {
+		t.Errorf("expected errInvalidBearerResponse, got %v", err)
+	}
+}
+
+// secretAuthenticator 知道 alice 的密码。
+type secretAuthenticator struct{ AuthenticatorFunc }
+
+func (secretAuthenticator) Secret(ctx *Context, username string) (string, error) {
+	if username == "alice" {
+		return "secret", nil
+	}
+	return "", errors.New("unknown user")
+}
+
+func newSecretSession(t *testing.T, b *Brisa, listener string) *Session {
+	t.Helper()
+	ctx := NewContext()
+	t.Cleanup(func() { FreeContext(ctx) })
+	ctx.Logger = b.logger
+	s := NewDetachedSessionWith(ctx, Envelope{Listener: listener})
+	s.authenticator = *b.authenticator.Load()
+	s.allowedMechs = b.authMechanismsFor(listener)
+	return s
+}
+
+func TestSession_AuthCramMD5(t *testing.T) {
+	b := newAuthBrisa(&Router{})
+	b.SetAuthenticator(secretAuthenticator{})
+
+	for _, tt := range []struct {
+		username, password string
+		ok                 bool
+	}{{"alice", "secret", true}, {"alice", "wrong", false}, {"bob", "secret", false}} {
+		s := newSecretSession(t, b, "")
+		server, err := s.Auth(CramMD5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge, done, err := server.Next(nil)
+		if err != nil || done || !strings.HasPrefix(string(challenge), "<") {
+			t.Fatalf("expected a challenge, got %q, %v, %v", challenge, done, err)
+		}
+		mac := hmac.New(md5.New, []byte(tt.password))
+		mac.Write(challenge)
+		_, done, err = server.Next([]byte(tt.username + " " + hex.EncodeToString(mac.Sum(nil))))
+		if !done || (err == nil) != tt.ok || s.ctx.HasFlag(FlagAuthenticated) != tt.ok {
+			t.Errorf("%s/%s: expected success %v, got %v", tt.username, tt.password, tt.ok, err)
+		}
+	}
+}
+
+// scramClient 按 RFC 5802 计算客户端消息。
+func scramClient(t *testing.T, server sasl.Server, username, password string) error {
+	t.Helper()
+	clientFirstBare := "n=" + username + ",r=clientnonce"
+	serverFirst, done, err := server.Next([]byte("n,," + clientFirstBare))
+	if err != nil || done {
+		t.Fatalf("expected server-first-message, got %q, %v, %v", serverFirst, done, err)
+	}
+	attrs := scramAttributes(string(serverFirst))
+	if !strings.HasPrefix(attrs["r"], "clientnonce") || attrs["i"] != "4096" {
+		t.Fatalf("unexpected server-first-message %q", serverFirst)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	salted, _ := pbkdf2.Key(sha256.New, password, salt, 4096, sha256.Size)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := []byte(clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverFinal, done, err := server.Next([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	want := "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(hmacSHA256(salted, []byte("Server Key")), authMessage))
+	if done || string(serverFinal) != want {
+		t.Fatalf("expected server-final-message %q, got %q, %v", want, serverFinal, done)
+	}
+	if _, done, err := server.Next([]byte{}); !done || err != nil {
+		t.Fatalf("expected the exchange to end, got %v, %v", done, err)
+	}
+	return nil
+}
+
+func TestSession_AuthScram(t *testing.T) {
+	b := newAuthBrisa(&Router{})
+	b.SetAuthenticator(secretAuthenticator{})
+
+	s := newSecretSession(t, b, "")
+	server, _ := s.Auth(ScramSHA256)
+	if err := scramClient(t, server, "alice", "secret"); err != nil || !s.ctx.HasFlag(FlagAuthenticated) {
+		t.Fatalf("expected SCRAM-SHA-256 to succeed, got %v", err)
+	}
+
+	for _, user := range []struct{ name, password string }{{"alice", "wrong"}, {"bob", "secret"}} {
+		s := newSecretSession(t, b, "")
+		server, _ := s.Auth(ScramSHA256)
+		if err := scramClient(t, server, user.name, user.password); err != ErrAuthFailed || s.ctx.HasFlag(FlagAuthenticated) {
+			t.Errorf("%s/%s: expected ErrAuthFailed, got %v", user.name, user.password, err)
+		}
+	}
+
+	// 不支持通道绑定。
+	server, _ = newSecretSession(t, b, "").Auth(ScramSHA256)
+	if _, _, err := server.Next([]byte("p=tls-unique,,n=alice,r=abc")); err != errInvalidSASLResponse {
+		t.Errorf("expected errInvalidSASLResponse, got %v", err)
+	}
+}
+
+func TestBrisa_SetAuthMechanisms(t *testing.T) {
+	b := newAuthBrisa(&Router{})
+	b.SetAuthenticator(secretAuthenticator{AuthenticatorFunc(func(ctx *Context, username, password string) error {
+		return nil
+	})})
+	if mechs := newSecretSession(t, b, "").AuthMechanisms(); !slices.Equal(mechs, []string{sasl.Plain, sasl.Login, CramMD5, ScramSHA256}) {
+		t.Errorf("expected the password mechanisms, got %v", mechs)
+	}
+
+	// 令牌机制不受支持，即使被允许也不提供。
+	b.SetAuthMechanisms("submission", []string{ScramSHA256, XOAuth2})
+	s := newSecretSession(t, b, "submission")
+	if mechs := s.AuthMechanisms(); !slices.Equal(mechs, []string{ScramSHA256}) {
+		t.Errorf("expected only SCRAM-SHA-256, got %v", mechs)
+	}
+	if _, err := s.Auth(sasl.Plain); err != smtp.ErrAuthUnknownMechanism {
+		t.Errorf("expected PLAIN to be refused, got %v", err)
+	}
+	env := Envelope{Listener: "submission", Username: "alice", Password: "secret", From: "alice@example.com", To: []string{"bob@example.com"}}
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != ChainAuth {
+		t.Errorf("expected the simulated AUTH PLAIN to be refused, got %+v", res)
+	}
+
+	if mechs := newSecretSession(t, b, "").AuthMechanisms(); len(mechs) != 4 {
+		t.Errorf("expected other listeners to keep all mechanisms, got %v", mechs)
+	}
+	b.SetAuthMechanisms("submission", nil)
+	if mechs := newSecretSession(t, b, "submission").AuthMechanisms(); len(mechs) != 4 {
+		t.Errorf("expected all mechanisms again, got %v", mechs)
+	}
+}
@@ -0,0 +1,98 @@
+package brisa
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultBusyRetryAfter is the default delay DataGateConfig suggests to
+// clients refused while the server is busy.
+const DefaultBusyRetryAfter = time.Minute
+
+// ErrServerBusy is the reply to DATA while the data gate is saturated. The
+// reply of a gate names its retry delay; see DataGateConfig.RetryAfter.
+var ErrServerBusy = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Server busy, please try again later",
+}
+
+// DataGateConfig bounds the messages processed at once, so that a burst of
+// large messages cannot exhaust memory and CPU for everyone. A message holds
+// a slot from DATA until its data chain and disposition are done; without a
+// free slot, it is refused with a temporary 451 and the client retries
+// later.
+type DataGateConfig struct {
+	// MaxConcurrent is the number of messages processed at once. Zero
+	// disables the gate.
+	MaxConcurrent int
+	// MaxWait is how long a message waits for a free slot before it is
+	// refused. Zero refuses it at once.
+	MaxWait time.Duration
+	// RetryAfter is the delay suggested to refused clients in the reply.
+	// Defaults to DefaultBusyRetryAfter.
+	RetryAfter time.Duration
+}
+
+// dataGate hands out the slots of a DataGateConfig.
+type dataGate struct {
+	slots   chan struct{}
+	wait    time.Duration
+	reply   *smtp.SMTPError
+	refused atomic.Int64
+}
+
+// SetDataGate sets the gate of the messages of new sessions. Sessions keep
+// the gate they started with.
+func (b *Brisa) SetDataGate(cfg DataGateConfig) {
+	if cfg.MaxConcurrent <= 0 {
+		b.dataGate.Store(nil)
+		return
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = DefaultBusyRetryAfter
+	}
+	reply := *ErrServerBusy
+	reply.Message = fmt.Sprintf("Server busy, please try again in %d seconds", int64(cfg.RetryAfter.Round(time.Second)/time.Second))
+	b.dataGate.Store(&dataGate{
+		slots: make(chan struct{}, cfg.MaxConcurrent),
+		wait:  cfg.MaxWait,
+		reply: &reply,
+	})
+}
+
+// BusyRefusals returns the number of messages the current data gate refused.
+func (b *Brisa) BusyRefusals() int64 {
+	if g := b.dataGate.Load(); g != nil {
+		return g.refused.Load()
+	}
+	return 0
+}
+
+// acquire takes a slot, waiting up to the configured time, and reports
+// whether it got one.
+func (g *dataGate) acquire() bool {
+	select {
+	case g.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if g.wait > 0 {
+		timer := time.NewTimer(g.wait)
+		defer timer.Stop()
+		select {
+		case g.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+	g.refused.Add(1)
+	return false
+}
+
+func (g *dataGate) release() {
+	<-g.slots
+}
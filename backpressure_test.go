@@ -0,0 +1,75 @@
+package brisa
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestDataGate(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	router := Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		if ctx.From == "slow@example.com" {
+			entered <- struct{}{}
+			<-release
+		}
+		return Pass
+	}})
+	b := New(nil)
+	b.UpdateRouter(&router)
+	b.SetDataGate(DataGateConfig{MaxConcurrent: 1, MaxWait: 200 * time.Millisecond, RetryAfter: 2 * time.Minute})
+
+	send := func(from string) error {
+		s := newPostQueueSession(b)
+		s.dataGate = b.dataGate.Load()
+		defer s.Logout()
+		if err := s.Mail(from, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Rcpt("bob@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		return s.Data(strings.NewReader("\r\nhello\r\n"))
+	}
+
+	done := make(chan error)
+	go func() { done <- send("slow@example.com") }()
+	<-entered
+
+	// 槽位被占用时，等待 MaxWait 后以 451 拒绝
+	start := time.Now()
+	err := send("alice@example.com")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.Message != "Server busy, please try again in 120 seconds" {
+		t.Fatalf("expected the busy reply, got %v", err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("expected the message to wait for a slot")
+	}
+	if n := b.BusyRefusals(); n != 1 {
+		t.Errorf("expected 1 refusal, got %d", n)
+	}
+
+	// 槽位释放后，等待中的邮件被处理
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	if err := send("alice@example.com"); err != nil {
+		t.Errorf("expected the waiting message to be accepted, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected the slow message to be accepted, got %v", err)
+	}
+
+	// 关闭后不再限制
+	b.SetDataGate(DataGateConfig{})
+	if b.dataGate.Load() != nil || b.BusyRefusals() != 0 {
+		t.Error("expected the gate to be disabled")
+	}
+}
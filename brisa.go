@@ -1,15 +1,20 @@
 package brisa
 
 import (
+	"crypto/x509"
 	"errors"
 	"io"
 	"log/slog"
+	"maps"
 	"net"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
+	"github.com/muzhy/brisa/address"
 )
 
 // ChainType defines the type for middleware chain names, providing type safety.
@@ -20,11 +25,17 @@ const (
 	ChainMailFrom ChainType = "mail_from"
 	ChainRcptTo   ChainType = "rcpt_to"
 	ChainData     ChainType = "data"
+	// ChainAuth runs after each AUTH attempt; see Brisa.SetAuthenticator.
+	ChainAuth ChainType = "auth"
 	// Deliver Quarantine Reject 用于定义确定Action之后要执行的动作
 	ChainDeliver    ChainType = "deliver"
 	ChainQuarantine ChainType = "quarantine"
 	ChainReject     ChainType = "reject"
 	ChainDiscard    ChainType = "discard"
+	// ChainPostQueue runs after a message has been accepted, outside the SMTP
+	// transaction, for heavy scans; see Brisa.StartPostQueue. Its final action
+	// selects the disposition chain, so delivery happens in this stage too.
+	ChainPostQueue ChainType = "post_queue"
 )
 
 // Router holds all named middleware chains for the Brisa server.
@@ -57,11 +68,21 @@ func (r *Router) OnRcptTo(m ...*Middleware) *Router {
 	return r.Use(ChainRcptTo, m...)
 }
 
+// OnAuth adds one or more middlewares to the Auth chain.
+func (r *Router) OnAuth(m ...*Middleware) *Router {
+	return r.Use(ChainAuth, m...)
+}
+
 // OnData adds a middleware to the Data chain.
 func (r *Router) OnData(m ...*Middleware) *Router {
 	return r.Use(ChainData, m...)
 }
 
+// OnPostQueue adds one or more middlewares to the PostQueue chain.
+func (r *Router) OnPostQueue(m ...*Middleware) *Router {
+	return r.Use(ChainPostQueue, m...)
+}
+
 // OnDeliver adds one or more middlewares to the Deliver chain.
 func (r *Router) OnDeliver(m ...*Middleware) *Router {
 	return r.Use(ChainDeliver, m...)
@@ -97,14 +118,82 @@ func (r *Router) Clone() *Router {
 	return &newRouter
 }
 
+// chainIndex is the position of a chain in a compiledRouter.
+type chainIndex int
+
+const (
+	chainConn chainIndex = iota
+	chainMailFrom
+	chainRcptTo
+	chainData
+	chainDeliver
+	chainQuarantine
+	chainReject
+	chainDiscard
+	chainPostQueue
+	chainAuth
+	numChains
+)
+
+// chainTypes are the chain names by chainIndex.
+var chainTypes = [numChains]ChainType{
+	ChainConn, ChainMailFrom, ChainRcptTo, ChainData,
+	ChainDeliver, ChainQuarantine, ChainReject, ChainDiscard,
+	ChainPostQueue, ChainAuth,
+}
+
+// compiledRouter is a Router prepared for execution: its chains are indexed by
+// position, so running a command needs no map lookup.
+type compiledRouter struct {
+	// router is the copy of the Router the chains were compiled from.
+	router *Router
+	chains [numChains]MiddlewareChain
+}
+
+// compileRouter compiles a deep copy of r. Chains with names other than the
+// ChainType constants are never executed and are dropped.
+func compileRouter(r *Router) *compiledRouter {
+	c := &compiledRouter{router: r.Clone()}
+	for i, t := range chainTypes {
+		c.chains[i] = (*c.router)[t]
+	}
+	return c
+}
+
 // Brisa implements SMTP server methods.
 type Brisa struct {
-	router    atomic.Pointer[Router]
-	logger    *slog.Logger
-	observers []Observer
+	router        atomic.Pointer[compiledRouter]
+	logger        *slog.Logger
+	observers     []Observer
+	events        *EventBus
+	rejectMessage atomic.Pointer[ReplyTemplate]
+	deferReject   atomic.Bool
+	limits        atomic.Pointer[ProtocolLimits]
+	postQueue     atomic.Pointer[postQueue]
+	hooks         atomic.Pointer[hookPool]
+	dataGate      atomic.Pointer[dataGate]
+	spools        spoolBudget
+	authenticator atomic.Pointer[Authenticator]
+	// listenerRouters replaces the router for the sessions of some listeners.
+	// The map is replaced, never modified; listenerMu serializes writers.
+	listenerRouters atomic.Pointer[map[string]*compiledRouter]
+	// listenerMechs restricts the AUTH mechanisms of some listeners, like
+	// listenerRouters.
+	listenerMechs atomic.Pointer[map[string][]string]
+	listenerMu    sync.Mutex
+	// tenants select the router of transactions by recipient domain.
+	tenants atomic.Pointer[tenantTable]
+	// hellos holds the ClientHellos recorded by FingerprintTLS until the
+	// sessions of their connections pick them up.
+	hellos sync.Map
 }
 
 // New creates a new Brisa instance with an initial logger and optional observers.
+//
+// Session and mail IDs are drawn from github.com/google/uuid. Programs that
+// do not otherwise depend on uuid reading the system random source for each
+// ID may call uuid.EnableRandPool once at startup to save that read; New
+// leaves this process-wide setting to them.
 func New(logger *slog.Logger, observers ...Observer) *Brisa {
 	if logger == nil {
 		logger = slog.Default()
@@ -113,9 +202,10 @@ func New(logger *slog.Logger, observers ...Observer) *Brisa {
 	b := &Brisa{
 		logger:    logger,
 		observers: observers,
+		events:    NewEventBus(logger),
 	}
 	// Initialize with empty chains.
-	b.router.Store(&Router{})
+	b.router.Store(compileRouter(&Router{}))
 
 	return b
 }
@@ -126,87 +216,400 @@ func New(logger *slog.Logger, observers ...Observer) *Brisa {
 // completely independent deep copy. This prevents race conditions where the
 // caller might modify the router or its middleware chains after application.
 func (b *Brisa) UpdateRouter(router *Router) {
-	// Atomically store a deep copy of the router.
-	b.router.Store(router.Clone())
+	// Atomically store a compiled deep copy of the router.
+	b.router.Store(compileRouter(router))
 	b.logger.Info("Middleware chains updated")
 }
 
+// UpdateListenerRouter atomically replaces the middleware chains of the
+// sessions of the listener with the given name (see Listener), so that e.g.
+// the MX and the submission port get different policies. A nil router makes
+// the listener use the router set with UpdateRouter again.
+func (b *Brisa) UpdateListenerRouter(listener string, router *Router) {
+	b.listenerMu.Lock()
+	defer b.listenerMu.Unlock()
+	routers := make(map[string]*compiledRouter)
+	if old := b.listenerRouters.Load(); old != nil {
+		maps.Copy(routers, *old)
+	}
+	if router == nil {
+		delete(routers, listener)
+	} else {
+		routers[listener] = compileRouter(router)
+	}
+	b.listenerRouters.Store(&routers)
+	b.logger.Info("Middleware chains updated", "listener", listener)
+}
+
+// routerFor returns the router for the sessions of listener.
+func (b *Brisa) routerFor(listener string) *compiledRouter {
+	if routers := b.listenerRouters.Load(); routers != nil {
+		if r, ok := (*routers)[listener]; ok {
+			return r
+		}
+	}
+	return b.router.Load()
+}
+
+// Listener returns a backend for an smtp.Server serving the listener with
+// the given name. Its sessions report the name in Session.Listener and run
+// the router set for it with UpdateListenerRouter, if any. Sessions of Brisa
+// itself as a backend have an empty listener name.
+func (b *Brisa) Listener(name string) smtp.Backend {
+	return listenerBackend{b: b, name: name}
+}
+
+type listenerBackend struct {
+	b    *Brisa
+	name string
+}
+
+// NewSession implements smtp.Backend.
+func (l listenerBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return l.b.newSession(c, l.name)
+}
+
+// SetRejectMessage sets the template of the text of ErrRejectedByPolicy, the
+// reply to commands rejected without RejectWith, for new sessions. Middleware
+// can have their own template in Middleware.RejectMessage. nil restores the
+// fixed text.
+func (b *Brisa) SetRejectMessage(t *ReplyTemplate) {
+	b.rejectMessage.Store(t)
+}
+
+// SetDeferredRejection makes new sessions postpone the rejections of the conn
+// and mail_from chains until DATA: the commands up to DATA are accepted
+// without running their chains, and DATA is refused with the original reply
+// after the reject chain has run with the message. Trap servers use it to
+// capture the messages of rejected clients. Recipient rejections are not
+// deferred.
+func (b *Brisa) SetDeferredRejection(enabled bool) {
+	b.deferReject.Store(enabled)
+}
+
+// Events returns the bus on which sessions publish their events. Delivery
+// middleware publish their DeliveryStatus events on it too.
+func (b *Brisa) Events() *EventBus {
+	return b.events
+}
+
 // NewSession is called after client greeting (EHLO, HELO).
 func (b *Brisa) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return b.newSession(c, "")
+}
+
+func (b *Brisa) newSession(c *smtp.Conn, listener string) (smtp.Session, error) {
 	id := uuid.NewString()
 	ctx := NewContext()
-	ctx.Logger = b.logger.With("session_id", id)
+	ctx.Logger = withAttr(b.logger, slog.String("session_id", id))
 
+	router := b.routerFor(listener)
 	s := &Session{
-		ctx:        ctx,
-		id:         id,
-		conn:       c,
-		router:     b.router.Load(),
-		baseLogger: ctx.Logger,
-		observers:  b.observers,
+		ctx:           ctx,
+		id:            id,
+		conn:          c,
+		listener:      listener,
+		router:        router,
+		baseLogger:    ctx.Logger,
+		tenants:       b.tenantsFor(listener),
+		sessionRouter: router,
+		observers:     b.observers,
+		events:        b.events,
+
+		rejectMessage: b.rejectMessage.Load(),
+		deferReject:   b.deferReject.Load(),
+		postQueue:     b.postQueue.Load(),
+		hookPool:      b.hooks.Load(),
+		dataGate:      b.dataGate.Load(),
+		spools:        &b.spools,
+
+		lastCommand: time.Now(),
+		hellos:      &b.hellos,
+	}
+	if a := b.authenticator.Load(); a != nil {
+		s.authenticator = *a
+		s.allowedMechs = b.authMechanismsFor(listener)
 	}
 	// Link session back to context
 	s.ctx.Session = s
-
-	for _, o := range b.observers {
-		o.OnSessionStart(s.ctx)
+	s.startLimits(b)
+	s.observeTLS()
+	if reason := earlyTalkerOf(c.Conn()); reason != "" {
+		s.ctx.SetFlag(FlagEarlyTalker)
+		s.ctx.Logger.Info("early talker", "reason", reason)
 	}
 
-	err := s.execute(ChainConn)
+	notify(b.observers, s.ctx, func(o Observer) { o.OnSessionStart(s.ctx) })
+
+	err := s.execute(chainConn)
 	if err != nil {
 		return nil, err
 	}
+	s.publishSessionStarted()
 
 	return s, nil
 }
 
+// withAttr is Logger.With for a single attribute, without boxing it in an any.
+func withAttr(logger *slog.Logger, attr slog.Attr) *slog.Logger {
+	return slog.New(logger.Handler().WithAttrs([]slog.Attr{attr}))
+}
+
 // ------- Session ---------
 type Session struct {
 	ctx        *Context
 	id         string
 	conn       *smtp.Conn
-	router     *Router
+	remoteAddr net.Addr          // client address of a simulated session without conn
+	tls        bool              // TLS state of a simulated session
+	clientCert *x509.Certificate // client certificate of a simulated session
+	listener   string
+	router     *compiledRouter
 	baseLogger *slog.Logger
-	observers  []Observer
+	// tenants select the router of each transaction; tenant is the tenant of
+	// the current one, whose router replaces sessionRouter, the router of the
+	// session.
+	tenants       tenantTable
+	tenant        *compiledTenant
+	sessionRouter *compiledRouter
+	observers     []Observer
+	events        *EventBus
+	mailID        string
+	// rejectMessage is the default template of the policy rejection reply.
+	rejectMessage *ReplyTemplate
+	// deferReject postpones conn and mail_from rejections until DATA; deferred
+	// holds the pending one.
+	deferReject bool
+	deferred    *deferredReject
+	// postQueue receives the messages to deliver when the router has a
+	// post-queue chain. postQueued marks the sessions of that stage.
+	postQueue  *postQueue
+	postQueued bool
+	// hookPool runs the hooks of accepted messages; see Context.AfterAccept.
+	hookPool *hookPool
+	// dataGate bounds the messages processed at once; see DataGateConfig.
+	dataGate *dataGate
+	// spools accounts the memory of the message spools; see SpoolConfig.
+	spools *spoolBudget
+	// authenticator checks AUTH credentials; AUTH is not offered without it.
+	authenticator Authenticator
+	// allowedMechs restricts the offered AUTH mechanisms; nil allows all.
+	allowedMechs []string
+	// limits protect the session from protocol abuse; commands and refusals
+	// count towards them.
+	limits       ProtocolLimits
+	commands     int
+	refusals     int
+	aborted      atomic.Bool
+	sessionTimer *time.Timer
+	// dataEnded marks the Reset go-smtp calls after each message, which is
+	// no command of the client. It is atomic as BDAT runs Data in another
+	// goroutine.
+	dataEnded atomic.Bool
+	// fp is the fingerprint of the client; lastCommand is the time of its
+	// latest command. hellos are the ClientHellos recorded by the server, and
+	// plain marks sessions of unencrypted connections.
+	fp          Fingerprint
+	lastCommand time.Time
+	hellos      *sync.Map
+	plain       bool
+}
+
+// deferredReject is a rejection postponed until DATA.
+type deferredReject struct {
+	chain ChainType
+	reply *smtp.SMTPError
 }
 
 func (s *Session) GetClientIP() net.Addr {
+	if s.conn == nil {
+		return s.remoteAddr
+	}
 	return s.conn.Conn().RemoteAddr()
 }
 
+// TLS reports whether the connection of the session is encrypted with TLS.
+func (s *Session) TLS() bool {
+	if s.conn == nil {
+		return s.tls
+	}
+	_, ok := s.conn.TLSConnectionState()
+	return ok
+}
+
+// ClientCertificate returns the certificate the client authenticated with
+// during the TLS handshake, if it was verified against the client CAs of the
+// server (see TLSConfig.ClientCAFile), or nil.
+func (s *Session) ClientCertificate() *x509.Certificate {
+	if s.conn == nil {
+		return s.clientCert
+	}
+	state, ok := s.conn.TLSConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// Listener returns the name of the listener the session arrived on; see
+// Brisa.Listener.
+func (s *Session) Listener() string {
+	return s.listener
+}
+
+// ID returns the ID of the session, as logged under session_id.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// MailID returns the ID of the current mail transaction, as logged under
+// mail_id and reported in message events.
+func (s *Session) MailID() string {
+	return s.mailID
+}
+
+// Events returns the event bus of the server, for middleware publishing
+// events such as DeliveryStatus. It is nil for detached sessions.
+func (s *Session) Events() *EventBus {
+	return s.events
+}
+
 // Mail is called when a sender is specified.
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	s.resetMailTransaction()
+	if err := s.command("MAIL"); err != nil {
+		return err
+	}
+	s.recordMail(opts)
+	if (opts == nil || !opts.UTF8) && address.NeedsSMTPUTF8(from) {
+		return s.refused(ErrNonASCIIAddress)
+	}
 
 	// generate mail_id for each email
-	mailId := uuid.NewString()
-	s.ctx.Logger = s.baseLogger.With("mail_id", mailId)
+	s.mailID = uuid.NewString()
+	s.ctx.Logger = withAttr(s.baseLogger, slog.String("mail_id", s.mailID))
 
-	s.ctx.From = from
+	s.ctx.From = address.ToASCII(address.Quote(from))
 	s.ctx.FromOptions = opts
-	return s.execute(ChainMailFrom)
+	if s.deferred != nil {
+		// The session is already rejected; its reply waits for DATA.
+		return nil
+	}
+	if err := s.execute(chainMailFrom); err != nil {
+		return s.refused(err)
+	}
+	if max := s.ctx.messageLimits.MaxMessageBytes; max > 0 && opts != nil && opts.Size > max {
+		s.ctx.Logger.Info("declared message size over limit", "size", opts.Size, "limit", max)
+		return s.refused(smtp.ErrDataTooLarge)
+	}
+	return nil
 }
 
 // Rcpt is called for each recipient.
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.ctx.To = append(s.ctx.To, to)
+	if err := s.command("RCPT"); err != nil {
+		return err
+	}
+	s.recordRcpt(opts)
+	if !s.ctx.SMTPUTF8() && address.NeedsSMTPUTF8(to) {
+		return s.refused(ErrNonASCIIAddress)
+	}
+	if max := s.ctx.messageLimits.MaxRecipients; max > 0 && len(s.ctx.To) >= max {
+		// Like the limit of go-smtp, this is not an error of the client: it
+		// sends the remaining recipients in another transaction.
+		return ErrTooManyRecipients
+	}
+	if s.tenants != nil && s.deferred == nil {
+		t := s.tenants.lookup(to)
+		if len(s.ctx.To) == 0 {
+			s.selectTenant(t)
+		} else if t != s.tenant {
+			// Not an error of the client either.
+			return ErrOtherTenant
+		}
+	}
+	action := s.ctx.Action
+	s.ctx.To = append(s.ctx.To, address.ToASCII(address.Quote(to)))
 	s.ctx.ToOptions = append(s.ctx.ToOptions, opts)
-	return s.execute(ChainRcptTo)
+	if s.deferred != nil {
+		return nil
+	}
+
+	if err := s.execute(chainRcptTo); err != nil {
+		// Only this recipient was refused; remove it from the transaction and
+		// restore the status so the remaining recipients are unaffected.
+		n := len(s.ctx.To) - 1
+		s.ctx.To = s.ctx.To[:n]
+		s.ctx.ToOptions = s.ctx.ToOptions[:n]
+		s.ctx.Action = action
+		return s.refused(err)
+	}
+	return nil
 }
 
-// Data is called when a message is received.
-func (s *Session) Data(r io.Reader) error {
+// Data is called when a message is received, with DATA or with the first
+// BDAT chunk (CHUNKING, RFC 3030). With BDAT, r delivers each chunk as it
+// arrives, so the data chain can reject a message before its last chunk: the
+// reply then answers the current chunk and the rest is not transferred.
+func (s *Session) Data(r io.Reader) (err error) {
+	defer s.dataEnded.Store(true)
+	if err := s.command("DATA"); err != nil {
+		return err
+	}
+	if s.limits.MinDataRate > 0 {
+		r = &dataRateReader{r: r, s: s, start: time.Now()}
+	}
+	var size *messageSizeReader
+	if max := s.ctx.messageLimits.MaxMessageBytes; max > 0 {
+		size = &messageSizeReader{r: r, max: max}
+		r = size
+	}
 	s.ctx.Reader = r
 	defer func() {
-		// Ensure the reader is always consumed to avoid client timeout.
-		// If no middleware consumes it, discard the data.
-		// This is a safe fallback. A dedicated middleware should ideally handle this.
-		io.Copy(io.Discard, s.ctx.Reader)
+		// An accepted message must be consumed in full, or the chunks still
+		// to come would be refused. go-smtp discards the rest of a refused
+		// DATA message itself.
+		if err == nil {
+			io.Copy(io.Discard, s.ctx.Reader)
+			if size.tooLarge(s.ctx.Logger) {
+				err = s.refused(smtp.ErrDataTooLarge)
+				return
+			}
+			s.runHooks()
+		}
 	}()
 
-	err := s.execute(ChainData)
-	if err != nil {
-		return err
+	if d := s.deferred; d != nil {
+		// Issue the deferred rejection now that the message is available to
+		// the reject chain, e.g. for capturing it.
+		s.ctx.Action = Reject
+		s.ctx.rejectErr = d.reply
+		s.runRejectChain()
+		s.ctx.rejectErr = nil
+		return s.refused(d.reply)
+	}
+
+	if g := s.dataGate; g != nil {
+		if !g.acquire() {
+			// The client is not at fault, so this is no refusal.
+			s.ctx.Logger.Warn("server busy, message deferred")
+			return g.reply
+		}
+		defer g.release()
+	}
+	if err := s.execute(chainData); err != nil {
+		return s.refused(err)
+	}
+	if s.aborted.Load() {
+		// The message may be incomplete.
+		return ErrProtocolAbuse
+	}
+	if size.tooLarge(s.ctx.Logger) {
+		return s.refused(smtp.ErrDataTooLarge)
+	}
+	if s.ctx.spoolErr != nil {
+		s.ctx.Logger.Warn("spool memory exhausted, message deferred")
+		return s.refused(ErrInsufficientStorage)
 	}
 
 	// If after all data middleware, the status is still Pass, it means no middleware
@@ -215,20 +618,50 @@ func (s *Session) Data(r io.Reader) error {
 	if s.ctx.Action == Pass {
 		s.ctx.Action = Deliver
 	}
+	err = s.dispose()
+	if size.tooLarge(s.ctx.Logger) {
+		// The message was read to its limit only while being disposed of.
+		return s.refused(smtp.ErrDataTooLarge)
+	}
+	return s.refused(err)
+}
+
+// dispose executes the disposition chain of the final action of the message.
+// A message to deliver passes the post_queue chain first: in the post-queue
+// stage if one is started, otherwise within the transaction.
+func (s *Session) dispose() error {
+	if s.ctx.Action == Deliver && !s.postQueued && len(s.router.chains[chainPostQueue]) > 0 {
+		if s.postQueue != nil {
+			if err := s.postQueue.enqueue(s); err != nil {
+				return err
+			}
+			s.publishMessageAccepted()
+			return nil
+		}
+		if err := s.runPostQueueChain(); err != nil {
+			return err
+		}
+	}
 
 	switch s.ctx.Action {
 	case Deliver:
-		err := s.execute(ChainDeliver)
-		if err != nil {
+		if err := s.execute(chainDeliver); err != nil {
 			return err
 		}
+		// The post-queue stage runs after the message was accepted.
+		if !s.postQueued {
+			s.publishMessageAccepted()
+		}
 	case Quarantine:
-		err := s.execute(ChainQuarantine)
+		err := s.execute(chainQuarantine)
 		if err != nil {
 			return err
 		}
+		if s.events.HasSubscribers(EventMessageQuarantined) {
+			s.events.Publish(MessageQuarantined{s.messageInfo()})
+		}
 	case Discard:
-		err := s.execute(ChainDiscard)
+		err := s.execute(chainDiscard)
 		if err != nil {
 			// Errors in the Discard chain probably shouldn't fail the SMTP transaction,
 			// as the intent is to successfully receive and then drop the mail.
@@ -242,23 +675,106 @@ func (s *Session) Data(r io.Reader) error {
 	return nil
 }
 
-// Reset is called when a transaction is aborted.
+// runPostQueueChain executes the post_queue chain, starting over from Pass so
+// the default ignore flags do not skip it. Pass results in Deliver.
+func (s *Session) runPostQueueChain() error {
+	s.ctx.Action = Pass
+	if err := s.execute(chainPostQueue); err != nil {
+		return err
+	}
+	if s.ctx.Action == Pass {
+		s.ctx.Action = Deliver
+	}
+	return nil
+}
+
+func (s *Session) publishMessageAccepted() {
+	if s.events.HasSubscribers(EventMessageAccepted) {
+		s.events.Publish(MessageAccepted{s.messageInfo()})
+	}
+}
+
+func (s *Session) publishSessionStarted() {
+	if s.events.HasSubscribers(EventSessionStarted) {
+		s.events.Publish(SessionStarted{SessionID: s.id, ClientAddr: s.GetClientIP()})
+	}
+}
+
+// messageInfo describes the current message for events.
+func (s *Session) messageInfo() MessageInfo {
+	return MessageInfo{
+		SessionID: s.id,
+		MailID:    s.mailID,
+		Tenant:    s.ctx.tenant,
+		From:      s.ctx.From,
+		To:        slices.Clone(s.ctx.To),
+		Score:     s.ctx.Score,
+	}
+}
+
+// Reset is called when a transaction is aborted with RSET, and by go-smtp
+// itself after each message and on a repeated EHLO or HELO. The reset after
+// a message is not counted as a command nor recorded in the fingerprint; a
+// repeated greeting cannot be told from RSET and counts as one. Reset cannot
+// refuse: when the client exceeds the command limit, command closes the
+// connection.
 func (s *Session) Reset() {
 	s.resetMailTransaction()
+	if s.dataEnded.Swap(false) {
+		return
+	}
+	s.command("RSET")
 }
 
 // resetMailTransaction resets the state for a single mail transaction,
 // allowing the session to be reused for another mail.
 func (s *Session) resetMailTransaction() {
+	if s.deferred != nil && s.deferred.chain == ChainMailFrom {
+		s.deferred = nil
+	}
 	s.ctx.ResetMailFields()
 	s.ctx.Logger = s.baseLogger // Revert to the session-level logger.
+	if s.tenants != nil {
+		s.tenant = nil
+		s.router = s.sessionRouter
+	}
+}
+
+// selectTenant makes t, which may be nil, the tenant of the transaction.
+func (s *Session) selectTenant(t *compiledTenant) {
+	s.tenant = t
+	logger := withAttr(s.baseLogger, slog.String("mail_id", s.mailID))
+	if t == nil {
+		s.router = s.sessionRouter
+		s.ctx.tenant = ""
+		s.ctx.Logger = logger
+		return
+	}
+	s.router = t.router
+	s.ctx.tenant = t.name
+	s.ctx.Logger = withAttr(logger, slog.String("tenant", t.name))
+}
+
+// runRejectChain executes the reject chain, keeping the middleware that
+// rejected the command for the reply.
+func (s *Session) runRejectChain() {
+	rejectChain := s.router.chains[chainReject]
+	if len(rejectChain) == 0 {
+		return
+	}
+	rejectedBy := s.ctx.rejectedBy
+	s.ctx.chain = ChainReject
+	if _, err := rejectChain.Execute(s.ctx); err != nil {
+		s.ctx.Logger.Error("reject middleware execute failed", "error", err)
+	}
+	s.ctx.rejectedBy = rejectedBy
 }
 
 // Logout is called when a client closes the connection.
 func (s *Session) Logout() error {
-	for _, o := range s.observers {
-		o.OnSessionEnd(s.ctx)
-	}
+	s.stopLimits()
+	s.handOverTLS()
+	notify(s.observers, s.ctx, func(o Observer) { o.OnSessionEnd(s.ctx) })
 	FreeContext(s.ctx)
 
 	return nil
@@ -266,36 +782,46 @@ func (s *Session) Logout() error {
 
 // execute is a helper method to run a middleware chain for a given SMTP command.
 // It fetches the appropriate chain, executes it, and handles panics or rejections.
-func (s *Session) execute(chainType ChainType) error {
-	chain, ok := (*s.router)[chainType]
-	if !ok {
+func (s *Session) execute(index chainIndex) error {
+	chain := s.router.chains[index]
+	if len(chain) == 0 {
 		// No middleware chain is defined for this command, so we allow it.
 		return nil
 	}
+	chainType := chainTypes[index]
 
-	for _, o := range s.observers {
-		o.OnChainStart(s.ctx, chainType)
-	}
+	notify(s.observers, s.ctx, func(o Observer) { o.OnChainStart(s.ctx, chainType) })
 	startTime := time.Now()
 
+	s.ctx.chain = chainType
+	s.ctx.rejectedBy = nil
 	action, err := chain.Execute(s.ctx)
 
 	duration := time.Since(startTime)
-	for _, o := range s.observers {
-		o.OnChainEnd(s.ctx, chainType, duration)
-	}
+	notify(s.observers, s.ctx, func(o Observer) { o.OnChainEnd(s.ctx, chainType, duration) })
 
 	if err != nil || action == Reject {
 		s.ctx.Action = Reject // Ensure context reflects the final decision.
 
+		if err == nil && s.deferReject && (index == chainConn || index == chainMailFrom) {
+			reply := s.ctx.rejectErr
+			s.ctx.rejectErr = nil
+			if reply == nil {
+				reply = ErrRejectedByPolicy
+			}
+			s.deferred = &deferredReject{chain: chainType, reply: s.reply(reply, chainType)}
+			s.ctx.Logger.Info("rejection deferred until DATA", "chain", string(chainType))
+			return nil
+		}
+
 		// Execute reject chain if it exists.
 		// Errors from the reject chain are logged but not returned to the client,
 		// as a primary decision to reject has already been made.
-		if rejectChain, ok := (*s.router)[ChainReject]; ok {
-			if _, rejectErr := rejectChain.Execute(s.ctx); rejectErr != nil {
-				s.ctx.Logger.Error("reject middleware execute failed", "error", rejectErr)
-			}
-		}
+		s.runRejectChain()
+
+		// A reply chosen with RejectWith only applies to the current command.
+		reply := s.ctx.rejectErr
+		s.ctx.rejectErr = nil
 
 		// Determine which SMTP error to return.
 		if err != nil {
@@ -309,8 +835,13 @@ func (s *Session) execute(chainType ChainType) error {
 			return ErrInternalServer
 		}
 
+		// If a middleware chose a specific reply with RejectWith, use it.
+		if reply != nil {
+			return s.reply(reply, chainType)
+		}
+
 		// If there was no error but the action is Reject, return the default policy rejection.
-		return ErrRejectedByPolicy
+		return s.reply(ErrRejectedByPolicy, chainType)
 	}
 
 	return nil
@@ -0,0 +1,94 @@
+package brisa
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+const benchMessage = "From: a@example.com\r\nTo: b@example.com\r\nSubject: bench\r\n\r\nhello\r\n"
+
+func newBenchBrisa() *Brisa {
+	pass := &Middleware{Handler: func(ctx *Context) Action { return Pass }}
+	router := &Router{}
+	router.OnConn(pass).OnMailFrom(pass).OnRcptTo(pass).OnData(pass, pass, pass)
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		io.Copy(io.Discard, ctx.Reader)
+		return Deliver
+	}})
+	b := New(slog.New(slog.DiscardHandler))
+	b.UpdateRouter(router)
+	return b
+}
+
+func BenchmarkNewSession(b *testing.B) {
+	br := newBenchBrisa()
+	b.ReportAllocs()
+	for b.Loop() {
+		s, err := br.NewSession(&smtp.Conn{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		s.Logout()
+	}
+}
+
+func BenchmarkMiddlewareChain_Execute(b *testing.B) {
+	pass := Middleware{Handler: func(ctx *Context) Action { return Pass }}
+	chain := MiddlewareChain{pass, pass, pass, pass, pass}
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	b.ReportAllocs()
+	for b.Loop() {
+		ctx.ResetMailFields()
+		chain.Execute(ctx)
+	}
+}
+
+func BenchmarkSession_Transaction(b *testing.B) {
+	br := newBenchBrisa()
+	s, err := br.NewSession(&smtp.Conn{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Logout()
+	r := strings.NewReader(benchMessage)
+	mailOpts, rcptOpts := &smtp.MailOptions{}, &smtp.RcptOptions{}
+	b.SetBytes(int64(len(benchMessage)))
+	b.ReportAllocs()
+	for b.Loop() {
+		s.Mail("a@example.com", mailOpts)
+		s.Rcpt("b@example.com", rcptOpts)
+		s.Rcpt("c@example.com", rcptOpts)
+		r.Reset(benchMessage)
+		if err := s.Data(r); err != nil {
+			b.Fatal(err)
+		}
+		s.Reset()
+	}
+}
+
+func BenchmarkSession_TransactionParallel(b *testing.B) {
+	br := newBenchBrisa()
+	b.SetBytes(int64(len(benchMessage)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		s, err := br.NewSession(&smtp.Conn{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer s.Logout()
+		r := strings.NewReader(benchMessage)
+		mailOpts, rcptOpts := &smtp.MailOptions{}, &smtp.RcptOptions{}
+		for pb.Next() {
+			s.Mail("a@example.com", mailOpts)
+			s.Rcpt("b@example.com", rcptOpts)
+			r.Reset(benchMessage)
+			s.Data(r)
+			s.Reset()
+		}
+	})
+}
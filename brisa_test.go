@@ -1,9 +1,14 @@
 package brisa
 
 import (
+	"bufio"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/emersion/go-smtp"
@@ -147,7 +152,7 @@ func TestBrisa_UpdateRouter(t *testing.T) {
 	b.UpdateRouter(originalRouter)
 
 	// 检查初始状态是否正确复制
-	internalRouter := b.router.Load()
+	internalRouter := b.router.Load().router
 	if !reflect.DeepEqual(originalRouter, internalRouter) {
 		t.Fatalf("内部 router 应该是原始 router 的深拷贝。\n原始: %+v\n内部:   %+v", *originalRouter, *internalRouter)
 	}
@@ -159,7 +164,7 @@ func TestBrisa_UpdateRouter(t *testing.T) {
 	originalRouter.Use(ChainData, mw1)
 
 	// 5. 验证内部的 router 没有被修改
-	internalRouterAfterModification := b.router.Load()
+	internalRouterAfterModification := b.router.Load().router
 
 	// 验证内部 router 实例没有改变
 	if internalRouter != internalRouterAfterModification {
@@ -174,3 +179,241 @@ func TestBrisa_UpdateRouter(t *testing.T) {
 		t.Error("向原始 router 添加新链不应影响内部 router，但 'data' 链存在于内部 router 中")
 	}
 }
+
+func TestCompileRouter(t *testing.T) {
+	router := &Router{}
+	router.OnData(&Middleware{IgnoreFlags: 1})
+	router.OnReject(&Middleware{IgnoreFlags: 2}, &Middleware{IgnoreFlags: 3})
+	router.Use("unknown", &Middleware{})
+
+	c := compileRouter(router)
+	if len(c.chains[chainData]) != 1 || len(c.chains[chainReject]) != 2 || len(c.chains[chainConn]) != 0 {
+		t.Errorf("unexpected compiled chains: %+v", c.chains)
+	}
+	for i, chain := range c.chains {
+		if !reflect.DeepEqual(chain, (*router)[chainTypes[i]]) {
+			t.Errorf("chain %s not compiled to its index", chainTypes[i])
+		}
+	}
+}
+
+func TestSession_execute_RejectWith(t *testing.T) {
+	customErr := &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}
+
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	ctx.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var rejectChainSaw *smtp.SMTPError
+	s := &Session{
+		ctx: ctx,
+		router: compileRouter(&Router{
+			ChainRcptTo: {{Handler: func(ctx *Context) Action { return ctx.RejectWith(customErr) }}},
+			ChainReject: {{Handler: func(ctx *Context) Action {
+				rejectChainSaw = ctx.RejectError()
+				return Reject
+			}}},
+			ChainData: {{Handler: func(ctx *Context) Action { return Reject }}},
+		}),
+	}
+
+	if err := s.execute(chainRcptTo); err != customErr {
+		t.Errorf("expected the reply set by RejectWith, got %v", err)
+	}
+	if rejectChainSaw != customErr {
+		t.Errorf("expected the reject chain to see the reply, got %v", rejectChainSaw)
+	}
+	if ctx.RejectError() != nil {
+		t.Error("expected the reply to be cleared after the command")
+	}
+
+	// A plain Reject on a later command falls back to the default reply.
+	if err := s.execute(chainData); err != ErrRejectedByPolicy {
+		t.Errorf("expected ErrRejectedByPolicy, got %v", err)
+	}
+}
+
+func TestSession_Rcpt_Rejected(t *testing.T) {
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	ctx.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	s := &Session{
+		ctx: ctx,
+		router: compileRouter(&Router{
+			ChainRcptTo: {{Handler: func(ctx *Context) Action {
+				if ctx.To[len(ctx.To)-1] == "full@example.com" {
+					return Reject
+				}
+				return Pass
+			}}},
+		}),
+	}
+
+	if err := s.Rcpt("ok@example.com", &smtp.RcptOptions{}); err != nil {
+		t.Fatalf("expected first recipient to be accepted, got %v", err)
+	}
+	if err := s.Rcpt("full@example.com", &smtp.RcptOptions{}); err == nil {
+		t.Fatal("expected second recipient to be rejected")
+	}
+
+	if !reflect.DeepEqual(ctx.To, []string{"ok@example.com"}) {
+		t.Errorf("rejected recipient should be removed, got %v", ctx.To)
+	}
+	if len(ctx.ToOptions) != 1 {
+		t.Errorf("rejected recipient options should be removed, got %d entries", len(ctx.ToOptions))
+	}
+	if ctx.Action != Pass {
+		t.Errorf("rejecting one recipient should not change the transaction status, got %v", ctx.Action)
+	}
+}
+
+func TestSession_IDNEnvelope(t *testing.T) {
+	var from string
+	var to []string
+	router := Router{}
+	var utf8 bool
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		from, to = ctx.From, append([]string(nil), ctx.To...)
+		utf8 = ctx.SMTPUTF8()
+		return Deliver
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+
+	// 信封地址的域名统一转换为 A-label，本地部分保持不变
+	env := Envelope{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")},
+		From:       "jörg@bücher.example",
+		To:         []string{"bob@example.com", "anna@münchen.de"},
+	}
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Err != nil {
+		t.Fatalf("unexpected error: %v", res.Err)
+	}
+	if from != "jörg@xn--bcher-kva.example" {
+		t.Errorf("unexpected sender %q", from)
+	}
+	if len(to) != 2 || to[0] != "bob@example.com" || to[1] != "anna@xn--mnchen-3ya.de" {
+		t.Errorf("unexpected recipients %q", to)
+	}
+	if !utf8 {
+		t.Error("expected a non-ASCII local part to imply SMTPUTF8")
+	}
+}
+
+func TestSession_SMTPUTF8(t *testing.T) {
+	var from string
+	var to []string
+	var msg []byte
+	router := Router{}
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		from, to = ctx.From, append([]string(nil), ctx.To...)
+		msg, _ = io.ReadAll(ctx.Reader)
+		return Deliver
+	}})
+	b := New(slog.New(slog.DiscardHandler))
+	b.UpdateRouter(&router)
+	server := startTestServer(t, b, testServerOptions{enableSMTPUTF8: true})
+
+	data, err := os.ReadFile("address/testdata/eai.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		addr, ascii, needs := f[0], f[1], f[3] == "true"
+		t.Run(addr, func(t *testing.T) {
+			c, err := smtp.Dial(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// 没有 SMTPUTF8 参数时拒绝非 ASCII 本地部分
+			err = c.Mail(addr, nil)
+			if needs {
+				if e, ok := err.(*smtp.SMTPError); !ok || e.Code != 553 || e.EnhancedCode != (smtp.EnhancedCode{5, 6, 7}) {
+					t.Errorf("expected 553 5.6.7 without SMTPUTF8, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error without SMTPUTF8: %v", err)
+			}
+			c.Reset()
+
+			// 信封和 UTF-8 头部原样通过
+			body := "From: Jörg <" + addr + ">\r\nTo: =?utf-8?q?J=C3=B6rg?= <" + addr + ">\r\nSubject: Grüße, 你好\r\n\r\nTschüß\r\n"
+			if err := c.Mail(addr, &smtp.MailOptions{UTF8: true}); err != nil {
+				t.Fatalf("unexpected error with SMTPUTF8: %v", err)
+			}
+			if err := c.Rcpt(addr, nil); err != nil {
+				t.Fatalf("unexpected RCPT error: %v", err)
+			}
+			w, err := c.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, body)
+			if err := w.Close(); err != nil {
+				t.Fatalf("unexpected DATA error: %v", err)
+			}
+			if from != ascii || len(to) != 1 || to[0] != ascii {
+				t.Errorf("expected envelope %q, got %q -> %q", ascii, from, to)
+			}
+			if string(msg) != body {
+				t.Errorf("message changed:\n%q\n%q", body, msg)
+			}
+		})
+	}
+}
+
+func TestSession_BDATRejectMidTransfer(t *testing.T) {
+	var delivered []byte
+	router := &Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		// 只查看消息的开头即可做出判断
+		br := bufio.NewReader(ctx.Reader)
+		ctx.Reader = br
+		if line, _ := br.Peek(8); string(line) == "X-Block:" {
+			return Reject
+		}
+		return Pass
+	}})
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		delivered, _ = io.ReadAll(ctx.Reader)
+		return Deliver
+	}})
+	addr := startLimitsServer(t, ProtocolLimits{}, router)
+
+	conn, r := dialTest(t, addr, true)
+	send := func(cmd string) string {
+		io.WriteString(conn, cmd)
+		return readReply(t, r)
+	}
+	send("MAIL FROM:<a@example.org>\r\n")
+	send("RCPT TO:<b@example.com>\r\n")
+	// 第一个块未读完就被拒绝，而不是等到最后一个块
+	chunk := "X-Block: yes\r\nSubject: hi\r\n\r\n" + strings.Repeat("body\r\n", 2000)
+	if reply := send(fmt.Sprintf("BDAT %d\r\n%s", len(chunk), chunk)); !strings.HasPrefix(reply, "554 ") {
+		t.Fatalf("expected the first chunk to be refused, got %q", reply)
+	}
+	if reply := send("BDAT 6 LAST\r\nbody\r\n"); !strings.HasPrefix(reply, "502 ") {
+		t.Errorf("expected the transaction to be over, got %q", reply)
+	}
+
+	// 接受的消息完整地分块到达
+	send("MAIL FROM:<a@example.org>\r\n")
+	send("RCPT TO:<b@example.com>\r\n")
+	chunk = "Subject: hi\r\n\r\n"
+	if reply := send(fmt.Sprintf("BDAT %d\r\n%s", len(chunk), chunk)); !strings.HasPrefix(reply, "250 ") {
+		t.Fatalf("expected the chunk to be accepted, got %q", reply)
+	}
+	if reply := send("BDAT 6 LAST\r\nbody\r\n"); !strings.HasPrefix(reply, "250 ") {
+		t.Fatalf("expected the message to be accepted, got %q", reply)
+	}
+	if string(delivered) != chunk+"body\r\n" {
+		t.Errorf("unexpected message %q", delivered)
+	}
+}
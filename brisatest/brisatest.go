@@ -0,0 +1,254 @@
+// Package brisatest provides helpers for testing brisa middleware and routers
+// in process, without an SMTP server or network connection.
+package brisatest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+// DefaultClientIP is the client address of contexts and transactions whose
+// envelope does not set one.
+var DefaultClientIP = net.IPv4(192, 0, 2, 1)
+
+// DefaultEnvelope returns the envelope used when a test does not care about
+// it: a client at DefaultClientIP sending from sender@example.com to
+// recipient@example.com.
+func DefaultEnvelope() brisa.Envelope {
+	return brisa.Envelope{
+		ClientAddr: &net.TCPAddr{IP: DefaultClientIP, Port: 25},
+		From:       "sender@example.com",
+		To:         []string{"recipient@example.com"},
+	}
+}
+
+// Password is the password of the envelopes of AuthEnvelope, and the one the
+// authenticator of NewBrisa accepts.
+const Password = "secret"
+
+// NewEnvelope returns DefaultEnvelope from a client at ip, or DefaultClientIP
+// if ip is empty, sending from from to the recipients to.
+func NewEnvelope(ip, from string, to ...string) brisa.Envelope {
+	env := DefaultEnvelope()
+	if ip != "" {
+		env.ClientAddr = &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}
+	}
+	env.From, env.To = from, to
+	return env
+}
+
+// AuthEnvelope returns DefaultEnvelope authenticating as user with Password,
+// sent to the recipients to if any are given.
+func AuthEnvelope(user string, to ...string) brisa.Envelope {
+	env := DefaultEnvelope()
+	env.Username, env.Password = user, Password
+	if len(to) > 0 {
+		env.To = to
+	}
+	return env
+}
+
+// NewBrisa returns a Brisa running router, with a logger that discards
+// everything and the given observers. Its authenticator accepts Password for
+// any user, so the transactions of AuthEnvelope are authenticated and those
+// with another password are not.
+func NewBrisa(router *brisa.Router, observers ...brisa.Observer) *brisa.Brisa {
+	b := brisa.New(slog.New(slog.DiscardHandler), observers...)
+	b.UpdateRouter(router)
+	b.SetAuthenticator(brisa.AuthenticatorFunc(func(ctx *brisa.Context, username, password string) error {
+		if password != Password {
+			return brisa.ErrAuthFailed
+		}
+		return nil
+	}))
+	return b
+}
+
+// NewContext returns a context for calling a handler directly. It has a
+// session with the client address, listener and TLS state of env, the
+// envelope addresses, message as its reader and a logger that discards
+// everything. The context is freed when the test ends.
+func NewContext(tb testing.TB, env brisa.Envelope, message string) *brisa.Context {
+	tb.Helper()
+	ctx := brisa.NewContext()
+	ctx.Logger = slog.New(slog.DiscardHandler)
+	if env.ClientAddr == nil {
+		env.ClientAddr = &net.TCPAddr{IP: DefaultClientIP, Port: 25}
+	}
+	brisa.NewDetachedSessionWith(ctx, env)
+	ctx.From = env.From
+	ctx.To = append([]string(nil), env.To...)
+	ctx.Reader = strings.NewReader(message)
+	tb.Cleanup(func() { brisa.FreeContext(ctx) })
+	return ctx
+}
+
+// ReadMessage consumes the (possibly rewritten) message from ctx.
+func ReadMessage(tb testing.TB, ctx *brisa.Context) string {
+	tb.Helper()
+	data, err := io.ReadAll(ctx.Reader)
+	if err != nil {
+		tb.Fatalf("read message: %v", err)
+	}
+	return string(data)
+}
+
+// Result is the outcome of a transaction run with Run.
+type Result struct {
+	*brisa.SimulationResult
+	// Message is the message as it reached the disposition chain, after the
+	// data chain rewrote it. It is nil if the transaction was rejected.
+	Message []byte
+	// Score is the spam score of the message when it reached the disposition
+	// chain.
+	Score float64
+	// Events are the observer events of the transaction. The disposition
+	// chain of the final action always appears, because Run adds the
+	// middleware capturing Message to it.
+	Events []Event
+}
+
+// Run runs a transaction with env and message through router and records the
+// outcome. The router itself is not modified.
+func Run(tb testing.TB, router *brisa.Router, env brisa.Envelope, message string) *Result {
+	tb.Helper()
+	if env.ClientAddr == nil {
+		env.ClientAddr = &net.TCPAddr{IP: DefaultClientIP, Port: 25}
+	}
+	res := &Result{}
+
+	// Capture the message before the disposition middleware consume it.
+	capture := &brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		data, err := io.ReadAll(ctx.Reader)
+		if err != nil {
+			tb.Errorf("read message: %v", err)
+		}
+		res.Message, res.Score = data, ctx.Score
+		ctx.Reader = bytes.NewReader(data)
+		return ctx.Action
+	}}
+	r := router.Clone()
+	for _, chain := range []brisa.ChainType{brisa.ChainDeliver, brisa.ChainQuarantine, brisa.ChainDiscard} {
+		(*r)[chain] = append(brisa.MiddlewareChain{*capture}, (*r)[chain]...)
+	}
+
+	rec := &Recorder{}
+	b := brisa.New(slog.New(slog.DiscardHandler), rec)
+	b.UpdateRouter(r)
+	res.SimulationResult = b.Simulate(env, strings.NewReader(message))
+	res.Events = rec.Events()
+	return res
+}
+
+// Header returns the header of the captured message.
+func (r *Result) Header() textproto.MIMEHeader {
+	if r.Message == nil {
+		return nil
+	}
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(r.Message))).ReadMIMEHeader()
+	return h
+}
+
+// AssertAction reports an error if the final action is not want.
+func (r *Result) AssertAction(tb testing.TB, want brisa.Action) {
+	tb.Helper()
+	if r.Action != want {
+		tb.Errorf("expected action %s, got %s (rejected at %q: %v)", want, r.Action, r.Chain, r.Err)
+	}
+}
+
+// AssertHeader reports an error if the captured message does not have a
+// header key with value want.
+func (r *Result) AssertHeader(tb testing.TB, key, want string) {
+	tb.Helper()
+	values := r.Header().Values(key)
+	for _, v := range values {
+		if v == want {
+			return
+		}
+	}
+	tb.Errorf("expected header %s: %q, got %q", key, want, values)
+}
+
+// EventType identifies an observer callback.
+type EventType string
+
+// Observer callbacks recorded by Recorder.
+const (
+	SessionStart EventType = "session_start"
+	SessionEnd   EventType = "session_end"
+	ChainStart   EventType = "chain_start"
+	ChainEnd     EventType = "chain_end"
+)
+
+// Event is an observer callback recorded by Recorder.
+type Event struct {
+	Type EventType
+	// Chain is the chain of ChainStart and ChainEnd events.
+	Chain brisa.ChainType
+	// Action is the context action at the time of the event.
+	Action brisa.Action
+	// Duration is the chain duration of ChainEnd events.
+	Duration time.Duration
+}
+
+// Recorder is a brisa.Observer that records the events it receives. It is
+// safe for concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *Recorder) record(e Event) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+// Events returns a copy of the recorded events.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// Chains returns the chains that ran, in order.
+func (r *Recorder) Chains() []brisa.ChainType {
+	var chains []brisa.ChainType
+	for _, e := range r.Events() {
+		if e.Type == ChainStart {
+			chains = append(chains, e.Chain)
+		}
+	}
+	return chains
+}
+
+// OnSessionStart implements brisa.Observer.
+func (r *Recorder) OnSessionStart(ctx *brisa.Context) {
+	r.record(Event{Type: SessionStart, Action: ctx.Action})
+}
+
+// OnSessionEnd implements brisa.Observer.
+func (r *Recorder) OnSessionEnd(ctx *brisa.Context) {
+	r.record(Event{Type: SessionEnd, Action: ctx.Action})
+}
+
+// OnChainStart implements brisa.Observer.
+func (r *Recorder) OnChainStart(ctx *brisa.Context, chainType brisa.ChainType) {
+	r.record(Event{Type: ChainStart, Chain: chainType, Action: ctx.Action})
+}
+
+// OnChainEnd implements brisa.Observer.
+func (r *Recorder) OnChainEnd(ctx *brisa.Context, chainType brisa.ChainType, duration time.Duration) {
+	r.record(Event{Type: ChainEnd, Chain: chainType, Action: ctx.Action, Duration: duration})
+}
@@ -0,0 +1,114 @@
+package brisatest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+)
+
+func TestNewContext(t *testing.T) {
+	env := DefaultEnvelope()
+	env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("198.51.100.7")}
+	ctx := NewContext(t, env, "Subject: hi\r\n\r\nbody\r\n")
+
+	if ip := ctx.Session.GetClientIP().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("expected client IP 198.51.100.7, got %v", ip)
+	}
+	if ctx.From != "sender@example.com" || len(ctx.To) != 1 {
+		t.Errorf("unexpected envelope %q %q", ctx.From, ctx.To)
+	}
+	if msg := ReadMessage(t, ctx); msg != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestRun(t *testing.T) {
+	router := &brisa.Router{}
+	router.OnData(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		ctx.Score = 7
+		ctx.Reader = io.MultiReader(strings.NewReader("X-Spam: yes\r\n"), ctx.Reader)
+		return brisa.Quarantine
+	}})
+	var consumed string
+	router.OnQuarantine(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		data, _ := io.ReadAll(ctx.Reader)
+		consumed = string(data)
+		return brisa.Quarantine
+	}})
+
+	res := Run(t, router, DefaultEnvelope(), "Subject: hi\r\n\r\nbody\r\n")
+	res.AssertAction(t, brisa.Quarantine)
+	res.AssertHeader(t, "X-Spam", "yes")
+	if res.Score != 7 {
+		t.Errorf("expected score 7, got %v", res.Score)
+	}
+	if consumed != string(res.Message) {
+		t.Errorf("expected disposition middleware to see the captured message, got %q", consumed)
+	}
+	if len(*router) != 2 {
+		t.Errorf("expected router to be unchanged, got %v", *router)
+	}
+
+	var chains []brisa.ChainType
+	for _, e := range res.Events {
+		if e.Type == ChainEnd {
+			chains = append(chains, e.Chain)
+		}
+	}
+	want := []brisa.ChainType{brisa.ChainData, brisa.ChainQuarantine}
+	if !reflect.DeepEqual(chains, want) {
+		t.Errorf("expected chains %v, got %v", want, chains)
+	}
+	if res.Events[0].Type != SessionStart || res.Events[len(res.Events)-1].Type != SessionEnd {
+		t.Errorf("expected session events around the chains, got %+v", res.Events)
+	}
+
+	rejecting := &brisa.Router{}
+	rejecting.OnMailFrom(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action { return brisa.Reject }})
+	res = Run(t, rejecting, DefaultEnvelope(), "\r\n")
+	res.AssertAction(t, brisa.Reject)
+	if res.Chain != brisa.ChainMailFrom || res.Message != nil {
+		t.Errorf("expected rejection at mail_from without message, got %+v", res)
+	}
+}
+
+func TestNewBrisa(t *testing.T) {
+	router := &brisa.Router{}
+	router.OnMailFrom(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		if !ctx.HasFlag(brisa.FlagAuthenticated) {
+			return brisa.Reject
+		}
+		return brisa.Pass
+	}})
+	b := NewBrisa(router)
+
+	if res := b.Simulate(AuthEnvelope("alice", "bob@example.com"), strings.NewReader("\r\n")); res.Err != nil {
+		t.Errorf("expected the authenticated transaction to pass, got %v", res.Err)
+	}
+	env := AuthEnvelope("alice")
+	env.Password = "wrong"
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != brisa.ChainAuth {
+		t.Errorf("expected a wrong password to fail AUTH, got %+v", res)
+	}
+	if res := b.Simulate(NewEnvelope("198.51.100.7", "", "bob@example.com"), strings.NewReader("\r\n")); res.Chain != brisa.ChainMailFrom {
+		t.Errorf("expected the anonymous transaction to be rejected at mail_from, got %+v", res)
+	}
+}
+
+func TestFakeResolver(t *testing.T) {
+	r := &FakeResolver{Hosts: map[string][]string{"Listed.Example.": {"127.0.0.2"}}}
+	if addrs, err := r.LookupHost(context.Background(), "listed.example"); err != nil || len(addrs) != 1 {
+		t.Errorf("expected listed host to resolve, got %v %v", addrs, err)
+	}
+	_, err := r.LookupTXT(context.Background(), "listed.example")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
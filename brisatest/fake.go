@@ -0,0 +1,88 @@
+package brisatest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeClock is a brisa.Clock that only moves when told to. It is safe for
+// concurrent use.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements brisa.Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// Set sets the clock to now.
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// FakeResolver is a DNS resolver answering from fixed records, for
+// middleware that take a resolver such as middleware.URLReputationConfig.
+// Names are matched case-insensitively, with or without a trailing dot.
+// Lookups of names without records fail with a not-found *net.DNSError. It
+// must not be modified while in use.
+type FakeResolver struct {
+	// Hosts maps names to addresses for LookupHost.
+	Hosts map[string][]string
+	// TXT maps names to TXT records for LookupTXT.
+	TXT map[string][]string
+	// MX maps names to MX records for LookupMX.
+	MX map[string][]*net.MX
+	// Addrs maps addresses to names for LookupAddr.
+	Addrs map[string][]string
+}
+
+func lookupFake[T any](records map[string][]T, name string) ([]T, error) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	for k, v := range records {
+		if strings.ToLower(strings.TrimSuffix(k, ".")) == key {
+			return v, nil
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// LookupHost implements the resolver interface of the middleware package.
+func (r *FakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return lookupFake(r.Hosts, host)
+}
+
+// LookupTXT returns the TXT records of name.
+func (r *FakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return lookupFake(r.TXT, name)
+}
+
+// LookupMX returns the MX records of name.
+func (r *FakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return lookupFake(r.MX, name)
+}
+
+// LookupAddr returns the names of addr.
+func (r *FakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return lookupFake(r.Addrs, addr)
+}
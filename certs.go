@@ -0,0 +1,81 @@
+package brisa
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Certificates selects the certificate of a TLS handshake by the server name
+// the client asks for (SNI), so that a server hosting several domains presents
+// the certificate of each. It can be reloaded while serving; handshakes in
+// progress keep the certificates they started with.
+type Certificates struct {
+	set atomic.Pointer[certificateSet]
+}
+
+type certificateSet struct {
+	// byName maps lower-case names, possibly wildcards such as
+	// "*.example.com", to their certificates.
+	byName map[string]*tls.Certificate
+	// fallback is presented to clients asking for no or an unknown name.
+	fallback *tls.Certificate
+}
+
+// Load loads the certificates of c and replaces the current ones. On error,
+// the current certificates stay in place.
+func (s *Certificates) Load(c *TLSConfig) error {
+	set := &certificateSet{byName: make(map[string]*tls.Certificate)}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load TLS certificate: %w", err)
+		}
+		set.fallback = &cert
+	}
+	for i, cc := range c.Certificates {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load TLS certificate %d: %w", i, err)
+		}
+		names := cc.Domains
+		if len(names) == 0 {
+			names = cert.Leaf.DNSNames
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("load TLS certificate %d: no domains given or in the certificate", i)
+		}
+		for _, name := range names {
+			set.byName[strings.ToLower(name)] = &cert
+		}
+		if set.fallback == nil {
+			set.fallback = &cert
+		}
+	}
+	if set.fallback == nil {
+		return fmt.Errorf("no TLS certificate configured")
+	}
+	s.set.Store(set)
+	return nil
+}
+
+// GetCertificate returns the certificate for the server name of hello: the
+// one of the name, of a wildcard matching it, or else the default one. It is
+// meant for tls.Config.GetCertificate.
+func (s *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.set.Load()
+	if set == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := set.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := set.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return set.fallback, nil
+}
@@ -0,0 +1,124 @@
+package brisa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成带有指定名称的自签名证书，写入临时文件
+func writeTestCert(t *testing.T, names ...string) CertificateConfig {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cc := CertificateConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	os.WriteFile(cc.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(cc.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return cc
+}
+
+// servedName 返回为 serverName 选择的证书的通用名
+func servedName(t *testing.T, certs *Certificates, serverName string) string {
+	t.Helper()
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertificates(t *testing.T) {
+	def := writeTestCert(t, "mx.example.com")
+	cfg := &TLSConfig{
+		CertFile: def.CertFile,
+		KeyFile:  def.KeyFile,
+		Certificates: []CertificateConfig{
+			writeTestCert(t, "mx.example.org", "*.example.org"),
+			withDomains(writeTestCert(t, "hosted.example.net"), "mail.example.net"),
+		},
+	}
+	certs := new(Certificates)
+	if err := certs.Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"":                 "mx.example.com",
+		"MX.example.org.":  "mx.example.org",
+		"smtp.example.org": "mx.example.org",
+		"a.b.example.org":  "mx.example.com",
+		"mail.example.net": "hosted.example.net",
+		// 配置的 domains 取代证书中的名称
+		"hosted.example.net": "mx.example.com",
+	} {
+		if got := servedName(t, certs, name); got != want {
+			t.Errorf("%q: expected the certificate of %s, got %s", name, want, got)
+		}
+	}
+
+	// 重新加载时替换证书，失败时保留原证书
+	cfg.Certificates = cfg.Certificates[:1]
+	cfg.Certificates[0] = writeTestCert(t, "new.example.org")
+	if err := certs.Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, certs, "new.example.org"); got != "new.example.org" {
+		t.Errorf("expected the reloaded certificate, got %s", got)
+	}
+	cfg.Certificates[0].KeyFile = def.KeyFile
+	if err := certs.Load(cfg); err == nil {
+		t.Error("expected an error for a mismatched key")
+	}
+	if got := servedName(t, certs, "new.example.org"); got != "new.example.org" {
+		t.Errorf("expected the certificates to stay after a failed reload, got %s", got)
+	}
+}
+
+func TestCertificates_NoDefault(t *testing.T) {
+	cfg := &TLSConfig{Certificates: []CertificateConfig{writeTestCert(t, "mx.example.org")}}
+	tlsConfig, err := cfg.Load()
+	if err != nil || tlsConfig == nil {
+		t.Fatalf("expected a TLS configuration, got %v", err)
+	}
+	cert, _ := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"})
+	if cert.Leaf.Subject.CommonName != "mx.example.org" {
+		t.Error("expected the first certificate to be the default")
+	}
+	if err := (&Config{Server: ServerConfig{TLS: TLSConfig{Implicit: true, Certificates: cfg.Certificates}}}).Validate(); err != nil {
+		t.Errorf("expected implicit TLS with per-domain certificates to be valid: %v", err)
+	}
+	if err := (&Config{Server: ServerConfig{TLS: TLSConfig{Certificates: []CertificateConfig{{CertFile: "c.pem"}}}}}).Validate(); err == nil {
+		t.Error("expected an error for a certificate without key")
+	}
+}
+
+func withDomains(cc CertificateConfig, domains ...string) CertificateConfig {
+	cc.Domains = domains
+	return cc
+}
@@ -0,0 +1,22 @@
+package brisa
+
+import "time"
+
+// Clock tells the current time. Components whose behaviour depends on time,
+// such as expiring entries, accept a Clock so that tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the Clock of the local system.
+var SystemClock Clock = systemClock{}
+
+// ClockFunc adapts a function to a Clock.
+type ClockFunc func() time.Time
+
+// Now implements Clock.
+func (f ClockFunc) Now() time.Time { return f() }
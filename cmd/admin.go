@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/muzhy/brisa/adminclient"
+)
+
+const adminUsage = "usage: brisa admin [-url url] [-token-file file] [-insecure] reload | purge ADDRESS"
+
+// runAdmin runs an operation of the debug endpoints of a running server.
+func runAdmin(args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	baseURL := fs.String("url", "http://127.0.0.1:6060", "URL of the debug endpoints (debug.addr)")
+	tokenFile := fs.String("token-file", "", "file holding the bearer token (debug.access[].token_file)")
+	insecure := fs.Bool("insecure", false, "do not verify the server certificate")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New(adminUsage)
+	}
+
+	c := adminclient.New(*baseURL, "")
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		c.Token = string(bytes.TrimSpace(data))
+	}
+	if *insecure {
+		c.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+
+	ctx := context.Background()
+	switch op := fs.Arg(0); {
+	case op == "reload" && fs.NArg() == 1:
+		if err := c.Reload(ctx); err != nil {
+			return err
+		}
+		fmt.Println("reloaded")
+	case op == "purge" && fs.NArg() == 2:
+		n, err := c.Purge(ctx, fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %d keys\n", n)
+	default:
+		return errors.New(adminUsage)
+	}
+	return nil
+}
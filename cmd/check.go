@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/muzhy/brisa"
+	"gopkg.in/yaml.v3"
+)
+
+// chainOrder is the order in which chains run.
+var chainOrder = []brisa.ChainType{
+	brisa.ChainConn, brisa.ChainAuth, brisa.ChainMailFrom, brisa.ChainRcptTo, brisa.ChainData,
+	brisa.ChainPostQueue,
+	brisa.ChainDeliver, brisa.ChainQuarantine, brisa.ChainReject, brisa.ChainDiscard,
+}
+
+// runCheck validates the configuration, builds what brisa.Serve builds from it
+// without listening (see brisa.Check), and prints the effective configuration
+// and the router layout.
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := configFlag(fs)
+	quiet := fs.Bool("q", false, "only report errors")
+	fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	routers, err := brisa.Check(cfg, newRegistry())
+	if err != nil {
+		return err
+	}
+	if *quiet {
+		return nil
+	}
+	return printCheck(os.Stdout, cfg, routers)
+}
+
+func printCheck(w io.Writer, cfg *brisa.Config, routers *brisa.Routers) error {
+	// Show the defaults brisa.Serve uses for unset settings.
+	effective := *cfg
+	if effective.Server.Addr == "" {
+		effective.Server.Addr = ":25"
+	}
+	if effective.Server.ShutdownTimeout == 0 {
+		effective.Server.ShutdownTimeout = brisa.Duration(brisa.DefaultShutdownTimeout)
+	}
+	if effective.Log.Level == "" {
+		effective.Log.Level = "info"
+	}
+	if effective.Log.Format == "" {
+		effective.Log.Format = "text"
+	}
+	if effective.Log.Path == "" {
+		effective.Log.Path = "stdout"
+	}
+	out, err := yaml.Marshal(&effective)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "# effective configuration")
+	w.Write(out)
+
+	fmt.Fprintln(w, "\n# router")
+	printRouter(w, routers.Router)
+	for _, l := range cfg.Listeners {
+		if r := routers.Listeners[l.Name]; r != nil {
+			fmt.Fprintf(w, "\n# router of listener %s\n", l.Name)
+			printRouter(w, r)
+		}
+	}
+	for _, t := range routers.Tenants {
+		fmt.Fprintf(w, "\n# router of tenant %s (%s)\n", t.Name, strings.Join(t.Domains, ", "))
+		printRouter(w, t.Router)
+	}
+	return nil
+}
+
+func printRouter(w io.Writer, router *brisa.Router) {
+	for _, chain := range chainOrder {
+		mws := (*router)[chain]
+		if len(mws) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", chain)
+		for i, m := range mws {
+			fmt.Fprintf(w, "  %d. %s (ignore: %s)\n", i+1, m.Name, m.IgnoreFlags)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+)
+
+func TestPrintCheck(t *testing.T) {
+	registry := brisa.NewRegistry()
+	registry.Register("pass", func(config map[string]any) (brisa.Handler, error) {
+		return func(ctx *brisa.Context) brisa.Action { return brisa.Pass }, nil
+	})
+	cfg := &brisa.Config{
+		Chains:    map[brisa.ChainType][]brisa.MiddlewareConfig{brisa.ChainConn: {{Name: "pass"}}},
+		Listeners: []brisa.ListenerConfig{{Name: "submission", Addr: ":587", Chains: map[brisa.ChainType][]brisa.MiddlewareConfig{brisa.ChainData: {{Name: "pass"}}}}},
+		Tenants:   []brisa.TenantConfig{{Name: "acme", Domains: []string{"acme.example", "acme.test"}}},
+	}
+	routers, err := brisa.Check(cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := printCheck(&buf, cfg, routers); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# effective configuration\n",
+		"addr: :25\n",
+		"# router\nconn:\n  1. pass (ignore: ",
+		"# router of listener submission\ndata:\n  1. pass",
+		"# router of tenant acme (acme.example, acme.test)\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected the output to contain %q, got:\n%s", want, out)
+		}
+	}
+	// 未设置的项显示 Serve 使用的默认值，配置本身不变
+	if cfg.Server.Addr != "" {
+		t.Error("expected the configuration to be left unchanged")
+	}
+}
+
+func TestCheck_BuiltinMiddleware(t *testing.T) {
+	cfg, err := brisa.ParseConfig([]byte(`
+[auth]
+name = "oauth2"
+config = { issuer = "https://idp.example.com", scopes = ["mail.send"] }
+
+[[chains.conn]]
+name = "ip_blacklist"
+config = { ips = ["192.0.2.1", "198.51.100.0/24"] }
+
+[[chains.mail_from]]
+name = "rate_limit"
+config = { limit = 100, window = "1h" }
+
+[[chains.data]]
+name = "dlp"
+config = { action = "quarantine", rules = [{ name = "project", keywords = ["codename"] }] }
+
+[[chains.data]]
+name = "spam_tag"
+`), brisa.FormatTOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := brisa.Check(cfg, newRegistry()); err != nil {
+		t.Fatalf("expected the built-in middleware to be accepted, got %v", err)
+	}
+
+	cfg.Chains[brisa.ChainData][0].Config["action"] = "drop"
+	if _, err := brisa.Check(cfg, newRegistry()); err == nil {
+		t.Error("expected an invalid setting to be rejected")
+	}
+}
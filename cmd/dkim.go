@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runDKIM runs the dkim subcommands.
+func runDKIM(args []string) error {
+	if len(args) == 0 || args[0] != "gen" {
+		return errors.New("usage: brisa dkim gen -domain example.com -selector s1")
+	}
+	return runDKIMGen(args[1:])
+}
+
+// runDKIMGen generates a DKIM key pair, stores the private key as
+// <dir>/<domain>/<selector>.pem and prints the DNS TXT record to publish.
+func runDKIMGen(args []string) error {
+	fs := flag.NewFlagSet("dkim gen", flag.ExitOnError)
+	domain := fs.String("domain", "", "signing domain (d=)")
+	selector := fs.String("selector", "", "selector (s=)")
+	keyType := fs.String("type", "rsa", "key type: rsa or ed25519")
+	bits := fs.Int("bits", 2048, "RSA key size")
+	dir := fs.String("dir", "dkim", "key store directory")
+	force := fs.Bool("f", false, "overwrite an existing key")
+	fs.Parse(args)
+	if *domain == "" || *selector == "" {
+		return errors.New("-domain and -selector are required")
+	}
+
+	var key crypto.Signer
+	var err error
+	switch *keyType {
+	case "rsa":
+		if *bits < 1024 {
+			return fmt.Errorf("RSA keys must have at least 1024 bits, got %d", *bits)
+		}
+		key, err = rsa.GenerateKey(rand.Reader, *bits)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("unsupported key type: %s", *keyType)
+	}
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(*dir, strings.ToLower(*domain), *selector+".pem")
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !*force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "private key written to %s\n", path)
+
+	record, err := dkimRecord(key.Public())
+	if err != nil {
+		return err
+	}
+	printDKIMRecord(os.Stdout, *selector, *domain, record)
+	return nil
+}
+
+// dkimRecord returns the DKIM key record of pub (RFC 6376, RFC 8463).
+func dkimRecord(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", fmt.Errorf("unsupported public key %T", pub)
+	}
+}
+
+// printDKIMRecord prints the TXT record in zone file syntax, split into
+// strings of at most 255 characters.
+func printDKIMRecord(w io.Writer, selector, domain, record string) {
+	var parts []string
+	for len(record) > 255 {
+		parts = append(parts, record[:255])
+		record = record[255:]
+	}
+	parts = append(parts, record)
+	fmt.Fprintf(w, "%s._domainkey.%s. IN TXT ( \"%s\" )\n", selector, strings.TrimSuffix(domain, "."), strings.Join(parts, "\"\n\t\""))
+}
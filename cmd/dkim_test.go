@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDKIMRecord(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := dkimRecord(rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := strings.CutPrefix(record, "v=DKIM1; k=rsa; p=")
+	if !ok {
+		t.Fatalf("unexpected RSA record %q", record)
+	}
+	der, _ := base64.StdEncoding.DecodeString(p)
+	if pub, err := x509.ParsePKIXPublicKey(der); err != nil || !rsaKey.PublicKey.Equal(pub) {
+		t.Errorf("expected the record to hold the public key, got %v", err)
+	}
+
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	record, err = dkimRecord(pub)
+	if err != nil || record != "v=DKIM1; k=ed25519; p="+base64.StdEncoding.EncodeToString(pub) {
+		t.Errorf("unexpected Ed25519 record (%q, %v)", record, err)
+	}
+
+	if _, err := dkimRecord("key"); err == nil {
+		t.Error("expected an error for an unsupported key")
+	}
+}
+
+func TestPrintDKIMRecord(t *testing.T) {
+	// 超过 255 个字符的记录拆成多个字符串
+	record := strings.Repeat("a", 300)
+	var buf bytes.Buffer
+	printDKIMRecord(&buf, "s1", "example.com.", record)
+	want := "s1._domainkey.example.com. IN TXT ( \"" + record[:255] + "\"\n\t\"" + record[255:] + "\" )\n"
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/muzhy/brisa"
+)
+
+// runLog runs the log subcommands.
+func runLog(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errors.New("usage: brisa log verify [-key file] [-continued] FILE...")
+	}
+	return runLogVerify(args[1:])
+}
+
+// runLogVerify checks that the chained log files, given oldest first, have
+// not been altered.
+func runLogVerify(args []string) error {
+	fs := flag.NewFlagSet("log verify", flag.ExitOnError)
+	keyFile := fs.String("key", "", "key file of the chain (log.chain_key_file)")
+	continued := fs.Bool("continued", false, "the first file continues the chain of a removed file")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("no log files given")
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		key = bytes.TrimSpace(data)
+	}
+	v := brisa.NewLogChainVerifier(key)
+	v.Continued = *continued
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = v.Verify(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	fmt.Printf("%d records verified\n", v.Records)
+	return nil
+}
@@ -1,49 +1,119 @@
 package main
 
 import (
-	"github.com/muzhy/brisa"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/emersion/go-smtp"
-
+	"github.com/google/uuid"
+	"github.com/muzhy/brisa"
 	"github.com/muzhy/brisa/middleware"
 )
 
+const usage = `usage: brisa [command] [flags]
+
+commands:
+  serve          run the SMTP server (default)
+  check          validate the configuration and print the effective setup
+  test-message   run a message file through the configured chains
+  dkim gen       generate a DKIM key and print its DNS record
+  send           send test messages to an SMTP server
+  log verify     verify the chain of log files
+  spool decrypt  recover the message of an encrypted spool file
+  admin          reload or purge through the debug endpoints of a server
+`
+
 func main() {
-	// init logger
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
-	// set routter
-	router := brisa.Router{}
-	// create middleware
-	ipBlacklistHandler, err := middleware.NewIPBlacklistHandler([]string{"192.168.1.100"})
-	if err != nil {
-		logger.Error("create IPBlacklist Handler failed")
-		return
+	var err error
+	switch cmd {
+	case "serve":
+		err = runServe(args)
+	case "check":
+		err = runCheck(args)
+	case "test-message":
+		err = runTestMessage(args)
+	case "dkim":
+		err = runDKIM(args)
+	case "send":
+		err = runSend(args)
+	case "log":
+		err = runLog(args)
+	case "spool":
+		err = runSpool(args)
+	case "admin":
+		err = runAdmin(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
-	router.OnConn(&brisa.Middleware{
-		Handler:     ipBlacklistHandler,
-		IgnoreFlags: brisa.DefaultIgnoreFlags,
-	})
-
-	b := brisa.New(logger)
-	b.UpdateRouter(&router)
-
-	// start server
-	s := smtp.NewServer(b)
-	s.Addr = ":1025"
-	s.Domain = "localhost" // 可在配置中添加
-	s.ReadTimeout = 10 * time.Second
-	s.WriteTimeout = 10 * time.Second
-	s.MaxMessageBytes = 1024 * 1024 // 可在配置中添加
-	s.MaxRecipients = 50            // 可在配置中添加
-	s.AllowInsecureAuth = true      // 可在配置中添加
-
-	logger.Info("starting SMTP server...", "address", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
-		logger.Error("server failed to start", "error", err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "brisa %s: %v\n", cmd, err)
 		os.Exit(1)
 	}
 }
+
+// newRegistry returns the registry with the middleware available to
+// configurations: the built-in middleware of the middleware package.
+func newRegistry() *brisa.Registry {
+	registry := brisa.NewRegistry()
+	middleware.Register(registry)
+	return registry
+}
+
+// configFlag adds the -c flag to fs.
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("c", "", "path to the configuration file (YAML, JSON or TOML)")
+}
+
+// loadConfig loads the configuration at path, or returns the default
+// configuration if path is empty.
+func loadConfig(path string) (*brisa.Config, error) {
+	if path == "" {
+		return defaultConfig(), nil
+	}
+	return brisa.LoadConfig(path)
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := configFlag(fs)
+	fs.Parse(args)
+
+	// Draw the session and mail IDs from a pool instead of reading the
+	// system random source for each.
+	uuid.EnableRandPool()
+
+	// init logger
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	if *configPath != "" {
+		return brisa.ServeFile(*configPath, newRegistry())
+	}
+	return brisa.Serve(defaultConfig(), newRegistry())
+}
+
+// defaultConfig is used when no configuration file is given.
+func defaultConfig() *brisa.Config {
+	return &brisa.Config{
+		Server: brisa.ServerConfig{
+			Addr:              ":1025",
+			Domain:            "localhost",
+			ReadTimeout:       brisa.Duration(10 * time.Second),
+			WriteTimeout:      brisa.Duration(10 * time.Second),
+			MaxMessageBytes:   1024 * 1024,
+			MaxRecipients:     50,
+			AllowInsecureAuth: true,
+		},
+		Chains: map[brisa.ChainType][]brisa.MiddlewareConfig{
+			brisa.ChainConn: {{Name: "ip_blacklist", Config: map[string]any{"ips": []any{"192.168.1.100"}}}},
+		},
+	}
+}
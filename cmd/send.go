@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+// sendOptions configures runSend.
+type sendOptions struct {
+	server    string
+	helo      string
+	from      string
+	to        []string
+	message   []byte
+	startTLS  bool
+	implicit  bool
+	tlsConfig *tls.Config
+	auth      sasl.Client
+}
+
+// runSend sends test messages to an SMTP server, optionally concurrently and
+// at a limited rate, and reports the throughput.
+func runSend(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	server := fs.String("server", "localhost:25", "SMTP server address")
+	helo := fs.String("helo", "", "EHLO name (default: localhost)")
+	from := fs.String("from", "sender@example.com", "envelope sender")
+	to := fs.String("to", "recipient@example.com", "comma-separated envelope recipients")
+	data := fs.String("data", "", "message file to send (default: a generated message)")
+	count := fs.Int("n", 1, "number of messages")
+	concurrency := fs.Int("concurrency", 1, "number of parallel connections")
+	rate := fs.Float64("rate", 0, "maximum messages per second (0: unlimited)")
+	startTLS := fs.Bool("starttls", false, "require STARTTLS")
+	implicit := fs.Bool("tls", false, "connect with implicit TLS")
+	insecure := fs.Bool("insecure", false, "do not verify the server certificate")
+	user := fs.String("user", "", "AUTH PLAIN user name")
+	password := fs.String("password", "", "AUTH PLAIN password")
+	fs.Parse(args)
+	if *count < 1 || *concurrency < 1 || *rate < 0 {
+		return errors.New("-n and -concurrency must be positive and -rate must not be negative")
+	}
+
+	opts := &sendOptions{
+		server:   *server,
+		helo:     *helo,
+		from:     *from,
+		to:       strings.Split(*to, ","),
+		startTLS: *startTLS,
+		implicit: *implicit,
+	}
+	if *startTLS || *implicit {
+		host, _, err := net.SplitHostPort(*server)
+		if err != nil {
+			return fmt.Errorf("-server: %w", err)
+		}
+		opts.tlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: *insecure}
+	}
+	if *user != "" {
+		opts.auth = sasl.NewPlainClient("", *user, *password)
+	}
+	if *data != "" {
+		message, err := os.ReadFile(*data)
+		if err != nil {
+			return err
+		}
+		opts.message = message
+	}
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if *rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := 0; i < *count; i++ {
+			if tick != nil && i > 0 {
+				<-tick
+			}
+			jobs <- i
+		}
+	}()
+
+	var sent, failed atomic.Int64
+	var errMu sync.Mutex
+	var firstErr error
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := sendOne(opts, i); err != nil {
+					failed.Add(1)
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+					continue
+				}
+				sent.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("sent %d, failed %d in %v (%.1f msg/s)\n", sent.Load(), failed.Load(), elapsed.Round(time.Millisecond), float64(sent.Load())/elapsed.Seconds())
+	if firstErr != nil {
+		return fmt.Errorf("%d messages failed, first error: %w", failed.Load(), firstErr)
+	}
+	return nil
+}
+
+// sendOne sends message number i over a new connection.
+func sendOne(opts *sendOptions, i int) error {
+	var c *smtp.Client
+	var err error
+	switch {
+	case opts.implicit:
+		c, err = smtp.DialTLS(opts.server, opts.tlsConfig)
+	case opts.startTLS:
+		c, err = smtp.DialStartTLS(opts.server, opts.tlsConfig)
+	default:
+		c, err = smtp.Dial(opts.server)
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if opts.helo != "" {
+		if err := c.Hello(opts.helo); err != nil {
+			return err
+		}
+	}
+	if opts.auth != nil {
+		if err := c.Auth(opts.auth); err != nil {
+			return err
+		}
+	}
+	message := opts.message
+	if message == nil {
+		message = testMessage(opts.from, opts.to, i)
+	}
+	if err := c.SendMail(opts.from, opts.to, bytes.NewReader(message)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// testMessage generates message number i.
+func testMessage(from string, to []string, i int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "From: <%s>\r\n", from)
+	fmt.Fprintf(&b, "To: <%s>\r\n", strings.Join(to, ">, <"))
+	fmt.Fprintf(&b, "Subject: brisa test message %d\r\n", i+1)
+	fmt.Fprintf(&b, "Message-ID: <%s@brisa.test>\r\n", uuid.NewString())
+	fmt.Fprintf(&b, "\r\nThis is test message %d sent by brisa send.\r\n", i+1)
+	return b.Bytes()
+}
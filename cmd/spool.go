@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/muzhy/brisa"
+)
+
+// runSpool runs the spool subcommands.
+func runSpool(args []string) error {
+	if len(args) == 0 || args[0] != "decrypt" {
+		return errors.New("usage: brisa spool decrypt -key file[,file...] FILE")
+	}
+	return runSpoolDecrypt(args[1:])
+}
+
+// runSpoolDecrypt writes the message of an encrypted spool file, e.g. one
+// left by a crash, to stdout.
+func runSpoolDecrypt(args []string) error {
+	fs := flag.NewFlagSet("spool decrypt", flag.ExitOnError)
+	keyFiles := fs.String("key", "", "comma-separated key files (server.spool_key_files)")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *keyFiles == "" {
+		return errors.New("usage: brisa spool decrypt -key file[,file...] FILE")
+	}
+
+	keys, err := brisa.LoadSpoolKeyring(strings.Split(*keyFiles, ",")...)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return brisa.DecryptSpool(os.Stdout, f, keys)
+}
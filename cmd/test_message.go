@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/muzhy/brisa"
+)
+
+// runTestMessage feeds a message file through the configured chains in
+// process and prints the verdict of every middleware that ran and the final
+// action.
+func runTestMessage(args []string) error {
+	fs := flag.NewFlagSet("test-message", flag.ExitOnError)
+	configPath := configFlag(fs)
+	from := fs.String("from", "", "envelope sender (default: From header)")
+	to := fs.String("to", "", "comma-separated envelope recipients (default: To and Cc headers)")
+	ip := fs.String("ip", "127.0.0.1", "client IP address")
+	listener := fs.String("listener", "", "name of the listener the client connects to (default: server.addr)")
+	dispositions := fs.Bool("dispositions", false, "also run the deliver, quarantine and discard chains")
+	verbose := fs.Bool("v", false, "log at debug level")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: brisa test-message [flags] message.eml")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	clientIP := net.ParseIP(*ip)
+	if clientIP == nil {
+		return fmt.Errorf("invalid client IP: %s", *ip)
+	}
+	env := brisa.Envelope{ClientAddr: &net.TCPAddr{IP: clientIP}, Listener: *listener, From: *from}
+	env.To = splitRecipients(*to)
+	if env.From == "" || len(env.To) == 0 {
+		if err := envelopeFromHeaders(&env, data); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *listener != "" && !slices.ContainsFunc(cfg.Listeners, func(l brisa.ListenerConfig) bool { return l.Name == *listener }) {
+		return fmt.Errorf("unknown listener: %s", *listener)
+	}
+	registry := newRegistry()
+	registry.SetStore(brisa.NewMemoryStore())
+	routers, err := brisa.BuildRouters(registry, cfg)
+	if err != nil {
+		return err
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	b := brisa.New(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	// Route the message the way brisa.Serve would: by the router of its
+	// listener, and by the tenant of its first recipient.
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHAIN\tMIDDLEWARE\tVERDICT")
+	prepare := func(router *brisa.Router) {
+		if !*dispositions {
+			delete(*router, brisa.ChainDeliver)
+			delete(*router, brisa.ChainQuarantine)
+			delete(*router, brisa.ChainDiscard)
+		}
+		traceRouter(router, w)
+	}
+	prepare(routers.Router)
+	b.UpdateRouter(routers.Router)
+	for name, router := range routers.Listeners {
+		prepare(router)
+		b.UpdateListenerRouter(name, router)
+	}
+	for _, t := range routers.Tenants {
+		prepare(t.Router)
+	}
+	if err := b.SetTenants(routers.Tenants); err != nil {
+		return err
+	}
+
+	result := b.Simulate(env, bytes.NewReader(data))
+	w.Flush()
+
+	fmt.Println()
+	for _, rcpt := range env.To {
+		if err := result.RcptErrors[rcpt]; err != nil {
+			fmt.Printf("recipient %s refused: %v\n", rcpt, err)
+		}
+	}
+	if result.Err != nil {
+		fmt.Printf("rejected at %s: %v\n", result.Chain, result.Err)
+	}
+	fmt.Printf("final action: %s\n", result.Action)
+	return nil
+}
+
+// traceRouter wraps the handlers of router to print their verdicts to w.
+func traceRouter(router *brisa.Router, w io.Writer) {
+	for chain, mws := range *router {
+		for i := range mws {
+			name, handler := mws[i].Name, mws[i].Handler
+			mws[i].Handler = func(ctx *brisa.Context) brisa.Action {
+				action := handler(ctx)
+				fmt.Fprintf(w, "%s\t%s\t%s\n", chain, name, action)
+				return action
+			}
+		}
+	}
+}
+
+// splitRecipients splits a comma-separated list of recipients, as in
+// "-to 'a@example.com, b@example.com'".
+func splitRecipients(s string) []string {
+	var rcpts []string
+	for _, rcpt := range strings.Split(s, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	return rcpts
+}
+
+// envelopeFromHeaders fills the unset envelope addresses from the From, To
+// and Cc headers of the message.
+func envelopeFromHeaders(env *brisa.Envelope, data []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("read message header: %w", err)
+	}
+	if env.From == "" {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			env.From = addr.Address
+		}
+	}
+	if len(env.To) == 0 {
+		for _, key := range []string{"To", "Cc"} {
+			addrs, _ := msg.Header.AddressList(key)
+			for _, addr := range addrs {
+				env.To = append(env.To, addr.Address)
+			}
+		}
+		if len(env.To) == 0 {
+			return errors.New("no recipients: use -to or a message with a To header")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/muzhy/brisa"
+)
+
+func TestSplitRecipients(t *testing.T) {
+	if got, want := splitRecipients("a@example.com, b@example.com ,,"), []string{"a@example.com", "b@example.com"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := splitRecipients(""); len(got) != 0 {
+		t.Errorf("expected no recipients, got %v", got)
+	}
+}
+
+func TestEnvelopeFromHeaders(t *testing.T) {
+	msg := []byte("From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.org, Carol <carol@example.org>\r\n" +
+		"Cc: dave@example.net\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"body\r\n")
+
+	var env brisa.Envelope
+	if err := envelopeFromHeaders(&env, msg); err != nil {
+		t.Fatal(err)
+	}
+	if env.From != "alice@example.com" {
+		t.Errorf("expected alice@example.com, got %q", env.From)
+	}
+	if want := []string{"bob@example.org", "carol@example.org", "dave@example.net"}; !slices.Equal(env.To, want) {
+		t.Errorf("expected %v, got %v", want, env.To)
+	}
+
+	// 已设置的地址不被覆盖
+	env = brisa.Envelope{From: "bounce@example.com", To: []string{"eve@example.org"}}
+	if err := envelopeFromHeaders(&env, msg); err != nil {
+		t.Fatal(err)
+	}
+	if env.From != "bounce@example.com" || !slices.Equal(env.To, []string{"eve@example.org"}) {
+		t.Errorf("expected the envelope to be kept, got %+v", env)
+	}
+
+	env = brisa.Envelope{}
+	if err := envelopeFromHeaders(&env, []byte("From: alice@example.com\r\n\r\nbody\r\n")); err == nil {
+		t.Error("expected an error for a message without recipients")
+	}
+}
@@ -0,0 +1,107 @@
+package brisa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muzhy/brisa/address"
+)
+
+// Condition reports whether a middleware should run for ctx; see
+// Middleware.Condition.
+type Condition func(ctx *Context) bool
+
+// ParseCondition parses a condition expression as used by the only_if and
+// skip_if settings of a middleware:
+//
+//   - a flag name, e.g. "authenticated", holds if the flag is set (see ParseFlag).
+//   - "rcpt_domain:example.com" holds if a recipient is in the domain.
+//   - "sender_domain:example.com" holds if the sender is in the domain.
+//   - "listener:submission" holds for sessions of the listener (see Brisa.Listener).
+//   - "tenant:acme" holds for transactions of the tenant (see Tenant).
+//
+// A leading "!" negates the condition, e.g. "!trusted". Domains are compared
+// with address.EqualDomains, so either IDN form matches.
+func ParseCondition(expr string) (Condition, error) {
+	expr = strings.TrimSpace(expr)
+	if rest, ok := strings.CutPrefix(expr, "!"); ok {
+		cond, err := ParseCondition(rest)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *Context) bool { return !cond(ctx) }, nil
+	}
+
+	kind, arg, ok := strings.Cut(expr, ":")
+	if !ok {
+		flag, err := ParseFlag(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition %q: %w", expr, err)
+		}
+		return func(ctx *Context) bool { return ctx.HasFlag(flag) }, nil
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("invalid condition %q: missing argument", expr)
+	}
+	switch kind {
+	case "listener":
+		return func(ctx *Context) bool { return ctx.Session != nil && ctx.Session.Listener() == arg }, nil
+	case "tenant":
+		return func(ctx *Context) bool { return ctx.tenant == arg }, nil
+	case "rcpt_domain":
+		return func(ctx *Context) bool {
+			for _, to := range ctx.To {
+				if address.EqualDomains(address.Domain(to), arg) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "sender_domain":
+		return func(ctx *Context) bool { return address.EqualDomains(address.Domain(ctx.From), arg) }, nil
+	default:
+		return nil, fmt.Errorf("invalid condition %q: unknown kind %q", expr, kind)
+	}
+}
+
+// conditions returns the Condition of a middleware with the given only_if
+// and skip_if expressions: it holds if all of onlyIf and none of skipIf
+// hold. It returns nil if there are no expressions.
+func conditions(onlyIf, skipIf []string) (Condition, error) {
+	if len(onlyIf) == 0 && len(skipIf) == 0 {
+		return nil, nil
+	}
+	only, err := parseConditions(onlyIf)
+	if err != nil {
+		return nil, fmt.Errorf("only_if: %w", err)
+	}
+	skip, err := parseConditions(skipIf)
+	if err != nil {
+		return nil, fmt.Errorf("skip_if: %w", err)
+	}
+	return func(ctx *Context) bool {
+		for _, cond := range only {
+			if !cond(ctx) {
+				return false
+			}
+		}
+		for _, cond := range skip {
+			if cond(ctx) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func parseConditions(exprs []string) ([]Condition, error) {
+	conds := make([]Condition, 0, len(exprs))
+	for _, expr := range exprs {
+		cond, err := ParseCondition(expr)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
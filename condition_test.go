@@ -0,0 +1,79 @@
+package brisa
+
+import "testing"
+
+func TestParseCondition(t *testing.T) {
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	ctx.From = "alice@Example.com"
+	ctx.To = []string{"bob@example.org", "carol@example.net", "dave@xn--bcher-kva.example"}
+	ctx.SetFlag(FlagAuthenticated)
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"authenticated", true},
+		{"!authenticated", false},
+		{"trusted", false},
+		{"!trusted", true},
+		{"rcpt_domain:example.net", true},
+		{"rcpt_domain:example.com", false},
+		{"sender_domain:example.com", true},
+		{"!sender_domain:example.com", false},
+		{"rcpt_domain:bücher.example", true},
+	}
+	for _, tt := range tests {
+		cond, err := ParseCondition(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCondition(%q): %v", tt.expr, err)
+		}
+		if got := cond(ctx); got != tt.want {
+			t.Errorf("%q: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	for _, expr := range []string{"vip", "rcpt_domain:", "listener_x:25", "!"} {
+		if _, err := ParseCondition(expr); err == nil {
+			t.Errorf("expected an error for %q", expr)
+		}
+	}
+}
+
+func TestMiddlewareChain_Condition(t *testing.T) {
+	ran := false
+	cond, err := conditions([]string{"!authenticated"}, []string{"rcpt_domain:example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := MiddlewareChain{{Name: "auth_check", Condition: cond, Handler: func(ctx *Context) Action {
+		ran = true
+		return Pass
+	}}}
+
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	ctx.To = []string{"bob@example.net"}
+	chain.Execute(ctx)
+	if !ran {
+		t.Fatal("expected the middleware to run for an unauthenticated client")
+	}
+
+	// 已认证的客户端跳过该中间件，并记录在跟踪中。
+	ran = false
+	ctx.SetFlag(FlagAuthenticated)
+	chain.Execute(ctx)
+	if ran {
+		t.Error("expected the middleware to be skipped for an authenticated client")
+	}
+	if trace := ctx.Trace(); !trace[len(trace)-1].Skipped {
+		t.Errorf("expected a skipped step, got %+v", trace)
+	}
+
+	ctx.ClearFlag(FlagAuthenticated)
+	ctx.To = append(ctx.To, "carol@example.org")
+	chain.Execute(ctx)
+	if ran {
+		t.Error("expected skip_if to skip the middleware")
+	}
+}
@@ -0,0 +1,848 @@
+package brisa
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa/address"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFormat is the file format of a configuration.
+type ConfigFormat string
+
+const (
+	FormatYAML ConfigFormat = "yaml"
+	FormatJSON ConfigFormat = "json"
+	FormatTOML ConfigFormat = "toml"
+)
+
+// Config is the configuration of a Brisa server. The same structure can be
+// written in YAML, JSON or TOML; keys are snake_case in all formats.
+type Config struct {
+	// Include lists further configuration files merged into this one. Entries
+	// are relative to the including file and may be glob patterns or
+	// directories, in which case all configuration files of the directory are
+	// included in lexical order (a conf.d directory).
+	Include []string `yaml:"include" json:"include" toml:"include"`
+
+	Server ServerConfig `yaml:"server" json:"server" toml:"server"`
+	Log    LogConfig    `yaml:"log" json:"log" toml:"log"`
+	// Debug enables the expvar and pprof HTTP endpoints.
+	Debug DebugConfig `yaml:"debug" json:"debug" toml:"debug"`
+	// Auth enables AUTH with an authenticator of the Registry; see
+	// Brisa.SetAuthenticator.
+	Auth AuthConfig `yaml:"auth" json:"auth" toml:"auth"`
+	// Chains lists the middleware of each chain, in execution order. The
+	// middleware are created by the factories of a Registry.
+	Chains map[ChainType][]MiddlewareConfig `yaml:"chains" json:"chains" toml:"chains"`
+	// Listeners are served in addition to server.addr, e.g. a submission port.
+	Listeners []ListenerConfig `yaml:"listeners" json:"listeners" toml:"listeners"`
+	// Tenants are hosted customers with chains of their own; see Tenant.
+	Tenants []TenantConfig `yaml:"tenants" json:"tenants" toml:"tenants"`
+	// Store configures the state shared by the middleware.
+	Store StoreConfig `yaml:"store" json:"store" toml:"store"`
+}
+
+// TenantConfig configures a Tenant.
+type TenantConfig struct {
+	Name    string   `yaml:"name" json:"name" toml:"name"`
+	Domains []string `yaml:"domains" json:"domains" toml:"domains"`
+	// Chains are the chains of the tenant, from rcpt_to on.
+	Chains map[ChainType][]MiddlewareConfig `yaml:"chains" json:"chains" toml:"chains"`
+}
+
+// AuthConfig selects the authenticator checking AUTH credentials.
+type AuthConfig struct {
+	// Name is the name of an authenticator factory of the Registry. Empty
+	// disables AUTH.
+	Name   string         `yaml:"name" json:"name" toml:"name"`
+	Config map[string]any `yaml:"config" json:"config" toml:"config"`
+	// Mechanisms restricts the offered SASL mechanisms, e.g.
+	// [SCRAM-SHA-256]; see Brisa.SetAuthMechanisms. When omitted, all
+	// mechanisms the authenticator supports are offered.
+	Mechanisms []string `yaml:"mechanisms" json:"mechanisms" toml:"mechanisms"`
+}
+
+// ListenerConfig configures an additional listener of the server. It shares
+// the server settings, including TLS, and can have chains of its own.
+type ListenerConfig struct {
+	// Name identifies the listener in Session.Listener and in "listener:"
+	// conditions. It is required and unique.
+	Name string `yaml:"name" json:"name" toml:"name"`
+	Addr string `yaml:"addr" json:"addr" toml:"addr"`
+	// ImplicitTLS serves TLS from the first byte, e.g. on port 465, with the
+	// certificate of server.tls.
+	ImplicitTLS bool `yaml:"implicit_tls" json:"implicit_tls" toml:"implicit_tls"`
+	// Hostname replaces server.hostname in the greeting and EHLO response of
+	// the listener, e.g. to match the reverse DNS of its address.
+	Hostname string `yaml:"hostname" json:"hostname" toml:"hostname"`
+	// Chains replace the top-level chains for the sessions of the listener.
+	// When omitted, the top-level chains apply.
+	Chains map[ChainType][]MiddlewareConfig `yaml:"chains" json:"chains" toml:"chains"`
+	// AuthMechanisms replaces auth.mechanisms for the sessions of the
+	// listener.
+	AuthMechanisms []string `yaml:"auth_mechanisms" json:"auth_mechanisms" toml:"auth_mechanisms"`
+}
+
+// ServerConfig holds the settings of the SMTP server. Zero values leave the
+// defaults of go-smtp in place.
+type ServerConfig struct {
+	Addr string `yaml:"addr" json:"addr" toml:"addr"`
+	// Domain is the domain of the server. It is announced in the greeting and
+	// the EHLO response unless Hostname is set.
+	Domain string `yaml:"domain" json:"domain" toml:"domain"`
+	// Hostname is the host name advertised in the greeting and EHLO response,
+	// when it differs from Domain (e.g. "mx1.example.com").
+	Hostname     string   `yaml:"hostname" json:"hostname" toml:"hostname"`
+	ReadTimeout  Duration `yaml:"read_timeout" json:"read_timeout" toml:"read_timeout"`
+	WriteTimeout Duration `yaml:"write_timeout" json:"write_timeout" toml:"write_timeout"`
+	// MaxIdleTime is the longest a client may stay silent between commands.
+	// go-smtp enforces it through the read deadline, so it lowers the read
+	// timeout when that is larger.
+	MaxIdleTime     Duration `yaml:"max_idle_time" json:"max_idle_time" toml:"max_idle_time"`
+	MaxMessageBytes int64    `yaml:"max_message_bytes" json:"max_message_bytes" toml:"max_message_bytes"`
+	MaxRecipients   int      `yaml:"max_recipients" json:"max_recipients" toml:"max_recipients"`
+	MaxLineLength   int      `yaml:"max_line_length" json:"max_line_length" toml:"max_line_length"`
+	// MaxCommands, MaxErrors, MinDataRate (bytes per second) and
+	// MaxSessionTime close abusive sessions; see ProtocolLimits.
+	MaxCommands    int      `yaml:"max_commands" json:"max_commands" toml:"max_commands"`
+	MaxErrors      int      `yaml:"max_errors" json:"max_errors" toml:"max_errors"`
+	MinDataRate    int64    `yaml:"min_data_rate" json:"min_data_rate" toml:"min_data_rate"`
+	MaxSessionTime Duration `yaml:"max_session_time" json:"max_session_time" toml:"max_session_time"`
+	// MaxConcurrentData, DataWait and BusyRetryAfter bound the messages
+	// processed at once; see DataGateConfig.
+	MaxConcurrentData int      `yaml:"max_concurrent_data" json:"max_concurrent_data" toml:"max_concurrent_data"`
+	DataWait          Duration `yaml:"data_wait" json:"data_wait" toml:"data_wait"`
+	BusyRetryAfter    Duration `yaml:"busy_retry_after" json:"busy_retry_after" toml:"busy_retry_after"`
+	// SpoolMaxMemory, SpoolDir, SpoolEncrypt and SpoolKeyFiles bound the
+	// memory of message spools and protect those that overflow; see
+	// SpoolConfig. SpoolKeyFiles are the keys of a SpoolKeyring, the current
+	// one first.
+	SpoolMaxMemory int64    `yaml:"spool_max_memory" json:"spool_max_memory" toml:"spool_max_memory"`
+	SpoolDir       string   `yaml:"spool_dir" json:"spool_dir" toml:"spool_dir"`
+	SpoolEncrypt   bool     `yaml:"spool_encrypt" json:"spool_encrypt" toml:"spool_encrypt"`
+	SpoolKeyFiles  []string `yaml:"spool_key_files" json:"spool_key_files" toml:"spool_key_files"`
+	// GreetDelay holds back the greeting of plain listeners to detect early
+	// talkers; see NewGreetListener.
+	GreetDelay        Duration `yaml:"greet_delay" json:"greet_delay" toml:"greet_delay"`
+	AllowInsecureAuth bool     `yaml:"allow_insecure_auth" json:"allow_insecure_auth" toml:"allow_insecure_auth"`
+	// EnableDSN advertises DSN (RFC 3461) so that clients can pass the NOTIFY,
+	// ORCPT, RET and ENVID parameters, found in the envelope options.
+	EnableDSN bool `yaml:"enable_dsn" json:"enable_dsn" toml:"enable_dsn"`
+	// EnableSMTPUTF8 advertises SMTPUTF8 (RFC 6531) so that clients can send
+	// internationalized addresses and header fields; see Context.SMTPUTF8.
+	EnableSMTPUTF8 bool `yaml:"enable_smtputf8" json:"enable_smtputf8" toml:"enable_smtputf8"`
+	// EnableMTPriority advertises MT-PRIORITY (RFC 6710) so that clients can
+	// pass a priority per recipient.
+	EnableMTPriority bool `yaml:"enable_mt_priority" json:"enable_mt_priority" toml:"enable_mt_priority"`
+	// DeferReject postpones conn and mail_from rejections until DATA, so the
+	// reject chain can capture the messages of rejected clients; see
+	// Brisa.SetDeferredRejection.
+	DeferReject bool `yaml:"defer_reject" json:"defer_reject" toml:"defer_reject"`
+	// RejectMessage is a ReplyTemplate for the text of the reply to commands
+	// rejected by policy, e.g. "Rejected, see https://example.com/help?id={{.MailID}}".
+	RejectMessage string `yaml:"reject_message" json:"reject_message" toml:"reject_message"`
+	// PostQueueWorkers and PostQueueSize configure the post-queue stage,
+	// started when the post_queue chain has middleware; see PostQueueConfig.
+	PostQueueWorkers int `yaml:"post_queue_workers" json:"post_queue_workers" toml:"post_queue_workers"`
+	PostQueueSize    int `yaml:"post_queue_size" json:"post_queue_size" toml:"post_queue_size"`
+	// HookWorkers and HookQueueSize configure the workers running the hooks
+	// of accepted messages; see HookConfig.
+	HookWorkers   int `yaml:"hook_workers" json:"hook_workers" toml:"hook_workers"`
+	HookQueueSize int `yaml:"hook_queue_size" json:"hook_queue_size" toml:"hook_queue_size"`
+	// ShutdownTimeout bounds the time Serve waits for open sessions on
+	// shutdown. Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout Duration  `yaml:"shutdown_timeout" json:"shutdown_timeout" toml:"shutdown_timeout"`
+	TLS             TLSConfig `yaml:"tls" json:"tls" toml:"tls"`
+}
+
+// Apply copies the settings to s. Zero values are skipped, so fields of s that
+// are not configured keep their value.
+func (c *ServerConfig) Apply(s *smtp.Server) {
+	if c.Addr != "" {
+		s.Addr = c.Addr
+	}
+	if c.Hostname != "" {
+		s.Domain = c.Hostname
+	} else if c.Domain != "" {
+		s.Domain = c.Domain
+	}
+	if c.ReadTimeout > 0 {
+		s.ReadTimeout = time.Duration(c.ReadTimeout)
+	}
+	if c.MaxIdleTime > 0 && (s.ReadTimeout == 0 || time.Duration(c.MaxIdleTime) < s.ReadTimeout) {
+		s.ReadTimeout = time.Duration(c.MaxIdleTime)
+	}
+	if c.WriteTimeout > 0 {
+		s.WriteTimeout = time.Duration(c.WriteTimeout)
+	}
+	if c.MaxMessageBytes > 0 {
+		s.MaxMessageBytes = c.MaxMessageBytes
+	}
+	if c.MaxRecipients > 0 {
+		s.MaxRecipients = c.MaxRecipients
+	}
+	if c.MaxLineLength > 0 {
+		s.MaxLineLength = c.MaxLineLength
+	}
+	if c.AllowInsecureAuth {
+		s.AllowInsecureAuth = true
+	}
+	if c.EnableDSN {
+		s.EnableDSN = true
+	}
+	if c.EnableSMTPUTF8 {
+		s.EnableSMTPUTF8 = true
+	}
+	if c.EnableMTPriority {
+		s.EnableMTPRIORITY = true
+	}
+}
+
+// ProtocolLimits returns the protocol limits of the settings.
+func (c *ServerConfig) ProtocolLimits() ProtocolLimits {
+	return ProtocolLimits{
+		MaxCommands:    c.MaxCommands,
+		MaxErrors:      c.MaxErrors,
+		MinDataRate:    c.MinDataRate,
+		MaxSessionTime: time.Duration(c.MaxSessionTime),
+	}
+}
+
+// DataGate returns the data gate of the configuration.
+func (c *ServerConfig) DataGate() DataGateConfig {
+	return DataGateConfig{
+		MaxConcurrent: c.MaxConcurrentData,
+		MaxWait:       time.Duration(c.DataWait),
+		RetryAfter:    time.Duration(c.BusyRetryAfter),
+	}
+}
+
+// Spool returns the spool configuration of the settings, with the keys of
+// SpoolKeyFiles loaded.
+func (c *ServerConfig) Spool() (SpoolConfig, error) {
+	cfg := SpoolConfig{MaxMemory: c.SpoolMaxMemory, Dir: c.SpoolDir, Encrypt: c.SpoolEncrypt}
+	if len(c.SpoolKeyFiles) > 0 {
+		keys, err := LoadSpoolKeyring(c.SpoolKeyFiles...)
+		if err != nil {
+			return SpoolConfig{}, err
+		}
+		cfg.Keys = keys
+	}
+	return cfg, nil
+}
+
+// MiddlewareConfig names a registered middleware factory and the config map
+// passed to it.
+type MiddlewareConfig struct {
+	Name   string         `yaml:"name" json:"name" toml:"name"`
+	Config map[string]any `yaml:"config" json:"config" toml:"config"`
+	// IgnoreFlags lists the actions ("deliver", "quarantine", "discard") for
+	// which the middleware is skipped. When omitted, middleware of the SMTP
+	// event chains use DefaultIgnoreFlags and those of the disposition chains
+	// are never skipped.
+	IgnoreFlags []string `yaml:"ignore_flags" json:"ignore_flags" toml:"ignore_flags"`
+	// OnlyIf and SkipIf are condition expressions (see ParseCondition): the
+	// middleware only runs if all of OnlyIf and none of SkipIf hold, e.g.
+	// only_if: ["!authenticated"].
+	OnlyIf []string `yaml:"only_if" json:"only_if" toml:"only_if"`
+	SkipIf []string `yaml:"skip_if" json:"skip_if" toml:"skip_if"`
+	// RejectMessage is a ReplyTemplate for the text of the replies to the
+	// commands the middleware rejects.
+	RejectMessage string `yaml:"reject_message" json:"reject_message" toml:"reject_message"`
+	// MaxScanBytes limits the message the middleware reads to its first
+	// bytes; see Middleware.MaxScanBytes.
+	MaxScanBytes int64 `yaml:"max_scan_bytes" json:"max_scan_bytes" toml:"max_scan_bytes"`
+}
+
+var ignoreFlagNames = map[string]Action{
+	"deliver":    IgnoreDeliver,
+	"quarantine": IgnoreQuarantine,
+	"discard":    IgnoreDiscard,
+}
+
+// hasPostQueue reports whether the top-level chains or those of a listener
+// or a tenant have a post_queue chain.
+func (c *Config) hasPostQueue() bool {
+	if len(c.Chains[ChainPostQueue]) > 0 {
+		return true
+	}
+	for _, l := range c.Listeners {
+		if len(l.Chains[ChainPostQueue]) > 0 {
+			return true
+		}
+	}
+	for _, t := range c.Tenants {
+		if len(t.Chains[ChainPostQueue]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validateChains checks the chains configured under prefix.
+func validateChains(prefix string, c map[ChainType][]MiddlewareConfig) []error {
+	var errs []error
+	chains := make([]string, 0, len(c))
+	for chain := range c {
+		chains = append(chains, string(chain))
+	}
+	sort.Strings(chains)
+	for _, chain := range chains {
+		if !knownChains[ChainType(chain)] {
+			errs = append(errs, fmt.Errorf("%s.%s: unknown chain", prefix, chain))
+			continue
+		}
+		for i, m := range c[ChainType(chain)] {
+			if m.Name == "" {
+				errs = append(errs, fmt.Errorf("%s.%s[%d].name: required", prefix, chain, i))
+			}
+			if _, err := m.ignoreFlags(ChainType(chain)); err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s[%d].ignore_flags: %w", prefix, chain, i, err))
+			}
+			if _, err := conditions(m.OnlyIf, m.SkipIf); err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s[%d].%w", prefix, chain, i, err))
+			}
+			if m.RejectMessage != "" {
+				if _, err := NewReplyTemplate(m.RejectMessage); err != nil {
+					errs = append(errs, fmt.Errorf("%s.%s[%d].reject_message: %w", prefix, chain, i, err))
+				}
+			}
+			if m.MaxScanBytes < 0 {
+				errs = append(errs, fmt.Errorf("%s.%s[%d].max_scan_bytes: must not be negative", prefix, chain, i))
+			}
+		}
+	}
+	return errs
+}
+
+// ignoreFlags returns the IgnoreFlags of the middleware in the given chain.
+func (m *MiddlewareConfig) ignoreFlags(chain ChainType) (Action, error) {
+	if m.IgnoreFlags == nil {
+		switch chain {
+		case ChainDeliver, ChainQuarantine, ChainReject, ChainDiscard:
+			return 0, nil
+		default:
+			return DefaultIgnoreFlags, nil
+		}
+	}
+	var flags Action
+	for _, name := range m.IgnoreFlags {
+		flag, ok := ignoreFlagNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("invalid ignore flag: %s", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// TLSConfig configures TLS for the SMTP server.
+type TLSConfig struct {
+	// CertFile and KeyFile are the default certificate, presented to clients
+	// asking for no server name or one without a certificate of its own.
+	CertFile string `yaml:"cert_file" json:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file" toml:"key_file"`
+	// Certificates are the certificates of hosted domains, chosen by the
+	// server name the client asks for (SNI). Without a default certificate,
+	// the first one is the default. They are reloaded on SIGHUP.
+	Certificates []CertificateConfig `yaml:"certificates" json:"certificates" toml:"certificates"`
+	// Implicit serves TLS from the first byte (SMTPS, usually port 465) instead
+	// of offering STARTTLS.
+	Implicit bool `yaml:"implicit" json:"implicit" toml:"implicit"`
+	// ClientCAFile is a PEM file of the CAs that issue client certificates.
+	// When set, clients are asked for a certificate, which is optional but
+	// must be valid if given; see Session.ClientCertificate.
+	ClientCAFile string `yaml:"client_ca_file" json:"client_ca_file" toml:"client_ca_file"`
+}
+
+// CertificateConfig is a certificate of hosted domains.
+type CertificateConfig struct {
+	// Domains are the server names the certificate is presented for, such as
+	// "mx.example.org" or "*.example.org". Defaults to the DNS names of the
+	// certificate.
+	Domains  []string `yaml:"domains" json:"domains" toml:"domains"`
+	CertFile string   `yaml:"cert_file" json:"cert_file" toml:"cert_file"`
+	KeyFile  string   `yaml:"key_file" json:"key_file" toml:"key_file"`
+}
+
+// enabled reports whether a certificate is configured.
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || len(c.Certificates) > 0
+}
+
+// Load loads the certificates. It returns nil if no certificate is
+// configured.
+func (c *TLSConfig) Load() (*tls.Config, error) {
+	return c.LoadInto(new(Certificates))
+}
+
+// LoadInto is like Load, with the certificates served from certs, so that
+// they can be reloaded with certs.Load.
+func (c *TLSConfig) LoadInto(certs *Certificates) (*tls.Config, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	if err := certs.Load(c); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client CAs: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("load client CAs: no certificates in %s", c.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Duration is a time.Duration written as a string such as "30s" or "5m" in
+// configuration files.
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration: %s", text)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// LoadConfig reads the configuration file at path. The format is detected from
+// the file extension (.yaml, .yml, .json or .toml), or from the content for
+// other extensions.
+//
+// Included files are merged after the including file, depth first and in the
+// listed order: set server settings override earlier ones and middleware are
+// appended to their chains. The merged configuration is validated, so that a
+// file can complete the settings of another.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if err := loadConfigFile(cfg, path, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configExtensions are the extensions of files picked up from an included directory.
+var configExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true, ".toml": true}
+
+// loadConfigFile merges the file at path and its includes into cfg. loading
+// holds the files on the current include path to detect cycles.
+func loadConfigFile(cfg *Config, path string, loading map[string]bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if loading[abs] {
+		return fmt.Errorf("%s: include cycle", path)
+	}
+	loading[abs] = true
+	defer delete(loading, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file, err := decodeConfig(data, DetectConfigFormat(path, data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.merge(file)
+
+	for _, pattern := range file.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		paths, err := expandInclude(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %s: %w", path, pattern, err)
+		}
+		for _, p := range paths {
+			if err := loadConfigFile(cfg, p, loading); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandInclude returns the files matched by an include entry, sorted.
+func expandInclude(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("no such file or directory")
+	}
+	sort.Strings(matches)
+
+	var paths []string
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, m)
+			continue
+		}
+		entries, err := os.ReadDir(m) // sorted by file name
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && configExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+				paths = append(paths, filepath.Join(m, e.Name()))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// merge merges o into c: server, log, debug, auth and store settings set in o replace those of c,
+// the middleware of o are appended to the chains of c and the listeners of o
+// to those of c.
+func (c *Config) merge(o *Config) {
+	mergeNonZero(reflect.ValueOf(&c.Server).Elem(), reflect.ValueOf(o.Server))
+	mergeNonZero(reflect.ValueOf(&c.Log).Elem(), reflect.ValueOf(o.Log))
+	mergeNonZero(reflect.ValueOf(&c.Debug).Elem(), reflect.ValueOf(o.Debug))
+	mergeNonZero(reflect.ValueOf(&c.Auth).Elem(), reflect.ValueOf(o.Auth))
+	mergeNonZero(reflect.ValueOf(&c.Store).Elem(), reflect.ValueOf(o.Store))
+	for chain, mws := range o.Chains {
+		if c.Chains == nil {
+			c.Chains = make(map[ChainType][]MiddlewareConfig)
+		}
+		c.Chains[chain] = append(c.Chains[chain], mws...)
+	}
+	c.Listeners = append(c.Listeners, o.Listeners...)
+	c.Tenants = append(c.Tenants, o.Tenants...)
+}
+
+// mergeNonZero copies the non-zero fields of the struct src to dst,
+// descending into nested structs.
+func mergeNonZero(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		f := src.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+			mergeNonZero(dst.Field(i), f)
+		case !f.IsZero():
+			dst.Field(i).Set(f)
+		}
+	}
+}
+
+// DetectConfigFormat returns the format of a configuration file from its
+// extension or, failing that, its content. Content that is not recognizably
+// JSON or TOML is taken to be YAML.
+func DetectConfigFormat(path string, data []byte) ConfigFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	case ".yaml", ".yml":
+		return FormatYAML
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return FormatJSON
+	}
+	// A TOML table header such as "[server]" on its own line is not valid YAML
+	// at the start of a document.
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' && !bytes.Contains(line, []byte(",")) {
+			return FormatTOML
+		}
+		break
+	}
+	return FormatYAML
+}
+
+// ParseConfig parses and validates a configuration in the given format.
+// Parsing is strict: unknown keys are errors, so that a typo such as
+// "raed_timeout" is not silently ignored. Errors carry the line (or, for keys
+// that are only found after decoding, the key path) they refer to.
+func ParseConfig(data []byte, format ConfigFormat) (*Config, error) {
+	cfg, err := decodeConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decodeConfig parses a configuration in the given format without validating
+// it.
+func decodeConfig(data []byte, format ConfigFormat) (*Config, error) {
+	cfg := &Config{}
+	var err error
+	switch format {
+	case FormatYAML:
+		err = decodeYAMLConfig(data, cfg)
+	case FormatJSON:
+		err = decodeJSONConfig(data, cfg)
+	case FormatTOML:
+		err = decodeTOMLConfig(data, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported config format: %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", format, err)
+	}
+	return cfg, nil
+}
+
+func decodeYAMLConfig(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF { // io.EOF: empty document
+		return err
+	}
+	return nil
+}
+
+func decodeJSONConfig(data []byte, cfg *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(cfg)
+	if err == nil {
+		return nil
+	}
+
+	offset := int64(-1)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		// encoding/json does not report the position of unknown fields.
+		if m := jsonUnknownField.FindStringSubmatch(err.Error()); m != nil {
+			key := regexp.MustCompile(`"` + regexp.QuoteMeta(m[1]) + `"\s*:`)
+			if loc := key.FindIndex(data); loc != nil {
+				offset = int64(loc[0])
+			}
+		}
+	}
+	if offset < 0 || offset > int64(len(data)) {
+		return err
+	}
+	return fmt.Errorf("line %d: %w", 1+bytes.Count(data[:offset], []byte("\n")), err)
+}
+
+var jsonUnknownField = regexp.MustCompile(`unknown field "([^"]*)"`)
+
+func decodeTOMLConfig(data []byte, cfg *Config) error {
+	md, err := toml.NewDecoder(bytes.NewReader(data)).Decode(cfg)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, k := range md.Undecoded() {
+		if !inMiddlewareConfig(k) {
+			keys = append(keys, k.String())
+		}
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// inMiddlewareConfig reports whether key is in the config map of a
+// middleware, whose keys are checked by its factory. The TOML decoder reports
+// the keys of tables nested in such a map as undecoded.
+func inMiddlewareConfig(key toml.Key) bool {
+	for i := 2; i < len(key); i++ {
+		if key[i] == "config" && key[i-2] == "chains" {
+			return true
+		}
+	}
+	return false
+}
+
+// knownChains are the chain names accepted in a configuration.
+var knownChains = map[ChainType]bool{
+	ChainConn: true, ChainMailFrom: true, ChainRcptTo: true, ChainData: true,
+	ChainDeliver: true, ChainQuarantine: true, ChainReject: true, ChainDiscard: true,
+	ChainPostQueue: true, ChainAuth: true,
+}
+
+// Validate checks the configuration for values the decoders accept but Brisa
+// cannot use: unknown chains, middleware without a name, listeners without
+// a name or address and negative durations or limits. All problems are
+// reported together.
+func (c *Config) Validate() error {
+	var errs []error
+	for _, f := range []struct {
+		name  string
+		value int64
+	}{
+		{"read_timeout", int64(c.Server.ReadTimeout)},
+		{"write_timeout", int64(c.Server.WriteTimeout)},
+		{"max_idle_time", int64(c.Server.MaxIdleTime)},
+		{"shutdown_timeout", int64(c.Server.ShutdownTimeout)},
+		{"max_message_bytes", c.Server.MaxMessageBytes},
+		{"max_recipients", int64(c.Server.MaxRecipients)},
+		{"max_line_length", int64(c.Server.MaxLineLength)},
+		{"max_commands", int64(c.Server.MaxCommands)},
+		{"max_errors", int64(c.Server.MaxErrors)},
+		{"min_data_rate", c.Server.MinDataRate},
+		{"max_session_time", int64(c.Server.MaxSessionTime)},
+		{"max_concurrent_data", int64(c.Server.MaxConcurrentData)},
+		{"data_wait", int64(c.Server.DataWait)},
+		{"busy_retry_after", int64(c.Server.BusyRetryAfter)},
+		{"spool_max_memory", c.Server.SpoolMaxMemory},
+		{"greet_delay", int64(c.Server.GreetDelay)},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("server.%s: must not be negative", f.name))
+		}
+	}
+	if (c.Server.TLS.CertFile == "") != (c.Server.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("server.tls: cert_file and key_file must be set together"))
+	}
+	for i, cc := range c.Server.TLS.Certificates {
+		if cc.CertFile == "" || cc.KeyFile == "" {
+			errs = append(errs, fmt.Errorf("server.tls.certificates[%d]: cert_file and key_file are required", i))
+		}
+	}
+	if c.Server.TLS.Implicit && !c.Server.TLS.enabled() {
+		errs = append(errs, fmt.Errorf("server.tls.implicit: requires a certificate"))
+	}
+	if c.Server.RejectMessage != "" {
+		if _, err := NewReplyTemplate(c.Server.RejectMessage); err != nil {
+			errs = append(errs, fmt.Errorf("server.reject_message: %w", err))
+		}
+	}
+
+	errs = append(errs, c.Log.validate()...)
+	errs = append(errs, c.Debug.validate()...)
+	errs = append(errs, c.Store.validate()...)
+
+	errs = append(errs, validateChains("chains", c.Chains)...)
+	errs = append(errs, validateAuthMechanisms("auth.mechanisms", c.Auth.Mechanisms)...)
+
+	names := make(map[string]bool)
+	for i, l := range c.Listeners {
+		prefix := fmt.Sprintf("listeners[%d]", i)
+		switch {
+		case l.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name: required", prefix))
+		case names[l.Name]:
+			errs = append(errs, fmt.Errorf("%s.name: duplicate listener %q", prefix, l.Name))
+		}
+		names[l.Name] = true
+		if l.Addr == "" {
+			errs = append(errs, fmt.Errorf("%s.addr: required", prefix))
+		}
+		if l.ImplicitTLS && !c.Server.TLS.enabled() {
+			errs = append(errs, fmt.Errorf("%s.implicit_tls: requires a server.tls certificate", prefix))
+		}
+		errs = append(errs, validateChains(prefix+".chains", l.Chains)...)
+		errs = append(errs, validateAuthMechanisms(prefix+".auth_mechanisms", l.AuthMechanisms)...)
+	}
+
+	tenants := make(map[string]bool)
+	domains := make(map[string]string)
+	for i, t := range c.Tenants {
+		prefix := fmt.Sprintf("tenants[%d]", i)
+		switch {
+		case t.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name: required", prefix))
+		case tenants[t.Name]:
+			errs = append(errs, fmt.Errorf("%s.name: duplicate tenant %q", prefix, t.Name))
+		}
+		tenants[t.Name] = true
+		if len(t.Domains) == 0 {
+			errs = append(errs, fmt.Errorf("%s.domains: required", prefix))
+		}
+		for j, d := range t.Domains {
+			d = address.NormalizeDomain(d)
+			if other, ok := domains[d]; ok {
+				errs = append(errs, fmt.Errorf("%s.domains[%d]: %s already belongs to tenant %q", prefix, j, d, other))
+			}
+			domains[d] = t.Name
+		}
+		for _, chain := range []ChainType{ChainConn, ChainAuth, ChainMailFrom} {
+			if len(t.Chains[chain]) > 0 {
+				errs = append(errs, fmt.Errorf("%s.chains.%s: tenants are selected by RCPT TO and have no %s chain", prefix, chain, chain))
+			}
+		}
+		errs = append(errs, validateChains(prefix+".chains", t.Chains)...)
+	}
+	return errors.Join(errs...)
+}
+
+// validateAuthMechanisms reports the unsupported SASL mechanisms of a
+// mechanisms setting.
+func validateAuthMechanisms(prefix string, mechs []string) []error {
+	var errs []error
+	for i, mech := range mechs {
+		if _, err := ParseAuthMechanism(mech); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %w", prefix, i, err))
+		}
+	}
+	return errs
+}
+
+// authMechanisms returns the SASL mechanisms offered on listener, in the
+// canonical case, or nil if all are.
+func (c *Config) authMechanisms(listener ListenerConfig) []string {
+	mechs := c.Auth.Mechanisms
+	if listener.AuthMechanisms != nil {
+		mechs = listener.AuthMechanisms
+	}
+	if mechs == nil {
+		return nil
+	}
+	canonical := make([]string, 0, len(mechs))
+	for _, mech := range mechs {
+		if m, err := ParseAuthMechanism(mech); err == nil {
+			canonical = append(canonical, m)
+		}
+	}
+	return canonical
+}
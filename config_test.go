@@ -0,0 +1,396 @@
+package brisa
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const testYAMLConfig = `
+server:
+  addr: ":2525"
+  read_timeout: 10s
+  write_timeout: 1m
+chains:
+  conn:
+    - name: ip_blacklist
+      config:
+        ips: ["192.0.2.1"]
+`
+
+const testJSONConfig = `{
+  "server": {"addr": ":2525", "read_timeout": "10s", "write_timeout": "1m"},
+  "chains": {
+    "conn": [{"name": "ip_blacklist", "config": {"ips": ["192.0.2.1"]}}]
+  }
+}`
+
+const testTOMLConfig = `
+[server]
+addr = ":2525"
+read_timeout = "10s"
+write_timeout = "1m"
+
+[[chains.conn]]
+name = "ip_blacklist"
+config = { ips = ["192.0.2.1"] }
+`
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"brisa.yaml": testYAMLConfig,
+		"brisa.json": testJSONConfig,
+		"brisa.toml": testTOMLConfig,
+		// 无扩展名时根据内容识别格式
+		"yaml.conf": testYAMLConfig,
+		"json.conf": testJSONConfig,
+		"toml.conf": testTOMLConfig,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := ServerConfig{
+				Addr:         ":2525",
+				ReadTimeout:  Duration(10 * time.Second),
+				WriteTimeout: Duration(time.Minute),
+			}
+			if !reflect.DeepEqual(cfg.Server, want) {
+				t.Errorf("expected server config %+v, got %+v", want, cfg.Server)
+			}
+			conn := cfg.Chains[ChainConn]
+			if len(conn) != 1 || conn[0].Name != "ip_blacklist" {
+				t.Fatalf("unexpected conn chain: %+v", conn)
+			}
+			if ips := conn[0].Config["ips"]; !reflect.DeepEqual(ips, []any{"192.0.2.1"}) {
+				t.Errorf("unexpected middleware config: %#v", ips)
+			}
+		})
+	}
+}
+
+func TestParseConfig_Errors(t *testing.T) {
+	if _, err := ParseConfig([]byte(`{"server": {"read_timeout": "soon"}}`), FormatJSON); err == nil {
+		t.Error("expected error for invalid duration")
+	}
+	if _, err := ParseConfig([]byte("server: ["), FormatYAML); err == nil {
+		t.Error("expected error for invalid YAML")
+	}
+	if _, err := ParseConfig(nil, "ini"); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestLoadConfig_Include(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("brisa.yaml", `
+include: ["conf.d", "extra.toml"]
+server:
+  addr: ":25"
+  read_timeout: 10s
+chains:
+  conn:
+    - name: first
+`)
+	// conf.d 中的文件按文件名顺序合并，与格式无关
+	write("conf.d/20-second.json", `{"server": {"addr": ":2525"}, "chains": {"conn": [{"name": "third"}]}}`)
+	write("conf.d/10-first.yaml", "chains:\n  conn:\n    - name: second\n")
+	write("conf.d/README", "not a config file")
+	write("extra.toml", "[[chains.data]]\nname = \"fourth\"\n")
+
+	cfg, err := LoadConfig(filepath.Join(dir, "brisa.yaml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Addr != ":2525" {
+		t.Errorf("expected included addr to override, got %q", cfg.Server.Addr)
+	}
+	if cfg.Server.ReadTimeout != Duration(10*time.Second) {
+		t.Errorf("expected read timeout to be kept, got %v", cfg.Server.ReadTimeout)
+	}
+	var names []string
+	for _, m := range cfg.Chains[ChainConn] {
+		names = append(names, m.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"first", "second", "third"}) {
+		t.Errorf("unexpected conn chain order: %v", names)
+	}
+	if data := cfg.Chains[ChainData]; len(data) != 1 || data[0].Name != "fourth" {
+		t.Errorf("unexpected data chain: %+v", data)
+	}
+}
+
+func TestLoadConfig_IncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.yaml")
+	os.WriteFile(a, []byte("include: [b.yaml]\n"), 0o600)
+	os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("include: [a.yaml]\n"), 0o600)
+	if _, err := LoadConfig(a); err == nil {
+		t.Error("expected error for include cycle")
+	}
+
+	c := filepath.Join(dir, "c.yaml")
+	os.WriteFile(c, []byte("include: [missing.yaml]\n"), 0o600)
+	if _, err := LoadConfig(c); err == nil {
+		t.Error("expected error for missing include")
+	}
+
+	// 没有匹配的通配符不是错误
+	d := filepath.Join(dir, "d.yaml")
+	os.WriteFile(d, []byte("include: [\"extra/*.yaml\"]\n"), 0o600)
+	if _, err := LoadConfig(d); err != nil {
+		t.Errorf("unexpected error for empty glob: %v", err)
+	}
+}
+
+func TestLoadConfig_IncludeValidation(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// 校验的是合并后的配置：错误指向合并后链中的位置
+	write("sub.yaml", "chains:\n  data:\n    - config: {}\n")
+	main := write("main.yaml", "include: [sub.yaml]\nchains:\n  data:\n    - name: x\n")
+	if _, err := LoadConfig(main); err == nil || !strings.Contains(err.Error(), "chains.data[1].name: required") {
+		t.Errorf("expected missing name error, got %v", err)
+	}
+
+	// 重复的监听器分属两个文件时也会报错
+	write("sub.yaml", "listeners:\n  - name: sub\n    addr: :588\n")
+	main = write("main.yaml", "include: [sub.yaml]\nlisteners:\n  - name: sub\n    addr: :587\n")
+	if _, err := LoadConfig(main); err == nil || !strings.Contains(err.Error(), `listeners[1].name: duplicate listener "sub"`) {
+		t.Errorf("expected duplicate listener error, got %v", err)
+	}
+
+	// 一个文件可以补全另一个文件的设置
+	write("key.yaml", "server:\n  tls:\n    key_file: /etc/brisa/key.pem\n")
+	main = write("tls.yaml", "include: [key.yaml]\nserver:\n  tls:\n    cert_file: /etc/brisa/cert.pem\n")
+	cfg, err := LoadConfig(main)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.TLS.CertFile == "" || cfg.Server.TLS.KeyFile == "" {
+		t.Errorf("expected both TLS files, got %+v", cfg.Server.TLS)
+	}
+}
+
+func TestParseConfig_TOMLMiddlewareConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+[[chains.data]]
+name = "dlp"
+config = { rules = [{ name = "project", keywords = ["codename"] }] }
+
+[[chains.data]]
+name = "header"
+[chains.data.config.headers]
+X-Filtered = "yes"
+`), FormatTOML)
+	if err != nil {
+		t.Fatalf("expected nested tables in middleware configs to be accepted, got %v", err)
+	}
+	rules, _ := cfg.Chains[ChainData][0].Config["rules"].([]any)
+	if len(rules) != 1 || rules[0].(map[string]any)["name"] != "project" {
+		t.Errorf("unexpected dlp config %#v", cfg.Chains[ChainData][0].Config)
+	}
+}
+
+func TestParseConfig_Strict(t *testing.T) {
+	tests := []struct {
+		name   string
+		format ConfigFormat
+		data   string
+		want   string
+	}{
+		{"yaml unknown key", FormatYAML, "server:\n  addr: \":25\"\n  raed_timeout: 10s\n", "line 3"},
+		{"json unknown key", FormatJSON, "{\n  \"server\": {\n    \"raed_timeout\": \"10s\"\n  }\n}", "line 3"},
+		{"toml unknown key", FormatTOML, "[server]\nraed_timeout = \"10s\"\n", "server.raed_timeout"},
+		{"yaml invalid duration", FormatYAML, "server:\n  read_timeout: soon\n", "invalid duration"},
+		{"toml invalid duration", FormatTOML, "[server]\nread_timeout = \"soon\"\n", "invalid duration"},
+		{"negative duration", FormatYAML, "server:\n  read_timeout: -1s\n", "server.read_timeout"},
+		{"negative store sweep interval", FormatYAML, "store:\n  sweep_interval: -1m\n", "store.sweep_interval"},
+		{"negative log max age", FormatYAML, "log:\n  max_age: -24h\n", "log: rotation settings"},
+		{"unknown chain", FormatYAML, "chains:\n  dta:\n    - name: x\n", "chains.dta"},
+		{"missing name", FormatJSON, `{"chains": {"data": [{"config": {}}]}}`, "chains.data[0].name"},
+		{"invalid reject message", FormatYAML, "server:\n  reject_message: \"{{.MailID\"\n", "server.reject_message"},
+		{"invalid middleware reject message", FormatYAML, "chains:\n  data:\n    - name: x\n      reject_message: \"{{\"\n", "chains.data[0].reject_message"},
+		{"negative scan limit", FormatYAML, "chains:\n  data:\n    - name: x\n      max_scan_bytes: -1\n", "chains.data[0].max_scan_bytes"},
+		{"invalid condition", FormatYAML, "chains:\n  data:\n    - name: x\n      only_if: [vip]\n", "chains.data[0].only_if"},
+		{"listener without address", FormatYAML, "listeners:\n  - name: submission\n", "listeners[0].addr"},
+		{"duplicate listener", FormatYAML, "listeners:\n  - name: a\n    addr: :587\n  - name: a\n    addr: :588\n", "listeners[1].name"},
+		{"unknown listener chain", FormatYAML, "listeners:\n  - name: a\n    addr: :587\n    chains:\n      dta: []\n", "listeners[0].chains.dta"},
+		{"redis store with file", FormatYAML, "store:\n  file: store.json\n  redis:\n    addr: redis:6379\n", "store.redis"},
+		{"gossip store without secret", FormatYAML, "store:\n  gossip:\n    addr: :7946\n", "store.gossip.secret_file"},
+		{"invalid debug role", FormatYAML, "debug:\n  access:\n    - token_file: t\n      role: root\n", "debug.access[0].role"},
+		{"debug certificate without CA", FormatYAML, "debug:\n  access:\n    - certificate: ops\n      role: admin\n", "debug.access[0].certificate"},
+		{"tenant without domains", FormatYAML, "tenants:\n  - name: acme\n", "tenants[0].domains"},
+		{"duplicate tenant domain", FormatYAML, "tenants:\n  - name: a\n    domains: [a.example]\n  - name: b\n    domains: [A.example]\n", "tenants[1].domains[0]"},
+		{"tenant mail_from chain", FormatYAML, "tenants:\n  - name: a\n    domains: [a.example]\n    chains:\n      mail_from:\n        - name: x\n", "tenants[0].chains.mail_from"},
+		{"unknown auth mechanism", FormatYAML, "auth:\n  mechanisms: [PLAIN, DIGEST-MD5]\n", "auth.mechanisms[1]"},
+		{"unknown listener auth mechanism", FormatYAML, "listeners:\n  - name: a\n    addr: :587\n    auth_mechanisms: [ntlm]\n", "listeners[0].auth_mechanisms[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tt.data), tt.format)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error to mention %q, got %q", tt.want, err)
+			}
+		})
+	}
+
+	// 中间件自身的配置不做严格检查，由工厂函数负责
+	if _, err := ParseConfig([]byte("chains:\n  data:\n    - name: x\n      config:\n        anything: 1\n"), FormatYAML); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ParseConfig(nil, FormatYAML); err != nil {
+		t.Errorf("unexpected error for empty config: %v", err)
+	}
+}
+
+func TestLoadConfig_ErrorContext(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "brisa.yaml")
+	os.WriteFile(main, []byte("include: [bad.yaml]\n"), 0o600)
+	os.WriteFile(filepath.Join(dir, "bad.yaml"), []byte("server:\n  raed_timeout: 1s\n"), 0o600)
+
+	_, err := LoadConfig(main)
+	if err == nil || !strings.Contains(err.Error(), "bad.yaml") || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error with file and line context, got %v", err)
+	}
+}
+
+func TestServerConfig_Apply(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+server:
+  addr: ":2525"
+  domain: example.com
+  hostname: mx1.example.com
+  read_timeout: 5m
+  write_timeout: 30s
+  max_idle_time: 1m
+  max_message_bytes: 10485760
+  max_recipients: 100
+  allow_insecure_auth: true
+  enable_dsn: true
+  enable_mt_priority: true
+  enable_smtputf8: true
+`), FormatYAML)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s := smtp.NewServer(nil)
+	cfg.Server.Apply(s)
+	if s.Addr != ":2525" || s.Domain != "mx1.example.com" {
+		t.Errorf("unexpected addr/domain: %q %q", s.Addr, s.Domain)
+	}
+	// max_idle_time 小于 read_timeout 时生效
+	if s.ReadTimeout != time.Minute || s.WriteTimeout != 30*time.Second {
+		t.Errorf("unexpected timeouts: %v %v", s.ReadTimeout, s.WriteTimeout)
+	}
+	if s.MaxMessageBytes != 10<<20 || s.MaxRecipients != 100 || !s.AllowInsecureAuth {
+		t.Errorf("unexpected limits: %d %d %v", s.MaxMessageBytes, s.MaxRecipients, s.AllowInsecureAuth)
+	}
+	if !s.EnableDSN || !s.EnableMTPRIORITY || !s.EnableSMTPUTF8 {
+		t.Error("expected DSN, MT-PRIORITY and SMTPUTF8 to be enabled")
+	}
+	if s.MaxLineLength != 2000 {
+		t.Errorf("expected unset max_line_length to keep the go-smtp default, got %d", s.MaxLineLength)
+	}
+
+	s = smtp.NewServer(nil)
+	(&ServerConfig{Domain: "example.com"}).Apply(s)
+	if s.Domain != "example.com" {
+		t.Errorf("expected domain to be advertised without hostname, got %q", s.Domain)
+	}
+
+	if _, err := ParseConfig([]byte("server:\n  max_recipients: -1\n"), FormatYAML); err == nil {
+		t.Error("expected error for negative limit")
+	}
+}
+
+func TestServerConfig_Spool(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "spool.key")
+	os.WriteFile(keyFile, []byte("spool key of at least 16 bytes\n"), 0o600)
+	server := ServerConfig{SpoolDir: dir, SpoolKeyFiles: []string{keyFile}}
+	cfg, err := server.Spool()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Dir != dir || cfg.Keys == nil {
+		t.Errorf("unexpected spool config: %+v", cfg)
+	}
+
+	server.SpoolKeyFiles = append(server.SpoolKeyFiles, filepath.Join(dir, "missing.key"))
+	if _, err := server.Spool(); err == nil {
+		t.Error("expected an error for a missing key file")
+	}
+}
+
+func TestConfig_HasPostQueue(t *testing.T) {
+	postQueue := map[ChainType][]MiddlewareConfig{ChainPostQueue: {{Name: "pass"}}}
+	tests := map[string]struct {
+		cfg  Config
+		want bool
+	}{
+		"none":     {cfg: Config{Chains: map[ChainType][]MiddlewareConfig{ChainData: {{Name: "pass"}}}}},
+		"top":      {cfg: Config{Chains: postQueue}, want: true},
+		"listener": {cfg: Config{Listeners: []ListenerConfig{{Name: "submission", Chains: postQueue}}}, want: true},
+		"tenant":   {cfg: Config{Tenants: []TenantConfig{{Name: "acme", Domains: []string{"acme.example"}, Chains: postQueue}}}, want: true},
+	}
+	for name, tt := range tests {
+		if got := tt.cfg.hasPostQueue(); got != tt.want {
+			t.Errorf("%s: hasPostQueue() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func FuzzParseConfig(f *testing.F) {
+	for _, seed := range []string{testYAMLConfig, testJSONConfig, testTOMLConfig, "include: [a]\n", "{}"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, format := range []ConfigFormat{FormatYAML, FormatJSON, FormatTOML} {
+			cfg, err := ParseConfig(data, format)
+			if err != nil {
+				continue
+			}
+			// A configuration that parses is valid.
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("%s: parsed configuration does not validate: %v", format, err)
+			}
+		}
+	})
+}
@@ -3,7 +3,10 @@ package brisa
 import (
 	"io"
 	"log/slog"
+	"maps"
+	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/emersion/go-smtp"
 )
@@ -15,46 +18,143 @@ type Context struct {
 
 	From        string
 	FromOptions *smtp.MailOptions
-	To          []string
-	ToOptions   []*smtp.RcptOptions
+	// To and ToOptions hold the accepted recipients. Their backing arrays are
+	// reused by the next transaction; copy them to keep them longer.
+	To        []string
+	ToOptions []*smtp.RcptOptions
 
 	Reader io.Reader
 	// Action stores the cumulative status during the execution of the middleware chain.
 	Action Action
-	keys   map[string]any
-	mu     sync.RWMutex
+	// Score accumulates the spam score contributed by content analysis middleware
+	// for the current mail. Higher values mean the mail is more likely spam.
+	Score float64
+	// flags are set with SetFlag; see Flag.
+	flags Flag
+	// messageLimits are set with SetMessageLimits.
+	messageLimits MessageLimits
+	// tenant is the name of the tenant of the transaction; see Tenant.
+	tenant string
+	// componentLoggers cache the loggers of the middleware built by a
+	// Registry, derived from componentBase; see withComponent.
+	componentBase    *slog.Logger
+	componentLoggers map[string]*slog.Logger
+	// auth is the latest AUTH attempt of the session.
+	auth AuthInfo
+	// rejectErr is the SMTP reply recorded by RejectWith for the current command.
+	rejectErr *smtp.SMTPError
+	// rejectedBy is the middleware that rejected the current command.
+	rejectedBy *Middleware
+	// chain is the chain being executed, recorded in the trace.
+	chain ChainType
+	trace []TraceStep
+	// hooks are scheduled with AfterAccept for the current transaction.
+	hooks []hook
+	// spools hold the message of the transaction; spoolErr records a message
+	// that did not fit. See SpoolMessage.
+	spools   []*Spool
+	spoolErr error
+	// keys hold the data of the current transaction; sessionKeys that of the
+	// session, which survives RSET.
+	keys        map[string]any
+	sessionKeys map[string]any
+	mu          sync.RWMutex
+	// freed is set by FreeContext until the context is reused; detached marks
+	// the copies of Detach, which are not pooled.
+	freed    atomic.Bool
+	detached bool
 }
 
 // Reset resets the context for reuse.
 func (c *Context) Reset() {
 	c.Session = nil
 	c.Logger = nil
+	c.componentBase = nil
+	clear(c.componentLoggers)
 	c.Action = Pass // Reset to the initial state
 	c.ResetMailFields()
+	c.chain = ""
+	c.flags = 0
+	c.auth = AuthInfo{}
+	clear(c.trace)
+	c.trace = c.trace[:0]
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.keys = nil
+	c.sessionKeys = nil
 }
 
 // ResetMailFields resets fields related to a single mail transaction.
 func (c *Context) ResetMailFields() {
 	c.Reader = nil
 	c.From = ""
-	c.To = nil
 	c.FromOptions = nil
-	c.ToOptions = nil
+	// Keep the recipient slices for reuse, dropping their references.
+	clear(c.To)
+	c.To = c.To[:0]
+	clear(c.ToOptions)
+	c.ToOptions = c.ToOptions[:0]
 	c.Action = Pass // Reset to the initial state for the new transaction
+	c.Score = 0
+	c.flags &= sessionFlags
+	c.messageLimits = MessageLimits{}
+	c.tenant = ""
+	c.rejectErr = nil
+	c.rejectedBy = nil
+	clear(c.hooks)
+	c.hooks = c.hooks[:0]
+	c.closeSpools()
+	// The conn chain ran once for the session; its steps stay in the trace of
+	// every transaction.
+	c.trace = slices.DeleteFunc(c.trace, func(s TraceStep) bool { return s.Chain != ChainConn })
 
 	c.mu.Lock()
-	// Clear the keys map for the new transaction to prevent state leakage.
-	c.keys = nil
+	// Clear the keys map for the new transaction to prevent state leakage,
+	// keeping its storage. Session keys stay.
+	clear(c.keys)
 	c.mu.Unlock()
 }
 
-// Set stores a new key-value pair in the context.
+// SMTPUTF8 reports whether the sender of the current transaction used the
+// SMTPUTF8 parameter (RFC 6531): its addresses and the header fields of its
+// message may hold UTF-8, and it may only be relayed to servers offering
+// SMTPUTF8.
+func (c *Context) SMTPUTF8() bool {
+	return c.FromOptions != nil && c.FromOptions.UTF8
+}
+
+// RejectWith records err as the SMTP reply to send for the current command and
+// returns Reject, so a handler can simply `return ctx.RejectWith(err)`.
+// Without it, a rejection is answered with ErrRejectedByPolicy.
+func (c *Context) RejectWith(err *smtp.SMTPError) Action {
+	c.checkLive()
+	c.rejectErr = err
+	return Reject
+}
+
+// RejectError returns the SMTP reply recorded by RejectWith, or nil if none was set.
+func (c *Context) RejectError() *smtp.SMTPError {
+	return c.rejectErr
+}
+
+// Trace returns the middleware executed so far for the current transaction,
+// in order, starting with the conn chain of the session. Later chains can use
+// it, e.g. the reject chain to log which middleware led to a rejection.
+func (c *Context) Trace() []TraceStep {
+	return slices.Clone(c.trace)
+}
+
+func (c *Context) addTraceStep(step TraceStep) {
+	step.Chain = c.chain
+	c.trace = append(c.trace, step)
+}
+
+// Set stores a new key-value pair in the context for the current
+// transaction; it is cleared by RSET and the next MAIL FROM.
 // It is safe for concurrent use.
 func (c *Context) Set(key string, value any) {
+	c.checkLive()
 	c.mu.Lock()
 	if c.keys == nil {
 		c.keys = make(map[string]any)
@@ -63,33 +163,136 @@ func (c *Context) Set(key string, value any) {
 	c.mu.Unlock()
 }
 
+// SetSession stores a new key-value pair in the context for the rest of the
+// session, for facts about the client such as its reputation, identity or TLS
+// details. Unlike keys stored with Set, it survives RSET and later
+// transactions. A key stored with Set shadows the session key of the same
+// name for the current transaction.
+// It is safe for concurrent use.
+func (c *Context) SetSession(key string, value any) {
+	c.checkLive()
+	c.mu.Lock()
+	if c.sessionKeys == nil {
+		c.sessionKeys = make(map[string]any)
+	}
+	c.sessionKeys[key] = value
+	c.mu.Unlock()
+}
+
 // Get returns the value for the given key, and a boolean indicating if the key exists.
+// Keys of the transaction are looked up before those of the session.
 // It is safe for concurrent use.
 func (c *Context) Get(key string) (value any, exists bool) {
+	c.checkLive()
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	if c.keys == nil {
-		return nil, false
+	if value, exists = c.keys[key]; exists {
+		return value, true
 	}
-	value, exists = c.keys[key]
+	value, exists = c.sessionKeys[key]
 	return value, exists
 }
 
+// Detach returns a copy of the context that stays valid after c is freed,
+// without the message reader, for consumers that keep it beyond the handler
+// or observer call, e.g. in another goroutine. The recipient slices, trace
+// and keys are copied; Session still refers to the session, which may end.
+// Detached copies are not pooled and need not be freed.
+func (c *Context) Detach() *Context {
+	c.checkLive()
+	s := &Context{
+		detached:      true,
+		Session:       c.Session,
+		Logger:        c.Logger,
+		From:          c.From,
+		FromOptions:   c.FromOptions,
+		To:            slices.Clone(c.To),
+		ToOptions:     slices.Clone(c.ToOptions),
+		Action:        c.Action,
+		Score:         c.Score,
+		flags:         c.flags,
+		auth:          c.auth,
+		messageLimits: c.messageLimits,
+		tenant:        c.tenant,
+		rejectErr:     c.rejectErr,
+		chain:         c.chain,
+		trace:         slices.Clone(c.trace),
+	}
+	c.mu.RLock()
+	s.keys = maps.Clone(c.keys)
+	s.sessionKeys = maps.Clone(c.sessionKeys)
+	c.mu.RUnlock()
+	return s
+}
+
 var contextPool = sync.Pool{
 	New: func() any {
 		return new(Context)
 	},
 }
 
+// contextChecks enables the debug checks of SetContextChecks.
+var contextChecks atomic.Bool
+
+// freedSender is the sender of a context poisoned by SetContextChecks.
+const freedSender = "<freed context>"
+
+// SetContextChecks enables or disables the debug checks of pooled contexts.
+// Without them, the use of a Context after FreeContext panics only until the
+// pool hands it out again; from then on, the stale holder silently reads the
+// data of another session. With them, freed contexts are poisoned and never
+// reused, so every later use panics or shows "<freed context>" as the sender, at
+// the cost of an allocation per session. Enable them to find middleware or
+// observers that keep a Context; see Context.Detach.
+func SetContextChecks(enabled bool) {
+	contextChecks.Store(enabled)
+}
+
+// checkLive panics if c was freed.
+func (c *Context) checkLive() {
+	if c.freed.Load() {
+		panic("brisa: use of a Context after FreeContext")
+	}
+}
+
 // newContext returns a new or recycled Context instance.
 func NewContext() *Context {
 	c := contextPool.Get().(*Context)
+	c.freed.Store(false)
 	c.Action = Pass // Ensure the instance from the pool has a clean state
 	return c
 }
 
-// FreeContext resets and returns a Context instance to the pool.
+// FreeContext resets and returns a Context instance to the pool. The context
+// must not be used afterwards. Freeing a context twice panics; detached
+// copies are left alone.
 func FreeContext(c *Context) {
+	if c.detached {
+		return
+	}
+	if c.freed.Swap(true) {
+		panic("brisa: Context freed twice")
+	}
 	c.Reset()
+	if contextChecks.Load() {
+		c.poison()
+		return
+	}
 	contextPool.Put(c)
 }
+
+// poison fills a freed context with values that fail its stale users.
+func (c *Context) poison() {
+	c.From = freedSender
+	c.To = nil
+	c.ToOptions = nil
+	c.Reader = poisonedReader{}
+	c.Action = 0
+}
+
+// poisonedReader is the message of a poisoned context.
+type poisonedReader struct{}
+
+func (poisonedReader) Read([]byte) (int, error) {
+	panic("brisa: use of a Context after FreeContext")
+}
@@ -0,0 +1,244 @@
+package brisa
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// DebugConfig configures the debug HTTP endpoints.
+type DebugConfig struct {
+	// Addr is the address the endpoints are served on, e.g. "127.0.0.1:6060".
+	// They expose internals and allow expensive profiles, so bind it to
+	// localhost or an internal network. Empty disables them.
+	Addr string `yaml:"addr" json:"addr" toml:"addr"`
+	// CheckContexts enables the debug checks of pooled contexts; see
+	// SetContextChecks.
+	CheckContexts bool `yaml:"check_contexts" json:"check_contexts" toml:"check_contexts"`
+	// TLS serves the endpoints over TLS. With a client_ca_file, clients can
+	// authenticate with a certificate; see DebugAccess.
+	TLS TLSConfig `yaml:"tls" json:"tls" toml:"tls"`
+	// Access lists the clients allowed to use the endpoints. When empty,
+	// anyone who can connect may use them.
+	Access []DebugAccess `yaml:"access" json:"access" toml:"access"`
+}
+
+// Roles of the clients of the debug endpoints.
+const (
+	// DebugRoleViewer may read the expvar variables.
+	DebugRoleViewer = "viewer"
+	// DebugRoleOperator may also use the operations under /debug/ops/, such
+	// as reloading the configuration.
+	DebugRoleOperator = "operator"
+	// DebugRoleAdmin may also take profiles, which expose internals and load
+	// the server.
+	DebugRoleAdmin = "admin"
+)
+
+var debugRoleLevels = map[string]int{DebugRoleViewer: 1, DebugRoleOperator: 2, DebugRoleAdmin: 3}
+
+// debugOpsPath is the prefix of the debug endpoints changing the state of
+// the server. They only accept POST requests.
+const debugOpsPath = "/debug/ops/"
+
+// DebugAccess grants a role on the debug endpoints to the clients sending a
+// bearer token, or presenting a client certificate.
+type DebugAccess struct {
+	// Name identifies the client in logs.
+	Name string `yaml:"name" json:"name" toml:"name"`
+	// TokenFile holds the token the client sends as
+	// "Authorization: Bearer <token>".
+	TokenFile string `yaml:"token_file" json:"token_file" toml:"token_file"`
+	// Certificate is the subject common name of a client certificate issued
+	// by the CAs of tls.client_ca_file.
+	Certificate string `yaml:"certificate" json:"certificate" toml:"certificate"`
+	// Role is DebugRoleViewer, DebugRoleOperator or DebugRoleAdmin.
+	Role string `yaml:"role" json:"role" toml:"role"`
+}
+
+// validate checks the settings of the debug endpoints.
+func (c *DebugConfig) validate() []error {
+	var errs []error
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("debug.tls: cert_file and key_file must be set together"))
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.enabled() {
+		errs = append(errs, fmt.Errorf("debug.tls.client_ca_file: requires a certificate"))
+	}
+	for i, a := range c.Access {
+		if _, ok := debugRoleLevels[a.Role]; !ok {
+			errs = append(errs, fmt.Errorf("debug.access[%d].role: invalid role: %s", i, a.Role))
+		}
+		switch {
+		case a.TokenFile == "" && a.Certificate == "":
+			errs = append(errs, fmt.Errorf("debug.access[%d]: token_file or certificate required", i))
+		case a.Certificate != "" && c.TLS.ClientCAFile == "":
+			errs = append(errs, fmt.Errorf("debug.access[%d].certificate: requires debug.tls.client_ca_file", i))
+		}
+	}
+	return errs
+}
+
+// debugVars holds the counters of all ExpvarObservers, published as "brisa"
+// on /debug/vars. The retention of the data of the server adds
+// store_keys_expired (see MemoryStore.SweepTask), log_backups_removed and
+// log_bytes_reclaimed (see LogConfig.MaxAge), and gossip stores add
+// gossip_updates_rejected (see GossipConfig.Secret).
+var debugVars = expvar.NewMap("brisa")
+
+// ExpvarObserver is an Observer counting sessions and chain executions in the
+// process-wide expvar map "brisa":
+//
+//   - sessions_total and sessions_active: sessions started and still open.
+//   - chains: executions per chain type.
+//   - actions: executions per chain type and resulting action, e.g. "rcpt_to.reject".
+//   - chain_seconds: time spent per chain type.
+//   - tenant_actions: actions per tenant, e.g. "acme.data.quarantine", for
+//     the chains run for a tenant (see Tenant).
+type ExpvarObserver struct{}
+
+// OnSessionStart implements Observer.
+func (ExpvarObserver) OnSessionStart(ctx *Context) {
+	debugVars.Add("sessions_total", 1)
+	debugVars.Add("sessions_active", 1)
+}
+
+// OnSessionEnd implements Observer.
+func (ExpvarObserver) OnSessionEnd(ctx *Context) {
+	debugVars.Add("sessions_active", -1)
+}
+
+// OnChainStart implements Observer.
+func (ExpvarObserver) OnChainStart(ctx *Context, chainType ChainType) {}
+
+// OnChainEnd implements Observer.
+func (ExpvarObserver) OnChainEnd(ctx *Context, chainType ChainType, duration time.Duration) {
+	addToMap("chains", string(chainType), 1)
+	addToMap("actions", string(chainType)+"."+ctx.Action.String(), 1)
+	if v, ok := debugVars.Get("chain_seconds").(*expvar.Map); ok {
+		v.AddFloat(string(chainType), duration.Seconds())
+	}
+	if tenant := ctx.Tenant(); tenant != "" {
+		addToMap("tenant_actions", tenant+"."+string(chainType)+"."+ctx.Action.String(), 1)
+	}
+}
+
+func init() {
+	for _, name := range []string{"sessions_total", "sessions_active", "store_keys_expired", "log_backups_removed", "log_bytes_reclaimed", "gossip_updates_rejected"} {
+		debugVars.Set(name, new(expvar.Int))
+	}
+	for _, name := range []string{"chains", "actions", "chain_seconds", "tenant_actions"} {
+		debugVars.Set(name, new(expvar.Map).Init())
+	}
+}
+
+func addToMap(name, key string, delta int64) {
+	if v, ok := debugVars.Get(name).(*expvar.Map); ok {
+		v.Add(key, delta)
+	}
+}
+
+// NewDebugHandler returns a handler serving the expvar variables on
+// /debug/vars, the net/http/pprof profiles under /debug/pprof/ and the
+// OpenAPI document of the endpoints for tools on /debug/openapi.json.
+func NewDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc(debugOpenAPIPath, debugOpenAPIHandler)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// debugGrant is a DebugAccess with its token loaded.
+type debugGrant struct {
+	name        string
+	token       []byte
+	certificate string
+	level       int
+}
+
+// debugAuthHandler lets the requests of the clients of its grants through
+// to next, if their role allows the endpoint.
+type debugAuthHandler struct {
+	next   http.Handler
+	grants []debugGrant
+}
+
+// NewDebugAuthHandler restricts h, the debug endpoints, to the clients of
+// access: /debug/vars and /debug/openapi.json to viewers, /debug/ops/ to
+// operators, everything else to admins. Other requests get 401, or 403 for a
+// role that does not allow the endpoint. Client certificates are only
+// accepted once verified by the TLS server.
+func NewDebugAuthHandler(h http.Handler, access []DebugAccess) (http.Handler, error) {
+	auth := &debugAuthHandler{next: h}
+	for i, a := range access {
+		level, ok := debugRoleLevels[a.Role]
+		if !ok {
+			return nil, fmt.Errorf("access[%d]: invalid role: %s", i, a.Role)
+		}
+		g := debugGrant{name: a.Name, certificate: a.Certificate, level: level}
+		if a.TokenFile != "" {
+			token, err := readKeyFile(a.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("access[%d].token_file: %w", i, err)
+			}
+			g.token = token
+		}
+		if g.token == nil && g.certificate == "" {
+			return nil, fmt.Errorf("access[%d]: token_file or certificate required", i)
+		}
+		auth.grants = append(auth.grants, g)
+	}
+	return auth, nil
+}
+
+// grant returns the grant of the client of r, if any.
+func (h *debugAuthHandler) grant(r *http.Request) *debugGrant {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for i := range h.grants {
+			if g := &h.grants[i]; g.token != nil && subtle.ConstantTimeCompare(g.token, []byte(token)) == 1 {
+				return g
+			}
+		}
+		return nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range h.grants {
+			if g := &h.grants[i]; g.certificate != "" && g.certificate == cn {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (h *debugAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g := h.grant(r)
+	if g == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	need := debugRoleLevels[DebugRoleAdmin]
+	switch {
+	case r.URL.Path == "/debug/vars", r.URL.Path == debugOpenAPIPath:
+		need = debugRoleLevels[DebugRoleViewer]
+	case strings.HasPrefix(r.URL.Path, debugOpsPath):
+		need = debugRoleLevels[DebugRoleOperator]
+	}
+	if g.level < need {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,98 @@
+package brisa
+
+import "net/http"
+
+// debugOpenAPIPath is the path of the OpenAPI document of the debug
+// endpoints. Any client allowed to read /debug/vars may read it.
+const debugOpenAPIPath = "/debug/openapi.json"
+
+// debugOpenAPI describes the debug endpoints meant for tools: the expvar
+// variables and the operations under /debug/ops/. The pprof profiles are
+// read with go tool pprof and are left out. Keep it in step with serve and
+// the adminclient package.
+const debugOpenAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Brisa debug endpoints",
+    "version": "1"
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"}
+    },
+    "responses": {
+      "Error": {
+        "description": "The request failed; the body is the reason.",
+        "content": {"text/plain": {"schema": {"type": "string"}}}
+      }
+    }
+  },
+  "security": [{"bearer": []}],
+  "paths": {
+    "/debug/vars": {
+      "get": {
+        "operationId": "vars",
+        "summary": "Read the expvar variables, the counters of Brisa under \"brisa\". Requires the viewer role.",
+        "responses": {
+          "200": {
+            "description": "The variables.",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/debug/ops/reload": {
+      "post": {
+        "operationId": "reload",
+        "summary": "Reload the configuration, as on SIGHUP. Requires the operator role and debug.access.",
+        "responses": {
+          "200": {
+            "description": "The configuration was reloaded.",
+            "content": {"text/plain": {"schema": {"type": "string", "example": "reloaded\n"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/debug/ops/purge": {
+      "post": {
+        "operationId": "purge",
+        "summary": "Remove the store keys holding data of an address. Requires the operator role and debug.access.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "type": "object",
+                "required": ["address"],
+                "properties": {"address": {"type": "string", "format": "email"}}
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The number of keys removed.",
+            "content": {"text/plain": {"schema": {"type": "string", "example": "purged 3 keys\n"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  }
+}
+`
+
+// debugOpenAPIHandler serves the OpenAPI document of the debug endpoints.
+func debugOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(debugOpenAPI))
+}
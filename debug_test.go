@@ -0,0 +1,165 @@
+package brisa
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpvarObserver(t *testing.T) {
+	router := Router{}
+	router.OnRcptTo(&Middleware{Handler: func(ctx *Context) Action { return Reject }})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)), ExpvarObserver{})
+	b.UpdateRouter(&router)
+
+	srv := httptest.NewServer(NewDebugHandler())
+	defer srv.Close()
+	vars := func() map[string]any {
+		resp, err := http.Get(srv.URL + "/debug/vars")
+		if err != nil {
+			t.Fatalf("get vars: %v", err)
+		}
+		defer resp.Body.Close()
+		var all map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&all); err != nil {
+			t.Fatalf("decode vars: %v", err)
+		}
+		return all["brisa"].(map[string]any)
+	}
+	count := func(v map[string]any, m, key string) float64 {
+		n, _ := v[m].(map[string]any)[key].(float64)
+		return n
+	}
+
+	// 计数器是进程级的，只比较差值
+	before := vars()
+	b.Simulate(Envelope{From: "a@example.com", To: []string{"b@example.com"}}, strings.NewReader("Subject: hi\r\n\r\n"))
+	after := vars()
+
+	if d := after["sessions_total"].(float64) - before["sessions_total"].(float64); d != 1 {
+		t.Errorf("expected 1 new session, got %v", d)
+	}
+	if d := count(after, "actions", "rcpt_to.reject") - count(before, "actions", "rcpt_to.reject"); d != 1 {
+		t.Errorf("expected 1 rcpt_to rejection, got %v", d)
+	}
+	if after["sessions_active"] != before["sessions_active"] {
+		t.Errorf("expected no open sessions, got %v", after["sessions_active"])
+	}
+}
+
+func TestDebugHandler_Pprof(t *testing.T) {
+	srv := httptest.NewServer(NewDebugHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatalf("get profile: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("unexpected response %d: %.100s", resp.StatusCode, body)
+	}
+}
+
+func TestDebugHandler_OpenAPI(t *testing.T) {
+	srv := httptest.NewServer(NewDebugHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/openapi.json")
+	if err != nil {
+		t.Fatalf("get document: %v", err)
+	}
+	defer resp.Body.Close()
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decode document: %v", err)
+	}
+	if doc.OpenAPI == "" {
+		t.Error("expected an openapi version")
+	}
+	// The document describes the operations serve provides.
+	for path, method := range map[string]string{"/debug/vars": "get", debugOpsPath + "reload": "post", debugOpsPath + "purge": "post"} {
+		if doc.Paths[path][method] == nil {
+			t.Errorf("expected %s %s to be described", method, path)
+		}
+	}
+}
+
+func TestDebugAuthHandler(t *testing.T) {
+	dir := t.TempDir()
+	viewerToken := filepath.Join(dir, "viewer.token")
+	operatorToken := filepath.Join(dir, "operator.token")
+	adminToken := filepath.Join(dir, "admin.token")
+	os.WriteFile(viewerToken, []byte("view-secret\n"), 0o600)
+	os.WriteFile(operatorToken, []byte("operate-secret\n"), 0o600)
+	os.WriteFile(adminToken, []byte("admin-secret\n"), 0o600)
+	h, err := NewDebugAuthHandler(NewDebugHandler(), []DebugAccess{
+		{Name: "grafana", TokenFile: viewerToken, Role: DebugRoleViewer},
+		{Name: "deploy", TokenFile: operatorToken, Role: DebugRoleOperator},
+		{Name: "oncall", TokenFile: adminToken, Role: DebugRoleAdmin},
+		{Name: "ops", Certificate: "ops.example.com", Role: DebugRoleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, token, cn string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if cn != "" {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	tests := []struct {
+		name, path, token, cn string
+		want                  int
+	}{
+		{"anonymous", "/debug/vars", "", "", http.StatusUnauthorized},
+		{"wrong token", "/debug/vars", "guess", "", http.StatusUnauthorized},
+		{"viewer vars", "/debug/vars", "view-secret", "", http.StatusOK},
+		{"viewer openapi", "/debug/openapi.json", "view-secret", "", http.StatusOK},
+		// 查看者不能采集性能分析
+		{"viewer pprof", "/debug/pprof/", "view-secret", "", http.StatusForbidden},
+		{"admin pprof", "/debug/pprof/", "admin-secret", "", http.StatusOK},
+		// 操作员可以使用 /debug/ops/ 下的操作（这里没有注册，所以是 404），但不能采集性能分析
+		{"viewer ops", "/debug/ops/reload", "view-secret", "", http.StatusForbidden},
+		{"operator ops", "/debug/ops/reload", "operate-secret", "", http.StatusNotFound},
+		{"operator vars", "/debug/vars", "operate-secret", "", http.StatusOK},
+		{"operator pprof", "/debug/pprof/", "operate-secret", "", http.StatusForbidden},
+		{"certificate", "/debug/pprof/", "", "ops.example.com", http.StatusOK},
+		{"unknown certificate", "/debug/vars", "", "mallory.example.com", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code := get(tt.path, tt.token, tt.cn); code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, code)
+		}
+	}
+
+	for _, access := range [][]DebugAccess{
+		{{TokenFile: viewerToken, Role: "owner"}},
+		{{Role: DebugRoleViewer}},
+		{{TokenFile: filepath.Join(dir, "missing"), Role: DebugRoleViewer}},
+	} {
+		if _, err := NewDebugAuthHandler(NewDebugHandler(), access); err == nil {
+			t.Errorf("expected error for %+v", access)
+		}
+	}
+}
@@ -28,6 +28,14 @@ var (
 		Message:      "Service temporarily unavailable, please try again later",
 	}
 
+	// ErrQueueFull is returned for DATA when an accepted message cannot be
+	// queued for the post-queue stage because the queue is full (452).
+	ErrQueueFull = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Mail queue full, please try again later",
+	}
+
 	// ErrInvalidAction is returned when an invalid action is encountered after
 	// the data middleware chain has finished. It signals a permanent failure (554).
 	ErrInvalidAction = &smtp.SMTPError{
@@ -35,4 +43,21 @@ var (
 		EnhancedCode: smtp.EnhancedCode{5, 3, 5},
 		Message:      "Transaction failed due to an invalid internal state",
 	}
+
+	// ErrTooManyRecipients is returned for RCPT TO once a transaction has
+	// as many recipients as its MessageLimits allow. It is temporary, so the
+	// client sends the remaining recipients in another transaction.
+	ErrTooManyRecipients = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients",
+	}
+
+	// ErrNonASCIIAddress is returned for an address with a non-ASCII local
+	// part in a transaction without the SMTPUTF8 parameter (RFC 6531).
+	ErrNonASCIIAddress = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+		Message:      "Non-ASCII addresses require SMTPUTF8",
+	}
 )
@@ -0,0 +1,225 @@
+package brisa
+
+import (
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+// The types of the events published by the server.
+const (
+	EventSessionStarted     EventType = "session_started"
+	EventMessageAccepted    EventType = "message_accepted"
+	EventMessageQuarantined EventType = "message_quarantined"
+	EventDeliveryStatus     EventType = "delivery_status"
+	EventQueueRetry         EventType = "queue_retry"
+	EventReputationChanged  EventType = "reputation_changed"
+	EventAnomalyDetected    EventType = "anomaly_detected"
+)
+
+// Event is something that happened inside the server, published on an
+// EventBus.
+type Event interface {
+	Type() EventType
+}
+
+// SessionStarted is published when a client connection has passed the conn
+// chain.
+type SessionStarted struct {
+	SessionID  string
+	ClientAddr net.Addr
+}
+
+// Type implements Event.
+func (SessionStarted) Type() EventType { return EventSessionStarted }
+
+// MessageInfo describes the message of a message event.
+type MessageInfo struct {
+	SessionID string
+	MailID    string
+	// Tenant is the name of the tenant of the message, if any.
+	Tenant string
+	From   string
+	To     []string
+	Score  float64
+}
+
+// MessageAccepted is published when a message has passed the deliver chain.
+type MessageAccepted struct {
+	MessageInfo
+}
+
+// Type implements Event.
+func (MessageAccepted) Type() EventType { return EventMessageAccepted }
+
+// MessageQuarantined is published when a message has passed the quarantine
+// chain.
+type MessageQuarantined struct {
+	MessageInfo
+}
+
+// Type implements Event.
+func (MessageQuarantined) Type() EventType { return EventMessageQuarantined }
+
+// DeliveryState is a step in the delivery of a message to a recipient.
+type DeliveryState string
+
+const (
+	DeliveryQueued    DeliveryState = "queued"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryDeferred  DeliveryState = "deferred"
+	DeliveryBounced   DeliveryState = "bounced"
+)
+
+// DeliveryStatus is published by delivery middleware and queues when the
+// delivery of a message to a recipient changes state, so that the
+// application that submitted it can follow it by its mail ID.
+type DeliveryStatus struct {
+	MailID    string
+	Recipient string
+	State     DeliveryState
+	// Detail is the reply of the remote server or the reason of the change.
+	Detail string
+}
+
+// Type implements Event.
+func (DeliveryStatus) Type() EventType { return EventDeliveryStatus }
+
+// QueueRetry is published by a delivery queue when a delivery attempt failed
+// temporarily and the message is scheduled again.
+type QueueRetry struct {
+	MessageID   string
+	Recipient   string
+	Attempt     int
+	NextAttempt time.Time
+	Err         error
+}
+
+// Type implements Event.
+func (QueueRetry) Type() EventType { return EventQueueRetry }
+
+// ReputationChanged is published when the reputation kept for a subject, such
+// as a client IP or a sender domain, changes.
+type ReputationChanged struct {
+	Subject  string
+	Old, New float64
+}
+
+// Type implements Event.
+func (ReputationChanged) Type() EventType { return EventReputationChanged }
+
+// AnomalyDetected is published when the behavior of an authenticated user
+// departs from their profile, which may mean the account is compromised.
+type AnomalyDetected struct {
+	SessionID  string
+	MailID     string
+	Username   string
+	ClientAddr net.Addr
+	// Reasons name the departures, e.g. "new_country".
+	Reasons []string
+}
+
+// Type implements Event.
+func (AnomalyDetected) Type() EventType { return EventAnomalyDetected }
+
+// EventBus delivers published events to the handlers subscribed to their
+// type. It lets integrations react to single events without implementing an
+// Observer or a middleware. Handlers run synchronously in the publishing
+// goroutine, often a session, so they must be fast and hand slow work off to
+// another goroutine. A panicking handler is recovered and logged. The zero
+// value is ready to use; publishing on a nil *EventBus does nothing.
+type EventBus struct {
+	// Logger logs panicking handlers. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	mu   sync.RWMutex
+	subs map[EventType][]*eventSubscription
+}
+
+type eventSubscription struct {
+	fn func(Event)
+}
+
+// NewEventBus creates a new EventBus logging to logger.
+func NewEventBus(logger *slog.Logger) *EventBus {
+	return &EventBus{Logger: logger}
+}
+
+// Subscribe calls fn for every published event of type t until the returned
+// function is called.
+func (b *EventBus) Subscribe(t EventType, fn func(Event)) (unsubscribe func()) {
+	sub := &eventSubscription{fn: fn}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[EventType][]*eventSubscription)
+	}
+	// The slices are replaced, never modified, so Publish can iterate over
+	// them without the lock.
+	b.subs[t] = append(slices.Clip(b.subs[t]), sub)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.subs[t] = slices.DeleteFunc(slices.Clone(b.subs[t]), func(s *eventSubscription) bool { return s == sub })
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Subscribe calls fn for every event of type E published on b until the
+// returned function is called:
+//
+//	brisa.Subscribe(b.Events(), func(e brisa.MessageQuarantined) { ... })
+func Subscribe[E Event](b *EventBus, fn func(E)) (unsubscribe func()) {
+	var zero E
+	return b.Subscribe(zero.Type(), func(e Event) {
+		if e, ok := e.(E); ok {
+			fn(e)
+		}
+	})
+}
+
+// HasSubscribers reports whether events of type t have subscribers, so that
+// publishers can skip building events nobody receives.
+func (b *EventBus) HasSubscribers(t EventType) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs[t]) > 0
+}
+
+// Publish delivers e to the subscribers of its type.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	subs := b.subs[e.Type()]
+	b.mu.RUnlock()
+	for _, sub := range subs {
+		b.deliver(sub, e)
+	}
+}
+
+func (b *EventBus) deliver(sub *eventSubscription, e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger := b.Logger
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.Error("event handler panicked", "event", string(e.Type()), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	sub.fn(e)
+}
@@ -0,0 +1,68 @@
+package brisa
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var got []string
+	unsubscribe := Subscribe(bus, func(e ReputationChanged) {
+		got = append(got, e.Subject)
+	})
+	// 处理函数的 panic 不影响其他订阅者
+	bus.Subscribe(EventReputationChanged, func(Event) { panic("boom") })
+	Subscribe(bus, func(e QueueRetry) { t.Error("unexpected queue retry event") })
+
+	if !bus.HasSubscribers(EventReputationChanged) || bus.HasSubscribers(EventSessionStarted) {
+		t.Error("unexpected subscribers")
+	}
+	bus.Publish(ReputationChanged{Subject: "192.0.2.1", Old: 0, New: -1})
+	unsubscribe()
+	unsubscribe()
+	bus.Publish(ReputationChanged{Subject: "192.0.2.2"})
+	if !reflect.DeepEqual(got, []string{"192.0.2.1"}) {
+		t.Errorf("unexpected events: %v", got)
+	}
+
+	var nilBus *EventBus
+	nilBus.Publish(ReputationChanged{})
+}
+
+func TestBrisa_Events(t *testing.T) {
+	router := Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		if strings.Contains(ctx.From, "spam") {
+			return Quarantine
+		}
+		return Pass
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+
+	var sessions int
+	var accepted, quarantined []MessageInfo
+	Subscribe(b.Events(), func(e SessionStarted) { sessions++ })
+	Subscribe(b.Events(), func(e MessageAccepted) { accepted = append(accepted, e.MessageInfo) })
+	Subscribe(b.Events(), func(e MessageQuarantined) { quarantined = append(quarantined, e.MessageInfo) })
+
+	env := observerTestEnvelope
+	b.Simulate(env, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	env.From = "spammer@example.com"
+	b.Simulate(env, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+
+	if sessions != 2 {
+		t.Errorf("expected 2 session events, got %d", sessions)
+	}
+	if len(accepted) != 1 || accepted[0].From != "alice@example.com" || accepted[0].MailID == "" ||
+		!reflect.DeepEqual(accepted[0].To, []string{"bob@example.com"}) {
+		t.Errorf("unexpected accepted events: %+v", accepted)
+	}
+	if len(quarantined) != 1 || quarantined[0].From != "spammer@example.com" {
+		t.Errorf("unexpected quarantined events: %+v", quarantined)
+	}
+}
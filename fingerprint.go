@@ -0,0 +1,227 @@
+package brisa
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// maxFingerprintCommands bounds the commands recorded in a fingerprint.
+const maxFingerprintCommands = 64
+
+// helloTTL is how long the ClientHello of a connection is kept for its
+// session; see Brisa.FingerprintTLS.
+const helloTTL = 5 * time.Minute
+
+// Fingerprint describes how a client speaks SMTP. Mail software tends to
+// behave the same way every time, so the fingerprints of spambots can be
+// recognized whatever address they connect from.
+type Fingerprint struct {
+	// Commands are the MAIL, RCPT, DATA, RSET and AUTH commands of the
+	// session so far, in order. go-smtp answers the others itself, and its
+	// own reset after each message is not recorded.
+	Commands []string
+	// Delays are the times between each command and the previous one, or the
+	// start of the session (EHLO) for the first.
+	Delays []time.Duration
+	// Extensions are the ESMTP parameters the client used, in order of first
+	// use: "SIZE", "BODY=8BITMIME", "SMTPUTF8", "REQUIRETLS", "RET",
+	// "ENVID", "AUTH", "NOTIFY" and "ORCPT".
+	Extensions []string
+	// STARTTLS reports whether the client upgraded the connection with
+	// STARTTLS. TLS is the JA3 hash of its TLS ClientHello. Both are only
+	// known if the TLS configuration of the server records the handshakes;
+	// see Brisa.FingerprintTLS.
+	STARTTLS bool
+	TLS      string
+}
+
+// String returns the fingerprint without timings, for logging and comparing:
+// the commands and extensions separated by spaces, the use of STARTTLS and
+// the TLS hash, separated by "|".
+func (f Fingerprint) String() string {
+	return strings.Join(f.Commands, " ") + "|" + strings.Join(f.Extensions, " ") + "|" +
+		strconv.FormatBool(f.STARTTLS) + "|" + f.TLS
+}
+
+// Fingerprint returns the fingerprint of the session so far. It is empty
+// without a session.
+func (c *Context) Fingerprint() Fingerprint {
+	if c.Session == nil {
+		return Fingerprint{}
+	}
+	f := c.Session.fp
+	f.Commands = slices.Clone(f.Commands)
+	f.Delays = slices.Clone(f.Delays)
+	f.Extensions = slices.Clone(f.Extensions)
+	return f
+}
+
+// record adds a command to the fingerprint of the session.
+func (s *Session) record(cmd string) {
+	if len(s.fp.Commands) >= maxFingerprintCommands {
+		return
+	}
+	now := time.Now()
+	s.fp.Commands = append(s.fp.Commands, cmd)
+	s.fp.Delays = append(s.fp.Delays, now.Sub(s.lastCommand))
+	s.lastCommand = now
+}
+
+// recordMail adds the parameters of MAIL FROM to the fingerprint.
+func (s *Session) recordMail(opts *smtp.MailOptions) {
+	if opts == nil {
+		return
+	}
+	if opts.Size > 0 {
+		s.extension("SIZE")
+	}
+	if opts.Body != "" {
+		s.extension("BODY=" + strings.ToUpper(string(opts.Body)))
+	}
+	if opts.UTF8 {
+		s.extension("SMTPUTF8")
+	}
+	if opts.RequireTLS {
+		s.extension("REQUIRETLS")
+	}
+	if opts.Return != "" {
+		s.extension("RET")
+	}
+	if opts.EnvelopeID != "" {
+		s.extension("ENVID")
+	}
+	if opts.Auth != nil {
+		s.extension("AUTH")
+	}
+}
+
+// recordRcpt adds the parameters of RCPT TO to the fingerprint.
+func (s *Session) recordRcpt(opts *smtp.RcptOptions) {
+	if opts == nil {
+		return
+	}
+	if len(opts.Notify) > 0 {
+		s.extension("NOTIFY")
+	}
+	if opts.OriginalRecipient != "" {
+		s.extension("ORCPT")
+	}
+}
+
+func (s *Session) extension(name string) {
+	if !slices.Contains(s.fp.Extensions, name) {
+		s.fp.Extensions = append(s.fp.Extensions, name)
+	}
+}
+
+// observeTLS records the TLS state of the connection in the fingerprint of a
+// new session. go-smtp starts a new session after STARTTLS, so the connection
+// is encrypted from the start of the session if at all.
+func (s *Session) observeTLS() {
+	tc, ok := s.conn.Conn().(*tls.Conn)
+	if !ok {
+		s.plain = true
+		return
+	}
+	if h, ok := s.hellos.LoadAndDelete(tc.NetConn()); ok {
+		hello := h.(*clientHello)
+		s.fp.TLS, s.fp.STARTTLS = hello.hash, hello.starttls
+	}
+}
+
+// handOverTLS tells the next session of the connection that the client
+// upgraded it with STARTTLS, when a plain session ends because of it.
+func (s *Session) handOverTLS() {
+	if !s.plain || s.conn == nil {
+		return
+	}
+	if tc, ok := s.conn.Conn().(*tls.Conn); ok {
+		if h, ok := s.hellos.Load(tc.NetConn()); ok {
+			h.(*clientHello).starttls = true
+		}
+	}
+}
+
+// clientHello is the recorded ClientHello of a connection. starttls is set
+// when the handshake followed STARTTLS.
+type clientHello struct {
+	hash     string
+	at       time.Time
+	starttls bool
+}
+
+// FingerprintTLS returns a copy of config that records the ClientHello of
+// every TLS handshake, so that the fingerprints of the sessions include its
+// JA3 hash. Use it for the TLS configuration of the servers of b, for
+// STARTTLS and implicit TLS.
+func (b *Brisa) FingerprintTLS(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		now := time.Now()
+		// Drop the hellos of connections that never reached a command.
+		b.hellos.Range(func(k, v any) bool {
+			if now.Sub(v.(*clientHello).at) > helloTTL {
+				b.hellos.Delete(k)
+			}
+			return true
+		})
+		b.hellos.Store(hello.Conn, &clientHello{hash: JA3(hello), at: now})
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+	return config
+}
+
+// JA3 returns the JA3 hash of a ClientHello: the MD5 of its highest version,
+// cipher suites, extensions, curves and point formats, without GREASE values
+// (RFC 8701).
+func JA3(hello *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) {
+			version = max(version, v)
+		}
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	s := fmt.Sprintf("%d,%s,%s,%s,%s", version, ja3List(hello.CipherSuites),
+		ja3List(hello.Extensions), ja3List(curves), ja3List(points))
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja3List(values []uint16) string {
+	var sb strings.Builder
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteString(strconv.Itoa(int(v)))
+	}
+	return sb.String()
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values of RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
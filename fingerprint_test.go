@@ -0,0 +1,155 @@
+package brisa
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// startFingerprintServer 启动记录数据链指纹的测试服务器
+func startFingerprintServer(t *testing.T) (string, <-chan Fingerprint) {
+	t.Helper()
+	fps := make(chan Fingerprint, 1)
+	b := New(slog.New(slog.DiscardHandler))
+	b.UpdateRouter(&Router{ChainData: {{Handler: func(ctx *Context) Action {
+		fps <- ctx.Fingerprint()
+		return Pass
+	}}}})
+	addr := startTestServer(t, b, testServerOptions{tls: b.FingerprintTLS(testTLSConfig(t)), enableDSN: true})
+	return addr, fps
+}
+
+// sendTestMail 通过客户端发送一封邮件
+func sendTestMail(t *testing.T, c *smtp.Client, mailOpts *smtp.MailOptions, rcptOpts *smtp.RcptOptions) {
+	t.Helper()
+	defer c.Close()
+	if err := c.Mail("a@example.org", mailOpts); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("b@example.com", rcptOpts); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "Subject: test\r\n\r\nbody\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFingerprint_Commands(t *testing.T) {
+	addr, fps := startFingerprintServer(t)
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendTestMail(t, c,
+		&smtp.MailOptions{Size: 30, Body: smtp.Body8BitMIME},
+		&smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}})
+
+	fp := <-fps
+	if want := []string{"MAIL", "RCPT", "DATA"}; !slices.Equal(fp.Commands, want) {
+		t.Errorf("expected commands %v, got %v", want, fp.Commands)
+	}
+	if len(fp.Delays) != len(fp.Commands) {
+		t.Errorf("expected a delay per command, got %v", fp.Delays)
+	}
+	if want := []string{"SIZE", "BODY=8BITMIME", "NOTIFY"}; !slices.Equal(fp.Extensions, want) {
+		t.Errorf("expected extensions %v, got %v", want, fp.Extensions)
+	}
+	if fp.STARTTLS || fp.TLS != "" {
+		t.Errorf("expected a plain connection, got %+v", fp)
+	}
+	if got, want := fp.String(), "MAIL RCPT DATA|SIZE BODY=8BITMIME NOTIFY|false|"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestFingerprint_Messages(t *testing.T) {
+	addr, fps := startFingerprintServer(t)
+	conn, r := dialTest(t, addr, true)
+	send := func() {
+		t.Helper()
+		for _, cmd := range []string{"MAIL FROM:<a@example.org>", "RCPT TO:<b@example.com>", "DATA"} {
+			io.WriteString(conn, cmd+"\r\n")
+			readReply(t, r)
+		}
+		io.WriteString(conn, "Subject: test\r\n\r\nbody\r\n.\r\n")
+		if reply := readReply(t, r); !strings.HasPrefix(reply, "250") {
+			t.Fatalf("unexpected DATA reply: %q", reply)
+		}
+	}
+
+	// 邮件之间 go-smtp 自动重置会话，只记录客户端发送的 RSET
+	send()
+	<-fps
+	send()
+	if got, want := (<-fps).Commands, []string{"MAIL", "RCPT", "DATA", "MAIL", "RCPT", "DATA"}; !slices.Equal(got, want) {
+		t.Errorf("expected commands %v, got %v", want, got)
+	}
+	io.WriteString(conn, "RSET\r\n")
+	readReply(t, r)
+	send()
+	if got, want := (<-fps).Commands, []string{"MAIL", "RCPT", "DATA", "MAIL", "RCPT", "DATA", "RSET", "MAIL", "RCPT", "DATA"}; !slices.Equal(got, want) {
+		t.Errorf("expected commands %v, got %v", want, got)
+	}
+}
+
+func TestFingerprint_STARTTLS(t *testing.T) {
+	addr, fps := startFingerprintServer(t)
+	c, err := smtp.DialStartTLS(addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendTestMail(t, c, nil, nil)
+
+	fp := <-fps
+	if !fp.STARTTLS {
+		t.Error("expected STARTTLS to be recorded")
+	}
+	if len(fp.TLS) != 32 {
+		t.Errorf("expected the JA3 hash of the ClientHello, got %q", fp.TLS)
+	}
+}
+
+func TestJA3(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{0x1a1a, tls.TLS_AES_128_GCM_SHA256},
+		Extensions:        []uint16{0, 10, 11},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+		SupportedPoints:   []uint8{0},
+	}
+	// GREASE 值不参与计算
+	plain := *hello
+	plain.SupportedVersions = []uint16{tls.VersionTLS13}
+	plain.CipherSuites = []uint16{tls.TLS_AES_128_GCM_SHA256}
+	if JA3(hello) != JA3(&plain) {
+		t.Error("expected GREASE values to be ignored")
+	}
+	plain.Extensions = []uint16{0, 10}
+	if JA3(hello) == JA3(&plain) {
+		t.Error("expected different extensions to change the hash")
+	}
+}
+
+func TestFingerprint_Simulate(t *testing.T) {
+	var fp Fingerprint
+	b := New(slog.New(slog.DiscardHandler))
+	b.UpdateRouter(&Router{ChainData: {{Handler: func(ctx *Context) Action {
+		fp = ctx.Fingerprint()
+		return Pass
+	}}}})
+	env := Envelope{TLS: true, TLSFingerprint: "abc", From: "a@example.org", To: []string{"b@example.com", "c@example.com"}}
+	b.Simulate(env, strings.NewReader("\r\nbody\r\n"))
+	if got, want := fp.String(), "MAIL RCPT RCPT DATA||true|abc"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
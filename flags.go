@@ -0,0 +1,100 @@
+package brisa
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Flag is a set of facts about a session or its message that middleware
+// establish for later middleware, such as a trusted client or a bulk
+// message, instead of agreeing on ad-hoc Context keys.
+type Flag uint32
+
+const (
+	// FlagTrusted marks a client that policy checks may let through, e.g.
+	// from an allowlisted network.
+	FlagTrusted Flag = 1 << iota
+	// FlagAuthenticated marks a client that has authenticated.
+	FlagAuthenticated
+	// FlagInternal marks mail originating inside the organization.
+	FlagInternal
+	// FlagBulk marks a bulk message, such as a newsletter.
+	FlagBulk
+	// FlagMailingList marks a message sent through a mailing list.
+	FlagMailingList
+	// FlagEarlyTalker marks a client that talked before the greeting or
+	// pipelined its EHLO, typical of spambots; see NewGreetListener.
+	FlagEarlyTalker
+
+	// sessionFlags hold for the whole session; the others only for the
+	// current message and are cleared by Context.ResetMailFields.
+	sessionFlags = FlagTrusted | FlagAuthenticated | FlagInternal | FlagEarlyTalker
+)
+
+var flagNames = []struct {
+	flag Flag
+	name string
+}{
+	{FlagTrusted, "trusted"},
+	{FlagAuthenticated, "authenticated"},
+	{FlagInternal, "internal"},
+	{FlagBulk, "bulk"},
+	{FlagMailingList, "mailing_list"},
+	{FlagEarlyTalker, "early_talker"},
+}
+
+// Has reports whether all flags of f2 are set in f.
+func (f Flag) Has(f2 Flag) bool {
+	return f&f2 == f2
+}
+
+// String returns the names of the flags joined by "|", e.g. "trusted|bulk".
+func (f Flag) String() string {
+	if f == 0 {
+		return "none"
+	}
+	var names []string
+	for _, n := range flagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+			f &^= n.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+	return strings.Join(names, "|")
+}
+
+// ParseFlag returns the flag with the given name, as returned by
+// Flag.String, ignoring case.
+func ParseFlag(name string) (Flag, error) {
+	for _, n := range flagNames {
+		if strings.EqualFold(name, n.name) {
+			return n.flag, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown flag: %s", name)
+}
+
+// SetFlag sets f on the context.
+func (c *Context) SetFlag(f Flag) {
+	c.checkLive()
+	c.flags |= f
+}
+
+// ClearFlag clears f on the context.
+func (c *Context) ClearFlag(f Flag) {
+	c.flags &^= f
+}
+
+// HasFlag reports whether all flags of f are set on the context.
+func (c *Context) HasFlag(f Flag) bool {
+	c.checkLive()
+	return c.flags.Has(f)
+}
+
+// Flags returns the flags set on the context.
+func (c *Context) Flags() Flag {
+	return c.flags
+}
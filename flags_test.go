@@ -0,0 +1,47 @@
+package brisa
+
+import "testing"
+
+func TestContext_Flags(t *testing.T) {
+	ctx := NewContext()
+	defer FreeContext(ctx)
+
+	ctx.SetFlag(FlagTrusted | FlagBulk)
+	if !ctx.HasFlag(FlagTrusted) || !ctx.HasFlag(FlagBulk) || ctx.HasFlag(FlagTrusted|FlagAuthenticated) {
+		t.Fatalf("unexpected flags: %v", ctx.Flags())
+	}
+	if got := ctx.Flags().String(); got != "trusted|bulk" {
+		t.Errorf("expected trusted|bulk, got %q", got)
+	}
+
+	// 新的邮件事务只保留会话级别的标志。
+	ctx.ResetMailFields()
+	if ctx.Flags() != FlagTrusted {
+		t.Errorf("expected only the session flag to survive, got %v", ctx.Flags())
+	}
+	ctx.ClearFlag(FlagTrusted)
+	if ctx.Flags() != 0 {
+		t.Errorf("expected no flags, got %v", ctx.Flags())
+	}
+
+	ctx.SetFlag(FlagInternal)
+	ctx.Reset()
+	if ctx.Flags() != 0 {
+		t.Errorf("expected Reset to clear the flags, got %v", ctx.Flags())
+	}
+}
+
+func TestParseFlag(t *testing.T) {
+	for _, name := range []string{"trusted", "Authenticated", "internal", "bulk", "mailing_list", "early_talker"} {
+		f, err := ParseFlag(name)
+		if err != nil {
+			t.Fatalf("ParseFlag(%q): %v", name, err)
+		}
+		if g, _ := ParseFlag(f.String()); g != f {
+			t.Errorf("flag %q does not round-trip", name)
+		}
+	}
+	if _, err := ParseFlag("vip"); err == nil {
+		t.Error("expected an error for an unknown flag")
+	}
+}
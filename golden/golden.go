@@ -0,0 +1,264 @@
+// Package golden records mail transactions as golden files and replays them
+// against another router, so that the effect of a policy change can be
+// reviewed before it is deployed.
+//
+// A Recorder instruments a router to capture the message and the verdict of
+// every middleware, and observes the server to save each transaction that
+// reaches DATA:
+//
+//	rec, err := golden.NewRecorder("testdata/golden")
+//	b := brisa.New(logger, rec)
+//	b.UpdateRouter(rec.Instrument(router))
+//
+// Replay then runs the recorded transactions through a new router and
+// reports those whose outcome changed.
+package golden
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+// transactionKey is the context key of the transaction being recorded.
+const transactionKey = "golden.transaction"
+
+// Verdict is the action a middleware returned.
+type Verdict struct {
+	Chain      brisa.ChainType `json:"chain"`
+	Middleware string          `json:"middleware"`
+	Action     string          `json:"action"`
+}
+
+// Transaction is a recorded mail transaction.
+type Transaction struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	// BodySHA256 is the hash of the message, which is stored in the file
+	// <hash>.eml next to the transaction.
+	BodySHA256 string `json:"body_sha256"`
+	// Verdicts are the verdicts of the mail transaction in order. The conn
+	// chain belongs to the session and is not recorded.
+	Verdicts []Verdict `json:"verdicts"`
+	// Action is the final action after the data chain.
+	Action string  `json:"action"`
+	Score  float64 `json:"score"`
+
+	body []byte
+}
+
+// Recorder is a brisa.Observer that saves the transactions of a router
+// instrumented with Instrument. Each transaction is written to
+// <dir>/<time>-<hash>.json and its message to <dir>/<hash>.eml.
+type Recorder struct {
+	dir    string
+	save   func(t *Transaction) error
+	logger *slog.Logger
+}
+
+// NewRecorder creates a Recorder writing to dir, which is created if needed.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{dir: dir, logger: slog.Default()}
+	r.save = r.write
+	return r, nil
+}
+
+// Instrument returns a copy of router whose middleware report their verdicts
+// to the recorder and whose data chain first captures the message.
+// Middleware without a Name are recorded by their position in the chain.
+func (r *Recorder) Instrument(router *brisa.Router) *brisa.Router {
+	instrumented := router.Clone()
+	for chain, mws := range *instrumented {
+		if chain == brisa.ChainConn {
+			continue
+		}
+		for i := range mws {
+			name, handler := mws[i].Name, mws[i].Handler
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			mws[i].Handler = func(ctx *brisa.Context) brisa.Action {
+				action := handler(ctx)
+				t := transaction(ctx)
+				t.Verdicts = append(t.Verdicts, Verdict{Chain: chain, Middleware: name, Action: action.String()})
+				return action
+			}
+		}
+	}
+	capture := brisa.Middleware{Name: "golden.capture", Handler: func(ctx *brisa.Context) brisa.Action {
+		body, err := io.ReadAll(ctx.Reader)
+		if err != nil {
+			ctx.Logger.Error("failed to capture message", "error", err)
+		}
+		transaction(ctx).body = body
+		ctx.Reader = bytes.NewReader(body)
+		return ctx.Action
+	}}
+	(*instrumented)[brisa.ChainData] = append(brisa.MiddlewareChain{capture}, (*instrumented)[brisa.ChainData]...)
+	return instrumented
+}
+
+// transaction returns the transaction recorded for the current mail of ctx.
+func transaction(ctx *brisa.Context) *Transaction {
+	if v, ok := ctx.Get(transactionKey); ok {
+		return v.(*Transaction)
+	}
+	t := &Transaction{}
+	ctx.Set(transactionKey, t)
+	return t
+}
+
+// OnSessionStart implements brisa.Observer.
+func (r *Recorder) OnSessionStart(ctx *brisa.Context) {}
+
+// OnSessionEnd implements brisa.Observer.
+func (r *Recorder) OnSessionEnd(ctx *brisa.Context) {}
+
+// OnChainStart implements brisa.Observer.
+func (r *Recorder) OnChainStart(ctx *brisa.Context, chainType brisa.ChainType) {}
+
+// OnChainEnd implements brisa.Observer. It saves the transaction when the
+// data chain has decided its outcome.
+func (r *Recorder) OnChainEnd(ctx *brisa.Context, chainType brisa.ChainType, duration time.Duration) {
+	if chainType != brisa.ChainData {
+		return
+	}
+	t := transaction(ctx)
+	t.Time = time.Now().UTC()
+	if ctx.Session != nil {
+		if addr, ok := ctx.Session.GetClientIP().(*net.TCPAddr); ok {
+			t.ClientIP = addr.IP.String()
+		}
+	}
+	t.From, t.To = ctx.From, append([]string(nil), ctx.To...)
+	sum := sha256.Sum256(t.body)
+	t.BodySHA256 = hex.EncodeToString(sum[:])
+	// The session delivers mail that no middleware decided on.
+	action := ctx.Action
+	if action == brisa.Pass {
+		action = brisa.Deliver
+	}
+	t.Action, t.Score = action.String(), ctx.Score
+	if err := r.save(t); err != nil {
+		r.logger.Error("failed to record transaction", "error", err)
+	}
+}
+
+// write saves t and its message to the directory of the recorder.
+func (r *Recorder) write(t *Transaction) error {
+	eml := filepath.Join(r.dir, t.BodySHA256+".eml")
+	if _, err := os.Stat(eml); errors.Is(err, fs.ErrNotExist) {
+		if err := os.WriteFile(eml, t.body, 0o644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := t.Time.Format("20060102T150405.000000000") + "-" + t.BodySHA256[:12] + ".json"
+	return os.WriteFile(filepath.Join(r.dir, name), data, 0o644)
+}
+
+// Diff is a recorded transaction whose replayed outcome differs.
+type Diff struct {
+	// File is the transaction file.
+	File     string
+	Recorded *Transaction
+	Replayed *Transaction
+}
+
+// String describes the changes.
+func (d *Diff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s -> %s", filepath.Base(d.File), d.Recorded.Action, d.Replayed.Action)
+	if !slices.Equal(d.Recorded.Verdicts, d.Replayed.Verdicts) {
+		b.WriteString("\n  verdicts recorded:")
+		for _, v := range d.Recorded.Verdicts {
+			fmt.Fprintf(&b, " %s/%s=%s", v.Chain, v.Middleware, v.Action)
+		}
+		b.WriteString("\n  verdicts replayed:")
+		for _, v := range d.Replayed.Verdicts {
+			fmt.Fprintf(&b, " %s/%s=%s", v.Chain, v.Middleware, v.Action)
+		}
+	}
+	return b.String()
+}
+
+// Replay runs the transactions recorded in dir through router and returns
+// those whose final action or middleware verdicts differ, in file order.
+// Transactions are replayed with their recorded envelope and client IP;
+// middleware that depend on time or external services may legitimately
+// decide differently.
+func Replay(dir string, router *brisa.Router) ([]*Diff, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var replayed *Transaction
+	rec := &Recorder{logger: slog.Default(), save: func(t *Transaction) error {
+		replayed = t
+		return nil
+	}}
+	b := brisa.New(slog.New(slog.DiscardHandler), rec)
+	b.UpdateRouter(rec.Instrument(router))
+
+	var diffs []*Diff
+	for _, file := range files {
+		recorded, body, err := load(dir, file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		replayed = nil
+		env := brisa.Envelope{ClientAddr: &net.TCPAddr{IP: net.ParseIP(recorded.ClientIP)}, From: recorded.From, To: recorded.To}
+		result := b.Simulate(env, bytes.NewReader(body))
+		if replayed == nil {
+			// Rejected before the data chain.
+			replayed = &Transaction{Action: result.Action.String()}
+		}
+		if replayed.Action != recorded.Action || !slices.Equal(replayed.Verdicts, recorded.Verdicts) {
+			diffs = append(diffs, &Diff{File: file, Recorded: recorded, Replayed: replayed})
+		}
+	}
+	return diffs, nil
+}
+
+// load reads a transaction file and its message.
+func load(dir, file string) (*Transaction, []byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &Transaction{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, nil, err
+	}
+	body, err := os.ReadFile(filepath.Join(dir, t.BodySHA256+".eml"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, body, nil
+}
@@ -0,0 +1,93 @@
+package golden
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+)
+
+func subjectFilter(word string, action brisa.Action) *brisa.Middleware {
+	return &brisa.Middleware{Name: "subject", Handler: func(ctx *brisa.Context) brisa.Action {
+		data, _ := io.ReadAll(ctx.Reader)
+		ctx.Reader = bytes.NewReader(data)
+		if bytes.Contains(data, []byte(word)) {
+			return action
+		}
+		return brisa.Pass
+	}}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := &brisa.Router{}
+	router.OnData(subjectFilter("viagra", brisa.Quarantine))
+	b := brisa.New(nil, rec)
+	b.UpdateRouter(rec.Instrument(router))
+
+	env := brisatest.DefaultEnvelope()
+	for _, msg := range []string{"Subject: hello\r\n\r\nhi\r\n", "Subject: viagra\r\n\r\nbuy\r\n"} {
+		b.Simulate(env, strings.NewReader(msg))
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	emls, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 2 || len(emls) != 2 {
+		t.Fatalf("expected 2 transactions and 2 messages, got %v %v", files, emls)
+	}
+	data, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(data), `"middleware": "subject"`) {
+		t.Errorf("expected verdict in transaction, got %s", data)
+	}
+
+	// 未改变的路由回放结果一致
+	diffs, err := Replay(dir, router)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v", diffs)
+	}
+
+	changed := &brisa.Router{}
+	changed.OnData(subjectFilter("hello", brisa.Reject))
+	diffs, err = Replay(dir, changed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(diffs) != 2 {
+		t.Fatalf("expected 2 differences, got %d", len(diffs))
+	}
+	for _, d := range diffs {
+		t.Log(d)
+	}
+	if diffs[0].Recorded.Action != "deliver" || diffs[0].Replayed.Action != "reject" {
+		t.Errorf("unexpected first difference: %s", diffs[0])
+	}
+	if diffs[1].Recorded.Action != "quarantine" || diffs[1].Replayed.Action != "deliver" {
+		t.Errorf("unexpected second difference: %s", diffs[1])
+	}
+
+	blocked := &brisa.Router{}
+	blocked.OnConn(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		if ctx.Session.GetClientIP().(*net.TCPAddr).IP.Equal(brisatest.DefaultClientIP) {
+			return brisa.Reject
+		}
+		return brisa.Pass
+	}})
+	diffs, _ = Replay(dir, blocked)
+	if len(diffs) != 2 || diffs[0].Replayed.Action != "reject" {
+		t.Errorf("expected replay to use the recorded client IP, got %v", diffs)
+	}
+}
@@ -0,0 +1,360 @@
+package brisa
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// gossipMaxPacket bounds the size of a gossip packet.
+	gossipMaxPacket = 8 << 10
+	// gossipVersionTTL is how long a deleted key, or one set without a TTL,
+	// keeps the version of its change, so that older updates arriving late do
+	// not revive or overwrite it. Updates are sent once, so one arriving
+	// later than that is not expected.
+	gossipVersionTTL = time.Hour
+)
+
+// gossipUpdate is a change to the store of an instance, sent to its peers.
+type gossipUpdate struct {
+	Node string `json:"node"`
+	// Op is "set", "delete" or "incr".
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Delta int64  `json:"delta,omitempty"`
+	// TTL is in milliseconds; zero means the key never expires.
+	TTL int64 `json:"ttl,omitempty"`
+	// At is the time of the change in Unix nanoseconds, the version of the
+	// key for set and delete.
+	At int64 `json:"at"`
+}
+
+// GossipConfig configures a GossipStore.
+type GossipConfig struct {
+	// Store holds the state of the instance. Defaults to a new MemoryStore.
+	Store Store
+	// Addr is the UDP address the instance receives updates on, e.g.
+	// ":7946".
+	Addr string
+	// Peers are the UDP addresses of the other instances.
+	Peers []string
+	// Secret authenticates the updates; all instances must share it. The
+	// updates are neither encrypted nor protected from replay, so they should
+	// travel on a private network. Packets failing authentication are
+	// dropped and counted as gossip_updates_rejected in the expvar map
+	// "brisa".
+	Secret []byte
+	// Prefixes are the key prefixes shared with the peers, e.g. "blacklist:",
+	// "bounce:rep:" and "greylist:". Defaults to all keys. Keep local counters,
+	// such as those of rate limits per instance, out of them.
+	Prefixes []string
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+	// Clock versions the changes and expires the versions. Defaults to
+	// brisa.SystemClock.
+	Clock Clock
+}
+
+// GossipStore is a Store whose changes are pushed to the other instances of
+// a cluster, for deployments without a shared Store such as RedisStore:
+// dynamic bans, reputation changes and greylist confirmations made on one
+// instance soon apply on all of them.
+//
+// Instances converge eventually: the latest set or delete of a key wins, and
+// counter deltas add up whatever their order. Updates are sent once over UDP,
+// so one lost in transit leaves its key different on one instance until it
+// is written again or expires. Operations are atomic on each instance only;
+// two instances may both create the same key.
+type GossipStore struct {
+	cfg   GossipConfig
+	node  string
+	conn  net.PacketConn
+	peers []*net.UDPAddr
+
+	// versions holds the time of the latest set or delete of the shared
+	// keys, until they expire or for gossipVersionTTL.
+	mu       sync.Mutex
+	versions map[string]gossipVersion
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type gossipVersion struct {
+	at      int64
+	expires time.Time
+}
+
+// NewGossipStore creates a GossipStore and starts receiving the updates of
+// its peers.
+func NewGossipStore(cfg GossipConfig) (*GossipStore, error) {
+	if len(cfg.Secret) == 0 {
+		return nil, fmt.Errorf("gossip needs a secret")
+	}
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("gossip needs an address")
+	}
+	peers := make([]*net.UDPAddr, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, fmt.Errorf("gossip peer %q: %w", p, err)
+		}
+		peers = append(peers, addr)
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryStoreWithClock(cfg.Clock)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	conn, err := net.ListenPacket("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("gossip: %w", err)
+	}
+	g := &GossipStore{
+		cfg:      cfg,
+		node:     uuid.NewString(),
+		conn:     conn,
+		peers:    peers,
+		versions: make(map[string]gossipVersion),
+		done:     make(chan struct{}),
+	}
+	g.wg.Add(2)
+	go g.receive()
+	go g.prune()
+	return g, nil
+}
+
+// Addr returns the address the store receives updates on.
+func (g *GossipStore) Addr() net.Addr {
+	return g.conn.LocalAddr()
+}
+
+// Close stops sending and receiving updates. The local store stays usable.
+func (g *GossipStore) Close() error {
+	close(g.done)
+	err := g.conn.Close()
+	g.wg.Wait()
+	return err
+}
+
+// Get implements Store.
+func (g *GossipStore) Get(key string) ([]byte, bool, error) {
+	return g.cfg.Store.Get(key)
+}
+
+// Set implements Store.
+func (g *GossipStore) Set(key string, value []byte, ttl time.Duration) error {
+	if err := g.cfg.Store.Set(key, value, ttl); err != nil {
+		return err
+	}
+	if g.shared(key) {
+		u := &gossipUpdate{Op: "set", Key: key, Value: value, TTL: ttl.Milliseconds(), At: g.cfg.Clock.Now().UnixNano()}
+		g.version(u)
+		g.send(u)
+	}
+	return nil
+}
+
+// Delete implements Store.
+func (g *GossipStore) Delete(key string) error {
+	if err := g.cfg.Store.Delete(key); err != nil {
+		return err
+	}
+	if g.shared(key) {
+		u := &gossipUpdate{Op: "delete", Key: key, At: g.cfg.Clock.Now().UnixNano()}
+		g.version(u)
+		g.send(u)
+	}
+	return nil
+}
+
+// DeleteFunc implements ScanStore if the local store is a ScanStore. The
+// shared keys removed are deleted on the peers as well.
+func (g *GossipStore) DeleteFunc(match func(key string) bool) (int, error) {
+	scan, ok := g.cfg.Store.(ScanStore)
+	if !ok {
+		return 0, ErrStoreNotScannable
+	}
+	var deleted []string
+	n, err := scan.DeleteFunc(func(key string) bool {
+		if !match(key) {
+			return false
+		}
+		deleted = append(deleted, key)
+		return true
+	})
+	for _, key := range deleted {
+		if g.shared(key) {
+			u := &gossipUpdate{Op: "delete", Key: key, At: g.cfg.Clock.Now().UnixNano()}
+			g.version(u)
+			g.send(u)
+		}
+	}
+	return n, err
+}
+
+// Incr implements Store. The peers add delta to their own counter.
+func (g *GossipStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	n, err := g.cfg.Store.Incr(key, delta, ttl)
+	if err != nil {
+		return 0, err
+	}
+	if delta != 0 && g.shared(key) {
+		g.send(&gossipUpdate{Op: "incr", Key: key, Delta: delta, TTL: ttl.Milliseconds(), At: g.cfg.Clock.Now().UnixNano()})
+	}
+	return n, nil
+}
+
+// shared reports whether key is shared with the peers.
+func (g *GossipStore) shared(key string) bool {
+	if len(g.cfg.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range g.cfg.Prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// version records the version of the key of a set or delete and reports
+// whether it is newer than the recorded one.
+func (g *GossipStore) version(u *gossipUpdate) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if v, ok := g.versions[u.Key]; ok && v.at > u.At {
+		return false
+	}
+	now := g.cfg.Clock.Now()
+	v := gossipVersion{at: u.At, expires: now.Add(gossipVersionTTL)}
+	if u.Op == "set" && u.TTL > 0 {
+		v.expires = now.Add(time.Duration(u.TTL) * time.Millisecond)
+	}
+	g.versions[u.Key] = v
+	return true
+}
+
+// send pushes an update to all peers.
+func (g *GossipStore) send(u *gossipUpdate) {
+	u.Node = g.node
+	payload, err := json.Marshal(u)
+	if err != nil {
+		return
+	}
+	if len(payload)+sha256.Size > gossipMaxPacket {
+		g.cfg.Logger.Warn("gossip update too large, not sent", "key", u.Key, "size", len(payload))
+		return
+	}
+	packet := append(g.sign(payload), payload...)
+	for _, peer := range g.peers {
+		if _, err := g.conn.WriteTo(packet, peer); err != nil {
+			g.cfg.Logger.Debug("failed to send gossip update", "peer", peer, "error", err)
+		}
+	}
+}
+
+func (g *GossipStore) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, g.cfg.Secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// receive applies the updates of the peers until the store is closed.
+func (g *GossipStore) receive() {
+	defer g.wg.Done()
+	buf := make([]byte, gossipMaxPacket)
+	for {
+		n, from, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		// Anyone reaching the port can send packets, so rejected ones are
+		// counted rather than logged as warnings.
+		if n < sha256.Size || !hmac.Equal(buf[:sha256.Size], g.sign(buf[sha256.Size:n])) {
+			debugVars.Add("gossip_updates_rejected", 1)
+			g.cfg.Logger.Debug("gossip update with invalid signature ignored", "from", from)
+			continue
+		}
+		var u gossipUpdate
+		if err := json.Unmarshal(buf[sha256.Size:n], &u); err != nil {
+			debugVars.Add("gossip_updates_rejected", 1)
+			g.cfg.Logger.Debug("malformed gossip update ignored", "from", from, "error", err)
+			continue
+		}
+		if err := g.apply(&u); err != nil {
+			g.cfg.Logger.Error("failed to apply gossip update", "key", u.Key, "error", err)
+		}
+	}
+}
+
+// apply applies an update of a peer to the local store.
+func (g *GossipStore) apply(u *gossipUpdate) error {
+	if u.Node == g.node || !g.shared(u.Key) {
+		return nil
+	}
+	ttl := time.Duration(u.TTL) * time.Millisecond
+	switch u.Op {
+	case "set":
+		if !g.version(u) {
+			return nil
+		}
+		return g.cfg.Store.Set(u.Key, u.Value, ttl)
+	case "delete":
+		if !g.version(u) {
+			return nil
+		}
+		return g.cfg.Store.Delete(u.Key)
+	case "incr":
+		_, err := g.cfg.Store.Incr(u.Key, u.Delta, ttl)
+		return err
+	default:
+		return fmt.Errorf("unknown operation %q", u.Op)
+	}
+}
+
+// prune drops the expired versions every minute.
+func (g *GossipStore) prune() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			g.pruneVersions()
+		}
+	}
+}
+
+// pruneVersions drops the versions that have expired by the time of the
+// clock.
+func (g *GossipStore) pruneVersions() {
+	now := g.cfg.Clock.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, v := range g.versions {
+		if now.After(v.expires) {
+			delete(g.versions, key)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package brisa
+
+import (
+	"errors"
+	"expvar"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// newGossipPair 创建互为对等节点的两个 GossipStore
+func newGossipPair(t *testing.T, prefixes ...string) (*GossipStore, *GossipStore) {
+	t.Helper()
+	cfg := GossipConfig{Addr: "127.0.0.1:0", Secret: []byte("s3cret"), Prefixes: prefixes, Logger: slog.New(slog.DiscardHandler)}
+	a, err := NewGossipStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Peers = []string{a.Addr().String()}
+	b, err := NewGossipStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a 启动时还不知道 b 的地址
+	a.peers = append(a.peers, b.conn.LocalAddr().(*net.UDPAddr))
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// eventually 等待条件成立
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGossipStore_Replication(t *testing.T) {
+	a, b := newGossipPair(t)
+
+	a.Set("blacklist:192.0.2.1", []byte("1"), time.Hour)
+	eventually(t, func() bool {
+		v, ok, _ := b.Get("blacklist:192.0.2.1")
+		return ok && string(v) == "1"
+	}, "expected the ban to reach the peer")
+
+	b.Delete("blacklist:192.0.2.1")
+	eventually(t, func() bool {
+		_, ok, _ := a.Get("blacklist:192.0.2.1")
+		return !ok
+	}, "expected the deletion to reach the peer")
+
+	// 计数器的增量在两边累加
+	a.Incr("rep:192.0.2.2", -3, time.Hour)
+	b.Incr("rep:192.0.2.2", -2, time.Hour)
+	for _, s := range []*GossipStore{a, b} {
+		eventually(t, func() bool {
+			n, _ := s.Incr("rep:192.0.2.2", 0, 0)
+			return n == -5
+		}, "expected the counters to converge")
+	}
+}
+
+func TestGossipStore_DeleteFunc(t *testing.T) {
+	a, b := newGossipPair(t, "blacklist:")
+
+	a.Set("blacklist:bob@example.com", []byte("1"), time.Hour)
+	eventually(t, func() bool {
+		_, ok, _ := b.Get("blacklist:bob@example.com")
+		return ok
+	}, "expected the ban to reach the peer")
+
+	n, err := PurgeAddress(a, "bob@example.com")
+	if err != nil || n != 1 {
+		t.Fatalf("expected (1, nil), got (%d, %v)", n, err)
+	}
+	eventually(t, func() bool {
+		_, ok, _ := b.Get("blacklist:bob@example.com")
+		return !ok
+	}, "expected the purge to reach the peer")
+
+	g, err := NewGossipStore(GossipConfig{Addr: "127.0.0.1:0", Secret: []byte("s3cret"), Store: struct{ Store }{NewMemoryStore()}, Logger: slog.New(slog.DiscardHandler)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, err := g.DeleteFunc(func(string) bool { return true }); !errors.Is(err, ErrStoreNotScannable) {
+		t.Errorf("expected ErrStoreNotScannable, got %v", err)
+	}
+}
+
+func TestGossipStore_Prefixes(t *testing.T) {
+	a, b := newGossipPair(t, "greylist:")
+	a.Set("ratelimit:x", []byte("1"), 0)
+	a.Set("greylist:y", []byte("pass"), 0)
+	eventually(t, func() bool {
+		_, ok, _ := b.Get("greylist:y")
+		return ok
+	}, "expected the shared key to reach the peer")
+	if _, ok, _ := b.Get("ratelimit:x"); ok {
+		t.Error("expected the local key not to be shared")
+	}
+}
+
+func TestGossipStore_LatestWins(t *testing.T) {
+	a, _ := newGossipPair(t)
+	now := time.Now().UnixNano()
+	a.apply(&gossipUpdate{Node: "peer", Op: "set", Key: "k", Value: []byte("new"), At: now})
+	// 迟到的旧更新被忽略
+	a.apply(&gossipUpdate{Node: "peer", Op: "set", Key: "k", Value: []byte("old"), At: now - 1})
+	a.apply(&gossipUpdate{Node: "peer", Op: "delete", Key: "k", At: now - 1})
+	if v, _, _ := a.Get("k"); string(v) != "new" {
+		t.Errorf("expected the latest value to win, got %q", v)
+	}
+}
+
+func TestGossipStore_Versions(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	g, err := NewGossipStore(GossipConfig{Addr: "127.0.0.1:0", Secret: []byte("s3cret"), Logger: slog.New(slog.DiscardHandler), Clock: ClockFunc(func() time.Time { return now })})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	g.Set("permanent", []byte("1"), 0)
+	g.Set("long", []byte("1"), 2*gossipVersionTTL)
+	g.Delete("deleted")
+	if v := g.versions["permanent"]; v.at != now.UnixNano() {
+		t.Errorf("expected the version to be the time of the clock, got %d", v.at)
+	}
+	// A late update older than the recorded version is ignored.
+	g.apply(&gossipUpdate{Node: "peer", Op: "set", Key: "deleted", Value: []byte("old"), At: now.Add(-time.Second).UnixNano()})
+	if _, ok, _ := g.Get("deleted"); ok {
+		t.Error("expected the deleted key to stay deleted")
+	}
+
+	// The versions of permanent and deleted keys expire too, those of keys
+	// with a longer TTL when the keys do.
+	now = now.Add(gossipVersionTTL + time.Second)
+	g.pruneVersions()
+	if _, ok := g.versions["permanent"]; ok {
+		t.Error("expected the version of the permanent key to be pruned")
+	}
+	if _, ok := g.versions["deleted"]; ok {
+		t.Error("expected the tombstone to be pruned")
+	}
+	if _, ok := g.versions["long"]; !ok {
+		t.Error("expected the version of the key with a TTL to be kept until it expires")
+	}
+	now = now.Add(gossipVersionTTL)
+	g.pruneVersions()
+	if len(g.versions) != 0 {
+		t.Errorf("expected all versions to be pruned, got %v", g.versions)
+	}
+}
+
+func TestGossipStore_Secret(t *testing.T) {
+	a, _ := newGossipPair(t)
+	cfg := GossipConfig{Addr: "127.0.0.1:0", Peers: []string{a.Addr().String()}, Secret: []byte("wrong"), Logger: slog.New(slog.DiscardHandler)}
+	evil, err := NewGossipStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer evil.Close()
+	rejected := debugVars.Get("gossip_updates_rejected").(*expvar.Int).Value()
+	evil.Set("blacklist:192.0.2.9", []byte("1"), 0)
+	// 之后的合法更新到达时，伪造的更新应该已被丢弃
+	b := &GossipStore{cfg: a.cfg, node: "b", conn: evil.conn, peers: evil.peers}
+	b.send(&gossipUpdate{Op: "set", Key: "marker", Value: []byte("1"), At: time.Now().UnixNano()})
+	eventually(t, func() bool {
+		_, ok, _ := a.Get("marker")
+		return ok
+	}, "expected the signed update to arrive")
+	if _, ok, _ := a.Get("blacklist:192.0.2.9"); ok {
+		t.Error("expected the update with a wrong signature to be ignored")
+	}
+	if n := debugVars.Get("gossip_updates_rejected").(*expvar.Int).Value(); n <= rejected {
+		t.Errorf("expected the update with a wrong signature to be counted, got %d", n-rejected)
+	}
+
+	if _, err := NewGossipStore(GossipConfig{Addr: "127.0.0.1:0"}); err == nil {
+		t.Error("expected an error without a secret")
+	}
+}
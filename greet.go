@@ -0,0 +1,131 @@
+package brisa
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// NewGreetListener returns a listener whose connections hold back the
+// greeting for delay and watch the client meanwhile. Legitimate clients wait
+// for the greeting and for the reply to EHLO before sending more, as RFC 5321
+// and RFC 2920 require; spambots often talk right away. Sessions of clients
+// sending before the greeting, or more commands along with their first HELO
+// or EHLO, get FlagEarlyTalker before the conn chain runs.
+//
+// The listener must accept plain connections: with implicit TLS, the client
+// speaks first by design.
+func NewGreetListener(l net.Listener, delay time.Duration) net.Listener {
+	return &greetListener{Listener: l, delay: delay}
+}
+
+type greetListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+// Accept implements net.Listener.
+func (l *greetListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &greetConn{Conn: c, delay: l.delay}, nil
+}
+
+// greetConn detects early talkers: clients sending before the greeting, or
+// more commands in the same packet as the first HELO or EHLO.
+type greetConn struct {
+	net.Conn
+	delay   time.Duration
+	greeted bool
+	// pending holds what the client sent before the greeting.
+	pending []byte
+	// line collects the first command line until it is complete.
+	line      []byte
+	firstDone bool
+	early     atomic.Value // string: the reason, once detected
+}
+
+// Write implements net.Conn. The first write is the greeting.
+func (c *greetConn) Write(p []byte) (int, error) {
+	if !c.greeted {
+		c.greeted = true
+		c.pause()
+	}
+	return c.Conn.Write(p)
+}
+
+// pause waits for the greeting delay, reading what the client sends meanwhile.
+func (c *greetConn) pause() {
+	if c.delay <= 0 {
+		return
+	}
+	deadline := time.Now().Add(c.delay)
+	c.Conn.SetReadDeadline(deadline)
+	buf := make([]byte, 512)
+	n, _ := c.Conn.Read(buf)
+	c.Conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		c.pending = buf[:n]
+		c.early.Store("talked before greeting")
+		// Early talkers wait the full delay all the same.
+		time.Sleep(time.Until(deadline))
+	}
+}
+
+// Read implements net.Conn.
+func (c *greetConn) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if len(c.pending) > 0 {
+		n = copy(p, c.pending)
+		c.pending = c.pending[n:]
+	} else {
+		n, err = c.Conn.Read(p)
+	}
+	if !c.firstDone && n > 0 {
+		c.inspect(p[:n])
+	}
+	return n, err
+}
+
+// inspect looks for commands pipelined after the first HELO or EHLO.
+func (c *greetConn) inspect(data []byte) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		c.line = append(c.line, data...)
+		return
+	}
+	c.firstDone = true
+	line := strings.ToUpper(string(append(c.line, data[:i]...)))
+	c.line = nil
+	if (strings.HasPrefix(line, "EHLO") || strings.HasPrefix(line, "HELO")) && i+1 < len(data) {
+		if c.early.Load() == nil {
+			c.early.Store("pipelined greeting")
+		}
+	}
+}
+
+// earlyTalker returns why the client is an early talker, or "".
+func (c *greetConn) earlyTalker() string {
+	reason, _ := c.early.Load().(string)
+	return reason
+}
+
+// earlyTalkerOf returns why the client of c is an early talker, or "" if it
+// is not or c was not accepted by a greet listener. After STARTTLS, the
+// connection of the listener is beneath the TLS connection, and the verdict
+// carries over to the sessions started over TLS.
+func earlyTalkerOf(c net.Conn) string {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if g, ok := c.(*greetConn); ok {
+		return g.earlyTalker()
+	}
+	return ""
+}
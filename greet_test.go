@@ -0,0 +1,100 @@
+package brisa
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startGreetServer 启动一个延迟问候的测试服务器，返回其地址和记录早发标志的通道
+func startGreetServer(t *testing.T, delay time.Duration) (string, <-chan bool) {
+	t.Helper()
+	flagged := make(chan bool, 1)
+	b := New(slog.New(slog.DiscardHandler))
+	b.UpdateRouter(&Router{ChainConn: {{Handler: func(ctx *Context) Action {
+		flagged <- ctx.HasFlag(FlagEarlyTalker)
+		return Pass
+	}}}})
+	addr := startTestServer(t, b, testServerOptions{
+		tls:  testTLSConfig(t),
+		wrap: func(l net.Listener) net.Listener { return NewGreetListener(l, delay) },
+	})
+	return addr, flagged
+}
+
+// expectFlag 检查会话是否被标记为早发客户端
+func expectFlag(t *testing.T, flagged <-chan bool, want bool) {
+	t.Helper()
+	select {
+	case got := <-flagged:
+		if got != want {
+			t.Errorf("expected early talker flag %v, got %v", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("conn chain did not run")
+	}
+}
+
+func TestGreetListener_WellBehaved(t *testing.T) {
+	addr, flagged := startGreetServer(t, 100*time.Millisecond)
+	conn, r := dialTest(t, addr, false)
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "220") {
+		t.Fatalf("unexpected greeting: %q", reply)
+	}
+	io.WriteString(conn, "EHLO client.example.org\r\n")
+	readReply(t, r)
+	expectFlag(t, flagged, false)
+}
+
+func TestGreetListener_TalkBeforeGreeting(t *testing.T) {
+	addr, flagged := startGreetServer(t, 200*time.Millisecond)
+	conn, r := dialTest(t, addr, false)
+	// 不等待问候就发送命令
+	io.WriteString(conn, "EHLO bot.example.org\r\n")
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "220") {
+		t.Fatalf("unexpected greeting: %q", reply)
+	}
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("unexpected EHLO reply: %q", reply)
+	}
+	expectFlag(t, flagged, true)
+}
+
+func TestGreetListener_STARTTLS(t *testing.T) {
+	addr, flagged := startGreetServer(t, 200*time.Millisecond)
+	conn, r := dialTest(t, addr, false)
+	io.WriteString(conn, "EHLO bot.example.org\r\n")
+	readReply(t, r)
+	readReply(t, r)
+	expectFlag(t, flagged, true)
+
+	// STARTTLS 之后的新会话仍然带有早发标志
+	io.WriteString(conn, "STARTTLS\r\n")
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "220") {
+		t.Fatalf("unexpected STARTTLS reply: %q", reply)
+	}
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(tc, "EHLO bot.example.org\r\n")
+	if reply := readReply(t, bufio.NewReader(tc)); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("unexpected EHLO reply: %q", reply)
+	}
+	expectFlag(t, flagged, true)
+}
+
+func TestGreetListener_PipelinedGreeting(t *testing.T) {
+	addr, flagged := startGreetServer(t, 50*time.Millisecond)
+	conn, r := dialTest(t, addr, false)
+	readReply(t, r)
+	// EHLO 之后不等待回复就发送 MAIL FROM
+	io.WriteString(conn, "EHLO bot.example.org\r\nMAIL FROM:<a@example.org>\r\n")
+	readReply(t, r)
+	expectFlag(t, flagged, true)
+}
@@ -0,0 +1,240 @@
+package brisa
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultHookWorkers is the default number of goroutines running
+	// post-accept hooks.
+	DefaultHookWorkers = 4
+	// DefaultHookQueueSize is the default number of accepted messages whose
+	// hooks can wait for a worker.
+	DefaultHookQueueSize = 1000
+)
+
+// HookConfig configures the workers of post-accept hooks.
+type HookConfig struct {
+	// Workers is the number of hooks run concurrently. Defaults to
+	// DefaultHookWorkers.
+	Workers int
+	// QueueSize is the number of accepted messages whose hooks can wait for a
+	// worker. When the queue is full, the hooks are dropped. Defaults to
+	// DefaultHookQueueSize.
+	QueueSize int
+}
+
+// Hook is work scheduled with Context.AfterAccept.
+type Hook func(tx *Transaction)
+
+// Transaction is the snapshot of an accepted mail transaction handed to
+// hooks. It does not change, and it stays valid while the session goes on
+// and its Context is reused. The values of its keys are shared with the
+// session and must not be modified.
+type Transaction struct {
+	SessionID string
+	MailID    string
+	Listener  string
+	// Tenant is the name of the tenant of the transaction, if any.
+	Tenant     string
+	ClientAddr net.Addr
+	From       string
+	To         []string
+	// Action is the final action of the message: Deliver, Quarantine or
+	// Discard.
+	Action Action
+	Score  float64
+	Flags  Flag
+	Auth   AuthInfo
+	// Logger logs with the session and mail IDs of the transaction.
+	Logger *slog.Logger
+	keys   map[string]any
+}
+
+// Get returns the value of a key of the transaction or its session when the
+// message was accepted.
+func (t *Transaction) Get(key string) (value any, exists bool) {
+	value, exists = t.keys[key]
+	return value, exists
+}
+
+// hook is a Hook with its name, which identifies it in logs.
+type hook struct {
+	name string
+	fn   Hook
+}
+
+// AfterAccept schedules fn to run once the current message is accepted, after
+// the reply to the client is on its way, for slow work the reply should not
+// wait for, such as notifications or training a classifier. It is dropped
+// if the message is refused. fn runs on the workers started with
+// Brisa.StartHooks, with a Transaction instead of the pooled Context, so it
+// must capture anything else it needs, such as the message data, itself.
+// Without started workers, hooks run before the reply, as in Simulate.
+func (c *Context) AfterAccept(name string, fn Hook) {
+	c.checkLive()
+	c.hooks = append(c.hooks, hook{name: name, fn: fn})
+}
+
+// StartHooks starts the workers running the hooks of accepted messages; see
+// Context.AfterAccept. Stop them with StopHooks after the SMTP server.
+func (b *Brisa) StartHooks(cfg HookConfig) {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultHookWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultHookQueueSize
+	}
+	p := &hookPool{jobs: make(chan *hookJob, cfg.QueueSize)}
+	for range cfg.Workers {
+		p.wg.Add(1)
+		go p.work()
+	}
+	if old := b.hooks.Swap(p); old != nil {
+		go old.stop(context.Background())
+	}
+}
+
+// StopHooks stops queueing hooks for new sessions and waits until the queued
+// hooks have run or ctx is done, returning its error then.
+func (b *Brisa) StopHooks(ctx context.Context) error {
+	p := b.hooks.Swap(nil)
+	if p == nil {
+		return nil
+	}
+	return p.stop(ctx)
+}
+
+// DroppedHooks returns the number of hooks the started workers dropped
+// because the queue was full.
+func (b *Brisa) DroppedHooks() uint64 {
+	if p := b.hooks.Load(); p != nil {
+		return p.dropped.Load()
+	}
+	return 0
+}
+
+// hookPool runs the hooks of accepted messages in worker goroutines.
+type hookPool struct {
+	jobs    chan *hookJob
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+
+	// mu guards closed, so no job is sent on the closed jobs channel.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// hookJob are the hooks of an accepted message.
+type hookJob struct {
+	tx    *Transaction
+	hooks []hook
+}
+
+func (p *hookPool) enqueue(job *hookJob) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *hookPool) stop(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *hookPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		job.run()
+	}
+}
+
+// run runs the hooks of the job in order. A panicking hook is logged and does
+// not affect the others.
+func (j *hookJob) run() {
+	for _, h := range j.hooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					j.tx.Logger.Error("hook panicked", "hook", h.name, "panic", r)
+				}
+			}()
+			h.fn(j.tx)
+		}()
+	}
+}
+
+// runHooks hands the hooks of the accepted message to the workers, or runs
+// them if none are started.
+func (s *Session) runHooks() {
+	if len(s.ctx.hooks) == 0 {
+		return
+	}
+	job := &hookJob{tx: s.transaction(), hooks: slices.Clone(s.ctx.hooks)}
+	if s.hookPool == nil {
+		job.run()
+		return
+	}
+	if !s.hookPool.enqueue(job) {
+		s.hookPool.dropped.Add(uint64(len(job.hooks)))
+		s.ctx.Logger.Warn("hook queue full, hooks dropped", "hooks", len(job.hooks))
+	}
+}
+
+// transaction returns the snapshot of the current transaction.
+func (s *Session) transaction() *Transaction {
+	c := s.ctx
+	tx := &Transaction{
+		SessionID:  s.id,
+		MailID:     s.mailID,
+		Listener:   s.listener,
+		Tenant:     c.tenant,
+		ClientAddr: s.GetClientIP(),
+		From:       c.From,
+		To:         slices.Clone(c.To),
+		Action:     c.Action,
+		Score:      c.Score,
+		Flags:      c.flags,
+		Auth:       c.auth,
+		Logger:     c.Logger,
+	}
+	c.mu.RLock()
+	tx.keys = maps.Clone(c.sessionKeys)
+	if tx.keys == nil {
+		tx.keys = maps.Clone(c.keys)
+	} else {
+		maps.Copy(tx.keys, c.keys)
+	}
+	c.mu.RUnlock()
+	return tx
+}
@@ -0,0 +1,126 @@
+package brisa
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContext_AfterAccept(t *testing.T) {
+	b := New(nil)
+	b.StartHooks(HookConfig{Workers: 1, QueueSize: 1})
+	release := make(chan struct{})
+	txs := make(chan *Transaction, 2)
+
+	router := Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		ctx.Set("verdict", "clean")
+		ctx.AfterAccept("panics", func(tx *Transaction) { panic("boom") })
+		ctx.AfterAccept("record", func(tx *Transaction) {
+			<-release
+			txs <- tx
+		})
+		if strings.Contains(ctx.To[0], "refused") {
+			return Reject
+		}
+		return Pass
+	}})
+	b.UpdateRouter(&router)
+
+	s := newPostQueueSession(b)
+	s.hookPool = b.hooks.Load()
+	// 钩子不阻塞回复
+	if err := sendMessage(t, s, "Subject: hi\r\n\r\nhello\r\n"); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	mailID := s.MailID()
+
+	// 被拒绝的邮件不运行钩子；下一个事务不影响已排队的快照
+	if err := s.Mail("carol@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("refused@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Data(strings.NewReader("\r\n")); err == nil {
+		t.Fatal("expected the message to be refused")
+	}
+	s.Logout()
+
+	close(release)
+	select {
+	case tx := <-txs:
+		if tx.MailID != mailID || tx.From != "alice@example.com" || len(tx.To) != 1 || tx.To[0] != "bob@example.com" || tx.Action != Deliver {
+			t.Errorf("unexpected transaction: %+v", tx)
+		}
+		if v, _ := tx.Get("verdict"); v != "clean" {
+			t.Errorf("expected the transaction key, got %v", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("hook did not run")
+	}
+	if err := b.StopHooks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 0 {
+		t.Error("expected no hook for the refused message")
+	}
+}
+
+func TestContext_AfterAccept_QueueFull(t *testing.T) {
+	b := New(nil)
+	b.StartHooks(HookConfig{Workers: 1, QueueSize: 1})
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	router := Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		ctx.AfterAccept("block", func(tx *Transaction) {
+			started <- struct{}{}
+			<-release
+		})
+		return Pass
+	}})
+	b.UpdateRouter(&router)
+
+	send := func() {
+		s := newPostQueueSession(b)
+		s.hookPool = b.hooks.Load()
+		defer s.Logout()
+		if err := sendMessage(t, s, "\r\n"); err != nil {
+			t.Fatalf("DATA failed: %v", err)
+		}
+	}
+	// 第一个钩子占用工作者，第二个排队，第三个被丢弃
+	send()
+	<-started
+	send()
+	send()
+	if n := b.DroppedHooks(); n != 1 {
+		t.Errorf("expected 1 dropped hook, got %d", n)
+	}
+	close(release)
+	if err := b.StopHooks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 1 {
+		t.Error("expected the queued hook to run")
+	}
+}
+
+func TestContext_AfterAccept_Inline(t *testing.T) {
+	ran := false
+	router := Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		ctx.AfterAccept("inline", func(tx *Transaction) { ran = true })
+		return Discard
+	}})
+	b := New(nil)
+	b.UpdateRouter(&router)
+
+	// 没有启动工作者时，钩子在回复前运行
+	res := b.Simulate(Envelope{From: "alice@example.com", To: []string{"bob@example.com"}}, strings.NewReader("\r\n"))
+	if res.Err != nil || !ran {
+		t.Errorf("expected the hook to run inline, got %v, ran %v", res.Err, ran)
+	}
+}
@@ -0,0 +1,116 @@
+package brisa
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// RetentionTask removes the data of a store that is past its retention, e.g.
+// expired entries or files older than a maximum age, and reports what it
+// removed.
+type RetentionTask func(ctx context.Context) (RetentionResult, error)
+
+// RetentionResult is the data removed by a run of a RetentionTask.
+type RetentionResult struct {
+	// Items is the number of entries, files or messages removed.
+	Items int64
+	// Bytes is the space reclaimed, if the store knows it.
+	Bytes int64
+}
+
+// JanitorStats sums up the runs of a RetentionTask.
+type JanitorStats struct {
+	Runs    int64
+	Errors  int64
+	Items   int64
+	Bytes   int64
+	LastRun time.Time
+}
+
+// Janitor runs the retention tasks of the stores of a server, each on its own
+// schedule, in the background. Stores register their task with Schedule
+// before Run is called.
+type Janitor struct {
+	logger *slog.Logger
+	tasks  []janitorTask
+
+	mu    sync.Mutex
+	stats map[string]JanitorStats
+}
+
+type janitorTask struct {
+	name     string
+	interval time.Duration
+	fn       RetentionTask
+}
+
+// NewJanitor creates a Janitor logging the failed runs to logger.
+func NewJanitor(logger *slog.Logger) *Janitor {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Janitor{logger: logger, stats: make(map[string]JanitorStats)}
+}
+
+// Schedule runs fn every interval once Run is called. A name identifies the
+// task in logs and Stats. It panics if interval is not positive.
+func (j *Janitor) Schedule(name string, interval time.Duration, fn RetentionTask) {
+	if interval <= 0 {
+		panic("brisa: non-positive janitor interval for " + name)
+	}
+	j.tasks = append(j.tasks, janitorTask{name: name, interval: interval, fn: fn})
+}
+
+// Run runs the scheduled tasks until ctx is done, then waits for the running
+// ones to return.
+func (j *Janitor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range j.tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(t.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					j.run(ctx, t)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// run runs t once and records its outcome.
+func (j *Janitor) run(ctx context.Context, t janitorTask) {
+	r, err := t.fn(ctx)
+	j.mu.Lock()
+	s := j.stats[t.name]
+	s.Runs++
+	s.Items += r.Items
+	s.Bytes += r.Bytes
+	s.LastRun = time.Now()
+	if err != nil {
+		s.Errors++
+	}
+	j.stats[t.name] = s
+	j.mu.Unlock()
+
+	if err != nil {
+		j.logger.Error("retention task failed", "task", t.name, "error", err)
+	} else if r.Items > 0 {
+		j.logger.Debug("retention task removed data", "task", t.name, "items", r.Items, "bytes", r.Bytes)
+	}
+}
+
+// Stats returns the statistics of the task named name.
+func (j *Janitor) Stats(name string) JanitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats[name]
+}
@@ -0,0 +1,54 @@
+package brisa
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJanitor(t *testing.T) {
+	j := NewJanitor(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var runs atomic.Int64
+	j.Schedule("cache", 10*time.Millisecond, func(ctx context.Context) (RetentionResult, error) {
+		runs.Add(1)
+		return RetentionResult{Items: 2, Bytes: 100}, nil
+	})
+	j.Schedule("broken", 10*time.Millisecond, func(ctx context.Context) (RetentionResult, error) {
+		return RetentionResult{}, errors.New("disk unavailable")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		j.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for (runs.Load() < 3 || j.Stats("broken").Errors < 1) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// 每次运行的清理量都会累加
+	s := j.Stats("cache")
+	if s.Runs < 3 || s.Items != 2*s.Runs || s.Bytes != 100*s.Runs || s.Errors != 0 || s.LastRun.IsZero() {
+		t.Errorf("unexpected cache stats %+v", s)
+	}
+	if s := j.Stats("broken"); s.Errors == 0 || s.Errors != s.Runs {
+		t.Errorf("expected the failed runs to be counted, got %+v", s)
+	}
+}
+
+func TestJanitor_InvalidInterval(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a zero interval")
+		}
+	}()
+	NewJanitor(nil).Schedule("cache", 0, nil)
+}
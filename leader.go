@@ -0,0 +1,204 @@
+package brisa
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultLeaderTTL is the default lease of a leader; see LeaderConfig.TTL.
+const DefaultLeaderTTL = 30 * time.Second
+
+// LeaderConfig configures a Leader.
+type LeaderConfig struct {
+	// Store is shared by the instances of the cluster, e.g. a RedisStore.
+	Store Store
+	// Key is the Store key of the lease, e.g. "leader:reports". Instances
+	// competing for the same jobs use the same key.
+	Key string
+	// TTL is how long the lease lasts without renewal, and so how long jobs
+	// stop when the leader dies. It is renewed every third of it. Defaults to
+	// DefaultLeaderTTL.
+	TTL time.Duration
+	// Node identifies the instance in the lease. Defaults to the host name
+	// followed by a random ID.
+	Node string
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Leader elects one instance of a cluster to run the jobs that must run once,
+// such as report generation, retention cleanup or digest sending. The leader
+// holds a lease in the shared Store, which it renews while it runs; when it
+// stops or dies, another instance takes over once the lease expires.
+//
+// The lease is taken atomically if the Store is an AddStore. Its renewal is a
+// separate read and write, so a leader pausing for longer than the TTL may
+// briefly lead alongside its successor; jobs scheduled with Schedule also
+// record their runs in the Store to avoid running twice.
+type Leader struct {
+	cfg LeaderConfig
+
+	mu      sync.Mutex
+	term    context.Context
+	endTerm context.CancelFunc
+}
+
+// NewLeader creates a Leader. It campaigns once Run is called.
+func NewLeader(cfg LeaderConfig) (*Leader, error) {
+	if cfg.Store == nil || cfg.Key == "" {
+		return nil, fmt.Errorf("leader election needs a store and a key")
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("leader ttl must not be negative")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultLeaderTTL
+	}
+	if cfg.Node == "" {
+		host, _ := os.Hostname()
+		cfg.Node = host + "/" + uuid.NewString()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	cfg.Logger = cfg.Logger.With("lease", cfg.Key)
+	return &Leader{cfg: cfg}, nil
+}
+
+// Run campaigns for leadership until ctx is done, then gives up the lease if
+// it holds it.
+func (l *Leader) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.cfg.TTL / 3)
+	defer ticker.Stop()
+	for {
+		l.campaign()
+		select {
+		case <-ctx.Done():
+			l.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsLeader reports whether the instance leads the cluster.
+func (l *Leader) IsLeader() bool {
+	_, ok := l.Term()
+	return ok
+}
+
+// Term returns a context that is canceled when the instance stops leading,
+// and whether it leads.
+func (l *Leader) Term() (context.Context, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.term, l.term != nil
+}
+
+// campaign takes or renews the lease.
+func (l *Leader) campaign() {
+	value, found, err := l.cfg.Store.Get(l.cfg.Key)
+	switch {
+	case err != nil:
+		// Without the Store, the lease may expire unnoticed.
+		l.cfg.Logger.Error("failed to read leader lease", "error", err)
+		l.setLeading(false)
+	case !found:
+		added, err := StoreAdd(l.cfg.Store, l.cfg.Key, []byte(l.cfg.Node), l.cfg.TTL)
+		if err != nil {
+			l.cfg.Logger.Error("failed to take leader lease", "error", err)
+		}
+		l.setLeading(added)
+	case string(value) == l.cfg.Node:
+		err := l.cfg.Store.Set(l.cfg.Key, []byte(l.cfg.Node), l.cfg.TTL)
+		if err != nil {
+			l.cfg.Logger.Error("failed to renew leader lease", "error", err)
+		}
+		l.setLeading(err == nil)
+	default:
+		l.setLeading(false)
+	}
+}
+
+// resign ends the term and releases the lease.
+func (l *Leader) resign() {
+	if !l.IsLeader() {
+		return
+	}
+	l.setLeading(false)
+	if value, found, err := l.cfg.Store.Get(l.cfg.Key); err == nil && found && string(value) == l.cfg.Node {
+		if err := l.cfg.Store.Delete(l.cfg.Key); err != nil {
+			l.cfg.Logger.Error("failed to release leader lease", "error", err)
+		}
+	}
+}
+
+func (l *Leader) setLeading(leading bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case leading && l.term == nil:
+		l.term, l.endTerm = context.WithCancel(context.Background())
+		l.cfg.Logger.Info("leading the cluster", "node", l.cfg.Node)
+	case !leading && l.term != nil:
+		l.endTerm()
+		l.term, l.endTerm = nil, nil
+		l.cfg.Logger.Info("no longer leading the cluster", "node", l.cfg.Node)
+	}
+}
+
+// Schedule runs job every interval while the instance leads the cluster,
+// until ctx is done. The context of job is canceled when the instance stops
+// leading. The time of the last run is kept in the Store under the lease key
+// and name, so that a new leader does not run the job again before its time.
+// Errors of job are logged.
+func (l *Leader) Schedule(ctx context.Context, name string, interval time.Duration, job func(ctx context.Context) error) {
+	key := l.cfg.Key + ":last:" + name
+	logger := l.cfg.Logger.With("job", name)
+	if interval <= 0 {
+		logger.Error("job not scheduled: interval must be positive")
+		return
+	}
+	ticker := time.NewTicker(min(interval, l.cfg.TTL/3))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		term, ok := l.Term()
+		if !ok {
+			continue
+		}
+		value, found, err := l.cfg.Store.Get(key)
+		if err != nil {
+			logger.Error("failed to read last run of job", "error", err)
+			continue
+		}
+		if found {
+			last, _ := strconv.ParseInt(string(value), 10, 64)
+			if time.Since(time.Unix(0, last)) < interval {
+				continue
+			}
+		}
+		if err := l.cfg.Store.Set(key, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), 2*interval); err != nil {
+			logger.Error("failed to record run of job", "error", err)
+			continue
+		}
+		jobCtx, cancel := context.WithCancel(term)
+		stop := context.AfterFunc(ctx, cancel)
+		if err := job(jobCtx); err != nil {
+			logger.Error("job failed", "error", err)
+		}
+		stop()
+		cancel()
+	}
+}
@@ -0,0 +1,93 @@
+package brisa
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestLeader 创建使用共享存储的 Leader
+func newTestLeader(t *testing.T, store Store, node string) *Leader {
+	t.Helper()
+	l, err := NewLeader(LeaderConfig{Store: store, Key: "leader:test", TTL: 60 * time.Millisecond, Node: node, Logger: slog.New(slog.DiscardHandler)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLeader_Failover(t *testing.T) {
+	store := NewMemoryStore()
+	a := newTestLeader(t, store, "a")
+	b := newTestLeader(t, store, "b")
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.Run(ctxA)
+	}()
+	eventually(t, a.IsLeader, "expected the first instance to lead")
+	go b.Run(ctxB)
+
+	time.Sleep(100 * time.Millisecond)
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("expected a single leader, got a=%v b=%v", a.IsLeader(), b.IsLeader())
+	}
+	term, _ := a.Term()
+
+	// a 退出后释放租约，b 接管
+	stopA()
+	wg.Wait()
+	if term.Err() == nil {
+		t.Error("expected the term of a to end")
+	}
+	eventually(t, b.IsLeader, "expected the second instance to take over")
+}
+
+func TestLeader_Schedule(t *testing.T) {
+	store := NewMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs, concurrent, maxConcurrent atomic.Int32
+	job := func(ctx context.Context) error {
+		n := concurrent.Add(1)
+		if n > maxConcurrent.Load() {
+			maxConcurrent.Store(n)
+		}
+		runs.Add(1)
+		concurrent.Add(-1)
+		return nil
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		l := newTestLeader(t, store, node)
+		go l.Run(ctx)
+		go l.Schedule(ctx, "report", 50*time.Millisecond, job)
+	}
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+
+	// 三个实例合起来大约每 50ms 运行一次
+	if n := runs.Load(); n < 2 || n > 7 {
+		t.Errorf("expected the job to run once per interval in the cluster, got %d runs", n)
+	}
+	if maxConcurrent.Load() > 1 {
+		t.Error("expected the job not to run concurrently")
+	}
+}
+
+func TestLeader_Config(t *testing.T) {
+	if _, err := NewLeader(LeaderConfig{Key: "k"}); err == nil {
+		t.Error("expected an error without a store")
+	}
+	if _, err := NewLeader(LeaderConfig{Store: NewMemoryStore(), Key: "k", TTL: -1}); err == nil {
+		t.Error("expected an error for a negative ttl")
+	}
+}
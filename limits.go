@@ -0,0 +1,184 @@
+package brisa
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultDataRateGrace is the default time a client may send a message at any
+// rate before ProtocolLimits.MinDataRate applies.
+const DefaultDataRateGrace = 10 * time.Second
+
+// ErrProtocolAbuse is the reply to the command after which a session exceeded
+// one of its ProtocolLimits; the connection is closed after it.
+var ErrProtocolAbuse = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Session limits exceeded, closing connection",
+}
+
+// ProtocolLimits protect the server from clients that tie up sessions, such
+// as slowloris clients trickling a message or bots issuing endless RSET. A
+// session exceeding a limit is closed with ErrProtocolAbuse. Zero values
+// disable the limits.
+type ProtocolLimits struct {
+	// MaxCommands limits the MAIL, RCPT, DATA, RSET and AUTH commands of a
+	// session. go-smtp answers NOOP, VRFY and HELP itself; MaxSessionTime
+	// bounds those.
+	MaxCommands int
+	// MaxErrors limits the commands of a session refused with an error reply.
+	MaxErrors int
+	// MinDataRate is the lowest average rate in bytes per second a client may
+	// send a message at once DataRateGrace, which defaults to
+	// DefaultDataRateGrace, has passed.
+	MinDataRate   int64
+	DataRateGrace time.Duration
+	// MaxSessionTime bounds the duration of a session.
+	MaxSessionTime time.Duration
+}
+
+// MessageLimits bound a mail transaction below the limits of the server (see
+// ServerConfig.MaxRecipients and MaxMessageBytes), which go-smtp enforces for
+// all clients. Policy middleware such as middleware.LimitPolicy set them in the
+// mail_from chain with Context.SetMessageLimits, so they can differ per user,
+// client network or listener. Zero values disable the limits.
+type MessageLimits struct {
+	// MaxRecipients limits the accepted recipients of a transaction; further
+	// RCPT TO commands are refused with ErrTooManyRecipients. Refused
+	// recipients do not count.
+	MaxRecipients int
+	// MaxMessageBytes limits the size of a message, as declared with the SIZE
+	// parameter of MAIL FROM and as transferred. Larger messages are refused
+	// with smtp.ErrDataTooLarge.
+	MaxMessageBytes int64
+}
+
+// SetMessageLimits sets the limits of the current transaction.
+func (c *Context) SetMessageLimits(l MessageLimits) {
+	c.messageLimits = l
+}
+
+// MessageLimits returns the limits of the current transaction.
+func (c *Context) MessageLimits() MessageLimits {
+	return c.messageLimits
+}
+
+// SetProtocolLimits sets the limits of new sessions.
+func (b *Brisa) SetProtocolLimits(l ProtocolLimits) {
+	if l.DataRateGrace <= 0 {
+		l.DataRateGrace = DefaultDataRateGrace
+	}
+	b.limits.Store(&l)
+}
+
+// startLimits applies the limits of b to a new session.
+func (s *Session) startLimits(b *Brisa) {
+	if l := b.limits.Load(); l != nil {
+		s.limits = *l
+	}
+	if d := s.limits.MaxSessionTime; d > 0 && s.conn != nil {
+		s.sessionTimer = time.AfterFunc(d, func() { s.abort("session time exceeded", "limit", d) })
+	}
+}
+
+// command records and counts a command of the client and returns
+// ErrProtocolAbuse if there are too many.
+func (s *Session) command(cmd string) error {
+	s.record(cmd)
+	s.commands++
+	if max := s.limits.MaxCommands; max > 0 && s.commands > max {
+		return s.abort("too many commands", "limit", max)
+	}
+	return nil
+}
+
+// refused counts the error reply err, if not nil, and returns it, or
+// ErrProtocolAbuse if there are too many.
+func (s *Session) refused(err error) error {
+	if err == nil {
+		return nil
+	}
+	s.refusals++
+	if max := s.limits.MaxErrors; max > 0 && s.refusals > max {
+		return s.abort("too many errors", "limit", max)
+	}
+	return err
+}
+
+// abort ends the session: it sends ErrProtocolAbuse, as go-smtp cannot close
+// the connection after the reply of a command, and closes the connection.
+func (s *Session) abort(reason string, attrs ...any) error {
+	if s.aborted.Swap(true) {
+		return ErrProtocolAbuse
+	}
+	s.baseLogger.Warn("session closed for protocol abuse", append([]any{"reason", reason}, attrs...)...)
+	if s.conn != nil {
+		c := s.conn.Conn()
+		e := ErrProtocolAbuse
+		fmt.Fprintf(c, "%d %d.%d.%d %s\r\n", e.Code, e.EnhancedCode[0], e.EnhancedCode[1], e.EnhancedCode[2], e.Message)
+		c.Close()
+	}
+	return ErrProtocolAbuse
+}
+
+// stopLimits releases the resources of the limits of an ended session.
+func (s *Session) stopLimits() {
+	if s.sessionTimer != nil {
+		s.sessionTimer.Stop()
+	}
+}
+
+// messageSizeReader fails reads once a message exceeds its size limit.
+type messageSizeReader struct {
+	r        io.Reader
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+// tooLarge reports, and logs, whether the message exceeded the limit. It is
+// false without a limit.
+func (r *messageSizeReader) tooLarge(logger *slog.Logger) bool {
+	if r == nil || !r.exceeded {
+		return false
+	}
+	logger.Info("message over size limit", "limit", r.max)
+	return true
+}
+
+func (r *messageSizeReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, smtp.ErrDataTooLarge
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.n > r.max {
+		r.exceeded = true
+		return n, smtp.ErrDataTooLarge
+	}
+	return n, err
+}
+
+// dataRateReader fails reads once the average rate of a message falls below
+// the minimum.
+type dataRateReader struct {
+	r     io.Reader
+	s     *Session
+	start time.Time
+	n     int64
+}
+
+func (r *dataRateReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if elapsed := time.Since(r.start); elapsed > r.s.limits.DataRateGrace {
+		if rate := float64(r.n) / elapsed.Seconds(); rate < float64(r.s.limits.MinDataRate) {
+			return n, r.s.abort("data rate too low", "rate", int64(rate), "limit", r.s.limits.MinDataRate)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,190 @@
+package brisa
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startLimitsServer 启动一个带协议限制的测试服务器，返回其地址
+func startLimitsServer(t *testing.T, limits ProtocolLimits, router *Router) string {
+	t.Helper()
+	b := New(slog.New(slog.DiscardHandler))
+	if router != nil {
+		b.UpdateRouter(router)
+	}
+	b.SetProtocolLimits(limits)
+	return startTestServer(t, b, testServerOptions{allowInsecureAuth: true})
+}
+
+func TestProtocolLimits_MaxCommands(t *testing.T) {
+	addr := startLimitsServer(t, ProtocolLimits{MaxCommands: 3}, nil)
+	conn, r := dialTest(t, addr, true)
+
+	// NOOP 由 go-smtp 直接应答，不计入限制
+	for range 5 {
+		io.WriteString(conn, "NOOP\r\n")
+		if reply := readReply(t, r); !strings.HasPrefix(reply, "250") {
+			t.Fatalf("unexpected NOOP reply: %q", reply)
+		}
+	}
+	for range 3 {
+		io.WriteString(conn, "RSET\r\n")
+		if reply := readReply(t, r); !strings.HasPrefix(reply, "250") {
+			t.Fatalf("unexpected RSET reply: %q", reply)
+		}
+	}
+	io.WriteString(conn, "MAIL FROM:<a@example.org>\r\n")
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "421 4.7.0") {
+		t.Errorf("expected 421 after too many commands, got %q", reply)
+	}
+	expectClosed(t, conn, r)
+}
+
+func TestProtocolLimits_MaxCommands_Messages(t *testing.T) {
+	addr := startLimitsServer(t, ProtocolLimits{MaxCommands: 6}, nil)
+	conn, r := dialTest(t, addr, true)
+
+	// go-smtp 在每封邮件之后自动重置会话，这不是客户端的命令
+	for range 2 {
+		for _, cmd := range []string{"MAIL FROM:<a@example.org>", "RCPT TO:<b@example.com>", "DATA"} {
+			io.WriteString(conn, cmd+"\r\n")
+			readReply(t, r)
+		}
+		io.WriteString(conn, "Subject: test\r\n\r\nbody\r\n.\r\n")
+		if reply := readReply(t, r); !strings.HasPrefix(reply, "250") {
+			t.Fatalf("unexpected DATA reply: %q", reply)
+		}
+	}
+	io.WriteString(conn, "RSET\r\n")
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "421 4.7.0") {
+		t.Errorf("expected 421 after too many commands, got %q", reply)
+	}
+}
+
+func TestProtocolLimits_MaxErrors(t *testing.T) {
+	router := &Router{ChainRcptTo: {{Handler: func(ctx *Context) Action { return Reject }}}}
+	addr := startLimitsServer(t, ProtocolLimits{MaxErrors: 2}, router)
+	conn, r := dialTest(t, addr, true)
+
+	io.WriteString(conn, "MAIL FROM:<a@example.org>\r\n")
+	readReply(t, r)
+	for i := range 3 {
+		io.WriteString(conn, "RCPT TO:<b@example.com>\r\n")
+		reply := readReply(t, r)
+		if i < 2 && !strings.HasPrefix(reply, "554") {
+			t.Errorf("expected refusal %d, got %q", i, reply)
+		}
+		if i == 2 && !strings.HasPrefix(reply, "421") {
+			t.Errorf("expected 421 after too many errors, got %q", reply)
+		}
+	}
+	expectClosed(t, conn, r)
+}
+
+func TestProtocolLimits_MinDataRate(t *testing.T) {
+	delivered := false
+	router := &Router{ChainDeliver: {{Handler: func(ctx *Context) Action {
+		// 投递时读取邮件，读取失败则不投递
+		if _, err := io.ReadAll(ctx.Reader); err == nil {
+			delivered = true
+		}
+		return ctx.Action
+	}}}}
+	addr := startLimitsServer(t, ProtocolLimits{MinDataRate: 1000, DataRateGrace: 100 * time.Millisecond}, router)
+	conn, r := dialTest(t, addr, true)
+
+	for _, cmd := range []string{"MAIL FROM:<a@example.org>", "RCPT TO:<b@example.com>", "DATA"} {
+		io.WriteString(conn, cmd+"\r\n")
+		readReply(t, r)
+	}
+	// 慢速发送（slowloris）
+	for range 5 {
+		if _, err := io.WriteString(conn, "Subject: slow\r\n"); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	io.WriteString(conn, "\r\nbody\r\n.\r\n")
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "421 4.7.0") {
+		t.Errorf("expected 421 for a slow client, got %q", reply)
+	}
+	expectClosed(t, conn, r)
+	if delivered {
+		t.Error("expected the truncated message not to be delivered")
+	}
+}
+
+func TestProtocolLimits_MaxSessionTime(t *testing.T) {
+	addr := startLimitsServer(t, ProtocolLimits{MaxSessionTime: 100 * time.Millisecond}, nil)
+	conn, r := dialTest(t, addr, true)
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "421 4.7.0") {
+		t.Errorf("expected 421 when the session time is over, got %q", reply)
+	}
+	expectClosed(t, conn, r)
+}
+
+func TestProtocolLimits_Simulate(t *testing.T) {
+	// 模拟会话同样计数，但没有连接可关闭
+	b := New(slog.New(slog.DiscardHandler))
+	b.SetProtocolLimits(ProtocolLimits{MaxCommands: 2})
+	env := Envelope{From: "a@example.org", To: []string{"b@example.com"}}
+	res := b.Simulate(env, strings.NewReader("\r\nbody\r\n"))
+	if res.Err != ErrProtocolAbuse || res.Chain != ChainData {
+		t.Errorf("expected DATA to exceed the command limit, got %v at %q", res.Err, res.Chain)
+	}
+}
+
+func TestMessageLimits(t *testing.T) {
+	router := &Router{}
+	router.OnMailFrom(&Middleware{Handler: func(ctx *Context) Action {
+		ctx.SetMessageLimits(MessageLimits{MaxRecipients: 2, MaxMessageBytes: 100})
+		return Pass
+	}})
+	router.OnRcptTo(&Middleware{Handler: func(ctx *Context) Action {
+		if strings.HasPrefix(ctx.To[len(ctx.To)-1], "unknown@") {
+			return Reject
+		}
+		return Pass
+	}})
+	addr := startLimitsServer(t, ProtocolLimits{MaxErrors: 3}, router)
+	conn, r := dialTest(t, addr, true)
+
+	// 声明的大小超过限制时拒绝 MAIL FROM
+	io.WriteString(conn, "MAIL FROM:<alice@example.org> SIZE=200\r\n")
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Fatalf("MAIL FROM with SIZE over the limit: got %q", reply)
+	}
+
+	// 被拒绝的收件人不计入限制，超出限制的收件人不计为错误
+	io.WriteString(conn, "MAIL FROM:<alice@example.org> SIZE=50\r\n")
+	readReply(t, r)
+	for _, rcpt := range []string{"unknown", "bob", "carol", "dave", "erin", "frank"} {
+		io.WriteString(conn, "RCPT TO:<"+rcpt+"@example.com>\r\n")
+		reply := readReply(t, r)
+		switch rcpt {
+		case "unknown":
+			if !strings.HasPrefix(reply, "554") {
+				t.Errorf("RCPT TO %s: got %q", rcpt, reply)
+			}
+		case "bob", "carol":
+			if !strings.HasPrefix(reply, "250") {
+				t.Errorf("RCPT TO %s: got %q", rcpt, reply)
+			}
+		default:
+			if !strings.HasPrefix(reply, "452 4.5.3") {
+				t.Errorf("RCPT TO %s: got %q", rcpt, reply)
+			}
+		}
+	}
+
+	// 实际传输的大小超过限制时拒绝邮件
+	io.WriteString(conn, "DATA\r\n")
+	readReply(t, r)
+	io.WriteString(conn, "Subject: hi\r\n\r\n"+strings.Repeat("x", 200)+"\r\n.\r\n")
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Fatalf("DATA over the limit: got %q", reply)
+	}
+}
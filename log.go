@@ -0,0 +1,419 @@
+package brisa
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogConfig configures the logger built by NewLogger.
+type LogConfig struct {
+	// Level is the minimum level: "debug", "info" (default), "warn" or "error".
+	Level string `yaml:"level" json:"level" toml:"level"`
+	// Components overrides Level per component, e.g. {"dnsbl": "debug"}. The
+	// component of a log record is its LogComponentKey attribute; middleware
+	// built by a Registry log with their name as component.
+	Components map[string]string `yaml:"components" json:"components" toml:"components"`
+	// Format is "text" (default) or "json".
+	Format string `yaml:"format" json:"format" toml:"format"`
+	// Path is the log file. Empty or "stdout" logs to standard output, "stderr"
+	// to standard error, "syslog" to the local syslog daemon (mail facility)
+	// and "journald" to the systemd journal.
+	Path string `yaml:"path" json:"path" toml:"path"`
+	// Tag is the program name sent to syslog or journald. Defaults to
+	// DefaultLogTag.
+	Tag string `yaml:"tag" json:"tag" toml:"tag"`
+	// MaxSize rotates the log file once it would grow beyond this many bytes.
+	MaxSize int64 `yaml:"max_size" json:"max_size" toml:"max_size"`
+	// RotateInterval rotates the log file when it is older than this.
+	RotateInterval Duration `yaml:"rotate_interval" json:"rotate_interval" toml:"rotate_interval"`
+	// MaxBackups is the number of rotated files kept. Zero keeps all of them.
+	MaxBackups int `yaml:"max_backups" json:"max_backups" toml:"max_backups"`
+	// MaxAge removes rotated files last written longer ago than this, on
+	// startup and with each rotation. Zero keeps them regardless of age.
+	// Verify the chain of the remaining files with
+	// LogChainVerifier.Continued.
+	MaxAge Duration `yaml:"max_age" json:"max_age" toml:"max_age"`
+	// Chain appends to each record a hash of it and of the hash of the
+	// previous record, so that altered, removed or reordered records can be
+	// detected with LogChainVerifier ("brisa log verify"). The chain
+	// continues across rotations and restarts. It requires a log file or
+	// standard output.
+	Chain bool `yaml:"chain" json:"chain" toml:"chain"`
+	// ChainKeyFile holds a secret key that makes the chain an HMAC-SHA256, so
+	// that it cannot be recomputed after altering records. It implies Chain.
+	ChainKeyFile string `yaml:"chain_key_file" json:"chain_key_file" toml:"chain_key_file"`
+	// Redact hashes or masks the email and IP addresses in records.
+	Redact LogRedactConfig `yaml:"redact" json:"redact" toml:"redact"`
+}
+
+// validate checks the values of the log configuration.
+func (c *LogConfig) validate() []error {
+	var errs []error
+	if _, err := c.level(); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if _, err := c.componentLevels(); err != nil {
+		errs = append(errs, fmt.Errorf("log.components: %w", err))
+	}
+	switch strings.ToLower(c.Format) {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log.format: invalid format: %s", c.Format))
+	}
+	if c.MaxSize < 0 || c.RotateInterval < 0 || c.MaxBackups < 0 || c.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("log: rotation settings must not be negative"))
+	}
+	errs = append(errs, c.Redact.validate()...)
+	if (c.Chain || c.ChainKeyFile != "") && (c.Path == "syslog" || c.Path == "journald") {
+		errs = append(errs, fmt.Errorf("log.chain: requires a log file or standard output"))
+	}
+	return errs
+}
+
+// isZero reports whether no log setting is configured.
+func (c *LogConfig) isZero() bool {
+	return reflect.ValueOf(*c).IsZero()
+}
+
+func (c *LogConfig) level() (slog.Level, error) {
+	if c.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	return parseLevel(c.Level)
+}
+
+func (c *LogConfig) componentLevels() (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level, len(c.Components))
+	for component, s := range c.Components {
+		level, err := parseLevel(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", component, err)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid level: %s", s)
+	}
+	return level, nil
+}
+
+// NewLogger builds a logger from cfg. The returned io.Closer closes the log
+// file, if any, and must be called when the logger is no longer used.
+func NewLogger(cfg LogConfig) (*slog.Logger, io.Closer, error) {
+	if errs := cfg.validate(); len(errs) > 0 {
+		return nil, nil, errs[0]
+	}
+	level, _ := cfg.level()
+	levels, _ := cfg.componentLevels()
+
+	tag := cfg.Tag
+	if tag == "" {
+		tag = DefaultLogTag
+	}
+
+	var w io.Writer
+	var pw *priorityWriter
+	closer := io.Closer(nopCloser{})
+	switch cfg.Path {
+	case "", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	case "syslog", "journald":
+		var sink prioritySink
+		var err error
+		if cfg.Path == "syslog" {
+			sink, err = newSyslogSink(tag)
+		} else {
+			sink, err = newJournalSink(DefaultJournalSocket, tag)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		pw = &priorityWriter{sink: sink}
+		w, closer = pw, sink
+	default:
+		f, err := newRotatingFile(cfg.Path, cfg.MaxSize, time.Duration(cfg.RotateInterval), cfg.MaxBackups, time.Duration(cfg.MaxAge))
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = f, f
+	}
+	if cfg.Chain || cfg.ChainKeyFile != "" {
+		var key []byte
+		if cfg.ChainKeyFile != "" {
+			var err error
+			if key, err = readKeyFile(cfg.ChainKeyFile); err != nil {
+				closer.Close()
+				return nil, nil, fmt.Errorf("log.chain_key_file: %w", err)
+			}
+		}
+		var path string
+		if _, ok := closer.(*rotatingFile); ok {
+			path = cfg.Path
+		}
+		cw, err := newChainWriter(w, key, strings.ToLower(cfg.Format) == "json", path)
+		if err != nil {
+			closer.Close()
+			return nil, nil, err
+		}
+		w = cw
+	}
+
+	// The output handler lets everything through that a component may log;
+	// the component filter applies the levels.
+	minLevel := level
+	for _, l := range levels {
+		minLevel = min(minLevel, l)
+	}
+	opts := &slog.HandlerOptions{Level: minLevel}
+	if pw != nil {
+		// The system logger records the time itself.
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	var h slog.Handler
+	if strings.ToLower(cfg.Format) == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	if pw != nil {
+		h = &priorityHandler{inner: h, w: pw}
+	}
+	if cfg.Redact.enabled() {
+		r := &redactor{addresses: cfg.Redact.Addresses, ips: cfg.Redact.IPs}
+		if cfg.Redact.HashKeyFile != "" {
+			key, err := readKeyFile(cfg.Redact.HashKeyFile)
+			if err != nil {
+				closer.Close()
+				return nil, nil, fmt.Errorf("log.redact.hash_key_file: %w", err)
+			}
+			r.key = key
+		}
+		h = &redactHandler{inner: h, r: r}
+	}
+	if len(levels) > 0 {
+		h = NewComponentLevelHandler(h, level, levels)
+	}
+	return slog.New(h), closer, nil
+}
+
+// LogComponentKey is the log attribute naming the component (subsystem or
+// middleware) a record comes from.
+const LogComponentKey = "component"
+
+// ComponentLevelHandler is a slog.Handler that filters records by a minimum
+// level per component, falling back to a default level. The component is
+// taken from a LogComponentKey attribute added with Logger.With or passed
+// with the record.
+type ComponentLevelHandler struct {
+	inner    slog.Handler
+	def      slog.Level
+	levels   map[string]slog.Level
+	minLevel slog.Level
+
+	// level is the level of the component bound with WithAttrs, if any.
+	level        slog.Level
+	hasComponent bool
+}
+
+// NewComponentLevelHandler wraps inner with per-component levels. inner must
+// let through records of the lowest configured level.
+func NewComponentLevelHandler(inner slog.Handler, def slog.Level, levels map[string]slog.Level) *ComponentLevelHandler {
+	h := &ComponentLevelHandler{inner: inner, def: def, levels: levels, minLevel: def}
+	for _, l := range levels {
+		h.minLevel = min(h.minLevel, l)
+	}
+	return h
+}
+
+func (h *ComponentLevelHandler) levelOf(component string) slog.Level {
+	if l, ok := h.levels[component]; ok {
+		return l
+	}
+	return h.def
+}
+
+// Enabled implements slog.Handler.
+func (h *ComponentLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.hasComponent {
+		return level >= h.level && h.inner.Enabled(ctx, level)
+	}
+	// The component may still come with the record; Handle decides.
+	return level >= h.minLevel && h.inner.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *ComponentLevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.hasComponent {
+		level := h.def
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == LogComponentKey {
+				level = h.levelOf(a.Value.String())
+				return false
+			}
+			return true
+		})
+		if r.Level < level {
+			return nil
+		}
+	}
+	return h.inner.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *ComponentLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.inner = h.inner.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key == LogComponentKey {
+			h2.level = h.levelOf(a.Value.String())
+			h2.hasComponent = true
+		}
+	}
+	return &h2
+}
+
+// WithGroup implements slog.Handler. Attributes inside a group are not
+// considered for the component.
+func (h *ComponentLevelHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.inner = h.inner.WithGroup(name)
+	return &h2
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile is a log file that is renamed to "<path>.<timestamp>" and
+// reopened when it exceeds its size or age limit.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	now        func() time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups, maxAge: maxAge, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), r.now()
+	return nil
+}
+
+// Write implements io.Writer.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.interval > 0 && r.now().Sub(r.opened) >= r.interval)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one. It must be called with
+// r.mu held.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	backup := r.path + "." + r.now().Format("20060102T150405.000000000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest backups beyond maxBackups and those last written
+// more than maxAge ago, counting them in the expvar map "brisa" as
+// log_backups_removed and log_bytes_reclaimed.
+func (r *rotatingFile) prune() {
+	if r.maxBackups <= 0 && r.maxAge <= 0 {
+		return
+	}
+	backups, _ := filepath.Glob(r.path + ".*")
+	sort.Strings(backups) // timestamps sort chronologically
+	now := r.now()
+	for i, backup := range backups {
+		info, err := os.Stat(backup)
+		if err != nil {
+			continue
+		}
+		if (r.maxBackups <= 0 || len(backups)-i <= r.maxBackups) && (r.maxAge <= 0 || now.Sub(info.ModTime()) <= r.maxAge) {
+			continue
+		}
+		if os.Remove(backup) == nil {
+			debugVars.Add("log_backups_removed", 1)
+			debugVars.Add("log_bytes_reclaimed", info.Size())
+		}
+	}
+}
+
+// Close implements io.Closer.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
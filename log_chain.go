@@ -0,0 +1,189 @@
+package brisa
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// Log records are chained by appending the hash of the previous record's
+// hash and the record itself: " chain=<hex>" to text records, and a "chain"
+// key to JSON records. Altering, removing or reordering records breaks the
+// chain from there on; with a key, the chain cannot be recomputed without
+// it.
+const (
+	logChainText = " chain="
+	logChainJSON = `,"chain":"`
+)
+
+// logChainHash returns the hash of a record following prev.
+func logChainHash(key []byte, prev, record []byte) []byte {
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(prev)
+	h.Write(record)
+	return h.Sum(nil)
+}
+
+// splitLogChain splits a chained record into the record and its hash.
+func splitLogChain(line []byte) (record, sum []byte, ok bool) {
+	const hexLen = 2 * sha256.Size
+	if i := bytes.LastIndex(line, []byte(logChainJSON)); i >= 0 && len(line)-i == len(logChainJSON)+hexLen+2 && bytes.HasSuffix(line, []byte(`"}`)) {
+		record = append(line[:i:i], '}')
+		sum = line[i+len(logChainJSON) : len(line)-2]
+	} else if i := bytes.LastIndex(line, []byte(logChainText)); i >= 0 && len(line)-i == len(logChainText)+hexLen {
+		record = line[:i]
+		sum = line[i+len(logChainText):]
+	} else {
+		return nil, nil, false
+	}
+	sum, err := hex.DecodeString(string(sum))
+	return record, sum, err == nil
+}
+
+// chainWriter chains the records written to w. slog handlers write each
+// record with a single Write.
+type chainWriter struct {
+	w    io.Writer
+	key  []byte
+	json bool
+
+	mu   sync.Mutex
+	prev []byte
+}
+
+// newChainWriter continues the chain of the last record of the log file at
+// path, if any.
+func newChainWriter(w io.Writer, key []byte, json bool, path string) (*chainWriter, error) {
+	cw := &chainWriter{w: w, key: key, json: json, prev: make([]byte, sha256.Size)}
+	if path == "" {
+		return cw, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cw, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, sum, ok := splitLogChain(last); ok {
+		cw.prev = sum
+	}
+	return cw, nil
+}
+
+// Write implements io.Writer.
+func (w *chainWriter) Write(p []byte) (int, error) {
+	record := bytes.TrimSuffix(p, []byte("\n"))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sum := logChainHash(w.key, w.prev, record)
+	line := make([]byte, 0, len(record)+len(logChainJSON)+2*len(sum)+3)
+	if w.json && bytes.HasSuffix(record, []byte("}")) {
+		line = append(line, record[:len(record)-1]...)
+		line = append(line, logChainJSON...)
+		line = hex.AppendEncode(line, sum)
+		line = append(line, `"}`...)
+	} else {
+		line = append(line, record...)
+		line = append(line, logChainText...)
+		line = hex.AppendEncode(line, sum)
+	}
+	line = append(line, '\n')
+	if _, err := w.w.Write(line); err != nil {
+		return 0, err
+	}
+	w.prev = sum
+	return len(p), nil
+}
+
+// LogChainError reports the first record of a log that breaks the chain.
+type LogChainError struct {
+	// Line is the line number of the record in its file.
+	Line int
+	Err  error
+}
+
+func (e *LogChainError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LogChainError) Unwrap() error { return e.Err }
+
+// ErrLogChainBroken is the error of a record whose hash does not follow the
+// previous record.
+var ErrLogChainBroken = errors.New("record does not follow the chain")
+
+// LogChainVerifier checks that log records, read in order from one or more
+// files, form an unbroken chain; see LogConfig.Chain.
+type LogChainVerifier struct {
+	key  []byte
+	prev []byte
+	// Continued accepts a first record that continues the chain of an
+	// earlier file, e.g. one removed by rotation, rather than starting it.
+	// That record is then trusted.
+	Continued bool
+	// Records is the number of records verified.
+	Records int
+}
+
+// NewLogChainVerifier returns a verifier of records chained with key, or
+// without a key if nil.
+func NewLogChainVerifier(key []byte) *LogChainVerifier {
+	return &LogChainVerifier{key: key}
+}
+
+// Verify checks the records read from r, continuing the chain of the
+// records verified before. It returns a *LogChainError for the first record
+// that is not chained or breaks the chain.
+func (v *LogChainVerifier) Verify(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		record, sum, ok := splitLogChain(line)
+		if !ok {
+			return &LogChainError{Line: n, Err: errors.New("record is not chained")}
+		}
+		if v.prev == nil {
+			if v.Continued {
+				v.prev = sum
+				v.Records++
+				continue
+			}
+			v.prev = make([]byte, sha256.Size)
+		}
+		if !hmac.Equal(logChainHash(v.key, v.prev, record), sum) {
+			return &LogChainError{Line: n, Err: ErrLogChainBroken}
+		}
+		v.prev = sum
+		v.Records++
+	}
+	return scanner.Err()
+}
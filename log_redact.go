@@ -0,0 +1,189 @@
+package brisa
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/muzhy/brisa/address"
+)
+
+// Redaction modes of LogRedactConfig.
+const (
+	// RedactHash replaces a value with "h:" and the start of its hash, so
+	// that records of the same address or IP can still be correlated.
+	RedactHash = "hash"
+	// RedactMask keeps part of a value: the first character of the local
+	// part and the domain of an address, the /24 (IPv4) or /48 (IPv6)
+	// network of an IP.
+	RedactMask = "mask"
+)
+
+// LogRedactConfig configures the redaction of personal data in log records.
+// It applies to attribute values, including those of groups and the
+// elements of string lists, that are an email address or an IP address,
+// with or without a port.
+type LogRedactConfig struct {
+	// Addresses is the redaction mode of email addresses: RedactHash,
+	// RedactMask or empty to log them as they are.
+	Addresses string `yaml:"addresses" json:"addresses" toml:"addresses"`
+	// IPs is the redaction mode of IP addresses.
+	IPs string `yaml:"ips" json:"ips" toml:"ips"`
+	// HashKeyFile holds a secret key that makes the hashes an HMAC-SHA256,
+	// so that they cannot be reversed by hashing candidate values.
+	HashKeyFile string `yaml:"hash_key_file" json:"hash_key_file" toml:"hash_key_file"`
+}
+
+func (c *LogRedactConfig) validate() []error {
+	var errs []error
+	for _, f := range []struct{ name, mode string }{{"addresses", c.Addresses}, {"ips", c.IPs}} {
+		switch f.mode {
+		case "", RedactHash, RedactMask:
+		default:
+			errs = append(errs, fmt.Errorf("log.redact.%s: invalid mode: %s", f.name, f.mode))
+		}
+	}
+	return errs
+}
+
+// enabled reports whether anything is redacted.
+func (c *LogRedactConfig) enabled() bool {
+	return c.Addresses != "" || c.IPs != ""
+}
+
+// redactor redacts the values of log attributes.
+type redactor struct {
+	addresses string
+	ips       string
+	key       []byte
+}
+
+func (r *redactor) hash(s string) string {
+	var sum []byte
+	if r.key != nil {
+		h := hmac.New(sha256.New, r.key)
+		h.Write([]byte(s))
+		sum = h.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(s))
+		sum = s[:]
+	}
+	return "h:" + hex.EncodeToString(sum[:6])
+}
+
+// redactString returns s redacted if it is an email or IP address.
+func (r *redactor) redactString(s string) (string, bool) {
+	if r.ips != "" {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			if ap, err2 := netip.ParseAddrPort(s); err2 == nil {
+				ip, err = ap.Addr(), nil
+			}
+		}
+		if err == nil {
+			if r.ips == RedactHash {
+				return r.hash(ip.Unmap().String()), true
+			}
+			ip = ip.Unmap()
+			bits := 48
+			if ip.Is4() {
+				bits = 24
+			}
+			prefix, _ := ip.WithZone("").Prefix(bits)
+			return prefix.String(), true
+		}
+	}
+	if r.addresses != "" && strings.Contains(s, "@") {
+		if a, err := address.Parse(s); err == nil {
+			if r.addresses == RedactHash {
+				return r.hash(a.Key()), true
+			}
+			_, n := utf8.DecodeRuneInString(a.Local)
+			return a.Local[:n] + "***@" + a.Domain, true
+		}
+	}
+	return s, false
+}
+
+// redactValue returns v with the email and IP addresses it holds redacted.
+func (r *redactor) redactValue(v slog.Value) slog.Value {
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		if s, ok := r.redactString(v.String()); ok {
+			return slog.StringValue(s)
+		}
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, a := range attrs {
+			redacted[i] = slog.Attr{Key: a.Key, Value: r.redactValue(a.Value)}
+		}
+		return slog.GroupValue(redacted...)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case []string:
+			redacted := make([]string, len(x))
+			for i, s := range x {
+				redacted[i], _ = r.redactString(s)
+			}
+			return slog.AnyValue(redacted)
+		case net.IP, netip.Addr, netip.AddrPort, net.Addr:
+			if s, ok := r.redactString(fmt.Sprint(x)); ok {
+				return slog.StringValue(s)
+			}
+		}
+	}
+	return v
+}
+
+func (r *redactor) redactAttrs(attrs []slog.Attr) []slog.Attr {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = slog.Attr{Key: a.Key, Value: r.redactValue(a.Value)}
+	}
+	return redacted
+}
+
+// redactHandler redacts the attributes of the records handled by inner.
+type redactHandler struct {
+	inner slog.Handler
+	r     *redactor
+}
+
+// Enabled implements slog.Handler.
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.NumAttrs() == 0 {
+		return h.inner.Handle(ctx, r)
+	}
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	redacted.AddAttrs(h.r.redactAttrs(attrs)...)
+	return h.inner.Handle(ctx, redacted)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &redactHandler{inner: h.inner.WithAttrs(h.r.redactAttrs(attrs)), r: h.r}
+}
+
+// WithGroup implements slog.Handler.
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{inner: h.inner.WithGroup(name), r: h.r}
+}
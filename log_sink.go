@@ -0,0 +1,131 @@
+package brisa
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// DefaultLogTag is the program name under which logs are sent to syslog or
+// journald.
+const DefaultLogTag = "brisa"
+
+// DefaultJournalSocket is the socket of the systemd journal.
+const DefaultJournalSocket = "/run/systemd/journal/socket"
+
+// Syslog priorities of the slog levels.
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+	priorityDebug   = 7
+)
+
+// logPriority maps a slog level to a syslog priority.
+func logPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return priorityErr
+	case level >= slog.LevelWarn:
+		return priorityWarning
+	case level >= slog.LevelInfo:
+		return priorityInfo
+	default:
+		return priorityDebug
+	}
+}
+
+// prioritySink receives formatted log records together with their level.
+type prioritySink interface {
+	send(level slog.Level, msg []byte) error
+	Close() error
+}
+
+// priorityWriter passes each formatted record to a sink. slog handlers write
+// a record with a single Write, so the level set by priorityHandler before
+// formatting belongs to that write.
+type priorityWriter struct {
+	mu    sync.Mutex
+	level slog.Level
+	sink  prioritySink
+}
+
+// Write implements io.Writer.
+func (w *priorityWriter) Write(p []byte) (int, error) {
+	if err := w.sink.send(w.level, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// priorityHandler tells its priorityWriter the level of each record handled
+// by inner.
+type priorityHandler struct {
+	inner slog.Handler
+	w     *priorityWriter
+}
+
+// Enabled implements slog.Handler.
+func (h *priorityHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *priorityHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.level = r.Level
+	return h.inner.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *priorityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &priorityHandler{inner: h.inner.WithAttrs(attrs), w: h.w}
+}
+
+// WithGroup implements slog.Handler.
+func (h *priorityHandler) WithGroup(name string) slog.Handler {
+	return &priorityHandler{inner: h.inner.WithGroup(name), w: h.w}
+}
+
+// journalSink sends records to the systemd journal with its native protocol.
+// Records larger than a datagram are not supported.
+type journalSink struct {
+	conn net.Conn
+	tag  string
+}
+
+func newJournalSink(socket, tag string) (*journalSink, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect to journald: %w", err)
+	}
+	return &journalSink{conn: conn, tag: tag}, nil
+}
+
+func (s *journalSink) send(level slog.Level, msg []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("PRIORITY=" + strconv.Itoa(logPriority(level)) + "\n")
+	buf.WriteString("SYSLOG_IDENTIFIER=" + s.tag + "\n")
+	if bytes.IndexByte(msg, '\n') < 0 {
+		buf.WriteString("MESSAGE=")
+		buf.Write(msg)
+	} else {
+		// Values with newlines are written as name, length and raw data.
+		buf.WriteString("MESSAGE\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(msg)))
+		buf.Write(msg)
+	}
+	buf.WriteByte('\n')
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+func (s *journalSink) Close() error {
+	return s.conn.Close()
+}
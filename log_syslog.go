@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+
+package brisa
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+// syslogSink sends records to the local syslog daemon.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(tag string) (prioritySink, error) {
+	w, err := syslog.New(syslog.LOG_MAIL|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) send(level slog.Level, msg []byte) error {
+	m := string(msg)
+	switch logPriority(level) {
+	case priorityErr:
+		return s.w.Err(m)
+	case priorityWarning:
+		return s.w.Warning(m)
+	case priorityInfo:
+		return s.w.Info(m)
+	default:
+		return s.w.Debug(m)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package brisa
+
+import "errors"
+
+func newSyslogSink(tag string) (prioritySink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,296 @@
+package brisa
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "brisa.log")
+	logger, closer, err := NewLogger(LogConfig{Level: "warn", Format: "json", Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "value")
+	closer.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hidden") {
+		t.Error("expected info message to be filtered")
+	}
+	if !strings.Contains(string(data), `"msg":"shown","key":"value"`) {
+		t.Errorf("expected JSON warn message, got %q", data)
+	}
+
+	for _, cfg := range []LogConfig{{Level: "loud"}, {Format: "xml"}, {MaxSize: -1}} {
+		if _, _, err := NewLogger(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestComponentLevelHandler(t *testing.T) {
+	var buf bytes.Buffer
+	inner := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	logger := slog.New(NewComponentLevelHandler(inner, slog.LevelInfo, map[string]slog.Level{
+		"dnsbl": slog.LevelDebug,
+		"queue": slog.LevelWarn,
+	}))
+
+	logger.Debug("default debug")
+	logger.Info("default info")
+	logger.With(LogComponentKey, "dnsbl").Debug("dnsbl debug")
+	logger.With(LogComponentKey, "queue").Info("queue info")
+	logger.With(LogComponentKey, "queue").WithGroup("g").Warn("queue warn")
+	// 组件也可以随日志记录传入
+	logger.Debug("record dnsbl debug", LogComponentKey, "dnsbl")
+	logger.Info("record queue info", LogComponentKey, "queue")
+
+	out := buf.String()
+	for _, msg := range []string{"default info", "dnsbl debug", "queue warn", "record dnsbl debug"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("expected %q to be logged, got %q", msg, out)
+		}
+	}
+	for _, msg := range []string{"default debug", "queue info", "record queue info"} {
+		if strings.Contains(out, msg) {
+			t.Errorf("expected %q to be filtered, got %q", msg, out)
+		}
+	}
+
+	if _, _, err := NewLogger(LogConfig{Components: map[string]string{"dnsbl": "loud"}}); err == nil {
+		t.Error("expected error for invalid component level")
+	}
+}
+
+func TestJournalSink(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram not available: %v", err)
+	}
+	defer conn.Close()
+
+	sink, err := newJournalSink(socket, "brisa-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	pw := &priorityWriter{sink: sink}
+	logger := slog.New(&priorityHandler{inner: slog.NewTextHandler(pw, nil), w: pw})
+
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	logger.Warn("disk almost full", "free", "1%")
+	got := read()
+	if !strings.HasPrefix(got, "PRIORITY=4\nSYSLOG_IDENTIFIER=brisa-test\nMESSAGE=") {
+		t.Errorf("unexpected journal entry %q", got)
+	}
+	if !strings.Contains(got, "msg=\"disk almost full\" free=1%\n") {
+		t.Errorf("expected formatted record in entry, got %q", got)
+	}
+
+	logger.Error("failed")
+	if got := read(); !strings.HasPrefix(got, "PRIORITY=3\n") {
+		t.Errorf("expected error priority, got %q", got)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "brisa.log")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	f, err := newRotatingFile(path, 10, time.Hour, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	write := func(s string) {
+		t.Helper()
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countBackups := func() int {
+		backups, _ := filepath.Glob(path + ".*")
+		return len(backups)
+	}
+
+	write("12345")
+	write("12345") // 恰好达到上限，不轮转
+	if n := countBackups(); n != 0 {
+		t.Errorf("expected no rotation yet, got %d backups", n)
+	}
+	write("1") // 超过大小上限
+	if n := countBackups(); n != 1 {
+		t.Errorf("expected 1 backup after size rotation, got %d", n)
+	}
+
+	now = now.Add(time.Hour) // 超过时间间隔
+	write("1")
+	now = now.Add(time.Hour)
+	write("1")
+	if n := countBackups(); n != 2 {
+		t.Errorf("expected backups to be pruned to 2, got %d", n)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "1" {
+		t.Errorf("expected current file to hold the last write, got %q", data)
+	}
+}
+
+func TestRotatingFile_MaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "brisa.log")
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"old": 48 * time.Hour, "recent": time.Hour} {
+		backup := path + "." + name
+		os.WriteFile(backup, []byte("record\n"), 0o644)
+		os.Chtimes(backup, now.Add(-age), now.Add(-age))
+	}
+
+	// 启动时删除超过保留期限的备份
+	f, err := newRotatingFile(path, 10, 0, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 || backups[0] != path+".recent" {
+		t.Errorf("expected only the recent backup to be kept, got %v", backups)
+	}
+
+	// 轮转时同样清理
+	f.now = func() time.Time { return now.Add(23*time.Hour + 30*time.Minute) }
+	f.Write([]byte("12345678"))
+	f.Write([]byte("12345678"))
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 || backups[0] == path+".recent" {
+		t.Errorf("expected the expired backup to be removed on rotation, got %v", backups)
+	}
+}
+
+func TestLogChain(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "chain.key")
+	os.WriteFile(keyFile, []byte("secret\n"), 0o600)
+	key := []byte("secret")
+
+	for _, format := range []string{"text", "json"} {
+		path := filepath.Join(dir, format+".log")
+		// 重启后链条从文件的最后一条记录继续
+		for i := range 2 {
+			logger, closer, err := NewLogger(LogConfig{Format: format, Path: path, ChainKeyFile: keyFile})
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger.Info("accepted", "run", i, "mail_id", "abc")
+			logger.Warn("rejected", "run", i)
+			closer.Close()
+		}
+
+		data, _ := os.ReadFile(path)
+		v := NewLogChainVerifier(key)
+		if err := v.Verify(bytes.NewReader(data)); err != nil || v.Records != 4 {
+			t.Fatalf("%s: expected 4 verified records, got %d, %v", format, v.Records, err)
+		}
+		if err := NewLogChainVerifier([]byte("other")).Verify(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected the wrong key to fail", format)
+		}
+
+		// 篡改或删除记录会破坏链条
+		tampered := bytes.Replace(data, []byte("abc"), []byte("xyz"), 1)
+		var chainErr *LogChainError
+		if err := NewLogChainVerifier(key).Verify(bytes.NewReader(tampered)); !errors.As(err, &chainErr) || chainErr.Line != 1 {
+			t.Errorf("%s: expected line 1 to break the chain, got %v", format, err)
+		}
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		removed := bytes.Join(append(lines[:1:1], lines[2:]...), nil)
+		if err := NewLogChainVerifier(key).Verify(bytes.NewReader(removed)); !errors.Is(err, ErrLogChainBroken) {
+			t.Errorf("%s: expected a removed record to break the chain, got %v", format, err)
+		}
+
+		// 轮转后的文件延续之前的链条
+		rotated := bytes.Join(lines[2:], nil)
+		if err := NewLogChainVerifier(key).Verify(bytes.NewReader(rotated)); err == nil {
+			t.Errorf("%s: expected a chain that does not start to fail", format)
+		}
+		v = NewLogChainVerifier(key)
+		v.Continued = true
+		if err := v.Verify(bytes.NewReader(rotated)); err != nil || v.Records != 2 {
+			t.Errorf("%s: expected a continued chain, got %d records, %v", format, v.Records, err)
+		}
+	}
+
+	if _, _, err := NewLogger(LogConfig{Path: "syslog", Chain: true}); err == nil {
+		t.Error("expected an error for a chained syslog")
+	}
+}
+
+func TestLogRedact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "brisa.log")
+	logger, closer, err := NewLogger(LogConfig{Format: "json", Path: path, Redact: LogRedactConfig{Addresses: RedactHash, IPs: RedactMask}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.With("ip", "192.0.2.17").Info("accepted",
+		"from", "Alice@example.com",
+		"to", []string{"bob@example.org", "not an address"},
+		slog.Group("client", "addr", "[2001:db8:1:2::5]:25"),
+		"mail_id", "abc")
+	logger.Info("other", "from", "alice@example.com", "ip", netip.MustParseAddr("198.51.100.9"))
+	closer.Close()
+
+	data, _ := os.ReadFile(path)
+	out := string(data)
+	for _, s := range []string{"Alice", "alice", "bob@", "192.0.2.17", "2001:db8:1:2::5", "198.51.100.9"} {
+		if strings.Contains(out, s) {
+			t.Errorf("expected %q to be redacted, got %s", s, out)
+		}
+	}
+	for _, s := range []string{`"ip":"192.0.2.0/24"`, `"addr":"2001:db8:1::/48"`, `"not an address"`, `"mail_id":"abc"`, `"ip":"198.51.100.0/24"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %s, got %s", s, out)
+		}
+	}
+	// 同一地址的哈希相同，可以关联记录
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	hash := regexp.MustCompile(`"from":"(h:[0-9a-f]{12})"`)
+	first, second := hash.FindStringSubmatch(lines[0]), hash.FindStringSubmatch(lines[1])
+	if first == nil || second == nil || first[1] != second[1] {
+		t.Errorf("expected the same hash of the sender, got %s", out)
+	}
+
+	masked := &redactor{addresses: RedactMask}
+	if s, _ := masked.redactString("alice@example.com"); s != "a***@example.com" {
+		t.Errorf("unexpected masked address %q", s)
+	}
+	if _, _, err := NewLogger(LogConfig{Redact: LogRedactConfig{IPs: "drop"}}); err == nil {
+		t.Error("expected an error for an invalid mode")
+	}
+}
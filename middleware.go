@@ -1,7 +1,11 @@
 package brisa
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 )
 
 // Action represents the action to be taken after a middleware executes. It also
@@ -22,6 +26,37 @@ const (
 	Discard // 16
 )
 
+var actionNames = []struct {
+	action Action
+	name   string
+}{
+	{Pass, "pass"},
+	{Reject, "reject"},
+	{Deliver, "deliver"},
+	{Quarantine, "quarantine"},
+	{Discard, "discard"},
+}
+
+// String returns the lower-case name of the action. A combination of flags,
+// such as IgnoreFlags, is written as names joined by "|", and no flags as
+// "none".
+func (a Action) String() string {
+	if a == 0 {
+		return "none"
+	}
+	var names []string
+	for _, n := range actionNames {
+		if a&n.action != 0 {
+			names = append(names, n.name)
+			a &^= n.action
+		}
+	}
+	if a != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(a)))
+	}
+	return strings.Join(names, "|")
+}
+
 // IgnoreFlags define the statuses that a middleware can ignore.
 const (
 	// IgnoreDeliver skips the middleware if the context status is Deliver.
@@ -40,43 +75,118 @@ type Handler func(ctx *Context) Action
 
 // Middleware is a struct containing the handler logic and its metadata.
 type Middleware struct {
+	// Name identifies the middleware in traces and recordings. Registry.BuildRouter
+	// sets it to the configured name; it is optional otherwise.
+	Name string
 	// Handler is the function to be executed by this middleware.
 	Handler Handler
 	// IgnoreFlags is a bitmask indicating which context statuses should cause
 	// this middleware to be skipped.
 	IgnoreFlags Action
+	// Condition, if set, skips the middleware when it returns false, e.g. to
+	// run it only for unauthenticated clients. It is checked after IgnoreFlags.
+	Condition Condition
+	// RejectMessage, if set, renders the text of the replies to the commands
+	// this middleware rejects, whether chosen with RejectWith or not.
+	RejectMessage *ReplyTemplate
+	// MaxScanBytes, if positive, limits the message the handler sees in
+	// ctx.Reader to its first MaxScanBytes bytes, for filters that only need
+	// the head of large messages. The later middleware get the whole message
+	// whatever the handler read. A handler replacing ctx.Reader, e.g. to add
+	// header fields, must leave the head it read in the new reader; the rest
+	// of the message follows it, so the handler must not rewrite the body.
+	MaxScanBytes int64
 }
 
 // MiddlewareChain is a slice of Middleware.
 type MiddlewareChain []Middleware
 
+// TraceStep is one middleware in the execution trace of a context.
+type TraceStep struct {
+	Chain ChainType
+	// Middleware is the Name of the middleware.
+	Middleware string
+	// Action is the action the middleware returned. It is the action of the
+	// context for skipped middleware.
+	Action   Action
+	Duration time.Duration
+	// Skipped is set when the middleware did not run because of its
+	// IgnoreFlags or Condition.
+	Skipped bool
+}
+
 // Execute iterates through and executes all middleware in the chain, passing the
 // context to each. It is panic-safe; if a middleware panics, Execute will
 // recover, return a Reject action, and an error detailing the panic.
 //
 // Execution logic:
-// - If a middleware's IgnoreFlags match the context's status, it's skipped.
+// - If a middleware's IgnoreFlags match the context's status or its Condition fails, it's skipped.
 // - The action returned by a handler updates the context's status for subsequent middleware.
 // - If a handler returns Reject, execution stops immediately.
+//
+// Every middleware, run or skipped, is added to the trace of the context.
 func (mc MiddlewareChain) Execute(ctx *Context) (action Action, err error) {
+	var current *Middleware
+	var start time.Time
 	defer func() {
 		if r := recover(); r != nil {
 			// A middleware panicked. Recover, set a terminal action, and return an error.
 			err = fmt.Errorf("panic recovered during middleware execution: %v", r)
 			action = Reject // Reject the session as a safe default.
+			if current != nil {
+				ctx.addTraceStep(TraceStep{Middleware: current.Name, Action: Reject, Duration: time.Since(start)})
+			}
 		}
 	}()
 
-	for _, m := range mc {
+	for i := range mc {
+		m := &mc[i]
 		// If the context's current status bit overlaps with the middleware's ignore flags, skip this middleware.
-		if (m.IgnoreFlags & ctx.Action) != 0 {
+		if (m.IgnoreFlags&ctx.Action) != 0 || (m.Condition != nil && !m.Condition(ctx)) {
+			ctx.addTraceStep(TraceStep{Middleware: m.Name, Action: ctx.Action, Skipped: true})
 			continue
 		}
 
-		ctx.Action = m.Handler(ctx)
+		current, start = m, time.Now()
+		if m.MaxScanBytes > 0 && ctx.Reader != nil {
+			ctx.Action = runScanLimited(ctx, m.MaxScanBytes, m.Handler)
+		} else {
+			ctx.Action = m.Handler(ctx)
+		}
+		ctx.addTraceStep(TraceStep{Middleware: m.Name, Action: ctx.Action, Duration: time.Since(start)})
+		current = nil
 		if ctx.Action == Reject { // Reject is a terminal state.
+			ctx.rejectedBy = m
 			return ctx.Action, nil
 		}
 	}
 	return ctx.Action, nil
 }
+
+// runScanLimited runs h with the context reader limited to the first limit
+// bytes of the message, and then restores the whole message. If h left the
+// limited reader in place, the bytes it read are put back in front of the
+// rest of the message, or the message is read from its spool again (see
+// Context.MessageSpool). If h replaced the reader to rewrite the message, the
+// new reader holds the head and the rest of the message follows it.
+func runScanLimited(ctx *Context, limit int64, h Handler) Action {
+	rest := ctx.Reader
+	sp := ctx.MessageSpool()
+	var head bytes.Buffer
+	src := rest
+	if sp == nil {
+		src = io.TeeReader(rest, &head)
+	}
+	limited := &io.LimitedReader{R: src, N: limit}
+	ctx.Reader = limited
+	action := h(ctx)
+	switch {
+	case ctx.Reader != io.Reader(limited):
+		ctx.Reader = io.MultiReader(ctx.Reader, rest)
+	case sp != nil:
+		ctx.SetMessageSpool(sp)
+	default:
+		ctx.Reader = io.MultiReader(bytes.NewReader(head.Bytes()), rest)
+	}
+	return action
+}
@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+// DefaultAliasMaxDepth is the default number of nested aliases and lists
+// expanded for a recipient.
+const DefaultAliasMaxDepth = 8
+
+// AliasExpansionKey is the context key holding the []AliasGroup of a
+// message whose recipients were expanded.
+const AliasExpansionKey = "alias.groups"
+
+var (
+	// ErrAliasLoop is returned for a message to an alias that expands to
+	// itself or nests deeper than the maximum depth.
+	ErrAliasLoop = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+		Message:      "Alias expansion loop detected",
+	}
+	// ErrListMessageTooBig is returned for a message larger than the size
+	// limit of a mailing list it is sent to.
+	ErrListMessageTooBig = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message too big for mailing list",
+	}
+	// ErrListTooManyRecipients is returned for a message to a mailing list
+	// that expands to more recipients than its limit.
+	ErrListTooManyRecipients = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 3},
+		Message:      "Mailing list has too many recipients",
+	}
+)
+
+// MailingList is an address expanded to its members with mailing-list
+// semantics: the members receive the message from the list owner, so that
+// bounces go to the owner rather than the original sender.
+type MailingList struct {
+	// Members are addresses, aliases or other lists.
+	Members []string
+	// Owner is the envelope sender for the members, e.g.
+	// "owner-team@example.com". Empty keeps the original sender.
+	Owner string
+	// MaxRecipients, if positive, refuses messages when the list expands to
+	// more recipients.
+	MaxRecipients int
+	// MaxSize, if positive, refuses messages larger than MaxSize bytes.
+	MaxSize int64
+}
+
+// AliasGroup is a set of expanded recipients that receive the message with
+// the same envelope sender.
+type AliasGroup struct {
+	From string
+	To   []string
+}
+
+// AliasConfig configures the Alias middleware. Addresses are compared
+// ignoring case, with their domains in either IDN form.
+type AliasConfig struct {
+	// Aliases map an address to the addresses, aliases or lists it forwards to.
+	Aliases map[string][]string
+	// Lists map an address to a mailing list.
+	Lists map[string]MailingList
+	// MaxDepth defaults to DefaultAliasMaxDepth.
+	MaxDepth int
+}
+
+// Alias expands aliases and mailing lists among the recipients of a message.
+// The recipients of the message are replaced by the expansion, each address
+// once even if several aliases or lists lead to it. The expansion is also
+// recorded under AliasExpansionKey, grouped by envelope sender: a message to
+// a list and to other recipients needs one delivery per group. If all
+// recipients share one sender, such as the owner of the only list, ctx.From is
+// rewritten to it.
+//
+// It must run in the Data chain, after the recipients are final.
+type Alias struct {
+	aliases  map[string][]string
+	lists    map[string]MailingList
+	maxDepth int
+}
+
+// NewAlias creates a new Alias instance.
+func NewAlias(cfg AliasConfig) (*Alias, error) {
+	if cfg.MaxDepth < 0 {
+		return nil, fmt.Errorf("invalid alias max depth: %d", cfg.MaxDepth)
+	}
+	if cfg.MaxDepth == 0 {
+		cfg.MaxDepth = DefaultAliasMaxDepth
+	}
+	a := &Alias{
+		aliases:  make(map[string][]string, len(cfg.Aliases)),
+		lists:    make(map[string]MailingList, len(cfg.Lists)),
+		maxDepth: cfg.MaxDepth,
+	}
+	for addr, targets := range cfg.Aliases {
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("alias %s has no targets", addr)
+		}
+		a.aliases[address.Key(addr)] = targets
+	}
+	for addr, list := range cfg.Lists {
+		key := address.Key(addr)
+		if _, ok := a.aliases[key]; ok {
+			return nil, fmt.Errorf("%s is both an alias and a list", addr)
+		}
+		if list.MaxRecipients < 0 || list.MaxSize < 0 {
+			return nil, fmt.Errorf("list %s: limits must not be negative", addr)
+		}
+		a.lists[key] = list
+	}
+	return a, nil
+}
+
+// NewAliasHandler creates a new Data middleware handler expanding aliases and
+// mailing lists.
+func NewAliasHandler(cfg AliasConfig) (brisa.Handler, error) {
+	a, err := NewAlias(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return a.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (a *Alias) Handle(ctx *brisa.Context) brisa.Action {
+	e := &aliasExpansion{alias: a, seen: make(map[string]bool)}
+	for i, rcpt := range ctx.To {
+		var opts *smtp.RcptOptions
+		if i < len(ctx.ToOptions) {
+			opts = ctx.ToOptions[i]
+		}
+		if err := e.expand(rcpt, ctx.From, opts, nil); err != nil {
+			ctx.Logger.Warn("alias expansion refused", "rcpt", rcpt, "error", err.Message)
+			return ctx.RejectWith(err)
+		}
+	}
+	if !e.expanded {
+		return brisa.Pass
+	}
+
+	var maxSize int64
+	for _, list := range e.lists {
+		if list.MaxSize > 0 && (maxSize == 0 || list.MaxSize < maxSize) {
+			maxSize = list.MaxSize
+		}
+	}
+	if maxSize > 0 {
+		data, err := readMessagePrefix(ctx, maxSize+1)
+		if err != nil {
+			ctx.Logger.Error("failed to read message", "error", err)
+			return brisa.Pass
+		}
+		if int64(len(data)) > maxSize {
+			return ctx.RejectWith(ErrListMessageTooBig)
+		}
+	}
+
+	ctx.To = append(ctx.To[:0], e.to...)
+	ctx.ToOptions = append(ctx.ToOptions[:0], e.opts...)
+	ctx.Set(AliasExpansionKey, e.groups)
+	if len(e.groups) == 1 && e.groups[0].From != ctx.From {
+		ctx.Logger.Info("envelope sender rewritten for mailing list", "from", ctx.From, "to", e.groups[0].From)
+		ctx.From = e.groups[0].From
+	}
+	ctx.Logger.Info("recipients expanded", "recipients", len(e.to), "groups", len(e.groups))
+	return brisa.Pass
+}
+
+// aliasExpansion is the state of expanding the recipients of one message.
+type aliasExpansion struct {
+	alias    *Alias
+	seen     map[string]bool
+	to       []string
+	opts     []*smtp.RcptOptions
+	groups   []AliasGroup
+	lists    []MailingList
+	expanded bool
+}
+
+// expand adds the final recipients of rcpt with envelope sender from. path
+// holds the aliases and lists being expanded, to detect loops.
+func (e *aliasExpansion) expand(rcpt, from string, opts *smtp.RcptOptions, path []string) *smtp.SMTPError {
+	key := address.Key(rcpt)
+	targets, isAlias := e.alias.aliases[key]
+	list, isList := e.alias.lists[key]
+	if !isAlias && !isList {
+		e.add(rcpt, from, opts)
+		return nil
+	}
+	for _, p := range path {
+		if p == key {
+			return ErrAliasLoop
+		}
+	}
+	if len(path) >= e.alias.maxDepth {
+		return ErrAliasLoop
+	}
+	e.expanded = true
+	path = append(path, key)
+	// Options of the original recipient, such as DSN NOTIFY, do not carry
+	// over to the expansion.
+	if isAlias {
+		for _, t := range targets {
+			if err := e.expand(t, from, nil, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if list.Owner != "" {
+		from = list.Owner
+	}
+	before := len(e.to)
+	for _, m := range list.Members {
+		if err := e.expand(m, from, nil, path); err != nil {
+			return err
+		}
+	}
+	if list.MaxRecipients > 0 && len(e.to)-before > list.MaxRecipients {
+		return ErrListTooManyRecipients
+	}
+	e.lists = append(e.lists, list)
+	return nil
+}
+
+// add adds a final recipient unless it was already added.
+func (e *aliasExpansion) add(rcpt, from string, opts *smtp.RcptOptions) {
+	key := address.Key(rcpt)
+	if e.seen[key] {
+		return
+	}
+	e.seen[key] = true
+	e.to = append(e.to, rcpt)
+	e.opts = append(e.opts, opts)
+	for i := range e.groups {
+		if e.groups[i].From == from {
+			e.groups[i].To = append(e.groups[i].To, rcpt)
+			return
+		}
+	}
+	e.groups = append(e.groups, AliasGroup{From: from, To: []string{rcpt}})
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAlias(t *testing.T) *Alias {
+	t.Helper()
+	a, err := NewAlias(AliasConfig{
+		Aliases: map[string][]string{
+			"postmaster@example.com": {"alice@example.com"},
+			"Sales@example.com":      {"bob@example.com", "team@example.com"},
+			"loop1@example.com":      {"loop2@example.com"},
+			"loop2@example.com":      {"loop1@example.com"},
+		},
+		Lists: map[string]MailingList{
+			"team@example.com": {
+				Members: []string{"alice@example.com", "carol@example.com", "postmaster@example.com"},
+				Owner:   "owner-team@example.com",
+			},
+			"small@example.com": {Members: []string{"a@example.org", "b@example.org"}, MaxRecipients: 1},
+			"tiny@example.com":  {Members: []string{"a@example.org"}, MaxSize: 64},
+		},
+	})
+	require.NoError(t, err)
+	return a
+}
+
+func runAlias(t *testing.T, a *Alias, message string, rcpts ...string) (*brisa.Context, brisa.Action) {
+	t.Helper()
+	env := brisatest.DefaultEnvelope()
+	env.To = rcpts
+	ctx := brisatest.NewContext(t, env, message)
+	for range rcpts {
+		ctx.ToOptions = append(ctx.ToOptions, &smtp.RcptOptions{})
+	}
+	return ctx, a.Handle(ctx)
+}
+
+func TestNewAlias(t *testing.T) {
+	_, err := NewAlias(AliasConfig{Aliases: map[string][]string{"a@example.com": nil}})
+	require.Error(t, err)
+	_, err = NewAlias(AliasConfig{
+		Aliases: map[string][]string{"a@example.com": {"b@example.com"}},
+		Lists:   map[string]MailingList{"A@example.com": {}},
+	})
+	require.Error(t, err)
+	_, err = NewAlias(AliasConfig{Lists: map[string]MailingList{"l@example.com": {MaxSize: -1}}})
+	require.Error(t, err)
+}
+
+func TestAlias(t *testing.T) {
+	a := newTestAlias(t)
+
+	// Without aliases the message is untouched.
+	ctx, action := runAlias(t, a, "\r\n", "dave@example.com")
+	assert.Equal(t, brisa.Pass, action)
+	assert.Equal(t, []string{"dave@example.com"}, ctx.To)
+	_, ok := ctx.Get(AliasExpansionKey)
+	assert.False(t, ok)
+
+	// A list alone: the owner becomes the envelope sender and recipients
+	// reached twice are delivered once.
+	ctx, action = runAlias(t, a, "\r\n", "TEAM@example.com")
+	assert.Equal(t, brisa.Pass, action)
+	assert.Equal(t, []string{"alice@example.com", "carol@example.com"}, ctx.To)
+	assert.Len(t, ctx.ToOptions, 2)
+	assert.Equal(t, "owner-team@example.com", ctx.From)
+
+	// Mixed recipients keep the original sender and are grouped.
+	ctx, action = runAlias(t, a, "\r\n", "sales@example.com", "dave@example.com")
+	assert.Equal(t, brisa.Pass, action)
+	assert.Equal(t, []string{"bob@example.com", "alice@example.com", "carol@example.com", "dave@example.com"}, ctx.To)
+	assert.Equal(t, brisatest.DefaultEnvelope().From, ctx.From)
+	groups, _ := ctx.Get(AliasExpansionKey)
+	assert.Equal(t, []AliasGroup{
+		{From: brisatest.DefaultEnvelope().From, To: []string{"bob@example.com", "dave@example.com"}},
+		{From: "owner-team@example.com", To: []string{"alice@example.com", "carol@example.com"}},
+	}, groups)
+}
+
+func TestAlias_Limits(t *testing.T) {
+	a := newTestAlias(t)
+
+	ctx, action := runAlias(t, a, "\r\n", "loop1@example.com")
+	assert.Equal(t, brisa.Reject, action)
+	assert.Equal(t, ErrAliasLoop, ctx.RejectError())
+
+	ctx, action = runAlias(t, a, "\r\n", "small@example.com")
+	assert.Equal(t, brisa.Reject, action)
+	assert.Equal(t, ErrListTooManyRecipients, ctx.RejectError())
+
+	_, action = runAlias(t, a, "Subject: hi\r\n\r\nshort\r\n", "tiny@example.com")
+	assert.Equal(t, brisa.Pass, action)
+	message := "Subject: hi\r\n\r\n" + strings.Repeat("long ", 20) + "\r\n"
+	ctx, action = runAlias(t, a, message, "tiny@example.com")
+	assert.Equal(t, brisa.Reject, action)
+	assert.Equal(t, ErrListMessageTooBig, ctx.RejectError())
+
+	// The message is still complete for later middleware.
+	ctx, _ = runAlias(t, a, "Subject: hi\r\n\r\nshort\r\n", "tiny@example.com")
+	assert.Equal(t, "Subject: hi\r\n\r\nshort\r\n", brisatest.ReadMessage(t, ctx))
+}
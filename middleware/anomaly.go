@@ -0,0 +1,318 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultAnomalyKeyPrefix is the default prefix of the Store keys written
+	// by Anomaly.
+	DefaultAnomalyKeyPrefix = "anomaly:"
+	// DefaultAnomalyLearningMessages is the default number of messages a user
+	// sends before their profile is trusted to detect anomalies.
+	DefaultAnomalyLearningMessages = 20
+	// DefaultAnomalyProfileTTL is the default time a profile is kept after
+	// the last message of the user.
+	DefaultAnomalyProfileTTL = 90 * 24 * time.Hour
+	// DefaultRecipientSpikeFactor is the default multiple of the average
+	// recipient count of a user that is a spike.
+	DefaultRecipientSpikeFactor = 5
+	// DefaultMinSpikeRecipients is the default recipient count below which a
+	// message is never a spike.
+	DefaultMinSpikeRecipients = 10
+	// DefaultNightBurst is the default number of messages per hour at night
+	// that is a burst.
+	DefaultNightBurst = 20
+
+	// maxAnomalyProfileNetworks bounds the countries and ASNs kept per user.
+	maxAnomalyProfileNetworks = 32
+)
+
+// AnomalyKey is the context key holding the reasons ([]string) of the
+// anomalies detected for the message.
+const AnomalyKey = "anomaly.reasons"
+
+// Reasons of the anomalies detected by Anomaly.
+const (
+	AnomalyNewCountry     = "new_country"
+	AnomalyNewASN         = "new_asn"
+	AnomalyRecipientSpike = "recipient_spike"
+	AnomalyNightBurst     = "night_burst"
+)
+
+// ErrReauthRequired is returned for a message refused by an Anomaly with
+// AnomalyReauth. The client must connect and authenticate again.
+var ErrReauthRequired = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Unusual activity, please authenticate again",
+}
+
+// AnomalyAction defines what the Anomaly middleware does with a message of
+// an anomalous session.
+type AnomalyAction int
+
+const (
+	// AnomalyFlag lets the message through; the anomaly is only logged,
+	// published and recorded under AnomalyKey.
+	AnomalyFlag AnomalyAction = iota
+	// AnomalyQuarantine marks the message for quarantine.
+	AnomalyQuarantine
+	// AnomalyReauth refuses the message with ErrReauthRequired and clears
+	// brisa.FlagAuthenticated for the rest of the session.
+	AnomalyReauth
+)
+
+// IPInfo is the network an IP address belongs to.
+type IPInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code, e.g. "DE".
+	Country string
+	ASN     uint32
+}
+
+// IPInfoLookup returns the network of an IP address, e.g. from a GeoIP
+// database. Empty fields are unknown and not compared.
+type IPInfoLookup func(ip net.IP) (IPInfo, error)
+
+// AnomalyConfig configures the Anomaly middleware.
+type AnomalyConfig struct {
+	// Store holds the profiles of the users. It is required. A profile is
+	// read and written back whole, so of two instances updating the profile
+	// of a user at the same time, only the last one's message is learned.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultAnomalyKeyPrefix.
+	KeyPrefix string
+	// Lookup finds the country and ASN of the client. Without it, networks
+	// are not compared.
+	Lookup IPInfoLookup
+	// LearningMessages defaults to DefaultAnomalyLearningMessages.
+	LearningMessages int64
+	// ProfileTTL defaults to DefaultAnomalyProfileTTL.
+	ProfileTTL time.Duration
+	// RecipientSpikeFactor and MinSpikeRecipients default to
+	// DefaultRecipientSpikeFactor and DefaultMinSpikeRecipients.
+	RecipientSpikeFactor float64
+	MinSpikeRecipients   int
+	// NightStart and NightEnd are the hours (0-23) of the night in Location,
+	// which defaults to time.Local. The night is off if both are zero.
+	NightStart, NightEnd int
+	Location             *time.Location
+	// NightBurst defaults to DefaultNightBurst.
+	NightBurst int64
+	// Action defaults to AnomalyFlag.
+	Action AnomalyAction
+	// Clock defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// Anomaly detects sudden changes in the behavior of authenticated users that
+// suggest a compromised account: a client in a country or network the user
+// never sent from, a message to many more recipients than usual, or a burst
+// of messages at night. It keeps a profile per user in the Store, updated by
+// each message without an anomaly; concurrent sessions of a user may lose
+// updates, which only delays learning.
+//
+// Anomalies are logged, recorded under AnomalyKey and published as
+// brisa.AnomalyDetected events. It must run in the Data chain.
+type Anomaly struct {
+	cfg AnomalyConfig
+}
+
+// anomalyProfile is the stored behavior of a user.
+type anomalyProfile struct {
+	Messages      int64    `json:"messages"`
+	AvgRecipients float64  `json:"avg_recipients"`
+	Countries     []string `json:"countries,omitempty"`
+	ASNs          []uint32 `json:"asns,omitempty"`
+}
+
+// NewAnomaly creates a new Anomaly instance.
+func NewAnomaly(cfg AnomalyConfig) (*Anomaly, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("anomaly store is required")
+	}
+	if cfg.NightStart < 0 || cfg.NightStart > 23 || cfg.NightEnd < 0 || cfg.NightEnd > 23 {
+		return nil, fmt.Errorf("invalid night hours: %d-%d", cfg.NightStart, cfg.NightEnd)
+	}
+	if cfg.LearningMessages < 0 || cfg.ProfileTTL < 0 || cfg.RecipientSpikeFactor < 0 || cfg.MinSpikeRecipients < 0 || cfg.NightBurst < 0 {
+		return nil, fmt.Errorf("anomaly thresholds must not be negative")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultAnomalyKeyPrefix
+	}
+	if cfg.LearningMessages == 0 {
+		cfg.LearningMessages = DefaultAnomalyLearningMessages
+	}
+	if cfg.ProfileTTL == 0 {
+		cfg.ProfileTTL = DefaultAnomalyProfileTTL
+	}
+	if cfg.RecipientSpikeFactor == 0 {
+		cfg.RecipientSpikeFactor = DefaultRecipientSpikeFactor
+	}
+	if cfg.MinSpikeRecipients == 0 {
+		cfg.MinSpikeRecipients = DefaultMinSpikeRecipients
+	}
+	if cfg.NightBurst == 0 {
+		cfg.NightBurst = DefaultNightBurst
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.Local
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+	return &Anomaly{cfg: cfg}, nil
+}
+
+// NewAnomalyHandler creates a new Data middleware handler detecting
+// anomalies.
+func NewAnomalyHandler(cfg AnomalyConfig) (brisa.Handler, error) {
+	a, err := NewAnomaly(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return a.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (a *Anomaly) Handle(ctx *brisa.Context) brisa.Action {
+	if !ctx.HasFlag(brisa.FlagAuthenticated) || ctx.Auth().Username == "" {
+		return brisa.Pass
+	}
+	user := strings.ToLower(ctx.Auth().Username)
+	key := a.cfg.KeyPrefix + "profile:" + user
+	profile, err := a.loadProfile(key)
+	if err != nil {
+		// Fail open: a broken Store must not stop submission.
+		ctx.Logger.Error("failed to load anomaly profile", "user", user, "error", err)
+		return brisa.Pass
+	}
+
+	var info IPInfo
+	if ip := clientIP(ctx); ip != nil && a.cfg.Lookup != nil {
+		if info, err = a.cfg.Lookup(ip); err != nil {
+			ctx.Logger.Error("failed to look up client network", "ip", ip, "error", err)
+		}
+	}
+
+	var reasons []string
+	if profile.Messages >= a.cfg.LearningMessages {
+		if info.Country != "" && !slices.Contains(profile.Countries, info.Country) {
+			reasons = append(reasons, AnomalyNewCountry)
+		}
+		if info.ASN != 0 && !slices.Contains(profile.ASNs, info.ASN) {
+			reasons = append(reasons, AnomalyNewASN)
+		}
+		if n := len(ctx.To); n >= a.cfg.MinSpikeRecipients && float64(n) > a.cfg.RecipientSpikeFactor*profile.AvgRecipients {
+			reasons = append(reasons, AnomalyRecipientSpike)
+		}
+	}
+	if a.night() {
+		n, err := a.cfg.Store.Incr(a.cfg.KeyPrefix+"night:"+user, 1, time.Hour)
+		if err != nil {
+			ctx.Logger.Error("failed to count night messages", "user", user, "error", err)
+		} else if n > a.cfg.NightBurst {
+			reasons = append(reasons, AnomalyNightBurst)
+		}
+	}
+
+	// Refused or quarantined messages do not teach the profile.
+	if len(reasons) == 0 || a.cfg.Action == AnomalyFlag {
+		profile.learn(info, len(ctx.To))
+		if err := a.saveProfile(key, profile); err != nil {
+			ctx.Logger.Error("failed to save anomaly profile", "user", user, "error", err)
+		}
+	}
+	if len(reasons) == 0 {
+		return brisa.Pass
+	}
+
+	ctx.Set(AnomalyKey, reasons)
+	ctx.Logger.Warn("anomalous activity of authenticated user", "user", user, "reasons", reasons,
+		"country", info.Country, "asn", info.ASN, "recipients", len(ctx.To))
+	if s := ctx.Session; s != nil {
+		s.Events().Publish(brisa.AnomalyDetected{
+			SessionID:  s.ID(),
+			MailID:     s.MailID(),
+			Username:   ctx.Auth().Username,
+			ClientAddr: s.GetClientIP(),
+			Reasons:    reasons,
+		})
+	}
+
+	switch a.cfg.Action {
+	case AnomalyQuarantine:
+		return brisa.Quarantine
+	case AnomalyReauth:
+		ctx.ClearFlag(brisa.FlagAuthenticated)
+		return ctx.RejectWith(ErrReauthRequired)
+	default:
+		return brisa.Pass
+	}
+}
+
+// night reports whether it is night in the configured hours.
+func (a *Anomaly) night() bool {
+	start, end := a.cfg.NightStart, a.cfg.NightEnd
+	if start == end {
+		return false
+	}
+	hour := a.cfg.Clock.Now().In(a.cfg.Location).Hour()
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+func (a *Anomaly) loadProfile(key string) (*anomalyProfile, error) {
+	profile := &anomalyProfile{}
+	data, ok, err := a.cfg.Store.Get(key)
+	if err != nil || !ok {
+		return profile, err
+	}
+	if err := json.Unmarshal(data, profile); err != nil {
+		// Start over rather than fail on a corrupt profile.
+		return &anomalyProfile{}, nil
+	}
+	return profile, nil
+}
+
+func (a *Anomaly) saveProfile(key string, profile *anomalyProfile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return a.cfg.Store.Set(key, data, a.cfg.ProfileTTL)
+}
+
+// learn adds a message from the network info with n recipients.
+func (p *anomalyProfile) learn(info IPInfo, n int) {
+	p.Messages++
+	// A moving average that follows slow changes after the first messages.
+	weight := float64(min(p.Messages, 50))
+	p.AvgRecipients += (float64(n) - p.AvgRecipients) / weight
+	if info.Country != "" && !slices.Contains(p.Countries, info.Country) {
+		p.Countries = appendCapped(p.Countries, info.Country)
+	}
+	if info.ASN != 0 && !slices.Contains(p.ASNs, info.ASN) {
+		p.ASNs = appendCapped(p.ASNs, info.ASN)
+	}
+}
+
+// appendCapped appends v, dropping the oldest entries beyond
+// maxAnomalyProfileNetworks.
+func appendCapped[T any](list []T, v T) []T {
+	list = append(list, v)
+	if len(list) > maxAnomalyProfileNetworks {
+		list = list[len(list)-maxAnomalyProfileNetworks:]
+	}
+	return list
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAnomalyBrisa(t *testing.T, cfg AnomalyConfig) (*brisa.Brisa, *[]brisa.AnomalyDetected) {
+	t.Helper()
+	handler, err := NewAnomalyHandler(cfg)
+	require.NoError(t, err)
+	router := brisa.Router{}
+	router.OnData(&brisa.Middleware{Handler: handler})
+	b := brisatest.NewBrisa(&router)
+	var events []brisa.AnomalyDetected
+	brisa.Subscribe(b.Events(), func(e brisa.AnomalyDetected) { events = append(events, e) })
+	return b, &events
+}
+
+// anomalyLookup places 198.51.100.0/24 in Germany and everything else in
+// Russia.
+func anomalyLookup(ip net.IP) (IPInfo, error) {
+	if ip.Mask(net.CIDRMask(24, 32)).Equal(net.ParseIP("198.51.100.0")) {
+		return IPInfo{Country: "DE", ASN: 3320}, nil
+	}
+	return IPInfo{Country: "RU", ASN: 12389}, nil
+}
+
+func anomalyEnvelope(ip string, rcpts int) brisa.Envelope {
+	env := brisatest.AuthEnvelope("alice@example.com")
+	env.ClientAddr = &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}
+	env.To = nil
+	for i := 0; i < rcpts; i++ {
+		env.To = append(env.To, "rcpt"+string(rune('a'+i))+"@example.org")
+	}
+	return env
+}
+
+func TestNewAnomaly(t *testing.T) {
+	_, err := NewAnomaly(AnomalyConfig{})
+	require.Error(t, err)
+	_, err = NewAnomaly(AnomalyConfig{Store: brisa.NewMemoryStore(), NightStart: 24})
+	require.Error(t, err)
+	_, err = NewAnomaly(AnomalyConfig{Store: brisa.NewMemoryStore(), NightBurst: -1})
+	require.Error(t, err)
+}
+
+func TestAnomaly(t *testing.T) {
+	b, events := newAnomalyBrisa(t, AnomalyConfig{
+		Store:            brisa.NewMemoryStore(),
+		Lookup:           anomalyLookup,
+		LearningMessages: 3,
+	})
+	send := func(env brisa.Envelope) *brisa.SimulationResult {
+		return b.Simulate(env, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	}
+
+	// While learning, nothing is anomalous.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, brisa.Deliver, send(anomalyEnvelope("198.51.100.7", 2)).Action)
+	}
+	assert.Empty(t, *events)
+
+	res := send(anomalyEnvelope("203.0.113.5", 2))
+	assert.Equal(t, brisa.Deliver, res.Action)
+	require.Len(t, *events, 1)
+	assert.Equal(t, []string{AnomalyNewCountry, AnomalyNewASN}, (*events)[0].Reasons)
+	assert.Equal(t, "alice@example.com", (*events)[0].Username)
+
+	// With AnomalyFlag the new network was learned.
+	send(anomalyEnvelope("203.0.113.5", 2))
+	assert.Len(t, *events, 1)
+
+	send(anomalyEnvelope("198.51.100.7", 15))
+	require.Len(t, *events, 2)
+	assert.Equal(t, []string{AnomalyRecipientSpike}, (*events)[1].Reasons)
+
+	// Clients that have not authenticated are not profiled.
+	env := anomalyEnvelope("192.0.2.1", 20)
+	env.Username = ""
+	send(env)
+	assert.Len(t, *events, 2)
+}
+
+func TestAnomaly_Actions(t *testing.T) {
+	for _, tt := range []struct {
+		action AnomalyAction
+		want   brisa.Action
+		err    error
+	}{
+		{AnomalyQuarantine, brisa.Quarantine, nil},
+		{AnomalyReauth, brisa.Reject, ErrReauthRequired},
+	} {
+		b, events := newAnomalyBrisa(t, AnomalyConfig{
+			Store:            brisa.NewMemoryStore(),
+			Lookup:           anomalyLookup,
+			LearningMessages: 1,
+			Action:           tt.action,
+		})
+		b.Simulate(anomalyEnvelope("198.51.100.7", 1), strings.NewReader("\r\n"))
+		for i := 0; i < 2; i++ {
+			// Anomalous networks are not learned, so the anomaly persists.
+			res := b.Simulate(anomalyEnvelope("203.0.113.5", 1), strings.NewReader("\r\n"))
+			assert.Equal(t, tt.want, res.Action)
+			assert.Equal(t, tt.err, res.Err)
+		}
+		assert.Len(t, *events, 2)
+	}
+}
+
+func TestAnomaly_NightBurst(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	clock := brisatest.NewFakeClock(time.Date(2024, 3, 1, 2, 30, 0, 0, loc))
+	b, events := newAnomalyBrisa(t, AnomalyConfig{
+		Store:      brisa.NewMemoryStoreWithClock(clock),
+		NightStart: 23,
+		NightEnd:   6,
+		Location:   loc,
+		NightBurst: 2,
+		Clock:      clock,
+	})
+	for i := 0; i < 3; i++ {
+		b.Simulate(anomalyEnvelope("198.51.100.7", 1), strings.NewReader("\r\n"))
+	}
+	require.Len(t, *events, 1)
+	assert.Equal(t, []string{AnomalyNightBurst}, (*events)[0].Reasons)
+
+	// During the day there is no burst limit.
+	clock.Set(time.Date(2024, 3, 1, 14, 0, 0, 0, loc))
+	for i := 0; i < 5; i++ {
+		b.Simulate(anomalyEnvelope("198.51.100.7", 1), strings.NewReader("\r\n"))
+	}
+	assert.Len(t, *events, 1)
+}
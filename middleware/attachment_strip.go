@@ -0,0 +1,227 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultAttachmentMaxSize is the default size in bytes above which an
+	// attachment is detached.
+	DefaultAttachmentMaxSize = 10 << 20
+	// DefaultAttachmentStripMaxBytes is the default size of the largest
+	// message rewritten; larger messages are left alone.
+	DefaultAttachmentStripMaxBytes = 64 << 20
+	// DefaultAttachmentStoreTimeout is the default timeout of storing the
+	// attachments of a message.
+	DefaultAttachmentStoreTimeout = 30 * time.Second
+	// DefaultAttachmentNotice is the default template of the text that
+	// replaces a detached attachment.
+	DefaultAttachmentNotice = `The attachment "{{.Filename}}" ({{.Size}} bytes) was removed from this message.
+{{- if .URL}}
+Download it from: {{.URL}}{{end}}
+`
+)
+
+// StrippedAttachmentsKey is the context key holding the attachments
+// ([]StrippedAttachment) removed from the message.
+const StrippedAttachmentsKey = "attachments.stripped"
+
+// AttachmentStore stores detached attachments, e.g. in an object store.
+type AttachmentStore interface {
+	// Put stores data under key and returns the URL it can be downloaded from.
+	Put(ctx context.Context, key, contentType string, data []byte) (url string, err error)
+}
+
+// StrippedAttachment is an attachment removed from a message. It is also the
+// data of the notice template.
+type StrippedAttachment struct {
+	Filename    string
+	ContentType string
+	Size        int
+	SHA256      string
+	// URL is empty if the attachment was removed without being stored.
+	URL string
+}
+
+// AttachmentStripperConfig configures the AttachmentStripper middleware.
+type AttachmentStripperConfig struct {
+	// MaxSize is the size in bytes above which attachments are detached.
+	// Defaults to DefaultAttachmentMaxSize; negative detaches by extension only.
+	MaxSize int64
+	// Extensions are the file extensions of risky attachments, e.g. ".exe",
+	// which are detached whatever their size.
+	Extensions []string
+	// Store receives the detached attachments, which are replaced by a link.
+	// Without it, the attachments are only removed.
+	Store AttachmentStore
+	// Notice is a text/template for the text replacing an attachment, executed
+	// with a StrippedAttachment. Defaults to DefaultAttachmentNotice.
+	Notice string
+	// MaxBytes defaults to DefaultAttachmentStripMaxBytes.
+	MaxBytes int64
+	// Timeout defaults to DefaultAttachmentStoreTimeout.
+	Timeout time.Duration
+}
+
+// AttachmentStripper keeps mailboxes small by replacing large or risky
+// attachments with a short text part. With a Store, the attachment is stored
+// there first and the text links to it, so no content is lost; an attachment
+// that cannot be stored is kept. The rest of the message is left byte-for-byte
+// as it is, but signatures over the body, such as DKIM, no longer verify.
+//
+// It must run in the Data chain. The removed attachments are recorded under
+// StrippedAttachmentsKey.
+type AttachmentStripper struct {
+	cfg        AttachmentStripperConfig
+	extensions map[string]bool
+	notice     *template.Template
+}
+
+// NewAttachmentStripper creates a new AttachmentStripper instance.
+func NewAttachmentStripper(cfg AttachmentStripperConfig) (*AttachmentStripper, error) {
+	if cfg.MaxBytes < 0 || cfg.Timeout < 0 {
+		return nil, fmt.Errorf("attachment stripper settings must not be negative")
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultAttachmentMaxSize
+	}
+	if cfg.Notice == "" {
+		cfg.Notice = DefaultAttachmentNotice
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = DefaultAttachmentStripMaxBytes
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultAttachmentStoreTimeout
+	}
+	notice, err := template.New("notice").Option("missingkey=error").Parse(cfg.Notice)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attachment notice: %w", err)
+	}
+	s := &AttachmentStripper{cfg: cfg, extensions: make(map[string]bool), notice: notice}
+	for _, ext := range cfg.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		s.extensions[ext] = true
+	}
+	return s, nil
+}
+
+// NewAttachmentStripperHandler creates a new Data middleware handler
+// stripping attachments.
+func NewAttachmentStripperHandler(cfg AttachmentStripperConfig) (brisa.Handler, error) {
+	s, err := NewAttachmentStripper(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (s *AttachmentStripper) Handle(ctx *brisa.Context) brisa.Action {
+	data, err := readMessagePrefix(ctx, s.cfg.MaxBytes+1)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return brisa.Pass
+	}
+	if int64(len(data)) > s.cfg.MaxBytes {
+		ctx.Logger.Debug("message too large to strip attachments", "limit", s.cfg.MaxBytes)
+		return brisa.Pass
+	}
+
+	storeCtx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+	var stripped []StrippedAttachment
+	rewritten, changed, err := rewriteParts(data, func(p *messagePart) *mimeReplacement {
+		if !p.IsAttachment() || !s.strip(p) {
+			return nil
+		}
+		a, repl, err := s.detach(storeCtx, p)
+		if err != nil {
+			ctx.Logger.Error("failed to detach attachment", "filename", p.Filename, "error", err)
+			return nil
+		}
+		stripped = append(stripped, a)
+		return repl
+	})
+	if err != nil {
+		ctx.Logger.Warn("failed to parse message for attachments", "error", err)
+		return brisa.Pass
+	}
+	if !changed {
+		return brisa.Pass
+	}
+
+	ctx.Reader = bytes.NewReader(rewritten)
+	ctx.Set(StrippedAttachmentsKey, stripped)
+	for _, a := range stripped {
+		ctx.Logger.Info("attachment stripped", "filename", a.Filename, "size", a.Size, "sha256", a.SHA256, "stored", a.URL != "")
+	}
+	return brisa.Pass
+}
+
+// strip reports whether an attachment is to be detached.
+func (s *AttachmentStripper) strip(p *messagePart) bool {
+	if s.extensions[strings.ToLower(path.Ext(p.Filename))] {
+		return true
+	}
+	return s.cfg.MaxSize > 0 && int64(len(p.Body)) > s.cfg.MaxSize
+}
+
+// detach stores the attachment, if there is a Store, and returns its
+// replacement.
+func (s *AttachmentStripper) detach(ctx context.Context, p *messagePart) (StrippedAttachment, *mimeReplacement, error) {
+	sum := sha256.Sum256(p.Body)
+	a := StrippedAttachment{
+		Filename:    p.Filename,
+		ContentType: p.MediaType,
+		Size:        len(p.Body),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+	if s.cfg.Store != nil {
+		// Keys by content hash store an attachment sent many times once.
+		key := a.SHA256
+		if name := path.Base(strings.ReplaceAll(p.Filename, "\\", "/")); name != "." && name != "/" {
+			key += "/" + name
+		}
+		url, err := s.cfg.Store.Put(ctx, key, p.MediaType, p.Body)
+		if err != nil {
+			return a, nil, err
+		}
+		a.URL = url
+	}
+
+	var text bytes.Buffer
+	if err := s.notice.Execute(&text, a); err != nil {
+		return a, nil, err
+	}
+	body := strings.ReplaceAll(strings.ReplaceAll(text.String(), "\r\n", "\n"), "\n", "\r\n")
+	if !strings.HasSuffix(body, "\r\n") {
+		body += "\r\n"
+	}
+	disposition := "inline"
+	if p.Filename != "" {
+		disposition = mime.FormatMediaType("inline", map[string]string{"filename": p.Filename + ".txt"})
+	}
+	return a, &mimeReplacement{
+		Fields: [][2]string{
+			{"Content-Type", "text/plain; charset=utf-8"},
+			{"Content-Transfer-Encoding", "8bit"},
+			{"Content-Disposition", disposition},
+		},
+		Body: []byte(body),
+	}, nil
+}
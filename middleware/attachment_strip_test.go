@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memAttachmentStore struct {
+	objects map[string][]byte
+	err     error
+}
+
+func (s *memAttachmentStore) Put(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	s.objects[key] = data
+	return "https://files.example.com/" + key, nil
+}
+
+func attachmentMessage(big []byte) string {
+	return "From: alice@example.org\r\n" +
+		"Subject: files\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"see attached\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(big) + "\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"setup.EXE\"\r\n" +
+		"\r\n" +
+		"MZ\r\n" +
+		"--inner\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Disposition: attachment; filename=\"logo.png\"\r\n" +
+		"\r\n" +
+		"png\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n" +
+		"epilogue\r\n"
+}
+
+func TestAttachmentStripper(t *testing.T) {
+	store := &memAttachmentStore{objects: make(map[string][]byte)}
+	s, err := NewAttachmentStripper(AttachmentStripperConfig{MaxSize: 100, Extensions: []string{"exe"}, Store: store})
+	require.NoError(t, err)
+	var stripped any
+	router := &brisa.Router{brisa.ChainData: {
+		{Handler: s.Handle},
+		{Handler: func(ctx *brisa.Context) brisa.Action {
+			stripped, _ = ctx.Get(StrippedAttachmentsKey)
+			return brisa.Pass
+		}},
+	}}
+
+	big := []byte(strings.Repeat("x", 200))
+	res := brisatest.Run(t, router, brisatest.DefaultEnvelope(), attachmentMessage(big))
+	res.AssertAction(t, brisa.Deliver)
+	msg := string(res.Message)
+
+	list, ok := stripped.([]StrippedAttachment)
+	require.True(t, ok)
+	require.Len(t, list, 2)
+	assert.Equal(t, "report.pdf", list[0].Filename)
+	assert.Equal(t, 200, list[0].Size)
+	assert.Equal(t, "https://files.example.com/"+list[0].SHA256+"/report.pdf", list[0].URL)
+	assert.Equal(t, big, store.objects[list[0].SHA256+"/report.pdf"])
+	assert.Equal(t, "setup.EXE", list[1].Filename)
+
+	assert.NotContains(t, msg, base64.StdEncoding.EncodeToString(big))
+	assert.NotContains(t, msg, "MZ\r\n")
+	assert.Contains(t, msg, "Content-Disposition: inline; filename=report.pdf.txt\r\n\r\n"+
+		"The attachment \"report.pdf\" (200 bytes) was removed from this message.\r\n"+
+		"Download it from: "+list[0].URL+"\r\n\r\n--outer\r\n")
+	// 其余部分保持原样
+	assert.True(t, strings.HasPrefix(msg, "From: alice@example.org\r\nSubject: files\r\n"))
+	assert.Contains(t, msg, "preamble\r\n--outer\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n--outer\r\n")
+	assert.Contains(t, msg, "filename=\"logo.png\"\r\n\r\npng\r\n--inner--\r\n--outer--\r\nepilogue\r\n")
+}
+
+func TestAttachmentStripper_NoStore(t *testing.T) {
+	s, err := NewAttachmentStripper(AttachmentStripperConfig{MaxSize: 2, Notice: "{{.Filename}} removed"})
+	require.NoError(t, err)
+	msg := "Subject: single\r\nContent-Type: application/zip\r\nContent-Disposition: attachment; filename=a.zip\r\n\r\nPK\x03\x04\r\n"
+	res := brisatest.Run(t, &brisa.Router{brisa.ChainData: {{Handler: s.Handle}}}, brisatest.DefaultEnvelope(), msg)
+	res.AssertAction(t, brisa.Deliver)
+	assert.Equal(t, "Subject: single\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n"+
+		"Content-Disposition: inline; filename=a.zip.txt\r\n\r\na.zip removed\r\n", string(res.Message))
+}
+
+func TestAttachmentStripper_StoreError(t *testing.T) {
+	store := &memAttachmentStore{err: errors.New("unavailable")}
+	s, err := NewAttachmentStripper(AttachmentStripperConfig{MaxSize: 100, Store: store})
+	require.NoError(t, err)
+	msg := attachmentMessage([]byte(strings.Repeat("x", 200)))
+	res := brisatest.Run(t, &brisa.Router{brisa.ChainData: {{Handler: s.Handle}}}, brisatest.DefaultEnvelope(), msg)
+	res.AssertAction(t, brisa.Deliver)
+	// 无法保存的附件保留在邮件中
+	assert.Equal(t, msg, string(res.Message))
+}
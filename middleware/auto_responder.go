@@ -0,0 +1,311 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+const (
+	// DefaultAutoResponderKeyPrefix is the default prefix of the Store keys
+	// written by AutoResponder.
+	DefaultAutoResponderKeyPrefix = "autoreply:"
+	// DefaultAutoReplyInterval is the default time during which a sender gets
+	// no second reply from the same address.
+	DefaultAutoReplyInterval = 24 * time.Hour
+	// DefaultAutoReplyTimeout is the default timeout of sending a reply.
+	DefaultAutoReplyTimeout = 10 * time.Second
+	// DefaultAutoReplySubject is the default subject template of a reply.
+	DefaultAutoReplySubject = "Auto: {{.Subject}}"
+)
+
+// AutoReplySender sends a reply message with the envelope sender from to to,
+// e.g. through an SMTPPool or a local submission service.
+type AutoReplySender func(ctx context.Context, from, to string, msg []byte) error
+
+// AutoResponse is the reply to messages for the recipients matching Pattern.
+type AutoResponse struct {
+	// Pattern matches recipients: an address, "@domain" for a whole domain,
+	// or a path.Match pattern such as "*-unattended@example.com". It is
+	// matched ignoring case.
+	Pattern string
+	// From is the From address of the reply. Defaults to the recipient.
+	From string
+	// Subject is a text/template executed with an AutoReplyData. Defaults to
+	// DefaultAutoReplySubject.
+	Subject string
+	// Body is a text/template executed with an AutoReplyData. It is required.
+	Body string
+}
+
+// AutoReplyData is the data the templates of an AutoResponse are executed
+// with.
+type AutoReplyData struct {
+	// Sender is the envelope sender of the message, who receives the reply.
+	Sender string
+	// Recipient is the recipient that matched the pattern.
+	Recipient string
+	// Subject and MessageID are those of the message.
+	Subject   string
+	MessageID string
+}
+
+// AutoResponderConfig configures the AutoResponder middleware.
+type AutoResponderConfig struct {
+	// Responses are tried in order; the first matching one is used. At least
+	// one is required.
+	Responses []AutoResponse
+	// Send sends the replies. It is required.
+	Send AutoReplySender
+	// Store remembers the replies sent for rate limiting. It is required.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to
+	// DefaultAutoResponderKeyPrefix.
+	KeyPrefix string
+	// Interval defaults to DefaultAutoReplyInterval.
+	Interval time.Duration
+	// Timeout defaults to DefaultAutoReplyTimeout.
+	Timeout time.Duration
+	// Clock defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// AutoResponder replies to messages for matching recipients with a templated
+// message, e.g. "this address is unattended". Following RFC 3834, it does not
+// reply to bounces, automatic messages, mailing lists or mailer addresses, sends
+// replies with a null envelope sender marked "Auto-Submitted: auto-replied",
+// and replies to a sender at most once per Interval for each recipient.
+//
+// It is meant for the Deliver chain, so that only accepted messages get a
+// reply. Replies are sent synchronously; failures are logged.
+type AutoResponder struct {
+	cfg       AutoResponderConfig
+	responses []autoResponse
+}
+
+type autoResponse struct {
+	pattern string
+	from    string
+	subject *template.Template
+	body    *template.Template
+}
+
+// NewAutoResponder creates a new AutoResponder instance.
+func NewAutoResponder(cfg AutoResponderConfig) (*AutoResponder, error) {
+	if len(cfg.Responses) == 0 {
+		return nil, fmt.Errorf("auto responder needs at least one response")
+	}
+	if cfg.Send == nil || cfg.Store == nil {
+		return nil, fmt.Errorf("auto responder sender and store are required")
+	}
+	if cfg.Interval < 0 || cfg.Timeout < 0 {
+		return nil, fmt.Errorf("auto responder settings must not be negative")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultAutoResponderKeyPrefix
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultAutoReplyInterval
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultAutoReplyTimeout
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+
+	a := &AutoResponder{cfg: cfg}
+	for i, r := range cfg.Responses {
+		pattern := r.Pattern
+		if strings.HasPrefix(pattern, "@") {
+			pattern = "*" + pattern
+		}
+		pattern = strings.ToLower(address.Normalize(pattern))
+		if _, err := path.Match(pattern, ""); err != nil || r.Pattern == "" {
+			return nil, fmt.Errorf("response %d: invalid pattern %q", i, r.Pattern)
+		}
+		if r.Body == "" {
+			return nil, fmt.Errorf("response %d: body is required", i)
+		}
+		if r.Subject == "" {
+			r.Subject = DefaultAutoReplySubject
+		}
+		subject, err := template.New("subject").Option("missingkey=error").Parse(r.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("response %d: %w", i, err)
+		}
+		body, err := template.New("body").Option("missingkey=error").Parse(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("response %d: %w", i, err)
+		}
+		a.responses = append(a.responses, autoResponse{pattern: pattern, from: r.From, subject: subject, body: body})
+	}
+	return a, nil
+}
+
+// NewAutoResponderHandler creates a new Deliver middleware handler sending
+// automatic replies.
+func NewAutoResponderHandler(cfg AutoResponderConfig) (brisa.Handler, error) {
+	a, err := NewAutoResponder(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return a.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (a *AutoResponder) Handle(ctx *brisa.Context) brisa.Action {
+	if ctx.From == "" || mailerAddress(ctx.From) {
+		return ctx.Action
+	}
+	var h *messageHeader
+	for _, rcpt := range ctx.To {
+		r := a.match(rcpt)
+		if r == nil || address.Equal(rcpt, ctx.From) {
+			continue
+		}
+		if h == nil {
+			var body io.Reader
+			var err error
+			h, body, err = readMessageHeader(ctx)
+			if err != nil {
+				ctx.Logger.Error("failed to read message header", "error", err)
+				return ctx.Action
+			}
+			setMessage(ctx, h, body)
+			if reason := automaticMessage(h); reason != "" {
+				ctx.Logger.Debug("no auto reply to automatic message", "reason", reason)
+				return ctx.Action
+			}
+		}
+		a.reply(ctx, r, rcpt, h)
+	}
+	return ctx.Action
+}
+
+// match returns the response for rcpt, or nil if none matches.
+func (a *AutoResponder) match(rcpt string) *autoResponse {
+	key := address.Key(rcpt)
+	for i := range a.responses {
+		if ok, _ := path.Match(a.responses[i].pattern, key); ok {
+			return &a.responses[i]
+		}
+	}
+	return nil
+}
+
+// reply sends the reply of r for the message to rcpt, unless the sender got
+// one within the interval.
+func (a *AutoResponder) reply(ctx *brisa.Context, r *autoResponse, rcpt string, h *messageHeader) {
+	key := a.cfg.KeyPrefix + address.Key(rcpt) + "|" + address.Key(ctx.From)
+	n, err := a.cfg.Store.Incr(key, 1, a.cfg.Interval)
+	if err != nil {
+		// Without the Store, loops cannot be ruled out: better no reply.
+		ctx.Logger.Error("failed to check auto reply rate", "error", err)
+		return
+	}
+	if n > 1 {
+		ctx.Logger.Debug("auto reply rate limited", "rcpt", rcpt, "sender", ctx.From)
+		return
+	}
+
+	data := AutoReplyData{Sender: ctx.From, Recipient: rcpt, Subject: h.Get("Subject"), MessageID: strings.TrimSpace(h.Get("Message-ID"))}
+	msg, err := a.compose(r, data)
+	if err != nil {
+		ctx.Logger.Error("failed to compose auto reply", "rcpt", rcpt, "error", err)
+		return
+	}
+	sendCtx, cancel := context.WithTimeout(context.Background(), a.cfg.Timeout)
+	defer cancel()
+	if err := a.cfg.Send(sendCtx, "", ctx.From, msg); err != nil {
+		ctx.Logger.Error("failed to send auto reply", "rcpt", rcpt, "sender", ctx.From, "error", err)
+		return
+	}
+	ctx.Logger.Info("auto reply sent", "rcpt", rcpt, "sender", ctx.From)
+}
+
+// compose writes the reply message.
+func (a *AutoResponder) compose(r *autoResponse, data AutoReplyData) ([]byte, error) {
+	var subject, body bytes.Buffer
+	if err := r.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := r.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	from := r.from
+	if from == "" {
+		from = data.Recipient
+	}
+	domain := address.Domain(from)
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	h := &messageHeader{}
+	h.Add("From", from)
+	h.Add("To", data.Sender)
+	h.Add("Subject", subject.String())
+	h.Add("Date", a.cfg.Clock.Now().Format(time.RFC1123Z))
+	h.Add("Message-ID", "<"+rand.Text()+"@"+domain+">")
+	if data.MessageID != "" {
+		h.Add("In-Reply-To", data.MessageID)
+		h.Add("References", data.MessageID)
+	}
+	h.Add("Auto-Submitted", "auto-replied")
+	h.Add("MIME-Version", "1.0")
+	h.Add("Content-Type", "text/plain; charset=utf-8")
+	h.Add("Content-Transfer-Encoding", "8bit")
+
+	var msg bytes.Buffer
+	msg.Write(h.Bytes())
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+	if !bytes.HasSuffix(msg.Bytes(), []byte("\r\n")) {
+		msg.WriteString("\r\n")
+	}
+	return msg.Bytes(), nil
+}
+
+// automaticMessage returns why a message must not be replied to, or "".
+func automaticMessage(h *messageHeader) string {
+	if v := strings.ToLower(strings.TrimSpace(h.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return "auto-submitted"
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "precedence"
+	}
+	if h.Has("List-Id") || h.Has("List-Unsubscribe") {
+		return "mailing list"
+	}
+	for _, v := range h.Values("X-Auto-Response-Suppress") {
+		for _, s := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(s)) {
+			case "all", "autoreply", "oof":
+				return "suppressed"
+			}
+		}
+	}
+	return ""
+}
+
+// mailerAddress reports whether an address belongs to software rather than a
+// person, such as MAILER-DAEMON or a list's owner- or -request address.
+func mailerAddress(addr string) bool {
+	local := strings.ToLower(address.LocalPart(addr))
+	switch local {
+	case "mailer-daemon", "postmaster", "listserv", "majordomo", "noreply", "no-reply", "donotreply", "do-not-reply":
+		return true
+	}
+	return strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") ||
+		strings.HasPrefix(local, "bounce")
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sentReply struct {
+	from, to string
+	msg      *mail.Message
+	body     string
+}
+
+func newTestAutoResponder(t *testing.T, clock brisa.Clock) (*AutoResponder, *[]sentReply) {
+	t.Helper()
+	var sent []sentReply
+	a, err := NewAutoResponder(AutoResponderConfig{
+		Responses: []AutoResponse{
+			{Pattern: "info@example.com", From: "Example Support <support@example.com>", Body: "Hello {{.Sender}},\nthis address is unattended.\n"},
+			{Pattern: "*-noreply@example.com", Subject: "Unattended: {{.Subject}}", Body: "Nobody reads {{.Recipient}}."},
+		},
+		Send: func(ctx context.Context, from, to string, msg []byte) error {
+			m, err := mail.ReadMessage(strings.NewReader(string(msg)))
+			require.NoError(t, err)
+			body := make([]byte, 1024)
+			n, _ := m.Body.Read(body)
+			sent = append(sent, sentReply{from: from, to: to, msg: m, body: string(body[:n])})
+			return nil
+		},
+		Store: brisa.NewMemoryStoreWithClock(clock),
+		Clock: clock,
+	})
+	require.NoError(t, err)
+	return a, &sent
+}
+
+func TestNewAutoResponder(t *testing.T) {
+	send := func(context.Context, string, string, []byte) error { return nil }
+	for _, cfg := range []AutoResponderConfig{
+		{Send: send, Store: brisa.NewMemoryStore()},
+		{Responses: []AutoResponse{{Pattern: "a@example.com", Body: "x"}}},
+		{Responses: []AutoResponse{{Pattern: "[a@example.com", Body: "x"}}, Send: send, Store: brisa.NewMemoryStore()},
+		{Responses: []AutoResponse{{Pattern: "a@example.com"}}, Send: send, Store: brisa.NewMemoryStore()},
+		{Responses: []AutoResponse{{Pattern: "a@example.com", Body: "{{.Nope"}}, Send: send, Store: brisa.NewMemoryStore()},
+	} {
+		_, err := NewAutoResponder(cfg)
+		assert.Error(t, err)
+	}
+}
+
+func TestAutoResponder(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	a, sent := newTestAutoResponder(t, clock)
+	router := &brisa.Router{brisa.ChainDeliver: {{Handler: a.Handle}}}
+	msg := "Subject: Question\r\nMessage-ID: <q1@example.org>\r\n\r\nhi\r\n"
+
+	env := brisatest.DefaultEnvelope()
+	env.From = "alice@example.org"
+	env.To = []string{"INFO@example.com", "bob@example.com", "sales-noreply@example.com"}
+	res := brisatest.Run(t, router, env, msg)
+	res.AssertAction(t, brisa.Deliver)
+	assert.Equal(t, msg, string(res.Message))
+	require.Len(t, *sent, 2)
+
+	r := (*sent)[0]
+	assert.Equal(t, "", r.from)
+	assert.Equal(t, "alice@example.org", r.to)
+	assert.Equal(t, "Example Support <support@example.com>", r.msg.Header.Get("From"))
+	assert.Equal(t, "Auto: Question", r.msg.Header.Get("Subject"))
+	assert.Equal(t, "auto-replied", r.msg.Header.Get("Auto-Submitted"))
+	assert.Equal(t, "<q1@example.org>", r.msg.Header.Get("In-Reply-To"))
+	assert.Equal(t, "Hello alice@example.org,\r\nthis address is unattended.\r\n", r.body)
+	assert.Equal(t, "Unattended: Question", (*sent)[1].msg.Header.Get("Subject"))
+	assert.Equal(t, "Nobody reads sales-noreply@example.com.\r\n", (*sent)[1].body)
+
+	// 同一发件人在间隔内只收到一次回复
+	*sent = nil
+	brisatest.Run(t, router, env, msg)
+	assert.Empty(t, *sent)
+	clock.Advance(DefaultAutoReplyInterval)
+	brisatest.Run(t, router, env, msg)
+	assert.Len(t, *sent, 2)
+}
+
+func TestAutoResponder_LoopProtection(t *testing.T) {
+	a, sent := newTestAutoResponder(t, brisa.SystemClock)
+	router := &brisa.Router{brisa.ChainDeliver: {{Handler: a.Handle}}}
+
+	tests := []struct {
+		name, from, msg string
+	}{
+		{"null sender", "", "Subject: x\r\n\r\n"},
+		{"mailer daemon", "MAILER-DAEMON@example.org", "Subject: x\r\n\r\n"},
+		{"list request", "users-request@lists.example.org", "Subject: x\r\n\r\n"},
+		{"auto submitted", "alice@example.org", "Auto-Submitted: auto-replied\r\n\r\n"},
+		{"bulk", "alice@example.org", "Precedence: bulk\r\n\r\n"},
+		{"list", "alice@example.org", "List-Id: <users.lists.example.org>\r\n\r\n"},
+		{"suppressed", "alice@example.org", "X-Auto-Response-Suppress: DR, AutoReply\r\n\r\n"},
+		{"self", "info@example.com", "Subject: x\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		env := brisatest.DefaultEnvelope()
+		env.From = tt.from
+		env.To = []string{"info@example.com"}
+		brisatest.Run(t, router, env, tt.msg).AssertAction(t, brisa.Deliver)
+		assert.Empty(t, *sent, tt.name)
+	}
+
+	// "Auto-Submitted: no" 是人工发送的邮件
+	env := brisatest.DefaultEnvelope()
+	env.To = []string{"info@example.com"}
+	brisatest.Run(t, router, env, "Auto-Submitted: no\r\n\r\n")
+	assert.Len(t, *sent, 1)
+}
+
+func TestAutoResponder_SendError(t *testing.T) {
+	a, err := NewAutoResponder(AutoResponderConfig{
+		Responses: []AutoResponse{{Pattern: "@example.com", Body: "unattended"}},
+		Send:      func(context.Context, string, string, []byte) error { return errors.New("down") },
+		Store:     brisa.NewMemoryStore(),
+	})
+	require.NoError(t, err)
+	res := brisatest.Run(t, &brisa.Router{brisa.ChainDeliver: {{Handler: a.Handle}}}, brisatest.DefaultEnvelope(), "\r\n")
+	res.AssertAction(t, brisa.Deliver)
+}
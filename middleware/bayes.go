@@ -0,0 +1,286 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultBayesKeyPrefix is the default prefix of the Store keys used by Bayes.
+	DefaultBayesKeyPrefix = "bayes:"
+	// DefaultBayesMinTrained is the default number of spam and of ham messages
+	// that must have been trained before messages are classified.
+	DefaultBayesMinTrained = 20
+	// DefaultBayesWeight is the default maximum score contribution.
+	DefaultBayesWeight = 5.0
+	// DefaultBayesMaxBytes is the default number of message bytes tokenized.
+	DefaultBayesMaxBytes = 256 * 1024
+)
+
+// BayesProbabilityKey is the context key holding the spam probability (float64)
+// computed by the Bayes middleware.
+const BayesProbabilityKey = "bayes.probability"
+
+const (
+	bayesStrength         = 1.0 // Robinson's s: confidence given to the 0.5 prior
+	bayesInterestingCount = 15  // number of most significant tokens combined
+	bayesMinTokenLen      = 3
+	bayesMaxTokenLen      = 24
+)
+
+// BayesConfig configures the Bayes middleware.
+type BayesConfig struct {
+	// Store holds the model. It is required.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultBayesKeyPrefix.
+	KeyPrefix string
+	// SpamAddress and HamAddress are optional training addresses: mail sent to
+	// them is discarded and learned as spam or ham respectively once it is
+	// accepted, outside the transaction (see brisa.Context.AfterAccept).
+	SpamAddress string
+	HamAddress  string
+	// MinTrained is the number of spam and of ham messages required before
+	// classifying. Defaults to DefaultBayesMinTrained.
+	MinTrained int64
+	// Weight is the score added for a certain spam. A certain ham subtracts the
+	// same amount and an undecided message adds nothing. Defaults to DefaultBayesWeight.
+	Weight float64
+	// MaxBytes is the number of leading message bytes tokenized.
+	// Defaults to DefaultBayesMaxBytes.
+	MaxBytes int64
+}
+
+// Bayes is a naive Bayes spam classifier. Tokens are hashed before they are
+// stored, so the model has a fixed key size and does not keep message text.
+type Bayes struct {
+	cfg BayesConfig
+}
+
+// NewBayes creates a new Bayes classifier.
+func NewBayes(cfg BayesConfig) (*Bayes, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("bayes store is required")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultBayesKeyPrefix
+	}
+	if cfg.MinTrained <= 0 {
+		cfg.MinTrained = DefaultBayesMinTrained
+	}
+	if cfg.Weight == 0 {
+		cfg.Weight = DefaultBayesWeight
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultBayesMaxBytes
+	}
+	return &Bayes{cfg: cfg}, nil
+}
+
+// NewBayesHandler creates a new Data middleware handler that classifies mail
+// and handles the training addresses.
+func NewBayesHandler(cfg BayesConfig) (brisa.Handler, error) {
+	b, err := NewBayes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return b.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+// Mail to a training address is discarded and learned after it is accepted;
+// any other mail is classified and its score adjusted.
+func (b *Bayes) Handle(ctx *brisa.Context) brisa.Action {
+	data, err := readMessagePrefix(ctx, b.cfg.MaxBytes)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return brisa.Pass
+	}
+
+	if spam, ok := b.trainingTarget(ctx.To); ok {
+		ctx.AfterAccept("bayes_training", func(tx *brisa.Transaction) {
+			if err := b.Train(bytes.NewReader(data), spam); err != nil {
+				tx.Logger.Error("bayes training failed", "error", err)
+				return
+			}
+			tx.Logger.Info("bayes model trained", "spam", spam)
+		})
+		return brisa.Discard
+	}
+
+	prob, ok, err := b.Classify(bytes.NewReader(data))
+	if err != nil {
+		ctx.Logger.Error("bayes classification failed", "error", err)
+		return brisa.Pass
+	}
+	if !ok {
+		ctx.Logger.Debug("bayes model not trained enough, skipping classification")
+		return brisa.Pass
+	}
+
+	ctx.Set(BayesProbabilityKey, prob)
+	ctx.Score += b.cfg.Weight * (2*prob - 1)
+	ctx.Logger.Debug("bayes classification", "probability", prob)
+	return brisa.Pass
+}
+
+// trainingTarget reports whether one of the recipients is a training address,
+// and if so whether it is the spam one.
+func (b *Bayes) trainingTarget(recipients []string) (spam bool, ok bool) {
+	for _, rcpt := range recipients {
+		switch {
+		case b.cfg.SpamAddress != "" && strings.EqualFold(rcpt, b.cfg.SpamAddress):
+			return true, true
+		case b.cfg.HamAddress != "" && strings.EqualFold(rcpt, b.cfg.HamAddress):
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// Train learns the message read from r as spam or ham. It is the entry point
+// for feedback from outside the SMTP path.
+func (b *Bayes) Train(r io.Reader, spam bool) error {
+	tokens, err := tokenizeMessage(io.LimitReader(r, b.cfg.MaxBytes))
+	if err != nil {
+		return err
+	}
+
+	class := b.classKey(spam)
+	for token := range tokens {
+		if _, err := b.cfg.Store.Incr(b.tokenKey(token, spam), 1, 0); err != nil {
+			return err
+		}
+	}
+	_, err = b.cfg.Store.Incr(class, 1, 0)
+	return err
+}
+
+// Classify returns the probability that the message read from r is spam.
+// ok is false if the model has not been trained with enough messages yet.
+func (b *Bayes) Classify(r io.Reader) (prob float64, ok bool, err error) {
+	nspam, err := b.count(b.classKey(true))
+	if err != nil {
+		return 0, false, err
+	}
+	nham, err := b.count(b.classKey(false))
+	if err != nil {
+		return 0, false, err
+	}
+	if nspam < b.cfg.MinTrained || nham < b.cfg.MinTrained {
+		return 0, false, nil
+	}
+
+	tokens, err := tokenizeMessage(io.LimitReader(r, b.cfg.MaxBytes))
+	if err != nil {
+		return 0, false, err
+	}
+
+	probs := make([]float64, 0, len(tokens))
+	for token := range tokens {
+		s, err := b.count(b.tokenKey(token, true))
+		if err != nil {
+			return 0, false, err
+		}
+		h, err := b.count(b.tokenKey(token, false))
+		if err != nil {
+			return 0, false, err
+		}
+		if s == 0 && h == 0 {
+			continue // never seen, carries no information
+		}
+
+		// Robinson's smoothed token probability.
+		spamRatio := float64(s) / float64(nspam)
+		hamRatio := float64(h) / float64(nham)
+		p := spamRatio / (spamRatio + hamRatio)
+		n := float64(s + h)
+		probs = append(probs, (bayesStrength*0.5+n*p)/(bayesStrength+n))
+	}
+
+	// Combine only the most significant tokens.
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > bayesInterestingCount {
+		probs = probs[:bayesInterestingCount]
+	}
+	if len(probs) == 0 {
+		return 0.5, true, nil
+	}
+
+	var logSpam, logHam float64
+	for _, p := range probs {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam)), true, nil
+}
+
+func (b *Bayes) classKey(spam bool) string {
+	if spam {
+		return b.cfg.KeyPrefix + "nspam"
+	}
+	return b.cfg.KeyPrefix + "nham"
+}
+
+func (b *Bayes) tokenKey(token uint64, spam bool) string {
+	class := "h"
+	if spam {
+		class = "s"
+	}
+	return fmt.Sprintf("%s%s:%016x", b.cfg.KeyPrefix, class, token)
+}
+
+func (b *Bayes) count(key string) (int64, error) {
+	value, ok, err := b.cfg.Store.Get(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+// tokenizeMessage returns the set of hashed tokens of a message. Subject and
+// From tokens are kept apart from body tokens since they carry more weight.
+func tokenizeMessage(r io.Reader) (map[uint64]struct{}, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[uint64]struct{})
+	addTokens(tokens, "subject:", h.Get("Subject"))
+	addTokens(tokens, "from:", h.Get("From"))
+
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	addTokens(tokens, "", string(body))
+	return tokens, nil
+}
+
+func addTokens(tokens map[uint64]struct{}, prefix, text string) {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '!' && r != '\'' && r != '-'
+	})
+	for _, word := range words {
+		if n := len(word); n < bayesMinTokenLen || n > bayesMaxTokenLen {
+			continue
+		}
+		hash := fnv.New64a()
+		hash.Write([]byte(prefix))
+		hash.Write([]byte(strings.ToLower(word)))
+		tokens[hash.Sum64()] = struct{}{}
+	}
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func trainTestBayes(t *testing.T, b *Bayes, n int) {
+	for i := 0; i < n; i++ {
+		spam := fmt.Sprintf("Subject: cheap pills %d\r\n\r\nBuy cheap viagra pills now!!! Limited offer, click here.\r\n", i)
+		ham := fmt.Sprintf("Subject: meeting notes %d\r\n\r\nHi team, attached are the notes from the project meeting.\r\n", i)
+		require.NoError(t, b.Train(strings.NewReader(spam), true))
+		require.NoError(t, b.Train(strings.NewReader(ham), false))
+	}
+}
+
+func TestBayes_Classify(t *testing.T) {
+	b, err := NewBayes(BayesConfig{Store: brisa.NewMemoryStore(), MinTrained: 5})
+	require.NoError(t, err)
+
+	t.Run("not enough training", func(t *testing.T) {
+		_, ok, err := b.Classify(strings.NewReader("Subject: hi\r\n\r\nhello\r\n"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	trainTestBayes(t, b, 5)
+
+	t.Run("spam", func(t *testing.T) {
+		prob, ok, err := b.Classify(strings.NewReader("Subject: cheap offer\r\n\r\nclick here for cheap pills\r\n"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Greater(t, prob, 0.9)
+	})
+
+	t.Run("ham", func(t *testing.T) {
+		prob, ok, err := b.Classify(strings.NewReader("Subject: project\r\n\r\nnotes from the team meeting\r\n"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Less(t, prob, 0.1)
+	})
+
+	t.Run("unknown tokens", func(t *testing.T) {
+		prob, ok, err := b.Classify(strings.NewReader("Subject: zzz\r\n\r\nqqq xxx\r\n"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 0.5, prob)
+	})
+}
+
+func TestBayes_Handle(t *testing.T) {
+	store := brisa.NewMemoryStore()
+	b, err := NewBayes(BayesConfig{
+		Store:       store,
+		MinTrained:  1,
+		SpamAddress: "spam@example.com",
+		HamAddress:  "ham@example.com",
+	})
+	require.NoError(t, err)
+
+	t.Run("training address", func(t *testing.T) {
+		router := &brisa.Router{brisa.ChainData: {{Handler: b.Handle}}}
+		env := brisatest.DefaultEnvelope()
+		env.To = []string{"Spam@example.com"}
+		brisatest.Run(t, router, env, "Subject: cheap pills\r\n\r\nbuy cheap pills\r\n").AssertAction(t, brisa.Discard)
+
+		env.To = []string{"ham@example.com"}
+		brisatest.Run(t, router, env, "Subject: meeting\r\n\r\nproject meeting notes\r\n").AssertAction(t, brisa.Discard)
+
+		nspam, _ := b.count(b.classKey(true))
+		nham, _ := b.count(b.classKey(false))
+		assert.Equal(t, int64(1), nspam)
+		assert.Equal(t, int64(1), nham)
+	})
+
+	t.Run("classification adds to score", func(t *testing.T) {
+		message := "Subject: cheap pills\r\n\r\nbuy cheap pills\r\n"
+		ctx := newTestContext(t, message)
+		ctx.To = []string{"user@example.com"}
+
+		assert.Equal(t, brisa.Pass, b.Handle(ctx))
+		prob, ok := ctx.Get(BayesProbabilityKey)
+		require.True(t, ok)
+		assert.Greater(t, prob, 0.5)
+		assert.Greater(t, ctx.Score, 0.0)
+		assert.Equal(t, message, readTestMessage(t, ctx))
+	})
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// BotFingerprintMatchesKey is the context key holding the names ([]string) of
+// the rules a session fingerprint matched.
+const BotFingerprintMatchesKey = "fingerprint.matches"
+
+// ErrBotFingerprint is returned to clients matching a rejecting rule.
+var ErrBotFingerprint = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Client software not accepted",
+}
+
+// FingerprintRule describes the fingerprint of known bad client software; see
+// brisa.Fingerprint. A fingerprint matches a rule if it matches all of its
+// conditions.
+type FingerprintRule struct {
+	// Name identifies the rule in logs and under BotFingerprintMatchesKey.
+	Name string
+	// TLS are JA3 hashes of the TLS stacks of the software.
+	TLS []string
+	// Commands is a regular expression matched against the commands of the
+	// session joined by spaces, e.g. "^(RSET )+MAIL".
+	Commands string
+	// NoExtensions matches clients that used no ESMTP parameter.
+	NoExtensions bool
+	// NoSTARTTLS matches clients that did not upgrade to TLS with STARTTLS,
+	// including all clients of implicit TLS listeners.
+	NoSTARTTLS bool
+	// MaxDelay matches clients sending every command sooner than MaxDelay
+	// after the previous one, faster than a server waiting for the replies.
+	MaxDelay time.Duration
+	// Score is added to the message of matching clients. Clients matching a
+	// rule without a score are rejected.
+	Score float64
+
+	commands *regexp.Regexp
+}
+
+// BotFingerprintConfig configures the BotFingerprint middleware.
+type BotFingerprintConfig struct {
+	Rules []FingerprintRule
+	// Reply defaults to ErrBotFingerprint.
+	Reply *smtp.SMTPError
+}
+
+// BotFingerprint matches the fingerprints of sessions against those of known
+// spambots and other unwanted client software, which reveal themselves by how
+// they speak SMTP whatever address they connect from.
+//
+// It runs in any chain from MAIL FROM; in the Data chain, the fingerprint
+// covers the whole transaction. Scores only count there, as they are reset
+// for every transaction. Matches are logged and recorded under
+// BotFingerprintMatchesKey.
+type BotFingerprint struct {
+	cfg BotFingerprintConfig
+}
+
+// NewBotFingerprint creates a new BotFingerprint instance.
+func NewBotFingerprint(cfg BotFingerprintConfig) (*BotFingerprint, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("bot fingerprint needs at least one rule")
+	}
+	cfg.Rules = slices.Clone(cfg.Rules)
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if r.Name == "" {
+			return nil, fmt.Errorf("bot fingerprint rule %d has no name", i)
+		}
+		if len(r.TLS) == 0 && r.Commands == "" && !r.NoExtensions && !r.NoSTARTTLS && r.MaxDelay <= 0 {
+			return nil, fmt.Errorf("bot fingerprint rule %q has no condition", r.Name)
+		}
+		if r.Score < 0 || r.MaxDelay < 0 {
+			return nil, fmt.Errorf("bot fingerprint rule %q: score and max delay must not be negative", r.Name)
+		}
+		if r.Commands != "" {
+			re, err := regexp.Compile(r.Commands)
+			if err != nil {
+				return nil, fmt.Errorf("bot fingerprint rule %q: %w", r.Name, err)
+			}
+			r.commands = re
+		}
+	}
+	if cfg.Reply == nil {
+		cfg.Reply = ErrBotFingerprint
+	}
+	return &BotFingerprint{cfg: cfg}, nil
+}
+
+// NewBotFingerprintHandler creates a new middleware handler matching session
+// fingerprints against rules.
+func NewBotFingerprintHandler(cfg BotFingerprintConfig) (brisa.Handler, error) {
+	b, err := NewBotFingerprint(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return b.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (b *BotFingerprint) Handle(ctx *brisa.Context) brisa.Action {
+	fp := ctx.Fingerprint()
+	var matches []string
+	reject := false
+	for i := range b.cfg.Rules {
+		r := &b.cfg.Rules[i]
+		if !r.match(&fp) {
+			continue
+		}
+		matches = append(matches, r.Name)
+		if r.Score == 0 {
+			reject = true
+		}
+		ctx.Score += r.Score
+	}
+	if len(matches) == 0 {
+		return brisa.Pass
+	}
+	ctx.Set(BotFingerprintMatchesKey, matches)
+	ctx.Logger.Info("bot fingerprint matched", "rules", matches, "fingerprint", fp.String())
+	if reject {
+		return ctx.RejectWith(b.cfg.Reply)
+	}
+	return brisa.Pass
+}
+
+// match reports whether fp matches all conditions of the rule.
+func (r *FingerprintRule) match(fp *brisa.Fingerprint) bool {
+	if len(r.TLS) > 0 && !slices.Contains(r.TLS, fp.TLS) {
+		return false
+	}
+	if r.commands != nil && !r.commands.MatchString(strings.Join(fp.Commands, " ")) {
+		return false
+	}
+	if r.NoExtensions && len(fp.Extensions) > 0 {
+		return false
+	}
+	if r.NoSTARTTLS && fp.STARTTLS {
+		return false
+	}
+	if r.MaxDelay > 0 && (len(fp.Delays) == 0 || slices.Max(fp.Delays) >= r.MaxDelay) {
+		return false
+	}
+	return true
+}
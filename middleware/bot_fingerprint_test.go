@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBotFingerprint(t *testing.T) {
+	b, err := NewBotFingerprint(BotFingerprintConfig{Rules: []FingerprintRule{
+		{Name: "ratware", TLS: []string{"bad"}},
+		{Name: "blaster", Commands: "^MAIL (RCPT ){2,}DATA$", NoExtensions: true, MaxDelay: time.Minute, Score: 2},
+		{Name: "plain", NoSTARTTLS: true, Score: 1},
+	}})
+	require.NoError(t, err)
+	var matches any
+	router := &brisa.Router{brisa.ChainData: {
+		{Handler: b.Handle},
+		{Handler: func(ctx *brisa.Context) brisa.Action {
+			matches, _ = ctx.Get(BotFingerprintMatchesKey)
+			return brisa.Pass
+		}},
+	}}
+
+	env := brisatest.DefaultEnvelope()
+	env.TLS, env.TLSFingerprint = true, "good"
+	res := brisatest.Run(t, router, env, "\r\nbody\r\n")
+	res.AssertAction(t, brisa.Deliver)
+	assert.Zero(t, res.Score)
+	assert.Nil(t, matches)
+
+	env.To = []string{"a@example.com", "b@example.com"}
+	res = brisatest.Run(t, router, env, "\r\nbody\r\n")
+	res.AssertAction(t, brisa.Deliver)
+	assert.Equal(t, 2.0, res.Score)
+	assert.Equal(t, []string{"blaster"}, matches)
+
+	env.TLS = false
+	res = brisatest.Run(t, router, env, "\r\nbody\r\n")
+	assert.Equal(t, 3.0, res.Score)
+
+	env.TLS, env.TLSFingerprint = true, "bad"
+	res = brisatest.Run(t, router, env, "\r\nbody\r\n")
+	res.AssertAction(t, brisa.Reject)
+	assert.Equal(t, ErrBotFingerprint, res.Err)
+}
+
+func TestBotFingerprint_Config(t *testing.T) {
+	for name, rules := range map[string][]FingerprintRule{
+		"no rules":     nil,
+		"no name":      {{TLS: []string{"x"}}},
+		"no condition": {{Name: "empty", Score: 1}},
+		"bad regexp":   {{Name: "re", Commands: "("}},
+		"negative":     {{Name: "neg", NoSTARTTLS: true, Score: -1}},
+	} {
+		_, err := NewBotFingerprint(BotFingerprintConfig{Rules: rules})
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+const (
+	// DefaultBouncePolicyKeyPrefix is the default prefix of the Store keys
+	// written by BouncePolicy.
+	DefaultBouncePolicyKeyPrefix = "bounce:"
+	// DefaultNullSenderWindow is the default window null-sender messages are
+	// counted in.
+	DefaultNullSenderWindow = time.Hour
+	// DefaultOutboundSenderTTL is the default time an outbound sender is
+	// remembered as a valid bounce target.
+	DefaultOutboundSenderTTL = 7 * 24 * time.Hour
+	// DefaultBounceViolationScore is the default score added to a message
+	// for a violation.
+	DefaultBounceViolationScore = 5.0
+	// DefaultBounceReputationPenalty is the default reputation a client IP
+	// loses for a violation.
+	DefaultBounceReputationPenalty = 1
+	// DefaultBounceReputationTTL is the default time a lowered reputation is
+	// kept after its first violation.
+	DefaultBounceReputationTTL = 24 * time.Hour
+)
+
+var (
+	// ErrTooManyBounces is returned for MAIL FROM:<> from a client IP that
+	// sent too many null-sender messages.
+	ErrTooManyBounces = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Too many bounces, please try again later",
+	}
+	// ErrUnsolicitedBounce is returned for a bounce to an address that has
+	// not sent mail recently, typical of backscatter.
+	ErrUnsolicitedBounce = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Bounce to an address that sent no mail",
+	}
+)
+
+// BouncePolicyConfig configures the BouncePolicy middleware.
+type BouncePolicyConfig struct {
+	// Store holds the counters, the outbound senders and the reputations. It
+	// is required.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultBouncePolicyKeyPrefix.
+	KeyPrefix string
+	// NullSenderLimit, if positive, is the number of null-sender messages a
+	// client IP may send per NullSenderWindow, which defaults to
+	// DefaultNullSenderWindow.
+	NullSenderLimit  int64
+	NullSenderWindow time.Duration
+	// VerifyRecipients checks that bounces go to addresses recorded by
+	// HandleOutbound within OutboundSenderTTL, which defaults to
+	// DefaultOutboundSenderTTL.
+	VerifyRecipients  bool
+	OutboundSenderTTL time.Duration
+	// RejectUnsolicited refuses bounces to unverified recipients with
+	// ErrUnsolicitedBounce instead of only scoring them.
+	RejectUnsolicited bool
+	// Score is added to the message for each violation. Defaults to
+	// DefaultBounceViolationScore.
+	Score float64
+	// Penalty is subtracted from the reputation of the client IP for each
+	// violation; the reputation recovers after ReputationTTL. Default to
+	// DefaultBounceReputationPenalty and DefaultBounceReputationTTL.
+	Penalty       int64
+	ReputationTTL time.Duration
+}
+
+// BouncePolicy controls bounce traffic, messages with the null sender
+// MAIL FROM:<>: HandleMailFrom, in the mail_from chain, limits them per
+// client IP; HandleRcptTo, in the rcpt_to chain, checks that they go to
+// addresses that recently sent mail, which HandleOutbound records in the
+// deliver chain of outgoing mail. Violations add to the message score and
+// lower the reputation of the client IP, published as brisa.ReputationChanged
+// events.
+type BouncePolicy struct {
+	cfg BouncePolicyConfig
+}
+
+// NewBouncePolicy creates a new BouncePolicy instance.
+func NewBouncePolicy(cfg BouncePolicyConfig) (*BouncePolicy, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("bounce policy store is required")
+	}
+	if cfg.NullSenderLimit < 0 || cfg.NullSenderWindow < 0 || cfg.OutboundSenderTTL < 0 ||
+		cfg.Score < 0 || cfg.Penalty < 0 || cfg.ReputationTTL < 0 {
+		return nil, fmt.Errorf("bounce policy settings must not be negative")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultBouncePolicyKeyPrefix
+	}
+	if cfg.NullSenderWindow == 0 {
+		cfg.NullSenderWindow = DefaultNullSenderWindow
+	}
+	if cfg.OutboundSenderTTL == 0 {
+		cfg.OutboundSenderTTL = DefaultOutboundSenderTTL
+	}
+	if cfg.Score == 0 {
+		cfg.Score = DefaultBounceViolationScore
+	}
+	if cfg.Penalty == 0 {
+		cfg.Penalty = DefaultBounceReputationPenalty
+	}
+	if cfg.ReputationTTL == 0 {
+		cfg.ReputationTTL = DefaultBounceReputationTTL
+	}
+	return &BouncePolicy{cfg: cfg}, nil
+}
+
+// HandleMailFrom is the brisa.Handler of the middleware for the mail_from
+// chain.
+func (p *BouncePolicy) HandleMailFrom(ctx *brisa.Context) brisa.Action {
+	if ctx.From != "" || p.cfg.NullSenderLimit == 0 {
+		return ctx.Action
+	}
+	ip := clientIP(ctx)
+	if ip == nil {
+		return ctx.Action
+	}
+	n, err := p.cfg.Store.Incr(p.cfg.KeyPrefix+"null:"+ip.String(), 1, p.cfg.NullSenderWindow)
+	if err != nil {
+		// Fail open: a broken Store must not stop mail flow.
+		ctx.Logger.Error("failed to count null-sender messages", "ip", ip, "error", err)
+		return ctx.Action
+	}
+	if n <= p.cfg.NullSenderLimit {
+		return ctx.Action
+	}
+	p.violation(ctx, "null-sender rate exceeded", "count", n, "limit", p.cfg.NullSenderLimit)
+	return ctx.RejectWith(ErrTooManyBounces)
+}
+
+// HandleRcptTo is the brisa.Handler of the middleware for the rcpt_to chain.
+// It checks the recipient added by the current RCPT TO command.
+func (p *BouncePolicy) HandleRcptTo(ctx *brisa.Context) brisa.Action {
+	if ctx.From != "" || !p.cfg.VerifyRecipients || len(ctx.To) == 0 {
+		return ctx.Action
+	}
+	rcpt := ctx.To[len(ctx.To)-1]
+	_, sent, err := p.cfg.Store.Get(p.sentKey(rcpt))
+	if err != nil {
+		ctx.Logger.Error("failed to look up outbound sender", "rcpt", rcpt, "error", err)
+		return ctx.Action
+	}
+	if sent {
+		return ctx.Action
+	}
+	p.violation(ctx, "bounce to an address that sent no mail", "rcpt", rcpt)
+	if p.cfg.RejectUnsolicited {
+		return ctx.RejectWith(ErrUnsolicitedBounce)
+	}
+	return ctx.Action
+}
+
+// HandleOutbound is the brisa.Handler of the middleware for the deliver
+// chain of outgoing mail, e.g. of the submission listener. It records the
+// sender as a valid bounce target.
+func (p *BouncePolicy) HandleOutbound(ctx *brisa.Context) brisa.Action {
+	if ctx.From == "" {
+		return ctx.Action
+	}
+	if err := p.cfg.Store.Set(p.sentKey(ctx.From), []byte{1}, p.cfg.OutboundSenderTTL); err != nil {
+		ctx.Logger.Error("failed to record outbound sender", "from", ctx.From, "error", err)
+	}
+	return ctx.Action
+}
+
+// Reputation returns the reputation of a client IP: zero, or negative after
+// violations.
+func (p *BouncePolicy) Reputation(ip string) (int64, error) {
+	return p.cfg.Store.Incr(p.cfg.KeyPrefix+"rep:"+ip, 0, p.cfg.ReputationTTL)
+}
+
+func (p *BouncePolicy) sentKey(addr string) string {
+	return p.cfg.KeyPrefix + "sent:" + address.Key(addr)
+}
+
+// violation scores a violation of the session's client.
+func (p *BouncePolicy) violation(ctx *brisa.Context, msg string, attrs ...any) {
+	ctx.Score += p.cfg.Score
+	ip := clientIP(ctx)
+	if ip == nil {
+		ctx.Logger.Warn(msg, attrs...)
+		return
+	}
+	ctx.Logger.Warn(msg, append(attrs, "ip", ip.String())...)
+	n, err := p.cfg.Store.Incr(p.cfg.KeyPrefix+"rep:"+ip.String(), -p.cfg.Penalty, p.cfg.ReputationTTL)
+	if err != nil {
+		ctx.Logger.Error("failed to lower reputation", "ip", ip, "error", err)
+		return
+	}
+	if ctx.Session != nil {
+		ctx.Session.Events().Publish(brisa.ReputationChanged{
+			Subject: ip.String(),
+			Old:     float64(n + p.cfg.Penalty),
+			New:     float64(n),
+		})
+	}
+}
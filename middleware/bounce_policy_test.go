@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBouncePolicyBrisa(t *testing.T, p *BouncePolicy) (*brisa.Brisa, *[]brisa.ReputationChanged) {
+	t.Helper()
+	router := brisa.Router{}
+	router.OnMailFrom(&brisa.Middleware{Handler: p.HandleMailFrom})
+	router.OnRcptTo(&brisa.Middleware{Handler: p.HandleRcptTo})
+	router.OnDeliver(&brisa.Middleware{Handler: p.HandleOutbound, Condition: func(ctx *brisa.Context) bool {
+		return ctx.HasFlag(brisa.FlagAuthenticated)
+	}})
+	b := brisatest.NewBrisa(&router)
+	var changes []brisa.ReputationChanged
+	brisa.Subscribe(b.Events(), func(e brisa.ReputationChanged) { changes = append(changes, e) })
+	return b, &changes
+}
+
+func bounceEnvelope(rcpt string) brisa.Envelope {
+	return brisatest.NewEnvelope("203.0.113.4", "", rcpt)
+}
+
+func TestNewBouncePolicy(t *testing.T) {
+	_, err := NewBouncePolicy(BouncePolicyConfig{})
+	require.Error(t, err)
+	_, err = NewBouncePolicy(BouncePolicyConfig{Store: brisa.NewMemoryStore(), NullSenderLimit: -1})
+	require.Error(t, err)
+}
+
+func TestBouncePolicy_NullSenderRate(t *testing.T) {
+	p, err := NewBouncePolicy(BouncePolicyConfig{Store: brisa.NewMemoryStore(), NullSenderLimit: 2})
+	require.NoError(t, err)
+	b, changes := newBouncePolicyBrisa(t, p)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.Simulate(bounceEnvelope("alice@example.com"), strings.NewReader("\r\n")).Err)
+	}
+	res := b.Simulate(bounceEnvelope("alice@example.com"), strings.NewReader("\r\n"))
+	assert.Equal(t, brisa.ChainMailFrom, res.Chain)
+	assert.Equal(t, ErrTooManyBounces, res.Err)
+
+	// Messages with a sender are not counted.
+	env := bounceEnvelope("alice@example.com")
+	env.From = "bob@example.org"
+	assert.NoError(t, b.Simulate(env, strings.NewReader("\r\n")).Err)
+
+	rep, err := p.Reputation("203.0.113.4")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), rep)
+	assert.Equal(t, []brisa.ReputationChanged{{Subject: "203.0.113.4", Old: 0, New: -1}}, *changes)
+}
+
+func TestBouncePolicy_VerifyRecipients(t *testing.T) {
+	p, err := NewBouncePolicy(BouncePolicyConfig{Store: brisa.NewMemoryStore(), VerifyRecipients: true, RejectUnsolicited: true})
+	require.NoError(t, err)
+	b, changes := newBouncePolicyBrisa(t, p)
+
+	res := b.Simulate(bounceEnvelope("alice@example.com"), strings.NewReader("\r\n"))
+	assert.Equal(t, map[string]error{"alice@example.com": ErrUnsolicitedBounce}, res.RcptErrors)
+	assert.Len(t, *changes, 1)
+
+	// Once alice has sent mail, bounces to her are expected.
+	env := brisatest.AuthEnvelope("alice")
+	env.From = "Alice@example.com"
+	assert.NoError(t, b.Simulate(env, strings.NewReader("\r\n")).Err)
+	res = b.Simulate(bounceEnvelope("alice@example.com"), strings.NewReader("\r\n"))
+	assert.NoError(t, res.Err)
+	assert.Empty(t, res.RcptErrors)
+}
+
+func TestBouncePolicy_ScoreOnly(t *testing.T) {
+	p, err := NewBouncePolicy(BouncePolicyConfig{Store: brisa.NewMemoryStore(), VerifyRecipients: true, Score: 3})
+	require.NoError(t, err)
+	env := bounceEnvelope("alice@example.com")
+	res := brisatest.Run(t, &brisa.Router{brisa.ChainRcptTo: {{Handler: p.HandleRcptTo}}}, env, "\r\n")
+	res.AssertAction(t, brisa.Deliver)
+	assert.Equal(t, 3.0, res.Score)
+}
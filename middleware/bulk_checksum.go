@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultBulkChecksumTimeout is the default time budget for all checksum
+	// services queried for one message.
+	DefaultBulkChecksumTimeout = 5 * time.Second
+	// DefaultBulkChecksumMaxBytes is the default number of message bytes sent to
+	// the checksum services.
+	DefaultBulkChecksumMaxBytes = 512 * 1024
+)
+
+// BulkChecksumKey is the context key holding the report counts per service
+// (map[string]int) found by the BulkChecksum middleware.
+const BulkChecksumKey = "bulk_checksum.counts"
+
+// BulkCountMany is the count reported when a service only says "many".
+const BulkCountMany = math.MaxInt32
+
+// BulkChecksumClient queries a collaborative checksum service (DCC, Pyzor,
+// Razor, ...) for the number of times a message has been reported or seen.
+// Services that only give a yes/no answer return 1 for a listed message.
+type BulkChecksumClient interface {
+	Name() string
+	Check(ctx context.Context, message []byte) (count int, err error)
+}
+
+// BulkChecksumService pairs a client with its scoring rule.
+type BulkChecksumService struct {
+	Client BulkChecksumClient
+	// Threshold is the count at or above which the message is considered bulk.
+	Threshold int
+	// Score is added to the context score when the threshold is reached.
+	Score float64
+}
+
+// BulkChecksumConfig configures the BulkChecksum middleware.
+type BulkChecksumConfig struct {
+	Services []BulkChecksumService
+	// Timeout bounds the time spent on all services. Defaults to DefaultBulkChecksumTimeout.
+	Timeout time.Duration
+	// MaxBytes is the number of leading message bytes checked.
+	// Defaults to DefaultBulkChecksumMaxBytes.
+	MaxBytes int64
+}
+
+// BulkChecksum scores near-identical bulk messages by asking collaborative
+// checksum services how often they have seen the message. All services are
+// queried concurrently.
+type BulkChecksum struct {
+	cfg BulkChecksumConfig
+}
+
+// NewBulkChecksum creates a new BulkChecksum instance.
+func NewBulkChecksum(cfg BulkChecksumConfig) (*BulkChecksum, error) {
+	if len(cfg.Services) == 0 {
+		return nil, fmt.Errorf("bulk checksum needs at least one service")
+	}
+	for _, s := range cfg.Services {
+		if s.Client == nil {
+			return nil, fmt.Errorf("bulk checksum service without client")
+		}
+		if s.Threshold <= 0 {
+			return nil, fmt.Errorf("invalid threshold %d for bulk checksum service %s", s.Threshold, s.Client.Name())
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultBulkChecksumTimeout
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultBulkChecksumMaxBytes
+	}
+	return &BulkChecksum{cfg: cfg}, nil
+}
+
+// NewBulkChecksumHandler creates a new Data middleware handler querying the
+// configured checksum services.
+func NewBulkChecksumHandler(cfg BulkChecksumConfig) (brisa.Handler, error) {
+	bc, err := NewBulkChecksum(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return bc.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (bc *BulkChecksum) Handle(ctx *brisa.Context) brisa.Action {
+	data, err := readMessagePrefix(ctx, bc.cfg.MaxBytes)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return brisa.Pass
+	}
+
+	checkCtx, cancel := context.WithTimeout(context.Background(), bc.cfg.Timeout)
+	defer cancel()
+
+	counts := make([]int, len(bc.cfg.Services))
+	errs := make([]error, len(bc.cfg.Services))
+	var wg sync.WaitGroup
+	for i, s := range bc.cfg.Services {
+		wg.Add(1)
+		go func(i int, client BulkChecksumClient) {
+			defer wg.Done()
+			counts[i], errs[i] = client.Check(checkCtx, data)
+		}(i, s.Client)
+	}
+	wg.Wait()
+
+	found := make(map[string]int)
+	for i, s := range bc.cfg.Services {
+		name := s.Client.Name()
+		if errs[i] != nil {
+			ctx.Logger.Error("bulk checksum query failed", "service", name, "error", errs[i])
+			continue
+		}
+		found[name] = counts[i]
+		if counts[i] >= s.Threshold {
+			ctx.Logger.Info("message reported by bulk checksum service", "service", name, "count", counts[i])
+			ctx.Score += s.Score
+		}
+	}
+	ctx.Set(BulkChecksumKey, found)
+	return brisa.Pass
+}
+
+// dccBodyCount matches the body count in the X-DCC header written by dccproc,
+// e.g. "X-DCC-Example-Metrics: host 1234; bulk Body=many Fuz1=12".
+var dccBodyCount = regexp.MustCompile(`(?i)\bBody=(\d+|many)`)
+
+// DCCClient checks messages with the dccproc program of the Distributed
+// Checksum Clearinghouse. It reports the body checksum count.
+type DCCClient struct {
+	// Path is the dccproc executable. Defaults to "dccproc".
+	Path string
+	// Args are extra arguments, e.g. "-a", clientIP to pass the client address.
+	Args []string
+}
+
+// Name implements BulkChecksumClient.
+func (c *DCCClient) Name() string { return "dcc" }
+
+// Check implements BulkChecksumClient.
+func (c *DCCClient) Check(ctx context.Context, message []byte) (int, error) {
+	path := c.Path
+	if path == "" {
+		path = "dccproc"
+	}
+	// -H: only output the X-DCC header, -x 0: exit 0 even for bulk mail.
+	args := append([]string{"-H", "-x", "0"}, c.Args...)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = bytes.NewReader(message)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("dccproc failed: %w", err)
+	}
+	return parseDCCCount(string(out))
+}
+
+// parseDCCCount extracts the body count from a dccproc X-DCC header.
+func parseDCCCount(header string) (int, error) {
+	m := dccBodyCount.FindStringSubmatch(header)
+	if m == nil {
+		return 0, fmt.Errorf("no body count in dccproc output %q", strings.TrimSpace(header))
+	}
+	if strings.EqualFold(m[1], "many") {
+		return BulkCountMany, nil
+	}
+	return strconv.Atoi(m[1])
+}
+
+// RazorClient checks messages with the razor-check program of Vipul's Razor.
+// Razor only answers listed or not, reported as a count of 1 or 0.
+type RazorClient struct {
+	// Path is the razor-check executable. Defaults to "razor-check".
+	Path string
+	// Args are extra arguments, e.g. "-home=/etc/razor".
+	Args []string
+}
+
+// Name implements BulkChecksumClient.
+func (c *RazorClient) Name() string { return "razor" }
+
+// Check implements BulkChecksumClient.
+func (c *RazorClient) Check(ctx context.Context, message []byte) (int, error) {
+	path := c.Path
+	if path == "" {
+		path = "razor-check"
+	}
+	cmd := exec.CommandContext(ctx, path, c.Args...)
+	cmd.Stdin = bytes.NewReader(message)
+	err := cmd.Run()
+
+	// razor-check exits with 0 for listed (spam) and 1 for not listed.
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 1, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("razor-check failed: %w", err)
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeChecksumClient struct {
+	name  string
+	count int
+	err   error
+}
+
+func (c *fakeChecksumClient) Name() string { return c.name }
+
+func (c *fakeChecksumClient) Check(ctx context.Context, message []byte) (int, error) {
+	return c.count, c.err
+}
+
+func TestNewBulkChecksum(t *testing.T) {
+	_, err := NewBulkChecksum(BulkChecksumConfig{})
+	require.Error(t, err)
+
+	_, err = NewBulkChecksum(BulkChecksumConfig{Services: []BulkChecksumService{
+		{Client: &fakeChecksumClient{name: "x"}},
+	}})
+	require.Error(t, err)
+}
+
+func TestBulkChecksum_Handle(t *testing.T) {
+	bc, err := NewBulkChecksum(BulkChecksumConfig{Services: []BulkChecksumService{
+		{Client: &fakeChecksumClient{name: "dcc", count: BulkCountMany}, Threshold: 100, Score: 2},
+		{Client: &fakeChecksumClient{name: "pyzor", count: 3}, Threshold: 5, Score: 3},
+		{Client: &fakeChecksumClient{name: "razor", count: 1}, Threshold: 1, Score: 1.5},
+		{Client: &fakeChecksumClient{name: "broken", err: errors.New("timeout")}, Threshold: 1, Score: 10},
+	}})
+	require.NoError(t, err)
+
+	message := "Subject: offer\r\n\r\nbody\r\n"
+	ctx := newTestContext(t, message)
+	assert.Equal(t, brisa.Pass, bc.Handle(ctx))
+
+	assert.Equal(t, 3.5, ctx.Score)
+	counts, ok := ctx.Get(BulkChecksumKey)
+	require.True(t, ok)
+	assert.Equal(t, map[string]int{"dcc": BulkCountMany, "pyzor": 3, "razor": 1}, counts)
+	assert.Equal(t, message, readTestMessage(t, ctx))
+}
+
+func TestParseDCCCount(t *testing.T) {
+	count, err := parseDCCCount("X-DCC-Example-Metrics: mx 1234; Body=42 Fuz1=many\n")
+	require.NoError(t, err)
+	assert.Equal(t, 42, count)
+
+	count, err = parseDCCCount("X-DCC-Example-Metrics: mx 1234; bulk Body=many Fuz1=many\n")
+	require.NoError(t, err)
+	assert.Equal(t, BulkCountMany, count)
+
+	_, err = parseDCCCount("garbage")
+	require.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultBulkThreshold is the default weight of the signals at or above
+	// which a message is bulk mail.
+	DefaultBulkThreshold = 3
+	// DefaultBulkStream is the default stream of bulk mail.
+	DefaultBulkStream = "bulk"
+	// DefaultStreamHeader is the default header carrying the stream of a
+	// message to the delivery layer, e.g. for a Sieve rule filing bulk mail
+	// into a "Promotions" folder.
+	DefaultStreamHeader = "X-Brisa-Stream"
+)
+
+// BulkSignalsKey is the context key holding the bulk signals ([]string) found
+// in the message, e.g. "list-unsubscribe" or "esp:mailchimp".
+const BulkSignalsKey = "bulk.signals"
+
+// defaultESPSignatures map header fields set by email service providers to
+// their names.
+var defaultESPSignatures = map[string]string{
+	"X-Mailgun-Sid":             "mailgun",
+	"X-Mailgun-Tag":             "mailgun",
+	"X-Sg-Eid":                  "sendgrid",
+	"X-Mc-User":                 "mailchimp",
+	"X-Mandrill-User":           "mandrill",
+	"X-Ses-Outgoing":            "amazon-ses",
+	"X-Pm-Message-Id":           "postmark",
+	"X-Sib-Id":                  "brevo",
+	"X-Mailjet-Campaign":        "mailjet",
+	"X-Campaign-Monitor":        "campaign-monitor",
+	"X-Hubspot-Message-Id":      "hubspot",
+	"X-Marketo-Tracking":        "marketo",
+	"X-Constantcontact-Id":      "constant-contact",
+	"X-Klaviyo-Message-Id":      "klaviyo",
+	"X-Sparkpost-Message-Id":    "sparkpost",
+	"X-Mailchimp-Campaign-Id":   "mailchimp",
+	"X-Salesforce-Marketing-Id": "salesforce",
+}
+
+// campaignHeaders carry a campaign identifier.
+var campaignHeaders = []string{"X-Campaign-Id", "X-Campaign", "X-Campaignid", "X-Mailgun-Campaign-Id", "X-Job"}
+
+// BulkClassifierConfig configures the BulkClassifier middleware.
+type BulkClassifierConfig struct {
+	// Threshold defaults to DefaultBulkThreshold.
+	Threshold int
+	// Stream is the stream of bulk mail. Defaults to DefaultBulkStream.
+	Stream string
+	// Header carries the stream in the message. Defaults to
+	// DefaultStreamHeader.
+	Header string
+	// DisableHeader only sets MessageStreamKey and leaves the message alone.
+	DisableHeader bool
+	// ESPSignatures add header fields of email service providers to the
+	// built-in ones, mapped to the provider name.
+	ESPSignatures map[string]string
+}
+
+// BulkClassifier recognizes newsletters and marketing mail by the header
+// fields bulk senders set: List-Unsubscribe, Precedence, campaign IDs and the
+// signatures of email service providers. Each signal has a weight; a message
+// reaching the threshold belongs to the bulk stream, recorded under
+// MessageStreamKey and in the stream header, which replaces any header of
+// that name from the sender.
+//
+// It runs in the Data chain and leaves the stream of messages another
+// middleware classified alone.
+type BulkClassifier struct {
+	cfg  BulkClassifierConfig
+	esps map[string]string
+}
+
+// NewBulkClassifier creates a new BulkClassifier instance.
+func NewBulkClassifier(cfg BulkClassifierConfig) (*BulkClassifier, error) {
+	if cfg.Threshold < 0 {
+		return nil, fmt.Errorf("invalid bulk threshold: %d", cfg.Threshold)
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = DefaultBulkThreshold
+	}
+	if cfg.Stream == "" {
+		cfg.Stream = DefaultBulkStream
+	}
+	if cfg.Header == "" {
+		cfg.Header = DefaultStreamHeader
+	}
+	esps := make(map[string]string, len(defaultESPSignatures)+len(cfg.ESPSignatures))
+	for k, v := range defaultESPSignatures {
+		esps[k] = v
+	}
+	for k, v := range cfg.ESPSignatures {
+		esps[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	return &BulkClassifier{cfg: cfg, esps: esps}, nil
+}
+
+// NewBulkClassifierHandler creates a new Data middleware handler classifying
+// bulk mail.
+func NewBulkClassifierHandler(cfg BulkClassifierConfig) (brisa.Handler, error) {
+	c, err := NewBulkClassifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (c *BulkClassifier) Handle(ctx *brisa.Context) brisa.Action {
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return brisa.Pass
+	}
+	defer setMessage(ctx, h, body)
+	if !c.cfg.DisableHeader {
+		// Never trust a stream claimed by the sender.
+		h.Del(c.cfg.Header)
+	}
+
+	if _, ok := ctx.Get(MessageStreamKey); ok {
+		return brisa.Pass
+	}
+	signals, weight := c.signals(h)
+	if len(signals) > 0 {
+		ctx.Set(BulkSignalsKey, signals)
+	}
+	if weight < c.cfg.Threshold {
+		return brisa.Pass
+	}
+	ctx.Set(MessageStreamKey, c.cfg.Stream)
+	if !c.cfg.DisableHeader {
+		h.Add(c.cfg.Header, c.cfg.Stream)
+	}
+	ctx.Logger.Debug("message classified as bulk", "signals", signals, "weight", weight)
+	return brisa.Pass
+}
+
+// signals returns the bulk signals of a header and their total weight.
+func (c *BulkClassifier) signals(h *messageHeader) ([]string, int) {
+	var signals []string
+	weight := 0
+	add := func(signal string, w int) {
+		signals = append(signals, signal)
+		weight += w
+	}
+
+	if h.Has("List-Unsubscribe") {
+		add("list-unsubscribe", 2)
+	}
+	if h.Has("List-Unsubscribe-Post") {
+		add("list-unsubscribe-post", 1)
+	}
+	if h.Has("List-Id") {
+		add("list-id", 1)
+	}
+	switch p := strings.ToLower(strings.TrimSpace(h.Get("Precedence"))); p {
+	case "bulk", "junk":
+		add("precedence:"+p, 2)
+	case "list":
+		add("precedence:list", 1)
+	}
+	for _, key := range campaignHeaders {
+		if h.Has(key) {
+			add("campaign-id", 2)
+			break
+		}
+	}
+	if h.Has("Feedback-Id") {
+		add("feedback-id", 1)
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range h.fields {
+		if esp, ok := c.esps[f.Key]; ok && !seen[esp] {
+			seen[esp] = true
+			add("esp:"+esp, 2)
+		}
+	}
+	return signals, weight
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkClassifier(t *testing.T) {
+	c, err := NewBulkClassifier(BulkClassifierConfig{ESPSignatures: map[string]string{"x-acme-mailing": "acme"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		header  string
+		bulk    bool
+		signals []string
+	}{
+		{"personal", "Subject: lunch?\r\n", false, nil},
+		{"newsletter", "List-Unsubscribe: <https://example.com/u>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n", true,
+			[]string{"list-unsubscribe", "list-unsubscribe-post"}},
+		{"esp campaign", "X-MC-User: abc\r\nX-Campaign-ID: spring\r\n", true, []string{"campaign-id", "esp:mailchimp"}},
+		{"custom esp", "X-Acme-Mailing: 1\r\nPrecedence: bulk\r\n", true, []string{"precedence:bulk", "esp:acme"}},
+		{"discussion list", "List-Id: <users.lists.example.org>\r\nPrecedence: list\r\n", false, []string{"list-id", "precedence:list"}},
+		{"forged stream", "X-Brisa-Stream: transactional\r\n", false, nil},
+	}
+	for _, tt := range tests {
+		var stream, signals any
+		router := &brisa.Router{brisa.ChainData: {
+			{Handler: c.Handle},
+			{Handler: func(ctx *brisa.Context) brisa.Action {
+				stream, _ = ctx.Get(MessageStreamKey)
+				signals, _ = ctx.Get(BulkSignalsKey)
+				return brisa.Pass
+			}},
+		}}
+		res := brisatest.Run(t, router, brisatest.DefaultEnvelope(), tt.header+"\r\nbody\r\n")
+		res.AssertAction(t, brisa.Deliver)
+		if tt.bulk {
+			assert.Equal(t, "bulk", stream, tt.name)
+			res.AssertHeader(t, DefaultStreamHeader, "bulk")
+		} else {
+			assert.Nil(t, stream, tt.name)
+			assert.Empty(t, res.Header().Get(DefaultStreamHeader), tt.name)
+		}
+		if tt.signals == nil {
+			assert.Nil(t, signals, tt.name)
+		} else {
+			assert.Equal(t, tt.signals, signals, tt.name)
+		}
+	}
+}
+
+func TestBulkClassifier_KeepsStream(t *testing.T) {
+	c, err := NewBulkClassifier(BulkClassifierConfig{})
+	require.NoError(t, err)
+	var stream any
+	router := &brisa.Router{brisa.ChainData: {
+		{Handler: func(ctx *brisa.Context) brisa.Action { ctx.Set(MessageStreamKey, "transactional"); return brisa.Pass }},
+		{Handler: c.Handle},
+		{Handler: func(ctx *brisa.Context) brisa.Action { stream, _ = ctx.Get(MessageStreamKey); return brisa.Pass }},
+	}}
+	res := brisatest.Run(t, router, brisatest.DefaultEnvelope(), "List-Unsubscribe: <mailto:u@example.com>\r\nPrecedence: bulk\r\n\r\n")
+	assert.Equal(t, "transactional", stream)
+	assert.Empty(t, res.Header().Get(DefaultStreamHeader))
+}
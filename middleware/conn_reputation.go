@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultConnReputationThreshold is the default reputation at or below
+	// which clients are deferred.
+	DefaultConnReputationThreshold = -5
+	// DefaultConnReputationTimeout is the default timeout of the DNS list
+	// lookups of a connection.
+	DefaultConnReputationTimeout = 2 * time.Second
+)
+
+// ClientReputationKey is the session context key holding the reputation
+// (int64) ConnReputation looked up for the client, for later chains such as
+// policies granting well-known clients more.
+const ClientReputationKey = "client.reputation"
+
+// ErrPoorReputation is returned to clients deferred for their reputation.
+var ErrPoorReputation = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Poor reputation, please try again later",
+}
+
+// ConnReputationConfig configures the ConnReputation middleware.
+type ConnReputationConfig struct {
+	// Reputation returns the reputation of a client IP, negative for bad
+	// clients, such as BouncePolicy.Reputation. Its errors are logged and the
+	// client is let in.
+	Reputation func(ip string) (int64, error)
+	// Threshold defaults to DefaultConnReputationThreshold.
+	Threshold int64
+	// Zones are DNS lists of client IPs, e.g. "zen.spamhaus.org". Clients
+	// listed in any of them are deferred.
+	Zones []string
+	// Resolver is used for DNS list queries. Defaults to SharedResolver(),
+	// whose cache answers for the clients that keep reconnecting during a
+	// spam run.
+	Resolver Resolver
+	// Timeout defaults to DefaultConnReputationTimeout.
+	Timeout time.Duration
+	// Reply defaults to ErrPoorReputation. Use a 450 reply to keep the
+	// connection open.
+	Reply *smtp.SMTPError
+}
+
+// ConnReputation defers clients with a poor reputation or listed on DNS lists
+// as soon as they connect, before any envelope data is exchanged, so that spam
+// storms cost as little as possible. Legitimate servers that end up there
+// retry later, when their reputation recovered.
+//
+// It must run in the Conn chain. The reputation is recorded under
+// ClientReputationKey for the whole session. With deferred rejections (see
+// Brisa.SetDeferredRejection) the reply waits for DATA like any other.
+type ConnReputation struct {
+	cfg ConnReputationConfig
+}
+
+// NewConnReputation creates a new ConnReputation instance.
+func NewConnReputation(cfg ConnReputationConfig) (*ConnReputation, error) {
+	if cfg.Reputation == nil && len(cfg.Zones) == 0 {
+		return nil, fmt.Errorf("connection reputation needs a reputation source or a DNS list zone")
+	}
+	if cfg.Timeout < 0 {
+		return nil, fmt.Errorf("connection reputation timeout must not be negative")
+	}
+	if cfg.Threshold == 0 {
+		cfg.Threshold = DefaultConnReputationThreshold
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = SharedResolver()
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultConnReputationTimeout
+	}
+	if cfg.Reply == nil {
+		cfg.Reply = ErrPoorReputation
+	}
+	return &ConnReputation{cfg: cfg}, nil
+}
+
+// NewConnReputationHandler creates a new Conn middleware handler deferring
+// clients with a poor reputation.
+func NewConnReputationHandler(cfg ConnReputationConfig) (brisa.Handler, error) {
+	r, err := NewConnReputation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (r *ConnReputation) Handle(ctx *brisa.Context) brisa.Action {
+	ip := clientIP(ctx)
+	if ip == nil {
+		return brisa.Pass
+	}
+	if r.cfg.Reputation != nil {
+		rep, err := r.cfg.Reputation(ip.String())
+		if err != nil {
+			ctx.Logger.Error("failed to look up client reputation", "ip", ip, "error", err)
+		} else if ctx.SetSession(ClientReputationKey, rep); rep <= r.cfg.Threshold {
+			ctx.Logger.Info("client deferred for reputation", "ip", ip, "reputation", rep)
+			return ctx.RejectWith(r.cfg.Reply)
+		}
+	}
+	if zone, ok := r.listed(ip); ok {
+		ctx.Logger.Info("client deferred for DNS list", "ip", ip, "zone", zone)
+		return ctx.RejectWith(r.cfg.Reply)
+	}
+	return brisa.Pass
+}
+
+// listed reports whether ip is listed in one of the zones, and in which.
+func (r *ConnReputation) listed(ip net.IP) (string, bool) {
+	if len(r.cfg.Zones) == 0 {
+		return "", false
+	}
+	lookupCtx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+	name := dnsListName(ip)
+	for _, zone := range r.cfg.Zones {
+		addrs, err := r.cfg.Resolver.LookupHost(lookupCtx, name+"."+zone)
+		if err == nil && dnsListListed(addrs) {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// dnsListName returns the name of ip in DNS lists: the reversed octets of
+// IPv4 addresses or nibbles of IPv6 ones.
+func dnsListName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	nibbles := strings.Split(spfIPName(ip), ".")
+	slices.Reverse(nibbles)
+	return strings.Join(nibbles, ".")
+}
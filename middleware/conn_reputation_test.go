@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConnReputation(t *testing.T) {
+	_, err := NewConnReputation(ConnReputationConfig{})
+	require.Error(t, err)
+	_, err = NewConnReputation(ConnReputationConfig{Zones: []string{"dnsbl.example"}, Timeout: -1})
+	require.Error(t, err)
+}
+
+func TestConnReputation_Handle(t *testing.T) {
+	p, err := NewBouncePolicy(BouncePolicyConfig{Store: brisa.NewMemoryStore(), Penalty: 3})
+	require.NoError(t, err)
+	r, err := NewConnReputation(ConnReputationConfig{
+		Reputation: func(ip string) (int64, error) {
+			if ip == "198.51.100.9" {
+				return 0, errors.New("store down")
+			}
+			return p.Reputation(ip)
+		},
+		Zones: []string{"dnsbl.example"},
+		Resolver: &brisatest.FakeResolver{Hosts: map[string][]string{
+			"4.113.0.203.dnsbl.example": {"127.0.0.2"},
+			"1.113.0.203.dnsbl.example": {"127.0.0.1"}, // refused query
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.dnsbl.example": {"127.0.0.4"},
+		}},
+	})
+	require.NoError(t, err)
+	var reputation any
+	router := &brisa.Router{
+		brisa.ChainConn: {{Handler: r.Handle}},
+		brisa.ChainData: {{Handler: func(ctx *brisa.Context) brisa.Action {
+			reputation, _ = ctx.Get(ClientReputationKey)
+			return brisa.Pass
+		}}},
+	}
+
+	connect := func(ip string) *brisatest.Result {
+		env := brisatest.DefaultEnvelope()
+		env.ClientAddr = &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}
+		return brisatest.Run(t, router, env, "\r\nhello\r\n")
+	}
+	connect("192.0.2.1").AssertAction(t, brisa.Deliver)
+	// The reputation is kept for the session, past MAIL FROM.
+	assert.Equal(t, int64(0), reputation)
+	connect("203.0.113.1").AssertAction(t, brisa.Deliver)
+	connect("198.51.100.9").AssertAction(t, brisa.Deliver)
+
+	res := connect("203.0.113.4")
+	assert.Equal(t, brisa.ChainConn, res.Chain)
+	assert.Equal(t, ErrPoorReputation, res.Err)
+	assert.Equal(t, ErrPoorReputation, connect("2001:db8::1").Err)
+
+	// Violations lower the reputation below the threshold.
+	_, err = p.cfg.Store.Incr(p.cfg.KeyPrefix+"rep:192.0.2.1", -5, p.cfg.ReputationTTL)
+	require.NoError(t, err)
+	assert.Equal(t, ErrPoorReputation, connect("192.0.2.1").Err)
+
+	reply := &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Later"}
+	r.cfg.Reply = reply
+	assert.Equal(t, reply, connect("192.0.2.1").Err)
+}
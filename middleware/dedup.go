@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultDedupKeyPrefix is the default prefix of the Store keys written by Dedup.
+	DefaultDedupKeyPrefix = "dedup:"
+	// DefaultDedupWindow is the default time a delivered message is remembered.
+	DefaultDedupWindow = 24 * time.Hour
+	// DefaultDedupClaimTTL is the default time a message being delivered holds
+	// its fingerprint.
+	DefaultDedupClaimTTL = 5 * time.Minute
+)
+
+// ErrDedupInFlight is returned for a copy of a message another session is
+// delivering, so that it is retried rather than dropped in case that delivery
+// fails.
+var ErrDedupInFlight = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Message is being delivered, please try again later",
+}
+
+// Values of the fingerprint keys.
+const (
+	dedupClaimed   = "claimed"
+	dedupDelivered = "1"
+)
+
+// DedupKey is the context key holding the fingerprint (string) Dedup computed
+// for the message. Record remembers it once the message is delivered.
+const DedupKey = "dedup.key"
+
+// DedupDuplicateKey is the context key set (to true) when the message is a
+// duplicate of one delivered within the window.
+const DedupDuplicateKey = "dedup.duplicate"
+
+// DedupMode selects what identifies a message.
+type DedupMode int
+
+const (
+	// DedupByContent identifies a message by a hash of its content. Trace
+	// header fields, which change from hop to hop, are left out.
+	DedupByContent DedupMode = iota
+	// DedupByMessageID identifies a message by its Message-ID, falling back to
+	// the content hash for messages without one.
+	DedupByMessageID
+)
+
+// dedupSkipHeaders are the header fields left out of the content hash.
+var dedupSkipHeaders = []string{"Received", "Return-Path", "Delivered-To", "Authentication-Results", "X-Spam-Score", "X-Spam-Status"}
+
+// DedupConfig configures the Dedup middleware.
+type DedupConfig struct {
+	// Store remembers the delivered messages. It is required; a shared Store
+	// suppresses duplicates across instances. The fingerprint is claimed with
+	// brisa.StoreAdd, so with an AddStore only one of the copies received at
+	// the same time by two instances passes.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultDedupKeyPrefix.
+	KeyPrefix string
+	// Window is the time a delivered message is remembered. Defaults to
+	// DefaultDedupWindow.
+	Window time.Duration
+	// ClaimTTL is the time a message holds its fingerprint between the Data
+	// and the Deliver chain; a message rejected or failing in between is no
+	// longer suppressed after it. Defaults to DefaultDedupClaimTTL.
+	ClaimTTL time.Duration
+	Mode     DedupMode
+	// Action is returned for duplicates. Defaults to brisa.Discard, which
+	// accepts and drops them so the upstream stops retrying. brisa.Pass only
+	// marks them with DedupDuplicateKey, e.g. for spamtrap analysis.
+	Action brisa.Action
+}
+
+// Dedup suppresses messages delivered more than once within a window, as sent
+// by upstreams that retry messages they already handed over. The envelope
+// sender and recipients are part of the fingerprint, so the same message to
+// other recipients is not a duplicate.
+//
+// Handle runs at the end of the Data chain and claims the fingerprint for
+// ClaimTTL; Record runs in the Deliver chain and remembers it for Window. A
+// copy received while the fingerprint is claimed is deferred with
+// ErrDedupInFlight, and a message that is rejected or fails in between is not
+// suppressed when it is retried after ClaimTTL.
+type Dedup struct {
+	cfg DedupConfig
+}
+
+// NewDedup creates a new Dedup instance. Unlike most middleware it has two
+// handlers, so there is no NewDedupHandler.
+func NewDedup(cfg DedupConfig) (*Dedup, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("dedup store is required")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultDedupKeyPrefix
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultDedupWindow
+	}
+	if cfg.ClaimTTL <= 0 {
+		cfg.ClaimTTL = DefaultDedupClaimTTL
+	}
+	if cfg.Action == 0 {
+		cfg.Action = brisa.Discard
+	}
+	return &Dedup{cfg: cfg}, nil
+}
+
+// Handle is the Data chain brisa.Handler of the middleware.
+func (d *Dedup) Handle(ctx *brisa.Context) brisa.Action {
+	key, err := d.fingerprint(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return ctx.Action
+	}
+	ctx.Set(DedupKey, key)
+
+	claimed, err := brisa.StoreAdd(d.cfg.Store, d.cfg.KeyPrefix+key, []byte(dedupClaimed), d.cfg.ClaimTTL)
+	if err != nil {
+		// Fail open: delivering a duplicate is better than losing a message.
+		ctx.Logger.Error("failed to claim message fingerprint", "error", err)
+		return ctx.Action
+	}
+	if claimed {
+		return ctx.Action
+	}
+	ctx.Set(DedupDuplicateKey, true)
+	ctx.Logger.Info("duplicate message", "from", ctx.From, "fingerprint", key)
+	if d.cfg.Action == brisa.Pass {
+		return ctx.Action
+	}
+	value, _, err := d.cfg.Store.Get(d.cfg.KeyPrefix + key)
+	if err != nil {
+		ctx.Logger.Error("failed to look up message fingerprint", "error", err)
+		return ctx.Action
+	}
+	if string(value) == dedupClaimed {
+		return ctx.RejectWith(ErrDedupInFlight)
+	}
+	return d.cfg.Action
+}
+
+// Record is the Deliver chain brisa.Handler of the middleware. It remembers
+// the fingerprint computed by Handle.
+func (d *Dedup) Record(ctx *brisa.Context) brisa.Action {
+	v, ok := ctx.Get(DedupKey)
+	if !ok {
+		return ctx.Action
+	}
+	key, _ := v.(string)
+	if err := d.cfg.Store.Set(d.cfg.KeyPrefix+key, []byte(dedupDelivered), d.cfg.Window); err != nil {
+		ctx.Logger.Error("failed to record message fingerprint", "error", err)
+	}
+	return ctx.Action
+}
+
+// fingerprint hashes the envelope and the message identity of ctx.
+func (d *Dedup) fingerprint(ctx *brisa.Context) (string, error) {
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.New()
+	rcpts := make([]string, len(ctx.To))
+	for i, rcpt := range ctx.To {
+		rcpts[i] = strings.ToLower(rcpt)
+	}
+	slices.Sort(rcpts)
+	fmt.Fprintf(sum, "%s\x00%s\x00", strings.ToLower(ctx.From), strings.Join(rcpts, ","))
+
+	if id := h.Get("Message-Id"); d.cfg.Mode == DedupByMessageID && id != "" {
+		fmt.Fprintf(sum, "id\x00%s", id)
+		setMessage(ctx, h, body)
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	}
+
+	fmt.Fprint(sum, "content\x00")
+	for _, f := range h.fields {
+		if !slices.Contains(dedupSkipHeaders, f.Key) {
+			sum.Write(f.Raw)
+		}
+	}
+	if _, ok := body.(*spooledBody); ok {
+		// The spool keeps the body for later middleware.
+		_, err = io.Copy(sum, body)
+		setMessage(ctx, h, body)
+	} else {
+		// Tee the body into the hash while keeping it for later middleware.
+		var buf bytes.Buffer
+		_, err = io.Copy(io.MultiWriter(sum, &buf), body)
+		setMessage(ctx, h, io.MultiReader(&buf, body))
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dedupTestMessage = "Message-ID: <1@example.com>\r\nSubject: invoice\r\n\r\nPlease pay.\r\n"
+
+func TestNewDedup(t *testing.T) {
+	_, err := NewDedup(DedupConfig{})
+	require.Error(t, err)
+}
+
+func TestDedup(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Now())
+	store := brisa.NewMemoryStoreWithClock(clock)
+	d, err := NewDedup(DedupConfig{Store: store, Window: time.Hour})
+	require.NoError(t, err)
+
+	run := func(from, to, msg string, deliver bool) (brisa.Action, *brisa.Context) {
+		ctx := newTestContext(t, msg)
+		ctx.From = from
+		ctx.To = []string{to}
+		action := d.Handle(ctx)
+		if deliver && action == brisa.Pass {
+			d.Record(ctx)
+		}
+		return action, ctx
+	}
+
+	// A copy received while the first is being delivered is deferred.
+	action, _ := run("a@example.com", "b@example.org", dedupTestMessage, false)
+	assert.Equal(t, brisa.Pass, action)
+	action, ctx := run("a@example.com", "b@example.org", dedupTestMessage, false)
+	assert.Equal(t, brisa.Reject, action)
+	assert.Equal(t, ErrDedupInFlight, ctx.RejectError())
+
+	// A message that was not delivered is forgotten after the claim.
+	clock.Advance(DefaultDedupClaimTTL + time.Second)
+	action, ctx = run("a@example.com", "b@example.org", dedupTestMessage, true)
+	assert.Equal(t, brisa.Pass, action)
+	data, err := readMessagePrefix(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, dedupTestMessage, string(data), "message must be left intact")
+
+	// A retry that went through another hop is a duplicate.
+	action, ctx = run("A@example.com", "b@example.org", "Received: from relay\r\n"+dedupTestMessage, true)
+	assert.Equal(t, brisa.Discard, action)
+	dup, _ := ctx.Get(DedupDuplicateKey)
+	assert.Equal(t, true, dup)
+
+	// The same message to another recipient is not.
+	action, _ = run("a@example.com", "c@example.org", dedupTestMessage, true)
+	assert.Equal(t, brisa.Pass, action)
+
+	// Nor is a different message.
+	action, _ = run("a@example.com", "b@example.org", strings.Replace(dedupTestMessage, "pay", "pay now", 1), true)
+	assert.Equal(t, brisa.Pass, action)
+
+	clock.Advance(2 * time.Hour)
+	action, _ = run("a@example.com", "b@example.org", dedupTestMessage, true)
+	assert.Equal(t, brisa.Pass, action, "window has passed")
+}
+
+func TestDedup_Concurrent(t *testing.T) {
+	d, err := NewDedup(DedupConfig{Store: brisa.NewMemoryStore()})
+	require.NoError(t, err)
+
+	// Only one of the copies received at the same time claims the fingerprint.
+	actions := make(chan brisa.Action, 8)
+	var wg sync.WaitGroup
+	for range cap(actions) {
+		ctx := newTestContext(t, dedupTestMessage)
+		ctx.To = []string{"b@example.org"}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			actions <- d.Handle(ctx)
+		}()
+	}
+	wg.Wait()
+	close(actions)
+	passed := 0
+	for action := range actions {
+		if action == brisa.Pass {
+			passed++
+		}
+	}
+	assert.Equal(t, 1, passed)
+}
+
+func TestDedup_MessageID(t *testing.T) {
+	d, err := NewDedup(DedupConfig{Store: brisa.NewMemoryStore(), Mode: DedupByMessageID, Action: brisa.Pass})
+	require.NoError(t, err)
+
+	ctx := newTestContext(t, dedupTestMessage)
+	ctx.To = []string{"b@example.org"}
+	require.Equal(t, brisa.Pass, d.Handle(ctx))
+	d.Record(ctx)
+
+	// Same Message-ID, rewritten body: still a duplicate, only marked.
+	ctx = newTestContext(t, strings.Replace(dedupTestMessage, "pay", "PAY", 1))
+	ctx.To = []string{"b@example.org"}
+	assert.Equal(t, brisa.Pass, d.Handle(ctx))
+	dup, _ := ctx.Get(DedupDuplicateKey)
+	assert.Equal(t, true, dup)
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+// Delivery priorities, on the scale of the MT-PRIORITY parameter (RFC 6710)
+// from -9 (lowest) to 9 (highest).
+const (
+	PriorityLow    = -4
+	PriorityNormal = 0
+	PriorityHigh   = 4
+)
+
+// DeliveryPriorityKey is the context key holding the delivery priority (int)
+// of the message, set by middleware to override the default.
+// DeliverAfterKey holds the time (time.Time) before which the message must not
+// be delivered.
+const (
+	DeliveryPriorityKey = "delivery.priority"
+	DeliverAfterKey     = "delivery.after"
+)
+
+// DeliveryPriority returns the priority a delivery queue should give the
+// message of ctx: the one set under DeliveryPriorityKey, else the highest
+// MT-PRIORITY of its recipients, else one derived from the message:
+// bounces and bulk mail are low, transactional mail (see MessageStreamKey)
+// is high.
+func DeliveryPriority(ctx *brisa.Context) int {
+	if v, ok := ctx.Get(DeliveryPriorityKey); ok {
+		if p, ok := v.(int); ok {
+			return max(-9, min(9, p))
+		}
+	}
+
+	requested, found := 0, false
+	for _, opts := range ctx.ToOptions {
+		if opts != nil && opts.MTPriority != nil && (!found || *opts.MTPriority > requested) {
+			requested, found = *opts.MTPriority, true
+		}
+	}
+	if found {
+		return requested
+	}
+
+	if ctx.From == "" {
+		return PriorityLow
+	}
+	if v, ok := ctx.Get(MessageStreamKey); ok {
+		switch v {
+		case "transactional":
+			return PriorityHigh
+		case "bulk":
+			return PriorityLow
+		}
+	}
+	return PriorityNormal
+}
+
+// DeferDelivery asks the delivery queue not to deliver the message of ctx
+// before t, e.g. for scheduled sends or to spread the mail of a warming up
+// IP address. When several middleware defer a message, the latest time wins.
+func DeferDelivery(ctx *brisa.Context, t time.Time) {
+	if t.After(DeliverAfter(ctx)) {
+		ctx.Set(DeliverAfterKey, t)
+	}
+}
+
+// DeliverAfter returns the time set by DeferDelivery, or the zero time if the
+// message may be delivered at once.
+func DeliverAfter(ctx *brisa.Context) time.Time {
+	if v, ok := ctx.Get(DeliverAfterKey); ok {
+		t, _ := v.(time.Time)
+		return t
+	}
+	return time.Time{}
+}
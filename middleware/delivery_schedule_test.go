@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryPriority(t *testing.T) {
+	ctx := newTestContext(t, "")
+	ctx.From = "alice@example.com"
+	assert.Equal(t, PriorityNormal, DeliveryPriority(ctx))
+
+	ctx.Set(MessageStreamKey, "transactional")
+	assert.Equal(t, PriorityHigh, DeliveryPriority(ctx))
+	ctx.Set(MessageStreamKey, "bulk")
+	assert.Equal(t, PriorityLow, DeliveryPriority(ctx))
+
+	// The client's MT-PRIORITY overrides the stream.
+	low, high := -2, 3
+	ctx.ToOptions = []*smtp.RcptOptions{{MTPriority: &low}, {}, {MTPriority: &high}}
+	assert.Equal(t, 3, DeliveryPriority(ctx))
+
+	// Middleware override everything.
+	ctx.Set(DeliveryPriorityKey, 20)
+	assert.Equal(t, 9, DeliveryPriority(ctx))
+
+	bounce := newTestContext(t, "")
+	assert.Equal(t, PriorityLow, DeliveryPriority(bounce))
+}
+
+func TestDeferDelivery(t *testing.T) {
+	ctx := newTestContext(t, "")
+	assert.True(t, DeliverAfter(ctx).IsZero())
+
+	t1 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	DeferDelivery(ctx, t1)
+	DeferDelivery(ctx, t1.Add(-time.Hour))
+	assert.Equal(t, t1, DeliverAfter(ctx))
+	DeferDelivery(ctx, t1.Add(time.Hour))
+	assert.Equal(t, t1.Add(time.Hour), DeliverAfter(ctx))
+}
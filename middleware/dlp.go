@@ -0,0 +1,314 @@
+package middleware
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/muzhy/brisa"
+)
+
+// DefaultDLPMaxBytes is the default number of message bytes inspected.
+const DefaultDLPMaxBytes = 10 * 1024 * 1024
+
+// DLPFindingsKey is the context key holding the []DLPFinding of the message.
+const DLPFindingsKey = "dlp.findings"
+
+// maxDLPArchiveEntryBytes bounds the uncompressed size read from a single
+// entry of an office document, to defuse zip bombs.
+const maxDLPArchiveEntryBytes = 8 * 1024 * 1024
+
+// DLPAction defines what the DLP middleware does with a message that matches.
+type DLPAction int
+
+const (
+	// DLPNotify lets the message through and only calls the Notify callback.
+	DLPNotify DLPAction = iota
+	// DLPQuarantine marks the message for quarantine.
+	DLPQuarantine
+	// DLPReject rejects the message.
+	DLPReject
+)
+
+// DLPRule describes sensitive content. A rule matches either a regular
+// expression (optionally confirmed by Validate) or any of its keywords.
+type DLPRule struct {
+	Name string
+	// Pattern is a regular expression matched against the text.
+	Pattern string
+	// Validate, if set, confirms each Pattern match, e.g. with a checksum.
+	Validate func(match string) bool
+	// Keywords are matched case-insensitively as whole words.
+	Keywords []string
+	// MinMatches is the number of matches needed in one part for the rule to
+	// fire. Defaults to 1.
+	MinMatches int
+}
+
+// Built-in rules for common sensitive data.
+var (
+	// DLPCreditCard matches payment card numbers that pass the Luhn check.
+	DLPCreditCard = DLPRule{
+		Name:     "credit_card",
+		Pattern:  `\b\d(?:[ -]?\d){12,18}\b`,
+		Validate: luhnValid,
+	}
+	// DLPUSSocialSecurity matches US social security numbers in the usual
+	// AAA-GG-SSSS notation, excluding ranges that are never assigned.
+	DLPUSSocialSecurity = DLPRule{
+		Name:     "us_ssn",
+		Pattern:  `\b\d{3}-\d{2}-\d{4}\b`,
+		Validate: ssnValid,
+	}
+	// DLPChinaResidentID matches 18-digit PRC resident identity card numbers
+	// with a valid check digit.
+	DLPChinaResidentID = DLPRule{
+		Name:     "cn_resident_id",
+		Pattern:  `\b\d{17}[\dXx]\b`,
+		Validate: chinaResidentIDValid,
+	}
+)
+
+// DLPFinding records that a rule fired on a part of a message. The matched
+// data itself is deliberately not kept.
+type DLPFinding struct {
+	Rule    string
+	Part    string // file name of the attachment, or the media type of the body part
+	Matches int
+}
+
+// DLPConfig configures the DLP middleware.
+type DLPConfig struct {
+	Rules  []DLPRule
+	Action DLPAction
+	// Notify, if set, is called with the findings of every matching message.
+	Notify func(ctx *brisa.Context, findings []DLPFinding)
+	// MaxBytes is the number of leading message bytes inspected.
+	// Defaults to DefaultDLPMaxBytes.
+	MaxBytes int64
+}
+
+type dlpRule struct {
+	name       string
+	pattern    *regexp.Regexp
+	validate   func(string) bool
+	minMatches int
+}
+
+// DLP is a data-loss-prevention middleware for outbound mail. It inspects text
+// bodies and common attachment types (plain text, CSV, JSON, XML, HTML and
+// Office Open XML / OpenDocument files) for sensitive data.
+type DLP struct {
+	rules    []dlpRule
+	action   DLPAction
+	notify   func(ctx *brisa.Context, findings []DLPFinding)
+	maxBytes int64
+}
+
+// NewDLP creates a new DLP instance. It returns an error if a rule is invalid.
+func NewDLP(cfg DLPConfig) (*DLP, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("dlp needs at least one rule")
+	}
+	d := &DLP{action: cfg.Action, notify: cfg.Notify, maxBytes: cfg.MaxBytes}
+	if d.maxBytes <= 0 {
+		d.maxBytes = DefaultDLPMaxBytes
+	}
+
+	for _, rule := range cfg.Rules {
+		r := dlpRule{name: rule.Name, validate: rule.Validate, minMatches: rule.MinMatches}
+		if r.minMatches <= 0 {
+			r.minMatches = 1
+		}
+
+		expr := rule.Pattern
+		if len(rule.Keywords) > 0 {
+			if expr != "" {
+				return nil, fmt.Errorf("dlp rule %s: pattern and keywords are mutually exclusive", rule.Name)
+			}
+			quoted := make([]string, len(rule.Keywords))
+			for i, kw := range rule.Keywords {
+				quoted[i] = regexp.QuoteMeta(kw)
+			}
+			expr = `(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`
+		}
+		if expr == "" {
+			return nil, fmt.Errorf("dlp rule %s: pattern or keywords required", rule.Name)
+		}
+
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("dlp rule %s: invalid pattern: %w", rule.Name, err)
+		}
+		r.pattern = pattern
+		d.rules = append(d.rules, r)
+	}
+	return d, nil
+}
+
+// NewDLPHandler creates a new Data middleware handler inspecting outbound mail.
+func NewDLPHandler(cfg DLPConfig) (brisa.Handler, error) {
+	d, err := NewDLP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return d.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (d *DLP) Handle(ctx *brisa.Context) brisa.Action {
+	data, err := readMessagePrefix(ctx, d.maxBytes)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return brisa.Pass
+	}
+
+	findings := d.Inspect(data)
+	if len(findings) == 0 {
+		return brisa.Pass
+	}
+
+	ctx.Set(DLPFindingsKey, findings)
+	for _, f := range findings {
+		ctx.Logger.Warn("sensitive content detected", "rule", f.Rule, "part", f.Part, "matches", f.Matches)
+	}
+	if d.notify != nil {
+		d.notify(ctx, findings)
+	}
+
+	switch d.action {
+	case DLPQuarantine:
+		return brisa.Quarantine
+	case DLPReject:
+		return brisa.Reject
+	default:
+		return brisa.Pass
+	}
+}
+
+// Inspect returns the findings of all rules on the parts of message.
+func (d *DLP) Inspect(message []byte) []DLPFinding {
+	var findings []DLPFinding
+	walkParts(message, func(p *messagePart) error {
+		text, ok := extractText(p)
+		if !ok {
+			return nil
+		}
+		name := p.Filename
+		if name == "" {
+			name = p.MediaType
+		}
+		for _, rule := range d.rules {
+			if n := rule.count(text); n >= rule.minMatches {
+				findings = append(findings, DLPFinding{Rule: rule.name, Part: name, Matches: n})
+			}
+		}
+		return nil
+	})
+	return findings
+}
+
+func (r *dlpRule) count(text string) int {
+	n := 0
+	for _, m := range r.pattern.FindAllString(text, -1) {
+		if r.validate == nil || r.validate(m) {
+			n++
+		}
+	}
+	return n
+}
+
+// officeTextEntries are the archive entries holding the text of Office Open
+// XML and OpenDocument files.
+var officeTextEntries = regexp.MustCompile(`^(?:word/document\.xml|word/(?:header|footer)\d*\.xml|xl/sharedStrings\.xml|ppt/slides/slide\d+\.xml|content\.xml)$`)
+
+var xmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// extractText returns the inspectable text of a part, or false if the type of
+// the part is not supported.
+func extractText(p *messagePart) (string, bool) {
+	ext := strings.ToLower(path.Ext(p.Filename))
+	switch {
+	case strings.HasPrefix(p.MediaType, "text/"),
+		p.MediaType == "application/json",
+		p.MediaType == "application/xml",
+		p.MediaType == "application/csv",
+		ext == ".txt", ext == ".csv", ext == ".json", ext == ".xml":
+		return string(p.Body), true
+	case ext == ".docx", ext == ".xlsx", ext == ".pptx", ext == ".odt", ext == ".ods", ext == ".odp",
+		strings.HasPrefix(p.MediaType, "application/vnd.openxmlformats-officedocument."),
+		strings.HasPrefix(p.MediaType, "application/vnd.oasis.opendocument."):
+		return officeText(p.Body)
+	}
+	return "", false
+}
+
+// officeText extracts the text of an Office Open XML or OpenDocument file.
+func officeText(data []byte) (string, bool) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", false
+	}
+	var sb strings.Builder
+	for _, f := range zr.File {
+		if !officeTextEntries.MatchString(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		content, _ := io.ReadAll(io.LimitReader(rc, maxDLPArchiveEntryBytes))
+		rc.Close()
+		// Replace tags by spaces so that text of adjacent cells or runs does not
+		// merge into a single token.
+		sb.WriteString(xmlTag.ReplaceAllString(string(content), " "))
+		sb.WriteByte('\n')
+	}
+	return sb.String(), true
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum.
+func luhnValid(s string) bool {
+	sum, n, double := 0, 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		n++
+	}
+	return n >= 13 && n <= 19 && sum%10 == 0
+}
+
+// ssnValid excludes social security numbers that are never assigned: area
+// 000, 666 or 9xx, group 00 and serial 0000.
+func ssnValid(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// chinaResidentIDValid verifies the ISO 7064 MOD 11-2 check digit of an
+// 18-digit resident identity card number.
+func chinaResidentIDValid(s string) bool {
+	weights := [17]int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	const checkDigits = "10X98765432"
+
+	sum := 0
+	for i := 0; i < 17; i++ {
+		sum += int(s[i]-'0') * weights[i]
+	}
+	return strings.ToUpper(s[17:]) == string(checkDigits[sum%11])
+}
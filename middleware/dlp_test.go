@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDLP(t *testing.T) {
+	_, err := NewDLP(DLPConfig{})
+	require.Error(t, err)
+
+	_, err = NewDLP(DLPConfig{Rules: []DLPRule{{Name: "empty"}}})
+	require.Error(t, err)
+
+	_, err = NewDLP(DLPConfig{Rules: []DLPRule{{Name: "both", Pattern: "x", Keywords: []string{"y"}}}})
+	require.Error(t, err)
+
+	_, err = NewDLP(DLPConfig{Rules: []DLPRule{{Name: "bad", Pattern: "("}}})
+	require.Error(t, err)
+}
+
+func TestDLP_Validators(t *testing.T) {
+	assert.True(t, luhnValid("4111 1111 1111 1111"))
+	assert.True(t, luhnValid("5500-0000-0000-0004"))
+	assert.False(t, luhnValid("4111 1111 1111 1112"))
+	assert.False(t, luhnValid("0000")) // too short
+
+	assert.True(t, ssnValid("123-45-6789"))
+	assert.False(t, ssnValid("000-45-6789"))
+	assert.False(t, ssnValid("666-45-6789"))
+	assert.False(t, ssnValid("923-45-6789"))
+	assert.False(t, ssnValid("123-00-6789"))
+
+	assert.True(t, chinaResidentIDValid("11010519491231002X"))
+	assert.True(t, chinaResidentIDValid("11010519491231002x"))
+	assert.False(t, chinaResidentIDValid("110105194912310021"))
+}
+
+func TestDLP_Inspect(t *testing.T) {
+	d, err := NewDLP(DLPConfig{Rules: []DLPRule{
+		DLPCreditCard,
+		DLPUSSocialSecurity,
+		DLPChinaResidentID,
+		{Name: "project", Keywords: []string{"Project Falcon"}},
+		{Name: "invoice", Pattern: `INV-\d{6}`, MinMatches: 2},
+	}})
+	require.NoError(t, err)
+
+	findings := d.Inspect([]byte("Subject: hi\r\n\r\n" +
+		"card 4111 1111 1111 1111, not 4111 1111 1111 1112\r\n" +
+		"ssn 123-45-6789 and order 1234567890123\r\n" +
+		"about project falcon, see INV-000001\r\n"))
+	assert.Equal(t, []DLPFinding{
+		{Rule: "credit_card", Part: "text/plain", Matches: 1},
+		{Rule: "us_ssn", Part: "text/plain", Matches: 1},
+		{Rule: "project", Part: "text/plain", Matches: 1},
+	}, findings)
+
+	assert.Empty(t, d.Inspect([]byte("Subject: hi\r\n\r\nnothing to see here\r\n")))
+}
+
+func TestDLP_InspectOfficeAttachment(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("word/document.xml")
+	require.NoError(t, err)
+	_, err = w.Write([]byte(`<w:document><w:p><w:r><w:t>ID 11010519491231002X</w:t></w:r></w:p></w:document>`))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	message := "Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"see attachment\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream; name=staff.docx\r\n" +
+		"Content-Disposition: attachment; filename=staff.docx\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(buf.Bytes()) + "\r\n" +
+		"--b--\r\n"
+
+	d, err := NewDLP(DLPConfig{Rules: []DLPRule{DLPChinaResidentID}})
+	require.NoError(t, err)
+	assert.Equal(t, []DLPFinding{{Rule: "cn_resident_id", Part: "staff.docx", Matches: 1}}, d.Inspect([]byte(message)))
+}
+
+func TestDLP_Handle(t *testing.T) {
+	message := "Subject: hi\r\n\r\ncard 4111-1111-1111-1111\r\n"
+
+	var notified []DLPFinding
+	d, err := NewDLP(DLPConfig{
+		Rules:  []DLPRule{DLPCreditCard},
+		Action: DLPQuarantine,
+		Notify: func(ctx *brisa.Context, findings []DLPFinding) { notified = findings },
+	})
+	require.NoError(t, err)
+
+	ctx := newTestContext(t, message)
+	assert.Equal(t, brisa.Quarantine, d.Handle(ctx))
+	assert.Len(t, notified, 1)
+	findings, ok := ctx.Get(DLPFindingsKey)
+	require.True(t, ok)
+	assert.Equal(t, notified, findings)
+	assert.Equal(t, message, readTestMessage(t, ctx))
+
+	d, err = NewDLP(DLPConfig{Rules: []DLPRule{DLPCreditCard}, Action: DLPNotify})
+	require.NoError(t, err)
+	assert.Equal(t, brisa.Pass, d.Handle(newTestContext(t, message)))
+
+	d, err = NewDLP(DLPConfig{Rules: []DLPRule{DLPCreditCard}, Action: DLPReject})
+	require.NoError(t, err)
+	assert.Equal(t, brisa.Reject, d.Handle(newTestContext(t, message)))
+	assert.Equal(t, brisa.Pass, d.Handle(newTestContext(t, "Subject: hi\r\n\r\nclean\r\n")))
+}
@@ -0,0 +1,280 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultDNSCacheSize is the default number of answers kept by a DNSResolver.
+	DefaultDNSCacheSize = 10000
+	// DefaultDNSCacheTTL is the default time an answer is cached.
+	DefaultDNSCacheTTL = 5 * time.Minute
+	// DefaultDNSNegativeTTL is the default time a "no such name" answer is cached.
+	DefaultDNSNegativeTTL = time.Minute
+	// DefaultDNSTimeout is the default timeout of a query to the upstream servers.
+	DefaultDNSTimeout = 5 * time.Second
+)
+
+// DNSLookuper is the set of DNS lookups used by the middleware. *net.Resolver,
+// *DNSResolver and brisatest.FakeResolver implement it.
+type DNSLookuper interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+}
+
+// DNSResolverConfig configures a DNSResolver.
+type DNSResolverConfig struct {
+	// Servers are the upstream name servers ("host" or "host:port"). Each query
+	// is sent to all of them at once and the first answer wins. Empty uses the
+	// system resolver.
+	Servers []string
+	// Upstreams replaces Servers with custom lookupers, e.g. for tests.
+	Upstreams []DNSLookuper
+	// CacheSize is the maximum number of cached answers; the least recently
+	// used are evicted first. Defaults to DefaultDNSCacheSize.
+	CacheSize int
+	// TTL is the time an answer is cached. Defaults to DefaultDNSCacheTTL.
+	TTL time.Duration
+	// NegativeTTL is the time a "no such name" answer is cached. Defaults to
+	// DefaultDNSNegativeTTL. Other failures are not cached.
+	NegativeTTL time.Duration
+	// Timeout bounds each query to the upstreams. Defaults to DefaultDNSTimeout.
+	Timeout time.Duration
+	// Clock expires the cached answers. Defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// DNSResolver is a DNS resolver with an LRU cache, shared by the middleware
+// so that the lookups of a message, and of the messages after it, do not hit
+// the network again. Concurrent lookups of the same name are merged into one
+// query. It is safe for concurrent use.
+//
+// The standard library does not report record TTLs, so answers are cached
+// for the configured TTL whatever their own.
+type DNSResolver struct {
+	cfg       DNSResolverConfig
+	upstreams []DNSLookuper
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // front is most recently used
+	inflight map[string]*dnsCall
+}
+
+type dnsEntry struct {
+	key     string
+	value   any
+	err     error
+	expires time.Time
+}
+
+type dnsCall struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// NewDNSResolver creates a new DNSResolver.
+func NewDNSResolver(cfg DNSResolverConfig) (*DNSResolver, error) {
+	if cfg.CacheSize < 0 || cfg.TTL < 0 || cfg.NegativeTTL < 0 || cfg.Timeout < 0 {
+		return nil, errors.New("dns resolver settings must not be negative")
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DefaultDNSCacheSize
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultDNSCacheTTL
+	}
+	if cfg.NegativeTTL == 0 {
+		cfg.NegativeTTL = DefaultDNSNegativeTTL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultDNSTimeout
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+
+	upstreams := cfg.Upstreams
+	if len(upstreams) == 0 {
+		for _, server := range cfg.Servers {
+			r, err := newServerResolver(server)
+			if err != nil {
+				return nil, err
+			}
+			upstreams = append(upstreams, r)
+		}
+	}
+	if len(upstreams) == 0 {
+		upstreams = []DNSLookuper{net.DefaultResolver}
+	}
+
+	return &DNSResolver{
+		cfg:       cfg,
+		upstreams: upstreams,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		inflight:  make(map[string]*dnsCall),
+	}, nil
+}
+
+// newServerResolver returns a resolver querying only server.
+func newServerResolver(server string) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	host, _, _ := net.SplitHostPort(server)
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid name server address: %s", server)
+	}
+	var d net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+var sharedResolver = sync.OnceValue(func() *DNSResolver {
+	r, _ := NewDNSResolver(DNSResolverConfig{})
+	return r
+})
+
+// SharedResolver returns the process-wide DNSResolver with the default
+// settings, used by middleware that are not given a resolver.
+func SharedResolver() *DNSResolver {
+	return sharedResolver()
+}
+
+// LookupHost implements DNSLookuper.
+func (r *DNSResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return dnsLookup(r, ctx, "A", host, DNSLookuper.LookupHost)
+}
+
+// LookupTXT implements DNSLookuper.
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return dnsLookup(r, ctx, "TXT", name, DNSLookuper.LookupTXT)
+}
+
+// LookupMX implements DNSLookuper.
+func (r *DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return dnsLookup(r, ctx, "MX", name, DNSLookuper.LookupMX)
+}
+
+// LookupAddr implements DNSLookuper.
+func (r *DNSResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return dnsLookup(r, ctx, "PTR", addr, DNSLookuper.LookupAddr)
+}
+
+// Len returns the number of cached answers, including expired ones not yet
+// evicted.
+func (r *DNSResolver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lru.Len()
+}
+
+// dnsLookup answers a query of the given kind from the cache or, on a miss,
+// from the upstreams. Returned slices are shared and must not be modified.
+func dnsLookup[T any](r *DNSResolver, ctx context.Context, kind, name string, lookup func(DNSLookuper, context.Context, string) (T, error)) (T, error) {
+	key := kind + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+
+	r.mu.Lock()
+	if e, ok := r.entries[key]; ok {
+		entry := e.Value.(*dnsEntry)
+		if r.cfg.Clock.Now().Before(entry.expires) {
+			r.lru.MoveToFront(e)
+			r.mu.Unlock()
+			value, _ := entry.value.(T)
+			return value, entry.err
+		}
+		r.lru.Remove(e)
+		delete(r.entries, key)
+	}
+	call, ok := r.inflight[key]
+	if !ok {
+		call = &dnsCall{done: make(chan struct{})}
+		r.inflight[key] = call
+		// The query is not bound to the first caller, whose context may be
+		// cancelled while others wait for the answer.
+		go r.resolve(key, call, func(ctx context.Context, u DNSLookuper) (any, error) {
+			return lookup(u, ctx, name)
+		})
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		value, _ := call.value.(T)
+		return value, call.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// resolve queries all upstreams at once and stores the first answer, or the
+// last failure if none answers.
+func (r *DNSResolver) resolve(key string, call *dnsCall, lookup func(context.Context, DNSLookuper) (any, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+
+	results := make(chan dnsCall, len(r.upstreams))
+	for _, u := range r.upstreams {
+		go func() {
+			value, err := lookup(ctx, u)
+			results <- dnsCall{value: value, err: err}
+		}()
+	}
+	for range r.upstreams {
+		res := <-results
+		call.value, call.err = res.value, res.err
+		if res.err == nil || isNotFound(res.err) {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	delete(r.inflight, key)
+	ttl := r.cfg.TTL
+	if call.err != nil {
+		ttl = r.cfg.NegativeTTL
+	}
+	if call.err == nil || isNotFound(call.err) {
+		r.store(&dnsEntry{key: key, value: call.value, err: call.err, expires: r.cfg.Clock.Now().Add(ttl)})
+	}
+	r.mu.Unlock()
+	close(call.done)
+}
+
+// store adds an entry, evicting the least recently used ones beyond the cache
+// size. It must be called with r.mu held.
+func (r *DNSResolver) store(entry *dnsEntry) {
+	if e, ok := r.entries[entry.key]; ok {
+		r.lru.Remove(e)
+	}
+	r.entries[entry.key] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.cfg.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*dnsEntry).key)
+	}
+}
+
+// isNotFound reports whether err is a definitive "no such name" answer.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
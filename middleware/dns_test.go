@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingLookuper counts the lookups reaching an upstream, optionally
+// delaying or failing them.
+type countingLookuper struct {
+	DNSLookuper
+	calls atomic.Int32
+	delay time.Duration
+	err   error
+}
+
+func (c *countingLookuper) LookupHost(ctx context.Context, host string) ([]string, error) {
+	c.calls.Add(1)
+	if c.delay > 0 {
+		select {
+		case <-time.After(c.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.DNSLookuper.LookupHost(ctx, host)
+}
+
+func TestDNSResolver_Cache(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Unix(1700000000, 0))
+	upstream := &countingLookuper{DNSLookuper: &brisatest.FakeResolver{Hosts: map[string][]string{
+		"a.example.com": {"192.0.2.1"},
+		"b.example.com": {"192.0.2.2"},
+		"c.example.com": {"192.0.2.3"},
+	}}}
+	r, err := NewDNSResolver(DNSResolverConfig{Upstreams: []DNSLookuper{upstream}, CacheSize: 2, Clock: clock})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	addrs, err := r.LookupHost(ctx, "a.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, addrs)
+	addrs, err = r.LookupHost(ctx, "A.Example.com.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, addrs)
+	assert.Equal(t, int32(1), upstream.calls.Load(), "second lookup must be cached")
+
+	// Not found answers are cached for the negative TTL.
+	_, err = r.LookupHost(ctx, "missing.example.com")
+	assert.True(t, isNotFound(err))
+	_, err = r.LookupHost(ctx, "missing.example.com")
+	assert.True(t, isNotFound(err))
+	assert.Equal(t, int32(2), upstream.calls.Load())
+	assert.Equal(t, 2, r.Len())
+
+	// b evicts a, the least recently used.
+	r.LookupHost(ctx, "missing.example.com")
+	r.LookupHost(ctx, "b.example.com")
+	r.LookupHost(ctx, "a.example.com")
+	assert.Equal(t, int32(4), upstream.calls.Load())
+
+	clock.Advance(DefaultDNSCacheTTL)
+	r.LookupHost(ctx, "a.example.com")
+	assert.Equal(t, int32(5), upstream.calls.Load(), "expired answer must be queried again")
+}
+
+func TestDNSResolver_FailuresNotCached(t *testing.T) {
+	upstream := &countingLookuper{DNSLookuper: &brisatest.FakeResolver{}, err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}
+	r, err := NewDNSResolver(DNSResolverConfig{Upstreams: []DNSLookuper{upstream}})
+	require.NoError(t, err)
+
+	for range 2 {
+		_, err := r.LookupHost(context.Background(), "a.example.com")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(2), upstream.calls.Load())
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestDNSResolver_FanOut(t *testing.T) {
+	records := &brisatest.FakeResolver{Hosts: map[string][]string{"a.example.com": {"192.0.2.1"}}}
+	slow := &countingLookuper{DNSLookuper: records, delay: time.Hour}
+	broken := &countingLookuper{DNSLookuper: records, err: errors.New("connection refused")}
+	fast := &countingLookuper{DNSLookuper: records}
+	r, err := NewDNSResolver(DNSResolverConfig{Upstreams: []DNSLookuper{slow, broken, fast}})
+	require.NoError(t, err)
+
+	addrs, err := r.LookupHost(context.Background(), "a.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, addrs)
+}
+
+func TestDNSResolver_MergesConcurrentLookups(t *testing.T) {
+	upstream := &countingLookuper{
+		DNSLookuper: &brisatest.FakeResolver{Hosts: map[string][]string{"a.example.com": {"192.0.2.1"}}},
+		delay:       50 * time.Millisecond,
+	}
+	r, err := NewDNSResolver(DNSResolverConfig{Upstreams: []DNSLookuper{upstream}})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := r.LookupHost(context.Background(), "a.example.com")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"192.0.2.1"}, addrs)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), upstream.calls.Load())
+
+	// A caller giving up does not cancel the query for the others.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.LookupTXT(ctx, "a.example.com")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestNewDNSResolver_Errors(t *testing.T) {
+	_, err := NewDNSResolver(DNSResolverConfig{Servers: []string{"ns.example.com"}})
+	assert.Error(t, err)
+	_, err = NewDNSResolver(DNSResolverConfig{TTL: -time.Second})
+	assert.Error(t, err)
+
+	r, err := NewDNSResolver(DNSResolverConfig{Servers: []string{"192.0.2.53", "[2001:db8::53]:5353"}})
+	require.NoError(t, err)
+	assert.Len(t, r.upstreams, 2)
+}
@@ -0,0 +1,291 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+// DSNAction is the action reported for a recipient in a delivery status
+// notification (RFC 3464, section 2.3.3).
+type DSNAction string
+
+const (
+	DSNFailed    DSNAction = "failed"
+	DSNDelayed   DSNAction = "delayed"
+	DSNDelivered DSNAction = "delivered"
+	DSNRelayed   DSNAction = "relayed"
+	DSNExpanded  DSNAction = "expanded"
+)
+
+// ErrDSNNotRequested is returned by WriteDSN when no recipient of the report
+// asked for a notification, or the message had a null sender.
+var ErrDSNNotRequested = errors.New("no delivery status notification requested")
+
+// DSNRecipient is the delivery status of one recipient.
+type DSNRecipient struct {
+	// Recipient is the envelope recipient.
+	Recipient string
+	// Options are the RCPT TO parameters, with NOTIFY and ORCPT.
+	Options *smtp.RcptOptions
+	Action  DSNAction
+	// Status is the enhanced status code, e.g. "5.1.1".
+	Status string
+	// DiagnosticCode is the reply of the remote server, e.g.
+	// "550 5.1.1 No such user".
+	DiagnosticCode string
+	// RemoteMTA is the server that gave the reply.
+	RemoteMTA   string
+	LastAttempt time.Time
+	// WillRetryUntil is the time a delayed message expires.
+	WillRetryUntil time.Time
+}
+
+// DSNReport is a delivery status notification about one message.
+type DSNReport struct {
+	// ReportingMTA is the host name of this server.
+	ReportingMTA string
+	// Sender is the envelope sender of the message, who receives the report.
+	Sender string
+	// EnvelopeID and Return are the ENVID and RET parameters of MAIL FROM.
+	EnvelopeID  string
+	Return      smtp.DSNReturn
+	ArrivalDate time.Time
+	Recipients  []DSNRecipient
+	// Date is the date of the report. Defaults to the current time.
+	Date time.Time
+	// UTF8 makes the report internationalized (RFC 6533), for messages sent
+	// with SMTPUTF8: its status part is message/global-delivery-status, which
+	// may hold UTF-8 addresses, and the original message is returned as
+	// message/global or message/global-headers. The report must then be sent
+	// with SMTPUTF8 as well.
+	UTF8 bool
+}
+
+// NewDSNReport returns a report for the message of ctx, with the sender and
+// the DSN parameters of its envelope. The recipients are added by the caller
+// as their delivery completes.
+func NewDSNReport(ctx *brisa.Context, reportingMTA string, arrival time.Time) *DSNReport {
+	r := &DSNReport{ReportingMTA: reportingMTA, Sender: ctx.From, ArrivalDate: arrival, UTF8: ctx.SMTPUTF8()}
+	if ctx.FromOptions != nil {
+		r.EnvelopeID = ctx.FromOptions.EnvelopeID
+		r.Return = ctx.FromOptions.Return
+	}
+	return r
+}
+
+// WantsDSN reports whether a recipient with the RCPT TO parameters opts asked
+// to be notified of action. Without a NOTIFY parameter, failures and delays
+// are reported.
+func WantsDSN(opts *smtp.RcptOptions, action DSNAction) bool {
+	var notify []smtp.DSNNotify
+	if opts != nil {
+		notify = opts.Notify
+	}
+	if len(notify) == 0 {
+		return action == DSNFailed || action == DSNDelayed
+	}
+	switch action {
+	case DSNFailed:
+		return slices.Contains(notify, smtp.DSNNotifyFailure)
+	case DSNDelayed:
+		return slices.Contains(notify, smtp.DSNNotifyDelayed)
+	case DSNDelivered, DSNRelayed, DSNExpanded:
+		return slices.Contains(notify, smtp.DSNNotifySuccess)
+	}
+	return false
+}
+
+// WriteDSN writes the report as a multipart/report message (RFC 3464) to w,
+// ready to be sent with a null envelope sender to r.Sender. Only recipients
+// that asked for a notification of their action are reported. The original
+// message is returned in full with RET=FULL and as its header otherwise.
+func WriteDSN(w io.Writer, r *DSNReport, original io.Reader) error {
+	if r.Sender == "" {
+		return ErrDSNNotRequested
+	}
+	var rcpts []DSNRecipient
+	for _, rcpt := range r.Recipients {
+		if WantsDSN(rcpt.Options, rcpt.Action) {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		return ErrDSNNotRequested
+	}
+	date := r.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	// Human readable explanation.
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	writeDSNText(part, r, rcpts)
+
+	// Machine readable status.
+	statusType, messageType, headersType := "message/delivery-status", "message/rfc822", "text/rfc822-headers"
+	if r.UTF8 {
+		statusType, messageType, headersType = "message/global-delivery-status", "message/global", "message/global-headers"
+	}
+	part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {statusType}})
+	if err != nil {
+		return err
+	}
+	writeDeliveryStatus(part, r, rcpts)
+
+	// The original message or its header.
+	if original != nil {
+		contentType := headersType
+		if r.Return == smtp.DSNReturnFull {
+			contentType = messageType
+		}
+		part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return err
+		}
+		if r.Return == smtp.DSNReturnFull {
+			_, err = io.Copy(part, original)
+		} else {
+			var h *messageHeader
+			h, err = readHeader(bufio.NewReader(original))
+			if err == nil {
+				_, err = part.Write(h.Bytes())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read original message: %w", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	h := &messageHeader{}
+	h.Add("From", "Mail Delivery System <MAILER-DAEMON@"+r.ReportingMTA+">")
+	h.Add("To", r.Sender)
+	h.Add("Subject", dsnSubject(rcpts))
+	h.Add("Date", date.Format(time.RFC1123Z))
+	h.Add("Message-ID", "<"+uuid.NewString()+"@"+r.ReportingMTA+">")
+	h.Add("Auto-Submitted", "auto-replied")
+	h.Add("MIME-Version", "1.0")
+	h.Add("Content-Type", `multipart/report; report-type=delivery-status; boundary="`+mw.Boundary()+`"`)
+	if _, err := w.Write(h.Bytes()); err != nil {
+		return err
+	}
+	_, err = body.WriteTo(w)
+	return err
+}
+
+// dsnSubject summarizes the reported actions.
+func dsnSubject(rcpts []DSNRecipient) string {
+	action := rcpts[0].Action
+	for _, rcpt := range rcpts[1:] {
+		if rcpt.Action != action {
+			return "Delivery Status Notification"
+		}
+	}
+	switch action {
+	case DSNFailed:
+		return "Undelivered Mail Returned to Sender"
+	case DSNDelayed:
+		return "Delayed Mail (still being retried)"
+	default:
+		return "Successful Mail Delivery Report"
+	}
+}
+
+func writeDSNText(w io.Writer, r *DSNReport, rcpts []DSNRecipient) {
+	fmt.Fprintf(w, "This is the mail system at host %s.\r\n\r\n", r.ReportingMTA)
+	for _, rcpt := range rcpts {
+		switch rcpt.Action {
+		case DSNFailed:
+			fmt.Fprintf(w, "Your message could not be delivered to <%s>.\r\n", rcpt.Recipient)
+		case DSNDelayed:
+			fmt.Fprintf(w, "Delivery of your message to <%s> has been delayed; it will be retried", rcpt.Recipient)
+			if !rcpt.WillRetryUntil.IsZero() {
+				fmt.Fprintf(w, " until %s", rcpt.WillRetryUntil.Format(time.RFC1123Z))
+			}
+			fmt.Fprint(w, ".\r\n")
+		default:
+			fmt.Fprintf(w, "Your message to <%s> was %s.\r\n", rcpt.Recipient, rcpt.Action)
+		}
+		if rcpt.DiagnosticCode != "" {
+			fmt.Fprintf(w, "    %s\r\n", rcpt.DiagnosticCode)
+		}
+	}
+}
+
+// writeDeliveryStatus writes the per-message and per-recipient fields of
+// RFC 3464, section 2.2 and 2.3.
+func writeDeliveryStatus(w io.Writer, r *DSNReport, rcpts []DSNRecipient) {
+	if r.EnvelopeID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %s\r\n", r.EnvelopeID)
+	}
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(w, "Arrival-Date: %s\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range rcpts {
+		fmt.Fprint(w, "\r\n")
+		if rcpt.Options != nil && rcpt.Options.OriginalRecipient != "" {
+			typ := rcpt.Options.OriginalRecipientType
+			if typ == "" {
+				typ = smtp.DSNAddressTypeRFC822
+			}
+			fmt.Fprintf(w, "Original-Recipient: %s;%s\r\n", strings.ToLower(string(typ)), rcpt.Options.OriginalRecipient)
+		}
+		typ := "rfc822"
+		if r.UTF8 && address.NeedsSMTPUTF8(rcpt.Recipient) {
+			typ = "utf-8"
+		}
+		fmt.Fprintf(w, "Final-Recipient: %s; %s\r\n", typ, rcpt.Recipient)
+		fmt.Fprintf(w, "Action: %s\r\n", rcpt.Action)
+		status := rcpt.Status
+		if status == "" {
+			status = defaultDSNStatus(rcpt.Action)
+		}
+		fmt.Fprintf(w, "Status: %s\r\n", status)
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(w, "Remote-MTA: dns; %s\r\n", rcpt.RemoteMTA)
+		}
+		if rcpt.DiagnosticCode != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %s\r\n", rcpt.DiagnosticCode)
+		}
+		if !rcpt.LastAttempt.IsZero() {
+			fmt.Fprintf(w, "Last-Attempt-Date: %s\r\n", rcpt.LastAttempt.Format(time.RFC1123Z))
+		}
+		if !rcpt.WillRetryUntil.IsZero() {
+			fmt.Fprintf(w, "Will-Retry-Until: %s\r\n", rcpt.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+}
+
+// defaultDSNStatus is the generic status of an action.
+func defaultDSNStatus(action DSNAction) string {
+	switch action {
+	case DSNFailed:
+		return "5.0.0"
+	case DSNDelayed:
+		return "4.0.0"
+	default:
+		return "2.0.0"
+	}
+}
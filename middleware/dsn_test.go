@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWantsDSN(t *testing.T) {
+	notify := func(n ...smtp.DSNNotify) *smtp.RcptOptions { return &smtp.RcptOptions{Notify: n} }
+
+	assert.True(t, WantsDSN(nil, DSNFailed))
+	assert.True(t, WantsDSN(&smtp.RcptOptions{}, DSNDelayed))
+	assert.False(t, WantsDSN(nil, DSNDelivered))
+	assert.False(t, WantsDSN(notify(smtp.DSNNotifyNever), DSNFailed))
+	assert.True(t, WantsDSN(notify(smtp.DSNNotifySuccess), DSNDelivered))
+	assert.False(t, WantsDSN(notify(smtp.DSNNotifySuccess), DSNFailed))
+	assert.True(t, WantsDSN(notify(smtp.DSNNotifyFailure, smtp.DSNNotifyDelayed), DSNDelayed))
+}
+
+// readDSN parses a report written by WriteDSN into its parts.
+func readDSN(t *testing.T, data []byte) (*mail.Message, []string, []string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/report", mediaType)
+	assert.Equal(t, "delivery-status", params["report-type"])
+
+	var types, bodies []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, _ := io.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	return msg, types, bodies
+}
+
+func TestWriteDSN(t *testing.T) {
+	ctx := newTestContext(t, "")
+	ctx.From = "alice@example.com"
+	ctx.FromOptions = &smtp.MailOptions{EnvelopeID: "QQ314159", Return: smtp.DSNReturnHeaders}
+	arrival := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	report := NewDSNReport(ctx, "mx.example.net", arrival)
+	report.Recipients = []DSNRecipient{
+		{
+			Recipient:      "bob@example.org",
+			Options:        &smtp.RcptOptions{OriginalRecipientType: smtp.DSNAddressTypeRFC822, OriginalRecipient: "Bob@example.org"},
+			Action:         DSNFailed,
+			Status:         "5.1.1",
+			DiagnosticCode: "550 5.1.1 No such user",
+			RemoteMTA:      "mx.example.org",
+		},
+		// Did not ask to be notified.
+		{Recipient: "carol@example.org", Options: &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}}, Action: DSNFailed},
+		{Recipient: "dave@example.org", Action: DSNDelivered},
+	}
+
+	original := "Subject: hello\r\nMessage-ID: <1@example.com>\r\n\r\nsecret body\r\n"
+	var buf bytes.Buffer
+	require.NoError(t, WriteDSN(&buf, report, strings.NewReader(original)))
+
+	msg, types, bodies := readDSN(t, buf.Bytes())
+	assert.Equal(t, "alice@example.com", msg.Header.Get("To"))
+	assert.Equal(t, "Undelivered Mail Returned to Sender", msg.Header.Get("Subject"))
+	assert.Equal(t, "auto-replied", msg.Header.Get("Auto-Submitted"))
+	require.Equal(t, []string{"text/plain; charset=utf-8", "message/delivery-status", "text/rfc822-headers"}, types)
+
+	assert.Contains(t, bodies[0], "<bob@example.org>")
+	status := bodies[1]
+	assert.Contains(t, status, "Original-Envelope-Id: QQ314159\r\n")
+	assert.Contains(t, status, "Reporting-MTA: dns; mx.example.net\r\n")
+	assert.Contains(t, status, "Arrival-Date: Fri, 01 Mar 2024 12:00:00 +0000\r\n")
+	assert.Contains(t, status, "Original-Recipient: rfc822;Bob@example.org\r\n")
+	assert.Contains(t, status, "Final-Recipient: rfc822; bob@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\n")
+	assert.Contains(t, status, "Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n")
+	assert.NotContains(t, status, "carol@example.org")
+	assert.NotContains(t, status, "dave@example.org")
+
+	// RET=HDRS returns only the header.
+	assert.Contains(t, bodies[2], "Subject: hello")
+	assert.NotContains(t, bodies[2], "secret body")
+}
+
+func TestWriteDSN_ReturnFull(t *testing.T) {
+	report := &DSNReport{
+		ReportingMTA: "mx.example.net",
+		Sender:       "alice@example.com",
+		Return:       smtp.DSNReturnFull,
+		Recipients:   []DSNRecipient{{Recipient: "bob@example.org", Action: DSNDelayed, WillRetryUntil: time.Now().Add(time.Hour)}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteDSN(&buf, report, strings.NewReader("Subject: hello\r\n\r\nbody\r\n")))
+	msg, types, bodies := readDSN(t, buf.Bytes())
+	assert.Equal(t, "Delayed Mail (still being retried)", msg.Header.Get("Subject"))
+	assert.Equal(t, "message/rfc822", types[2])
+	assert.Contains(t, bodies[1], "Status: 4.0.0\r\n")
+	assert.Contains(t, bodies[1], "Will-Retry-Until: ")
+	assert.Contains(t, bodies[2], "body")
+}
+
+func TestWriteDSN_UTF8(t *testing.T) {
+	ctx := newTestContext(t, "")
+	ctx.From = "jörg@xn--bcher-kva.example"
+	ctx.FromOptions = &smtp.MailOptions{UTF8: true, Return: smtp.DSNReturnHeaders}
+	report := NewDSNReport(ctx, "mx.example.net", time.Time{})
+	assert.True(t, report.UTF8)
+	report.Recipients = []DSNRecipient{
+		{Recipient: "用户@xn--fsqu00a.xn--4rr70v", Action: DSNFailed, Status: "5.1.1"},
+		{Recipient: "bob@example.org", Action: DSNFailed, Status: "5.1.1"},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteDSN(&buf, report, strings.NewReader("Subject: Grüße\r\n\r\nbody\r\n")))
+	msg, types, bodies := readDSN(t, buf.Bytes())
+	assert.Equal(t, "jörg@xn--bcher-kva.example", msg.Header.Get("To"))
+	assert.Equal(t, []string{"text/plain; charset=utf-8", "message/global-delivery-status", "message/global-headers"}, types)
+	assert.Contains(t, bodies[1], "Final-Recipient: utf-8; 用户@xn--fsqu00a.xn--4rr70v\r\n")
+	assert.Contains(t, bodies[1], "Final-Recipient: rfc822; bob@example.org\r\n")
+	assert.Contains(t, bodies[2], "Subject: Grüße")
+}
+
+func TestWriteDSN_NotRequested(t *testing.T) {
+	// Bounces are never sent for a null sender.
+	report := &DSNReport{ReportingMTA: "mx.example.net", Recipients: []DSNRecipient{{Recipient: "bob@example.org", Action: DSNFailed}}}
+	assert.ErrorIs(t, WriteDSN(io.Discard, report, nil), ErrDSNNotRequested)
+
+	report.Sender = "alice@example.com"
+	report.Recipients[0].Action = DSNDelivered
+	assert.ErrorIs(t, WriteDSN(io.Discard, report, nil), ErrDSNNotRequested)
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// DefaultEarlyTalkerScore is the default score added to messages of early
+// talkers.
+const DefaultEarlyTalkerScore = 5.0
+
+// ErrEarlyTalker is returned to clients that talked before the greeting.
+var ErrEarlyTalker = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+	Message:      "Protocol violation: commands sent before the greeting",
+}
+
+// EarlyTalkerAction defines what EarlyTalker does with an early talker.
+type EarlyTalkerAction int
+
+const (
+	// EarlyTalkerReject refuses the client with the configured reply.
+	EarlyTalkerReject EarlyTalkerAction = iota
+	// EarlyTalkerScore lets the client through, adding Score to its messages.
+	EarlyTalkerScore
+)
+
+// EarlyTalkerConfig configures the EarlyTalker middleware.
+type EarlyTalkerConfig struct {
+	// Action defaults to EarlyTalkerReject.
+	Action EarlyTalkerAction
+	// Score is added to messages of early talkers. Defaults to
+	// DefaultEarlyTalkerScore.
+	Score float64
+	// Reply defaults to ErrEarlyTalker.
+	Reply *smtp.SMTPError
+}
+
+// EarlyTalker acts on sessions with brisa.FlagEarlyTalker: clients that sent
+// commands before the greeting or pipelined their first HELO or EHLO, which
+// legitimate servers do not do. The flag is set by connections accepted with
+// brisa.NewGreetListener.
+//
+// To reject, it runs in the Conn chain. To score, it runs in the Data chain,
+// as the score is reset for every transaction.
+type EarlyTalker struct {
+	cfg EarlyTalkerConfig
+}
+
+// NewEarlyTalker creates a new EarlyTalker instance.
+func NewEarlyTalker(cfg EarlyTalkerConfig) (*EarlyTalker, error) {
+	if cfg.Score < 0 {
+		return nil, fmt.Errorf("early talker score must not be negative")
+	}
+	if cfg.Score == 0 {
+		cfg.Score = DefaultEarlyTalkerScore
+	}
+	if cfg.Reply == nil {
+		cfg.Reply = ErrEarlyTalker
+	}
+	return &EarlyTalker{cfg: cfg}, nil
+}
+
+// NewEarlyTalkerHandler creates a new middleware handler acting on early
+// talkers.
+func NewEarlyTalkerHandler(cfg EarlyTalkerConfig) (brisa.Handler, error) {
+	e, err := NewEarlyTalker(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return e.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (e *EarlyTalker) Handle(ctx *brisa.Context) brisa.Action {
+	if !ctx.HasFlag(brisa.FlagEarlyTalker) {
+		return brisa.Pass
+	}
+	if e.cfg.Action == EarlyTalkerScore {
+		ctx.Score += e.cfg.Score
+		return brisa.Pass
+	}
+	ctx.Logger.Info("early talker rejected", "ip", clientIP(ctx))
+	return ctx.RejectWith(e.cfg.Reply)
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEarlyTalker_Reject(t *testing.T) {
+	h, err := NewEarlyTalkerHandler(EarlyTalkerConfig{})
+	require.NoError(t, err)
+	router := &brisa.Router{brisa.ChainConn: {{Handler: h}}}
+
+	env := brisatest.DefaultEnvelope()
+	brisatest.Run(t, router, env, "\r\nbody\r\n").AssertAction(t, brisa.Deliver)
+
+	env.EarlyTalker = true
+	res := brisatest.Run(t, router, env, "\r\nbody\r\n")
+	res.AssertAction(t, brisa.Reject)
+	assert.Equal(t, brisa.ChainConn, res.Chain)
+	assert.Equal(t, ErrEarlyTalker, res.Err)
+}
+
+func TestEarlyTalker_Score(t *testing.T) {
+	h, err := NewEarlyTalkerHandler(EarlyTalkerConfig{Action: EarlyTalkerScore, Score: 3})
+	require.NoError(t, err)
+	router := &brisa.Router{brisa.ChainData: {{Handler: h}}}
+
+	env := brisatest.DefaultEnvelope()
+	env.EarlyTalker = true
+	res := brisatest.Run(t, router, env, "\r\nbody\r\n")
+	res.AssertAction(t, brisa.Deliver)
+	assert.Equal(t, 3.0, res.Score)
+
+	_, err = NewEarlyTalker(EarlyTalkerConfig{Score: -1})
+	assert.Error(t, err)
+}
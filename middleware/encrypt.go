@@ -0,0 +1,304 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+// ErrEncryptionKeyMissing is returned when a message must be encrypted but no
+// key is known for one of its recipients.
+var ErrEncryptionKeyMissing = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Encryption required but no key found for recipient",
+}
+
+// ErrEncryptionKeyLookup is returned when a message must be encrypted but
+// the key of a recipient could not be looked up. It is temporary, as the
+// lookup may succeed on the next attempt.
+var ErrEncryptionKeyLookup = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Encryption key lookup failed, please try again later",
+}
+
+// ErrEncryptionFailed is returned when a message must be encrypted but could
+// not be read or encrypted.
+var ErrEncryptionFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Encryption failed, please try again later",
+}
+
+// ErrEncryptionTooLarge is returned when a message must be encrypted but is
+// larger than EncryptorConfig.MaxSize.
+var ErrEncryptionTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message too big to encrypt",
+}
+
+// EncryptedKey is the context key set to the format of the message, "smime"
+// or "pgp", when it has been encrypted by the Encryptor middleware.
+const EncryptedKey = "encrypted"
+
+// DefaultEncryptMaxSize is the default of EncryptorConfig.MaxSize.
+const DefaultEncryptMaxSize = 64 << 20
+
+// EncryptorConfig configures the Encryptor middleware. At least one of
+// Certificates and PGPKeys is required.
+type EncryptorConfig struct {
+	// Certificates returns the S/MIME certificates of recipients.
+	Certificates CertificateSource
+	// PGPKeys returns the OpenPGP keys of recipients.
+	PGPKeys PGPKeySource
+	// Domains are the recipient domains with a mandatory encryption policy. A
+	// message to any of them is encrypted for all of its recipients, and
+	// rejected with ErrEncryptionKeyMissing if a recipient has no key.
+	Domains []string
+	// Opportunistic also encrypts messages to other recipients when all of them
+	// have a key.
+	Opportunistic bool
+	// MaxSize is the size of the largest message encrypted. Larger messages
+	// are rejected if encryption is mandatory and left as they are otherwise.
+	// Zero means DefaultEncryptMaxSize.
+	MaxSize int64
+}
+
+// Encryptor encrypts messages to the keys of their recipients before storage
+// or relay: to their S/MIME certificates (RFC 8551) if all recipients have
+// one, and to their OpenPGP keys with PGP/MIME (RFC 3156) otherwise.
+//
+// Routing headers such as From, To and Subject stay readable; the Content-*
+// headers and the body are encrypted. The message is spooled (see
+// brisa.Context.SpoolMessage) and encrypted from the spool to a new one, so
+// it is not held in memory beyond the budget of the spools. It is meant for
+// the Deliver chain; register it with IgnoreFlags that do not include
+// IgnoreDeliver.
+type Encryptor struct {
+	cfg     EncryptorConfig
+	domains map[string]struct{}
+}
+
+// NewEncryptor creates a new Encryptor instance.
+func NewEncryptor(cfg EncryptorConfig) (*Encryptor, error) {
+	if cfg.Certificates == nil && cfg.PGPKeys == nil {
+		return nil, fmt.Errorf("encryptor needs a certificate or OpenPGP key source")
+	}
+	if len(cfg.Domains) == 0 && !cfg.Opportunistic {
+		return nil, fmt.Errorf("encryptor needs mandatory domains or opportunistic encryption")
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultEncryptMaxSize
+	}
+	e := &Encryptor{cfg: cfg, domains: make(map[string]struct{})}
+	for _, d := range cfg.Domains {
+		e.domains[address.NormalizeDomain(strings.TrimSpace(d))] = struct{}{}
+	}
+	return e, nil
+}
+
+// NewEncryptorHandler creates a new Deliver middleware handler encrypting messages.
+func NewEncryptorHandler(cfg EncryptorConfig) (brisa.Handler, error) {
+	e, err := NewEncryptor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return e.Handle, nil
+}
+
+// encryptFunc writes the message of header h and body to w, encrypted; size
+// is the length of the body.
+type encryptFunc func(w io.Writer, h *messageHeader, body io.Reader, size int64) error
+
+// Handle is the brisa.Handler of the middleware. It leaves the action unchanged
+// unless a mandatory encryption policy cannot be met.
+func (e *Encryptor) Handle(ctx *brisa.Context) brisa.Action {
+	if len(ctx.To) == 0 {
+		return ctx.Action
+	}
+
+	mandatory := false
+	for _, rcpt := range ctx.To {
+		if _, ok := e.domains[domainOf(rcpt)]; ok {
+			mandatory = true
+			break
+		}
+	}
+	if !mandatory && !e.cfg.Opportunistic {
+		return ctx.Action
+	}
+
+	format, encrypt, err := e.encryption(ctx.To)
+	switch {
+	case err != nil:
+		ctx.Logger.Error("encryption key lookup failed", "error", err)
+		if mandatory {
+			return ctx.RejectWith(ErrEncryptionKeyLookup)
+		}
+		return ctx.Action
+	case encrypt == nil:
+		if mandatory {
+			ctx.Logger.Warn("no encryption key for a recipient")
+			return ctx.RejectWith(ErrEncryptionKeyMissing)
+		}
+		return ctx.Action
+	}
+
+	sp, err := ctx.SpoolMessage()
+	if err != nil {
+		ctx.Logger.Error("failed to spool message", "error", err)
+		return e.failed(ctx, mandatory, ErrEncryptionFailed)
+	}
+	if sp.Len() > e.cfg.MaxSize {
+		ctx.Logger.Warn("message too big to encrypt", "size", sp.Len())
+		return e.failed(ctx, mandatory, ErrEncryptionTooLarge)
+	}
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return e.failed(ctx, mandatory, ErrEncryptionFailed)
+	}
+	size := sp.Len()
+	if b, ok := body.(*spooledBody); ok {
+		size -= b.off
+	}
+	out := ctx.NewSpool()
+	w := bufio.NewWriterSize(out, 32*1024)
+	err = encrypt(w, h, body, size)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		ctx.Logger.Error("failed to encrypt message", "error", err)
+		return e.failed(ctx, mandatory, ErrEncryptionFailed)
+	}
+	ctx.SetMessageSpool(out)
+	ctx.Set(EncryptedKey, format)
+	return ctx.Action
+}
+
+// encryption returns the format and encryption of a message to rcpts: S/MIME
+// if all of them have a certificate, OpenPGP if all of them have an OpenPGP
+// key, and none otherwise.
+func (e *Encryptor) encryption(rcpts []string) (string, encryptFunc, error) {
+	if e.cfg.Certificates != nil {
+		certs, err := lookupKeys(rcpts, e.cfg.Certificates)
+		if err != nil {
+			return "", nil, err
+		}
+		if certs != nil {
+			return "smime", func(w io.Writer, h *messageHeader, body io.Reader, size int64) error {
+				return writeSMIME(w, h, body, size, certs)
+			}, nil
+		}
+	}
+	if e.cfg.PGPKeys != nil {
+		keys, err := lookupKeys(rcpts, e.cfg.PGPKeys)
+		if err != nil {
+			return "", nil, err
+		}
+		if keys != nil {
+			return "pgp", func(w io.Writer, h *messageHeader, body io.Reader, size int64) error {
+				return writePGPMIME(w, h, body, size, keys)
+			}, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// lookupKeys returns the keys of all rcpts, or nil if one of them has none.
+func lookupKeys[K comparable](rcpts []string, lookup func(rcpt string) (K, error)) ([]K, error) {
+	var zero K
+	keys := make([]K, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		key, err := lookup(rcpt)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rcpt, err)
+		}
+		if key == zero {
+			return nil, nil
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// failed returns the action for a message that could not be encrypted: only
+// mandatory encryption rejects it, with err.
+func (e *Encryptor) failed(ctx *brisa.Context, mandatory bool, err *smtp.SMTPError) brisa.Action {
+	if mandatory {
+		return ctx.RejectWith(err)
+	}
+	return ctx.Action
+}
+
+// domainOf returns the domain of an address normalized by
+// address.NormalizeDomain.
+func domainOf(addr string) string {
+	return address.NormalizeDomain(address.Domain(addr))
+}
+
+// splitContentHeader splits h into the outer header of an encrypted message,
+// without the Content-* and MIME-Version fields, and the header of the
+// encrypted MIME entity, with the Content-* fields and the empty line ending
+// it.
+func splitContentHeader(h *messageHeader) (*messageHeader, []byte) {
+	var entity bytes.Buffer
+	outer := &messageHeader{}
+	for _, f := range h.fields {
+		switch {
+		case strings.HasPrefix(f.Key, "Content-"):
+			entity.Write(f.Raw)
+		case f.Key == "Mime-Version":
+		default:
+			outer.fields = append(outer.fields, f)
+		}
+	}
+	entity.WriteString("\r\n")
+	return outer, entity.Bytes()
+}
+
+// lineWriter breaks the text written to w into lines of n bytes, ending each
+// with CRLF; Close ends the last line.
+type lineWriter struct {
+	w   io.Writer
+	n   int
+	col int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.col == l.n {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+		k := min(len(p), l.n-l.col)
+		if _, err := l.w.Write(p[:k]); err != nil {
+			return written, err
+		}
+		p = p[k:]
+		l.col += k
+		written += k
+	}
+	return written, nil
+}
+
+func (l *lineWriter) Close() error {
+	if l.col == 0 {
+		return nil
+	}
+	l.col = 0
+	_, err := io.WriteString(l.w, "\r\n")
+	return err
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptor_Policy(t *testing.T) {
+	cert, _ := newTestCertificate(t, "bob@secure.example")
+	certs := func(rcpt string) (*x509.Certificate, error) {
+		switch rcpt {
+		case "bob@secure.example":
+			return cert, nil
+		case "down@secure.example", "down@example.com":
+			return nil, errors.New("directory unavailable")
+		}
+		return nil, nil
+	}
+	message := "Subject: hi\r\n\r\nbody\r\n"
+	run := func(e *Encryptor, to ...string) (*brisa.Context, brisa.Action) {
+		ctx := newTestContext(t, message)
+		ctx.Action = brisa.Deliver
+		ctx.To = to
+		return ctx, e.Handle(ctx)
+	}
+
+	e, err := NewEncryptor(EncryptorConfig{Certificates: certs, Domains: []string{"secure.example"}})
+	require.NoError(t, err)
+
+	// Mandatory domain with a recipient lacking a certificate.
+	ctx, action := run(e, "bob@secure.example", "carol@secure.example")
+	assert.Equal(t, brisa.Reject, action)
+	assert.Equal(t, ErrEncryptionKeyMissing, ctx.RejectError())
+
+	// A failed lookup is temporary.
+	ctx, action = run(e, "bob@secure.example", "down@secure.example")
+	assert.Equal(t, brisa.Reject, action)
+	assert.Equal(t, ErrEncryptionKeyLookup, ctx.RejectError())
+
+	// No mandatory domain involved: untouched.
+	ctx, action = run(e, "dave@example.com")
+	assert.Equal(t, brisa.Deliver, action)
+	assert.Equal(t, message, readTestMessage(t, ctx))
+
+	// Opportunistic encryption skips recipients without certificates, and
+	// failed lookups.
+	e, err = NewEncryptor(EncryptorConfig{Certificates: certs, Opportunistic: true})
+	require.NoError(t, err)
+	for _, rcpt := range []string{"dave@example.com", "down@example.com"} {
+		ctx, action = run(e, "bob@secure.example", rcpt)
+		assert.Equal(t, brisa.Deliver, action)
+		assert.Equal(t, message, readTestMessage(t, ctx))
+	}
+}
+
+func TestEncryptor_Failures(t *testing.T) {
+	cert, _ := newTestCertificate(t, "bob@secure.example")
+	message := "Subject: hi\r\n\r\n" + strings.Repeat("body\r\n", 100)
+
+	// Messages above MaxSize are not encrypted.
+	e, err := NewEncryptor(EncryptorConfig{
+		Certificates: func(string) (*x509.Certificate, error) { return cert, nil },
+		Domains:      []string{"secure.example"},
+		MaxSize:      100,
+	})
+	require.NoError(t, err)
+	ctx := newTestContext(t, message)
+	ctx.Action = brisa.Deliver
+	ctx.To = []string{"bob@secure.example"}
+	assert.Equal(t, brisa.Reject, e.Handle(ctx))
+	assert.Equal(t, ErrEncryptionTooLarge, ctx.RejectError())
+	assert.Equal(t, message, readTestMessage(t, ctx))
+
+	// A key that cannot encrypt fails temporarily and leaves the message.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "carol@secure.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	ecCert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	e, err = NewEncryptor(EncryptorConfig{
+		Certificates: func(string) (*x509.Certificate, error) { return ecCert, nil },
+		Domains:      []string{"secure.example"},
+	})
+	require.NoError(t, err)
+	ctx = newTestContext(t, message)
+	ctx.Action = brisa.Deliver
+	ctx.To = []string{"carol@secure.example"}
+	assert.Equal(t, brisa.Reject, e.Handle(ctx))
+	assert.Equal(t, ErrEncryptionFailed, ctx.RejectError())
+	assert.Equal(t, message, readTestMessage(t, ctx))
+}
+
+func TestEncryptor_Format(t *testing.T) {
+	cert, _ := newTestCertificate(t, "bob@secure.example")
+	e, err := NewEncryptor(EncryptorConfig{
+		Certificates: func(rcpt string) (*x509.Certificate, error) {
+			if rcpt == "bob@secure.example" {
+				return cert, nil
+			}
+			return nil, nil
+		},
+		PGPKeys: func(rcpt string) (*PGPKey, error) {
+			return ParsePGPKey([]byte(testPGPCertificate), "")
+		},
+		Domains: []string{"secure.example"},
+	})
+	require.NoError(t, err)
+
+	// S/MIME if every recipient has a certificate, OpenPGP otherwise.
+	for _, tt := range []struct {
+		to     []string
+		format string
+	}{
+		{[]string{"bob@secure.example"}, "smime"},
+		{[]string{"bob@secure.example", "carol@secure.example"}, "pgp"},
+	} {
+		ctx := newTestContext(t, "Subject: hi\r\n\r\nbody\r\n")
+		ctx.Action = brisa.Deliver
+		ctx.To = tt.to
+		assert.Equal(t, brisa.Deliver, e.Handle(ctx))
+		format, _ := ctx.Get(EncryptedKey)
+		assert.Equal(t, tt.format, format, "%v", tt.to)
+	}
+}
@@ -0,0 +1,224 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+const (
+	// DefaultGreylistKeyPrefix is the default prefix of the Store keys
+	// written by Greylist.
+	DefaultGreylistKeyPrefix = "greylist:"
+	// DefaultGreylistDelay is the default time a client must wait before
+	// retrying.
+	DefaultGreylistDelay = 5 * time.Minute
+	// DefaultGreylistRetryWindow is the default time after the first attempt
+	// within which a retry passes.
+	DefaultGreylistRetryWindow = 24 * time.Hour
+	// DefaultGreylistPassTTL is the default time a passed triplet is not
+	// greylisted again.
+	DefaultGreylistPassTTL = 36 * 24 * time.Hour
+	// DefaultKnownSenderTTL is the default time a sender domain is known
+	// after its last authenticated message.
+	DefaultKnownSenderTTL = 60 * 24 * time.Hour
+	// DefaultGreylistSPFTimeout is the default timeout of the SPF check.
+	DefaultGreylistSPFTimeout = 5 * time.Second
+)
+
+// DKIMDomainsKey is the context key holding the signing domains ([]string) of
+// the valid DKIM signatures of the message, set by a DKIM verifier.
+const DKIMDomainsKey = "dkim.domains"
+
+// ErrGreylisted is returned for the first attempt of an unknown client,
+// sender and recipient triplet.
+var ErrGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Greylisted, please try again later",
+}
+
+// GreylistConfig configures the Greylist middleware.
+type GreylistConfig struct {
+	// Store holds the triplets and known senders. It is required.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultGreylistKeyPrefix.
+	KeyPrefix string
+	// Delay defaults to DefaultGreylistDelay.
+	Delay time.Duration
+	// RetryWindow defaults to DefaultGreylistRetryWindow.
+	RetryWindow time.Duration
+	// PassTTL defaults to DefaultGreylistPassTTL.
+	PassTTL time.Duration
+	// KnownSenderTTL defaults to DefaultKnownSenderTTL.
+	KnownSenderTTL time.Duration
+	// DisableKnownSenders greylists every unknown triplet, even from known
+	// sender domains passing SPF.
+	DisableKnownSenders bool
+	// Resolver is used for SPF checks. Defaults to SharedResolver().
+	Resolver DNSLookuper
+	// SPFTimeout defaults to DefaultGreylistSPFTimeout.
+	SPFTimeout time.Duration
+	// Clock defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// Greylist temporarily refuses the first attempt of every client network
+// (/24 or /64), sender and recipient triplet with ErrGreylisted; legitimate
+// servers retry after Delay and pass, while most spamware never does.
+//
+// The delay is skipped for known senders: mail whose sender domain passes SPF
+// and delivered authenticated mail before. HandleRcptTo, in the rcpt_to
+// chain, greylists; HandleDeliver, in the deliver chain, learns the sender
+// domains of accepted messages that passed SPF or carry a valid DKIM
+// signature of that domain (see DKIMDomainsKey). The SPF result is recorded
+// under SPFResultKey.
+type Greylist struct {
+	cfg GreylistConfig
+}
+
+// NewGreylist creates a new Greylist instance.
+func NewGreylist(cfg GreylistConfig) (*Greylist, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("greylist store is required")
+	}
+	if cfg.Delay < 0 || cfg.RetryWindow < 0 || cfg.PassTTL < 0 || cfg.KnownSenderTTL < 0 || cfg.SPFTimeout < 0 {
+		return nil, fmt.Errorf("greylist settings must not be negative")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultGreylistKeyPrefix
+	}
+	if cfg.Delay == 0 {
+		cfg.Delay = DefaultGreylistDelay
+	}
+	if cfg.RetryWindow == 0 {
+		cfg.RetryWindow = DefaultGreylistRetryWindow
+	}
+	if cfg.RetryWindow <= cfg.Delay {
+		return nil, fmt.Errorf("greylist retry window must be longer than the delay")
+	}
+	if cfg.PassTTL == 0 {
+		cfg.PassTTL = DefaultGreylistPassTTL
+	}
+	if cfg.KnownSenderTTL == 0 {
+		cfg.KnownSenderTTL = DefaultKnownSenderTTL
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = SharedResolver()
+	}
+	if cfg.SPFTimeout == 0 {
+		cfg.SPFTimeout = DefaultGreylistSPFTimeout
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+	return &Greylist{cfg: cfg}, nil
+}
+
+// HandleRcptTo is the brisa.Handler of the middleware for the rcpt_to chain.
+// It checks the recipient added by the current RCPT TO command.
+func (g *Greylist) HandleRcptTo(ctx *brisa.Context) brisa.Action {
+	ip := clientIP(ctx)
+	if ip == nil || len(ctx.To) == 0 {
+		return ctx.Action
+	}
+	if g.knownSender(ctx, ip) {
+		ctx.Logger.Debug("greylisting skipped for known sender", "from", ctx.From)
+		return ctx.Action
+	}
+
+	rcpt := ctx.To[len(ctx.To)-1]
+	key := g.cfg.KeyPrefix + "t:" + greylistNetwork(ip) + "|" + address.Key(ctx.From) + "|" + address.Key(rcpt)
+	now := g.cfg.Clock.Now()
+	value, found, err := g.cfg.Store.Get(key)
+	if err != nil {
+		// Fail open: a broken Store must not stop mail flow.
+		ctx.Logger.Error("failed to look up greylist triplet", "error", err)
+		return ctx.Action
+	}
+	if !found {
+		// Of several instances sharing the Store, only the first to see the
+		// triplet records when.
+		if _, err := brisa.StoreAdd(g.cfg.Store, key, []byte(strconv.FormatInt(now.Unix(), 10)), g.cfg.RetryWindow); err != nil {
+			ctx.Logger.Error("failed to record greylist triplet", "error", err)
+			return ctx.Action
+		}
+		ctx.Logger.Info("greylisted", "ip", ip, "from", ctx.From, "rcpt", rcpt)
+		return ctx.RejectWith(ErrGreylisted)
+	}
+	if string(value) == "pass" {
+		return ctx.Action
+	}
+	first, _ := strconv.ParseInt(string(value), 10, 64)
+	if now.Sub(time.Unix(first, 0)) < g.cfg.Delay {
+		return ctx.RejectWith(ErrGreylisted)
+	}
+	if err := g.cfg.Store.Set(key, []byte("pass"), g.cfg.PassTTL); err != nil {
+		ctx.Logger.Error("failed to record greylist pass", "error", err)
+	}
+	return ctx.Action
+}
+
+// HandleDeliver is the brisa.Handler of the middleware for the deliver chain.
+// It remembers the sender domain of an authenticated message.
+func (g *Greylist) HandleDeliver(ctx *brisa.Context) brisa.Action {
+	domain := address.NormalizeDomain(address.Domain(ctx.From))
+	if domain == "" || g.cfg.DisableKnownSenders {
+		return ctx.Action
+	}
+	dkim, _ := ctx.Get(DKIMDomainsKey)
+	domains, _ := dkim.([]string)
+	if !slices.ContainsFunc(domains, func(d string) bool { return address.EqualDomains(d, domain) }) {
+		if ip := clientIP(ctx); ip == nil || g.spf(ctx, ip) != SPFPass {
+			return ctx.Action
+		}
+	}
+	if err := g.cfg.Store.Set(g.cfg.KeyPrefix+"known:"+domain, []byte{1}, g.cfg.KnownSenderTTL); err != nil {
+		ctx.Logger.Error("failed to record known sender", "domain", domain, "error", err)
+	}
+	return ctx.Action
+}
+
+// knownSender reports whether the sender domain is known and passes SPF.
+func (g *Greylist) knownSender(ctx *brisa.Context, ip net.IP) bool {
+	domain := address.NormalizeDomain(address.Domain(ctx.From))
+	if domain == "" || g.cfg.DisableKnownSenders {
+		return false
+	}
+	_, known, err := g.cfg.Store.Get(g.cfg.KeyPrefix + "known:" + domain)
+	if err != nil {
+		ctx.Logger.Error("failed to look up known sender", "domain", domain, "error", err)
+	}
+	return known && g.spf(ctx, ip) == SPFPass
+}
+
+// spf returns the SPF result of the envelope sender, checking it once per
+// transaction.
+func (g *Greylist) spf(ctx *brisa.Context, ip net.IP) SPFResult {
+	if result, ok := ctx.Get(SPFResultKey); ok {
+		if r, ok := result.(SPFResult); ok {
+			return r
+		}
+	}
+	spfCtx, cancel := context.WithTimeout(context.Background(), g.cfg.SPFTimeout)
+	defer cancel()
+	result := CheckSPF(spfCtx, g.cfg.Resolver, ip, ctx.From)
+	ctx.Set(SPFResultKey, result)
+	return result
+}
+
+// greylistNetwork returns the network of ip greylisted together, as the
+// servers of large senders retry from other addresses of their pool.
+func greylistNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGreylist(t *testing.T) {
+	_, err := NewGreylist(GreylistConfig{})
+	require.Error(t, err)
+	_, err = NewGreylist(GreylistConfig{Store: brisa.NewMemoryStore(), Delay: -time.Minute})
+	require.Error(t, err)
+	_, err = NewGreylist(GreylistConfig{Store: brisa.NewMemoryStore(), Delay: time.Hour, RetryWindow: time.Minute})
+	require.Error(t, err)
+}
+
+func newGreylistRouter(t *testing.T, cfg GreylistConfig, dkim ...string) *brisa.Router {
+	t.Helper()
+	g, err := NewGreylist(cfg)
+	require.NoError(t, err)
+	router := &brisa.Router{
+		brisa.ChainRcptTo: {{Handler: g.HandleRcptTo}},
+		brisa.ChainData: {{Handler: func(ctx *brisa.Context) brisa.Action {
+			if len(dkim) > 0 {
+				ctx.Set(DKIMDomainsKey, dkim)
+			}
+			return brisa.Pass
+		}}},
+		brisa.ChainDeliver: {{Handler: g.HandleDeliver}},
+	}
+	return router
+}
+
+func TestGreylist_Triplets(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Now())
+	router := newGreylistRouter(t, GreylistConfig{
+		Store:    brisa.NewMemoryStoreWithClock(clock),
+		Resolver: &brisatest.FakeResolver{},
+		Clock:    clock,
+	})
+	env := brisatest.NewEnvelope("203.0.113.4", "alice@example.org", "bob@example.com")
+
+	res := brisatest.Run(t, router, env, "\r\nhello\r\n")
+	assert.Equal(t, ErrGreylisted, res.RcptErrors["bob@example.com"])
+
+	// Too early.
+	clock.Advance(time.Minute)
+	res = brisatest.Run(t, router, env, "\r\nhello\r\n")
+	assert.Equal(t, ErrGreylisted, res.RcptErrors["bob@example.com"])
+
+	// A retry from another server of the same network passes, and so do the
+	// messages after it.
+	clock.Advance(5 * time.Minute)
+	env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 25}
+	brisatest.Run(t, router, env, "\r\nhello\r\n").AssertAction(t, brisa.Deliver)
+	clock.Advance(30 * 24 * time.Hour)
+	brisatest.Run(t, router, env, "\r\nhello\r\n").AssertAction(t, brisa.Deliver)
+
+	// Other triplets are greylisted.
+	other := brisatest.NewEnvelope("198.51.100.1", "alice@example.org", "bob@example.com")
+	res = brisatest.Run(t, router, other, "\r\nhello\r\n")
+	assert.Equal(t, ErrGreylisted, res.RcptErrors["bob@example.com"])
+
+	// A retry after the window starts over.
+	clock.Advance(25 * time.Hour)
+	res = brisatest.Run(t, router, other, "\r\nhello\r\n")
+	assert.Equal(t, ErrGreylisted, res.RcptErrors["bob@example.com"])
+}
+
+func TestGreylist_KnownSenders(t *testing.T) {
+	resolver := &brisatest.FakeResolver{TXT: map[string][]string{
+		"example.org": {"v=spf1 ip4:203.0.113.0/24 -all"},
+		"example.net": {"v=spf1 -all"},
+	}}
+	clock := brisatest.NewFakeClock(time.Now())
+	store := brisa.NewMemoryStoreWithClock(clock)
+	cfg := GreylistConfig{Store: store, Resolver: resolver, Clock: clock}
+	router := newGreylistRouter(t, cfg)
+
+	// The first message of a domain passing SPF is greylisted, then makes the
+	// domain known.
+	env := brisatest.NewEnvelope("203.0.113.4", "alice@example.org", "bob@example.com")
+	res := brisatest.Run(t, router, env, "\r\nhello\r\n")
+	assert.Equal(t, ErrGreylisted, res.RcptErrors["bob@example.com"])
+	clock.Advance(10 * time.Minute)
+	brisatest.Run(t, router, env, "\r\nhello\r\n").AssertAction(t, brisa.Deliver)
+
+	// First contact from a known domain passing SPF is not delayed.
+	env = brisatest.NewEnvelope("203.0.113.4", "carol@example.org", "dave@example.com")
+	brisatest.Run(t, router, env, "\r\nhello\r\n").AssertAction(t, brisa.Deliver)
+
+	// But a known domain failing SPF is.
+	env = brisatest.NewEnvelope("198.51.100.1", "carol@example.org", "erin@example.com")
+	res = brisatest.Run(t, router, env, "\r\nhello\r\n")
+	assert.Equal(t, ErrGreylisted, res.RcptErrors["erin@example.com"])
+
+	// Without SPF, a valid DKIM signature of the sender domain makes it known.
+	dkimRouter := newGreylistRouter(t, cfg, "Example.NET")
+	env = brisatest.NewEnvelope("198.51.100.1", "frank@example.net", "bob@example.com")
+	brisatest.Run(t, dkimRouter, env, "\r\nhello\r\n")
+	clock.Advance(10 * time.Minute)
+	brisatest.Run(t, dkimRouter, env, "\r\nhello\r\n").AssertAction(t, brisa.Deliver)
+	_, known, err := store.Get(DefaultGreylistKeyPrefix + "known:example.net")
+	require.NoError(t, err)
+	assert.True(t, known)
+
+	cfg.DisableKnownSenders = true
+	router = newGreylistRouter(t, cfg)
+	env = brisatest.NewEnvelope("203.0.113.4", "grace@example.org", "dave@example.com")
+	res = brisatest.Run(t, router, env, "\r\nhello\r\n")
+	assert.Equal(t, ErrGreylisted, res.RcptErrors["dave@example.com"])
+}
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/muzhy/brisa"
+)
+
+// headerField is a single header field of a message. Raw keeps the field
+// exactly as it was received (including folding and the trailing line break)
+// so that untouched fields are written back byte-for-byte.
+type headerField struct {
+	Key   string // canonical header key, e.g. "Message-Id"
+	Value string // unfolded and trimmed value
+	Raw   []byte
+}
+
+// messageHeader is an ordered, mutable view of a message header block.
+type messageHeader struct {
+	fields []headerField
+}
+
+// readHeader reads the header block from r, stopping after the empty line that
+// separates the header from the body. The parser is deliberately lenient: a
+// message without a body or with malformed lines is not an error.
+func readHeader(r *bufio.Reader) (*messageHeader, error) {
+	h := &messageHeader{}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				return h, nil
+			}
+			return nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return h, nil // end of header
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(h.fields) > 0 {
+			// Continuation of the previous (folded) field.
+			last := &h.fields[len(h.fields)-1]
+			last.Raw = append(last.Raw, line...)
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(string(line)))
+		} else {
+			h.fields = append(h.fields, parseHeaderLine(line))
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return h, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// parseHeaderLine splits a raw "Key: value" line into a headerField.
+func parseHeaderLine(line []byte) headerField {
+	f := headerField{Raw: append([]byte(nil), line...)}
+	if i := bytes.IndexByte(line, ':'); i > 0 {
+		f.Key = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(string(line[:i])))
+		f.Value = strings.TrimSpace(string(line[i+1:]))
+	}
+	return f
+}
+
+// Get returns the value of the first field with the given key.
+func (h *messageHeader) Get(key string) string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	for _, f := range h.fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields with the given key, in order.
+func (h *messageHeader) Values(key string) []string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	var values []string
+	for _, f := range h.fields {
+		if f.Key == key {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Has reports whether at least one field with the given key exists.
+func (h *messageHeader) Has(key string) bool {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	for _, f := range h.fields {
+		if f.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Add appends a new field at the end of the header.
+func (h *messageHeader) Add(key, value string) {
+	h.fields = append(h.fields, newHeaderField(key, value))
+}
+
+// Prepend inserts a new field at the top of the header, which is where trace
+// fields such as Received belong.
+func (h *messageHeader) Prepend(key, value string) {
+	h.fields = append([]headerField{newHeaderField(key, value)}, h.fields...)
+}
+
+// Set replaces the first field with the given key, removing any others. If no
+// such field exists, the field is appended.
+func (h *messageHeader) Set(key, value string) {
+	canonical := textproto.CanonicalMIMEHeaderKey(key)
+	replaced := false
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if f.Key == canonical {
+			if replaced {
+				continue
+			}
+			f = newHeaderField(key, value)
+			replaced = true
+		}
+		fields = append(fields, f)
+	}
+	h.fields = fields
+	if !replaced {
+		h.Add(key, value)
+	}
+}
+
+// Del removes all fields with the given key.
+func (h *messageHeader) Del(key string) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	h.Filter(func(f headerField) bool { return f.Key != key })
+}
+
+// Filter keeps only the fields for which keep returns true.
+func (h *messageHeader) Filter(keep func(f headerField) bool) {
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if keep(f) {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+// Bytes serializes the header, including the empty line that terminates it.
+func (h *messageHeader) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range h.fields {
+		buf.Write(f.Raw)
+		if !bytes.HasSuffix(f.Raw, []byte("\n")) {
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// newHeaderField builds a field from key and value. The key is written out with
+// the spelling given by the caller (e.g. "Message-ID") rather than its canonical form.
+// Line breaks in value are replaced by spaces, so that a value taken from the
+// message or the envelope cannot inject fields or end the header.
+func newHeaderField(key, value string) headerField {
+	value = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, value)
+	return headerField{
+		Key:   textproto.CanonicalMIMEHeaderKey(key),
+		Value: value,
+		Raw:   []byte(key + ": " + value + "\r\n"),
+	}
+}
+
+// readMessageHeader parses the header of the message currently held by ctx.
+// It returns the parsed header and a reader positioned at the start of the body.
+// Callers must hand both back through setMessage so that later middleware and
+// the disposition chains still see the complete message. A spooled message
+// (see brisa.Context.MessageSpool) is read from its spool, which setMessage
+// then shares instead of spooling the message again.
+func readMessageHeader(ctx *brisa.Context) (*messageHeader, io.Reader, error) {
+	if sp := ctx.MessageSpool(); sp != nil {
+		cr := &countingReader{r: sp.NewReader()}
+		br := bufio.NewReader(cr)
+		h, err := readHeader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return h, &spooledBody{Reader: br, spool: sp, off: cr.n - int64(br.Buffered())}, nil
+	}
+	br := bufio.NewReader(ctx.Reader)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, br, nil
+}
+
+// spooledBody is the body of a spooled message, starting at off in its spool.
+type spooledBody struct {
+	io.Reader
+	spool *brisa.Spool
+	off   int64
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// setMessage replaces the message reader of ctx with the given header followed
+// by the (unread) body. The body of a spooled message is taken from its
+// spool, whatever was read from it, and the header is spliced onto it.
+func setMessage(ctx *brisa.Context, h *messageHeader, body io.Reader) {
+	if b, ok := body.(*spooledBody); ok {
+		ctx.SetMessageSpool(b.spool.Splice(h.Bytes(), b.off))
+		return
+	}
+	ctx.Reader = io.MultiReader(bytes.NewReader(h.Bytes()), body)
+}
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/muzhy/brisa"
+)
+
+// HeaderScrubRule selects header fields to be removed from a message.
+type HeaderScrubRule struct {
+	// Header is the field name to match, case-insensitively. A trailing "*"
+	// matches any suffix, e.g. "X-Originating-*".
+	Header string
+	// Pattern, if set, restricts the rule to fields whose value matches this
+	// regular expression.
+	Pattern string
+	// OldestOnly restricts the rule to the oldest (bottom-most) matching field.
+	// For Received this is the line added by the first hop, which is only the
+	// submitting hop for messages that arrive without Received lines.
+	OldestOnly bool
+}
+
+// DefaultHeaderScrubRules removes the headers that typically leak information
+// about the submitting user: the originating IP and the mail client. Received
+// lines are kept: a message may arrive with Received lines of earlier hops,
+// so the oldest one is not necessarily the submitting hop. Add a Received
+// rule with a Pattern matching that hop, such as the addresses of the
+// clients, to remove it.
+var DefaultHeaderScrubRules = []HeaderScrubRule{
+	{Header: "X-Originating-IP"},
+	{Header: "User-Agent"},
+}
+
+type headerScrubRule struct {
+	name       string // canonical name, or prefix if wildcard is set
+	wildcard   bool
+	pattern    *regexp.Regexp
+	oldestOnly bool
+}
+
+func (r *headerScrubRule) matches(f headerField) bool {
+	if r.wildcard {
+		if !strings.HasPrefix(f.Key, r.name) {
+			return false
+		}
+	} else if f.Key != r.name {
+		return false
+	}
+	return r.pattern == nil || r.pattern.MatchString(f.Value)
+}
+
+// HeaderScrubber removes privacy-sensitive header fields from outgoing mail.
+// It is meant for the submission path.
+type HeaderScrubber struct {
+	rules []headerScrubRule
+}
+
+// NewHeaderScrubber creates a new HeaderScrubber from the given rules.
+// It returns an error if a rule has no header name or an invalid pattern.
+func NewHeaderScrubber(rules []HeaderScrubRule) (*HeaderScrubber, error) {
+	hs := &HeaderScrubber{rules: make([]headerScrubRule, 0, len(rules))}
+	for _, rule := range rules {
+		name := strings.TrimSpace(rule.Header)
+		wildcard := strings.HasSuffix(name, "*")
+		name = strings.TrimSuffix(name, "*")
+		if name == "" {
+			return nil, fmt.Errorf("invalid header scrub rule: empty header name")
+		}
+
+		r := headerScrubRule{
+			name:       textproto.CanonicalMIMEHeaderKey(name),
+			wildcard:   wildcard,
+			oldestOnly: rule.OldestOnly,
+		}
+		if wildcard {
+			r.name = canonicalPrefix(name)
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern in header scrub rule for %s: %w", rule.Header, err)
+			}
+			r.pattern = pattern
+		}
+		hs.rules = append(hs.rules, r)
+	}
+	return hs, nil
+}
+
+// NewHeaderScrubberHandler creates a new Data middleware handler that removes
+// the header fields selected by rules.
+func NewHeaderScrubberHandler(rules []HeaderScrubRule) (brisa.Handler, error) {
+	hs, err := NewHeaderScrubber(rules)
+	if err != nil {
+		return nil, err
+	}
+	return hs.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (hs *HeaderScrubber) Handle(ctx *brisa.Context) brisa.Action {
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return brisa.Reject
+	}
+	defer setMessage(ctx, h, body)
+
+	if removed := hs.scrub(h); removed > 0 {
+		ctx.Logger.Debug("scrubbed private header fields", "count", removed)
+	}
+	return brisa.Pass
+}
+
+// scrub removes all matching fields from h and returns how many were removed.
+func (hs *HeaderScrubber) scrub(h *messageHeader) int {
+	drop := make([]bool, len(h.fields))
+	for i := range hs.rules {
+		rule := &hs.rules[i]
+		// Header fields are prepended by each hop, so the oldest is the last one.
+		for j := len(h.fields) - 1; j >= 0; j-- {
+			if rule.matches(h.fields[j]) {
+				drop[j] = true
+				if rule.oldestOnly {
+					break
+				}
+			}
+		}
+	}
+
+	removed, i := 0, 0
+	h.Filter(func(headerField) bool {
+		keep := !drop[i]
+		if !keep {
+			removed++
+		}
+		i++
+		return keep
+	})
+	return removed
+}
+
+// canonicalPrefix canonicalizes a header name prefix the same way
+// textproto.CanonicalMIMEHeaderKey does: upper-case the first letter and every
+// letter after a hyphen, lower-case the rest.
+func canonicalPrefix(prefix string) string {
+	b := []byte(prefix)
+	upper := true
+	for i, c := range b {
+		if upper && 'a' <= c && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	return string(b)
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHeaderScrubber(t *testing.T) {
+	t.Run("empty header name", func(t *testing.T) {
+		_, err := NewHeaderScrubber([]HeaderScrubRule{{Header: "*"}})
+		require.Error(t, err)
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		_, err := NewHeaderScrubber([]HeaderScrubRule{{Header: "Received", Pattern: "("}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid pattern")
+	})
+}
+
+func TestHeaderScrubber_Handle(t *testing.T) {
+	message := "Received: from relay by mx2\r\n" +
+		"Received: from [203.0.113.7] by submission\r\n" +
+		"X-Originating-IP: 203.0.113.7\r\n" +
+		"x-originating-host: laptop\r\n" +
+		"User-Agent: Mail/1.0\r\n" +
+		"X-Mailer: Mail/1.0\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	testCases := []struct {
+		name  string
+		rules []HeaderScrubRule
+		want  string
+	}{
+		{
+			name:  "default rules",
+			rules: DefaultHeaderScrubRules,
+			want: "Received: from relay by mx2\r\n" +
+				"Received: from [203.0.113.7] by submission\r\n" +
+				"x-originating-host: laptop\r\n" +
+				"X-Mailer: Mail/1.0\r\n" +
+				"Subject: hello\r\n" +
+				"\r\n" +
+				"body\r\n",
+		},
+		{
+			name:  "oldest only",
+			rules: []HeaderScrubRule{{Header: "Received", OldestOnly: true}},
+			want: "Received: from relay by mx2\r\n" +
+				"X-Originating-IP: 203.0.113.7\r\n" +
+				"x-originating-host: laptop\r\n" +
+				"User-Agent: Mail/1.0\r\n" +
+				"X-Mailer: Mail/1.0\r\n" +
+				"Subject: hello\r\n" +
+				"\r\n" +
+				"body\r\n",
+		},
+		{
+			name:  "wildcard header",
+			rules: []HeaderScrubRule{{Header: "x-originating-*"}},
+			want: "Received: from relay by mx2\r\n" +
+				"Received: from [203.0.113.7] by submission\r\n" +
+				"User-Agent: Mail/1.0\r\n" +
+				"X-Mailer: Mail/1.0\r\n" +
+				"Subject: hello\r\n" +
+				"\r\n" +
+				"body\r\n",
+		},
+		{
+			name:  "value pattern",
+			rules: []HeaderScrubRule{{Header: "Received", Pattern: `\[203\.0\.113\.\d+\]`}, {Header: "X-Mailer"}},
+			want: "Received: from relay by mx2\r\n" +
+				"X-Originating-IP: 203.0.113.7\r\n" +
+				"x-originating-host: laptop\r\n" +
+				"User-Agent: Mail/1.0\r\n" +
+				"Subject: hello\r\n" +
+				"\r\n" +
+				"body\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, err := NewHeaderScrubberHandler(tc.rules)
+			require.NoError(t, err)
+
+			ctx := newTestContext(t, message)
+			assert.Equal(t, brisa.Pass, handler(ctx))
+			assert.Equal(t, tc.want, readTestMessage(t, ctx))
+		})
+	}
+}
+
+func TestHeaderScrubber_PriorReceived(t *testing.T) {
+	// A message relayed by the sender's own servers arrives with their
+	// Received lines; the default rules must not remove the oldest of them.
+	message := "Received: from gw.corp.example by relay.corp.example\r\n" +
+		"Received: from build-01 by gw.corp.example\r\n" +
+		"User-Agent: Mail/1.0\r\n" +
+		"Subject: report\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	handler, err := NewHeaderScrubberHandler(DefaultHeaderScrubRules)
+	require.NoError(t, err)
+	ctx := newTestContext(t, message)
+	assert.Equal(t, brisa.Pass, handler(ctx))
+	assert.Equal(t, strings.Replace(message, "User-Agent: Mail/1.0\r\n", "", 1), readTestMessage(t, ctx))
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadHeader(t *testing.T) {
+	raw := "From: alice@example.com\r\n" +
+		"Subject: a folded\r\n" +
+		"\tsubject line\r\n" +
+		"To: bob@example.com\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	br := bufio.NewReader(strings.NewReader(raw))
+	h, err := readHeader(br)
+	require.NoError(t, err)
+
+	assert.Len(t, h.fields, 3)
+	assert.Equal(t, "a folded subject line", h.Get("subject"))
+	assert.Equal(t, "bob@example.com", h.Get("To"))
+
+	rest, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "body\r\n", rest)
+
+	// Untouched fields must be written back byte-for-byte.
+	assert.Equal(t, raw[:strings.Index(raw, "body")], string(h.Bytes()))
+}
+
+func TestReadHeader_NoBody(t *testing.T) {
+	h, err := readHeader(bufio.NewReader(strings.NewReader("From: alice@example.com")))
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", h.Get("From"))
+}
+
+func TestMessageHeader_Modify(t *testing.T) {
+	h, err := readHeader(bufio.NewReader(strings.NewReader("A: 1\r\nB: 2\r\nA: 3\r\n\r\n")))
+	require.NoError(t, err)
+
+	h.Set("A", "4")
+	assert.Equal(t, []string{"4"}, h.Values("A"))
+
+	h.Prepend("Received", "from x")
+	h.Add("C", "5")
+	h.Del("B")
+	assert.Equal(t, "Received: from x\r\nA: 4\r\nC: 5\r\n\r\n", string(h.Bytes()))
+}
+
+func FuzzReadHeader(f *testing.F) {
+	f.Add("Subject: hi\r\nTo: a@example.com,\r\n b@example.com\r\n\r\nbody")
+	f.Add("no colon\nX: y")
+	f.Add(" leading continuation\r\n\r\n")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		h, err := readHeader(bufio.NewReader(strings.NewReader(data)))
+		if err != nil {
+			return
+		}
+		// Writing the header back and reading it again must give the same fields.
+		h2, err := readHeader(bufio.NewReader(strings.NewReader(string(h.Bytes()))))
+		require.NoError(t, err)
+		require.Equal(t, len(h.fields), len(h2.fields))
+		for i := range h.fields {
+			assert.Equal(t, h.fields[i].Key, h2.fields[i].Key)
+			assert.Equal(t, h.fields[i].Value, h2.fields[i].Value)
+		}
+	})
+}
+
+func FuzzMessageHeader_Set(f *testing.F) {
+	f.Add("Subject: hi\r\n\r\n", "X-Spam", "yes")
+	f.Add("", "Subject", "a\r\nBcc: victim@example.com")
+
+	f.Fuzz(func(t *testing.T, data, key, value string) {
+		if !validHeaderKey(key) {
+			t.Skip()
+		}
+		h, err := readHeader(bufio.NewReader(strings.NewReader(data)))
+		if err != nil {
+			return
+		}
+		h.Set(key, value)
+
+		// A value must not be able to add fields or end the header.
+		h2, err := readHeader(bufio.NewReader(strings.NewReader(string(h.Bytes()))))
+		require.NoError(t, err)
+		require.Len(t, h2.fields, len(h.fields))
+		require.Len(t, h2.Values(key), 1)
+	})
+}
+
+// validHeaderKey reports whether key is a non-empty field name (RFC 5322).
+func validHeaderKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] > '~' || key[i] == ':' {
+			return false
+		}
+	}
+	return key != ""
+}
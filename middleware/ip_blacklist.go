@@ -3,13 +3,34 @@ package middleware
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/muzhy/brisa"
 )
 
+// DefaultIPBlacklistKeyPrefix is the default prefix of the Store keys written
+// by IPBlacklist.
+const DefaultIPBlacklistKeyPrefix = "blacklist:"
+
 type IPBlacklist struct {
+	// Clock tells the time for the expiry of temporary blocks. Defaults to
+	// brisa.SystemClock.
+	Clock brisa.Clock
+	// Store, if set, persists the blocks made with Block under
+	// "<KeyPrefix><ip>" until they expire, so that they survive restarts and
+	// apply to all instances sharing the Store.
+	Store brisa.Store
+	// KeyPrefix defaults to DefaultIPBlacklistKeyPrefix.
+	KeyPrefix string
+
 	blockedIPs map[string]struct{}
 	networks   []*net.IPNet
+
+	// temporary holds IPs blocked at runtime with Block, mapped to their expiry.
+	mu        sync.RWMutex
+	temporary map[string]time.Time
 }
 
 // NewIPBlacklist creates a new IPBlacklist instance.
@@ -39,18 +60,94 @@ func NewIPBlacklist(ips []string) (*IPBlacklist, error) {
 	return bl, nil
 }
 
-// IsBlocked checks if a given IP address is in the blacklist.
+// Block adds ip to the blacklist for the given duration. It is safe for
+// concurrent use with IsBlocked. The block is in effect even if it could not
+// be written to the Store.
+func (bl *IPBlacklist) Block(ip net.IP, d time.Duration) error {
+	now := bl.now()
+	bl.block(ip.String(), now.Add(d), now)
+	if bl.Store == nil {
+		return nil
+	}
+	expiresAt := strconv.FormatInt(now.Add(d).Unix(), 10)
+	if err := bl.Store.Set(bl.storeKey(ip), []byte(expiresAt), d); err != nil {
+		return fmt.Errorf("failed to persist block of %s: %w", ip, err)
+	}
+	return nil
+}
+
+func (bl *IPBlacklist) block(key string, expiresAt, now time.Time) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if bl.temporary == nil {
+		bl.temporary = make(map[string]time.Time)
+	}
+	// Drop expired entries so the map does not grow without bound.
+	for k, exp := range bl.temporary {
+		if !now.Before(exp) {
+			delete(bl.temporary, k)
+		}
+	}
+	bl.temporary[key] = expiresAt
+}
+
+func (bl *IPBlacklist) storeKey(ip net.IP) string {
+	prefix := bl.KeyPrefix
+	if prefix == "" {
+		prefix = DefaultIPBlacklistKeyPrefix
+	}
+	return prefix + ip.String()
+}
+
+// storedBlock reports whether ip is blocked in the Store, caching the block
+// locally until it expires.
+func (bl *IPBlacklist) storedBlock(ip net.IP) bool {
+	value, ok, err := bl.Store.Get(bl.storeKey(ip))
+	if err != nil || !ok {
+		// Fail open: a broken Store must not block every client.
+		return false
+	}
+	now := bl.now()
+	expiresAt := now.Add(time.Minute)
+	if sec, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+		expiresAt = time.Unix(sec, 0)
+	}
+	if !now.Before(expiresAt) {
+		return false
+	}
+	bl.block(ip.String(), expiresAt, now)
+	return true
+}
+
+func (bl *IPBlacklist) now() time.Time {
+	if bl.Clock == nil {
+		return time.Now()
+	}
+	return bl.Clock.Now()
+}
+
+// IsBlocked checks if a given IP address is in the blacklist. With a Store,
+// addresses not blocked locally are looked up there, so blocks made before a
+// restart or by other instances apply.
 func (bl *IPBlacklist) IsBlocked(ip net.IP) bool {
 	if _, found := bl.blockedIPs[ip.String()]; found {
 		return true
 	}
 
+	bl.mu.RLock()
+	expiresAt, found := bl.temporary[ip.String()]
+	bl.mu.RUnlock()
+	if found && bl.now().Before(expiresAt) {
+		return true
+	}
+
 	for _, network := range bl.networks {
 		if network.Contains(ip) {
 			return true
 		}
 	}
-	return false
+	return bl.Store != nil && bl.storedBlock(ip)
 }
 
 // NewIPBlacklistHandler creates a new middleware handler for blocking IPs.
@@ -60,15 +157,17 @@ func NewIPBlacklistHandler(IPs []string) (brisa.Handler, error) {
 	if err != nil {
 		return nil, err
 	}
+	return blacklist.Handle, nil
+}
 
-	// Return the actual middleware function (a closure)
-	return func(ctx *brisa.Context) brisa.Action {
-		clientIP := ctx.Session.GetClientIP().(*net.TCPAddr).IP
+// Handle is the brisa.Handler of the blacklist. Use it instead of
+// NewIPBlacklistHandler when the blacklist is also updated at runtime with Block.
+func (bl *IPBlacklist) Handle(ctx *brisa.Context) brisa.Action {
+	clientIP := ctx.Session.GetClientIP().(*net.TCPAddr).IP
 
-		if blacklist.IsBlocked(clientIP) {
-			ctx.Logger.Info("IP rejected by blacklist", "ip", clientIP)
-			return brisa.Reject
-		}
-		return brisa.Pass
-	}, nil
+	if bl.IsBlocked(clientIP) {
+		ctx.Logger.Info("IP rejected by blacklist", "ip", clientIP)
+		return brisa.Reject
+	}
+	return brisa.Pass
 }
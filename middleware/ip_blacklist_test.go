@@ -3,7 +3,10 @@ package middleware
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -92,3 +95,55 @@ func TestIPBlacklist_IsBlocked(t *testing.T) {
 		})
 	}
 }
+
+func TestIPBlacklist_Block(t *testing.T) {
+	blacklist, err := NewIPBlacklist(nil)
+	require.NoError(t, err)
+
+	clock := brisatest.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	blacklist.Clock = clock
+
+	ip := net.ParseIP("203.0.113.9")
+	assert.False(t, blacklist.IsBlocked(ip))
+
+	require.NoError(t, blacklist.Block(ip, time.Hour))
+	assert.True(t, blacklist.IsBlocked(ip))
+
+	clock.Advance(time.Hour)
+	assert.False(t, blacklist.IsBlocked(ip), "an expired temporary block must not apply")
+}
+
+func TestIPBlacklist_BlockStore(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := brisa.NewMemoryStoreWithClock(clock)
+	ip := net.ParseIP("203.0.113.9")
+
+	blacklist, err := NewIPBlacklist(nil)
+	require.NoError(t, err)
+	blacklist.Clock, blacklist.Store = clock, store
+	require.NoError(t, blacklist.Block(ip, time.Hour))
+
+	// A new instance, e.g. after a restart, sees the block until it expires.
+	restarted, err := NewIPBlacklist(nil)
+	require.NoError(t, err)
+	restarted.Clock, restarted.Store = clock, store
+	assert.True(t, restarted.IsBlocked(ip))
+	assert.False(t, restarted.IsBlocked(net.ParseIP("203.0.113.10")))
+
+	clock.Advance(time.Hour)
+	assert.False(t, restarted.IsBlocked(ip))
+}
+
+func TestIPBlacklist_Handle(t *testing.T) {
+	handler, err := NewIPBlacklistHandler([]string{"192.0.2.0/24"})
+	require.NoError(t, err)
+
+	ctx := brisatest.NewContext(t, brisatest.DefaultEnvelope(), "")
+	assert.Equal(t, brisa.Reject, handler(ctx))
+
+	router := &brisa.Router{}
+	router.OnConn(&brisa.Middleware{Handler: handler})
+	env := brisatest.DefaultEnvelope()
+	env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}
+	brisatest.Run(t, router, env, "Subject: hi\r\n\r\n").AssertAction(t, brisa.Deliver)
+}
@@ -0,0 +1,361 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// LDAPConfig configures the lookup of recipient keys in an LDAP directory
+// (RFC 4511); see LDAPCertificateSource and LDAPPGPKeySource.
+type LDAPConfig struct {
+	// URL is the server, "ldap://host[:port]" or "ldaps://host[:port]".
+	URL string
+	// BindDN and Password authenticate with a simple bind. An empty BindDN
+	// searches anonymously.
+	BindDN   string
+	Password string
+	// BaseDN is the base of the subtree searched.
+	BaseDN string
+	// MailAttribute is the attribute matched with the recipient address.
+	// Empty means "mail".
+	MailAttribute string
+	// KeyAttribute is the attribute holding the key of the first entry
+	// found. Empty means "userCertificate;binary" for certificates and
+	// "pgpKey" for OpenPGP keys.
+	KeyAttribute string
+	// Timeout bounds a lookup. Zero means 10 seconds.
+	Timeout time.Duration
+	// TLSConfig is the TLS configuration of ldaps URLs.
+	TLSConfig *tls.Config
+}
+
+// LDAPCertificateSource returns a CertificateSource looking up the
+// certificates of recipients in an LDAP directory. The first value of the
+// key attribute that is a DER certificate is used.
+func LDAPCertificateSource(cfg LDAPConfig) (CertificateSource, error) {
+	if cfg.KeyAttribute == "" {
+		cfg.KeyAttribute = "userCertificate;binary"
+	}
+	search, err := newLDAPSearch(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(rcpt string) (*x509.Certificate, error) {
+		values, err := search(rcpt)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if cert, err := x509.ParseCertificate(v); err == nil {
+				return cert, nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+// LDAPPGPKeySource returns a PGPKeySource looking up the OpenPGP keys of
+// recipients in an LDAP directory. The first value of the key attribute with
+// an encryption key is used.
+func LDAPPGPKeySource(cfg LDAPConfig) (PGPKeySource, error) {
+	if cfg.KeyAttribute == "" {
+		cfg.KeyAttribute = "pgpKey"
+	}
+	search, err := newLDAPSearch(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(rcpt string) (*PGPKey, error) {
+		values, err := search(rcpt)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if key, err := ParsePGPKey(v, ""); err == nil && key != nil {
+				return key, nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+// LDAP protocol operations (RFC 4511, section 4.2) by their application tag.
+const (
+	ldapBindResponse   = 1
+	ldapSearchEntry    = 4
+	ldapSearchDone     = 5
+	ldapSearchRef      = 19
+	ldapSuccess        = 0
+	ldapSizeLimitError = 4
+	ldapMaxMessageSize = 1 << 20
+)
+
+// newLDAPSearch returns a function returning the values of the key attribute
+// of the first entry matching a recipient, with a connection of its own.
+func newLDAPSearch(cfg LDAPConfig) (func(rcpt string) ([][]byte, error), error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap url: %w", err)
+	}
+	addr := u.Host
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	case "ldaps":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "636")
+		}
+	default:
+		return nil, fmt.Errorf("ldap url %q: expected ldap:// or ldaps://", cfg.URL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("ldap url %q: no host", cfg.URL)
+	}
+	if cfg.MailAttribute == "" {
+		cfg.MailAttribute = "mail"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	tlsConfig := cfg.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+
+	return func(rcpt string) ([][]byte, error) {
+		dialer := &net.Dialer{Timeout: cfg.Timeout}
+		var conn net.Conn
+		var err error
+		if u.Scheme == "ldaps" {
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		} else {
+			conn, err = dialer.Dial("tcp", addr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ldap: %w", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(cfg.Timeout))
+		c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+		values, err := c.search(cfg, rcpt)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: %w", err)
+		}
+		c.send(berElement(0x42)) // UnbindRequest
+		return values, nil
+	}, nil
+}
+
+// ldapConn is an LDAP connection with its last message ID.
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+func (c *ldapConn) search(cfg LDAPConfig, rcpt string) ([][]byte, error) {
+	if cfg.BindDN != "" {
+		err := c.send(berElement(0x60, // BindRequest
+			berInt(0x02, 3), berOctets(cfg.BindDN), berElement(0x80, []byte(cfg.Password))))
+		if err != nil {
+			return nil, err
+		}
+		tag, op, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		if tag != ldapBindResponse {
+			return nil, fmt.Errorf("unexpected response %d to bind", tag)
+		}
+		if code, msg := ldapResult(op); code != ldapSuccess {
+			return nil, fmt.Errorf("bind: result %d %s", code, msg)
+		}
+	}
+
+	timeLimit := int(cfg.Timeout / time.Second)
+	err := c.send(berElement(0x63, // SearchRequest
+		berOctets(cfg.BaseDN),
+		berInt(0x0a, 2), // wholeSubtree
+		berInt(0x0a, 0), // neverDerefAliases
+		berInt(0x02, 1), // sizeLimit
+		berInt(0x02, timeLimit),
+		[]byte{0x01, 0x01, 0x00}, // typesOnly FALSE
+		berElement(0xa3, berOctets(cfg.MailAttribute), berOctets(rcpt)), // equalityMatch
+		berElement(0x30, berOctets(cfg.KeyAttribute))))
+	if err != nil {
+		return nil, err
+	}
+	var values [][]byte
+	found := false
+	for {
+		tag, op, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case ldapSearchEntry:
+			if !found {
+				values, found = ldapEntryValues(op), true
+			}
+		case ldapSearchRef:
+		case ldapSearchDone:
+			if code, msg := ldapResult(op); code != ldapSuccess && code != ldapSizeLimitError {
+				return nil, fmt.Errorf("search: result %d %s", code, msg)
+			}
+			return values, nil
+		default:
+			return nil, fmt.Errorf("unexpected response %d to search", tag)
+		}
+	}
+}
+
+// send writes an LDAPMessage with the protocol operation op.
+func (c *ldapConn) send(op []byte) error {
+	c.id++
+	_, err := c.conn.Write(berElement(0x30, berInt(0x02, c.id), op))
+	return err
+}
+
+// recv reads an LDAPMessage and returns the tag and contents of its protocol
+// operation.
+func (c *ldapConn) recv() (int, []byte, error) {
+	msg, err := readBER(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var seq, id, op asn1.RawValue
+	if _, err := asn1.Unmarshal(msg, &seq); err != nil {
+		return 0, nil, err
+	}
+	rest, err := asn1.Unmarshal(seq.Bytes, &id)
+	if err == nil {
+		_, err = asn1.Unmarshal(rest, &op)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if op.Class != asn1.ClassApplication {
+		return 0, nil, errors.New("invalid LDAP message")
+	}
+	return op.Tag, op.Bytes, nil
+}
+
+// ldapResult returns the result code and diagnostic message of an
+// LDAPResult.
+func ldapResult(op []byte) (int, string) {
+	var code, matched, diag asn1.RawValue
+	rest, err := asn1.Unmarshal(op, &code)
+	if err == nil {
+		rest, err = asn1.Unmarshal(rest, &matched)
+	}
+	if err == nil {
+		_, err = asn1.Unmarshal(rest, &diag)
+	}
+	if err != nil || len(code.Bytes) == 0 {
+		return -1, "invalid result"
+	}
+	n := 0
+	for _, b := range code.Bytes {
+		n = n<<8 | int(b)
+	}
+	return n, string(diag.Bytes)
+}
+
+// ldapEntryValues returns the values of the first attribute of a
+// SearchResultEntry.
+func ldapEntryValues(op []byte) [][]byte {
+	var name, attrs, attr, typ, vals asn1.RawValue
+	rest, err := asn1.Unmarshal(op, &name)
+	if err == nil {
+		_, err = asn1.Unmarshal(rest, &attrs)
+	}
+	if err == nil {
+		_, err = asn1.Unmarshal(attrs.Bytes, &attr)
+	}
+	if err == nil {
+		rest, err = asn1.Unmarshal(attr.Bytes, &typ)
+	}
+	if err == nil {
+		_, err = asn1.Unmarshal(rest, &vals)
+	}
+	if err != nil {
+		return nil
+	}
+	var values [][]byte
+	for rest := vals.Bytes; len(rest) > 0; {
+		var v asn1.RawValue
+		if rest, err = asn1.Unmarshal(rest, &v); err != nil {
+			break
+		}
+		values = append(values, v.Bytes)
+	}
+	return values
+}
+
+// readBER reads a BER element of definite length from r.
+func readBER(r *bufio.Reader) ([]byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	el := []byte{tag, first}
+	n := int(first)
+	if first&0x80 != 0 {
+		k := int(first & 0x7f)
+		if k == 0 || k > 3 {
+			return nil, errors.New("unsupported BER length")
+		}
+		length := make([]byte, k)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, err
+		}
+		el = append(el, length...)
+		n = 0
+		for _, b := range length {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > ldapMaxMessageSize {
+		return nil, fmt.Errorf("LDAP message of %d bytes", n)
+	}
+	contents := make([]byte, n)
+	if _, err := io.ReadFull(r, contents); err != nil {
+		return nil, err
+	}
+	return append(el, contents...), nil
+}
+
+// berElement returns the element of tag with the concatenated parts as
+// contents.
+func berElement(tag byte, parts ...[]byte) []byte {
+	var contents []byte
+	for _, p := range parts {
+		contents = append(contents, p...)
+	}
+	return append(derHeader(tag, int64(len(contents))), contents...)
+}
+
+// berInt returns an INTEGER, or with tag 0x0a an ENUMERATED, of v.
+func berInt(tag byte, v int) []byte {
+	der, _ := asn1.Marshal(v)
+	der[0] = tag
+	return der
+}
+
+func berOctets(s string) []byte {
+	return berElement(0x04, []byte(s))
+}
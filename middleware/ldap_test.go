@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ldapTestServer serves LDAP connections with a directory of the values of
+// one attribute by mail address. It returns the ldap:// URL of the server.
+func ldapTestServer(t *testing.T, bindDN, password string, values map[string][][]byte) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	reply := func(conn net.Conn, id []byte, op []byte) {
+		conn.Write(berElement(0x30, id, op))
+	}
+	result := func(tag byte, code int) []byte {
+		return berElement(tag, berInt(0x0a, code), berOctets(""), berOctets(""))
+	}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readBER(r)
+			if err != nil {
+				return
+			}
+			var seq, id, op asn1.RawValue
+			asn1.Unmarshal(msg, &seq)
+			rest, _ := asn1.Unmarshal(seq.Bytes, &id)
+			asn1.Unmarshal(rest, &op)
+			switch op.Tag {
+			case 0: // BindRequest
+				var version, name, auth asn1.RawValue
+				rest, _ := asn1.Unmarshal(op.Bytes, &version)
+				rest, _ = asn1.Unmarshal(rest, &name)
+				asn1.Unmarshal(rest, &auth)
+				code := 0
+				if string(name.Bytes) != bindDN || string(auth.Bytes) != password {
+					code = 49 // invalidCredentials
+				}
+				reply(conn, id.FullBytes, result(0x61, code))
+			case 3: // SearchRequest
+				// The filter follows the base, scope, derefAliases, sizeLimit,
+				// timeLimit and typesOnly.
+				var v, filter, attr, mail asn1.RawValue
+				rest := op.Bytes
+				for range 6 {
+					rest, _ = asn1.Unmarshal(rest, &v)
+				}
+				asn1.Unmarshal(rest, &filter)
+				rest, _ = asn1.Unmarshal(filter.Bytes, &attr)
+				asn1.Unmarshal(rest, &mail)
+				if vals, ok := values[string(mail.Bytes)]; ok {
+					var encoded [][]byte
+					for _, val := range vals {
+						encoded = append(encoded, berElement(0x04, val))
+					}
+					reply(conn, id.FullBytes, berElement(0x64, berOctets("cn=user"),
+						berElement(0x30, berElement(0x30, berOctets("key"), berElement(0x31, encoded...)))))
+				}
+				code := 0
+				if string(mail.Bytes) == "down@secure.example" {
+					code = 51 // busy
+				}
+				reply(conn, id.FullBytes, result(0x65, code))
+			case 2: // UnbindRequest
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func TestLDAPCertificateSource(t *testing.T) {
+	cert, _ := newTestCertificate(t, "bob@secure.example")
+	url := ldapTestServer(t, "cn=brisa", "secret", map[string][][]byte{
+		"bob@secure.example": {[]byte("not a certificate"), cert.Raw},
+	})
+	source, err := LDAPCertificateSource(LDAPConfig{URL: url, BindDN: "cn=brisa", Password: "secret", BaseDN: "dc=example"})
+	require.NoError(t, err)
+
+	got, err := source("bob@secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, cert.Raw, got.Raw)
+
+	got, err = source("carol@secure.example")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	_, err = source("down@secure.example")
+	assert.Error(t, err)
+
+	source, err = LDAPCertificateSource(LDAPConfig{URL: url, BindDN: "cn=brisa", Password: "wrong"})
+	require.NoError(t, err)
+	_, err = source("bob@secure.example")
+	assert.Error(t, err)
+
+	_, err = LDAPCertificateSource(LDAPConfig{URL: "http://ldap.example"})
+	assert.Error(t, err)
+}
+
+func TestLDAPPGPKeySource(t *testing.T) {
+	url := ldapTestServer(t, "", "", map[string][][]byte{
+		"bob@secure.example": {[]byte(testPGPCertificate)},
+	})
+	source, err := LDAPPGPKeySource(LDAPConfig{URL: url})
+	require.NoError(t, err)
+
+	key, err := source("bob@secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, "ba15308e5f9e8de987f7dda5e01fc982bb33be04", hex.EncodeToString(key.Fingerprint))
+
+	key, err = source("carol@secure.example")
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+}
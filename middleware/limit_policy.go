@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/muzhy/brisa"
+)
+
+// LimitRule sets the message limits of the sessions it matches. A rule
+// matches a session that matches each of its non-empty lists.
+type LimitRule struct {
+	// Users are the authenticated user names the rule applies to, ignoring
+	// case.
+	Users []string
+	// Networks are the IP addresses and CIDR blocks of the clients the rule
+	// applies to.
+	Networks []string
+	// Listeners are the names of the listeners the rule applies to; see
+	// brisa.Session.Listener.
+	Listeners []string
+	// Limits are the limits of the matching sessions. Zero values keep the
+	// default limits.
+	Limits brisa.MessageLimits
+}
+
+// LimitPolicyConfig configures the LimitPolicy middleware.
+type LimitPolicyConfig struct {
+	// Limits apply to sessions no rule matches, and to the zero values of the
+	// matching rule.
+	Limits brisa.MessageLimits
+	// Rules are tried in order; the first matching rule applies.
+	Rules []LimitRule
+}
+
+// LimitPolicy sets the recipient and size limits of each transaction (see
+// brisa.MessageLimits), which the server enforces: e.g. more recipients for
+// authenticated users on submission than for clients on the MX listener, or
+// larger messages from the internal network. It runs in the MailFrom chain,
+// after AUTH, and does not refuse anything itself. The limits of the server
+// still apply to all sessions.
+type LimitPolicy struct {
+	defaults brisa.MessageLimits
+	rules    []limitRule
+}
+
+type limitRule struct {
+	users     map[string]bool
+	networks  []*net.IPNet
+	listeners []string
+	limits    brisa.MessageLimits
+}
+
+// NewLimitPolicy creates a new LimitPolicy instance.
+func NewLimitPolicy(cfg LimitPolicyConfig) (*LimitPolicy, error) {
+	if err := validateMessageLimits(cfg.Limits); err != nil {
+		return nil, err
+	}
+	p := &LimitPolicy{defaults: cfg.Limits}
+	for i, r := range cfg.Rules {
+		if err := validateMessageLimits(r.Limits); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		networks, err := parseNetworks(r.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid network: %w", i, err)
+		}
+		rule := limitRule{networks: networks, listeners: r.Listeners, limits: r.Limits}
+		if len(r.Users) > 0 {
+			rule.users = make(map[string]bool, len(r.Users))
+			for _, u := range r.Users {
+				rule.users[strings.ToLower(u)] = true
+			}
+		}
+		if rule.limits.MaxRecipients == 0 {
+			rule.limits.MaxRecipients = cfg.Limits.MaxRecipients
+		}
+		if rule.limits.MaxMessageBytes == 0 {
+			rule.limits.MaxMessageBytes = cfg.Limits.MaxMessageBytes
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// NewLimitPolicyHandler creates a new MailFrom middleware handler setting the
+// limits of the transaction.
+func NewLimitPolicyHandler(cfg LimitPolicyConfig) (brisa.Handler, error) {
+	p, err := NewLimitPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return p.Handle, nil
+}
+
+func validateMessageLimits(l brisa.MessageLimits) error {
+	if l.MaxRecipients < 0 || l.MaxMessageBytes < 0 {
+		return fmt.Errorf("message limits must not be negative")
+	}
+	return nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (p *LimitPolicy) Handle(ctx *brisa.Context) brisa.Action {
+	ctx.SetMessageLimits(p.Limits(ctx))
+	return ctx.Action
+}
+
+// Limits returns the limits of the session of ctx.
+func (p *LimitPolicy) Limits(ctx *brisa.Context) brisa.MessageLimits {
+	for _, r := range p.rules {
+		if r.matches(ctx) {
+			return r.limits
+		}
+	}
+	return p.defaults
+}
+
+func (r *limitRule) matches(ctx *brisa.Context) bool {
+	if r.users != nil {
+		if !ctx.HasFlag(brisa.FlagAuthenticated) || !r.users[strings.ToLower(ctx.Auth().Username)] {
+			return false
+		}
+	}
+	if len(r.networks) > 0 {
+		ip := clientIP(ctx)
+		if ip == nil || !slices.ContainsFunc(r.networks, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			return false
+		}
+	}
+	if len(r.listeners) > 0 {
+		if ctx.Session == nil || !slices.Contains(r.listeners, ctx.Session.Listener()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLimitPolicy(t *testing.T) {
+	_, err := NewLimitPolicy(LimitPolicyConfig{Limits: brisa.MessageLimits{MaxRecipients: -1}})
+	require.Error(t, err)
+	_, err = NewLimitPolicy(LimitPolicyConfig{Rules: []LimitRule{{Networks: []string{"10.0.0.0/33"}}}})
+	require.Error(t, err)
+}
+
+func TestLimitPolicy(t *testing.T) {
+	p, err := NewLimitPolicy(LimitPolicyConfig{
+		Limits: brisa.MessageLimits{MaxRecipients: 2, MaxMessageBytes: 100},
+		Rules: []LimitRule{
+			{Users: []string{"Alice"}, Listeners: []string{"submission"}, Limits: brisa.MessageLimits{MaxRecipients: 4}},
+			{Networks: []string{"10.0.0.0/8"}, Limits: brisa.MessageLimits{MaxMessageBytes: 1000}},
+		},
+	})
+	require.NoError(t, err)
+	router := brisa.Router{}
+	router.OnMailFrom(&brisa.Middleware{Handler: p.Handle})
+	router.OnRcptTo(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		if strings.HasPrefix(ctx.To[len(ctx.To)-1], "unknown@") {
+			return ctx.RejectWith(ErrUnknownRecipient)
+		}
+		return brisa.Pass
+	}})
+	b := brisa.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+	b.SetAuthenticator(brisa.AuthenticatorFunc(func(ctx *brisa.Context, username, password string) error {
+		return nil
+	}))
+
+	small, large := "Subject: hi\r\n\r\nhello\r\n", "Subject: hi\r\n\r\n"+strings.Repeat("x", 200)+"\r\n"
+	tests := []struct {
+		name     string
+		setup    func(env *brisa.Envelope)
+		message  string
+		accepted int
+		tooLarge bool
+	}{
+		{"default", func(env *brisa.Envelope) {}, small, 2, false},
+		{"default too large", func(env *brisa.Envelope) {}, large, 2, true},
+		{"user on submission", func(env *brisa.Envelope) { env.Listener, env.Username = "submission", "alice" }, small, 4, false},
+		{"user on mx", func(env *brisa.Envelope) { env.Username = "alice" }, small, 2, false},
+		{"user keeps default size", func(env *brisa.Envelope) { env.Listener, env.Username = "submission", "alice" }, large, 4, true},
+		{"network", func(env *brisa.Envelope) { env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("10.1.2.3")} }, large, 2, false},
+	}
+	for _, tt := range tests {
+		env := brisatest.DefaultEnvelope()
+		env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("203.0.113.9")}
+		env.To = []string{"unknown@example.com", "a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+		tt.setup(&env)
+		res := b.Simulate(env, strings.NewReader(tt.message))
+
+		// The refused recipient does not count towards the limit.
+		assert.Equal(t, ErrUnknownRecipient, res.RcptErrors["unknown@example.com"], tt.name)
+		assert.Len(t, res.RcptErrors, len(env.To)-tt.accepted, tt.name)
+		for _, err := range res.RcptErrors {
+			if err != ErrUnknownRecipient {
+				assert.Equal(t, brisa.ErrTooManyRecipients, err, tt.name)
+			}
+		}
+		if tt.tooLarge {
+			assert.Equal(t, smtp.ErrDataTooLarge, res.Err, tt.name)
+		} else {
+			assert.NoError(t, res.Err, tt.name)
+		}
+	}
+}
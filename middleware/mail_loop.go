@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// DefaultMaxReceived is the default maximum number of Received headers a
+// message may carry before it is considered to be looping.
+const DefaultMaxReceived = 30
+
+// ErrMailLoop is returned when a message is rejected as a probable mail loop.
+var ErrMailLoop = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+	Message:      "Routing loop detected",
+}
+
+// receivedByPattern extracts the host name from the "by" clause of a Received header.
+var receivedByPattern = regexp.MustCompile(`(?i)\bby\s+([^\s;()]+)`)
+
+// MailLoopConfig configures the MailLoop middleware.
+type MailLoopConfig struct {
+	// MaxReceived is the maximum number of Received headers allowed.
+	// Defaults to DefaultMaxReceived.
+	MaxReceived int
+	// Hostnames are the names this server (or cluster) uses in Received headers.
+	Hostnames []string
+	// MaxOwnHops is the number of Received headers naming one of Hostnames that
+	// is still tolerated, e.g. for mail legitimately passing through twice.
+	MaxOwnHops int
+}
+
+// MailLoop detects messages that are looping between mail servers, either
+// because they have been relayed too many times, because they already passed
+// through this server, or because they were already delivered to one of the
+// current recipients (Delivered-To).
+type MailLoop struct {
+	maxReceived int
+	maxOwnHops  int
+	hostnames   map[string]struct{}
+}
+
+// NewMailLoop creates a new MailLoop instance.
+func NewMailLoop(cfg MailLoopConfig) *MailLoop {
+	ml := &MailLoop{
+		maxReceived: cfg.MaxReceived,
+		maxOwnHops:  cfg.MaxOwnHops,
+		hostnames:   make(map[string]struct{}, len(cfg.Hostnames)),
+	}
+	if ml.maxReceived <= 0 {
+		ml.maxReceived = DefaultMaxReceived
+	}
+	for _, name := range cfg.Hostnames {
+		ml.hostnames[strings.ToLower(name)] = struct{}{}
+	}
+	return ml
+}
+
+// NewMailLoopHandler creates a new Data middleware handler that rejects
+// probable mail loops with ErrMailLoop.
+func NewMailLoopHandler(cfg MailLoopConfig) brisa.Handler {
+	return NewMailLoop(cfg).Handle
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (ml *MailLoop) Handle(ctx *brisa.Context) brisa.Action {
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return brisa.Reject
+	}
+	defer setMessage(ctx, h, body)
+
+	if reason := ml.detect(h, ctx.To); reason != "" {
+		ctx.Logger.Warn("probable mail loop detected", "reason", reason)
+		return ctx.RejectWith(ErrMailLoop)
+	}
+	return brisa.Pass
+}
+
+// detect returns a non-empty reason if the header indicates a mail loop.
+func (ml *MailLoop) detect(h *messageHeader, recipients []string) string {
+	received := h.Values("Received")
+	if len(received) > ml.maxReceived {
+		return "too many Received headers"
+	}
+
+	if len(ml.hostnames) > 0 {
+		ownHops := 0
+		for _, value := range received {
+			m := receivedByPattern.FindStringSubmatch(value)
+			if m == nil {
+				continue
+			}
+			if _, ok := ml.hostnames[strings.ToLower(m[1])]; ok {
+				ownHops++
+			}
+		}
+		if ownHops > ml.maxOwnHops {
+			return "message already passed through this server"
+		}
+	}
+
+	for _, deliveredTo := range h.Values("Delivered-To") {
+		for _, rcpt := range recipients {
+			if strings.EqualFold(deliveredTo, rcpt) {
+				return "message already delivered to recipient"
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailLoop_Handle(t *testing.T) {
+	testCases := []struct {
+		name       string
+		cfg        MailLoopConfig
+		header     string
+		recipients []string
+		wantAction brisa.Action
+	}{
+		{
+			name:       "few Received headers pass",
+			cfg:        MailLoopConfig{MaxReceived: 3},
+			header:     strings.Repeat("Received: from a by b\r\n", 3),
+			wantAction: brisa.Pass,
+		},
+		{
+			name:       "too many Received headers",
+			cfg:        MailLoopConfig{MaxReceived: 3},
+			header:     strings.Repeat("Received: from a by b\r\n", 4),
+			wantAction: brisa.Reject,
+		},
+		{
+			name:       "own hostname within tolerance",
+			cfg:        MailLoopConfig{Hostnames: []string{"mx.example.com"}, MaxOwnHops: 1},
+			header:     "Received: from a by MX.example.com (Brisa); Mon, 1 Jan 2024 00:00:00 +0000\r\n",
+			wantAction: brisa.Pass,
+		},
+		{
+			name: "own hostname seen too often",
+			cfg:  MailLoopConfig{Hostnames: []string{"mx.example.com"}, MaxOwnHops: 1},
+			header: "Received: from a by mx.example.com; Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+				"Received: from b\r\n\tby mx.example.com; Mon, 1 Jan 2024 00:00:00 +0000\r\n",
+			wantAction: brisa.Reject,
+		},
+		{
+			name:       "already delivered to recipient",
+			header:     "Delivered-To: Bob@example.com\r\n",
+			recipients: []string{"bob@example.com"},
+			wantAction: brisa.Reject,
+		},
+		{
+			name:       "delivered to another recipient",
+			header:     "Delivered-To: alice@example.com\r\n",
+			recipients: []string{"bob@example.com"},
+			wantAction: brisa.Pass,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newTestContext(t, tc.header+"Subject: test\r\n\r\nbody\r\n")
+			ctx.To = tc.recipients
+
+			action := NewMailLoopHandler(tc.cfg)(ctx)
+			assert.Equal(t, tc.wantAction, action)
+			if tc.wantAction == brisa.Reject {
+				assert.Equal(t, ErrMailLoop, ctx.RejectError())
+			}
+			assert.True(t, strings.HasSuffix(readTestMessage(t, ctx), "\r\n\r\nbody\r\n"))
+		})
+	}
+}
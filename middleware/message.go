@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"io"
+
+	"github.com/muzhy/brisa"
+)
+
+// readMessagePrefix reads up to limit bytes of the message held by ctx, or the
+// whole message if limit is zero or less. The message is spooled (see
+// brisa.Context.SpoolMessage), so that later middleware still see the
+// complete message and read it from the same spool.
+func readMessagePrefix(ctx *brisa.Context, limit int64) ([]byte, error) {
+	sp, err := ctx.SpoolMessage()
+	if err != nil {
+		return nil, err
+	}
+	r := sp.NewReader()
+	if limit > 0 {
+		r = io.LimitReader(r, limit)
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/muzhy/brisa"
+)
+
+// DateSkewedKey is the context key set to true when the Date header of a message
+// is skewed beyond the configured tolerance.
+const DateSkewedKey = "hygiene.date_skewed"
+
+// DateSkewPolicy defines how MessageHygiene treats a skewed Date header.
+type DateSkewPolicy int
+
+const (
+	// DateSkewIgnore leaves skewed Date headers untouched.
+	DateSkewIgnore DateSkewPolicy = iota
+	// DateSkewFlag keeps the Date header but marks the context with DateSkewedKey.
+	DateSkewFlag
+	// DateSkewNormalize replaces the Date header with the time the message was
+	// received. The original value is kept in X-Original-Date.
+	DateSkewNormalize
+)
+
+// MessageHygieneConfig configures the MessageHygiene middleware.
+type MessageHygieneConfig struct {
+	// Hostname is used as the right-hand side of generated Message-IDs.
+	// Defaults to the local hostname.
+	Hostname string
+	// MaxDateSkew is the tolerated distance between the Date header and the
+	// time of receipt. Zero disables the check.
+	MaxDateSkew time.Duration
+	// DateSkewPolicy selects what to do with a skewed or unparsable Date header.
+	DateSkewPolicy DateSkewPolicy
+	// RequiredHeaders lists header fields that must be present; messages missing
+	// any of them are rejected. Leave empty to never reject.
+	RequiredHeaders []string
+	// Clock tells the time of receipt. Defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// MessageHygiene fixes up common defects in submitted messages: it adds a
+// Message-ID and Date when they are missing, handles wildly skewed Date headers
+// and optionally rejects messages lacking mandatory header fields.
+type MessageHygiene struct {
+	cfg MessageHygieneConfig
+}
+
+// NewMessageHygiene creates a new MessageHygiene instance.
+func NewMessageHygiene(cfg MessageHygieneConfig) (*MessageHygiene, error) {
+	if cfg.MaxDateSkew < 0 {
+		return nil, fmt.Errorf("invalid max date skew: %s", cfg.MaxDateSkew)
+	}
+	if cfg.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine hostname for Message-ID: %w", err)
+		}
+		cfg.Hostname = hostname
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+	return &MessageHygiene{cfg: cfg}, nil
+}
+
+// NewMessageHygieneHandler creates a new Data middleware handler that applies
+// the message hygiene rules.
+func NewMessageHygieneHandler(cfg MessageHygieneConfig) (brisa.Handler, error) {
+	hygiene, err := NewMessageHygiene(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return hygiene.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (mh *MessageHygiene) Handle(ctx *brisa.Context) brisa.Action {
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return brisa.Reject
+	}
+	defer setMessage(ctx, h, body)
+
+	for _, key := range mh.cfg.RequiredHeaders {
+		if !h.Has(key) {
+			ctx.Logger.Info("message rejected, missing mandatory header", "header", key)
+			return brisa.Reject
+		}
+	}
+
+	if !h.Has("Message-ID") {
+		id := fmt.Sprintf("<%s@%s>", uuid.NewString(), mh.cfg.Hostname)
+		h.Add("Message-ID", id)
+		ctx.Logger.Debug("added missing Message-ID", "message_id", id)
+	}
+
+	now := mh.cfg.Clock.Now()
+	date := h.Get("Date")
+	if date == "" {
+		h.Add("Date", now.Format(time.RFC1123Z))
+		return brisa.Pass
+	}
+
+	if mh.cfg.MaxDateSkew == 0 || mh.cfg.DateSkewPolicy == DateSkewIgnore {
+		return brisa.Pass
+	}
+	if t, err := mail.ParseDate(date); err == nil && absDuration(now.Sub(t)) <= mh.cfg.MaxDateSkew {
+		return brisa.Pass
+	}
+
+	ctx.Logger.Info("message has skewed or invalid Date header", "date", date)
+	switch mh.cfg.DateSkewPolicy {
+	case DateSkewFlag:
+		ctx.Set(DateSkewedKey, true)
+	case DateSkewNormalize:
+		h.Set("X-Original-Date", date)
+		h.Set("Date", now.Format(time.RFC1123Z))
+	}
+	return brisa.Pass
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
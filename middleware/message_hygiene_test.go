@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestContext returns a context carrying the given raw message.
+func newTestContext(t *testing.T, message string) *brisa.Context {
+	ctx := brisa.NewContext()
+	ctx.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx.Reader = strings.NewReader(message)
+	t.Cleanup(func() { brisa.FreeContext(ctx) })
+	return ctx
+}
+
+// readTestMessage consumes the (possibly rewritten) message from the context.
+func readTestMessage(t *testing.T, ctx *brisa.Context) string {
+	data, err := io.ReadAll(ctx.Reader)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestMessageHygiene_Handle(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	newHygiene := func(t *testing.T, cfg MessageHygieneConfig) *MessageHygiene {
+		cfg.Hostname = "mx.example.com"
+		cfg.Clock = brisatest.NewFakeClock(now)
+		mh, err := NewMessageHygiene(cfg)
+		require.NoError(t, err)
+		return mh
+	}
+
+	t.Run("adds missing Message-ID and Date", func(t *testing.T) {
+		mh := newHygiene(t, MessageHygieneConfig{})
+		ctx := newTestContext(t, "From: a@example.com\r\n\r\nhello\r\n")
+
+		assert.Equal(t, brisa.Pass, mh.Handle(ctx))
+
+		msg := readTestMessage(t, ctx)
+		assert.Contains(t, msg, "Message-ID: <")
+		assert.Contains(t, msg, "@mx.example.com>\r\n")
+		assert.Contains(t, msg, "Date: Thu, 02 Jan 2025 03:04:05 +0000\r\n")
+		assert.True(t, strings.HasSuffix(msg, "\r\n\r\nhello\r\n"))
+	})
+
+	t.Run("keeps existing Message-ID", func(t *testing.T) {
+		mh := newHygiene(t, MessageHygieneConfig{})
+		ctx := newTestContext(t, "Message-ID: <x@y>\r\nDate: Thu, 02 Jan 2025 03:04:05 +0000\r\n\r\n")
+
+		assert.Equal(t, brisa.Pass, mh.Handle(ctx))
+		assert.Equal(t, "Message-ID: <x@y>\r\nDate: Thu, 02 Jan 2025 03:04:05 +0000\r\n\r\n", readTestMessage(t, ctx))
+	})
+
+	t.Run("rejects missing mandatory header", func(t *testing.T) {
+		mh := newHygiene(t, MessageHygieneConfig{RequiredHeaders: []string{"From"}})
+		ctx := newTestContext(t, "Subject: hi\r\n\r\n")
+
+		assert.Equal(t, brisa.Reject, mh.Handle(ctx))
+	})
+
+	t.Run("flags skewed date", func(t *testing.T) {
+		mh := newHygiene(t, MessageHygieneConfig{MaxDateSkew: 24 * time.Hour, DateSkewPolicy: DateSkewFlag})
+		ctx := newTestContext(t, "Message-ID: <x@y>\r\nDate: Mon, 02 Jan 2006 15:04:05 -0700\r\n\r\n")
+
+		assert.Equal(t, brisa.Pass, mh.Handle(ctx))
+		skewed, ok := ctx.Get(DateSkewedKey)
+		assert.True(t, ok)
+		assert.Equal(t, true, skewed)
+	})
+
+	t.Run("normalizes skewed date", func(t *testing.T) {
+		mh := newHygiene(t, MessageHygieneConfig{MaxDateSkew: 24 * time.Hour, DateSkewPolicy: DateSkewNormalize})
+		ctx := newTestContext(t, "Message-ID: <x@y>\r\nDate: not a date\r\n\r\n")
+
+		assert.Equal(t, brisa.Pass, mh.Handle(ctx))
+		msg := readTestMessage(t, ctx)
+		assert.Contains(t, msg, "Date: Thu, 02 Jan 2025 03:04:05 +0000\r\n")
+		assert.Contains(t, msg, "X-Original-Date: not a date\r\n")
+	})
+
+	t.Run("date within tolerance is untouched", func(t *testing.T) {
+		mh := newHygiene(t, MessageHygieneConfig{MaxDateSkew: 24 * time.Hour, DateSkewPolicy: DateSkewNormalize})
+		ctx := newTestContext(t, "Message-ID: <x@y>\r\nDate: Thu, 02 Jan 2025 01:00:00 +0000\r\n\r\n")
+
+		assert.Equal(t, brisa.Pass, mh.Handle(ctx))
+		_, ok := ctx.Get(DateSkewedKey)
+		assert.False(t, ok)
+		assert.NotContains(t, readTestMessage(t, ctx), "X-Original-Date")
+	})
+}
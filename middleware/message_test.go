@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMessagePrefix(t *testing.T) {
+	ctx := newTestContext(t, "Subject: hi\r\n\r\nbody\r\n")
+
+	prefix, err := readMessagePrefix(ctx, 4)
+	require.NoError(t, err)
+	assert.Equal(t, "Subj", string(prefix))
+
+	all, err := readMessagePrefix(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: hi\r\n\r\nbody\r\n", string(all))
+	assert.Equal(t, "Subject: hi\r\n\r\nbody\r\n", readTestMessage(t, ctx))
+}
+
+func TestReadMessagePrefix_AfterHeaderRewrite(t *testing.T) {
+	ctx := newTestContext(t, "Subject: hi\r\n\r\nbody\r\n")
+	_, err := readMessagePrefix(ctx, 0)
+	require.NoError(t, err)
+
+	h, body, err := readMessageHeader(ctx)
+	require.NoError(t, err)
+	h.Prepend("X-Test", "1")
+	setMessage(ctx, h, body)
+
+	// The rewritten message shares the spool instead of being spooled again.
+	sp := ctx.MessageSpool()
+	require.NotNil(t, sp)
+	all, err := readMessagePrefix(ctx, 0)
+	require.NoError(t, err)
+	assert.Same(t, sp, ctx.MessageSpool())
+	assert.Equal(t, "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n", string(all))
+	assert.Equal(t, "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n", readTestMessage(t, ctx))
+}
@@ -0,0 +1,319 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxMIMEDepth bounds the nesting of multipart bodies.
+	maxMIMEDepth = 16
+	// maxMIMEParts bounds the number of parts visited in one message.
+	maxMIMEParts = 1000
+)
+
+// errStopWalk can be returned by a walkParts callback to stop early without error.
+var errStopWalk = errors.New("stop walking message parts")
+
+// errTooManyParts is returned when a message exceeds maxMIMEParts.
+var errTooManyParts = errors.New("too many MIME parts")
+
+// messagePart is a leaf part of a MIME message.
+type messagePart struct {
+	Header    textproto.MIMEHeader
+	MediaType string // lower-case media type, e.g. "text/plain"
+	Params    map[string]string
+	// Filename is the decoded file name of the part, if any.
+	Filename string
+	// Body is the content with its transfer encoding removed.
+	Body []byte
+}
+
+// IsAttachment reports whether the part is meant to be saved rather than
+// displayed inline.
+func (p *messagePart) IsAttachment() bool {
+	disposition, _, _ := parseMediaType(p.Header.Get("Content-Disposition"))
+	return disposition == "attachment" || (p.Filename != "" && !strings.HasPrefix(p.MediaType, "text/"))
+}
+
+// walkParts parses the message in data and calls fn for each of its leaf parts,
+// descending into multipart bodies. Parsing is lenient: a part whose transfer
+// encoding cannot be decoded is passed on with its raw body.
+func walkParts(data []byte, fn func(p *messagePart) error) error {
+	br := bufio.NewReader(bytes.NewReader(data))
+	h, err := readHeader(br)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = walkPart(mimeHeaderOf(h), body, 0, &count, fn)
+	if errors.Is(err, errStopWalk) {
+		return nil
+	}
+	return err
+}
+
+func walkPart(header textproto.MIMEHeader, body []byte, depth int, count *int, fn func(p *messagePart) error) error {
+	if *count++; *count > maxMIMEParts {
+		return errTooManyParts
+	}
+
+	mediaType, params, err := parseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxMIMEDepth {
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				// A truncated or malformed multipart body ends the walk of this
+				// level; whatever was parsed so far has been visited.
+				return nil
+			}
+			partBody, err := io.ReadAll(part)
+			if err != nil {
+				return nil
+			}
+			if err := walkPart(part.Header, partBody, depth+1, count, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	return fn(newMessagePart(header, mediaType, params, body))
+}
+
+// utf8ParamValue matches an unquoted parameter value with UTF-8 characters.
+var utf8ParamValue = regexp.MustCompile(`=([^\s";]*[^\x00-\x7f][^\s";]*)`)
+
+// parseMediaType is mime.ParseMediaType, also accepting the unquoted UTF-8
+// parameter values of internationalized messages (RFC 6532), such as
+// filename=résumé.pdf, which it rejects. Otherwise such a part would lose its
+// media type and file name to the checks.
+func parseMediaType(v string) (string, map[string]string, error) {
+	mediaType, params, err := mime.ParseMediaType(v)
+	if errors.Is(err, mime.ErrInvalidMediaParameter) {
+		mediaType, params, err = mime.ParseMediaType(utf8ParamValue.ReplaceAllString(v, `="$1"`))
+	}
+	return mediaType, params, err
+}
+
+// newMessagePart returns the leaf part with header and the raw body.
+func newMessagePart(header textproto.MIMEHeader, mediaType string, params map[string]string, body []byte) *messagePart {
+	return &messagePart{
+		Header:    header,
+		MediaType: mediaType,
+		Params:    params,
+		Filename:  partFilename(header, params),
+		Body:      decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body),
+	}
+}
+
+// mimeHeaderOf returns the fields of h as a textproto.MIMEHeader.
+func mimeHeaderOf(h *messageHeader) textproto.MIMEHeader {
+	header := make(textproto.MIMEHeader)
+	for _, f := range h.fields {
+		if f.Key != "" {
+			header.Add(f.Key, f.Value)
+		}
+	}
+	return header
+}
+
+// partFilename returns the decoded file name from Content-Disposition or, as a
+// fallback, the name parameter of Content-Type.
+func partFilename(header textproto.MIMEHeader, params map[string]string) string {
+	name := ""
+	if _, dparams, err := parseMediaType(header.Get("Content-Disposition")); err == nil {
+		name = dparams["filename"]
+	}
+	if name == "" {
+		name = params["name"]
+	}
+	dec := new(mime.WordDecoder)
+	if decoded, err := dec.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
+
+// decodeTransferEncoding removes the Content-Transfer-Encoding from body. The
+// raw body is returned if it cannot be decoded.
+func decodeTransferEncoding(encoding string, body []byte) []byte {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.TrimSpace(body)))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil && len(decoded) == 0 {
+		return body
+	}
+	return decoded
+}
+
+// mimeReplacement replaces a leaf part: its content header fields and body.
+type mimeReplacement struct {
+	Fields [][2]string
+	Body   []byte
+}
+
+// rewriteParts calls fn for each leaf part of the message in data like
+// walkParts, and replaces the parts for which fn returns a replacement. The
+// other parts, the boundaries and the message header are kept byte-for-byte.
+// It reports whether the message was changed.
+func rewriteParts(data []byte, fn func(p *messagePart) *mimeReplacement) ([]byte, bool, error) {
+	br := bufio.NewReader(bytes.NewReader(data))
+	h, err := readHeader(br)
+	if err != nil {
+		return data, false, err
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return data, false, err
+	}
+
+	count := 0
+	newBody, repl, changed, err := rewritePart(mimeHeaderOf(h), body, 0, &count, fn)
+	if err != nil || !changed {
+		return data, false, err
+	}
+	if repl != nil {
+		// The message itself is the part: replace its content fields only.
+		for _, key := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"} {
+			h.Del(key)
+		}
+		for _, f := range repl.Fields {
+			h.Add(f[0], f[1])
+		}
+		newBody = repl.Body
+	}
+	return append(h.Bytes(), newBody...), true, nil
+}
+
+// rewritePart rewrites a part with header and raw body. A leaf part is
+// returned as a replacement, a multipart body as newBody.
+func rewritePart(header textproto.MIMEHeader, body []byte, depth int, count *int, fn func(p *messagePart) *mimeReplacement) (newBody []byte, repl *mimeReplacement, changed bool, err error) {
+	if *count++; *count > maxMIMEParts {
+		return nil, nil, false, errTooManyParts
+	}
+	mediaType, params, err := parseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxMIMEDepth {
+		newBody, changed, err := rewriteMultipart(body, params["boundary"], depth, count, fn)
+		return newBody, nil, changed, err
+	}
+	if r := fn(newMessagePart(header, mediaType, params, body)); r != nil {
+		return nil, r, true, nil
+	}
+	return body, nil, false, nil
+}
+
+// rewriteMultipart rewrites the parts of a multipart body with boundary.
+func rewriteMultipart(body []byte, boundary string, depth int, count *int, fn func(p *messagePart) *mimeReplacement) ([]byte, bool, error) {
+	delim := []byte("--" + boundary)
+	var out bytes.Buffer
+	changed, inPart := false, false
+	partStart := 0
+	for off := 0; off < len(body); {
+		lineEnd := len(body)
+		if i := bytes.IndexByte(body[off:], '\n'); i >= 0 {
+			lineEnd = off + i + 1
+		}
+		line := body[off:lineEnd]
+		rest, ok := bytes.CutPrefix(bytes.TrimRight(line, " \t\r\n"), delim)
+		if !ok || (len(rest) > 0 && string(rest) != "--") {
+			off = lineEnd
+			continue
+		}
+
+		if inPart {
+			part, c, err := rewriteRawPart(body[partStart:off], depth, count, fn)
+			if err != nil {
+				return body, false, err
+			}
+			out.Write(part)
+			changed = changed || c
+		} else {
+			out.Write(body[:off])
+		}
+		out.Write(line)
+		if len(rest) > 0 {
+			// The close delimiter: the epilogue is kept as it is.
+			out.Write(body[lineEnd:])
+			return out.Bytes(), changed, nil
+		}
+		inPart, partStart, off = true, lineEnd, lineEnd
+	}
+	if inPart {
+		// A truncated body: the last part is kept as it is.
+		out.Write(body[partStart:])
+	}
+	if !changed {
+		return body, false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+// rewriteRawPart rewrites a part of a multipart body. raw ends with the line
+// break that belongs to the following delimiter.
+func rewriteRawPart(raw []byte, depth int, count *int, fn func(p *messagePart) *mimeReplacement) ([]byte, bool, error) {
+	content := raw
+	lineBreak := []byte(nil)
+	for _, lb := range [][]byte{[]byte("\r\n"), []byte("\n")} {
+		if bytes.HasSuffix(content, lb) {
+			content, lineBreak = content[:len(content)-len(lb)], lb
+			break
+		}
+	}
+
+	br := bufio.NewReader(bytes.NewReader(content))
+	h, err := readHeader(br)
+	if err != nil {
+		return raw, false, nil
+	}
+	body, _ := io.ReadAll(br)
+	newBody, repl, changed, err := rewritePart(mimeHeaderOf(h), body, depth+1, count, fn)
+	if err != nil || !changed {
+		return raw, false, err
+	}
+
+	var out bytes.Buffer
+	if repl != nil {
+		for _, f := range repl.Fields {
+			out.Write(newHeaderField(f[0], f[1]).Raw)
+		}
+		out.WriteString("\r\n")
+		out.Write(repl.Body)
+	} else {
+		out.Write(h.Bytes())
+		out.Write(newBody)
+	}
+	out.Write(lineBreak)
+	return out.Bytes(), true, nil
+}
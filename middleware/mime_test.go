@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMultipartMessage = "From: a@example.com\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>cafe</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"=?utf-8?q?r=C3=A9sum=C3=A9.pdf?=\"\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0x\r\n" +
+	"LjQ=\r\n" +
+	"--outer--\r\n"
+
+func TestWalkParts(t *testing.T) {
+	var parts []*messagePart
+	err := walkParts([]byte(testMultipartMessage), func(p *messagePart) error {
+		parts = append(parts, p)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, parts, 3)
+
+	assert.Equal(t, "text/plain", parts[0].MediaType)
+	assert.Equal(t, "café", string(parts[0].Body))
+	assert.False(t, parts[0].IsAttachment())
+
+	assert.Equal(t, "text/html", parts[1].MediaType)
+	assert.Equal(t, "<p>cafe</p>", string(parts[1].Body))
+
+	assert.Equal(t, "application/pdf", parts[2].MediaType)
+	assert.Equal(t, "résumé.pdf", parts[2].Filename)
+	assert.Equal(t, "%PDF-1.4", string(parts[2].Body))
+	assert.True(t, parts[2].IsAttachment())
+}
+
+func TestWalkParts_SinglePart(t *testing.T) {
+	var parts []*messagePart
+	err := walkParts([]byte("Subject: hi\r\n\r\nhello\r\n"), func(p *messagePart) error {
+		parts = append(parts, p)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	assert.Equal(t, "text/plain", parts[0].MediaType)
+	assert.Equal(t, "hello\r\n", string(parts[0].Body))
+}
+
+func TestWalkParts_UTF8Params(t *testing.T) {
+	// Internationalized messages (RFC 6532) may carry unquoted UTF-8
+	// parameter values, which must not hide the type and name of a part.
+	msg := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/x-msdownload; name=fähre.exe\r\n" +
+		"Content-Disposition: attachment; filename=fähre.exe; size=3\r\n" +
+		"\r\n" +
+		"MZ!\r\n" +
+		"--b--\r\n"
+	var parts []*messagePart
+	require.NoError(t, walkParts([]byte(msg), func(p *messagePart) error {
+		parts = append(parts, p)
+		return nil
+	}))
+	require.Len(t, parts, 1)
+	assert.Equal(t, "application/x-msdownload", parts[0].MediaType)
+	assert.Equal(t, "fähre.exe", parts[0].Filename)
+	assert.True(t, parts[0].IsAttachment())
+}
+
+func TestWalkParts_Stop(t *testing.T) {
+	calls := 0
+	err := walkParts([]byte(testMultipartMessage), func(p *messagePart) error {
+		calls++
+		return errStopWalk
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func FuzzWalkParts(f *testing.F) {
+	f.Add([]byte(testMultipartMessage))
+	f.Add([]byte("Subject: hi\r\n\r\nhello\r\n"))
+	f.Add([]byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b--\r\n"))
+	f.Add([]byte("Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\n!!!\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parts := 0
+		err := walkParts(data, func(p *messagePart) error {
+			parts++
+			return nil
+		})
+		if parts > maxMIMEParts {
+			t.Fatalf("visited %d parts, limit is %d", parts, maxMIMEParts)
+		}
+		if err == errTooManyParts && parts != maxMIMEParts {
+			t.Fatalf("stopped at %d parts, limit is %d", parts, maxMIMEParts)
+		}
+	})
+}
@@ -0,0 +1,462 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultOAuth2UsernameClaim is the default claim holding the user name
+	// of a token.
+	DefaultOAuth2UsernameClaim = "email"
+	// DefaultOAuth2Leeway is the default clock skew allowed for the exp and
+	// nbf claims.
+	DefaultOAuth2Leeway = time.Minute
+	// DefaultJWKSRefreshInterval is the default minimum time between two
+	// fetches of the JWKS, which is fetched again for tokens signed with an
+	// unknown key.
+	DefaultJWKSRefreshInterval = 5 * time.Minute
+)
+
+// OAuth2Config configures the OAuth2 authenticator.
+type OAuth2Config struct {
+	// Issuer is the OIDC issuer whose tokens are accepted, compared with the
+	// iss claim.
+	Issuer string
+	// JWKSURL is the URL of the issuer's signing keys. If empty, it is
+	// discovered from the jwks_uri of Issuer's
+	// /.well-known/openid-configuration.
+	JWKSURL string
+	// Audience, if set, must be one of the token's aud claim.
+	Audience string
+	// Scopes must all be granted by the token, in its "scope" (space
+	// separated) or "scp" (list) claim.
+	Scopes []string
+	// UsernameClaim is the claim that must match the user name the client
+	// authenticates as. Defaults to DefaultOAuth2UsernameClaim.
+	UsernameClaim string
+	// Leeway defaults to DefaultOAuth2Leeway.
+	Leeway time.Duration
+	// RefreshInterval defaults to DefaultJWKSRefreshInterval.
+	RefreshInterval time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Clock checks the token lifetime. Defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// OAuth2 is a brisa.TokenAuthenticator accepting JWT access tokens of an
+// OIDC issuer with AUTH OAUTHBEARER and XOAUTH2. It does not accept
+// passwords.
+type OAuth2 struct {
+	cfg OAuth2Config
+
+	mu        sync.RWMutex
+	jwksURL   string
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	fetch     *jwksFetch // in progress, or nil
+}
+
+// jwksFetch is a fetch of the signing keys, shared by the tokens waiting for
+// it.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	errPasswordNotSupported = errors.New("password authentication not supported")
+	errUnknownSigningKey    = errors.New("token signed with an unknown key")
+)
+
+// NewOAuth2 creates a new OAuth2 authenticator. The keys are fetched with
+// the first token.
+func NewOAuth2(cfg OAuth2Config) (*OAuth2, error) {
+	if cfg.Issuer == "" {
+		return nil, fmt.Errorf("oauth2 requires an issuer")
+	}
+	if cfg.Leeway < 0 || cfg.RefreshInterval < 0 {
+		return nil, fmt.Errorf("oauth2 leeway and refresh interval must not be negative")
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = DefaultOAuth2UsernameClaim
+	}
+	if cfg.Leeway == 0 {
+		cfg.Leeway = DefaultOAuth2Leeway
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = DefaultJWKSRefreshInterval
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+	return &OAuth2{cfg: cfg, jwksURL: cfg.JWKSURL}, nil
+}
+
+// Authenticate implements brisa.Authenticator. It refuses all passwords.
+func (o *OAuth2) Authenticate(ctx *brisa.Context, username, password string) error {
+	return errPasswordNotSupported
+}
+
+// AuthenticateToken implements brisa.TokenAuthenticator. It returns the
+// UsernameClaim of the token.
+func (o *OAuth2) AuthenticateToken(ctx *brisa.Context, username, token string) (string, error) {
+	claims, err := o.verify(token)
+	if err != nil {
+		return "", err
+	}
+	if err := o.checkClaims(claims); err != nil {
+		return "", err
+	}
+	subject, _ := claims[o.cfg.UsernameClaim].(string)
+	if subject == "" {
+		return "", fmt.Errorf("token has no %s claim", o.cfg.UsernameClaim)
+	}
+	if username != "" && !strings.EqualFold(username, subject) {
+		return "", fmt.Errorf("token issued to %s, not %s", subject, username)
+	}
+	return subject, nil
+}
+
+// verify checks the signature of a JWT and returns its claims.
+func (o *OAuth2) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	return claims, nil
+}
+
+func (o *OAuth2) checkClaims(claims map[string]any) error {
+	if iss, _ := claims["iss"].(string); iss != o.cfg.Issuer {
+		return fmt.Errorf("token issued by %q", iss)
+	}
+	if o.cfg.Audience != "" && !slices.Contains(stringList(claims["aud"]), o.cfg.Audience) {
+		return fmt.Errorf("token not issued for %s", o.cfg.Audience)
+	}
+
+	now := o.cfg.Clock.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(o.cfg.Leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(o.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+
+	granted := stringList(claims["scp"])
+	if scope, ok := claims["scope"].(string); ok {
+		granted = append(granted, strings.Fields(scope)...)
+	}
+	for _, scope := range o.cfg.Scopes {
+		if !slices.Contains(granted, scope) {
+			return fmt.Errorf("token lacks scope %s", scope)
+		}
+	}
+	return nil
+}
+
+// key returns the signing key with the given ID, fetching the JWKS if the
+// key is unknown and it was not fetched within the refresh interval. The
+// fetch runs without holding the lock, so that tokens signed with a known key
+// are not held up by a slow issuer, and tokens waiting for the same fetch
+// share it.
+func (o *OAuth2) key(kid string) (crypto.PublicKey, error) {
+	o.mu.RLock()
+	key, ok := o.lookup(kid)
+	o.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	o.mu.Lock()
+	if key, ok := o.lookup(kid); ok {
+		o.mu.Unlock()
+		return key, nil
+	}
+	call := o.fetch
+	if call == nil {
+		if !o.fetchedAt.IsZero() && o.cfg.Clock.Now().Sub(o.fetchedAt) < o.cfg.RefreshInterval {
+			o.mu.Unlock()
+			return nil, errUnknownSigningKey
+		}
+		// Rate limit failed fetches too.
+		o.fetchedAt = o.cfg.Clock.Now()
+		call = &jwksFetch{done: make(chan struct{})}
+		o.fetch = call
+		jwksURL := o.jwksURL
+		o.mu.Unlock()
+
+		jwksURL, keys, err := o.fetchKeys(jwksURL)
+		o.mu.Lock()
+		if err == nil {
+			o.jwksURL, o.keys = jwksURL, keys
+		}
+		call.err = err
+		o.fetch = nil
+		close(call.done)
+	}
+	o.mu.Unlock()
+
+	<-call.done
+	if call.err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", call.err)
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if key, ok := o.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, errUnknownSigningKey
+}
+
+// lookup returns the key with the given ID; tokens without an ID are
+// accepted if the issuer has a single key.
+func (o *OAuth2) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, true
+		}
+	}
+	key, ok := o.keys[kid]
+	return key, ok
+}
+
+// fetchKeys fetches the signing keys from jwksURL, or from the jwks_uri of
+// the issuer if jwksURL is empty, and returns the URL they were fetched from.
+func (o *OAuth2) fetchKeys(jwksURL string) (string, map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := o.getJSON(ctx, strings.TrimSuffix(o.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return "", nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return "", nil, errors.New("issuer has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return "", nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Skip keys of unsupported types rather than failing all tokens.
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return jwksURL, keys, nil
+}
+
+func (o *OAuth2) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is a JSON Web Key (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// verifySignature checks the signature of a JWS signing input with the
+// algorithm named in its header. The key type must match the algorithm.
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) error {
+	invalid := errors.New("invalid token signature")
+	var h hash.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = sha256.New()
+	case "RS384", "ES384":
+		h = sha512.New384()
+	case "RS512":
+		h = sha512.New()
+	case "EdDSA":
+		if k, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(k, input, sig) {
+			return nil
+		}
+		return invalid
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return invalid
+		}
+		hashes := map[string]crypto.Hash{"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512}
+		if rsa.VerifyPKCS1v15(k, hashes[alg], digest, sig) != nil {
+			return invalid
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		// RFC 7518, section 3.4: each algorithm has its own curve.
+		curves := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384()}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if curves[alg] != k.Curve || len(sig) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+		return nil
+	}
+	return invalid
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringList returns a claim that is a string or a list of strings as a list.
+func stringList(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
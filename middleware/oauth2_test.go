@@ -0,0 +1,277 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type oauth2Issuer struct {
+	server  *httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	edKey   ed25519.PrivateKey
+	fetches atomic.Int64
+}
+
+func newOAuth2Issuer(t *testing.T) *oauth2Issuer {
+	t.Helper()
+	iss := &oauth2Issuer{}
+	var err error
+	iss.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	iss.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, iss.edKey, err = ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": iss.server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(iss.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(iss.rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(iss.ecKey.X.FillBytes(make([]byte, 32))), "y": b64(iss.ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(iss.edKey.Public().(ed25519.PublicKey))},
+		}})
+	})
+	iss.server = httptest.NewServer(mux)
+	t.Cleanup(iss.server.Close)
+	return iss
+}
+
+// token returns a JWT with the given claims signed by the key named kid.
+func (iss *oauth2Issuer) token(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	alg := map[string]string{"rsa": "RS256", "ec": "ES256", "ed": "EdDSA", "unknown": "RS256"}[kid]
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, iss.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, iss.ecKey, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		sig = ed25519.Sign(iss.edKey, []byte(input))
+	}
+	require.NoError(t, err)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestNewOAuth2(t *testing.T) {
+	_, err := NewOAuth2(OAuth2Config{})
+	require.Error(t, err)
+	_, err = NewOAuth2(OAuth2Config{Issuer: "https://idp.example.com", Leeway: -time.Second})
+	require.Error(t, err)
+}
+
+func TestOAuth2(t *testing.T) {
+	iss := newOAuth2Issuer(t)
+	clock := brisatest.NewFakeClock(time.Unix(1_700_000_000, 0))
+	auth, err := NewOAuth2(OAuth2Config{
+		Issuer:   iss.server.URL,
+		Audience: "smtp",
+		Scopes:   []string{"mail.send"},
+		Clock:    clock,
+	})
+	require.NoError(t, err)
+	ctx := brisatest.NewContext(t, brisatest.DefaultEnvelope(), "")
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   iss.server.URL,
+			"aud":   []string{"smtp", "imap"},
+			"exp":   clock.Now().Add(time.Hour).Unix(),
+			"nbf":   clock.Now().Add(-time.Minute).Unix(),
+			"scope": "openid mail.send",
+			"email": "Alice@example.com",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	authenticate := func(username, token string) error {
+		_, err := auth.AuthenticateToken(ctx, username, token)
+		return err
+	}
+	for _, kid := range []string{"rsa", "ec", "ed"} {
+		assert.NoError(t, authenticate("alice@example.com", iss.token(t, kid, claims(nil))), kid)
+	}
+	// Without an authorization identity, the user is the one of the token.
+	subject, err := auth.AuthenticateToken(ctx, "", iss.token(t, "rsa", claims(nil)))
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice@example.com", subject)
+	assert.NoError(t, authenticate("alice@example.com",
+		iss.token(t, "rsa", claims(map[string]any{"scope": nil, "scp": []string{"mail.send"}, "aud": "smtp"}))))
+	// Discovery and keys are fetched once.
+	assert.Equal(t, int64(1), iss.fetches.Load())
+
+	tests := map[string]map[string]any{
+		"issuer":      {"iss": "https://evil.example.com"},
+		"audience":    {"aud": "imap"},
+		"expired":     {"exp": clock.Now().Add(-2 * time.Minute).Unix()},
+		"not yet":     {"nbf": clock.Now().Add(2 * time.Minute).Unix()},
+		"no expiry":   {"exp": nil},
+		"scope":       {"scope": "openid"},
+		"username":    {"email": "mallory@example.com"},
+		"no username": {"email": nil},
+	}
+	for name, changes := range tests {
+		assert.Error(t, authenticate("alice@example.com", iss.token(t, "rsa", claims(changes))), name)
+	}
+	// Within the leeway.
+	assert.NoError(t, authenticate("alice@example.com",
+		iss.token(t, "rsa", claims(map[string]any{"exp": clock.Now().Add(-30 * time.Second).Unix()}))))
+
+	// A tampered token.
+	token := iss.token(t, "ec", claims(nil))
+	assert.Error(t, authenticate("alice@example.com", token[:len(token)-4]+"AAAA"))
+	// A key of another type than the algorithm.
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"rsa"}`))
+	valid := iss.token(t, "rsa", claims(nil))
+	assert.Error(t, authenticate("alice@example.com", header+valid[strings.IndexByte(valid, '.'):]))
+	assert.Error(t, authenticate("alice@example.com", "not-a-jwt"))
+
+	// Unknown keys are fetched again, but not more often than the refresh
+	// interval.
+	assert.ErrorIs(t, authenticate("alice@example.com", iss.token(t, "unknown", claims(nil))), errUnknownSigningKey)
+	assert.Equal(t, int64(1), iss.fetches.Load())
+	clock.Advance(DefaultJWKSRefreshInterval)
+	assert.ErrorIs(t, authenticate("alice@example.com", iss.token(t, "unknown", claims(nil))), errUnknownSigningKey)
+	assert.Equal(t, int64(2), iss.fetches.Load())
+
+	assert.Error(t, auth.Authenticate(ctx, "alice@example.com", "secret"))
+}
+
+func TestOAuth2_Simulate(t *testing.T) {
+	iss := newOAuth2Issuer(t)
+	auth, err := NewOAuth2(OAuth2Config{Issuer: iss.server.URL, JWKSURL: iss.server.URL + "/jwks"})
+	require.NoError(t, err)
+	b := brisa.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.SetAuthenticator(auth)
+
+	// Passwords are refused.
+	env := brisatest.DefaultEnvelope()
+	env.Username, env.Password = "alice@example.com", "secret"
+	res := b.Simulate(env, strings.NewReader("\r\n"))
+	assert.Equal(t, brisa.ChainAuth, res.Chain)
+	assert.Equal(t, brisa.ErrAuthFailed, res.Err)
+}
+
+func TestOAuth2_FetchOutsideLock(t *testing.T) {
+	iss := newOAuth2Issuer(t)
+	release := make(chan struct{})
+	var fetches atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		resp, err := http.Get(iss.server.URL + "/jwks")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer slow.Close()
+
+	clock := brisatest.NewFakeClock(time.Unix(1_700_000_000, 0))
+	auth, err := NewOAuth2(OAuth2Config{Issuer: iss.server.URL, JWKSURL: slow.URL, Clock: clock})
+	require.NoError(t, err)
+	ctx := brisatest.NewContext(t, brisatest.DefaultEnvelope(), "")
+	claims := map[string]any{"iss": iss.server.URL, "exp": clock.Now().Add(time.Hour).Unix(), "email": "alice@example.com"}
+	known, unknown := iss.token(t, "rsa", claims), iss.token(t, "unknown", claims)
+
+	_, err = auth.AuthenticateToken(ctx, "alice@example.com", known)
+	require.NoError(t, err)
+
+	// Tokens with an unknown key wait for one fetch of the keys.
+	clock.Advance(DefaultJWKSRefreshInterval)
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := auth.AuthenticateToken(ctx, "alice@example.com", unknown)
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return fetches.Load() == 2 }, 5*time.Second, time.Millisecond)
+
+	// Tokens with a known key do not.
+	done := make(chan error, 1)
+	go func() {
+		_, err := auth.AuthenticateToken(ctx, "alice@example.com", known)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("expected a known key to be used while the keys are fetched")
+	}
+
+	close(release)
+	for range 2 {
+		assert.ErrorIs(t, <-errs, errUnknownSigningKey)
+	}
+	assert.Equal(t, int64(2), fetches.Load())
+}
+
+func TestVerifySignature_Curve(t *testing.T) {
+	input := []byte("header.payload")
+	sign := func(key *ecdsa.PrivateKey, digest []byte) []byte {
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		require.NoError(t, err)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	d256 := sha256.Sum256(input)
+	d384 := sha512.Sum384(input)
+
+	assert.NoError(t, verifySignature("ES256", &p256.PublicKey, input, sign(p256, d256[:])))
+	assert.NoError(t, verifySignature("ES384", &p384.PublicKey, input, sign(p384, d384[:])))
+	// RFC 7518 ties each algorithm to its curve.
+	assert.Error(t, verifySignature("ES256", &p384.PublicKey, input, sign(p384, d256[:])))
+	assert.Error(t, verifySignature("ES384", &p256.PublicKey, input, sign(p256, d384[:])))
+}
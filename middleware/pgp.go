@@ -0,0 +1,740 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math/big"
+	"math/bits"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PGPKey is the encryption key of an OpenPGP certificate (RFC 9580): a
+// version 4 RSA or ECDH public key or subkey.
+type PGPKey struct {
+	// Fingerprint is the fingerprint of the key.
+	Fingerprint []byte
+	algo        byte
+	rsa         *rsa.PublicKey
+	// curve, point and kdf are the curve OID, the public point and the KDF
+	// parameters of an ECDH key.
+	curve []byte
+	point *ecdh.PublicKey
+	kdf   [2]byte
+}
+
+// PGPKeySource returns the OpenPGP key of a recipient, or nil if none is
+// known; see DirPGPKeySource, WKDKeySource and LDAPPGPKeySource.
+type PGPKeySource func(rcpt string) (*PGPKey, error)
+
+// DirPGPKeySource returns a PGPKeySource reading OpenPGP certificates, binary
+// or ASCII-armored, from dir, one file per recipient named "<address>.asc" in
+// lower case.
+func DirPGPKeySource(dir string) PGPKeySource {
+	return func(rcpt string) (*PGPKey, error) {
+		name := strings.ToLower(rcpt)
+		if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+			return nil, nil
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name+".asc"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePGPKey(data, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name+".asc", err)
+		}
+		return key, nil
+	}
+}
+
+// OpenPGP packet tags, public key algorithms and ciphers used here.
+const (
+	pgpTagPKESK     = 1
+	pgpTagSignature = 2
+	pgpTagPublicKey = 6
+	pgpTagLiteral   = 11
+	pgpTagUserID    = 13
+	pgpTagSubkey    = 14
+	pgpTagSEIPD     = 18
+	pgpTagMDC       = 19
+
+	pgpRSA        = 1
+	pgpRSAEncrypt = 2
+	pgpECDH       = 18
+
+	pgpAES256 = 9
+)
+
+// pgpCurves are the ECDH curves of OpenPGP by their OID.
+var pgpCurves = map[string]ecdh.Curve{
+	"2b060104019755010501": ecdh.X25519(), // Curve25519Legacy
+	"2a8648ce3d030107":     ecdh.P256(),
+	"2b81040022":           ecdh.P384(),
+	"2b81040023":           ecdh.P521(),
+}
+
+// ParsePGPKey returns the encryption key of the first OpenPGP certificate in
+// data, binary or ASCII-armored, that has a user ID with the address addr, or
+// of the first certificate if addr is empty. It returns nil if there is none.
+// The newest valid subkey flagged for encryption is preferred. Signatures are
+// not verified: certificates are trusted as the source serves them.
+func ParsePGPKey(data []byte, addr string) (*PGPKey, error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		var err error
+		if data, err = pgpDearmor(data); err != nil {
+			return nil, err
+		}
+	}
+	var cert *pgpCert
+	finish := func() *PGPKey {
+		if cert == nil || (addr != "" && !cert.hasAddress(addr)) {
+			return nil
+		}
+		return cert.encryptionKey(time.Now())
+	}
+	for len(data) > 0 {
+		tag, body, rest, err := pgpReadPacket(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		switch tag {
+		case pgpTagPublicKey:
+			if key := finish(); key != nil {
+				return key, nil
+			}
+			cert = &pgpCert{}
+			cert.keys = append(cert.keys, parsePGPPublicKey(body))
+		case pgpTagSubkey:
+			if cert != nil {
+				cert.keys = append(cert.keys, parsePGPPublicKey(body))
+			}
+		case pgpTagUserID:
+			if cert != nil {
+				cert.uids = append(cert.uids, string(body))
+			}
+		case pgpTagSignature:
+			if cert != nil {
+				cert.addSignature(body)
+			}
+		}
+	}
+	return finish(), nil
+}
+
+// pgpCert is an OpenPGP certificate as far as needed to pick its encryption
+// key: its primary key first, its subkeys and its user IDs.
+type pgpCert struct {
+	keys    []*pgpPublicKey
+	uids    []string
+	revoked bool
+}
+
+type pgpPublicKey struct {
+	key     *PGPKey // nil if the key cannot encrypt
+	created time.Time
+	// flags and expires come from the newest binding or self-signature.
+	flags    byte
+	hasFlags bool
+	sigTime  time.Time
+	expires  time.Duration
+	revoked  bool
+}
+
+func (c *pgpCert) hasAddress(addr string) bool {
+	for _, uid := range c.uids {
+		a, err := mail.ParseAddress(uid)
+		if err != nil {
+			a = &mail.Address{Address: strings.TrimSpace(uid)}
+		}
+		if strings.EqualFold(a.Address, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addSignature applies a signature following the packets of c to the key it
+// binds or revokes.
+func (c *pgpCert) addSignature(body []byte) {
+	sig, ok := parsePGPSignature(body)
+	if !ok {
+		return
+	}
+	primary := c.keys[0]
+	last := c.keys[len(c.keys)-1]
+	switch {
+	case sig.typ == 0x20:
+		c.revoked = true
+	case sig.typ == 0x28:
+		last.revoked = true
+	case sig.typ == 0x18:
+		last.apply(sig)
+	case sig.typ >= 0x10 && sig.typ <= 0x13 && len(c.keys) == 1 && primary.key != nil &&
+		(sig.issuer == nil || bytes.HasSuffix(primary.key.Fingerprint, sig.issuer)):
+		primary.apply(sig)
+	}
+}
+
+func (k *pgpPublicKey) apply(sig pgpSignature) {
+	if sig.created.Before(k.sigTime) {
+		return
+	}
+	k.sigTime = sig.created
+	k.flags, k.hasFlags = sig.flags, sig.hasFlags
+	k.expires = sig.expires
+}
+
+// encryptionKey returns the newest key of c valid at now that may encrypt.
+func (c *pgpCert) encryptionKey(now time.Time) *PGPKey {
+	if c.revoked {
+		return nil
+	}
+	var best *pgpPublicKey
+	for i, k := range c.keys {
+		switch {
+		case k.key == nil || k.revoked:
+			continue
+		case k.hasFlags && k.flags&0x0c == 0:
+			continue
+		case !k.hasFlags && i == 0:
+			// A primary key encrypts only if flagged to.
+			continue
+		case k.expires > 0 && now.After(k.created.Add(k.expires)):
+			continue
+		}
+		if best == nil || !k.created.Before(best.created) {
+			best = k
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.key
+}
+
+// pgpReadPacket splits the first packet off data.
+func pgpReadPacket(data []byte) (tag byte, body, rest []byte, err error) {
+	if len(data) < 2 || data[0]&0x80 == 0 {
+		return 0, nil, nil, errors.New("invalid OpenPGP packet")
+	}
+	var n, hdr int
+	if data[0]&0x40 != 0 {
+		tag = data[0] & 0x3f
+		switch l := data[1]; {
+		case l < 192:
+			n, hdr = int(l), 2
+		case l < 224 && len(data) >= 3:
+			n, hdr = (int(l)-192)<<8+int(data[2])+192, 3
+		case l == 255 && len(data) >= 6:
+			n, hdr = int(binary.BigEndian.Uint32(data[2:6])), 6
+		default:
+			return 0, nil, nil, errors.New("unsupported OpenPGP partial body length")
+		}
+	} else {
+		tag = (data[0] >> 2) & 0x0f
+		switch data[0] & 3 {
+		case 0:
+			n, hdr = int(data[1]), 2
+		case 1:
+			if len(data) < 3 {
+				return 0, nil, nil, io.ErrUnexpectedEOF
+			}
+			n, hdr = int(binary.BigEndian.Uint16(data[1:3])), 3
+		case 2:
+			if len(data) < 5 {
+				return 0, nil, nil, io.ErrUnexpectedEOF
+			}
+			n, hdr = int(binary.BigEndian.Uint32(data[1:5])), 5
+		default:
+			return 0, nil, nil, errors.New("unsupported OpenPGP indeterminate length")
+		}
+	}
+	if n < 0 || len(data)-hdr < n {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, data[hdr : hdr+n], data[hdr+n:], nil
+}
+
+// parsePGPPublicKey parses the body of a public key or subkey packet. Keys
+// that cannot encrypt, or of other versions, have no PGPKey.
+func parsePGPPublicKey(body []byte) *pgpPublicKey {
+	k := &pgpPublicKey{}
+	if len(body) < 6 || body[0] != 4 {
+		return k
+	}
+	k.created = time.Unix(int64(binary.BigEndian.Uint32(body[1:5])), 0)
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+	h.Write(body)
+	key := &PGPKey{Fingerprint: h.Sum(nil), algo: body[5]}
+	fields := body[6:]
+	switch key.algo {
+	case pgpRSA, pgpRSAEncrypt:
+		n, fields, ok := pgpReadMPI(fields)
+		if !ok {
+			return k
+		}
+		e, _, ok := pgpReadMPI(fields)
+		if !ok || len(e) > 4 {
+			return k
+		}
+		key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case pgpECDH:
+		if len(fields) < 1 || len(fields) < 1+int(fields[0]) {
+			return k
+		}
+		key.curve = fields[1 : 1+fields[0]]
+		curve, ok := pgpCurves[hex.EncodeToString(key.curve)]
+		if !ok {
+			return k
+		}
+		point, rest, ok := pgpReadMPI(fields[1+fields[0]:])
+		if !ok || len(rest) < 4 || rest[0] != 3 || rest[1] != 1 {
+			return k
+		}
+		if curve == ecdh.X25519() {
+			if len(point) != 33 || point[0] != 0x40 {
+				return k
+			}
+			point = point[1:]
+		}
+		pub, err := curve.NewPublicKey(point)
+		if err != nil {
+			return k
+		}
+		if _, ok := pgpKDFHash(rest[2]); !ok || pgpCipherKeySize(rest[3]) == 0 {
+			return k
+		}
+		key.point = pub
+		key.kdf = [2]byte{rest[2], rest[3]}
+	default:
+		return k
+	}
+	k.key = key
+	return k
+}
+
+// pgpReadMPI splits a multiprecision integer off data.
+func pgpReadMPI(data []byte) (mpi, rest []byte, ok bool) {
+	if len(data) < 2 {
+		return nil, nil, false
+	}
+	n := (int(binary.BigEndian.Uint16(data)) + 7) / 8
+	if len(data)-2 < n {
+		return nil, nil, false
+	}
+	return data[2 : 2+n], data[2+n:], true
+}
+
+// pgpSignature holds the fields of a version 4 signature that bear on the
+// choice of an encryption key.
+type pgpSignature struct {
+	typ      byte
+	created  time.Time
+	flags    byte
+	hasFlags bool
+	expires  time.Duration
+	issuer   []byte
+}
+
+func parsePGPSignature(body []byte) (pgpSignature, bool) {
+	var sig pgpSignature
+	if len(body) < 6 || body[0] != 4 {
+		return sig, false
+	}
+	sig.typ = body[1]
+	hashed := int(binary.BigEndian.Uint16(body[4:6]))
+	if len(body) < 8+hashed {
+		return sig, false
+	}
+	unhashed := body[8+hashed:]
+	if n := int(binary.BigEndian.Uint16(body[6+hashed:])); n <= len(unhashed) {
+		unhashed = unhashed[:n]
+	}
+	for i, area := range [][]byte{body[6 : 6+hashed], unhashed} {
+		for len(area) > 0 {
+			n, hdr := int(area[0]), 1
+			switch {
+			case area[0] >= 255 && len(area) >= 5:
+				n, hdr = int(binary.BigEndian.Uint32(area[1:5])), 5
+			case area[0] >= 192 && len(area) >= 2:
+				n, hdr = (int(area[0])-192)<<8+int(area[1])+192, 2
+			}
+			if n < 1 || len(area)-hdr < n {
+				break
+			}
+			typ, data := area[hdr]&0x7f, area[hdr+1:hdr+n]
+			area = area[hdr+n:]
+			switch {
+			case typ == 2 && i == 0 && len(data) == 4:
+				sig.created = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+			case typ == 9 && i == 0 && len(data) == 4:
+				sig.expires = time.Duration(binary.BigEndian.Uint32(data)) * time.Second
+			case typ == 27 && i == 0 && len(data) > 0:
+				sig.flags, sig.hasFlags = data[0], true
+			case typ == 16 && len(data) == 8:
+				sig.issuer = data
+			case typ == 33 && len(data) == 21 && data[0] == 4:
+				sig.issuer = data[1:]
+			}
+		}
+	}
+	return sig, true
+}
+
+// pgpDearmor returns the data of the first ASCII armor in data.
+func pgpDearmor(data []byte) ([]byte, error) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, len(data)+1)
+	var b64 strings.Builder
+	state := 0 // before the armor, in its headers, in its data
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case state == 0 && strings.HasPrefix(line, "-----BEGIN PGP "):
+			state = 1
+		case state == 1 && line == "":
+			state = 2
+		case state == 1 && !strings.Contains(line, ":"):
+			// No armor headers.
+			state = 2
+			b64.WriteString(line)
+		case state == 2 && strings.HasPrefix(line, "-----END PGP "):
+			return base64.StdEncoding.DecodeString(b64.String())
+		case state == 2 && strings.HasPrefix(line, "="):
+			// The checksum.
+		case state == 2:
+			b64.WriteString(line)
+		}
+	}
+	return nil, errors.New("invalid OpenPGP armor")
+}
+
+func pgpKDFHash(id byte) (func() hash.Hash, bool) {
+	switch id {
+	case 8:
+		return sha256.New, true
+	case 9:
+		return sha512.New384, true
+	case 10:
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+func pgpCipherKeySize(id byte) int {
+	switch id {
+	case 7:
+		return 16
+	case 8:
+		return 24
+	case 9:
+		return 32
+	}
+	return 0
+}
+
+// keyID returns the key ID of k, the low 64 bits of its fingerprint.
+func (k *PGPKey) keyID() []byte {
+	return k.Fingerprint[len(k.Fingerprint)-8:]
+}
+
+// encryptSessionKey returns the body of a public-key encrypted session key
+// packet (version 3) of the AES-256 sessionKey for k.
+func (k *PGPKey) encryptSessionKey(sessionKey []byte) ([]byte, error) {
+	m := append([]byte{pgpAES256}, sessionKey...)
+	var sum uint16
+	for _, b := range sessionKey {
+		sum += uint16(b)
+	}
+	m = binary.BigEndian.AppendUint16(m, sum)
+
+	out := append([]byte{3}, k.keyID()...)
+	out = append(out, k.algo)
+	switch k.algo {
+	case pgpRSA, pgpRSAEncrypt:
+		c, err := rsa.EncryptPKCS1v15(rand.Reader, k.rsa, m)
+		if err != nil {
+			return nil, err
+		}
+		return pgpAppendMPI(out, c), nil
+	case pgpECDH:
+		eph, err := k.point.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := eph.ECDH(k.point)
+		if err != nil {
+			return nil, err
+		}
+		// RFC 6637: the key-encryption key is derived from the shared secret
+		// and the parameters of the recipient key.
+		param := append([]byte{byte(len(k.curve))}, k.curve...)
+		param = append(param, pgpECDH, 3, 1, k.kdf[0], k.kdf[1])
+		param = append(param, "Anonymous Sender    "...)
+		param = append(param, k.Fingerprint...)
+		newHash, _ := pgpKDFHash(k.kdf[0])
+		h := newHash()
+		h.Write([]byte{0, 0, 0, 1})
+		h.Write(shared)
+		h.Write(param)
+		kek := h.Sum(nil)[:pgpCipherKeySize(k.kdf[1])]
+		pad := 8 - len(m)%8
+		m = append(m, bytes.Repeat([]byte{byte(pad)}, pad)...)
+		wrapped, err := aesKeyWrap(kek, m)
+		if err != nil {
+			return nil, err
+		}
+		point := eph.PublicKey().Bytes()
+		if k.point.Curve() == ecdh.X25519() {
+			point = append([]byte{0x40}, point...)
+		}
+		out = pgpAppendMPI(out, point)
+		out = append(out, byte(len(wrapped)))
+		return append(out, wrapped...), nil
+	}
+	return nil, fmt.Errorf("unsupported OpenPGP algorithm %d", k.algo)
+}
+
+func pgpAppendMPI(out, n []byte) []byte {
+	n = bytes.TrimLeft(n, "\x00")
+	length := 0
+	if len(n) > 0 {
+		length = (len(n)-1)*8 + bits.Len8(n[0])
+	}
+	out = binary.BigEndian.AppendUint16(out, uint16(length))
+	return append(out, n...)
+}
+
+// aesKeyWrap wraps key with kek (RFC 3394).
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6})
+	copy(out[8:], key)
+	b := make([]byte, 16)
+	for j := range 6 {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[i*8:i*8+8])
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[i*8:], b[8:])
+		}
+	}
+	return out, nil
+}
+
+// pgpPacketHeader returns the header of a packet with a body of n bytes, in
+// the OpenPGP packet format.
+func pgpPacketHeader(tag byte, n int64) []byte {
+	hdr := []byte{0xc0 | tag}
+	switch {
+	case n < 192:
+		return append(hdr, byte(n))
+	case n < 8384:
+		n -= 192
+		return append(hdr, byte(n>>8)+192, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(append(hdr, 255), uint32(n))
+}
+
+// writePGPMIME writes the message of header h and body, of size bytes, to w
+// as a PGP/MIME encrypted message (RFC 3156) for keys: the Content-* fields
+// and the body are encrypted into an OpenPGP message with AES-256 and a
+// modification detection code.
+func writePGPMIME(w io.Writer, h *messageHeader, body io.Reader, size int64, keys []*PGPKey) error {
+	outer, entity := splitContentHeader(h)
+	size += int64(len(entity))
+	if size > 1<<32-64 {
+		return fmt.Errorf("message of %d bytes too big for OpenPGP", size)
+	}
+	sessionKey := make([]byte, 32)
+	boundary := make([]byte, 12)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return err
+	}
+	if _, err := rand.Read(boundary); err != nil {
+		return err
+	}
+	b := "pgp-" + hex.EncodeToString(boundary)
+	outer.Add("MIME-Version", "1.0")
+	outer.Add("Content-Type", `multipart/encrypted; protocol="application/pgp-encrypted"; boundary="`+b+`"`)
+	if _, err := w.Write(outer.Bytes()); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "This is an OpenPGP/MIME encrypted message (RFC 3156).\r\n"+
+		"--"+b+"\r\n"+
+		"Content-Type: application/pgp-encrypted\r\n"+
+		"Content-Description: PGP/MIME version identification\r\n\r\n"+
+		"Version: 1\r\n\r\n"+
+		"--"+b+"\r\n"+
+		"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n"+
+		"Content-Description: OpenPGP encrypted message\r\n"+
+		"Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n"+
+		"-----BEGIN PGP MESSAGE-----\r\n\r\n"); err != nil {
+		return err
+	}
+
+	armor := newPGPArmorWriter(w)
+	for _, key := range keys {
+		pkesk, err := key.encryptSessionKey(sessionKey)
+		if err != nil {
+			return err
+		}
+		armor.Write(pgpPacketHeader(pgpTagPKESK, int64(len(pkesk))))
+		armor.Write(pkesk)
+	}
+	if err := writePGPEncrypted(armor, sessionKey, io.MultiReader(bytes.NewReader(entity), body), size); err != nil {
+		return err
+	}
+	if err := armor.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "-----END PGP MESSAGE-----\r\n\r\n--"+b+"--\r\n")
+	return err
+}
+
+// writePGPEncrypted writes a symmetrically encrypted and integrity protected
+// data packet (version 1) holding a literal data packet of the size bytes of
+// content to w.
+func writePGPEncrypted(w io.Writer, sessionKey []byte, content io.Reader, size int64) error {
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, aes.BlockSize+2)
+	if _, err := rand.Read(prefix[:aes.BlockSize]); err != nil {
+		return err
+	}
+	copy(prefix[aes.BlockSize:], prefix[aes.BlockSize-2:aes.BlockSize])
+	literal := append(pgpPacketHeader(pgpTagLiteral, 6+size), 'b', 0, 0, 0, 0, 0)
+	mdcLen := int64(2 + sha1.Size)
+	encLen := 1 + int64(len(prefix)+len(literal)) + size + mdcLen
+	if _, err := w.Write(append(pgpPacketHeader(pgpTagSEIPD, encLen), 1)); err != nil {
+		return err
+	}
+
+	mdc := sha1.New()
+	cfb := &pgpCFBWriter{w: w, block: block, iv: make([]byte, aes.BlockSize)}
+	plain := io.MultiWriter(mdc, cfb)
+	plain.Write(prefix)
+	plain.Write(literal)
+	n, err := io.Copy(plain, content)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("message of %d bytes, expected %d", n, size)
+	}
+	plain.Write(pgpPacketHeader(pgpTagMDC, sha1.Size))
+	cfb.Write(mdc.Sum(nil))
+	return cfb.Close()
+}
+
+// pgpCFBWriter encrypts in CFB mode, as version 1 encrypted data packets do,
+// to w. Writes are buffered into blocks; Close writes the last, partial one
+// and reports the first write error.
+type pgpCFBWriter struct {
+	w     io.Writer
+	block cipher.Block
+	iv    []byte
+	buf   []byte
+	err   error
+}
+
+func (c *pgpCFBWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for c.err == nil && len(p) > 0 {
+		k := min(len(p), aes.BlockSize-len(c.buf))
+		c.buf = append(c.buf, p[:k]...)
+		p = p[k:]
+		if len(c.buf) == aes.BlockSize {
+			c.flush()
+		}
+	}
+	return n, c.err
+}
+
+func (c *pgpCFBWriter) flush() {
+	c.block.Encrypt(c.iv, c.iv)
+	for i, b := range c.buf {
+		c.iv[i] ^= b
+	}
+	_, c.err = c.w.Write(c.iv[:len(c.buf)])
+	c.buf = c.buf[:0]
+}
+
+func (c *pgpCFBWriter) Close() error {
+	if c.err == nil && len(c.buf) > 0 {
+		c.flush()
+	}
+	return c.err
+}
+
+// pgpArmorWriter writes the data of an ASCII armor (RFC 9580, section 6):
+// base64 lines and the CRC-24 checksum on Close.
+type pgpArmorWriter struct {
+	lines *lineWriter
+	enc   io.WriteCloser
+	crc   uint32
+}
+
+func newPGPArmorWriter(w io.Writer) *pgpArmorWriter {
+	lines := &lineWriter{w: w, n: 64}
+	return &pgpArmorWriter{lines: lines, enc: base64.NewEncoder(base64.StdEncoding, lines), crc: 0xb704ce}
+}
+
+func (a *pgpArmorWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		a.crc ^= uint32(b) << 16
+		for range 8 {
+			a.crc <<= 1
+			if a.crc&0x1000000 != 0 {
+				a.crc ^= 0x1864cfb
+			}
+		}
+	}
+	return a.enc.Write(p)
+}
+
+func (a *pgpArmorWriter) Close() error {
+	if err := a.enc.Close(); err != nil {
+		return err
+	}
+	if err := a.lines.Close(); err != nil {
+		return err
+	}
+	crc := []byte{byte(a.crc >> 16), byte(a.crc >> 8), byte(a.crc)}
+	_, err := io.WriteString(a.lines.w, "="+base64.StdEncoding.EncodeToString(crc)+"\r\n")
+	return err
+}
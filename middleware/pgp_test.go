@@ -0,0 +1,273 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPGPCertificate is a certificate exported by GnuPG: an Ed25519 primary
+// key for bob@secure.example with a Curve25519 encryption subkey.
+const testPGPCertificate = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEatHdixYJKwYBBAHaRw8BAQdALL3ob9om5fKdtnn60ThzPNwoFbPX3bgtAA/b
+FHNmwqG0GEJvYiA8Ym9iQHNlY3VyZS5leGFtcGxlPoiQBBMWCAA4FiEEz4NMJ2p3
+uZpKfqj/ay8V3Kq5JfYFAmrR3YsCGwEFCwkIBwIGFQoJCAsCBBYCAwECHgECF4AA
+CgkQay8V3Kq5JfYlOQEAjKbJi7GafjVd0KCjrMHs5t3Usrm51GCnt1QtM5a0XtUB
+ALacSdVcZWzU23+6X5wz1jEfMYhfOHGpjsTTXXTsAacJuDgEatHdixIKKwYBBAGX
+VQEFAQEHQIhXtYKfpaR9Px7BdhV8knwIBuT1mGOuQPgEjUOVY7lAAwEIB4h4BBgW
+CAAgFiEEz4NMJ2p3uZpKfqj/ay8V3Kq5JfYFAmrR3YsCGwwACgkQay8V3Kq5JfaZ
+TgD/VU5zorkdMDSZ+mn+yQmGxSJJptj2FmsJwElnw0JJQl8BAJJuB9cnqIA3uI3t
+CnUmizks7HUjq7AGFC9TvFW8vhkE
+=DZhd
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+// newTestPGPCertificate builds a certificate for uid with an encryption
+// subkey of pub, an *rsa.PublicKey or an X25519 *ecdh.PublicKey, laid out as
+// GnuPG does. The signatures are placeholders.
+func newTestPGPCertificate(t *testing.T, uid string, pub any) []byte {
+	t.Helper()
+	packet := func(tag byte, body []byte) []byte {
+		return append(pgpPacketHeader(tag, int64(len(body))), body...)
+	}
+	signature := func(typ, flags byte) []byte {
+		hashed := []byte{5, 2, 0, 0, 0, 1, 2, 27, flags} // creation time, key flags
+		sig := append([]byte{4, typ, 22, 8, 0, byte(len(hashed))}, hashed...)
+		sig = append(sig, 0, 0, 0, 0) // no unhashed subpackets, hash prefix
+		return pgpAppendMPI(sig, []byte{1})
+	}
+
+	primary := append([]byte{4, 0, 0, 0, 1, 22, 9}, 0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01)
+	primary = pgpAppendMPI(primary, append([]byte{0x40}, make([]byte, 32)...))
+	subkey := []byte{4, 0, 0, 0, 2}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		subkey = append(subkey, pgpRSA)
+		subkey = pgpAppendMPI(subkey, pub.N.Bytes())
+		subkey = pgpAppendMPI(subkey, big.NewInt(int64(pub.E)).Bytes())
+	case *ecdh.PublicKey:
+		oid, _ := hex.DecodeString("2b060104019755010501")
+		subkey = append(append(subkey, pgpECDH, byte(len(oid))), oid...)
+		subkey = pgpAppendMPI(subkey, append([]byte{0x40}, pub.Bytes()...))
+		subkey = append(subkey, 3, 1, 8, 7) // SHA-256, AES-128
+	default:
+		t.Fatalf("unsupported key %T", pub)
+	}
+
+	var cert []byte
+	cert = append(cert, packet(pgpTagPublicKey, primary)...)
+	cert = append(cert, packet(pgpTagUserID, []byte(uid))...)
+	cert = append(cert, packet(pgpTagSignature, signature(0x13, 0x03))...)
+	cert = append(cert, packet(pgpTagSubkey, subkey)...)
+	cert = append(cert, packet(pgpTagSignature, signature(0x18, 0x0c))...)
+	return cert
+}
+
+// decryptPGPMessage is the recipient side of writePGPMIME for the armored
+// message with the private key priv, an *rsa.PrivateKey or an X25519
+// *ecdh.PrivateKey of key.
+func decryptPGPMessage(t *testing.T, armored string, key *PGPKey, priv any) []byte {
+	t.Helper()
+	data, err := pgpDearmor([]byte(armored))
+	require.NoError(t, err)
+
+	var sessionKey []byte
+	for len(data) > 0 {
+		tag, body, rest, err := pgpReadPacket(data)
+		require.NoError(t, err)
+		data = rest
+		switch tag {
+		case pgpTagPKESK:
+			if !bytes.Equal(body[1:9], key.keyID()) {
+				continue
+			}
+			var m []byte
+			switch priv := priv.(type) {
+			case *rsa.PrivateKey:
+				c, _, ok := pgpReadMPI(body[10:])
+				require.True(t, ok)
+				m, err = rsa.DecryptPKCS1v15(nil, priv, c)
+				require.NoError(t, err)
+			case *ecdh.PrivateKey:
+				point, rest, ok := pgpReadMPI(body[10:])
+				require.True(t, ok)
+				eph, err := ecdh.X25519().NewPublicKey(point[1:])
+				require.NoError(t, err)
+				shared, err := priv.ECDH(eph)
+				require.NoError(t, err)
+				param := append([]byte{byte(len(key.curve))}, key.curve...)
+				param = append(param, pgpECDH, 3, 1, key.kdf[0], key.kdf[1])
+				param = append(append(param, "Anonymous Sender    "...), key.Fingerprint...)
+				kek := sha256.Sum256(append(append([]byte{0, 0, 0, 1}, shared...), param...))
+				m = aesKeyUnwrap(t, kek[:16], rest[1:1+rest[0]])
+				m = m[:len(m)-int(m[len(m)-1])]
+			}
+			require.Equal(t, byte(pgpAES256), m[0])
+			sessionKey = m[1:33]
+			var sum uint16
+			for _, b := range sessionKey {
+				sum += uint16(b)
+			}
+			require.Equal(t, sum, binary.BigEndian.Uint16(m[33:]))
+		case pgpTagSEIPD:
+			require.NotNil(t, sessionKey, "no session key for the recipient")
+			require.Equal(t, byte(1), body[0])
+			block, err := aes.NewCipher(sessionKey)
+			require.NoError(t, err)
+			ciphertext := body[1:]
+			plain := make([]byte, len(ciphertext))
+			prev, stream := make([]byte, aes.BlockSize), make([]byte, aes.BlockSize)
+			for i := 0; i < len(ciphertext); i += aes.BlockSize {
+				block.Encrypt(stream, prev)
+				end := min(i+aes.BlockSize, len(ciphertext))
+				for j := i; j < end; j++ {
+					plain[j] = ciphertext[j] ^ stream[j-i]
+				}
+				copy(prev, ciphertext[i:end])
+			}
+			require.Equal(t, plain[14:16], plain[16:18], "quick check")
+			mdc := sha1.Sum(plain[:len(plain)-sha1.Size])
+			require.Equal(t, mdc[:], plain[len(plain)-sha1.Size:], "modification detection code")
+			tag, literal, _, err := pgpReadPacket(plain[18 : len(plain)-2-sha1.Size])
+			require.NoError(t, err)
+			require.Equal(t, byte(pgpTagLiteral), tag)
+			return literal[6:]
+		}
+	}
+	t.Fatal("no encrypted data")
+	return nil
+}
+
+// aesKeyUnwrap unwraps key with kek (RFC 3394).
+func aesKeyUnwrap(t *testing.T, kek, wrapped []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(kek)
+	require.NoError(t, err)
+	n := len(wrapped)/8 - 1
+	a := append([]byte(nil), wrapped[:8]...)
+	r := append([]byte(nil), wrapped[8:]...)
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^uint64(n*j+i))
+			copy(b[8:], r[(i-1)*8:i*8])
+			block.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(r[(i-1)*8:], b[8:])
+		}
+	}
+	require.Equal(t, bytes.Repeat([]byte{0xa6}, 8), a, "key wrap integrity")
+	return r
+}
+
+func TestParsePGPKey(t *testing.T) {
+	key, err := ParsePGPKey([]byte(testPGPCertificate), "Bob@Secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	// The encryption subkey rather than the certification-only primary key.
+	assert.Equal(t, "ba15308e5f9e8de987f7dda5e01fc982bb33be04", hex.EncodeToString(key.Fingerprint))
+	assert.Equal(t, byte(pgpECDH), key.algo)
+
+	key, err = ParsePGPKey([]byte(testPGPCertificate), "carol@secure.example")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	// Binary certificates, and the first of several with an address.
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	certs := append(newTestPGPCertificate(t, "Carol <carol@secure.example>", &rsaKey.PublicKey),
+		newTestPGPCertificate(t, "dave@secure.example", x25519Key.PublicKey())...)
+	key, err = ParsePGPKey(certs, "dave@secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, byte(pgpECDH), key.algo)
+	key, err = ParsePGPKey(certs, "carol@secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, byte(pgpRSA), key.algo)
+
+	_, err = ParsePGPKey([]byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n!!!\n-----END PGP PUBLIC KEY BLOCK-----\n"), "")
+	assert.Error(t, err)
+}
+
+func TestEncryptor_PGP(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bob@secure.example.asc"),
+		newTestPGPCertificate(t, "bob@secure.example", &rsaKey.PublicKey), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "carol@secure.example.asc"),
+		newTestPGPCertificate(t, "carol@secure.example", x25519Key.PublicKey()), 0o600))
+	keys := DirPGPKeySource(dir)
+	bob, err := keys("bob@secure.example")
+	require.NoError(t, err)
+	carol, err := keys("Carol@secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, bob)
+	require.NotNil(t, carol)
+
+	e, err := NewEncryptor(EncryptorConfig{PGPKeys: keys, Domains: []string{"secure.example"}})
+	require.NoError(t, err)
+	for _, body := range []string{"the launch code\r\n", strings.Repeat("the launch code\r\n", 10000)} {
+		message := "From: alice@example.com\r\n" +
+			"Subject: secret\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"\r\n" + body
+		ctx := newTestContext(t, message)
+		ctx.Action = brisa.Deliver
+		ctx.To = []string{"bob@secure.example", "carol@secure.example"}
+		assert.Equal(t, brisa.Deliver, e.Handle(ctx))
+		format, _ := ctx.Get(EncryptedKey)
+		assert.Equal(t, "pgp", format)
+
+		out := readTestMessage(t, ctx)
+		header, mime, ok := strings.Cut(out, "\r\n\r\n")
+		require.True(t, ok)
+		assert.Contains(t, header, "Subject: secret\r\n")
+		assert.Contains(t, header, `Content-Type: multipart/encrypted; protocol="application/pgp-encrypted"`)
+		assert.NotContains(t, mime, "launch")
+		assert.Contains(t, mime, "Content-Type: application/pgp-encrypted\r\n")
+
+		want := "Content-Type: text/plain; charset=utf-8\r\n\r\n" + body
+		assert.Equal(t, want, string(decryptPGPMessage(t, mime, bob, rsaKey)))
+		assert.Equal(t, want, string(decryptPGPMessage(t, mime, carol, x25519Key)))
+	}
+}
+
+func TestDirPGPKeySource(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bob@secure.example.asc"), []byte(testPGPCertificate), 0o600))
+	source := DirPGPKeySource(dir)
+
+	key, err := source("Bob@Secure.example")
+	require.NoError(t, err)
+	assert.NotNil(t, key)
+
+	key, err = source("nobody@secure.example")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	key, err = source("../etc/passwd")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+}
@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultPyzorServer is the address of the public Pyzor server.
+const DefaultPyzorServer = "public.pyzor.org:24441"
+
+const (
+	pyzorProtoVersion   = "2.1"
+	pyzorAnonymousUser  = "anonymous"
+	pyzorMaxPacketSize  = 8192
+	pyzorAtomicNumLines = 4
+	pyzorMinLineLength  = 8
+	pyzorSendAttempts   = 2
+	pyzorAttemptTimeout = 3 * time.Second
+)
+
+// pyzorDigestSpec selects the lines digested from longer messages as
+// (offset in percent, number of lines) pairs.
+var pyzorDigestSpec = [][2]int{{20, 3}, {60, 3}}
+
+var (
+	pyzorLongString = regexp.MustCompile(`\S{10,}`)
+	pyzorEmail      = regexp.MustCompile(`\S+@\S+`)
+	pyzorURL        = regexp.MustCompile(`(?i)[a-z]+:\S+`)
+	pyzorHTMLTag    = regexp.MustCompile(`(?s)<.*?>`)
+	pyzorLineBreak  = regexp.MustCompile(`\r\n|\r|\n`)
+)
+
+// PyzorClient checks messages against a Pyzor server using the Pyzor 2.1 UDP
+// protocol with the anonymous account.
+type PyzorClient struct {
+	// Server is the host:port of the Pyzor server. Defaults to DefaultPyzorServer.
+	Server string
+}
+
+// Name implements BulkChecksumClient.
+func (c *PyzorClient) Name() string { return "pyzor" }
+
+// Check implements BulkChecksumClient. It returns the report count of the
+// message, or 0 if the server has whitelisted it.
+func (c *PyzorClient) Check(ctx context.Context, message []byte) (int, error) {
+	digest, ok := pyzorDigest(message)
+	if !ok {
+		return 0, nil // nothing to digest, e.g. an empty or attachment-only message
+	}
+
+	server := c.Server
+	if server == "" {
+		server = DefaultPyzorServer
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	thread := strconv.Itoa(1024 + rand.IntN(65535-1024))
+	request := pyzorRequest(digest, thread, time.Now().Unix())
+
+	var response map[string]string
+	for attempt := 0; attempt < pyzorSendAttempts; attempt++ {
+		// UDP may silently drop the request or response; wait a bounded time
+		// for each attempt.
+		deadline := time.Now().Add(pyzorAttemptTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetDeadline(deadline)
+
+		if _, err = conn.Write(request); err != nil {
+			return 0, err
+		}
+		response, err = readPyzorResponse(conn, thread)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return 0, err
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if code := response["Code"]; code != "200" {
+		return 0, fmt.Errorf("pyzor server error %s: %s", code, response["Diag"])
+	}
+	if wl, _ := strconv.Atoi(response["WL-Count"]); wl > 0 {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(response["Count"])
+	if err != nil {
+		return 0, fmt.Errorf("invalid pyzor count %q", response["Count"])
+	}
+	return count, nil
+}
+
+// pyzorRequest builds a signed check request for the anonymous account.
+func pyzorRequest(digest, thread string, timestamp int64) []byte {
+	fields := "Op: check\n" +
+		"Op-Digest: " + digest + "\n" +
+		"Thread: " + thread + "\n" +
+		"PV: " + pyzorProtoVersion + "\n" +
+		"User: " + pyzorAnonymousUser + "\n" +
+		"Time: " + strconv.FormatInt(timestamp, 10) + "\n"
+
+	// The signature covers the message so far, the time and the hashed key of
+	// the account. The anonymous account has an empty key.
+	hashedKey := sha1.Sum([]byte(pyzorAnonymousUser + ":"))
+	msgHash := sha1.Sum([]byte(strings.TrimSpace(fields)))
+	sig := sha1.New()
+	sig.Write(msgHash[:])
+	fmt.Fprintf(sig, ":%d:%s", timestamp, hex.EncodeToString(hashedKey[:]))
+
+	return []byte(fields + "Sig: " + hex.EncodeToString(sig.Sum(nil)) + "\n\n")
+}
+
+// readPyzorResponse reads the response matching thread. Responses to other
+// threads (e.g. late answers to a retried request) are skipped.
+func readPyzorResponse(conn net.Conn, thread string) (map[string]string, error) {
+	buf := make([]byte, pyzorMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		response := make(map[string]string)
+		scanner := bufio.NewScanner(strings.NewReader(string(buf[:n])))
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if ok {
+				response[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+		if response["Thread"] == thread {
+			return response, nil
+		}
+	}
+}
+
+// pyzorDigest computes the Pyzor digest of the text parts of a message. The
+// text is normalized so that small per-recipient variations (addresses, URLs,
+// long tokens, whitespace) do not change the digest. ok is false if the
+// message has no text to digest.
+func pyzorDigest(message []byte) (digest string, ok bool) {
+	var lines []string
+	walkParts(message, func(p *messagePart) error {
+		if !strings.HasPrefix(p.MediaType, "text/") {
+			return nil
+		}
+		text := string(p.Body)
+		if p.MediaType == "text/html" {
+			text = html.UnescapeString(pyzorHTMLTag.ReplaceAllString(text, ""))
+		}
+		for _, line := range pyzorLineBreak.Split(text, -1) {
+			if norm := pyzorNormalize(line); len(norm) >= pyzorMinLineLength {
+				lines = append(lines, norm)
+			}
+		}
+		return nil
+	})
+	if len(lines) == 0 {
+		return "", false
+	}
+
+	h := sha1.New()
+	if len(lines) <= pyzorAtomicNumLines {
+		for _, line := range lines {
+			h.Write([]byte(line))
+		}
+	} else {
+		for _, spec := range pyzorDigestSpec {
+			start := spec[0] * len(lines) / 100
+			for i := start; i < start+spec[1] && i < len(lines); i++ {
+				h.Write([]byte(lines[i]))
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// pyzorNormalize removes long tokens, e-mail addresses, URLs and all whitespace
+// from a line.
+func pyzorNormalize(line string) string {
+	line = pyzorLongString.ReplaceAllString(line, "")
+	line = pyzorEmail.ReplaceAllString(line, "")
+	line = pyzorURL.ReplaceAllString(line, "")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, line)
+}
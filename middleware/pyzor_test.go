@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const pyzorTestMessage = "Subject: offer\r\n\r\nwe have a great offer for you today\r\n"
+
+// startFakePyzor serves Pyzor requests on a local UDP port. reply returns the
+// response fields to a request, without the thread, or nil to drop it.
+func startFakePyzor(t *testing.T, reply func(request map[string]string) []string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, pyzorMaxPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := make(map[string]string)
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				if key, value, ok := strings.Cut(line, ": "); ok {
+					request[key] = value
+				}
+			}
+			fields := reply(request)
+			if fields == nil {
+				continue
+			}
+			response := strings.Join(fields, "\n") + "\nThread: " + request["Thread"] + "\n\n"
+			pc.WriteTo([]byte(response), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestPyzorClient_Check(t *testing.T) {
+	digest, ok := pyzorDigest([]byte(pyzorTestMessage))
+	require.True(t, ok)
+
+	tests := []struct {
+		name    string
+		fields  []string
+		want    int
+		wantErr bool
+	}{
+		{name: "hit", fields: []string{"Code: 200", "Diag: OK", "PV: 2.1", "Count: 7", "WL-Count: 0"}, want: 7},
+		{name: "miss", fields: []string{"Code: 200", "Diag: OK", "PV: 2.1", "Count: 0", "WL-Count: 0"}, want: 0},
+		{name: "whitelisted", fields: []string{"Code: 200", "Diag: OK", "PV: 2.1", "Count: 50", "WL-Count: 1"}, want: 0},
+		{name: "server error", fields: []string{"Code: 500", "Diag: Internal Server Error", "PV: 2.1"}, wantErr: true},
+		{name: "invalid count", fields: []string{"Code: 200", "Diag: OK", "PV: 2.1", "Count: many"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startFakePyzor(t, func(request map[string]string) []string {
+				assert.Equal(t, "check", request["Op"])
+				assert.Equal(t, digest, request["Op-Digest"])
+				assert.Equal(t, "anonymous", request["User"])
+				return tt.fields
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			count, err := (&PyzorClient{Server: server}).Check(ctx, []byte(pyzorTestMessage))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, count)
+		})
+	}
+}
+
+func TestPyzorClient_Check_Timeout(t *testing.T) {
+	server := startFakePyzor(t, func(request map[string]string) []string { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := (&PyzorClient{Server: server}).Check(ctx, []byte(pyzorTestMessage))
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second, "the deadline of ctx bounds the attempts")
+}
+
+func TestPyzorClient_Check_NoText(t *testing.T) {
+	// A message without text is not sent to the server at all.
+	server := startFakePyzor(t, func(request map[string]string) []string {
+		t.Error("unexpected request")
+		return nil
+	})
+	count, err := (&PyzorClient{Server: server}).Check(context.Background(), []byte("Subject: empty\r\n\r\nhi\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestReadPyzorResponse_OtherThread(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		// A late response to an earlier attempt is skipped.
+		server.Write([]byte("Code: 200\nThread: 1111\nCount: 1\n\n"))
+		server.Write([]byte("Code: 200\nThread: 2222\nCount: 2\n\n"))
+	}()
+
+	response, err := readPyzorResponse(client, "2222")
+	require.NoError(t, err)
+	assert.Equal(t, "2", response["Count"])
+}
+
+func TestPyzorDigest(t *testing.T) {
+	base := "Subject: offer\r\n\r\n" +
+		"Dear customer,\r\n" +
+		"we have a great offer for you today.\r\n" +
+		"Contact %s or visit %s for details.\r\n"
+
+	d1, ok := pyzorDigest([]byte(strings.Replace(strings.Replace(base, "%s", "alice@example.com", 1), "%s", "http://a.example/x", 1)))
+	require.True(t, ok)
+	d2, ok := pyzorDigest([]byte(strings.Replace(strings.Replace(base, "%s", "bob@example.org", 1), "%s", "http://b.example/y", 1)))
+	require.True(t, ok)
+	assert.Equal(t, d1, d2, "per-recipient variations must not change the digest")
+	assert.Len(t, d1, 40)
+
+	_, ok = pyzorDigest([]byte("Subject: empty\r\n\r\nhi\r\n"))
+	assert.False(t, ok)
+}
+
+func TestPyzorRequest(t *testing.T) {
+	request := string(pyzorRequest("abc", "1234", 1700000000))
+	assert.True(t, strings.HasPrefix(request, "Op: check\nOp-Digest: abc\nThread: 1234\nPV: 2.1\nUser: anonymous\nTime: 1700000000\nSig: "))
+	assert.True(t, strings.HasSuffix(request, "\n\n"))
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// DefaultQuotaWarnRatio is the default fraction of a quota at which a
+// near-quota warning is emitted.
+const DefaultQuotaWarnRatio = 0.9
+
+// QuotaWarningKey is the context key holding the recipients ([]string) whose
+// mailbox is close to its quota.
+const QuotaWarningKey = "quota.near_quota"
+
+// ErrMailboxFull is returned for a recipient whose mailbox is over quota. It is
+// a temporary failure so the sender retries once space has been freed.
+var ErrMailboxFull = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+	Message:      "Mailbox full, please try again later",
+}
+
+// QuotaSource returns the storage used by a recipient's mailbox and its limit,
+// both in bytes. A limit of zero or less means the mailbox has no quota.
+type QuotaSource func(rcpt string) (used, limit int64, err error)
+
+// QuotaConfig configures the Quota middleware.
+type QuotaConfig struct {
+	// Source looks up mailbox usage. It is required.
+	Source QuotaSource
+	// WarnRatio is the fraction of the limit at which a near-quota warning is
+	// emitted. Defaults to DefaultQuotaWarnRatio.
+	WarnRatio float64
+}
+
+// Quota enforces per-recipient storage quotas. It runs in the RcptTo chain so
+// that only the affected recipient is refused. When the client announced the
+// message size with MAIL FROM SIZE=, the size is taken into account.
+type Quota struct {
+	source    QuotaSource
+	warnRatio float64
+}
+
+// NewQuota creates a new Quota instance.
+func NewQuota(cfg QuotaConfig) (*Quota, error) {
+	if cfg.Source == nil {
+		return nil, fmt.Errorf("quota source is required")
+	}
+	if cfg.WarnRatio < 0 || cfg.WarnRatio > 1 {
+		return nil, fmt.Errorf("invalid quota warn ratio: %v", cfg.WarnRatio)
+	}
+	if cfg.WarnRatio == 0 {
+		cfg.WarnRatio = DefaultQuotaWarnRatio
+	}
+	return &Quota{source: cfg.Source, warnRatio: cfg.WarnRatio}, nil
+}
+
+// NewQuotaHandler creates a new RcptTo middleware handler enforcing mailbox quotas.
+func NewQuotaHandler(cfg QuotaConfig) (brisa.Handler, error) {
+	q, err := NewQuota(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return q.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It checks the recipient added
+// by the current RCPT TO command.
+func (q *Quota) Handle(ctx *brisa.Context) brisa.Action {
+	if len(ctx.To) == 0 {
+		return brisa.Pass
+	}
+	rcpt := ctx.To[len(ctx.To)-1]
+
+	used, limit, err := q.source(rcpt)
+	if err != nil {
+		// Fail open: a broken quota backend must not stop mail flow.
+		ctx.Logger.Error("quota lookup failed", "rcpt", rcpt, "error", err)
+		return brisa.Pass
+	}
+	if limit <= 0 {
+		return brisa.Pass
+	}
+
+	var size int64
+	if ctx.FromOptions != nil {
+		size = ctx.FromOptions.Size
+	}
+	if used >= limit || used+size > limit {
+		ctx.Logger.Info("recipient over quota", "rcpt", rcpt, "used", used, "limit", limit, "size", size)
+		return ctx.RejectWith(ErrMailboxFull)
+	}
+
+	if float64(used+size) >= q.warnRatio*float64(limit) {
+		ctx.Logger.Warn("recipient near quota", "rcpt", rcpt, "used", used, "limit", limit)
+		var near []string
+		if v, ok := ctx.Get(QuotaWarningKey); ok {
+			near, _ = v.([]string)
+		}
+		ctx.Set(QuotaWarningKey, append(near, rcpt))
+	}
+	return brisa.Pass
+}
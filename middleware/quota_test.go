@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewQuota(t *testing.T) {
+	_, err := NewQuota(QuotaConfig{})
+	require.Error(t, err)
+
+	_, err = NewQuota(QuotaConfig{Source: func(string) (int64, int64, error) { return 0, 0, nil }, WarnRatio: 2})
+	require.Error(t, err)
+}
+
+func TestQuota_Handle(t *testing.T) {
+	usage := map[string][2]int64{
+		"full@example.com":      {100, 100},
+		"near@example.com":      {95, 100},
+		"ok@example.com":        {10, 100},
+		"unlimited@example.com": {1 << 40, 0},
+	}
+	source := func(rcpt string) (int64, int64, error) {
+		if rcpt == "broken@example.com" {
+			return 0, 0, errors.New("backend down")
+		}
+		u := usage[rcpt]
+		return u[0], u[1], nil
+	}
+
+	handler, err := NewQuotaHandler(QuotaConfig{Source: source})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		rcpt       string
+		size       int64
+		wantAction brisa.Action
+		wantWarn   bool
+	}{
+		{name: "under quota", rcpt: "ok@example.com", wantAction: brisa.Pass},
+		{name: "over quota", rcpt: "full@example.com", wantAction: brisa.Reject},
+		{name: "announced size exceeds quota", rcpt: "ok@example.com", size: 91, wantAction: brisa.Reject},
+		{name: "near quota", rcpt: "near@example.com", wantAction: brisa.Pass, wantWarn: true},
+		{name: "no quota", rcpt: "unlimited@example.com", wantAction: brisa.Pass},
+		{name: "lookup error fails open", rcpt: "broken@example.com", wantAction: brisa.Pass},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newTestContext(t, "")
+			ctx.FromOptions = &smtp.MailOptions{Size: tc.size}
+			ctx.To = []string{"other@example.com", tc.rcpt}
+
+			assert.Equal(t, tc.wantAction, handler(ctx))
+			if tc.wantAction == brisa.Reject {
+				assert.Equal(t, ErrMailboxFull, ctx.RejectError())
+			}
+
+			near, ok := ctx.Get(QuotaWarningKey)
+			assert.Equal(t, tc.wantWarn, ok)
+			if tc.wantWarn {
+				assert.Equal(t, []string{tc.rcpt}, near)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// DefaultRateLimitKeyPrefix is the default prefix of the Store keys written by RateLimit.
+const DefaultRateLimitKeyPrefix = "ratelimit:"
+
+// ErrRateLimited is returned when a client exceeds its rate limit. It is a
+// temporary failure so well-behaved senders slow down and retry.
+var ErrRateLimited = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Rate limit exceeded, please try again later",
+}
+
+// RateLimitKey returns what a rate limit counts for a transaction, such as the
+// client IP or the sender. An empty key is not limited.
+type RateLimitKey func(ctx *brisa.Context) string
+
+// RateByClientIP counts per client IP address.
+func RateByClientIP(ctx *brisa.Context) string {
+	if ip := clientIP(ctx); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return ""
+}
+
+// RateBySender counts per envelope sender.
+func RateBySender(ctx *brisa.Context) string {
+	if ctx.From == "" {
+		return ""
+	}
+	return "sender:" + strings.ToLower(ctx.From)
+}
+
+// RateLimitConfig configures the RateLimit middleware.
+type RateLimitConfig struct {
+	// Store holds the counters. It is required. Counters live in the Store with
+	// the window as TTL, so a persistent or shared Store keeps them across
+	// restarts and instances.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultRateLimitKeyPrefix.
+	KeyPrefix string
+	// Limit is the number of passes allowed per Window. It is required.
+	Limit  int64
+	Window time.Duration
+	// Key selects the counter. Defaults to RateByClientIP.
+	Key RateLimitKey
+	// Blacklist, if set, blocks the client IP for BanFor once it exceeds the
+	// limit. Give the blacklist a Store for the ban to survive restarts.
+	Blacklist *IPBlacklist
+	BanFor    time.Duration
+}
+
+// RateLimit limits how often a client passes the chain it runs in, e.g.
+// connections in the Conn chain, messages in the MailFrom chain or
+// recipients in the RcptTo chain, with a fixed window counter per key.
+type RateLimit struct {
+	cfg RateLimitConfig
+}
+
+// NewRateLimit creates a new RateLimit instance.
+func NewRateLimit(cfg RateLimitConfig) (*RateLimit, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("rate limit store is required")
+	}
+	if cfg.Limit <= 0 || cfg.Window <= 0 {
+		return nil, fmt.Errorf("rate limit needs a positive limit and window")
+	}
+	if cfg.Blacklist != nil && cfg.BanFor <= 0 {
+		return nil, fmt.Errorf("rate limit blacklist requires a positive ban duration")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultRateLimitKeyPrefix
+	}
+	if cfg.Key == nil {
+		cfg.Key = RateByClientIP
+	}
+	return &RateLimit{cfg: cfg}, nil
+}
+
+// NewRateLimitHandler creates a new middleware handler enforcing a rate limit.
+func NewRateLimitHandler(cfg RateLimitConfig) (brisa.Handler, error) {
+	rl, err := NewRateLimit(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return rl.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (rl *RateLimit) Handle(ctx *brisa.Context) brisa.Action {
+	key := rl.cfg.Key(ctx)
+	if key == "" {
+		return brisa.Pass
+	}
+	n, err := rl.cfg.Store.Incr(rl.cfg.KeyPrefix+key, 1, rl.cfg.Window)
+	if err != nil {
+		// Fail open: a broken Store must not stop mail flow.
+		ctx.Logger.Error("failed to count rate limit", "key", key, "error", err)
+		return brisa.Pass
+	}
+	if n <= rl.cfg.Limit {
+		return brisa.Pass
+	}
+
+	ctx.Logger.Warn("rate limit exceeded", "key", key, "count", n, "limit", rl.cfg.Limit)
+	// Ban once, when the limit is first exceeded.
+	if rl.cfg.Blacklist != nil && n == rl.cfg.Limit+1 {
+		if ip := clientIP(ctx); ip != nil {
+			if err := rl.cfg.Blacklist.Block(ip, rl.cfg.BanFor); err != nil {
+				ctx.Logger.Error("failed to record rate limit ban", "error", err)
+			}
+			ctx.Logger.Info("rate limited client temporarily blacklisted", "ip", ip, "duration", rl.cfg.BanFor)
+		}
+	}
+	return ctx.RejectWith(ErrRateLimited)
+}
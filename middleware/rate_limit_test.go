@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRateLimit(t *testing.T) {
+	store := brisa.NewMemoryStore()
+	_, err := NewRateLimit(RateLimitConfig{Limit: 1, Window: time.Minute})
+	require.Error(t, err)
+	_, err = NewRateLimit(RateLimitConfig{Store: store})
+	require.Error(t, err)
+	blacklist, _ := NewIPBlacklist(nil)
+	_, err = NewRateLimit(RateLimitConfig{Store: store, Limit: 1, Window: time.Minute, Blacklist: blacklist})
+	require.Error(t, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := brisa.NewMemoryStoreWithClock(clock)
+	blacklist, err := NewIPBlacklist(nil)
+	require.NoError(t, err)
+	blacklist.Clock, blacklist.Store = clock, store
+
+	newLimit := func() *RateLimit {
+		rl, err := NewRateLimit(RateLimitConfig{Store: store, Limit: 2, Window: time.Minute, Blacklist: blacklist, BanFor: time.Hour})
+		require.NoError(t, err)
+		return rl
+	}
+	rl := newLimit()
+	handle := func(rl *RateLimit) (brisa.Action, *brisa.Context) {
+		ctx := brisatest.NewContext(t, brisatest.DefaultEnvelope(), "")
+		return rl.Handle(ctx), ctx
+	}
+
+	for range 2 {
+		action, _ := handle(rl)
+		assert.Equal(t, brisa.Pass, action)
+	}
+	action, ctx := handle(rl)
+	assert.Equal(t, brisa.Reject, action)
+	assert.Equal(t, ErrRateLimited, ctx.RejectError())
+	assert.True(t, blacklist.IsBlocked(brisatest.DefaultClientIP))
+
+	// The counter lives in the Store, so a restart does not reset it.
+	action, _ = handle(newLimit())
+	assert.Equal(t, brisa.Reject, action)
+
+	// Other clients have their own counter.
+	env := brisatest.DefaultEnvelope()
+	env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}
+	assert.Equal(t, brisa.Pass, rl.Handle(brisatest.NewContext(t, env, "")))
+
+	clock.Advance(time.Minute)
+	action, _ = handle(rl)
+	assert.Equal(t, brisa.Pass, action, "the window has passed")
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+const (
+	// RecipientResolvedKey is the context key holding the recipients
+	// (map[string]bool, lower case) a RecipientPolicy has decided on, which
+	// RecipientVerifier does not look up again.
+	RecipientResolvedKey = "recipient.resolved"
+	// CatchAllKey is the context key holding the original recipients
+	// ([]string) that were redirected to a catch-all address.
+	CatchAllKey = "recipient.catch_all"
+)
+
+// DomainPolicy is the recipient policy of a hosted domain. A recipient
+// matching a mailbox is accepted; other recipients go to CatchAll if set,
+// are refused if RejectUnknown is set, or are left to later verification.
+type DomainPolicy struct {
+	// Mailboxes are the local parts of the domain's addresses, e.g. "alice".
+	Mailboxes []string
+	// CatchAll is the address unknown recipients are redirected to.
+	CatchAll string
+	// RejectUnknown refuses unknown recipients with ErrUnknownRecipient.
+	RejectUnknown bool
+}
+
+// RecipientPolicyConfig configures the RecipientPolicy middleware.
+type RecipientPolicyConfig struct {
+	// Domains map a hosted domain to its policy. Recipients in other domains
+	// are left alone.
+	Domains map[string]DomainPolicy
+}
+
+// RecipientPolicy applies the recipient policy of the hosted domains in the
+// RcptTo chain. It needs no backend, so it belongs before verification
+// middleware such as RecipientVerifier, which skip the recipients it decided.
+type RecipientPolicy struct {
+	domains map[string]*domainPolicy
+}
+
+type domainPolicy struct {
+	mailboxes     map[string]bool
+	catchAll      string
+	rejectUnknown bool
+}
+
+// NewRecipientPolicy creates a new RecipientPolicy instance.
+func NewRecipientPolicy(cfg RecipientPolicyConfig) (*RecipientPolicy, error) {
+	domains := make(map[string]*domainPolicy, len(cfg.Domains))
+	for domain, p := range cfg.Domains {
+		if p.CatchAll != "" && p.RejectUnknown {
+			return nil, fmt.Errorf("domain %s: catch-all and reject-unknown exclude each other", domain)
+		}
+		if p.CatchAll != "" && !strings.Contains(p.CatchAll, "@") {
+			return nil, fmt.Errorf("domain %s: invalid catch-all address %q", domain, p.CatchAll)
+		}
+		dp := &domainPolicy{mailboxes: make(map[string]bool, len(p.Mailboxes)), catchAll: p.CatchAll, rejectUnknown: p.RejectUnknown}
+		for _, m := range p.Mailboxes {
+			dp.mailboxes[strings.ToLower(m)] = true
+		}
+		domains[address.NormalizeDomain(domain)] = dp
+	}
+	return &RecipientPolicy{domains: domains}, nil
+}
+
+// NewRecipientPolicyHandler creates a new RcptTo middleware handler applying
+// the recipient policy of the hosted domains.
+func NewRecipientPolicyHandler(cfg RecipientPolicyConfig) (brisa.Handler, error) {
+	p, err := NewRecipientPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return p.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It applies the policy to
+// the recipient added by the current RCPT TO command, without the detail
+// recorded by Subaddressing.
+func (p *RecipientPolicy) Handle(ctx *brisa.Context) brisa.Action {
+	if len(ctx.To) == 0 {
+		return brisa.Pass
+	}
+	i := len(ctx.To) - 1
+	rcpt := ctx.To[i]
+	addr, err := address.Parse(baseRecipient(ctx, rcpt))
+	if err != nil {
+		return brisa.Pass
+	}
+	dp, ok := p.domains[address.NormalizeDomain(addr.Domain)]
+	if !ok {
+		return brisa.Pass
+	}
+
+	switch {
+	case dp.mailboxes[strings.ToLower(addr.Local)]:
+		markResolved(ctx, rcpt)
+	case dp.catchAll != "":
+		ctx.Logger.Info("recipient redirected to catch-all", "rcpt", rcpt, "catch_all", dp.catchAll)
+		var originals []string
+		if v, ok := ctx.Get(CatchAllKey); ok {
+			originals, _ = v.([]string)
+		}
+		ctx.Set(CatchAllKey, append(originals, rcpt))
+		ctx.To[i] = dp.catchAll
+		markResolved(ctx, dp.catchAll)
+	case dp.rejectUnknown:
+		ctx.Logger.Info("unknown recipient", "rcpt", rcpt)
+		return ctx.RejectWith(ErrUnknownRecipient)
+	}
+	return brisa.Pass
+}
+
+// markResolved records that the recipient needs no further verification.
+func markResolved(ctx *brisa.Context, rcpt string) {
+	resolved, _ := ctx.Get(RecipientResolvedKey)
+	m, ok := resolved.(map[string]bool)
+	if !ok {
+		m = make(map[string]bool)
+		ctx.Set(RecipientResolvedKey, m)
+	}
+	m[address.Key(rcpt)] = true
+}
+
+// recipientResolved reports whether a RecipientPolicy has decided on rcpt.
+func recipientResolved(ctx *brisa.Context, rcpt string) bool {
+	resolved, _ := ctx.Get(RecipientResolvedKey)
+	m, _ := resolved.(map[string]bool)
+	return m[address.Key(rcpt)]
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRecipientPolicy(t *testing.T) {
+	_, err := NewRecipientPolicy(RecipientPolicyConfig{Domains: map[string]DomainPolicy{
+		"example.com": {CatchAll: "all@example.com", RejectUnknown: true},
+	}})
+	require.Error(t, err)
+	_, err = NewRecipientPolicy(RecipientPolicyConfig{Domains: map[string]DomainPolicy{
+		"example.com": {CatchAll: "all"},
+	}})
+	require.Error(t, err)
+}
+
+func TestRecipientPolicy(t *testing.T) {
+	policy, err := NewRecipientPolicy(RecipientPolicyConfig{Domains: map[string]DomainPolicy{
+		"strict.example":   {Mailboxes: []string{"alice"}, RejectUnknown: true},
+		"catchall.example": {Mailboxes: []string{"bob"}, CatchAll: "inbox@catchall.example"},
+		"Verified.Example": {Mailboxes: []string{"carol"}},
+	}})
+	require.NoError(t, err)
+
+	var lookups atomic.Int64
+	verifier, err := NewRecipientVerifier(RecipientVerifierConfig{
+		BatchSize: 1,
+		Lookup: func(ctx context.Context, rcpts []string) (map[string]bool, error) {
+			lookups.Add(1)
+			return map[string]bool{"dave@verified.example": true}, nil
+		},
+	})
+	require.NoError(t, err)
+
+	router := brisa.Router{}
+	router.OnRcptTo(&brisa.Middleware{Handler: policy.Handle}, &brisa.Middleware{Handler: verifier.Handle})
+	var to []string
+	var catchAll any
+	router.OnData(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		to = append([]string(nil), ctx.To...)
+		catchAll, _ = ctx.Get(CatchAllKey)
+		return brisa.Pass
+	}})
+	b := brisa.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+
+	env := brisatest.DefaultEnvelope()
+	env.To = []string{
+		"Alice@strict.example", "eve@strict.example",
+		"bob@catchall.example", "frank@catchall.example",
+		"carol@verified.example", "dave@verified.example", "mallory@verified.example",
+	}
+	res := b.Simulate(env, strings.NewReader("\r\n"))
+	assert.NoError(t, res.Err)
+	assert.Equal(t, map[string]error{
+		"eve@strict.example":       ErrUnknownRecipient,
+		"mallory@verified.example": ErrUnknownRecipient,
+	}, res.RcptErrors)
+	assert.Equal(t, []string{
+		"Alice@strict.example", "bob@catchall.example", "inbox@catchall.example",
+		"carol@verified.example", "dave@verified.example",
+	}, to)
+	assert.Equal(t, []string{"frank@catchall.example"}, catchAll)
+	// Only the recipients the policy left open were looked up.
+	assert.Equal(t, int64(2), lookups.Load())
+}
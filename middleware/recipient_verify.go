@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultRecipientBatchSize is the default maximum number of recipients
+	// verified by one backend lookup.
+	DefaultRecipientBatchSize = 100
+	// DefaultRecipientBatchWindow is the default time a lookup waits for more
+	// recipients to join its batch.
+	DefaultRecipientBatchWindow = 2 * time.Millisecond
+	// DefaultRecipientConcurrency is the default number of backend lookups in
+	// flight at once.
+	DefaultRecipientConcurrency = 8
+	// DefaultRecipientTimeout is the default timeout of a backend lookup.
+	DefaultRecipientTimeout = 10 * time.Second
+)
+
+var (
+	// ErrUnknownRecipient is returned for a recipient the backend does not know.
+	ErrUnknownRecipient = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user here",
+	}
+	// ErrRecipientVerifyFailed is returned when the backend could not be
+	// asked, so that the sender retries later.
+	ErrRecipientVerifyFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Recipient verification unavailable, please try again later",
+	}
+)
+
+// RecipientLookup verifies a batch of recipients against a backend such as a
+// directory, a database or a callout, and returns the ones that exist.
+// Recipients missing from the result are unknown.
+type RecipientLookup func(ctx context.Context, rcpts []string) (valid map[string]bool, err error)
+
+// RecipientVerifierConfig configures the RecipientVerifier middleware.
+type RecipientVerifierConfig struct {
+	// Lookup verifies recipients. It is required.
+	Lookup RecipientLookup
+	// BatchSize bounds the recipients of one lookup. Defaults to
+	// DefaultRecipientBatchSize; 1 disables batching.
+	BatchSize int
+	// BatchWindow is the time a lookup waits for more recipients before it is
+	// sent. Defaults to DefaultRecipientBatchWindow.
+	BatchWindow time.Duration
+	// Concurrency bounds the lookups in flight. Defaults to
+	// DefaultRecipientConcurrency.
+	Concurrency int
+	// Timeout bounds each lookup. Defaults to DefaultRecipientTimeout.
+	Timeout time.Duration
+	// FailOpen accepts recipients when the lookup fails instead of refusing
+	// them with ErrRecipientVerifyFailed.
+	FailOpen bool
+}
+
+// RecipientVerifier refuses unknown recipients in the RcptTo chain. Instead of
+// one backend lookup per RCPT TO command, the recipients of all sessions
+// arriving within a short window are verified together, and several batches
+// are looked up in parallel. Every RCPT TO still gets its own reply.
+type RecipientVerifier struct {
+	cfg RecipientVerifierConfig
+	sem chan struct{}
+
+	mu      sync.Mutex
+	pending *recipientBatch
+}
+
+// recipientBatch is a lookup being collected or in flight.
+type recipientBatch struct {
+	rcpts []string
+	seen  map[string]bool
+	full  chan struct{} // closed when no more recipients fit
+	done  chan struct{} // closed when valid and err are set
+	valid map[string]bool
+	err   error
+}
+
+// NewRecipientVerifier creates a new RecipientVerifier instance.
+func NewRecipientVerifier(cfg RecipientVerifierConfig) (*RecipientVerifier, error) {
+	if cfg.Lookup == nil {
+		return nil, fmt.Errorf("recipient lookup is required")
+	}
+	if cfg.BatchSize < 0 || cfg.BatchWindow < 0 || cfg.Concurrency < 0 || cfg.Timeout < 0 {
+		return nil, fmt.Errorf("recipient verifier settings must not be negative")
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = DefaultRecipientBatchSize
+	}
+	if cfg.BatchWindow == 0 {
+		cfg.BatchWindow = DefaultRecipientBatchWindow
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = DefaultRecipientConcurrency
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultRecipientTimeout
+	}
+	return &RecipientVerifier{cfg: cfg, sem: make(chan struct{}, cfg.Concurrency)}, nil
+}
+
+// NewRecipientVerifierHandler creates a new RcptTo middleware handler
+// verifying recipients.
+func NewRecipientVerifierHandler(cfg RecipientVerifierConfig) (brisa.Handler, error) {
+	v, err := NewRecipientVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return v.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It verifies the recipient
+// added by the current RCPT TO command, without the detail recorded by
+// Subaddressing, unless a RecipientPolicy has already decided on it.
+func (v *RecipientVerifier) Handle(ctx *brisa.Context) brisa.Action {
+	if len(ctx.To) == 0 {
+		return brisa.Pass
+	}
+	rcpt := ctx.To[len(ctx.To)-1]
+	if recipientResolved(ctx, rcpt) {
+		return brisa.Pass
+	}
+
+	valid, err := v.Verify(baseRecipient(ctx, rcpt))
+	if err != nil {
+		ctx.Logger.Error("recipient verification failed", "rcpt", rcpt, "error", err)
+		if v.cfg.FailOpen {
+			return brisa.Pass
+		}
+		return ctx.RejectWith(ErrRecipientVerifyFailed)
+	}
+	if !valid {
+		ctx.Logger.Info("unknown recipient", "rcpt", rcpt)
+		return ctx.RejectWith(ErrUnknownRecipient)
+	}
+	return brisa.Pass
+}
+
+// Verify reports whether rcpt exists, batching the lookup with concurrent
+// calls.
+func (v *RecipientVerifier) Verify(rcpt string) (bool, error) {
+	v.mu.Lock()
+	b := v.pending
+	leader := b == nil
+	if leader {
+		b = &recipientBatch{seen: make(map[string]bool), full: make(chan struct{}), done: make(chan struct{})}
+		v.pending = b
+	}
+	if !b.seen[rcpt] {
+		b.seen[rcpt] = true
+		b.rcpts = append(b.rcpts, rcpt)
+		if len(b.rcpts) >= v.cfg.BatchSize {
+			v.pending = nil
+			close(b.full)
+		}
+	}
+	v.mu.Unlock()
+
+	// The first caller of a batch sends it once the window has passed or the
+	// batch is full; the others wait for its answer.
+	if leader {
+		v.send(b)
+	}
+	<-b.done
+	if b.err != nil {
+		return false, b.err
+	}
+	return b.valid[rcpt], nil
+}
+
+func (v *RecipientVerifier) send(b *recipientBatch) {
+	timer := time.NewTimer(v.cfg.BatchWindow)
+	select {
+	case <-timer.C:
+	case <-b.full:
+		timer.Stop()
+	}
+	v.mu.Lock()
+	if v.pending == b {
+		v.pending = nil
+	}
+	v.mu.Unlock()
+
+	v.sem <- struct{}{}
+	defer func() { <-v.sem }()
+	ctx, cancel := context.WithTimeout(context.Background(), v.cfg.Timeout)
+	defer cancel()
+	b.valid, b.err = v.cfg.Lookup(ctx, b.rcpts)
+	close(b.done)
+}
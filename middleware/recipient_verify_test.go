@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecipientVerifier_Handle(t *testing.T) {
+	lookup := func(ctx context.Context, rcpts []string) (map[string]bool, error) {
+		return map[string]bool{"alice@example.com": true}, nil
+	}
+	h, err := NewRecipientVerifierHandler(RecipientVerifierConfig{Lookup: lookup})
+	require.NoError(t, err)
+
+	ctx := newTestContext(t, "")
+	ctx.To = []string{"alice@example.com"}
+	assert.Equal(t, brisa.Pass, h(ctx))
+
+	ctx = newTestContext(t, "")
+	ctx.To = []string{"alice@example.com", "bob@example.com"}
+	assert.Equal(t, brisa.Reject, h(ctx))
+	assert.Equal(t, ErrUnknownRecipient, ctx.RejectError())
+}
+
+func TestRecipientVerifier_LookupFailure(t *testing.T) {
+	lookup := func(ctx context.Context, rcpts []string) (map[string]bool, error) {
+		return nil, errors.New("directory unavailable")
+	}
+	for _, failOpen := range []bool{false, true} {
+		h, err := NewRecipientVerifierHandler(RecipientVerifierConfig{Lookup: lookup, FailOpen: failOpen})
+		require.NoError(t, err)
+		ctx := newTestContext(t, "")
+		ctx.To = []string{"alice@example.com"}
+		if failOpen {
+			assert.Equal(t, brisa.Pass, h(ctx))
+		} else {
+			assert.Equal(t, brisa.Reject, h(ctx))
+			assert.Equal(t, ErrRecipientVerifyFailed, ctx.RejectError())
+		}
+	}
+}
+
+func TestRecipientVerifier_Batching(t *testing.T) {
+	var calls, inFlight, maxInFlight atomic.Int32
+	var mu sync.Mutex
+	var sizes []int
+	lookup := func(ctx context.Context, rcpts []string) (map[string]bool, error) {
+		calls.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		mu.Lock()
+		sizes = append(sizes, len(rcpts))
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+
+		valid := make(map[string]bool)
+		for _, r := range rcpts {
+			valid[r] = r != "unknown@example.com"
+		}
+		return valid, nil
+	}
+	v, err := NewRecipientVerifier(RecipientVerifierConfig{Lookup: lookup, BatchSize: 10, BatchWindow: 50 * time.Millisecond, Concurrency: 2})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range 40 {
+		rcpt := fmt.Sprintf("user%d@example.com", i)
+		if i%4 == 0 {
+			rcpt = "unknown@example.com"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			valid, err := v.Verify(rcpt)
+			assert.NoError(t, err)
+			assert.Equal(t, rcpt != "unknown@example.com", valid, rcpt)
+		}()
+	}
+	wg.Wait()
+
+	assert.Less(t, calls.Load(), int32(40), "recipients must be batched")
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(2))
+	for _, n := range sizes {
+		assert.LessOrEqual(t, n, 10)
+	}
+}
+
+func TestNewRecipientVerifier_Errors(t *testing.T) {
+	_, err := NewRecipientVerifier(RecipientVerifierConfig{})
+	assert.Error(t, err)
+	_, err = NewRecipientVerifier(RecipientVerifierConfig{
+		Lookup:    func(context.Context, []string) (map[string]bool, error) { return nil, nil },
+		BatchSize: -1,
+	})
+	assert.Error(t, err)
+}
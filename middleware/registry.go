@@ -0,0 +1,306 @@
+package middleware
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+// Register adds the factories of the built-in middleware that can be
+// configured from a file to r, so that configurations can refer to them by
+// name, e.g. "spam_tag", and the "oauth2" authenticator.
+//
+// The config map of a middleware sets the fields of its Config type, with the
+// field names in snake case, e.g. max_scan_bytes for MaxScanBytes. Durations
+// are strings such as "10m", times are RFC 3339 strings and locations are
+// IANA names. Settings that take code, such as lookups and callbacks, cannot
+// be configured, and middleware with handlers for several chains are built in
+// code. A Store left unset is the Store of r; see brisa.Registry.Store.
+func Register(r *brisa.Registry) {
+	r.Register("alias", configFactory(r, NewAliasHandler))
+	r.Register("anomaly", configFactory(r, NewAnomalyHandler))
+	r.Register("attachment_strip", configFactory(r, NewAttachmentStripperHandler))
+	r.Register("bayes", configFactory(r, NewBayesHandler))
+	r.Register("bot_fingerprint", configFactory(r, NewBotFingerprintHandler))
+	r.Register("bulk_classify", configFactory(r, NewBulkClassifierHandler))
+	r.Register("conn_reputation", configFactory(r, NewConnReputationHandler))
+	r.Register("dlp", configFactory(r, NewDLPHandler))
+	r.Register("early_talker", configFactory(r, NewEarlyTalkerHandler))
+	r.Register("header_scrub", configFactory(r, func(cfg headerScrubConfig) (brisa.Handler, error) {
+		return NewHeaderScrubberHandler(cfg.Rules)
+	}))
+	r.Register("ip_blacklist", configFactory(r, func(cfg ipBlacklistConfig) (brisa.Handler, error) {
+		return NewIPBlacklistHandler(cfg.IPs)
+	}))
+	r.Register("limit_policy", configFactory(r, NewLimitPolicyHandler))
+	r.Register("mail_loop", configFactory(r, func(cfg MailLoopConfig) (brisa.Handler, error) {
+		return NewMailLoopHandler(cfg), nil
+	}))
+	r.Register("message_hygiene", configFactory(r, NewMessageHygieneHandler))
+	r.Register("rate_limit", configFactory(r, NewRateLimitHandler))
+	r.Register("recipient_policy", configFactory(r, NewRecipientPolicyHandler))
+	r.Register("relay_control", configFactory(r, NewRelayControlHandler))
+	r.Register("spam_tag", configFactory(r, func(cfg SpamTaggerConfig) (brisa.Handler, error) {
+		return NewSpamTaggerHandler(cfg), nil
+	}))
+	r.Register("spamtrap", configFactory(r, NewSpamtrapHandler))
+	r.Register("subaddress", configFactory(r, NewSubaddressingHandler))
+	r.Register("threat_intel", configFactory(r, NewThreatIntelHandler))
+	r.Register("trace", configFactory(r, NewTraceHandler))
+	r.Register("unsubscribe_check", configFactory(r, NewUnsubscribeCheckHandler))
+	r.Register("url_reputation", configFactory(r, NewURLReputationHandler))
+	r.Register("warmup", configFactory(r, NewWarmUpHandler))
+
+	r.RegisterAuthenticator("oauth2", func(config map[string]any) (brisa.Authenticator, error) {
+		var cfg OAuth2Config
+		if err := decodeConfig(config, &cfg); err != nil {
+			return nil, err
+		}
+		return NewOAuth2(cfg)
+	})
+}
+
+// ipBlacklistConfig is the config map of the ip_blacklist middleware.
+type ipBlacklistConfig struct {
+	IPs []string
+}
+
+// headerScrubConfig is the config map of the header_scrub middleware.
+type headerScrubConfig struct {
+	Rules []HeaderScrubRule
+}
+
+// configFactory returns a factory decoding the config map into a C, with the
+// Store of r if C has an unset Store, and creating the handler from it.
+func configFactory[C any](r *brisa.Registry, newHandler func(C) (brisa.Handler, error)) brisa.MiddlewareFactory {
+	return func(config map[string]any) (brisa.Handler, error) {
+		var cfg C
+		if err := decodeConfig(config, &cfg); err != nil {
+			return nil, err
+		}
+		if s := r.Store(); s != nil {
+			if f := reflect.ValueOf(&cfg).Elem().FieldByName("Store"); f.IsValid() && f.Type() == storeType && f.IsNil() {
+				f.Set(reflect.ValueOf(s))
+			}
+		}
+		return newHandler(cfg)
+	}
+}
+
+var (
+	storeType    = reflect.TypeFor[brisa.Store]()
+	durationType = reflect.TypeFor[time.Duration]()
+	timeType     = reflect.TypeFor[time.Time]()
+	locationType = reflect.TypeFor[*time.Location]()
+)
+
+// configEnums are the names of the enumerated settings in config maps.
+var configEnums = map[reflect.Type]map[string]int64{
+	reflect.TypeFor[AnomalyAction]():     {"flag": int64(AnomalyFlag), "quarantine": int64(AnomalyQuarantine), "reauth": int64(AnomalyReauth)},
+	reflect.TypeFor[DLPAction]():         {"notify": int64(DLPNotify), "quarantine": int64(DLPQuarantine), "reject": int64(DLPReject)},
+	reflect.TypeFor[DateSkewPolicy]():    {"ignore": int64(DateSkewIgnore), "flag": int64(DateSkewFlag), "normalize": int64(DateSkewNormalize)},
+	reflect.TypeFor[EarlyTalkerAction](): {"reject": int64(EarlyTalkerReject), "score": int64(EarlyTalkerScore)},
+	reflect.TypeFor[UnsubscribeAction](): {"reject": int64(UnsubscribeReject), "flag": int64(UnsubscribeFlag)},
+}
+
+// decodeConfig sets the fields of the struct dst points to from config. Keys
+// match field names ignoring case and underscores. Unknown keys and settings
+// of fields that cannot be configured are errors.
+func decodeConfig(config map[string]any, dst any) error {
+	return decodeValue("config", config, reflect.ValueOf(dst).Elem())
+}
+
+// decodeValue sets v from the config value raw; path names it in errors.
+func decodeValue(path string, raw any, v reflect.Value) error {
+	if raw == nil {
+		return nil
+	}
+	t := v.Type()
+	if names, ok := configEnums[t]; ok {
+		name, _ := raw.(string)
+		n, ok := names[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("%s: invalid value %v, expected one of %s", path, raw, enumNames(names))
+		}
+		v.SetInt(n)
+		return nil
+	}
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok && t != timeType {
+			s, ok := raw.(string)
+			if !ok {
+				return fmt.Errorf("%s: expected a string, got %T", path, raw)
+			}
+			if err := u.UnmarshalText([]byte(s)); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			return nil
+		}
+	}
+	switch t {
+	case durationType:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a duration such as \"10m\", got %v", path, raw)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetInt(int64(d))
+		return nil
+	case timeType:
+		if tm, ok := raw.(time.Time); ok {
+			v.Set(reflect.ValueOf(tm))
+			return nil
+		}
+		s, _ := raw.(string)
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			if tm, err = time.Parse(time.DateOnly, s); err != nil {
+				return fmt.Errorf("%s: expected an RFC 3339 time or a date, got %v", path, raw)
+			}
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	case locationType:
+		s, _ := raw.(string)
+		loc, err := time.LoadLocation(s)
+		if err != nil || s == "" {
+			return fmt.Errorf("%s: invalid location %v", path, raw)
+		}
+		v.Set(reflect.ValueOf(loc))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %T", path, raw)
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := raw.(bool)
+		if !ok {
+			return fmt.Errorf("%s: expected a boolean, got %T", path, raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, ok := configNumber(raw)
+		if !ok || f != math.Trunc(f) || v.OverflowInt(int64(f)) {
+			return fmt.Errorf("%s: expected an integer, got %v", path, raw)
+		}
+		v.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f, ok := configNumber(raw)
+		if !ok || f != math.Trunc(f) || f < 0 || v.OverflowUint(uint64(f)) {
+			return fmt.Errorf("%s: expected a non-negative integer, got %v", path, raw)
+		}
+		v.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		f, ok := configNumber(raw)
+		if !ok {
+			return fmt.Errorf("%s: expected a number, got %T", path, raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			s, ok := raw.(string)
+			if !ok {
+				return fmt.Errorf("%s: expected a string, got %T", path, raw)
+			}
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		items := reflect.ValueOf(raw)
+		if items.Kind() != reflect.Slice {
+			return fmt.Errorf("%s: expected a list, got %T", path, raw)
+		}
+		s := reflect.MakeSlice(t, items.Len(), items.Len())
+		for i := range items.Len() {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", path, i), items.Index(i).Interface(), s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		entries, ok := raw.(map[string]any)
+		if !ok || t.Key().Kind() != reflect.String {
+			return fmt.Errorf("%s: expected a map, got %T", path, raw)
+		}
+		m := reflect.MakeMapWithSize(t, len(entries))
+		for k, e := range entries {
+			ev := reflect.New(t.Elem()).Elem()
+			if err := decodeValue(path+"."+k, e, ev); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), ev)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		entries, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a map, got %T", path, raw)
+		}
+		keys := make([]string, 0, len(entries))
+		for k := range entries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f, ok := configField(v, k)
+			if !ok {
+				return fmt.Errorf("%s: unknown setting %q", path, k)
+			}
+			if err := decodeValue(path+"."+k, entries[k], f); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: cannot be configured", path)
+	}
+	return nil
+}
+
+// configField returns the exported field of the struct v matching key.
+func configField(v reflect.Value, key string) (reflect.Value, bool) {
+	key = strings.ToLower(strings.ReplaceAll(key, "_", ""))
+	for i := range v.NumField() {
+		if f := v.Type().Field(i); f.IsExported() && strings.ToLower(f.Name) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// configNumber returns the number of a config value, which depends on the
+// format the configuration was parsed from.
+func configNumber(raw any) (float64, bool) {
+	switch n := raw.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func enumNames(names map[string]int64) string {
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
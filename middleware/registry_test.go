@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	var cfg struct {
+		Name      string
+		Enabled   bool
+		MaxURLs   int
+		Threshold float64
+		Window    time.Duration
+		Secret    []byte
+		Since     time.Time
+		Domains   []string
+		Scores    map[string]float64
+		Action    DLPAction
+		Rules     []HeaderScrubRule
+	}
+	err := decodeConfig(map[string]any{
+		"name":      "test",
+		"enabled":   true,
+		"max_urls":  int64(5), // TOML
+		"threshold": 4,        // YAML
+		"window":    "10m",
+		"secret":    "key",
+		"since":     "2024-01-02",
+		"domains":   []any{"a.example", "b.example"},
+		"scores":    map[string]any{"x": 1.5},
+		"action":    "Quarantine",
+		"rules":     []any{map[string]any{"header": "X-Originating-IP", "oldest_only": true}},
+	}, &cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "test", cfg.Name)
+	assert.True(t, cfg.Enabled)
+	assert.Equal(t, 5, cfg.MaxURLs)
+	assert.Equal(t, 4.0, cfg.Threshold)
+	assert.Equal(t, 10*time.Minute, cfg.Window)
+	assert.Equal(t, []byte("key"), cfg.Secret)
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), cfg.Since)
+	assert.Equal(t, []string{"a.example", "b.example"}, cfg.Domains)
+	assert.Equal(t, map[string]float64{"x": 1.5}, cfg.Scores)
+	assert.Equal(t, DLPQuarantine, cfg.Action)
+	assert.Equal(t, []HeaderScrubRule{{Header: "X-Originating-IP", OldestOnly: true}}, cfg.Rules)
+
+	for _, config := range []map[string]any{
+		{"unknown": 1},
+		{"max_urls": 1.5},
+		{"max_urls": "5"},
+		{"window": 10},
+		{"action": "drop"},
+		{"domains": "a.example"},
+		{"notify": "x"},
+	} {
+		var cfg struct {
+			MaxURLs int
+			Window  time.Duration
+			Action  DLPAction
+			Domains []string
+			Notify  func()
+		}
+		assert.Error(t, decodeConfig(config, &cfg), "%v", config)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	registry := brisa.NewRegistry()
+	store := brisa.NewMemoryStore()
+	registry.SetStore(store)
+	Register(registry)
+
+	for name, config := range map[string]map[string]any{
+		"ip_blacklist": {"ips": []any{"192.0.2.1", "198.51.100.0/24"}},
+		"spam_tag":     {},
+		"dlp":          {"rules": []any{map[string]any{"name": "secret", "keywords": []any{"confidential"}}}, "action": "reject"},
+		"rate_limit":   {"limit": 10, "window": "1m"},
+		"header_scrub": {"rules": []any{map[string]any{"header": "X-Originating-*"}}},
+		"trace":        {"secret": "trace-key"},
+	} {
+		factory, ok := registry.Get(name)
+		require.True(t, ok, name)
+		_, err := factory(config)
+		assert.NoError(t, err, name)
+	}
+
+	// Settings are checked.
+	factory, _ := registry.Get("rate_limit")
+	_, err := factory(map[string]any{"limit": 10, "window": "1m", "burst": 5})
+	assert.Error(t, err)
+
+	_, err = registry.BuildAuthenticator(brisa.AuthConfig{Name: "oauth2", Config: map[string]any{
+		"issuer":   "https://idp.example.com",
+		"jwks_url": "https://idp.example.com/keys",
+		"scopes":   []any{"mail.send"},
+	}})
+	assert.NoError(t, err)
+}
+
+func TestRegister_Store(t *testing.T) {
+	registry := brisa.NewRegistry()
+	Register(registry)
+	factory, _ := registry.Get("rate_limit")
+
+	// Without a Store of the registry, the Store is required as in code.
+	_, err := factory(map[string]any{"limit": 10, "window": "1m"})
+	assert.Error(t, err)
+
+	registry.SetStore(brisa.NewMemoryStore())
+	_, err = factory(map[string]any{"limit": 10, "window": "1m"})
+	assert.NoError(t, err)
+}
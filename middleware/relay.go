@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+// ErrRelayDenied is returned for a recipient in a non-local domain from a
+// client that may not relay.
+var ErrRelayDenied = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Relay access denied",
+}
+
+// RelayControlConfig configures the RelayControl middleware.
+type RelayControlConfig struct {
+	// LocalDomains are the domains the server accepts mail for from anyone.
+	// It is required.
+	LocalDomains []string
+	// Networks are the IP addresses and CIDR blocks of clients that may
+	// relay, e.g. the internal network.
+	Networks []string
+	// AllowAuthenticated lets clients relay after a successful AUTH.
+	AllowAuthenticated bool
+	// AllowClientCert lets clients relay that presented a verified TLS client
+	// certificate; see brisa.TLSConfig.ClientCAFile.
+	AllowClientCert bool
+	// ClientCertNames, if set, restricts AllowClientCert to certificates with
+	// one of these names as common name or DNS name.
+	ClientCertNames []string
+}
+
+// RelayControl refuses to relay mail to non-local domains for clients that
+// are not allowed to, so that the server is not an open relay. It runs in the
+// RcptTo chain and refuses the recipient with ErrRelayDenied. Refused
+// attempts are logged as "relay access denied" with the client and envelope.
+type RelayControl struct {
+	cfg      RelayControlConfig
+	local    map[string]bool
+	networks []*net.IPNet
+	denied   atomic.Int64
+}
+
+// NewRelayControl creates a new RelayControl instance.
+func NewRelayControl(cfg RelayControlConfig) (*RelayControl, error) {
+	if len(cfg.LocalDomains) == 0 {
+		return nil, fmt.Errorf("relay control requires local domains")
+	}
+	rc := &RelayControl{cfg: cfg, local: make(map[string]bool, len(cfg.LocalDomains))}
+	for _, d := range cfg.LocalDomains {
+		rc.local[address.NormalizeDomain(d)] = true
+	}
+	networks, err := parseNetworks(cfg.Networks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay network: %w", err)
+	}
+	rc.networks = networks
+	return rc, nil
+}
+
+// parseNetworks parses IP addresses and CIDR blocks; an address is a block of
+// one address.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			if ip := net.ParseIP(n); ip != nil && ip.To4() != nil {
+				n += "/32"
+			} else {
+				n += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, errors.New(n)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// NewRelayControlHandler creates a new RcptTo middleware handler refusing
+// unauthorized relaying.
+func NewRelayControlHandler(cfg RelayControlConfig) (brisa.Handler, error) {
+	rc, err := NewRelayControl(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It checks the recipient
+// added by the current RCPT TO command.
+func (rc *RelayControl) Handle(ctx *brisa.Context) brisa.Action {
+	if len(ctx.To) == 0 {
+		return brisa.Pass
+	}
+	rcpt := ctx.To[len(ctx.To)-1]
+	if rc.local[address.NormalizeDomain(address.Domain(rcpt))] {
+		return brisa.Pass
+	}
+	if reason := rc.relayAllowed(ctx); reason != "" {
+		ctx.Logger.Debug("relaying allowed", "rcpt", rcpt, "reason", reason)
+		return brisa.Pass
+	}
+
+	rc.denied.Add(1)
+	attrs := []any{"rcpt", rcpt, "from", ctx.From, "authenticated", ctx.HasFlag(brisa.FlagAuthenticated)}
+	if ip := clientIP(ctx); ip != nil {
+		attrs = append(attrs, "ip", ip.String())
+	}
+	ctx.Logger.Warn("relay access denied", attrs...)
+	return ctx.RejectWith(ErrRelayDenied)
+}
+
+// relayAllowed returns why the client may relay, or "" if it may not.
+func (rc *RelayControl) relayAllowed(ctx *brisa.Context) string {
+	if ip := clientIP(ctx); ip != nil {
+		for _, n := range rc.networks {
+			if n.Contains(ip) {
+				return "network"
+			}
+		}
+	}
+	if rc.cfg.AllowAuthenticated && ctx.HasFlag(brisa.FlagAuthenticated) {
+		return "authenticated"
+	}
+	if rc.cfg.AllowClientCert && ctx.Session != nil {
+		if cert := ctx.Session.ClientCertificate(); cert != nil {
+			if len(rc.cfg.ClientCertNames) == 0 ||
+				slices.Contains(rc.cfg.ClientCertNames, cert.Subject.CommonName) ||
+				slices.ContainsFunc(cert.DNSNames, func(name string) bool { return slices.Contains(rc.cfg.ClientCertNames, name) }) {
+				return "client_certificate"
+			}
+		}
+	}
+	return ""
+}
+
+// Denied returns the number of recipients refused so far.
+func (rc *RelayControl) Denied() int64 {
+	return rc.denied.Load()
+}
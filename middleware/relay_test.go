@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelayControl(t *testing.T) {
+	_, err := NewRelayControl(RelayControlConfig{})
+	require.Error(t, err)
+	_, err = NewRelayControl(RelayControlConfig{LocalDomains: []string{"example.com"}, Networks: []string{"10.0.0.0/33"}})
+	require.Error(t, err)
+}
+
+func TestRelayControl(t *testing.T) {
+	rc, err := NewRelayControl(RelayControlConfig{
+		LocalDomains:       []string{"Example.com", "bücher.example"},
+		Networks:           []string{"10.0.0.0/8", "2001:db8::1"},
+		AllowAuthenticated: true,
+		AllowClientCert:    true,
+		ClientCertNames:    []string{"relay.partner.example"},
+	})
+	require.NoError(t, err)
+	router := brisa.Router{}
+	router.OnRcptTo(&brisa.Middleware{Handler: rc.Handle})
+	b := brisa.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+	b.SetAuthenticator(brisa.AuthenticatorFunc(func(ctx *brisa.Context, username, password string) error {
+		return nil
+	}))
+
+	partner, _ := newTestCertificate(t, "relay.partner.example")
+	other, _ := newTestCertificate(t, "other.example")
+	tests := []struct {
+		name  string
+		setup func(env *brisa.Envelope)
+		relay bool
+	}{
+		{"outside", func(env *brisa.Envelope) {}, false},
+		{"network", func(env *brisa.Envelope) { env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("10.1.2.3")} }, true},
+		{"ipv6 host", func(env *brisa.Envelope) { env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("2001:db8::1")} }, true},
+		{"authenticated", func(env *brisa.Envelope) { env.Username, env.Password = "alice", "secret" }, true},
+		{"client certificate", func(env *brisa.Envelope) { env.ClientCert = partner }, true},
+		{"unknown certificate", func(env *brisa.Envelope) { env.ClientCert = other }, false},
+	}
+	for _, tt := range tests {
+		env := brisatest.DefaultEnvelope()
+		env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("203.0.113.9")}
+		env.To = []string{"bob@EXAMPLE.com", "dave@xn--bcher-kva.example", "carol@elsewhere.example"}
+		tt.setup(&env)
+		res := b.Simulate(env, strings.NewReader("\r\n"))
+		assert.NoError(t, res.Err, tt.name)
+		if tt.relay {
+			assert.Empty(t, res.RcptErrors, tt.name)
+		} else {
+			assert.Equal(t, map[string]error{"carol@elsewhere.example": ErrRelayDenied}, res.RcptErrors, tt.name)
+		}
+	}
+	assert.Equal(t, int64(2), rc.Denied())
+}
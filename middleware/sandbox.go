@@ -0,0 +1,464 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultSandboxWaitTimeout is the default time a message waits for verdicts.
+	DefaultSandboxWaitTimeout = 30 * time.Second
+	// MaxSandboxWaitTimeout is the longest wait allowed. The DATA reply is held
+	// for the whole wait, so it stays well below both the 10 minute DATA reply
+	// timeout of RFC 5321 and the shorter timeouts of many clients; slower
+	// analyses finish while the message is deferred with ErrSandboxPending.
+	MaxSandboxWaitTimeout = time.Minute
+	// DefaultSandboxTaskTTL is the default time a submitted task is remembered
+	// for the retries of a deferred message.
+	DefaultSandboxTaskTTL = time.Hour
+	// DefaultSandboxPollInterval is the default interval between result polls.
+	DefaultSandboxPollInterval = 5 * time.Second
+	// DefaultSandboxMaxBytes is the default number of message bytes inspected.
+	DefaultSandboxMaxBytes = 25 * 1024 * 1024
+)
+
+// DefaultSandboxExtensions are the attachment extensions submitted by default:
+// executables, scripts, macro-enabled documents and containers often used to
+// smuggle them.
+var DefaultSandboxExtensions = []string{
+	".exe", ".dll", ".scr", ".com", ".msi", ".bat", ".cmd", ".ps1", ".vbs", ".js", ".jse", ".wsf", ".hta", ".lnk",
+	".docm", ".xlsm", ".pptm", ".doc", ".xls", ".rtf", ".pdf",
+	".zip", ".rar", ".7z", ".iso", ".img",
+}
+
+// SandboxVerdictsKey is the context key holding the verdicts
+// (map[string]SandboxVerdict) of the submitted attachments, by the hex
+// SHA-256 of their content, so attachments sharing a file name are kept apart.
+const SandboxVerdictsKey = "sandbox.verdicts"
+
+var (
+	// ErrSandboxMalicious is returned for a message with an attachment the
+	// sandbox found malicious.
+	ErrSandboxMalicious = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message contains a malicious attachment",
+	}
+	// ErrSandboxPending is returned when the verdict is not ready in time and the
+	// timeout policy defers the message. The sending server holds the message in
+	// its queue and retries; by then the verdict is usually known.
+	ErrSandboxPending = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Attachment analysis in progress, please try again later",
+	}
+)
+
+// SandboxVerdict is the result of a sandbox analysis.
+type SandboxVerdict int
+
+const (
+	// SandboxUnknown means the sandbox has never seen the file.
+	SandboxUnknown SandboxVerdict = iota
+	// SandboxPending means the analysis has not finished yet.
+	SandboxPending
+	SandboxClean
+	SandboxMalicious
+)
+
+func (v SandboxVerdict) String() string {
+	switch v {
+	case SandboxPending:
+		return "pending"
+	case SandboxClean:
+		return "clean"
+	case SandboxMalicious:
+		return "malicious"
+	default:
+		return "unknown"
+	}
+}
+
+// Sandbox is an external file analysis service.
+type Sandbox interface {
+	// Lookup returns the verdict of a previously analysed file by its SHA-256
+	// hash, or SandboxUnknown.
+	Lookup(ctx context.Context, sha256 string) (SandboxVerdict, error)
+	// Submit uploads a file for analysis and returns the task ID.
+	Submit(ctx context.Context, filename string, data []byte) (taskID string, err error)
+	// Result returns the verdict of a submitted task, or SandboxPending.
+	Result(ctx context.Context, taskID string) (SandboxVerdict, error)
+}
+
+// SandboxTimeoutPolicy defines what happens to a message whose verdicts are not
+// ready within the wait timeout, or could not be obtained.
+type SandboxTimeoutPolicy int
+
+const (
+	// SandboxDefer temporarily rejects the message with ErrSandboxPending.
+	SandboxDefer SandboxTimeoutPolicy = iota
+	// SandboxQuarantine quarantines the message.
+	SandboxQuarantine
+	// SandboxAccept lets the message through.
+	SandboxAccept
+)
+
+// SandboxConfig configures the SandboxScanner middleware.
+type SandboxConfig struct {
+	Sandbox Sandbox
+	// Extensions are the attachment file extensions submitted for analysis.
+	// Defaults to DefaultSandboxExtensions.
+	Extensions []string
+	// WaitTimeout bounds the time spent waiting for verdicts per message.
+	// Defaults to DefaultSandboxWaitTimeout and may not exceed
+	// MaxSandboxWaitTimeout.
+	WaitTimeout time.Duration
+	// TaskTTL is the time a task whose verdict is not known yet is kept for
+	// the retries of the message; tasks older than that are forgotten and
+	// their files submitted again. Defaults to DefaultSandboxTaskTTL.
+	TaskTTL time.Duration
+	// PollInterval is the interval between result polls. Defaults to DefaultSandboxPollInterval.
+	PollInterval time.Duration
+	// TimeoutPolicy applies when verdicts are missing. Defaults to SandboxDefer.
+	TimeoutPolicy SandboxTimeoutPolicy
+	// MaxBytes is the number of leading message bytes inspected.
+	// Defaults to DefaultSandboxMaxBytes.
+	MaxBytes int64
+	// Clock defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// SandboxScanner submits suspicious attachments to an external analysis
+// sandbox. Known files are looked up by hash first; unknown files are uploaded
+// and the message waits for the verdict.
+//
+// Tasks are remembered by hash for TaskTTL, so a message deferred with
+// ErrSandboxPending does not upload its attachments again when the sender
+// retries.
+type SandboxScanner struct {
+	cfg        SandboxConfig
+	extensions map[string]struct{}
+
+	mu    sync.Mutex
+	tasks map[string]sandboxTask // SHA-256 -> pending analysis
+}
+
+type sandboxTask struct {
+	id        string
+	submitted time.Time
+}
+
+// NewSandboxScanner creates a new SandboxScanner instance.
+func NewSandboxScanner(cfg SandboxConfig) (*SandboxScanner, error) {
+	if cfg.Sandbox == nil {
+		return nil, fmt.Errorf("sandbox scanner needs a sandbox")
+	}
+	if len(cfg.Extensions) == 0 {
+		cfg.Extensions = DefaultSandboxExtensions
+	}
+	if cfg.WaitTimeout <= 0 {
+		cfg.WaitTimeout = DefaultSandboxWaitTimeout
+	}
+	if cfg.WaitTimeout > MaxSandboxWaitTimeout {
+		return nil, fmt.Errorf("sandbox wait timeout %s exceeds %s", cfg.WaitTimeout, MaxSandboxWaitTimeout)
+	}
+	if cfg.TaskTTL <= 0 {
+		cfg.TaskTTL = DefaultSandboxTaskTTL
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultSandboxPollInterval
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultSandboxMaxBytes
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+
+	s := &SandboxScanner{
+		cfg:        cfg,
+		extensions: make(map[string]struct{}),
+		tasks:      make(map[string]sandboxTask),
+	}
+	for _, ext := range cfg.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		s.extensions[ext] = struct{}{}
+	}
+	return s, nil
+}
+
+// NewSandboxScannerHandler creates a new Data middleware handler submitting
+// attachments to a sandbox.
+func NewSandboxScannerHandler(cfg SandboxConfig) (brisa.Handler, error) {
+	s, err := NewSandboxScanner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handle, nil
+}
+
+type sandboxFile struct {
+	name string
+	hash string
+	data []byte
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (s *SandboxScanner) Handle(ctx *brisa.Context) brisa.Action {
+	data, err := readMessagePrefix(ctx, s.cfg.MaxBytes)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return brisa.Pass
+	}
+
+	var files []sandboxFile
+	seen := make(map[string]struct{})
+	walkParts(data, func(p *messagePart) error {
+		if _, ok := s.extensions[strings.ToLower(path.Ext(p.Filename))]; !ok {
+			return nil
+		}
+		sum := sha256.Sum256(p.Body)
+		hash := hex.EncodeToString(sum[:])
+		if _, ok := seen[hash]; !ok {
+			seen[hash] = struct{}{}
+			files = append(files, sandboxFile{name: p.Filename, hash: hash, data: p.Body})
+		}
+		return nil
+	})
+	if len(files) == 0 {
+		return brisa.Pass
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), s.cfg.WaitTimeout)
+	defer cancel()
+
+	verdicts := make(map[string]SandboxVerdict, len(files))
+	complete := true
+	for _, f := range files {
+		v, err := s.verdict(waitCtx, f)
+		if err != nil {
+			ctx.Logger.Error("sandbox analysis failed", "file", f.name, "sha256", f.hash, "error", err)
+		}
+		verdicts[f.hash] = v
+		if v == SandboxMalicious {
+			ctx.Set(SandboxVerdictsKey, verdicts)
+			ctx.Logger.Warn("malicious attachment", "file", f.name, "sha256", f.hash)
+			return ctx.RejectWith(ErrSandboxMalicious)
+		}
+		if v != SandboxClean {
+			complete = false
+		}
+	}
+	ctx.Set(SandboxVerdictsKey, verdicts)
+	if complete {
+		return brisa.Pass
+	}
+
+	ctx.Logger.Info("sandbox verdicts incomplete, applying timeout policy", "verdicts", verdicts)
+	switch s.cfg.TimeoutPolicy {
+	case SandboxQuarantine:
+		return brisa.Quarantine
+	case SandboxAccept:
+		return brisa.Pass
+	default:
+		return ctx.RejectWith(ErrSandboxPending)
+	}
+}
+
+// verdict looks up a file by hash, submits it if unknown and polls for the
+// result until it is ready or ctx is done.
+func (s *SandboxScanner) verdict(ctx context.Context, f sandboxFile) (SandboxVerdict, error) {
+	s.mu.Lock()
+	task, pending := s.tasks[f.hash]
+	s.mu.Unlock()
+	pending = pending && s.cfg.Clock.Now().Sub(task.submitted) <= s.cfg.TaskTTL
+
+	if !pending {
+		v, err := s.cfg.Sandbox.Lookup(ctx, f.hash)
+		if err != nil || v != SandboxUnknown {
+			return v, err
+		}
+		id, err := s.cfg.Sandbox.Submit(ctx, f.name, f.data)
+		if err != nil {
+			return SandboxUnknown, err
+		}
+		task = sandboxTask{id: id, submitted: s.cfg.Clock.Now()}
+		s.addTask(f.hash, task)
+	}
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		v, err := s.cfg.Sandbox.Result(ctx, task.id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return SandboxPending, nil
+			}
+			// The sandbox may have dropped the task: submit again next time.
+			s.removeTask(f.hash)
+			return SandboxPending, err
+		}
+		if v != SandboxPending {
+			s.removeTask(f.hash)
+			return v, nil
+		}
+		select {
+		case <-ctx.Done():
+			return SandboxPending, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// addTask remembers a pending task, forgetting the tasks older than TaskTTL
+// whose messages were never retried.
+func (s *SandboxScanner) addTask(hash string, task sandboxTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, t := range s.tasks {
+		if task.submitted.Sub(t.submitted) > s.cfg.TaskTTL {
+			delete(s.tasks, h)
+		}
+	}
+	s.tasks[hash] = task
+}
+
+func (s *SandboxScanner) removeTask(hash string) {
+	s.mu.Lock()
+	delete(s.tasks, hash)
+	s.mu.Unlock()
+}
+
+// HTTPSandbox is a client for sandboxes exposing a simple JSON API:
+//
+//	GET  <BaseURL>/files/<sha256>  -> {"verdict": "clean"}, or 404 if unknown
+//	POST <BaseURL>/tasks           -> {"task_id": "..."}, file in the "file" form field
+//	GET  <BaseURL>/tasks/<id>      -> {"verdict": "pending"}
+//
+// Verdicts are "pending", "clean" or "malicious". Vendor APIs with a different
+// shape implement Sandbox directly.
+type HTTPSandbox struct {
+	BaseURL string
+	// APIKey, if set, is sent as a bearer token.
+	APIKey string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type sandboxResponse struct {
+	Verdict string `json:"verdict"`
+	TaskID  string `json:"task_id"`
+}
+
+// Lookup implements Sandbox.
+func (c *HTTPSandbox) Lookup(ctx context.Context, sha256 string) (SandboxVerdict, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/files/"+url.PathEscape(sha256), "", nil)
+	if errors.Is(err, errSandboxNotFound) {
+		return SandboxUnknown, nil
+	}
+	if err != nil {
+		return SandboxUnknown, err
+	}
+	return parseSandboxVerdict(resp.Verdict)
+}
+
+// Submit implements Sandbox.
+func (c *HTTPSandbox) Submit(ctx context.Context, filename string, data []byte) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/tasks", mw.FormDataContentType(), &body)
+	if err != nil {
+		return "", err
+	}
+	if resp.TaskID == "" {
+		return "", fmt.Errorf("sandbox returned no task id")
+	}
+	return resp.TaskID, nil
+}
+
+// Result implements Sandbox.
+func (c *HTTPSandbox) Result(ctx context.Context, taskID string) (SandboxVerdict, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/tasks/"+url.PathEscape(taskID), "", nil)
+	if err != nil {
+		return SandboxPending, err
+	}
+	return parseSandboxVerdict(resp.Verdict)
+}
+
+var errSandboxNotFound = errors.New("not found")
+
+func (c *HTTPSandbox) do(ctx context.Context, method, p, contentType string, body io.Reader) (*sandboxResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.BaseURL, "/")+p, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errSandboxNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("sandbox %s %s: %s", method, p, resp.Status)
+	}
+	var r sandboxResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("invalid sandbox response: %w", err)
+	}
+	return &r, nil
+}
+
+func parseSandboxVerdict(s string) (SandboxVerdict, error) {
+	switch strings.ToLower(s) {
+	case "pending":
+		return SandboxPending, nil
+	case "clean":
+		return SandboxClean, nil
+	case "malicious":
+		return SandboxMalicious, nil
+	default:
+		return SandboxUnknown, fmt.Errorf("invalid sandbox verdict: %s", s)
+	}
+}
@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSandboxServer implements the HTTPSandbox API. Uploaded files become
+// malicious if they contain "EVIL" and clean otherwise; results stay pending
+// for the next polls requests.
+type fakeSandboxServer struct {
+	mu       sync.Mutex
+	verdicts map[string]string // sha256 -> verdict
+	tasks    map[string]string // task ID -> "sha256:verdict"
+	polls    int
+	uploads  int
+}
+
+func (s *fakeSandboxServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/files/"):
+		v, ok := s.verdicts[strings.TrimPrefix(r.URL.Path, "/files/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"verdict":%q}`, v)
+	case r.Method == http.MethodPost && r.URL.Path == "/tasks":
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		verdict := "clean"
+		if strings.Contains(string(data), "EVIL") {
+			verdict = "malicious"
+		}
+		s.uploads++
+		id := fmt.Sprintf("task-%d", s.uploads)
+		s.tasks[id] = hash + ":" + verdict
+		fmt.Fprintf(w, `{"task_id":%q}`, id)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/tasks/"):
+		task, ok := s.tasks[strings.TrimPrefix(r.URL.Path, "/tasks/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if s.polls > 0 {
+			s.polls--
+			fmt.Fprint(w, `{"verdict":"pending"}`)
+			return
+		}
+		hash, verdict, _ := strings.Cut(task, ":")
+		s.verdicts[hash] = verdict
+		fmt.Fprintf(w, `{"verdict":%q}`, verdict)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// setPolls makes the next n result polls return pending. Polls of an earlier
+// message that timed out may still be served concurrently.
+func (s *fakeSandboxServer) setPolls(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polls = n
+}
+
+func (s *fakeSandboxServer) uploadCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads
+}
+
+func sandboxTestMessage(filename, content string) string {
+	return "Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"invoice attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=" + filename + "\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(content)) + "\r\n" +
+		"--b--\r\n"
+}
+
+func sandboxTestHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestSandboxScanner(t *testing.T, server *fakeSandboxServer, cfg SandboxConfig) *SandboxScanner {
+	t.Helper()
+	server.verdicts = make(map[string]string)
+	server.tasks = make(map[string]string)
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	cfg.Sandbox = &HTTPSandbox{BaseURL: ts.URL}
+	cfg.PollInterval = time.Millisecond
+	s, err := NewSandboxScanner(cfg)
+	require.NoError(t, err)
+	return s
+}
+
+func TestNewSandboxScanner(t *testing.T) {
+	_, err := NewSandboxScanner(SandboxConfig{})
+	require.Error(t, err)
+
+	// The DATA reply waits for the verdicts: long waits are refused.
+	_, err = NewSandboxScanner(SandboxConfig{Sandbox: &HTTPSandbox{}, WaitTimeout: 5 * time.Minute})
+	require.Error(t, err)
+}
+
+func TestSandboxScanner_Handle(t *testing.T) {
+	server := &fakeSandboxServer{}
+	s := newTestSandboxScanner(t, server, SandboxConfig{})
+
+	message := sandboxTestMessage("invoice.exe", "MZ harmless")
+	ctx := newTestContext(t, message)
+	assert.Equal(t, brisa.Pass, s.Handle(ctx))
+	verdicts, _ := ctx.Get(SandboxVerdictsKey)
+	assert.Equal(t, map[string]SandboxVerdict{sandboxTestHash("MZ harmless"): SandboxClean}, verdicts)
+	assert.Equal(t, message, readTestMessage(t, ctx))
+	assert.Equal(t, 1, server.uploadCount())
+
+	// The verdict is now known by hash: no second upload.
+	assert.Equal(t, brisa.Pass, s.Handle(newTestContext(t, message)))
+	assert.Equal(t, 1, server.uploadCount())
+
+	ctx = newTestContext(t, sandboxTestMessage("invoice.exe", "MZ EVIL"))
+	assert.Equal(t, brisa.Reject, s.Handle(ctx))
+	assert.Equal(t, ErrSandboxMalicious, ctx.RejectError())
+
+	// Attachments sharing a file name get a verdict each.
+	message = "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Disposition: attachment; filename=scan.pdf\r\n\r\nfirst\r\n" +
+		"--b\r\nContent-Disposition: attachment; filename=scan.pdf\r\n\r\nsecond\r\n" +
+		"--b--\r\n"
+	ctx = newTestContext(t, message)
+	assert.Equal(t, brisa.Pass, s.Handle(ctx))
+	verdicts, _ = ctx.Get(SandboxVerdictsKey)
+	assert.Equal(t, map[string]SandboxVerdict{sandboxTestHash("first"): SandboxClean, sandboxTestHash("second"): SandboxClean}, verdicts)
+
+	// Attachments with other extensions are not submitted.
+	assert.Equal(t, brisa.Pass, s.Handle(newTestContext(t, sandboxTestMessage("notes.txt", "EVIL"))))
+	assert.Equal(t, 4, server.uploadCount())
+}
+
+func TestSandboxScanner_TimeoutPolicy(t *testing.T) {
+	server := &fakeSandboxServer{}
+	s := newTestSandboxScanner(t, server, SandboxConfig{WaitTimeout: 20 * time.Millisecond})
+
+	server.setPolls(1 << 30)
+	message := sandboxTestMessage("macro.docm", "EVIL")
+	ctx := newTestContext(t, message)
+	assert.Equal(t, brisa.Reject, s.Handle(ctx))
+	assert.Equal(t, ErrSandboxPending, ctx.RejectError())
+	assert.Equal(t, 1, server.uploadCount())
+
+	// The sender retries after the analysis finished: the pending task is
+	// reused instead of uploading the file again.
+	server.setPolls(0)
+	ctx = newTestContext(t, message)
+	assert.Equal(t, brisa.Reject, s.Handle(ctx))
+	assert.Equal(t, ErrSandboxMalicious, ctx.RejectError())
+	assert.Equal(t, 1, server.uploadCount())
+
+	server = &fakeSandboxServer{polls: 1 << 30}
+	s = newTestSandboxScanner(t, server, SandboxConfig{WaitTimeout: 20 * time.Millisecond, TimeoutPolicy: SandboxQuarantine})
+	assert.Equal(t, brisa.Quarantine, s.Handle(newTestContext(t, message)))
+}
+
+func TestSandboxScanner_TaskTTL(t *testing.T) {
+	server := &fakeSandboxServer{polls: 1 << 30}
+	clock := brisatest.NewFakeClock(time.Now())
+	s := newTestSandboxScanner(t, server, SandboxConfig{WaitTimeout: 20 * time.Millisecond, TaskTTL: time.Hour, Clock: clock})
+
+	message := sandboxTestMessage("macro.docm", "EVIL")
+	assert.Equal(t, brisa.Reject, s.Handle(newTestContext(t, message)))
+	other := sandboxTestMessage("tool.exe", "MZ")
+	assert.Equal(t, brisa.Reject, s.Handle(newTestContext(t, other)))
+	require.Len(t, s.tasks, 2)
+
+	// Tasks of messages never retried are forgotten after the TTL, and a
+	// late retry submits the file again.
+	clock.Advance(2 * time.Hour)
+	assert.Equal(t, brisa.Reject, s.Handle(newTestContext(t, message)))
+	assert.Equal(t, 3, server.uploadCount())
+	s.mu.Lock()
+	assert.Len(t, s.tasks, 1)
+	s.mu.Unlock()
+}
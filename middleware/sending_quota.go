@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// DefaultSendingQuotaKeyPrefix is the default prefix of the Store keys written
+// by SendingQuota.
+const DefaultSendingQuotaKeyPrefix = "sendquota:"
+
+var (
+	// ErrSendingQuotaExceeded is returned for MAIL FROM of a user who has sent
+	// too many messages. It is temporary, as the quota window passes.
+	ErrSendingQuotaExceeded = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Sending quota exceeded, please try again later",
+	}
+	// ErrRecipientQuotaExceeded is returned for RCPT TO of a user who has sent
+	// to too many recipients.
+	ErrRecipientQuotaExceeded = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Recipient quota exceeded, please try again later",
+	}
+)
+
+// SendingLimits are the numbers of messages and recipients a user may send
+// per hour and per day. Zero means no limit.
+type SendingLimits struct {
+	MessagesPerHour   int64
+	MessagesPerDay    int64
+	RecipientsPerHour int64
+	RecipientsPerDay  int64
+}
+
+// SendingQuotaConfig configures the SendingQuota middleware.
+type SendingQuotaConfig struct {
+	// Store holds the counters. It is required; a shared Store enforces the
+	// quotas across instances.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultSendingQuotaKeyPrefix.
+	KeyPrefix string
+	// Limits apply to all users not in Users.
+	Limits SendingLimits
+	// Users overrides Limits for some users, by user name ignoring case.
+	Users map[string]SendingLimits
+}
+
+// SendingQuota limits what authenticated users send, to contain compromised
+// accounts on submission: HandleMailFrom, in the mail_from chain, counts the
+// messages of the user and HandleRcptTo, in the rcpt_to chain, the
+// recipients, per hour and per day. Clients that have not authenticated are
+// not limited.
+type SendingQuota struct {
+	cfg   SendingQuotaConfig
+	users map[string]SendingLimits
+}
+
+// NewSendingQuota creates a new SendingQuota instance.
+func NewSendingQuota(cfg SendingQuotaConfig) (*SendingQuota, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("sending quota store is required")
+	}
+	if err := cfg.Limits.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultSendingQuotaKeyPrefix
+	}
+	users := make(map[string]SendingLimits, len(cfg.Users))
+	for user, limits := range cfg.Users {
+		if err := limits.validate(); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user, err)
+		}
+		users[strings.ToLower(user)] = limits
+	}
+	return &SendingQuota{cfg: cfg, users: users}, nil
+}
+
+func (l SendingLimits) validate() error {
+	if l.MessagesPerHour < 0 || l.MessagesPerDay < 0 || l.RecipientsPerHour < 0 || l.RecipientsPerDay < 0 {
+		return fmt.Errorf("sending limits must not be negative")
+	}
+	return nil
+}
+
+// quotaWindow is a counted window with its limit.
+type quotaWindow struct {
+	name   string
+	window time.Duration
+	limit  int64
+}
+
+// HandleMailFrom is the brisa.Handler of the middleware for the mail_from
+// chain.
+func (q *SendingQuota) HandleMailFrom(ctx *brisa.Context) brisa.Action {
+	user, limits, ok := q.user(ctx)
+	if !ok {
+		return ctx.Action
+	}
+	if !q.count(ctx, "msg", user, []quotaWindow{
+		{"hour", time.Hour, limits.MessagesPerHour},
+		{"day", 24 * time.Hour, limits.MessagesPerDay},
+	}) {
+		return ctx.RejectWith(ErrSendingQuotaExceeded)
+	}
+	return ctx.Action
+}
+
+// HandleRcptTo is the brisa.Handler of the middleware for the rcpt_to chain.
+// Refused recipients are not counted.
+func (q *SendingQuota) HandleRcptTo(ctx *brisa.Context) brisa.Action {
+	user, limits, ok := q.user(ctx)
+	if !ok {
+		return ctx.Action
+	}
+	if !q.count(ctx, "rcpt", user, []quotaWindow{
+		{"hour", time.Hour, limits.RecipientsPerHour},
+		{"day", 24 * time.Hour, limits.RecipientsPerDay},
+	}) {
+		return ctx.RejectWith(ErrRecipientQuotaExceeded)
+	}
+	return ctx.Action
+}
+
+// user returns the authenticated user of the session and their limits.
+func (q *SendingQuota) user(ctx *brisa.Context) (string, SendingLimits, bool) {
+	if !ctx.HasFlag(brisa.FlagAuthenticated) || ctx.Auth().Username == "" {
+		return "", SendingLimits{}, false
+	}
+	user := strings.ToLower(ctx.Auth().Username)
+	limits, ok := q.users[user]
+	if !ok {
+		limits = q.cfg.Limits
+	}
+	return user, limits, true
+}
+
+// count adds one to the counters of user in the limited windows and reports
+// whether all are within their limit. If one is exceeded, the counts are
+// taken back, so that refused commands do not use up the quota.
+func (q *SendingQuota) count(ctx *brisa.Context, kind, user string, windows []quotaWindow) bool {
+	type counter struct {
+		key    string
+		window time.Duration
+	}
+	var counted []counter
+	within := true
+	for _, w := range windows {
+		if w.limit == 0 {
+			continue
+		}
+		key := q.cfg.KeyPrefix + kind + ":" + w.name + ":" + user
+		n, err := q.cfg.Store.Incr(key, 1, w.window)
+		if err != nil {
+			// Fail open: a broken Store must not stop submission.
+			ctx.Logger.Error("failed to count sending quota", "user", user, "error", err)
+			continue
+		}
+		counted = append(counted, counter{key, w.window})
+		if n > w.limit {
+			ctx.Logger.Warn("sending quota exceeded", "user", user, "quota", kind+"/"+w.name, "count", n, "limit", w.limit)
+			within = false
+		}
+	}
+	if !within {
+		for _, c := range counted {
+			if _, err := q.cfg.Store.Incr(c.key, -1, c.window); err != nil {
+				ctx.Logger.Error("failed to correct sending quota", "user", user, "error", err)
+			}
+		}
+	}
+	return within
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSendingQuotaBrisa(t *testing.T, cfg SendingQuotaConfig) *brisa.Brisa {
+	t.Helper()
+	q, err := NewSendingQuota(cfg)
+	require.NoError(t, err)
+	router := brisa.Router{}
+	router.OnMailFrom(&brisa.Middleware{Handler: q.HandleMailFrom})
+	router.OnRcptTo(&brisa.Middleware{Handler: q.HandleRcptTo})
+	return brisatest.NewBrisa(&router)
+}
+
+func TestNewSendingQuota(t *testing.T) {
+	_, err := NewSendingQuota(SendingQuotaConfig{})
+	require.Error(t, err)
+	store := brisa.NewMemoryStore()
+	_, err = NewSendingQuota(SendingQuotaConfig{Store: store, Limits: SendingLimits{MessagesPerHour: -1}})
+	require.Error(t, err)
+	_, err = NewSendingQuota(SendingQuotaConfig{Store: store, Users: map[string]SendingLimits{"alice": {RecipientsPerDay: -1}}})
+	require.Error(t, err)
+}
+
+func TestSendingQuota_Messages(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Now())
+	store := brisa.NewMemoryStoreWithClock(clock)
+	b := newSendingQuotaBrisa(t, SendingQuotaConfig{
+		Store:  store,
+		Limits: SendingLimits{MessagesPerHour: 2, MessagesPerDay: 3},
+		Users:  map[string]SendingLimits{"Bulk@example.com": {}},
+	})
+
+	send := func(user string) error {
+		return b.Simulate(brisatest.AuthEnvelope(user, "bob@example.com"), strings.NewReader("\r\n")).Err
+	}
+	assert.NoError(t, send("alice"))
+	assert.NoError(t, send("ALICE"))
+	assert.Equal(t, ErrSendingQuotaExceeded, send("alice"))
+	// Other users have their own quota, or none.
+	assert.NoError(t, send("carol"))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, send("bulk@example.com"))
+	}
+
+	// The refused message did not count: one more fits the day.
+	clock.Advance(time.Hour)
+	assert.NoError(t, send("alice"))
+	assert.Equal(t, ErrSendingQuotaExceeded, send("alice"))
+
+	clock.Advance(24 * time.Hour)
+	assert.NoError(t, send("alice"))
+
+	// Clients that have not authenticated are not limited.
+	env := brisatest.AuthEnvelope("", "bob@example.com")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, b.Simulate(env, strings.NewReader("\r\n")).Err)
+	}
+}
+
+func TestSendingQuota_Recipients(t *testing.T) {
+	b := newSendingQuotaBrisa(t, SendingQuotaConfig{
+		Store:  brisa.NewMemoryStore(),
+		Limits: SendingLimits{RecipientsPerHour: 3},
+	})
+
+	res := b.Simulate(brisatest.AuthEnvelope("alice", "a@example.com", "b@example.com"), strings.NewReader("\r\n"))
+	assert.NoError(t, res.Err)
+	res = b.Simulate(brisatest.AuthEnvelope("alice", "c@example.com", "d@example.com", "e@example.com"), strings.NewReader("\r\n"))
+	assert.NoError(t, res.Err)
+	assert.Equal(t, ErrRecipientQuotaExceeded, res.RcptErrors["d@example.com"])
+	assert.Equal(t, ErrRecipientQuotaExceeded, res.RcptErrors["e@example.com"])
+	assert.NotContains(t, res.RcptErrors, "c@example.com")
+}
@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CertificateSource returns the encryption certificate of a recipient, or nil
+// if none is known; see DirCertificateSource and LDAPCertificateSource.
+type CertificateSource func(rcpt string) (*x509.Certificate, error)
+
+// DirCertificateSource returns a CertificateSource reading PEM certificates from
+// dir, one file per recipient named "<address>.pem" in lower case.
+func DirCertificateSource(dir string) CertificateSource {
+	return func(rcpt string) (*x509.Certificate, error) {
+		name := strings.ToLower(rcpt)
+		if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+			return nil, nil
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name+".pem"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("no PEM certificate in %s", name+".pem")
+		}
+		return x509.ParseCertificate(block.Bytes)
+	}
+}
+
+// writeSMIME writes the message of header h and body, of size bytes, to w
+// as an S/MIME enveloped-data message for certs: the Content-* fields and
+// the body are encrypted into a CMS structure with AES-256-CBC content
+// encryption and RSA key transport.
+func writeSMIME(w io.Writer, h *messageHeader, body io.Reader, size int64, certs []*x509.Certificate) error {
+	outer, entity := splitContentHeader(h)
+	outer.Add("MIME-Version", "1.0")
+	outer.Add("Content-Type", `application/pkcs7-mime; smime-type=enveloped-data; name="smime.p7m"`)
+	outer.Add("Content-Disposition", `attachment; filename="smime.p7m"`)
+	outer.Add("Content-Transfer-Encoding", "base64")
+	if _, err := w.Write(outer.Bytes()); err != nil {
+		return err
+	}
+
+	lines := &lineWriter{w: w, n: 76}
+	enc := base64.NewEncoder(base64.StdEncoding, lines)
+	content := io.MultiReader(bytes.NewReader(entity), body)
+	if err := envelopeData(enc, content, int64(len(entity))+size, certs); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return lines.Close()
+}
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidAES256CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// CMS structures of RFC 5652 needed for enveloped-data with key transport.
+type (
+	cmsContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue // [0] EXPLICIT, tagged by hand
+	}
+	cmsEnvelopedData struct {
+		Version              int
+		RecipientInfos       []cmsKeyTransRecipientInfo `asn1:"set"`
+		EncryptedContentInfo cmsEncryptedContentInfo
+	}
+	cmsKeyTransRecipientInfo struct {
+		Version                int
+		Rid                    cmsIssuerAndSerialNumber
+		KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+		EncryptedKey           []byte
+	}
+	cmsIssuerAndSerialNumber struct {
+		Issuer       asn1.RawValue
+		SerialNumber asn1.RawValue
+	}
+	cmsEncryptedContentInfo struct {
+		ContentType                asn1.ObjectIdentifier
+		ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+		EncryptedContent           []byte `asn1:"tag:0,optional"`
+	}
+)
+
+// envelopeData writes the DER encoded ContentInfo of content, of size bytes,
+// encrypted with a random AES-256 key wrapped for each certificate, to w.
+// The encrypted content ends every structure around it, so their lengths are
+// computed up front and the content is encrypted as it is read.
+func envelopeData(w io.Writer, content io.Reader, size int64, certs []*x509.Certificate) error {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return err
+	}
+
+	env := cmsEnvelopedData{}
+	for _, cert := range certs {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("unsupported public key type %T for %s", cert.PublicKey, cert.Subject)
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return err
+		}
+		serial, err := asn1.Marshal(cert.SerialNumber)
+		if err != nil {
+			return err
+		}
+		env.RecipientInfos = append(env.RecipientInfos, cmsKeyTransRecipientInfo{
+			Rid: cmsIssuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: asn1.RawValue{FullBytes: serial},
+			},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  oidRSAEncryption,
+				Parameters: asn1.NullRawValue,
+			},
+			EncryptedKey: encryptedKey,
+		})
+	}
+	// The fields before the encrypted content, without the headers of the
+	// sequences around them.
+	envFields, err := derContents(struct {
+		Version        int
+		RecipientInfos []cmsKeyTransRecipientInfo `asn1:"set"`
+	}{env.Version, env.RecipientInfos})
+	if err != nil {
+		return err
+	}
+	eciFields, err := derContents(struct {
+		ContentType                asn1.ObjectIdentifier
+		ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	}{oidData, pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}}})
+	if err != nil {
+		return err
+	}
+	contentType, err := asn1.Marshal(oidEnvelopedData)
+	if err != nil {
+		return err
+	}
+
+	// PKCS #7 padding adds 1 to 16 bytes.
+	cipherLen := (size/aes.BlockSize + 1) * aes.BlockSize
+	encrypted := derHeader(0x80, cipherLen) // [0] IMPLICIT OCTET STRING
+	eciLen := int64(len(eciFields)+len(encrypted)) + cipherLen
+	eci := derHeader(0x30, eciLen)
+	envLen := int64(len(envFields)+len(eci)) + eciLen
+	envSeq := derHeader(0x30, envLen)
+	explicitLen := int64(len(envSeq)) + envLen
+	explicit := derHeader(0xa0, explicitLen)
+	ci := derHeader(0x30, int64(len(contentType)+len(explicit))+explicitLen)
+
+	var prefix []byte
+	for _, b := range [][]byte{ci, contentType, explicit, envSeq, envFields, eci, eciFields, encrypted} {
+		prefix = append(prefix, b...)
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+
+	cbc := cipher.NewCBCEncrypter(block, iv)
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		k, err := io.ReadFull(content, buf)
+		n += int64(k)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if n != size {
+				return fmt.Errorf("message of %d bytes, expected %d", n, size)
+			}
+			pad := aes.BlockSize - k%aes.BlockSize
+			last := append(buf[:k], bytes.Repeat([]byte{byte(pad)}, pad)...)
+			cbc.CryptBlocks(last, last)
+			_, err = w.Write(last)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		cbc.CryptBlocks(buf, buf)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+// derContents returns the DER encoding of the fields of the struct v,
+// without the header of the sequence holding them.
+func derContents(v any) ([]byte, error) {
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &seq); err != nil {
+		return nil, err
+	}
+	return seq.Bytes, nil
+}
+
+// derHeader returns the DER identifier and length octets of a value.
+func derHeader(tag byte, n int64) []byte {
+	if n < 0x80 {
+		return []byte{tag, byte(n)}
+	}
+	var length []byte
+	for ; n > 0; n >>= 8 {
+		length = append([]byte{byte(n)}, length...)
+	}
+	return append([]byte{tag, 0x80 | byte(len(length))}, length...)
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificate(t *testing.T, cn string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+// decryptEnvelopedData is the recipient side of envelopeData.
+func decryptEnvelopedData(t *testing.T, der []byte, cert *x509.Certificate, key *rsa.PrivateKey) []byte {
+	t.Helper()
+	var ci cmsContentInfo
+	_, err := asn1.Unmarshal(der, &ci)
+	require.NoError(t, err)
+	require.True(t, ci.ContentType.Equal(oidEnvelopedData))
+
+	var env cmsEnvelopedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &env)
+	require.NoError(t, err)
+
+	var cek []byte
+	for _, ri := range env.RecipientInfos {
+		if bytes.Equal(ri.Rid.Issuer.FullBytes, cert.RawIssuer) {
+			cek, err = rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey)
+			require.NoError(t, err)
+		}
+	}
+	require.NotNil(t, cek, "no recipient info for certificate")
+
+	var iv []byte
+	_, err = asn1.Unmarshal(env.EncryptedContentInfo.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+	plain := append([]byte(nil), env.EncryptedContentInfo.EncryptedContent...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, plain)
+	return plain[:len(plain)-int(plain[len(plain)-1])]
+}
+
+func TestEncryptor_SMIME(t *testing.T) {
+	cert, key := newTestCertificate(t, "bob@secure.example")
+	certs := func(rcpt string) (*x509.Certificate, error) {
+		if rcpt == "bob@secure.example" {
+			return cert, nil
+		}
+		return nil, nil
+	}
+
+	e, err := NewEncryptor(EncryptorConfig{Certificates: certs, Domains: []string{"secure.example"}})
+	require.NoError(t, err)
+
+	for _, body := range []string{"the launch code\r\n", strings.Repeat("the launch code\r\n", 10000)} {
+		message := "From: alice@example.com\r\n" +
+			"To: bob@secure.example\r\n" +
+			"Subject: secret\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"\r\n" + body
+		ctx := newTestContext(t, message)
+		ctx.Action = brisa.Deliver
+		ctx.To = []string{"bob@secure.example"}
+		assert.Equal(t, brisa.Deliver, e.Handle(ctx))
+		format, _ := ctx.Get(EncryptedKey)
+		assert.Equal(t, "smime", format)
+
+		out := readTestMessage(t, ctx)
+		header, encoded, ok := strings.Cut(out, "\r\n\r\n")
+		require.True(t, ok)
+		assert.Contains(t, header, "Subject: secret\r\n")
+		assert.Contains(t, header, "Content-Type: application/pkcs7-mime; smime-type=enveloped-data")
+		assert.NotContains(t, header, "charset=utf-8")
+		assert.NotContains(t, encoded, "launch")
+		for _, line := range strings.Split(strings.TrimSuffix(encoded, "\r\n"), "\r\n") {
+			assert.LessOrEqual(t, len(line), 76)
+		}
+
+		der, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(encoded, "\r\n", ""))
+		require.NoError(t, err)
+		assert.Equal(t, "Content-Type: text/plain; charset=utf-8\r\n\r\n"+body,
+			string(decryptEnvelopedData(t, der, cert, key)))
+	}
+}
+
+func TestDirCertificateSource(t *testing.T) {
+	cert, _ := newTestCertificate(t, "bob@secure.example")
+	dir := t.TempDir()
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bob@secure.example.pem"), pemData, 0o600))
+
+	source := DirCertificateSource(dir)
+	got, err := source("Bob@Secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, cert.Raw, got.Raw)
+
+	got, err = source("nobody@secure.example")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	got, err = source("../etc/passwd")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
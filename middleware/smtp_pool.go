@@ -0,0 +1,385 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultSMTPPoolMaxIdle is the default number of idle connections kept
+	// per destination.
+	DefaultSMTPPoolMaxIdle = 4
+	// DefaultSMTPPoolMaxConns is the default number of connections open at
+	// once per destination.
+	DefaultSMTPPoolMaxConns = 16
+	// DefaultSMTPPoolIdleTimeout is the default time an idle connection is
+	// kept. It is well below the 5 minutes servers wait for a command.
+	DefaultSMTPPoolIdleTimeout = 30 * time.Second
+	// DefaultSMTPPoolMaxLifetime is the default age after which a connection
+	// is no longer reused.
+	DefaultSMTPPoolMaxLifetime = 10 * time.Minute
+	// DefaultSMTPPoolDialTimeout is the default timeout for connecting and
+	// greeting a destination.
+	DefaultSMTPPoolDialTimeout = 30 * time.Second
+)
+
+// SMTPTLSPolicy selects when pooled connections use STARTTLS.
+type SMTPTLSPolicy int
+
+const (
+	// TLSOpportunistic uses STARTTLS when the destination offers it.
+	TLSOpportunistic SMTPTLSPolicy = iota
+	// TLSRequired fails connections to destinations without STARTTLS.
+	TLSRequired
+	// TLSDisabled never uses STARTTLS.
+	TLSDisabled
+)
+
+// ErrSMTPPoolClosed is returned by Get after the pool has been closed.
+var ErrSMTPPoolClosed = errors.New("smtp pool closed")
+
+// SMTPPoolConfig configures an SMTPPool.
+type SMTPPoolConfig struct {
+	// HeloName is the name sent with EHLO. Defaults to the host name.
+	HeloName string
+	// HeloNames maps local IP addresses to the names sent with EHLO on
+	// connections made from them, so that a host sending from several
+	// addresses greets with the name matching the reverse DNS of each. They
+	// replace HeloName, and are replaced by the EHLO name of the source
+	// address given to GetFrom.
+	HeloNames map[string]string
+	// MaxIdle bounds the idle connections kept per destination. Defaults to
+	// DefaultSMTPPoolMaxIdle.
+	MaxIdle int
+	// MaxConns bounds the connections open at once per destination; Get waits
+	// for one to be released. Defaults to DefaultSMTPPoolMaxConns.
+	MaxConns int
+	// IdleTimeout closes connections idle for longer. Defaults to
+	// DefaultSMTPPoolIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxLifetime stops reusing connections older than this. Defaults to
+	// DefaultSMTPPoolMaxLifetime.
+	MaxLifetime time.Duration
+	// DialTimeout bounds connecting and greeting. Defaults to
+	// DefaultSMTPPoolDialTimeout.
+	DialTimeout time.Duration
+	// TLSPolicy selects when STARTTLS is used. Defaults to TLSOpportunistic.
+	TLSPolicy SMTPTLSPolicy
+	// TLSConfig is used for STARTTLS. Its ServerName defaults to the
+	// destination host. Unless it has one, a session cache is added so that
+	// new connections resume earlier TLS sessions.
+	TLSConfig *tls.Config
+	// Dial opens connections. Defaults to a net.Dialer binding the source
+	// address of the connection; custom functions find it with
+	// SourceAddressFromContext.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Clock measures idle time and age. Defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// SMTPPool is a pool of outbound SMTP connections per destination, shared by
+// the components that talk to other servers, such as delivery, recipient
+// callouts and queue dispatch. Connections are reused across transactions
+// with RSET, so bursts of mail to one destination do not open a connection
+// per message. It is safe for concurrent use.
+type SMTPPool struct {
+	cfg       SMTPPoolConfig
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex
+	hosts  map[string]*smtpHostPool
+	closed bool
+}
+
+// smtpHostPool holds the connections to one destination from one source
+// address.
+type smtpHostPool struct {
+	idle  []*PooledClient // most recently released last
+	sem   chan struct{}   // one slot per open connection
+	noTLS bool            // the destination did not offer STARTTLS
+}
+
+// PooledClient is an SMTP client taken from an SMTPPool. It must be given back
+// with Release when its transaction is complete, or with Discard after an
+// error that leaves the connection in an unknown state.
+type PooledClient struct {
+	*smtp.Client
+	pool     *SMTPPool
+	host     *smtpHostPool
+	created  time.Time
+	released time.Time
+}
+
+// NewSMTPPool creates a new SMTPPool.
+func NewSMTPPool(cfg SMTPPoolConfig) (*SMTPPool, error) {
+	if cfg.MaxIdle < 0 || cfg.MaxConns < 0 || cfg.IdleTimeout < 0 || cfg.MaxLifetime < 0 || cfg.DialTimeout < 0 {
+		return nil, fmt.Errorf("smtp pool settings must not be negative")
+	}
+	if cfg.HeloName == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("smtp pool helo name: %w", err)
+		}
+		cfg.HeloName = name
+	}
+	heloNames := make(map[string]string, len(cfg.HeloNames))
+	for addr, name := range cfg.HeloNames {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("smtp pool helo name of %q: invalid IP address", addr)
+		}
+		heloNames[ip.String()] = name
+	}
+	cfg.HeloNames = heloNames
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = DefaultSMTPPoolMaxIdle
+	}
+	if cfg.MaxConns == 0 {
+		cfg.MaxConns = DefaultSMTPPoolMaxConns
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultSMTPPoolIdleTimeout
+	}
+	if cfg.MaxLifetime == 0 {
+		cfg.MaxLifetime = DefaultSMTPPoolMaxLifetime
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = DefaultSMTPPoolDialTimeout
+	}
+	if cfg.Dial == nil {
+		cfg.Dial = dialFromSource
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return &SMTPPool{cfg: cfg, tlsConfig: tlsConfig, hosts: make(map[string]*smtpHostPool)}, nil
+}
+
+// Get returns a client connected to addr ("host:port"), reusing an idle
+// connection when there is one. It waits while MaxConns connections to addr
+// are in use.
+func (p *SMTPPool) Get(ctx context.Context, addr string) (*PooledClient, error) {
+	return p.GetFrom(ctx, addr, SourceAddress{})
+}
+
+// GetFrom is Get for connections from the source address src, which are
+// pooled apart from the connections of other sources. The EHLO name of src
+// replaces HeloName.
+func (p *SMTPPool) GetFrom(ctx context.Context, addr string, src SourceAddress) (*PooledClient, error) {
+	key := addr
+	if src.IP != nil {
+		key = src.IP.String() + " " + addr
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrSMTPPoolClosed
+	}
+	h := p.hosts[key]
+	if h == nil {
+		h = &smtpHostPool{sem: make(chan struct{}, p.cfg.MaxConns)}
+		p.hosts[key] = h
+	}
+	p.mu.Unlock()
+
+	select {
+	case h.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	now := p.cfg.Clock.Now()
+	for len(h.idle) > 0 {
+		c := h.idle[len(h.idle)-1]
+		h.idle = h.idle[:len(h.idle)-1]
+		if p.reusable(c, now) {
+			p.mu.Unlock()
+			return c, nil
+		}
+		c.Client.Close()
+	}
+	noTLS := h.noTLS
+	p.mu.Unlock()
+
+	c, err := p.dial(ctx, h, addr, src, noTLS)
+	if err != nil {
+		<-h.sem
+		return nil, err
+	}
+	return c, nil
+}
+
+// reusable reports whether an idle connection may still be used at now.
+func (p *SMTPPool) reusable(c *PooledClient, now time.Time) bool {
+	return now.Sub(c.released) < p.cfg.IdleTimeout && now.Sub(c.created) < p.cfg.MaxLifetime
+}
+
+// dial opens a connection from src to addr and greets it, with STARTTLS as
+// the policy asks.
+func (p *SMTPPool) dial(ctx context.Context, h *smtpHostPool, addr string, src SourceAddress, noTLS bool) (*PooledClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.DialTimeout)
+	defer cancel()
+
+	useTLS := p.cfg.TLSPolicy != TLSDisabled && !(noTLS && p.cfg.TLSPolicy == TLSOpportunistic)
+	conn, err := p.cfg.Dial(context.WithValue(ctx, sourceAddressKey{}, src), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Bound the greeting and STARTTLS exchange; the client applies its own
+	// command timeouts afterwards.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var client *smtp.Client
+	if useTLS {
+		tlsConfig := p.tlsConfig
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		// go-smtp greets with "localhost" before STARTTLS; the configured
+		// name is sent in the EHLO that follows it.
+		client, err = smtp.NewClientStartTLS(conn, tlsConfig)
+		if err != nil && p.cfg.TLSPolicy == TLSOpportunistic && isNoStartTLS(err) {
+			p.mu.Lock()
+			h.noTLS = true
+			p.mu.Unlock()
+			return p.dial(ctx, h, addr, src, true)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("starttls with %s: %w", addr, err)
+		}
+	} else {
+		client = smtp.NewClient(conn)
+	}
+	if err := client.Hello(p.heloName(conn, src)); err != nil {
+		client.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	now := p.cfg.Clock.Now()
+	return &PooledClient{Client: client, pool: p, host: h, created: now, released: now}, nil
+}
+
+// heloName returns the EHLO name of a connection from src.
+func (p *SMTPPool) heloName(conn net.Conn, src SourceAddress) string {
+	if src.HeloName != "" {
+		return src.HeloName
+	}
+	if tcp, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		if name, ok := p.cfg.HeloNames[tcp.IP.String()]; ok {
+			return name
+		}
+	}
+	return p.cfg.HeloName
+}
+
+// isNoStartTLS reports whether err means the server does not offer STARTTLS.
+// go-smtp does not export a sentinel for it.
+func isNoStartTLS(err error) bool {
+	return strings.Contains(err.Error(), "doesn't support STARTTLS")
+}
+
+// Release ends the transaction with RSET and returns the connection to the
+// pool, or closes it when it is too old or the pool has enough idle ones.
+func (c *PooledClient) Release() {
+	p := c.pool
+	if err := c.Client.Reset(); err != nil {
+		c.Discard()
+		return
+	}
+
+	p.mu.Lock()
+	h := c.host
+	now := p.cfg.Clock.Now()
+	c.released = now
+	if p.closed || len(h.idle) >= p.cfg.MaxIdle || !p.reusable(c, now) {
+		p.mu.Unlock()
+		c.Client.Quit()
+		c.Client.Close()
+	} else {
+		h.idle = append(h.idle, c)
+		p.mu.Unlock()
+	}
+	<-h.sem
+}
+
+// Discard closes the connection without returning it to the pool.
+func (c *PooledClient) Discard() {
+	c.Client.Close()
+	<-c.host.sem
+}
+
+// CloseIdle closes the idle connections that have expired.
+func (p *SMTPPool) CloseIdle() {
+	p.mu.Lock()
+	now := p.cfg.Clock.Now()
+	var expired []*PooledClient
+	for _, h := range p.hosts {
+		kept := h.idle[:0]
+		for _, c := range h.idle {
+			if p.reusable(c, now) {
+				kept = append(kept, c)
+			} else {
+				expired = append(expired, c)
+			}
+		}
+		clear(h.idle[len(kept):])
+		h.idle = kept
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		c.Client.Close()
+	}
+}
+
+// Idle returns the number of idle connections to addr from the default
+// source address.
+func (p *SMTPPool) Idle(addr string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h := p.hosts[addr]; h != nil {
+		return len(h.idle)
+	}
+	return 0
+}
+
+// Close closes the idle connections and makes Get fail. Connections in use
+// are closed when they are released.
+func (p *SMTPPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	var idle []*PooledClient
+	for _, h := range p.hosts {
+		idle = append(idle, h.idle...)
+		h.idle = nil
+	}
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		c.Client.Close()
+	}
+	return nil
+}
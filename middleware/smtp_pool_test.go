@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// poolTestBackend is an SMTP server backend counting connections and
+// messages.
+type poolTestBackend struct {
+	conns    atomic.Int32
+	messages atomic.Int32
+	tls      atomic.Int32
+	helo     atomic.Value // EHLO name of the last transaction
+}
+
+func (b *poolTestBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &poolTestSession{b: b, c: c}, nil
+}
+
+type poolTestSession struct {
+	b *poolTestBackend
+	c *smtp.Conn
+}
+
+func (s *poolTestSession) Rcpt(to string, opts *smtp.RcptOptions) error { return nil }
+func (s *poolTestSession) Reset()                                       {}
+func (s *poolTestSession) Logout() error                                { return nil }
+
+func (s *poolTestSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.b.helo.Store(s.c.Hostname())
+	return nil
+}
+
+func (s *poolTestSession) Data(r io.Reader) error {
+	if _, ok := s.c.TLSConnectionState(); ok {
+		s.b.tls.Add(1)
+	}
+	io.Copy(io.Discard, r)
+	s.b.messages.Add(1)
+	return nil
+}
+
+// startPoolTestServer starts an SMTP server, with STARTTLS if tlsConfig is set.
+func startPoolTestServer(t *testing.T, tlsConfig *tls.Config) (*poolTestBackend, string) {
+	t.Helper()
+	be := &poolTestBackend{}
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.com"
+	s.AllowInsecureAuth = true
+	s.TLSConfig = tlsConfig
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(&countingListener{Listener: l, n: &be.conns})
+	t.Cleanup(func() { s.Close() })
+	return be, l.Addr().String()
+}
+
+type countingListener struct {
+	net.Listener
+	n *atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.n.Add(1)
+	}
+	return c, err
+}
+
+func sendPooled(t *testing.T, p *SMTPPool, addr string) {
+	t.Helper()
+	c, err := p.Get(context.Background(), addr)
+	require.NoError(t, err)
+	require.NoError(t, c.Mail("sender@example.com", nil))
+	require.NoError(t, c.Rcpt("rcpt@example.com", nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	io.Copy(w, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	require.NoError(t, w.Close())
+	c.Release()
+}
+
+func TestSMTPPool_Reuse(t *testing.T) {
+	be, addr := startPoolTestServer(t, nil)
+	clock := brisatest.NewFakeClock(time.Unix(1700000000, 0))
+	p, err := NewSMTPPool(SMTPPoolConfig{HeloName: "relay.example.com", TLSPolicy: TLSDisabled, Clock: clock})
+	require.NoError(t, err)
+	defer p.Close()
+
+	for range 3 {
+		sendPooled(t, p, addr)
+	}
+	assert.Equal(t, int32(3), be.messages.Load())
+	assert.Equal(t, int32(1), be.conns.Load(), "connection must be reused")
+	assert.Equal(t, 1, p.Idle(addr))
+
+	// Idle connections expire.
+	clock.Advance(DefaultSMTPPoolIdleTimeout)
+	p.CloseIdle()
+	assert.Equal(t, 0, p.Idle(addr))
+	sendPooled(t, p, addr)
+	assert.Equal(t, int32(2), be.conns.Load())
+
+	// So do old ones, even when in use.
+	c, err := p.Get(context.Background(), addr)
+	require.NoError(t, err)
+	clock.Advance(DefaultSMTPPoolMaxLifetime)
+	c.Release()
+	assert.Equal(t, 0, p.Idle(addr))
+}
+
+func TestSMTPPool_HeloNames(t *testing.T) {
+	be, addr := startPoolTestServer(t, nil)
+	p, err := NewSMTPPool(SMTPPoolConfig{
+		HeloName:  "relay.example.com",
+		HeloNames: map[string]string{"::ffff:127.0.0.1": "local.example.com"},
+		TLSPolicy: TLSDisabled,
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	// The name of the local address replaces HeloName.
+	sendPooled(t, p, addr)
+	assert.Equal(t, "local.example.com", be.helo.Load())
+
+	// The name of the source address given to GetFrom wins.
+	c, err := p.GetFrom(context.Background(), addr, SourceAddress{IP: net.ParseIP("127.0.0.1"), HeloName: "tx1.example.com"})
+	require.NoError(t, err)
+	require.NoError(t, c.Mail("sender@example.com", nil))
+	c.Release()
+	assert.Equal(t, "tx1.example.com", be.helo.Load())
+
+	_, err = NewSMTPPool(SMTPPoolConfig{HeloNames: map[string]string{"mx1": "mx1.example.com"}})
+	assert.Error(t, err)
+}
+
+func TestSMTPPool_MaxConns(t *testing.T) {
+	be, addr := startPoolTestServer(t, nil)
+	p, err := NewSMTPPool(SMTPPoolConfig{HeloName: "relay.example.com", TLSPolicy: TLSDisabled, MaxConns: 2, MaxIdle: 2})
+	require.NoError(t, err)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendPooled(t, p, addr)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(10), be.messages.Load())
+	assert.LessOrEqual(t, be.conns.Load(), int32(2))
+
+	// Get gives up when its context ends while all connections are in use.
+	c1, err := p.Get(context.Background(), addr)
+	require.NoError(t, err)
+	c2, err := p.Get(context.Background(), addr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.Get(ctx, addr)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	c1.Release()
+	c2.Discard()
+}
+
+func TestSMTPPool_TLS(t *testing.T) {
+	cert, key := newTestCertificate(t, "mx.example.com")
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+	be, addr := startPoolTestServer(t, serverTLS)
+
+	p, err := NewSMTPPool(SMTPPoolConfig{HeloName: "relay.example.com", TLSPolicy: TLSRequired, TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+	require.NoError(t, err)
+	defer p.Close()
+	sendPooled(t, p, addr)
+	sendPooled(t, p, addr)
+	assert.Equal(t, int32(2), be.tls.Load())
+	assert.Equal(t, int32(1), be.conns.Load())
+
+	// Without STARTTLS, opportunistic TLS falls back to plain text and
+	// required TLS fails.
+	plain, plainAddr := startPoolTestServer(t, nil)
+	_, err = p.Get(context.Background(), plainAddr)
+	assert.Error(t, err)
+
+	p2, err := NewSMTPPool(SMTPPoolConfig{HeloName: "relay.example.com"})
+	require.NoError(t, err)
+	defer p2.Close()
+	sendPooled(t, p2, plainAddr)
+	sendPooled(t, p2, plainAddr)
+	assert.Equal(t, int32(2), plain.messages.Load())
+	assert.Equal(t, int32(0), plain.tls.Load())
+	// One connection of each pool found that STARTTLS is not offered.
+	assert.Equal(t, int32(3), plain.conns.Load())
+}
+
+func TestSMTPPool_Close(t *testing.T) {
+	_, addr := startPoolTestServer(t, nil)
+	p, err := NewSMTPPool(SMTPPoolConfig{HeloName: "relay.example.com"})
+	require.NoError(t, err)
+	sendPooled(t, p, addr)
+	require.NoError(t, p.Close())
+	assert.Equal(t, 0, p.Idle(addr))
+	_, err = p.Get(context.Background(), addr)
+	assert.ErrorIs(t, err, ErrSMTPPoolClosed)
+}
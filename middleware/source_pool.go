@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync/atomic"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+// MessageStreamKey is the context key holding the stream (string) a message
+// belongs to, such as "transactional" or "bulk", for choosing its source
+// address.
+const MessageStreamKey = "message.stream"
+
+// SourceAddress is a local address outbound connections are made from, with
+// the EHLO name matching its reverse DNS.
+type SourceAddress struct {
+	// Name identifies the address in SourceRule.
+	Name     string
+	IP       net.IP
+	HeloName string
+}
+
+type sourceAddressKey struct{}
+
+// SourceAddressFromContext returns the source address a connection dialed
+// with ctx must be made from, for custom SMTPPoolConfig.Dial functions.
+func SourceAddressFromContext(ctx context.Context) (SourceAddress, bool) {
+	src, ok := ctx.Value(sourceAddressKey{}).(SourceAddress)
+	return src, ok && src.IP != nil
+}
+
+// dialFromSource dials addr from the source address of ctx, if any.
+func dialFromSource(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if src, ok := SourceAddressFromContext(ctx); ok {
+		d.LocalAddr = &net.TCPAddr{IP: src.IP}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// SourceRule selects the source addresses of the messages it matches. Empty
+// conditions match every message.
+type SourceRule struct {
+	// SenderDomains matches the domain of the envelope sender.
+	SenderDomains []string
+	// Stream matches the MessageStreamKey of the message.
+	Stream string
+	// Sources names the addresses used in turn for matching messages.
+	Sources []string
+}
+
+// SourcePoolConfig configures a SourcePool.
+type SourcePoolConfig struct {
+	// Sources are the available addresses.
+	Sources []SourceAddress
+	// Rules are tried in order; the first match selects the addresses.
+	// Messages matching no rule use all Sources.
+	Rules []SourceRule
+}
+
+// SourcePool selects the local address of outbound deliveries, so that for
+// example transactional and bulk mail, or the mail of different customers,
+// build separate IP reputations. The addresses of a rule are used
+// round-robin. It is safe for concurrent use.
+type SourcePool struct {
+	rules    []sourceGroup
+	fallback sourceGroup
+}
+
+type sourceGroup struct {
+	rule    SourceRule
+	sources []SourceAddress
+	next    *atomic.Uint32
+}
+
+func (g *sourceGroup) pick() SourceAddress {
+	n := g.next.Add(1) - 1
+	return g.sources[n%uint32(len(g.sources))]
+}
+
+// NewSourcePool creates a new SourcePool.
+func NewSourcePool(cfg SourcePoolConfig) (*SourcePool, error) {
+	if len(cfg.Sources) == 0 {
+		return nil, fmt.Errorf("source pool needs at least one address")
+	}
+	cfg.Sources = slices.Clone(cfg.Sources)
+	byName := make(map[string]SourceAddress, len(cfg.Sources))
+	for i, src := range cfg.Sources {
+		if src.IP == nil {
+			return nil, fmt.Errorf("source address %d (%s) has no IP", i, src.Name)
+		}
+		if src.Name == "" {
+			src.Name = src.IP.String()
+			cfg.Sources[i] = src
+		}
+		if _, ok := byName[src.Name]; ok {
+			return nil, fmt.Errorf("duplicate source address name: %s", src.Name)
+		}
+		byName[src.Name] = src
+	}
+
+	p := &SourcePool{fallback: sourceGroup{sources: cfg.Sources, next: new(atomic.Uint32)}}
+	for i, rule := range cfg.Rules {
+		if len(rule.Sources) == 0 {
+			return nil, fmt.Errorf("source rule %d has no sources", i)
+		}
+		g := sourceGroup{rule: rule, next: new(atomic.Uint32)}
+		for _, name := range rule.Sources {
+			src, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("source rule %d: unknown source address: %s", i, name)
+			}
+			g.sources = append(g.sources, src)
+		}
+		g.rule.SenderDomains = make([]string, len(rule.SenderDomains))
+		for j, d := range rule.SenderDomains {
+			g.rule.SenderDomains[j] = address.NormalizeDomain(d)
+		}
+		p.rules = append(p.rules, g)
+	}
+	return p, nil
+}
+
+// Select returns the source address for a message from sender in stream.
+func (p *SourcePool) Select(sender, stream string) SourceAddress {
+	domain := domainOf(sender)
+	for i := range p.rules {
+		g := &p.rules[i]
+		if len(g.rule.SenderDomains) > 0 && !slices.Contains(g.rule.SenderDomains, domain) {
+			continue
+		}
+		if g.rule.Stream != "" && g.rule.Stream != stream {
+			continue
+		}
+		return g.pick()
+	}
+	return p.fallback.pick()
+}
+
+// SelectFor returns the source address for the message of ctx, by its
+// envelope sender and MessageStreamKey.
+func (p *SourcePool) SelectFor(ctx *brisa.Context) SourceAddress {
+	var stream string
+	if v, ok := ctx.Get(MessageStreamKey); ok {
+		stream, _ = v.(string)
+	}
+	return p.Select(ctx.From, stream)
+}
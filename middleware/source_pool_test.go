@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourcePool_Select(t *testing.T) {
+	p, err := NewSourcePool(SourcePoolConfig{
+		Sources: []SourceAddress{
+			{Name: "tx1", IP: net.ParseIP("198.51.100.1"), HeloName: "tx1.example.com"},
+			{Name: "tx2", IP: net.ParseIP("198.51.100.2"), HeloName: "tx2.example.com"},
+			{Name: "bulk", IP: net.ParseIP("198.51.100.10"), HeloName: "bulk.example.com"},
+			{Name: "customer", IP: net.ParseIP("198.51.100.20"), HeloName: "mail.customer.example"},
+		},
+		Rules: []SourceRule{
+			{SenderDomains: []string{"Customer.example"}, Sources: []string{"customer"}},
+			{Stream: "bulk", Sources: []string{"bulk"}},
+			{Stream: "transactional", Sources: []string{"tx1", "tx2"}},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "customer", p.Select("news@customer.example", "bulk").Name)
+	assert.Equal(t, "bulk", p.Select("news@example.com", "bulk").Name)
+	// Round-robin within a rule.
+	assert.Equal(t, "tx1", p.Select("noreply@example.com", "transactional").Name)
+	assert.Equal(t, "tx2", p.Select("noreply@example.com", "transactional").Name)
+	assert.Equal(t, "tx1", p.Select("noreply@example.com", "transactional").Name)
+
+	// Unmatched messages use all addresses.
+	seen := make(map[string]bool)
+	for range 4 {
+		seen[p.Select("alice@example.com", "").Name] = true
+	}
+	assert.Len(t, seen, 4)
+
+	ctx := newTestContext(t, "")
+	ctx.From = "noreply@example.com"
+	ctx.Set(MessageStreamKey, "bulk")
+	assert.Equal(t, "bulk.example.com", p.SelectFor(ctx).HeloName)
+}
+
+func TestNewSourcePool_Errors(t *testing.T) {
+	ip := net.ParseIP("198.51.100.1")
+	for name, cfg := range map[string]SourcePoolConfig{
+		"no sources":     {},
+		"no ip":          {Sources: []SourceAddress{{Name: "a"}}},
+		"duplicate name": {Sources: []SourceAddress{{Name: "a", IP: ip}, {Name: "a", IP: ip}}},
+		"unknown source": {Sources: []SourceAddress{{IP: ip}}, Rules: []SourceRule{{Sources: []string{"b"}}}},
+		"empty rule":     {Sources: []SourceAddress{{IP: ip}}, Rules: []SourceRule{{Stream: "bulk"}}},
+	} {
+		_, err := NewSourcePool(cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSMTPPool_GetFrom(t *testing.T) {
+	be, addr := startPoolTestServer(t, nil)
+	var locals []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if src, ok := SourceAddressFromContext(ctx); ok {
+			locals = append(locals, src.IP.String())
+		}
+		// The test host has no 198.51.100.0/24 addresses to bind.
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	p, err := NewSMTPPool(SMTPPoolConfig{HeloName: "relay.example.com", TLSPolicy: TLSDisabled, Dial: dial})
+	require.NoError(t, err)
+	defer p.Close()
+
+	src := SourceAddress{IP: net.ParseIP("198.51.100.1"), HeloName: "tx1.example.com"}
+	c, err := p.GetFrom(context.Background(), addr, src)
+	require.NoError(t, err)
+	c.Release()
+	c, err = p.GetFrom(context.Background(), addr, src)
+	require.NoError(t, err)
+	c.Release()
+	// Connections of different sources are not shared.
+	c, err = p.Get(context.Background(), addr)
+	require.NoError(t, err)
+	c.Release()
+
+	assert.Equal(t, []string{"198.51.100.1"}, locals)
+	assert.Equal(t, int32(2), be.conns.Load())
+}
+
+func TestDialFromSource(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	ctx := context.WithValue(context.Background(), sourceAddressKey{}, SourceAddress{IP: net.ParseIP("127.0.0.1")})
+	conn, err := dialFromSource(ctx, "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", conn.LocalAddr().(*net.TCPAddr).IP.String())
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muzhy/brisa"
+)
+
+// DefaultSpamSubjectTag is the tag prepended to the Subject of mail flagged as spam.
+const DefaultSpamSubjectTag = "[SPAM]"
+
+// SpamTaggerConfig configures the SpamTagger middleware.
+type SpamTaggerConfig struct {
+	// Threshold is the score at or above which a mail is flagged as spam.
+	Threshold float64
+	// SubjectTag is prepended to the Subject of flagged mail.
+	// Defaults to DefaultSpamSubjectTag.
+	SubjectTag string
+	// DisableSubjectTag only adds the X-Spam-* headers and leaves the Subject alone.
+	DisableSubjectTag bool
+}
+
+// SpamTagger is the outcome middleware for mail that is delivered but flagged:
+// it records the context score in X-Spam-Score and X-Spam-Status headers and
+// tags the Subject when the score reaches the threshold.
+//
+// It is meant for the Deliver chain; register it with IgnoreFlags that do not
+// include IgnoreDeliver, otherwise it is skipped.
+type SpamTagger struct {
+	cfg SpamTaggerConfig
+}
+
+// NewSpamTagger creates a new SpamTagger instance.
+func NewSpamTagger(cfg SpamTaggerConfig) *SpamTagger {
+	if cfg.SubjectTag == "" {
+		cfg.SubjectTag = DefaultSpamSubjectTag
+	}
+	return &SpamTagger{cfg: cfg}
+}
+
+// NewSpamTaggerHandler creates a new middleware handler that tags spam.
+func NewSpamTaggerHandler(cfg SpamTaggerConfig) brisa.Handler {
+	return NewSpamTagger(cfg).Handle
+}
+
+// Handle is the brisa.Handler of the middleware. It leaves the action unchanged.
+func (st *SpamTagger) Handle(ctx *brisa.Context) brisa.Action {
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return ctx.Action
+	}
+	defer setMessage(ctx, h, body)
+
+	isSpam := ctx.Score >= st.cfg.Threshold
+	status := "No"
+	if isSpam {
+		status = "Yes"
+	}
+
+	// Never trust spam headers supplied by the sender.
+	h.Del("X-Spam-Score")
+	h.Del("X-Spam-Status")
+	h.Add("X-Spam-Score", fmt.Sprintf("%.1f", ctx.Score))
+	h.Add("X-Spam-Status", fmt.Sprintf("%s, score=%.1f required=%.1f", status, ctx.Score, st.cfg.Threshold))
+
+	if isSpam && !st.cfg.DisableSubjectTag {
+		subject := h.Get("Subject")
+		if !strings.HasPrefix(subject, st.cfg.SubjectTag) {
+			h.Set("Subject", strings.TrimSpace(st.cfg.SubjectTag+" "+subject))
+		}
+		ctx.Logger.Info("mail flagged as spam", "score", ctx.Score)
+	}
+	return ctx.Action
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpamTagger_Handle(t *testing.T) {
+	message := "Subject: Cheap watches\r\nX-Spam-Status: No, forged\r\n\r\nbody\r\n"
+
+	testCases := []struct {
+		name  string
+		cfg   SpamTaggerConfig
+		score float64
+		want  string
+	}{
+		{
+			name:  "below threshold",
+			cfg:   SpamTaggerConfig{Threshold: 5},
+			score: 1.25,
+			want:  "Subject: Cheap watches\r\nX-Spam-Score: 1.2\r\nX-Spam-Status: No, score=1.2 required=5.0\r\n\r\nbody\r\n",
+		},
+		{
+			name:  "at threshold",
+			cfg:   SpamTaggerConfig{Threshold: 5},
+			score: 5,
+			want:  "Subject: [SPAM] Cheap watches\r\nX-Spam-Score: 5.0\r\nX-Spam-Status: Yes, score=5.0 required=5.0\r\n\r\nbody\r\n",
+		},
+		{
+			name:  "custom tag",
+			cfg:   SpamTaggerConfig{Threshold: 5, SubjectTag: "***SPAM***"},
+			score: 9,
+			want:  "Subject: ***SPAM*** Cheap watches\r\nX-Spam-Score: 9.0\r\nX-Spam-Status: Yes, score=9.0 required=5.0\r\n\r\nbody\r\n",
+		},
+		{
+			name:  "subject tag disabled",
+			cfg:   SpamTaggerConfig{Threshold: 5, DisableSubjectTag: true},
+			score: 9,
+			want:  "Subject: Cheap watches\r\nX-Spam-Score: 9.0\r\nX-Spam-Status: Yes, score=9.0 required=5.0\r\n\r\nbody\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newTestContext(t, message)
+			ctx.Action = brisa.Deliver
+			ctx.Score = tc.score
+
+			assert.Equal(t, brisa.Deliver, NewSpamTaggerHandler(tc.cfg)(ctx))
+			assert.Equal(t, tc.want, readTestMessage(t, ctx))
+		})
+	}
+
+	t.Run("subject is not tagged twice", func(t *testing.T) {
+		ctx := newTestContext(t, "Subject: [SPAM] Cheap watches\r\n\r\n")
+		ctx.Score = 10
+
+		NewSpamTaggerHandler(SpamTaggerConfig{Threshold: 5})(ctx)
+		assert.Contains(t, readTestMessage(t, ctx), "Subject: [SPAM] Cheap watches\r\n")
+	})
+}
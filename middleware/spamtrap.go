@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+const (
+	// DefaultSpamtrapKeyPrefix is the default prefix of the Store keys written by Spamtrap.
+	DefaultSpamtrapKeyPrefix = "spamtrap:"
+	// DefaultSpamtrapPenalty is the default penalty recorded per spamtrap hit.
+	DefaultSpamtrapPenalty = 100
+	// DefaultSpamtrapPenaltyTTL is the default lifetime of recorded penalties.
+	DefaultSpamtrapPenaltyTTL = 7 * 24 * time.Hour
+)
+
+// SpamtrapHitKey is the context key holding the last spamtrap address (string)
+// hit in the current transaction.
+const SpamtrapHitKey = "spamtrap.hit"
+
+// SpamtrapConfig configures the Spamtrap middleware.
+type SpamtrapConfig struct {
+	// Addresses are the spamtrap recipients. An entry starting with "@" turns a
+	// whole domain into a trap.
+	Addresses []string
+	// Store, if set, receives a penalty for the sending IP and sender, under the
+	// keys "<prefix>ip:<ip>" and "<prefix>sender:<address>". Other middleware can
+	// use these counters as reputation data.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultSpamtrapKeyPrefix.
+	KeyPrefix string
+	// Penalty is added to the counters on each hit. Defaults to DefaultSpamtrapPenalty.
+	Penalty int64
+	// PenaltyTTL is the lifetime of new counters. Defaults to DefaultSpamtrapPenaltyTTL.
+	PenaltyTTL time.Duration
+	// Blacklist, if set, temporarily blocks the sending IP for BlockFor.
+	Blacklist *IPBlacklist
+	BlockFor  time.Duration
+}
+
+// Spamtrap turns recipient addresses into honeypots. A spamtrap recipient is
+// silently accepted and its source is penalized.
+//
+// Handle runs in the RcptTo chain and only records the hit, as the action of
+// the transaction also applies to its other recipients. HandleData, in the
+// Data chain, then discards a message sent only to spamtraps, and removes the
+// spamtraps from the recipients of the others.
+type Spamtrap struct {
+	cfg       SpamtrapConfig
+	addresses map[string]struct{}
+	domains   map[string]struct{}
+}
+
+// NewSpamtrap creates a new Spamtrap instance.
+func NewSpamtrap(cfg SpamtrapConfig) (*Spamtrap, error) {
+	if len(cfg.Addresses) == 0 {
+		return nil, fmt.Errorf("spamtrap needs at least one address")
+	}
+	if cfg.Blacklist != nil && cfg.BlockFor <= 0 {
+		return nil, fmt.Errorf("spamtrap blacklist requires a positive block duration")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultSpamtrapKeyPrefix
+	}
+	if cfg.Penalty == 0 {
+		cfg.Penalty = DefaultSpamtrapPenalty
+	}
+	if cfg.PenaltyTTL <= 0 {
+		cfg.PenaltyTTL = DefaultSpamtrapPenaltyTTL
+	}
+
+	st := &Spamtrap{
+		cfg:       cfg,
+		addresses: make(map[string]struct{}),
+		domains:   make(map[string]struct{}),
+	}
+	for _, addr := range cfg.Addresses {
+		addr = strings.TrimSpace(addr)
+		if domain, ok := strings.CutPrefix(addr, "@"); ok {
+			st.domains[address.NormalizeDomain(domain)] = struct{}{}
+		} else {
+			st.addresses[address.Key(addr)] = struct{}{}
+		}
+	}
+	return st, nil
+}
+
+// NewSpamtrapHandler creates a new RcptTo middleware handler for spamtraps. It
+// only penalizes the sources; use NewSpamtrap to also add HandleData to the
+// Data chain.
+func NewSpamtrapHandler(cfg SpamtrapConfig) (brisa.Handler, error) {
+	st, err := NewSpamtrap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return st.Handle, nil
+}
+
+// IsTrap reports whether rcpt is a spamtrap address.
+func (st *Spamtrap) IsTrap(rcpt string) bool {
+	if _, ok := st.addresses[address.Key(rcpt)]; ok {
+		return true
+	}
+	if domain := address.Domain(rcpt); domain != "" {
+		_, ok := st.domains[address.NormalizeDomain(domain)]
+		return ok
+	}
+	return false
+}
+
+// Handle is the brisa.Handler of the middleware. It checks the recipient added
+// by the current RCPT TO command.
+func (st *Spamtrap) Handle(ctx *brisa.Context) brisa.Action {
+	if len(ctx.To) == 0 {
+		return ctx.Action
+	}
+	rcpt := ctx.To[len(ctx.To)-1]
+	if !st.IsTrap(rcpt) {
+		return ctx.Action
+	}
+
+	ip := clientIP(ctx)
+	ctx.Logger.Warn("spamtrap hit", "rcpt", rcpt, "from", ctx.From, "ip", ip)
+	ctx.Set(SpamtrapHitKey, rcpt)
+
+	if st.cfg.Store != nil {
+		if ip != nil {
+			st.penalize("ip:"+ip.String(), ctx)
+		}
+		if ctx.From != "" {
+			st.penalize("sender:"+strings.ToLower(ctx.From), ctx)
+		}
+	}
+	if st.cfg.Blacklist != nil && ip != nil {
+		if err := st.cfg.Blacklist.Block(ip, st.cfg.BlockFor); err != nil {
+			ctx.Logger.Error("failed to record spamtrap block", "error", err)
+		}
+		ctx.Logger.Info("spamtrap source temporarily blacklisted", "ip", ip, "duration", st.cfg.BlockFor)
+	}
+	return ctx.Action
+}
+
+// HandleData is the Data chain brisa.Handler of the middleware. It discards a
+// message whose recipients are all spamtraps, and otherwise delivers it to
+// the other recipients only.
+func (st *Spamtrap) HandleData(ctx *brisa.Context) brisa.Action {
+	if _, hit := ctx.Get(SpamtrapHitKey); !hit {
+		return ctx.Action
+	}
+	to, opts := ctx.To[:0], ctx.ToOptions[:0]
+	for i, rcpt := range ctx.To {
+		if st.IsTrap(rcpt) {
+			continue
+		}
+		to = append(to, rcpt)
+		if i < len(ctx.ToOptions) {
+			opts = append(opts, ctx.ToOptions[i])
+		}
+	}
+	ctx.To, ctx.ToOptions = to, opts
+	if len(to) == 0 {
+		return brisa.Discard
+	}
+	return ctx.Action
+}
+
+func (st *Spamtrap) penalize(key string, ctx *brisa.Context) {
+	if _, err := st.cfg.Store.Incr(st.cfg.KeyPrefix+key, st.cfg.Penalty, st.cfg.PenaltyTTL); err != nil {
+		ctx.Logger.Error("failed to record spamtrap penalty", "key", key, "error", err)
+	}
+}
+
+// clientIP returns the IP address of the connected client, or nil if it is not
+// known (e.g. the context is not attached to a TCP session).
+func clientIP(ctx *brisa.Context) net.IP {
+	if ctx.Session == nil {
+		return nil
+	}
+	if addr, ok := ctx.Session.GetClientIP().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
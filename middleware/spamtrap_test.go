@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSpamtrap(t *testing.T) {
+	_, err := NewSpamtrap(SpamtrapConfig{})
+	require.Error(t, err)
+
+	blacklist, _ := NewIPBlacklist(nil)
+	_, err = NewSpamtrap(SpamtrapConfig{Addresses: []string{"trap@example.com"}, Blacklist: blacklist})
+	require.Error(t, err)
+}
+
+func TestSpamtrap_IsTrap(t *testing.T) {
+	st, err := NewSpamtrap(SpamtrapConfig{Addresses: []string{"Trap@example.com", "@traps.example.org"}})
+	require.NoError(t, err)
+
+	assert.True(t, st.IsTrap("trap@EXAMPLE.com"))
+	assert.True(t, st.IsTrap("anything@traps.example.org"))
+	assert.False(t, st.IsTrap("user@example.com"))
+	assert.False(t, st.IsTrap("user@sub.traps.example.org"))
+}
+
+func TestSpamtrap_Handle(t *testing.T) {
+	store := brisa.NewMemoryStore()
+	st, err := NewSpamtrap(SpamtrapConfig{Addresses: []string{"trap@example.com"}, Store: store, Penalty: 50})
+	require.NoError(t, err)
+
+	t.Run("regular recipient", func(t *testing.T) {
+		ctx := newTestContext(t, "")
+		ctx.From = "spammer@example.net"
+		ctx.To = []string{"user@example.com"}
+
+		assert.Equal(t, brisa.Pass, st.Handle(ctx))
+		_, hit := ctx.Get(SpamtrapHitKey)
+		assert.False(t, hit)
+	})
+
+	t.Run("spamtrap recipient", func(t *testing.T) {
+		ctx := newTestContext(t, "")
+		ctx.From = "Spammer@example.net"
+		ctx.To = []string{"user@example.com", "trap@example.com"}
+
+		// The legitimate recipient shares the transaction, so its action
+		// is kept.
+		assert.Equal(t, brisa.Pass, st.Handle(ctx))
+		rcpt, hit := ctx.Get(SpamtrapHitKey)
+		assert.True(t, hit)
+		assert.Equal(t, "trap@example.com", rcpt)
+
+		penalty, ok, err := store.Get(DefaultSpamtrapKeyPrefix + "sender:spammer@example.net")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, "50", string(penalty))
+
+		assert.Equal(t, brisa.Pass, st.HandleData(ctx))
+		assert.Equal(t, []string{"user@example.com"}, ctx.To)
+	})
+
+	t.Run("spamtrap recipients only", func(t *testing.T) {
+		ctx := newTestContext(t, "")
+		ctx.From = "spammer@example.net"
+		ctx.To = []string{"trap@example.com"}
+
+		assert.Equal(t, brisa.Pass, st.Handle(ctx))
+		assert.Equal(t, brisa.Discard, st.HandleData(ctx))
+		assert.Empty(t, ctx.To)
+	})
+
+	t.Run("no hit", func(t *testing.T) {
+		ctx := newTestContext(t, "")
+		ctx.To = []string{"user@example.com"}
+		assert.Equal(t, brisa.Pass, st.HandleData(ctx))
+		assert.Equal(t, []string{"user@example.com"}, ctx.To)
+	})
+}
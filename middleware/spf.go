@@ -0,0 +1,367 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/muzhy/brisa/address"
+)
+
+// SPFResultKey is the context key holding the SPFResult of the envelope sender
+// once a middleware checked it.
+const SPFResultKey = "spf.result"
+
+// SPFResult is the result of an SPF check (RFC 7208).
+type SPFResult string
+
+// SPF results.
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// spfMaxLookups is the limit of mechanisms and modifiers doing DNS lookups in
+// one check (RFC 7208, section 4.6.4).
+const spfMaxLookups = 10
+
+// CheckSPF checks whether ip may send mail from sender according to the SPF
+// record of its domain. The ptr mechanism, deprecated by RFC 7208, never
+// matches.
+func CheckSPF(ctx context.Context, r DNSLookuper, ip net.IP, sender string) SPFResult {
+	local, domain := address.LocalPart(sender), address.Domain(sender)
+	if local == "" {
+		local = "postmaster"
+	}
+	domain = address.NormalizeDomain(domain)
+	if domain == "" || ip == nil {
+		return SPFNone
+	}
+	c := &spfCheck{r: r, ip: ip, local: local, sender: domain}
+	return c.check(ctx, domain)
+}
+
+type spfCheck struct {
+	r       DNSLookuper
+	ip      net.IP
+	local   string
+	sender  string
+	lookups int
+}
+
+// check evaluates the SPF record of domain.
+func (c *spfCheck) check(ctx context.Context, domain string) SPFResult {
+	txts, err := c.r.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return SPFNone
+		}
+		return SPFTempError
+	}
+	var record string
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			if record != "" {
+				return SPFPermError
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return SPFNone
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		name, value, isModifier := spfModifier(term)
+		if isModifier {
+			if name == "redirect" {
+				redirect = value
+			}
+			continue
+		}
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+		match, result := c.mechanism(ctx, domain, term)
+		if result != "" {
+			return result
+		}
+		if match {
+			return qualifier
+		}
+	}
+
+	if redirect == "" {
+		return SPFNeutral
+	}
+	if c.lookups++; c.lookups > spfMaxLookups {
+		return SPFPermError
+	}
+	target, ok := c.expand(redirect, domain)
+	if !ok {
+		return SPFPermError
+	}
+	if result := c.check(ctx, target); result != SPFNone {
+		return result
+	}
+	return SPFPermError
+}
+
+// mechanism reports whether a mechanism matches. A non-empty result ends the
+// check with that result.
+func (c *spfCheck) mechanism(ctx context.Context, domain, term string) (bool, SPFResult) {
+	name, arg, _ := strings.Cut(term, ":")
+	name, cidr, _ := strings.Cut(name, "/")
+	if cidr != "" {
+		cidr = "/" + cidr
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			arg += map[string]string{"ip4": "/32", "ip6": "/128"}[name]
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil || (name == "ip4") != (network.IP.To4() != nil) {
+			return false, SPFPermError
+		}
+		return network.Contains(c.ip), ""
+	case "a", "mx", "include", "exists", "ptr":
+	default:
+		return false, SPFPermError
+	}
+
+	if c.lookups++; c.lookups > spfMaxLookups {
+		return false, SPFPermError
+	}
+	if name == "ptr" {
+		return false, ""
+	}
+	target := domain
+	if arg != "" {
+		// The dual CIDR length of a and mx follows the domain.
+		if i := strings.Index(arg, "/"); i >= 0 && name != "include" && name != "exists" {
+			arg, cidr = arg[:i], arg[i:]
+		}
+		var ok bool
+		if target, ok = c.expand(arg, domain); !ok {
+			return false, SPFPermError
+		}
+	} else if name == "include" || name == "exists" {
+		return false, SPFPermError
+	}
+
+	switch name {
+	case "include":
+		switch c.check(ctx, target) {
+		case SPFPass:
+			return true, ""
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, ""
+		case SPFTempError:
+			return false, SPFTempError
+		default:
+			return false, SPFPermError
+		}
+	case "exists":
+		addrs, err := c.r.LookupHost(ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError
+		}
+		return len(addrs) > 0, ""
+	}
+
+	bits4, bits6, ok := spfCIDR(cidr)
+	if !ok {
+		return false, SPFPermError
+	}
+	hosts := []string{target}
+	if name == "mx" {
+		mxs, err := c.r.LookupMX(ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError
+		}
+		if len(mxs) > spfMaxLookups {
+			return false, SPFPermError
+		}
+		hosts = hosts[:0]
+		for _, mx := range mxs {
+			hosts = append(hosts, mx.Host)
+		}
+	}
+	for _, host := range hosts {
+		addrs, err := c.r.LookupHost(ctx, host)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return false, SPFTempError
+		}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && spfIPMatch(c.ip, ip, bits4, bits6) {
+				return true, ""
+			}
+		}
+	}
+	return false, ""
+}
+
+// expand expands the macros of a domain-spec (RFC 7208, section 7).
+func (c *spfCheck) expand(spec, domain string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i++; i >= len(spec) {
+			return "", false
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", false
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", false
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch macro[0] | 0x20 {
+		case 's':
+			value = c.local + "@" + c.sender
+		case 'l':
+			value = c.local
+		case 'o':
+			value = c.sender
+		case 'd', 'h':
+			value = domain
+		case 'i':
+			value = spfIPName(c.ip)
+		case 'v':
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		default:
+			return "", false
+		}
+
+		transformers := macro[1:]
+		digits := strings.TrimLeft(transformers, "0123456789")
+		keep := 0
+		if n := len(transformers) - len(digits); n > 0 {
+			keep, _ = strconv.Atoi(transformers[:n])
+			if keep == 0 {
+				return "", false
+			}
+		}
+		reverse := strings.HasPrefix(digits, "r") || strings.HasPrefix(digits, "R")
+		if reverse {
+			digits = digits[1:]
+		}
+		delimiters := digits
+		if strings.Trim(delimiters, ".-+,/_=") != "" {
+			return "", false
+		}
+		if delimiters == "" {
+			delimiters = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		b.WriteString(strings.Join(parts, "."))
+	}
+	return b.String(), true
+}
+
+// spfModifier splits a modifier term into its name and value.
+func spfModifier(term string) (name, value string, ok bool) {
+	name, value, ok = strings.Cut(term, "=")
+	if !ok || name == "" || strings.ContainsAny(name, ":/") {
+		return "", "", false
+	}
+	return strings.ToLower(name), value, true
+}
+
+// spfCIDR parses the "/n", "//n" or "/n//m" suffix of an a or mx mechanism.
+func spfCIDR(cidr string) (bits4, bits6 int, ok bool) {
+	bits4, bits6 = 32, 128
+	v4, v6, dual := strings.Cut(cidr, "//")
+	if dual {
+		n, err := strconv.Atoi(v6)
+		if err != nil || n < 0 || n > 128 {
+			return 0, 0, false
+		}
+		bits6 = n
+	}
+	if v4 != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(v4, "/"))
+		if err != nil || n < 0 || n > 32 || !strings.HasPrefix(v4, "/") {
+			return 0, 0, false
+		}
+		bits4 = n
+	}
+	return bits4, bits6, true
+}
+
+// spfIPMatch reports whether ip is within the network of addr.
+func spfIPMatch(ip, addr net.IP, bits4, bits6 int) bool {
+	if ip4, addr4 := ip.To4(), addr.To4(); ip4 != nil || addr4 != nil {
+		if ip4 == nil || addr4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(bits4, 32)
+		return ip4.Mask(mask).Equal(addr4.Mask(mask))
+	}
+	mask := net.CIDRMask(bits6, 128)
+	return ip.Mask(mask).Equal(addr.Mask(mask))
+}
+
+// spfIPName returns the %{i} macro value of ip: dotted quad or nibbles.
+func spfIPName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSPF(t *testing.T) {
+	r := &brisatest.FakeResolver{
+		TXT: map[string][]string{
+			"example.com":         {"some verification", "v=spf1 ip4:192.0.2.0/24 a:mail.example.com include:_spf.example.net -all"},
+			"_spf.example.net":    {"v=spf1 ip6:2001:db8::/32 mx/30 ~all"},
+			"soft.example.org":    {"v=spf1 ~all"},
+			"redirect.example":    {"v=spf1 redirect=example.com"},
+			"neutral.example":     {"v=spf1 ip4:10.0.0.1"},
+			"double.example":      {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":      {"v=spf1 bogus:foo -all"},
+			"exists.example":      {"v=spf1 exists:%{ir}.%{l1r+-}.allow.example -all"},
+			"loop.example":        {"v=spf1 include:loop.example -all"},
+			"missing.example":     {"v=spf1 include:nowhere.example -all"},
+			"ptr.example":         {"v=spf1 ptr -all"},
+			"dual.example":        {"v=spf1 a//48 a/28 -all"},
+			"badmacro.example":    {"v=spf1 exists:%{z}.example -all"},
+			"uppercase.example":   {"V=SPF1 +ALL"},
+			"nospf.example":       {"hello"},
+			"mx.example.net.test": {"v=spf1 mx -all"},
+		},
+		Hosts: map[string][]string{
+			"mail.example.com":               {"198.51.100.7"},
+			"mx1.example.net":                {"203.0.113.9"},
+			"dual.example":                   {"203.0.113.16", "2001:db8:1::1"},
+			"7.100.51.198.bob.allow.example": {"127.0.0.2"},
+			"mx.example.net.test":            {"192.0.2.77"},
+			"mx-host.example.net.test":       {"192.0.2.88"},
+		},
+		MX: map[string][]*net.MX{
+			"_spf.example.net":    {{Host: "mx1.example.net.", Pref: 10}},
+			"mx.example.net.test": {{Host: "mx-host.example.net.test.", Pref: 10}},
+		},
+	}
+
+	tests := []struct {
+		ip     string
+		sender string
+		want   SPFResult
+	}{
+		{"192.0.2.10", "alice@example.com", SPFPass},
+		{"198.51.100.7", "alice@example.com", SPFPass},
+		{"2001:db8::1", "alice@Example.COM", SPFPass},
+		{"203.0.113.10", "alice@example.com", SPFPass}, // mx/30 of the include
+		{"203.0.113.20", "alice@example.com", SPFFail},
+		{"203.0.113.20", "alice@soft.example.org", SPFSoftFail},
+		{"192.0.2.10", "alice@redirect.example", SPFPass},
+		{"203.0.113.20", "alice@redirect.example", SPFFail},
+		{"203.0.113.20", "alice@neutral.example", SPFNeutral},
+		{"203.0.113.20", "alice@double.example", SPFPermError},
+		{"203.0.113.20", "alice@broken.example", SPFPermError},
+		{"198.51.100.7", "bob-x@exists.example", SPFPass},
+		{"198.51.100.8", "bob-x@exists.example", SPFFail},
+		{"203.0.113.20", "alice@loop.example", SPFPermError},
+		{"203.0.113.20", "alice@missing.example", SPFPermError},
+		{"203.0.113.20", "alice@ptr.example", SPFFail},
+		{"203.0.113.30", "alice@dual.example", SPFPass},
+		{"203.0.113.40", "alice@dual.example", SPFFail},
+		{"2001:db8:1:0:ffff::1", "alice@dual.example", SPFPass},
+		{"2001:db8:2::1", "alice@dual.example", SPFFail},
+		{"203.0.113.20", "alice@badmacro.example", SPFPermError},
+		{"203.0.113.20", "alice@uppercase.example", SPFPass},
+		{"203.0.113.20", "alice@nospf.example", SPFNone},
+		{"203.0.113.20", "alice@unknown.example", SPFNone},
+		{"192.0.2.88", "alice@mx.example.net.test", SPFPass},
+		{"192.0.2.77", "alice@mx.example.net.test", SPFFail},
+		{"203.0.113.20", "", SPFNone},
+	}
+	for _, tt := range tests {
+		got := CheckSPF(context.Background(), r, net.ParseIP(tt.ip), tt.sender)
+		assert.Equal(t, tt.want, got, "%s from %s", tt.sender, tt.ip)
+	}
+}
+
+func TestSPFCheck_Expand(t *testing.T) {
+	c := &spfCheck{ip: net.ParseIP("192.0.2.3"), local: "strong-bad", sender: "email.example.com"}
+	tests := map[string]string{
+		"%{s}":                 "strong-bad@email.example.com",
+		"%{o}":                 "email.example.com",
+		"%{d4}":                "email.example.com",
+		"%{d2}":                "example.com",
+		"%{dr}":                "com.example.email",
+		"%{d2r}":               "example.email",
+		"%{l-}":                "strong.bad",
+		"%{lr-}":               "bad.strong",
+		"%{ir}.%{v}._spf.%d":   "",
+		"%{ir}.%{v}._spf.%{d}": "3.2.0.192.in-addr._spf.email.example.com",
+		"%%%_%-":               "% %20",
+	}
+	for spec, want := range tests {
+		got, ok := c.expand(spec, "email.example.com")
+		assert.Equal(t, want != "", ok, spec)
+		assert.Equal(t, want, got, spec)
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	got, ok := c.expand("%{ir}.%{v}", "example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6", got)
+}
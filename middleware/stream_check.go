@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// ErrMessageTooLarge is returned by SizeLimitConsumer for a message over its
+// limit.
+var ErrMessageTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message size exceeds fixed limit",
+}
+
+// ErrBlockedAttachment is returned by AttachmentTypeConsumer for a message
+// with a blocked attachment.
+var ErrBlockedAttachment = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message contains a blocked attachment type",
+}
+
+// SizeLimitConsumer returns a StreamConsumer that rejects messages of more
+// than maxBytes with ErrMessageTooLarge as soon as they exceed it. Unlike the
+// max_message_bytes setting of the server, the limit can be chosen per Tee,
+// e.g. lower on the MX listener than on submission.
+func SizeLimitConsumer(maxBytes int64) StreamConsumer {
+	return StreamConsumer{Name: "size_limit", Consume: func(ctx *brisa.Context, r io.Reader) (brisa.Action, error) {
+		n, err := io.Copy(io.Discard, io.LimitReader(r, maxBytes+1))
+		if err != nil {
+			return brisa.Pass, err
+		}
+		if n > maxBytes {
+			ctx.Logger.Info("message over size limit", "limit", maxBytes)
+			return brisa.Reject, ErrMessageTooLarge
+		}
+		return brisa.Pass, nil
+	}}
+}
+
+// AttachmentTypeConfig configures AttachmentTypeConsumer.
+type AttachmentTypeConfig struct {
+	// Extensions are the blocked file extensions, e.g. ".exe".
+	Extensions []string
+	// MediaTypes are the blocked media types, e.g. "application/x-msdownload".
+	MediaTypes []string
+}
+
+// AttachmentTypeConsumer returns a StreamConsumer that rejects messages with
+// an attachment of a blocked file extension or media type with
+// ErrBlockedAttachment. It reads the MIME structure as it arrives and rejects
+// at the header of the first blocked part, before its content.
+func AttachmentTypeConsumer(cfg AttachmentTypeConfig) StreamConsumer {
+	extensions := make(map[string]bool, len(cfg.Extensions))
+	for _, ext := range cfg.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions[ext] = true
+	}
+	mediaTypes := make(map[string]bool, len(cfg.MediaTypes))
+	for _, t := range cfg.MediaTypes {
+		mediaTypes[strings.ToLower(t)] = true
+	}
+	return StreamConsumer{Name: "attachment_type", Consume: func(ctx *brisa.Context, r io.Reader) (brisa.Action, error) {
+		br := bufio.NewReader(r)
+		h, err := readHeader(br)
+		if err != nil {
+			return brisa.Pass, err
+		}
+		count := 0
+		err = streamParts(mimeHeaderOf(h), br, 0, &count, func(p *messagePart) bool {
+			blocked := mediaTypes[p.MediaType] || extensions[strings.ToLower(path.Ext(p.Filename))]
+			if blocked {
+				ctx.Logger.Info("blocked attachment", "filename", p.Filename, "content_type", p.MediaType)
+			}
+			return blocked
+		})
+		if errors.Is(err, errStopWalk) {
+			return brisa.Reject, ErrBlockedAttachment
+		}
+		if errors.Is(err, errTooManyParts) {
+			return brisa.Pass, nil
+		}
+		return brisa.Pass, err
+	}}
+}
+
+// streamParts calls blocked with each leaf part of the part with header and
+// body as its header arrives, without its content, descending into multipart
+// bodies. It returns errStopWalk once blocked returns true. Malformed
+// multipart bodies end the walk of their level.
+func streamParts(header textproto.MIMEHeader, body io.Reader, depth int, count *int, blocked func(p *messagePart) bool) error {
+	if *count++; *count > maxMIMEParts {
+		return errTooManyParts
+	}
+	mediaType, params, err := parseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxMIMEDepth {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return nil
+			}
+			if err := streamParts(part.Header, part, depth+1, count, blocked); err != nil {
+				return err
+			}
+		}
+	}
+	p := &messagePart{Header: header, MediaType: mediaType, Params: params, Filename: partFilename(header, params)}
+	if blocked(p) {
+		return errStopWalk
+	}
+	return nil
+}
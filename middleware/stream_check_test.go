@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamChunks feeds the message of ctx chunk by chunk, as BDAT does: the
+// prefix, then chunk until the stream is stopped. stop returns the number of
+// chunks written.
+func streamChunks(ctx *brisa.Context, prefix, chunk string) (stop func() int) {
+	pr, pw := io.Pipe()
+	ctx.Reader = pr
+	done := make(chan int, 1)
+	go func() {
+		n := 0
+		if _, err := io.WriteString(pw, prefix); err == nil {
+			for n = 1; ; n++ {
+				if _, err := io.WriteString(pw, chunk); err != nil {
+					break
+				}
+			}
+		}
+		done <- n
+	}()
+	return func() int {
+		pr.Close()
+		return <-done
+	}
+}
+
+func TestSizeLimitConsumer(t *testing.T) {
+	h, err := NewTeeHandler(TeeConfig{Consumers: []StreamConsumer{SizeLimitConsumer(100), SHA256Consumer()}, ChunkSize: 64})
+	require.NoError(t, err)
+
+	ctx := newTestContext(t, "Subject: small\r\n\r\nbody\r\n")
+	assert.Equal(t, brisa.Pass, h(ctx))
+
+	// The message is refused without reading it to the end.
+	ctx = newTestContext(t, "")
+	stop := streamChunks(ctx, "Subject: large\r\n\r\n", strings.Repeat("x", 64))
+	assert.Equal(t, brisa.Reject, h(ctx))
+	assert.Equal(t, ErrMessageTooLarge, ctx.RejectError())
+	assert.Less(t, stop(), 5)
+}
+
+func TestAttachmentTypeConsumer(t *testing.T) {
+	h, err := NewTeeHandler(TeeConfig{Consumers: []StreamConsumer{
+		AttachmentTypeConsumer(AttachmentTypeConfig{Extensions: []string{"exe", ".JS"}, MediaTypes: []string{"application/x-msdownload"}}),
+		SHA256Consumer(),
+	}})
+	require.NoError(t, err)
+
+	ctx := newTestContext(t, testMultipartMessage)
+	assert.Equal(t, brisa.Pass, h(ctx))
+
+	message := func(header string) string {
+		return "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+			"--outer\r\n" +
+			"Content-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+			"--inner\r\n" +
+			"Content-Type: text/plain\r\n\r\n" +
+			"hello\r\n" +
+			"--inner--\r\n" +
+			"--outer\r\n" +
+			header + "\r\n\r\n"
+	}
+	for _, header := range []string{
+		`Content-Type: application/octet-stream; name="=?utf-8?q?Rechnung.JS?="`,
+		"Content-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=setup.exe",
+		"Content-Type: application/x-msdownload",
+	} {
+		// The message is refused at the header of the part, before its content.
+		ctx := newTestContext(t, "")
+		stop := streamChunks(ctx, message(header), strings.Repeat("TVqQAAMAAAAEAAAA\r\n", 100))
+		assert.Equal(t, brisa.Reject, h(ctx), header)
+		assert.Equal(t, ErrBlockedAttachment, ctx.RejectError(), header)
+		assert.Less(t, stop(), 5, header)
+	}
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+// SubaddressKey is the context key holding the subaddresses of the recipients
+// (map[string]Subaddress, keyed by address.Key of the recipient in ctx.To).
+// Use SubaddressOf to read it.
+const SubaddressKey = "rcpt.subaddress"
+
+// Subaddress is a recipient with detail, such as "user+tag@example.com".
+type Subaddress struct {
+	// Address is the recipient without the detail, e.g. "user@example.com".
+	Address string
+	// Detail is the tag, e.g. "tag".
+	Detail string
+}
+
+// SubaddressConfig configures the Subaddressing middleware.
+type SubaddressConfig struct {
+	// Separator separates the user from the detail. Defaults to
+	// address.DefaultDetailSeparator.
+	Separator string
+	// Strip replaces the recipient by the address without the detail, so that
+	// later middleware and delivery only see the base address. Otherwise the
+	// recipient is kept and only verified without the detail.
+	Strip bool
+}
+
+// Subaddressing recognizes detail addresses (RFC 5233), e.g.
+// "user+tag@example.com", in the RcptTo chain. The tag is recorded under
+// SubaddressKey for delivery, e.g. to file the message into a folder named
+// after it. RecipientPolicy and RecipientVerifier check the address without
+// the tag, so it must run before them.
+type Subaddressing struct {
+	cfg SubaddressConfig
+}
+
+// NewSubaddressing creates a new Subaddressing instance.
+func NewSubaddressing(cfg SubaddressConfig) (*Subaddressing, error) {
+	if cfg.Separator == "" {
+		cfg.Separator = address.DefaultDetailSeparator
+	}
+	if len(cfg.Separator) != 1 {
+		return nil, fmt.Errorf("invalid subaddress separator %q", cfg.Separator)
+	}
+	return &Subaddressing{cfg: cfg}, nil
+}
+
+// NewSubaddressingHandler creates a new RcptTo middleware handler recognizing
+// detail addresses.
+func NewSubaddressingHandler(cfg SubaddressConfig) (brisa.Handler, error) {
+	s, err := NewSubaddressing(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It checks the recipient
+// added by the current RCPT TO command.
+func (s *Subaddressing) Handle(ctx *brisa.Context) brisa.Action {
+	if len(ctx.To) == 0 {
+		return brisa.Pass
+	}
+	i := len(ctx.To) - 1
+	addr, err := address.Parse(ctx.To[i])
+	if err != nil {
+		return brisa.Pass
+	}
+	_, detail, ok := addr.Detail(s.cfg.Separator)
+	if !ok {
+		return brisa.Pass
+	}
+	sub := Subaddress{Address: addr.WithoutDetail(s.cfg.Separator).String(), Detail: detail}
+	if s.cfg.Strip {
+		ctx.Logger.Debug("subaddress stripped", "rcpt", ctx.To[i], "detail", detail)
+		ctx.To[i] = sub.Address
+	}
+
+	v, _ := ctx.Get(SubaddressKey)
+	m, ok := v.(map[string]Subaddress)
+	if !ok {
+		m = make(map[string]Subaddress)
+		ctx.Set(SubaddressKey, m)
+	}
+	m[address.Key(ctx.To[i])] = sub
+	return brisa.Pass
+}
+
+// SubaddressOf returns the subaddress recorded for a recipient in ctx.To by a
+// Subaddressing middleware.
+func SubaddressOf(ctx *brisa.Context, rcpt string) (Subaddress, bool) {
+	v, _ := ctx.Get(SubaddressKey)
+	m, _ := v.(map[string]Subaddress)
+	sub, ok := m[address.Key(rcpt)]
+	return sub, ok
+}
+
+// baseRecipient returns the recipient to verify: the address without the
+// detail if it has one.
+func baseRecipient(ctx *brisa.Context, rcpt string) string {
+	if sub, ok := SubaddressOf(ctx, rcpt); ok {
+		return sub.Address
+	}
+	return rcpt
+}
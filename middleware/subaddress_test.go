@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSubaddressing(t *testing.T) {
+	_, err := NewSubaddressing(SubaddressConfig{Separator: "++"})
+	require.Error(t, err)
+}
+
+func TestSubaddressing(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		sub, err := NewSubaddressing(SubaddressConfig{Strip: strip})
+		require.NoError(t, err)
+		policy, err := NewRecipientPolicy(RecipientPolicyConfig{Domains: map[string]DomainPolicy{
+			"example.com": {Mailboxes: []string{"alice"}, RejectUnknown: true},
+		}})
+		require.NoError(t, err)
+		var verified []string
+		verifier, err := NewRecipientVerifier(RecipientVerifierConfig{
+			BatchSize: 1,
+			Lookup: func(ctx context.Context, rcpts []string) (map[string]bool, error) {
+				verified = append(verified, rcpts...)
+				return map[string]bool{"bob@example.org": true}, nil
+			},
+		})
+		require.NoError(t, err)
+
+		router := brisa.Router{}
+		router.OnRcptTo(&brisa.Middleware{Handler: sub.Handle}, &brisa.Middleware{Handler: policy.Handle},
+			&brisa.Middleware{Handler: verifier.Handle})
+		var to []string
+		var details []Subaddress
+		router.OnData(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+			to = append([]string(nil), ctx.To...)
+			for _, rcpt := range ctx.To {
+				s, _ := SubaddressOf(ctx, rcpt)
+				details = append(details, s)
+			}
+			return brisa.Pass
+		}})
+		b := brisa.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		b.UpdateRouter(&router)
+
+		env := brisatest.DefaultEnvelope()
+		env.To = []string{"alice+lists@example.com", "bob+shop@example.org", "carol@example.org", "eve+x@example.com"}
+		res := b.Simulate(env, strings.NewReader("\r\n"))
+		require.NoError(t, res.Err)
+		assert.Equal(t, map[string]error{"carol@example.org": ErrUnknownRecipient, "eve+x@example.com": ErrUnknownRecipient}, res.RcptErrors)
+		assert.Equal(t, []string{"bob@example.org", "carol@example.org"}, verified)
+		if strip {
+			assert.Equal(t, []string{"alice@example.com", "bob@example.org"}, to)
+		} else {
+			assert.Equal(t, []string{"alice+lists@example.com", "bob+shop@example.org"}, to)
+		}
+		assert.Equal(t, []Subaddress{{"alice@example.com", "lists"}, {"bob@example.org", "shop"}}, details)
+	}
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultSubmissionKeyPrefix is the default prefix of the Store keys
+	// written by Submission.
+	DefaultSubmissionKeyPrefix = "authfail:"
+	// DefaultMaxAuthFailures is the default number of failed AUTH attempts
+	// per client IP and window before it is refused.
+	DefaultMaxAuthFailures = 5
+	// DefaultAuthFailureWindow is the default window failed AUTH attempts are
+	// counted in.
+	DefaultAuthFailureWindow = 15 * time.Minute
+)
+
+var (
+	// ErrAuthRequired is returned for MAIL FROM without authentication.
+	ErrAuthRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Authentication required",
+	}
+	// ErrEncryptionRequired is returned for AUTH before STARTTLS.
+	ErrEncryptionRequired = &smtp.SMTPError{
+		Code:         538,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 11},
+		Message:      "Encryption required for requested authentication mechanism",
+	}
+	// ErrTooManyAuthFailures is returned for AUTH from a client IP with too
+	// many failed attempts. It is temporary, as the failures expire.
+	ErrTooManyAuthFailures = &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many authentication failures, please try again later",
+	}
+)
+
+// SubmissionConfig configures the Submission middleware.
+type SubmissionConfig struct {
+	// AllowInsecure accepts AUTH over unencrypted connections. By default AUTH
+	// requires STARTTLS or implicit TLS, even if the server allows insecure
+	// authentication for other listeners.
+	AllowInsecure bool
+	// Store counts the failed AUTH attempts per client IP. Without it, failures
+	// are not limited.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultSubmissionKeyPrefix.
+	KeyPrefix string
+	// MaxFailures is the number of failed attempts per Window after which AUTH
+	// is refused with ErrTooManyAuthFailures, even with valid credentials.
+	// Defaults to DefaultMaxAuthFailures and DefaultAuthFailureWindow.
+	MaxFailures int64
+	Window      time.Duration
+	// Blacklist, if set, blocks the client IP for BanFor once it exceeds
+	// MaxFailures, so an IPBlacklist in the conn chain refuses its connections.
+	Blacklist *IPBlacklist
+	BanFor    time.Duration
+}
+
+// SubmissionStats are the counts of AUTH attempts seen by a Submission.
+type SubmissionStats struct {
+	Successes int64
+	Failures  int64
+	// Refused counts attempts refused by the middleware: without TLS or from
+	// a client IP with too many failures.
+	Refused int64
+	Bans    int64
+}
+
+// Submission enforces authenticated submission, e.g. on a port 587 listener:
+// HandleAuth, in the auth chain, requires TLS before AUTH and limits failed
+// attempts per client IP; HandleMailFrom, in the mail_from chain, requires a
+// successful AUTH.
+type Submission struct {
+	cfg                                SubmissionConfig
+	successes, failures, refused, bans atomic.Int64
+}
+
+// NewSubmission creates a new Submission instance.
+func NewSubmission(cfg SubmissionConfig) (*Submission, error) {
+	if cfg.MaxFailures < 0 || cfg.Window < 0 {
+		return nil, fmt.Errorf("submission needs a positive failure limit and window")
+	}
+	if cfg.Blacklist != nil && cfg.BanFor <= 0 {
+		return nil, fmt.Errorf("submission blacklist requires a positive ban duration")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultSubmissionKeyPrefix
+	}
+	if cfg.MaxFailures == 0 {
+		cfg.MaxFailures = DefaultMaxAuthFailures
+	}
+	if cfg.Window == 0 {
+		cfg.Window = DefaultAuthFailureWindow
+	}
+	return &Submission{cfg: cfg}, nil
+}
+
+// HandleAuth is the brisa.Handler of the middleware for the auth chain.
+func (s *Submission) HandleAuth(ctx *brisa.Context) brisa.Action {
+	if !s.cfg.AllowInsecure && (ctx.Session == nil || !ctx.Session.TLS()) {
+		s.refused.Add(1)
+		return ctx.RejectWith(ErrEncryptionRequired)
+	}
+
+	failed := ctx.Auth().Err != nil
+	if failed {
+		s.failures.Add(1)
+	}
+	ip := clientIP(ctx)
+	if s.cfg.Store == nil || ip == nil {
+		if !failed {
+			s.successes.Add(1)
+		}
+		return ctx.Action
+	}
+
+	// A successful attempt only reads the count.
+	var delta int64
+	if failed {
+		delta = 1
+	}
+	key := ip.String()
+	n, err := s.cfg.Store.Incr(s.cfg.KeyPrefix+key, delta, s.cfg.Window)
+	if err != nil {
+		// Fail open: a broken Store must not stop submission.
+		ctx.Logger.Error("failed to count authentication failures", "ip", key, "error", err)
+		n = 0
+	}
+	if n <= s.cfg.MaxFailures {
+		if !failed {
+			s.successes.Add(1)
+		}
+		return ctx.Action
+	}
+
+	s.refused.Add(1)
+	ctx.Logger.Warn("too many authentication failures", "ip", key, "count", n, "limit", s.cfg.MaxFailures)
+	// Ban once, when the limit is first exceeded.
+	if s.cfg.Blacklist != nil && failed && n == s.cfg.MaxFailures+1 {
+		s.bans.Add(1)
+		if err := s.cfg.Blacklist.Block(ip, s.cfg.BanFor); err != nil {
+			ctx.Logger.Error("failed to record authentication ban", "error", err)
+		}
+		ctx.Logger.Info("client temporarily blacklisted for authentication failures", "ip", key, "duration", s.cfg.BanFor)
+	}
+	return ctx.RejectWith(ErrTooManyAuthFailures)
+}
+
+// HandleMailFrom is the brisa.Handler of the middleware for the mail_from
+// chain.
+func (s *Submission) HandleMailFrom(ctx *brisa.Context) brisa.Action {
+	if !ctx.HasFlag(brisa.FlagAuthenticated) {
+		return ctx.RejectWith(ErrAuthRequired)
+	}
+	return ctx.Action
+}
+
+// Stats returns the counts of AUTH attempts seen so far.
+func (s *Submission) Stats() SubmissionStats {
+	return SubmissionStats{
+		Successes: s.successes.Load(),
+		Failures:  s.failures.Load(),
+		Refused:   s.refused.Load(),
+		Bans:      s.bans.Load(),
+	}
+}
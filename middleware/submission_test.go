@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSubmissionBrisa(t *testing.T, cfg SubmissionConfig) (*brisa.Brisa, *Submission) {
+	t.Helper()
+	sub, err := NewSubmission(cfg)
+	require.NoError(t, err)
+	router := brisa.Router{}
+	router.OnAuth(&brisa.Middleware{Handler: sub.HandleAuth})
+	router.OnMailFrom(&brisa.Middleware{Handler: sub.HandleMailFrom})
+	return brisatest.NewBrisa(&router), sub
+}
+
+func submissionEnvelope(password string) brisa.Envelope {
+	env := brisatest.AuthEnvelope("alice")
+	env.TLS = true
+	env.Password = password
+	return env
+}
+
+func TestNewSubmission(t *testing.T) {
+	blacklist, _ := NewIPBlacklist(nil)
+	_, err := NewSubmission(SubmissionConfig{Blacklist: blacklist})
+	require.Error(t, err)
+	_, err = NewSubmission(SubmissionConfig{MaxFailures: -1})
+	require.Error(t, err)
+}
+
+func TestSubmission(t *testing.T) {
+	b, sub := newSubmissionBrisa(t, SubmissionConfig{})
+
+	res := b.Simulate(submissionEnvelope("secret"), strings.NewReader("\r\n"))
+	assert.NoError(t, res.Err)
+
+	// Without AUTH, MAIL FROM is refused.
+	env := submissionEnvelope("")
+	env.Username = ""
+	res = b.Simulate(env, strings.NewReader("\r\n"))
+	assert.Equal(t, brisa.ChainMailFrom, res.Chain)
+	assert.Equal(t, ErrAuthRequired, res.Err)
+
+	// AUTH requires TLS.
+	env = submissionEnvelope("secret")
+	env.TLS = false
+	res = b.Simulate(env, strings.NewReader("\r\n"))
+	assert.Equal(t, brisa.ChainAuth, res.Chain)
+	assert.Equal(t, ErrEncryptionRequired, res.Err)
+
+	assert.Equal(t, SubmissionStats{Successes: 1, Refused: 1}, sub.Stats())
+}
+
+func TestSubmission_Failures(t *testing.T) {
+	clock := brisatest.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := brisa.NewMemoryStoreWithClock(clock)
+	blacklist, err := NewIPBlacklist(nil)
+	require.NoError(t, err)
+	blacklist.Clock, blacklist.Store = clock, store
+	b, sub := newSubmissionBrisa(t, SubmissionConfig{
+		Store: store, MaxFailures: 2, Window: time.Minute, Blacklist: blacklist, BanFor: time.Hour,
+	})
+
+	for range 2 {
+		res := b.Simulate(submissionEnvelope("wrong"), strings.NewReader("\r\n"))
+		assert.Equal(t, brisa.ErrAuthFailed, res.Err)
+	}
+	res := b.Simulate(submissionEnvelope("wrong"), strings.NewReader("\r\n"))
+	assert.Equal(t, ErrTooManyAuthFailures, res.Err)
+	assert.True(t, blacklist.IsBlocked(brisatest.DefaultClientIP))
+
+	// Valid credentials are refused too until the failures expire.
+	res = b.Simulate(submissionEnvelope("secret"), strings.NewReader("\r\n"))
+	assert.Equal(t, ErrTooManyAuthFailures, res.Err)
+	clock.Advance(time.Minute)
+	res = b.Simulate(submissionEnvelope("secret"), strings.NewReader("\r\n"))
+	assert.NoError(t, res.Err)
+
+	assert.Equal(t, SubmissionStats{Successes: 1, Failures: 3, Refused: 2, Bans: 1}, sub.Stats())
+}
@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// DefaultTeeChunkSize is the default size of the chunks handed to consumers.
+const DefaultTeeChunkSize = 32 * 1024
+
+// MessageSHA256Key is the context key holding the hex SHA-256 digest of the
+// message computed by SHA256Consumer.
+const MessageSHA256Key = "message.sha256"
+
+// ErrTeeConsumerFailed is returned when a stream consumer fails and the Tee
+// fails closed.
+var ErrTeeConsumerFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Message could not be processed, try again later",
+}
+
+// StreamConsumer receives the message of a Tee as a stream. Consume runs in its
+// own goroutine, concurrently with the other consumers, and returns its
+// verdict. It may stop reading early; the rest of the message is then not
+// sent to it. A consumer rejecting the message may return the reply as an
+// *smtp.SMTPError error. Consumers must only use the concurrency-safe parts of
+// the context: Logger, Get and Set.
+type StreamConsumer struct {
+	// Name identifies the consumer in logs.
+	Name    string
+	Consume func(ctx *brisa.Context, r io.Reader) (brisa.Action, error)
+}
+
+// TeeConfig configures the Tee middleware.
+type TeeConfig struct {
+	// Consumers receive the message.
+	Consumers []StreamConsumer
+	// ChunkSize is the size of the chunks read from the message. Defaults to
+	// DefaultTeeChunkSize.
+	ChunkSize int
+	// FailClosed rejects the message with ErrTeeConsumerFailed when a consumer
+	// fails. Otherwise the failure is logged and the consumer's verdict is
+	// ignored.
+	FailClosed bool
+}
+
+// Tee streams the message to several consumers at once, such as a virus
+// scanner, a hasher and a storage writer, without buffering it in memory. The
+// message is read chunk by chunk and every chunk is handed to each consumer
+// still reading before the next one is read, so the slowest consumer sets the
+// pace.
+//
+// As soon as a consumer rejects the message, the Tee stops reading it and the
+// other consumers get a read error. With BDAT (CHUNKING), the client is then
+// refused without sending the remaining chunks, so size and content checks
+// need not wait for the whole message.
+//
+// The message is consumed: later middleware and the disposition chains see
+// an empty body, so one of the consumers must store it. Place the Tee last in
+// the data chain.
+type Tee struct {
+	cfg TeeConfig
+}
+
+// NewTee creates a new Tee instance.
+func NewTee(cfg TeeConfig) (*Tee, error) {
+	if len(cfg.Consumers) == 0 {
+		return nil, errors.New("tee needs at least one consumer")
+	}
+	for i, c := range cfg.Consumers {
+		if c.Consume == nil {
+			return nil, fmt.Errorf("consumer %d (%s) has no Consume function", i, c.Name)
+		}
+	}
+	if cfg.ChunkSize < 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", cfg.ChunkSize)
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = DefaultTeeChunkSize
+	}
+	return &Tee{cfg: cfg}, nil
+}
+
+// NewTeeHandler creates a new Data middleware handler that streams the
+// message to the configured consumers.
+func NewTeeHandler(cfg TeeConfig) (brisa.Handler, error) {
+	t, err := NewTee(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return t.Handle, nil
+}
+
+// errTeeStopped is the read error of the consumers still reading when another
+// one rejected the message.
+var errTeeStopped = errors.New("message rejected by another consumer")
+
+type teeResult struct {
+	action brisa.Action
+	err    error
+}
+
+// Handle is the brisa.Handler of the Tee. It returns the most severe verdict
+// of the consumers: Reject, then Quarantine, Discard and Deliver.
+func (t *Tee) Handle(ctx *brisa.Context) brisa.Action {
+	n := len(t.cfg.Consumers)
+	writers := make([]*io.PipeWriter, n)
+	results := make([]teeResult, n)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var wg sync.WaitGroup
+	for i, c := range t.cfg.Consumers {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			action, err := c.Consume(ctx, pr)
+			results[i] = teeResult{action, err}
+			// Unblock the writer if the consumer stopped early.
+			pr.Close()
+			if action == brisa.Reject {
+				stopOnce.Do(func() { close(stop) })
+			}
+		}()
+	}
+
+	readErr := t.copy(ctx.Reader, writers, stop)
+	for _, w := range writers {
+		w.CloseWithError(readErr)
+	}
+	wg.Wait()
+
+	if readErr != nil && readErr != errTeeStopped {
+		ctx.Logger.Error("failed to read message", "error", readErr)
+		return ctx.RejectWith(ErrTeeConsumerFailed)
+	}
+	action := ctx.Action
+	var reply *smtp.SMTPError
+	for i, r := range results {
+		var rejection *smtp.SMTPError
+		if r.action == brisa.Reject && errors.As(r.err, &rejection) {
+			if reply == nil {
+				reply = rejection
+			}
+			action = brisa.Reject
+			continue
+		}
+		if errors.Is(r.err, errTeeStopped) {
+			continue
+		}
+		if r.err != nil {
+			ctx.Logger.Error("stream consumer failed", "consumer", t.cfg.Consumers[i].Name, "error", r.err)
+			if t.cfg.FailClosed {
+				return ctx.RejectWith(ErrTeeConsumerFailed)
+			}
+			continue
+		}
+		if severity(r.action) > severity(action) {
+			action = r.action
+		}
+	}
+	if action == brisa.Reject && reply != nil {
+		return ctx.RejectWith(reply)
+	}
+	return action
+}
+
+// copy reads r chunk by chunk and writes each chunk to the writers whose
+// consumer is still reading, until stop is closed. It returns the read error,
+// if any, or errTeeStopped.
+func (t *Tee) copy(r io.Reader, writers []*io.PipeWriter, stop <-chan struct{}) error {
+	buf := make([]byte, t.cfg.ChunkSize)
+	active := make([]bool, len(writers))
+	for i := range active {
+		active[i] = true
+	}
+	for {
+		select {
+		case <-stop:
+			return errTeeStopped
+		default:
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, w := range writers {
+				if active[i] {
+					if _, werr := w.Write(buf[:n]); werr != nil {
+						active[i] = false
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// severity orders actions for combining verdicts.
+func severity(a brisa.Action) int {
+	switch a {
+	case brisa.Reject:
+		return 4
+	case brisa.Quarantine:
+		return 3
+	case brisa.Discard:
+		return 2
+	case brisa.Deliver:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// SHA256Consumer returns a StreamConsumer that stores the hex SHA-256 digest
+// of the message under MessageSHA256Key.
+func SHA256Consumer() StreamConsumer {
+	return HashConsumer("sha256", MessageSHA256Key, sha256.New)
+}
+
+// HashConsumer returns a StreamConsumer that stores the hex digest of the
+// message computed with newHash under key.
+func HashConsumer(name, key string, newHash func() hash.Hash) StreamConsumer {
+	return StreamConsumer{Name: name, Consume: func(ctx *brisa.Context, r io.Reader) (brisa.Action, error) {
+		h := newHash()
+		if _, err := io.Copy(h, r); err != nil {
+			return brisa.Pass, err
+		}
+		ctx.Set(key, hex.EncodeToString(h.Sum(nil)))
+		return brisa.Pass, nil
+	}}
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTee_Handle(t *testing.T) {
+	message := "Subject: test\r\n\r\n" + strings.Repeat("0123456789", 1000)
+	sum := sha256.Sum256([]byte(message))
+
+	var stored strings.Builder
+	var maxChunk atomic.Int64
+	store := StreamConsumer{Name: "store", Consume: func(ctx *brisa.Context, r io.Reader) (brisa.Action, error) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if int64(n) > maxChunk.Load() {
+				maxChunk.Store(int64(n))
+			}
+			stored.Write(buf[:n])
+			if err == io.EOF {
+				return brisa.Deliver, nil
+			}
+			if err != nil {
+				return brisa.Pass, err
+			}
+		}
+	}}
+	// Stops after the headers; must not block the others.
+	early := StreamConsumer{Name: "early", Consume: func(ctx *brisa.Context, r io.Reader) (brisa.Action, error) {
+		buf := make([]byte, 10)
+		_, err := io.ReadFull(r, buf)
+		return brisa.Pass, err
+	}}
+
+	h, err := NewTeeHandler(TeeConfig{Consumers: []StreamConsumer{store, early, SHA256Consumer()}, ChunkSize: 1024})
+	require.NoError(t, err)
+
+	ctx := newTestContext(t, message)
+	assert.Equal(t, brisa.Deliver, h(ctx))
+	assert.Equal(t, message, stored.String())
+	assert.LessOrEqual(t, maxChunk.Load(), int64(1024))
+	digest, _ := ctx.Get(MessageSHA256Key)
+	assert.Equal(t, hex.EncodeToString(sum[:]), digest)
+}
+
+func TestTee_Verdicts(t *testing.T) {
+	verdict := func(action brisa.Action, err error) StreamConsumer {
+		return StreamConsumer{Name: action.String(), Consume: func(ctx *brisa.Context, r io.Reader) (brisa.Action, error) {
+			io.Copy(io.Discard, r)
+			return action, err
+		}}
+	}
+
+	tests := []struct {
+		name       string
+		consumers  []StreamConsumer
+		failClosed bool
+		want       brisa.Action
+	}{
+		{"most severe wins", []StreamConsumer{verdict(brisa.Deliver, nil), verdict(brisa.Quarantine, nil), verdict(brisa.Discard, nil)}, false, brisa.Quarantine},
+		{"failure ignored", []StreamConsumer{verdict(brisa.Reject, errors.New("scanner down")), verdict(brisa.Deliver, nil)}, false, brisa.Deliver},
+		{"fail closed", []StreamConsumer{verdict(brisa.Deliver, errors.New("scanner down")), verdict(brisa.Deliver, nil)}, true, brisa.Reject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewTeeHandler(TeeConfig{Consumers: tt.consumers, FailClosed: tt.failClosed})
+			require.NoError(t, err)
+			ctx := newTestContext(t, "Subject: test\r\n\r\nbody\r\n")
+			assert.Equal(t, tt.want, h(ctx))
+			if tt.want == brisa.Reject {
+				assert.Equal(t, ErrTeeConsumerFailed, ctx.RejectError())
+			}
+		})
+	}
+}
+
+func TestNewTee_Errors(t *testing.T) {
+	_, err := NewTee(TeeConfig{})
+	assert.Error(t, err)
+	_, err = NewTee(TeeConfig{Consumers: []StreamConsumer{{Name: "nil"}}})
+	assert.Error(t, err)
+	_, err = NewTee(TeeConfig{Consumers: []StreamConsumer{SHA256Consumer()}, ChunkSize: -1})
+	assert.Error(t, err)
+}
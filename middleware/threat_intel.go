@@ -0,0 +1,276 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultThreatIntelKeyPrefix is the default prefix of the cached verdicts in the Store.
+	DefaultThreatIntelKeyPrefix = "intel:"
+	// DefaultThreatIntelCacheTTL is the default lifetime of cached verdicts.
+	DefaultThreatIntelCacheTTL = 24 * time.Hour
+	// DefaultThreatIntelTimeout is the default time budget for feed queries per message.
+	DefaultThreatIntelTimeout = 5 * time.Second
+	// DefaultThreatIntelMaxBytes is the default number of message bytes inspected.
+	DefaultThreatIntelMaxBytes = 25 * 1024 * 1024
+)
+
+// DefaultMalwareBazaarURL is the endpoint of the MalwareBazaar API.
+const DefaultMalwareBazaarURL = "https://mb-api.abuse.ch/api/v1/"
+
+// AttachmentHashesKey is the context key holding the SHA-256 hashes ([]string)
+// of the attachments of the message.
+const AttachmentHashesKey = "intel.attachment_hashes"
+
+// ErrKnownMalware is returned for a message with an attachment that is on the
+// deny list or reported by a threat intelligence feed.
+var ErrKnownMalware = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message contains known malware",
+}
+
+// ThreatIntelFeed is an external source of known-malicious file hashes.
+type ThreatIntelFeed interface {
+	Name() string
+	Lookup(ctx context.Context, sha256 string) (malicious bool, err error)
+}
+
+// ThreatIntelConfig configures the ThreatIntel middleware.
+type ThreatIntelConfig struct {
+	// Allow and Deny are local lists of SHA-256 hashes. Allow wins over Deny and
+	// over the feeds.
+	Allow []string
+	Deny  []string
+	Feeds []ThreatIntelFeed
+	// Store, if set, caches the feed verdicts.
+	Store brisa.Store
+	// KeyPrefix is prepended to the Store keys. Defaults to DefaultThreatIntelKeyPrefix.
+	KeyPrefix string
+	// CacheTTL is the lifetime of cached verdicts. Defaults to DefaultThreatIntelCacheTTL.
+	CacheTTL time.Duration
+	// Timeout bounds the time spent on feed queries per message.
+	// Defaults to DefaultThreatIntelTimeout.
+	Timeout time.Duration
+	// MaxBytes is the number of leading message bytes inspected.
+	// Defaults to DefaultThreatIntelMaxBytes.
+	MaxBytes int64
+}
+
+// ThreatIntel hashes the attachments of a message with SHA-256 and rejects
+// messages carrying known malware, according to local lists and threat
+// intelligence feeds.
+type ThreatIntel struct {
+	cfg   ThreatIntelConfig
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+// NewThreatIntel creates a new ThreatIntel instance.
+func NewThreatIntel(cfg ThreatIntelConfig) (*ThreatIntel, error) {
+	if len(cfg.Deny) == 0 && len(cfg.Feeds) == 0 {
+		return nil, fmt.Errorf("threat intel needs a deny list or at least one feed")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultThreatIntelKeyPrefix
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = DefaultThreatIntelCacheTTL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultThreatIntelTimeout
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultThreatIntelMaxBytes
+	}
+
+	ti := &ThreatIntel{cfg: cfg, allow: make(map[string]struct{}), deny: make(map[string]struct{})}
+	for _, list := range []struct {
+		hashes []string
+		set    map[string]struct{}
+	}{{cfg.Allow, ti.allow}, {cfg.Deny, ti.deny}} {
+		for _, h := range list.hashes {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if len(h) != sha256.Size*2 {
+				return nil, fmt.Errorf("invalid sha256 hash: %s", h)
+			}
+			if _, err := hex.DecodeString(h); err != nil {
+				return nil, fmt.Errorf("invalid sha256 hash: %s", h)
+			}
+			list.set[h] = struct{}{}
+		}
+	}
+	return ti, nil
+}
+
+// NewThreatIntelHandler creates a new Data middleware handler checking attachment hashes.
+func NewThreatIntelHandler(cfg ThreatIntelConfig) (brisa.Handler, error) {
+	ti, err := NewThreatIntel(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ti.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (ti *ThreatIntel) Handle(ctx *brisa.Context) brisa.Action {
+	data, err := readMessagePrefix(ctx, ti.cfg.MaxBytes)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return brisa.Pass
+	}
+
+	var hashes, names []string
+	seen := make(map[string]struct{})
+	walkParts(data, func(p *messagePart) error {
+		if !p.IsAttachment() {
+			return nil
+		}
+		sum := sha256.Sum256(p.Body)
+		h := hex.EncodeToString(sum[:])
+		if _, ok := seen[h]; !ok {
+			seen[h] = struct{}{}
+			hashes = append(hashes, h)
+			names = append(names, p.Filename)
+		}
+		return nil
+	})
+	if len(hashes) == 0 {
+		return brisa.Pass
+	}
+	ctx.Set(AttachmentHashesKey, hashes)
+
+	lookupCtx, cancel := context.WithTimeout(context.Background(), ti.cfg.Timeout)
+	defer cancel()
+
+	for i, h := range hashes {
+		if _, ok := ti.allow[h]; ok {
+			continue
+		}
+		if _, ok := ti.deny[h]; ok {
+			ctx.Logger.Warn("attachment on deny list", "file", names[i], "sha256", h)
+			return ctx.RejectWith(ErrKnownMalware)
+		}
+		if source, malicious := ti.lookup(lookupCtx, ctx, h); malicious {
+			ctx.Logger.Warn("attachment reported as malware", "file", names[i], "sha256", h, "source", source)
+			return ctx.RejectWith(ErrKnownMalware)
+		}
+	}
+	return brisa.Pass
+}
+
+// lookup returns the cached verdict for a hash, or queries the feeds and caches
+// their verdict. A clean verdict is only cached when all feeds answered.
+func (ti *ThreatIntel) lookup(lookupCtx context.Context, ctx *brisa.Context, hash string) (source string, malicious bool) {
+	if len(ti.cfg.Feeds) == 0 {
+		return "", false
+	}
+
+	key := ti.cfg.KeyPrefix + hash
+	if ti.cfg.Store != nil {
+		v, ok, err := ti.cfg.Store.Get(key)
+		if err != nil {
+			ctx.Logger.Error("failed to read cached verdict", "sha256", hash, "error", err)
+		} else if ok {
+			// The cached value is "clean" or the name of the reporting feed.
+			if string(v) == "clean" {
+				return "", false
+			}
+			return string(v), true
+		}
+	}
+
+	complete := true
+	for _, feed := range ti.cfg.Feeds {
+		bad, err := feed.Lookup(lookupCtx, hash)
+		if err != nil {
+			ctx.Logger.Error("threat intel lookup failed", "feed", feed.Name(), "sha256", hash, "error", err)
+			complete = false
+			continue
+		}
+		if bad {
+			source, malicious = feed.Name(), true
+			break
+		}
+	}
+
+	if ti.cfg.Store != nil && (malicious || complete) {
+		verdict := "clean"
+		if malicious {
+			verdict = source
+		}
+		if err := ti.cfg.Store.Set(key, []byte(verdict), ti.cfg.CacheTTL); err != nil {
+			ctx.Logger.Error("failed to cache verdict", "sha256", hash, "error", err)
+		}
+	}
+	return source, malicious
+}
+
+// MalwareBazaarFeed queries the MalwareBazaar database of abuse.ch.
+type MalwareBazaarFeed struct {
+	// APIKey is the abuse.ch Auth-Key.
+	APIKey string
+	// URL defaults to DefaultMalwareBazaarURL.
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Name implements ThreatIntelFeed.
+func (f *MalwareBazaarFeed) Name() string { return "malwarebazaar" }
+
+// Lookup implements ThreatIntelFeed.
+func (f *MalwareBazaarFeed) Lookup(ctx context.Context, sha256 string) (bool, error) {
+	endpoint := f.URL
+	if endpoint == "" {
+		endpoint = DefaultMalwareBazaarURL
+	}
+	form := url.Values{"query": {"get_info"}, "hash": {sha256}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if f.APIKey != "" {
+		req.Header.Set("Auth-Key", f.APIKey)
+	}
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("malwarebazaar: %s", resp.Status)
+	}
+
+	var r struct {
+		QueryStatus string `json:"query_status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return false, fmt.Errorf("invalid malwarebazaar response: %w", err)
+	}
+	switch r.QueryStatus {
+	case "ok":
+		return true, nil
+	case "hash_not_found":
+		return false, nil
+	default:
+		return false, fmt.Errorf("malwarebazaar query failed: %s", r.QueryStatus)
+	}
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeThreatIntelFeed struct {
+	bad     map[string]bool
+	err     error
+	lookups int
+}
+
+func (f *fakeThreatIntelFeed) Name() string { return "fake" }
+
+func (f *fakeThreatIntelFeed) Lookup(ctx context.Context, sha256 string) (bool, error) {
+	f.lookups++
+	return f.bad[sha256], f.err
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestNewThreatIntel(t *testing.T) {
+	_, err := NewThreatIntel(ThreatIntelConfig{})
+	require.Error(t, err)
+
+	_, err = NewThreatIntel(ThreatIntelConfig{Deny: []string{"abc"}})
+	require.Error(t, err)
+}
+
+func TestThreatIntel_Lists(t *testing.T) {
+	ti, err := NewThreatIntel(ThreatIntelConfig{Deny: []string{sha256Hex("EVIL")}})
+	require.NoError(t, err)
+
+	message := sandboxTestMessage("a.bin", "EVIL")
+	ctx := newTestContext(t, message)
+	assert.Equal(t, brisa.Reject, ti.Handle(ctx))
+	assert.Equal(t, ErrKnownMalware, ctx.RejectError())
+	hashes, _ := ctx.Get(AttachmentHashesKey)
+	assert.Equal(t, []string{sha256Hex("EVIL")}, hashes)
+
+	ctx = newTestContext(t, sandboxTestMessage("a.bin", "fine"))
+	assert.Equal(t, brisa.Pass, ti.Handle(ctx))
+	assert.Equal(t, sandboxTestMessage("a.bin", "fine"), readTestMessage(t, ctx))
+
+	ti, err = NewThreatIntel(ThreatIntelConfig{Allow: []string{sha256Hex("EVIL")}, Deny: []string{sha256Hex("EVIL")}})
+	require.NoError(t, err)
+	assert.Equal(t, brisa.Pass, ti.Handle(newTestContext(t, message)))
+}
+
+func TestThreatIntel_FeedsAndCache(t *testing.T) {
+	feed := &fakeThreatIntelFeed{bad: map[string]bool{sha256Hex("EVIL"): true}}
+	store := brisa.NewMemoryStore()
+	ti, err := NewThreatIntel(ThreatIntelConfig{Feeds: []ThreatIntelFeed{feed}, Store: store})
+	require.NoError(t, err)
+
+	bad := sandboxTestMessage("a.bin", "EVIL")
+	assert.Equal(t, brisa.Reject, ti.Handle(newTestContext(t, bad)))
+	assert.Equal(t, brisa.Reject, ti.Handle(newTestContext(t, bad)))
+	assert.Equal(t, 1, feed.lookups)
+	v, ok, err := store.Get(DefaultThreatIntelKeyPrefix + sha256Hex("EVIL"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "fake", string(v))
+
+	good := sandboxTestMessage("a.bin", "fine")
+	assert.Equal(t, brisa.Pass, ti.Handle(newTestContext(t, good)))
+	assert.Equal(t, brisa.Pass, ti.Handle(newTestContext(t, good)))
+	assert.Equal(t, 2, feed.lookups)
+
+	// Failed lookups are not cached.
+	feed.err = errors.New("unavailable")
+	other := sandboxTestMessage("a.bin", "other")
+	assert.Equal(t, brisa.Pass, ti.Handle(newTestContext(t, other)))
+	assert.Equal(t, brisa.Pass, ti.Handle(newTestContext(t, other)))
+	assert.Equal(t, 4, feed.lookups)
+}
+
+func TestMalwareBazaarFeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("Auth-Key"))
+		assert.Equal(t, "get_info", r.FormValue("query"))
+		switch r.FormValue("hash") {
+		case "bad":
+			fmt.Fprint(w, `{"query_status":"ok","data":[{"signature":"Emotet"}]}`)
+		case "good":
+			fmt.Fprint(w, `{"query_status":"hash_not_found"}`)
+		default:
+			fmt.Fprint(w, `{"query_status":"illegal_hash"}`)
+		}
+	}))
+	defer server.Close()
+
+	feed := &MalwareBazaarFeed{APIKey: "secret", URL: server.URL}
+	malicious, err := feed.Lookup(context.Background(), "bad")
+	require.NoError(t, err)
+	assert.True(t, malicious)
+
+	malicious, err = feed.Lookup(context.Background(), "good")
+	require.NoError(t, err)
+	assert.False(t, malicious)
+
+	_, err = feed.Lookup(context.Background(), "x")
+	require.Error(t, err)
+}
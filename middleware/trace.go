@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+// TraceHeader is the header field carrying the signed trace of a hop.
+const TraceHeader = "X-Brisa-Trace"
+
+// TraceHopsKey is the context key holding the verified traces ([]TraceInfo)
+// of the earlier passes of the message through Brisa, oldest first.
+const TraceHopsKey = "trace.hops"
+
+// ErrInvalidTrace is returned by VerifyTrace for malformed traces and traces
+// with a wrong signature.
+var ErrInvalidTrace = errors.New("invalid trace header")
+
+// TraceInfo identifies one pass of a message through Brisa.
+type TraceInfo struct {
+	Host      string
+	SessionID string
+	MailID    string
+	Time      time.Time
+}
+
+// TraceConfig configures the Trace middleware.
+type TraceConfig struct {
+	// Secret signs the traces. It is required and must be shared by all
+	// instances whose traces should be trusted.
+	Secret []byte
+	// Hostname names this server in the traces.
+	Hostname string
+	// Clock defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// Trace adds a signed TraceHeader with the session and mail IDs to every
+// message, and verifies the traces of messages that come back, e.g. released
+// from quarantine or looping, so that their logs can be correlated across
+// hops. Traces with a wrong signature are ignored, as anyone can add them.
+type Trace struct {
+	cfg TraceConfig
+}
+
+// NewTrace creates a new Trace instance.
+func NewTrace(cfg TraceConfig) (*Trace, error) {
+	if len(cfg.Secret) == 0 {
+		return nil, fmt.Errorf("trace secret is required")
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+	return &Trace{cfg: cfg}, nil
+}
+
+// NewTraceHandler creates a new Data middleware handler adding trace headers.
+func NewTraceHandler(cfg TraceConfig) (brisa.Handler, error) {
+	t, err := NewTrace(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return t.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (t *Trace) Handle(ctx *brisa.Context) brisa.Action {
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return ctx.Action
+	}
+	defer setMessage(ctx, h, body)
+
+	// Each hop prepends its trace, so the header lists the newest first.
+	values := h.Values(TraceHeader)
+	var hops []TraceInfo
+	for i := len(values) - 1; i >= 0; i-- {
+		info, err := t.Verify(values[i])
+		if err != nil {
+			ctx.Logger.Debug("ignoring trace header", "value", values[i], "error", err)
+			continue
+		}
+		hops = append(hops, info)
+	}
+	if len(hops) > 0 {
+		prev := hops[len(hops)-1]
+		ctx.Set(TraceHopsKey, hops)
+		ctx.Logger.Info("message seen before", "hops", len(hops), "prev_host", prev.Host,
+			"prev_session_id", prev.SessionID, "prev_mail_id", prev.MailID)
+	}
+
+	info := TraceInfo{Host: t.cfg.Hostname, Time: t.cfg.Clock.Now()}
+	if ctx.Session != nil {
+		info.SessionID = ctx.Session.ID()
+		info.MailID = ctx.Session.MailID()
+	}
+	h.Prepend(TraceHeader, t.Sign(info))
+	return ctx.Action
+}
+
+// Sign returns the TraceHeader value for info.
+func (t *Trace) Sign(info TraceInfo) string {
+	fields := fmt.Sprintf("v=1; h=%s; s=%s; m=%s; t=%d", info.Host, info.SessionID, info.MailID, info.Time.Unix())
+	return fields + "; b=" + t.signature(fields)
+}
+
+// Verify parses a TraceHeader value and checks its signature.
+func (t *Trace) Verify(value string) (TraceInfo, error) {
+	fields, sig, ok := strings.Cut(value, "; b=")
+	if !ok || !hmac.Equal([]byte(sig), []byte(t.signature(fields))) {
+		return TraceInfo{}, ErrInvalidTrace
+	}
+
+	var info TraceInfo
+	for _, field := range strings.Split(fields, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch k {
+		case "v":
+			if v != "1" {
+				return TraceInfo{}, fmt.Errorf("%w: unknown version %s", ErrInvalidTrace, v)
+			}
+		case "h":
+			info.Host = v
+		case "s":
+			info.SessionID = v
+		case "m":
+			info.MailID = v
+		case "t":
+			sec, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return TraceInfo{}, fmt.Errorf("%w: bad time %s", ErrInvalidTrace, v)
+			}
+			info.Time = time.Unix(sec, 0)
+		}
+	}
+	return info, nil
+}
+
+func (t *Trace) signature(fields string) string {
+	mac := hmac.New(sha256.New, t.cfg.Secret)
+	mac.Write([]byte(fields))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTrace(t *testing.T) {
+	_, err := NewTrace(TraceConfig{})
+	require.Error(t, err)
+}
+
+func TestTrace_SignVerify(t *testing.T) {
+	tr, err := NewTrace(TraceConfig{Secret: []byte("secret")})
+	require.NoError(t, err)
+
+	info := TraceInfo{Host: "mx1.example.com", SessionID: "s1", MailID: "m1", Time: time.Unix(1700000000, 0)}
+	value := tr.Sign(info)
+	got, err := tr.Verify(value)
+	require.NoError(t, err)
+	assert.Equal(t, info, got)
+
+	_, err = tr.Verify(strings.Replace(value, "m=m1", "m=m2", 1))
+	assert.ErrorIs(t, err, ErrInvalidTrace)
+
+	other, _ := NewTrace(TraceConfig{Secret: []byte("other")})
+	_, err = other.Verify(value)
+	assert.ErrorIs(t, err, ErrInvalidTrace)
+}
+
+func TestTrace_Handle(t *testing.T) {
+	tr, err := NewTrace(TraceConfig{Secret: []byte("secret"), Hostname: "mx1.example.com"})
+	require.NoError(t, err)
+
+	// First pass: a trace is added.
+	ctx := brisatest.NewContext(t, brisatest.DefaultEnvelope(), "Subject: hi\r\n\r\nbody\r\n")
+	assert.Equal(t, brisa.Pass, tr.Handle(ctx))
+	first := brisatest.ReadMessage(t, ctx)
+	require.True(t, strings.HasPrefix(first, TraceHeader+": v=1; h=mx1.example.com; s="+ctx.Session.ID()+"; m="))
+	_, seen := ctx.Get(TraceHopsKey)
+	assert.False(t, seen)
+	firstSession := ctx.Session.ID()
+
+	// The message comes back with a forged trace added by someone else.
+	forged := TraceHeader + ": v=1; h=evil; s=x; m=y; t=0; b=AAAA\r\n"
+	ctx = brisatest.NewContext(t, brisatest.DefaultEnvelope(), forged+first)
+	assert.Equal(t, brisa.Pass, tr.Handle(ctx))
+	v, seen := ctx.Get(TraceHopsKey)
+	require.True(t, seen)
+	hops := v.([]TraceInfo)
+	require.Len(t, hops, 1)
+	assert.Equal(t, firstSession, hops[0].SessionID)
+	assert.Equal(t, "mx1.example.com", hops[0].Host)
+	assert.Equal(t, 3, strings.Count(brisatest.ReadMessage(t, ctx), TraceHeader+":"))
+}
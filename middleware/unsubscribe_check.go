@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa"
+)
+
+// UnsubscribeViolationsKey is the context key holding the List-Unsubscribe
+// violations ([]string) of a non-compliant message.
+const UnsubscribeViolationsKey = "unsubscribe.violations"
+
+// Violations found by UnsubscribeCheck.
+const (
+	UnsubscribeMissing         = "missing_list_unsubscribe"
+	UnsubscribeInvalidTarget   = "invalid_unsubscribe_target"
+	UnsubscribeMissingPost     = "missing_one_click"
+	UnsubscribeInvalidPost     = "invalid_one_click"
+	UnsubscribeNoHTTPSOneClick = "one_click_without_https"
+)
+
+// ErrUnsubscribeNonCompliant is returned for bulk mail without a valid
+// List-Unsubscribe header.
+var ErrUnsubscribeNonCompliant = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Bulk mail must carry valid List-Unsubscribe and List-Unsubscribe-Post headers",
+}
+
+// UnsubscribeAction defines what UnsubscribeCheck does with a non-compliant
+// message.
+type UnsubscribeAction int
+
+const (
+	// UnsubscribeReject refuses the message with ErrUnsubscribeNonCompliant.
+	UnsubscribeReject UnsubscribeAction = iota
+	// UnsubscribeFlag lets the message through, adding Score to it.
+	UnsubscribeFlag
+)
+
+// UnsubscribeCheckConfig configures the UnsubscribeCheck middleware.
+type UnsubscribeCheckConfig struct {
+	// Streams are the streams (see MessageStreamKey) checked. Defaults to
+	// DefaultBulkStream.
+	Streams []string
+	// AllowNoOneClick accepts messages without one-click unsubscription
+	// (RFC 8058), which large mailbox providers require of bulk senders.
+	AllowNoOneClick bool
+	// Action defaults to UnsubscribeReject.
+	Action UnsubscribeAction
+	// Score is added to flagged messages.
+	Score float64
+}
+
+// UnsubscribeCheck enforces the List-Unsubscribe header (RFC 2369) on
+// outbound bulk mail, so that campaigns that recipients cannot leave do not
+// damage the reputation of the sending IPs and domains. The header must list
+// mailto: or https: targets, and one-click unsubscription (RFC 8058) needs
+// "List-Unsubscribe-Post: List-Unsubscribe=One-Click" and an https: target.
+//
+// It runs in the Data chain of outbound mail, after the stream of the message
+// is known, e.g. from a BulkClassifier. Violations are logged and recorded
+// under UnsubscribeViolationsKey.
+type UnsubscribeCheck struct {
+	cfg UnsubscribeCheckConfig
+}
+
+// NewUnsubscribeCheck creates a new UnsubscribeCheck instance.
+func NewUnsubscribeCheck(cfg UnsubscribeCheckConfig) (*UnsubscribeCheck, error) {
+	if cfg.Score < 0 {
+		return nil, fmt.Errorf("unsubscribe check score must not be negative")
+	}
+	if len(cfg.Streams) == 0 {
+		cfg.Streams = []string{DefaultBulkStream}
+	}
+	return &UnsubscribeCheck{cfg: cfg}, nil
+}
+
+// NewUnsubscribeCheckHandler creates a new Data middleware handler checking
+// List-Unsubscribe compliance.
+func NewUnsubscribeCheckHandler(cfg UnsubscribeCheckConfig) (brisa.Handler, error) {
+	c, err := NewUnsubscribeCheck(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware.
+func (c *UnsubscribeCheck) Handle(ctx *brisa.Context) brisa.Action {
+	stream, _ := ctx.Get(MessageStreamKey)
+	if s, ok := stream.(string); !ok || !slices.Contains(c.cfg.Streams, s) {
+		return brisa.Pass
+	}
+	h, body, err := readMessageHeader(ctx)
+	if err != nil {
+		ctx.Logger.Error("failed to read message header", "error", err)
+		return brisa.Pass
+	}
+	setMessage(ctx, h, body)
+
+	violations := c.check(h)
+	if len(violations) == 0 {
+		return brisa.Pass
+	}
+	ctx.Set(UnsubscribeViolationsKey, violations)
+	ctx.Logger.Warn("bulk mail without valid unsubscription", "violations", violations, "from", ctx.From)
+	if c.cfg.Action == UnsubscribeFlag {
+		ctx.Score += c.cfg.Score
+		return brisa.Pass
+	}
+	return ctx.RejectWith(ErrUnsubscribeNonCompliant)
+}
+
+// check returns the violations of a message header.
+func (c *UnsubscribeCheck) check(h *messageHeader) []string {
+	value := h.Get("List-Unsubscribe")
+	if value == "" {
+		return []string{UnsubscribeMissing}
+	}
+	var violations []string
+	targets, ok := unsubscribeTargets(value)
+	if !ok {
+		violations = append(violations, UnsubscribeInvalidTarget)
+	}
+	if c.cfg.AllowNoOneClick && !h.Has("List-Unsubscribe-Post") {
+		return violations
+	}
+	switch post := h.Get("List-Unsubscribe-Post"); {
+	case post == "":
+		violations = append(violations, UnsubscribeMissingPost)
+	case post != "List-Unsubscribe=One-Click":
+		violations = append(violations, UnsubscribeInvalidPost)
+	case !slices.ContainsFunc(targets, func(u *url.URL) bool { return u.Scheme == "https" }):
+		violations = append(violations, UnsubscribeNoHTTPSOneClick)
+	}
+	return violations
+}
+
+// unsubscribeTargets parses the angle-bracketed URIs of a List-Unsubscribe
+// value. ok is false if any is not a valid mailto: or https: URI, or there is
+// none.
+func unsubscribeTargets(value string) (targets []*url.URL, ok bool) {
+	ok = true
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		raw, found := strings.CutPrefix(item, "<")
+		raw, closed := strings.CutSuffix(raw, ">")
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if !found || !closed || err != nil || !validUnsubscribeTarget(u) {
+			ok = false
+			continue
+		}
+		targets = append(targets, u)
+	}
+	return targets, ok && len(targets) > 0
+}
+
+func validUnsubscribeTarget(u *url.URL) bool {
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		u.Scheme = "https"
+		return u.Host != ""
+	case "mailto":
+		u.Scheme = "mailto"
+		_, err := mail.ParseAddress(u.Opaque)
+		return err == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runUnsubscribeCheck(t *testing.T, c *UnsubscribeCheck, stream, header string) (*brisatest.Result, any) {
+	t.Helper()
+	var violations any
+	router := &brisa.Router{brisa.ChainData: {
+		{Handler: func(ctx *brisa.Context) brisa.Action {
+			if stream != "" {
+				ctx.Set(MessageStreamKey, stream)
+			}
+			return brisa.Pass
+		}},
+		{Handler: c.Handle},
+		{Handler: func(ctx *brisa.Context) brisa.Action {
+			violations, _ = ctx.Get(UnsubscribeViolationsKey)
+			return brisa.Pass
+		}},
+	}}
+	return brisatest.Run(t, router, brisatest.DefaultEnvelope(), header+"\r\nbody\r\n"), violations
+}
+
+func TestUnsubscribeCheck(t *testing.T) {
+	c, err := NewUnsubscribeCheck(UnsubscribeCheckConfig{})
+	require.NoError(t, err)
+	flag, err := NewUnsubscribeCheck(UnsubscribeCheckConfig{Action: UnsubscribeFlag})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		header     string
+		violations []string
+	}{
+		{"compliant", "List-Unsubscribe: <mailto:u@example.com?subject=unsub>, <https://example.com/u?id=1>\r\n" +
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n", nil},
+		{"missing", "Subject: sale\r\n", []string{UnsubscribeMissing}},
+		{"no one-click", "List-Unsubscribe: <https://example.com/u>\r\n", []string{UnsubscribeMissingPost}},
+		{"bad post", "List-Unsubscribe: <https://example.com/u>\r\nList-Unsubscribe-Post: yes\r\n", []string{UnsubscribeInvalidPost}},
+		{"mailto only", "List-Unsubscribe: <mailto:u@example.com>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+			[]string{UnsubscribeNoHTTPSOneClick}},
+		{"http target", "List-Unsubscribe: <http://example.com/u>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+			[]string{UnsubscribeInvalidTarget, UnsubscribeNoHTTPSOneClick}},
+		{"no brackets", "List-Unsubscribe: https://example.com/u\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+			[]string{UnsubscribeInvalidTarget, UnsubscribeNoHTTPSOneClick}},
+		{"bad mailto", "List-Unsubscribe: <mailto:nobody>, <https://example.com/u>\r\nList-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+			[]string{UnsubscribeInvalidTarget}},
+	}
+	for _, tt := range tests {
+		res, violations := runUnsubscribeCheck(t, c, "bulk", tt.header)
+		if tt.violations == nil {
+			res.AssertAction(t, brisa.Deliver)
+			assert.Nil(t, violations, tt.name)
+			continue
+		}
+		res.AssertAction(t, brisa.Reject)
+		assert.Equal(t, ErrUnsubscribeNonCompliant, res.Err, tt.name)
+		_, violations = runUnsubscribeCheck(t, flag, "bulk", tt.header)
+		assert.Equal(t, tt.violations, violations, tt.name)
+	}
+
+	// 非批量邮件不检查
+	res, _ := runUnsubscribeCheck(t, c, "", "Subject: hi\r\n")
+	res.AssertAction(t, brisa.Deliver)
+	res, _ = runUnsubscribeCheck(t, c, "transactional", "Subject: hi\r\n")
+	res.AssertAction(t, brisa.Deliver)
+}
+
+func TestUnsubscribeCheck_Flag(t *testing.T) {
+	c, err := NewUnsubscribeCheck(UnsubscribeCheckConfig{Action: UnsubscribeFlag, Score: 4, AllowNoOneClick: true, Streams: []string{"marketing"}})
+	require.NoError(t, err)
+
+	res, violations := runUnsubscribeCheck(t, c, "marketing", "List-Unsubscribe: <mailto:u@example.com>\r\n")
+	res.AssertAction(t, brisa.Deliver)
+	assert.Nil(t, violations)
+
+	res, violations = runUnsubscribeCheck(t, c, "marketing", "List-Unsubscribe: <ftp://example.com/u>\r\n")
+	res.AssertAction(t, brisa.Deliver)
+	assert.Equal(t, []string{UnsubscribeInvalidTarget}, violations)
+	assert.Equal(t, 4.0, res.Score)
+}
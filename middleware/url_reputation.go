@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultURLListedScore is the default score added per URL domain found on a DNS list.
+	DefaultURLListedScore = 5.0
+	// DefaultURLMaxURLs is the default maximum number of distinct URLs checked per message.
+	DefaultURLMaxURLs = 20
+	// DefaultURLTimeout is the default time budget for all lookups of one message.
+	DefaultURLTimeout = 5 * time.Second
+	// DefaultURLMaxBytes is the default number of message bytes scanned for URLs.
+	DefaultURLMaxBytes = 1024 * 1024
+)
+
+// URLsKey is the context key holding the normalized URLs ([]string) found in
+// the message. URLListedKey holds the URLs ([]string) reported as bad.
+const (
+	URLsKey      = "url.urls"
+	URLListedKey = "url.listed"
+)
+
+var (
+	urlTextPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"'(){}\[\]]+`)
+	urlHrefPattern = regexp.MustCompile(`(?i)\bhref\s*=\s*["']?([^"'\s>]+)`)
+)
+
+// Resolver resolves host names. *net.Resolver and *DNSResolver implement it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// URLChecker checks URLs against an external reputation service, such as a
+// Safe Browsing style API, and returns the URLs it considers malicious.
+type URLChecker func(ctx context.Context, urls []string) (malicious []string, err error)
+
+// URLReputationConfig configures the URLReputation middleware.
+type URLReputationConfig struct {
+	// Zones are the DNS list zones to query, e.g. "multi.surbl.org" or "multi.uribl.com".
+	Zones []string
+	// Checker is an optional external URL reputation service.
+	Checker URLChecker
+	// ListedScore is added to the context score for each bad URL.
+	// Defaults to DefaultURLListedScore.
+	ListedScore float64
+	// MaxURLs bounds the number of distinct URLs checked. Defaults to DefaultURLMaxURLs.
+	MaxURLs int
+	// Timeout bounds the time spent on lookups per message. Defaults to DefaultURLTimeout.
+	Timeout time.Duration
+	// MaxBytes is the number of leading message bytes scanned. Defaults to DefaultURLMaxBytes.
+	MaxBytes int64
+	// Resolver is used for DNS list queries. Defaults to SharedResolver().
+	Resolver Resolver
+}
+
+// URLReputation extracts URLs from the text and HTML parts of a message and
+// checks their domains against SURBL/URIBL style DNS lists and an optional
+// external checker, adding to the context score for every bad URL.
+type URLReputation struct {
+	cfg URLReputationConfig
+}
+
+// NewURLReputation creates a new URLReputation instance.
+func NewURLReputation(cfg URLReputationConfig) (*URLReputation, error) {
+	if len(cfg.Zones) == 0 && cfg.Checker == nil {
+		return nil, fmt.Errorf("url reputation needs at least one DNS list zone or a checker")
+	}
+	if cfg.ListedScore == 0 {
+		cfg.ListedScore = DefaultURLListedScore
+	}
+	if cfg.MaxURLs <= 0 {
+		cfg.MaxURLs = DefaultURLMaxURLs
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultURLTimeout
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultURLMaxBytes
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = SharedResolver()
+	}
+	return &URLReputation{cfg: cfg}, nil
+}
+
+// NewURLReputationHandler creates a new Data middleware handler checking URL reputation.
+func NewURLReputationHandler(cfg URLReputationConfig) (brisa.Handler, error) {
+	ur, err := NewURLReputation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ur.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It must run in the Data chain.
+func (ur *URLReputation) Handle(ctx *brisa.Context) brisa.Action {
+	data, err := readMessagePrefix(ctx, ur.cfg.MaxBytes)
+	if err != nil {
+		ctx.Logger.Error("failed to read message", "error", err)
+		return brisa.Pass
+	}
+
+	urls := extractURLs(data, ur.cfg.MaxURLs)
+	if len(urls) == 0 {
+		return brisa.Pass
+	}
+	ctx.Set(URLsKey, urls)
+
+	lookupCtx, cancel := context.WithTimeout(context.Background(), ur.cfg.Timeout)
+	defer cancel()
+
+	listed := make(map[string]struct{})
+	for _, u := range urls {
+		if zone, ok := ur.listedInZones(lookupCtx, u); ok {
+			ctx.Logger.Info("URL listed on DNS list", "url", u, "zone", zone)
+			listed[u] = struct{}{}
+		}
+	}
+
+	if ur.cfg.Checker != nil {
+		malicious, err := ur.cfg.Checker(lookupCtx, urls)
+		if err != nil {
+			ctx.Logger.Error("URL reputation check failed", "error", err)
+		}
+		for _, u := range malicious {
+			ctx.Logger.Info("URL reported as malicious", "url", u)
+			listed[u] = struct{}{}
+		}
+	}
+
+	if len(listed) > 0 {
+		bad := make([]string, 0, len(listed))
+		for _, u := range urls {
+			if _, ok := listed[u]; ok {
+				bad = append(bad, u)
+			}
+		}
+		ctx.Set(URLListedKey, bad)
+		ctx.Score += ur.cfg.ListedScore * float64(len(bad))
+	}
+	return brisa.Pass
+}
+
+// listedInZones reports whether the domain of rawURL is listed in one of the
+// configured zones, and in which.
+func (ur *URLReputation) listedInZones(ctx context.Context, rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	for _, zone := range ur.cfg.Zones {
+		for _, name := range urlLookupNames(u.Hostname()) {
+			addrs, err := ur.cfg.Resolver.LookupHost(ctx, name+"."+zone)
+			if err != nil {
+				continue // NXDOMAIN: not listed
+			}
+			if dnsListListed(addrs) {
+				return zone, true
+			}
+		}
+	}
+	return "", false
+}
+
+// dnsListListed reports whether a DNS list answer means "listed". Answers are in
+// 127.0.0.0/8; 127.0.0.1 is used by several lists to signal a refused query.
+func dnsListListed(addrs []string) bool {
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+		ip4 := ip.To4()
+		if ip4[0] == 127 && !ip4.Equal(net.IPv4(127, 0, 0, 1)) {
+			return true
+		}
+	}
+	return false
+}
+
+// urlLookupNames returns the names to query for a URL host: the reversed
+// address for IP literals, otherwise its base domain candidates. Without a
+// public suffix list both the two- and three-label suffixes are queried.
+func urlLookupNames(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return []string{fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])}
+		}
+		return nil
+	}
+
+	labels := strings.Split(strings.Trim(host, "."), ".")
+	if len(labels) < 2 {
+		return nil
+	}
+	names := []string{strings.Join(labels[len(labels)-2:], ".")}
+	if len(labels) > 2 {
+		names = append(names, strings.Join(labels[len(labels)-3:], "."))
+	}
+	return names
+}
+
+// extractURLs returns up to max distinct, normalized http(s) URLs found in the
+// text and HTML parts of the message.
+func extractURLs(data []byte, max int) []string {
+	seen := make(map[string]struct{})
+	var urls []string
+	add := func(raw string) {
+		if len(urls) >= max {
+			return
+		}
+		u := normalizeURL(raw)
+		if u == "" {
+			return
+		}
+		if _, ok := seen[u]; !ok {
+			seen[u] = struct{}{}
+			urls = append(urls, u)
+		}
+	}
+
+	walkParts(data, func(p *messagePart) error {
+		switch p.MediaType {
+		case "text/html":
+			text := string(p.Body)
+			for _, m := range urlHrefPattern.FindAllStringSubmatch(text, -1) {
+				add(html.UnescapeString(m[1]))
+			}
+			for _, m := range urlTextPattern.FindAllString(html.UnescapeString(text), -1) {
+				add(m)
+			}
+		case "text/plain":
+			for _, m := range urlTextPattern.FindAllString(string(p.Body), -1) {
+				add(m)
+			}
+		}
+		if len(urls) >= max {
+			return errStopWalk
+		}
+		return nil
+	})
+	return urls
+}
+
+// normalizeURL returns the canonical form of an http(s) URL: lower-case scheme
+// and host, no default port, no fragment and no trailing punctuation. It
+// returns an empty string for anything that is not an http(s) URL.
+func normalizeURL(raw string) string {
+	raw = strings.TrimRight(strings.TrimSpace(raw), ".,;:!?")
+	if strings.HasPrefix(strings.ToLower(raw), "www.") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return ""
+	}
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]" // IPv6 literal
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	u.User = nil
+	u.Fragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	testCases := map[string]string{
+		"HTTP://User@Example.COM:80/a#frag": "http://example.com/a",
+		"https://example.com:443":           "https://example.com/",
+		"https://example.com:8443/x?y=1":    "https://example.com:8443/x?y=1",
+		"www.example.com/offer.":            "http://www.example.com/offer",
+		"ftp://example.com/":                "",
+		"http://":                           "",
+	}
+	for raw, want := range testCases {
+		assert.Equal(t, want, normalizeURL(raw), raw)
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	message := "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee http://a.example.com/x and www.b.example.org.\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<a href=\"https://c.example.net/?a=1&amp;b=2\">http://a.example.com/x</a>\r\n" +
+		"--b--\r\n"
+
+	urls := extractURLs([]byte(message), 10)
+	assert.Equal(t, []string{
+		"http://a.example.com/x",
+		"http://www.b.example.org/",
+		"https://c.example.net/?a=1&b=2",
+	}, urls)
+
+	assert.Len(t, extractURLs([]byte(message), 2), 2)
+}
+
+func TestURLReputation_Handle(t *testing.T) {
+	resolver := &brisatest.FakeResolver{Hosts: map[string][]string{
+		"bad.com.multi.surbl.org":     {"127.0.0.2"},
+		"refused.com.multi.surbl.org": {"127.0.0.1"},
+		"4.3.2.1.multi.surbl.org":     {"127.0.0.4"},
+		"phish.co.uk.multi.surbl.org": {"127.0.0.8"},
+	}}
+
+	ur, err := NewURLReputation(URLReputationConfig{
+		Zones:       []string{"multi.surbl.org"},
+		Resolver:    resolver,
+		ListedScore: 2,
+		Checker: func(ctx context.Context, urls []string) ([]string, error) {
+			return []string{"http://malware.example/"}, nil
+		},
+	})
+	require.NoError(t, err)
+
+	message := "Subject: links\r\n\r\n" +
+		"http://www.bad.com/x http://ok.com/ http://refused.com/ http://1.2.3.4/ " +
+		"http://shop.phish.co.uk/ http://malware.example/\r\n"
+	ctx := newTestContext(t, message)
+
+	assert.Equal(t, brisa.Pass, ur.Handle(ctx))
+
+	listed, ok := ctx.Get(URLListedKey)
+	require.True(t, ok)
+	assert.Equal(t, []string{
+		"http://www.bad.com/x",
+		"http://1.2.3.4/",
+		"http://shop.phish.co.uk/",
+		"http://malware.example/",
+	}, listed)
+	assert.Equal(t, 8.0, ctx.Score)
+	assert.Equal(t, message, readTestMessage(t, ctx))
+}
+
+func TestNewURLReputation(t *testing.T) {
+	_, err := NewURLReputation(URLReputationConfig{})
+	require.Error(t, err)
+}
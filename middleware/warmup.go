@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/address"
+)
+
+// DefaultWarmUpKeyPrefix is the default prefix of the Store keys written by
+// WarmUp.
+const DefaultWarmUpKeyPrefix = "warmup:"
+
+// WarmUpConfig configures the WarmUp middleware.
+type WarmUpConfig struct {
+	// Store holds the daily counters. It is required.
+	Store brisa.Store
+	// KeyPrefix is prepended to all Store keys. Defaults to DefaultWarmUpKeyPrefix.
+	KeyPrefix string
+	// Identities map the sending identities being warmed up, such as a new
+	// source address or sending domain, to the first day of their warm-up.
+	// Other identities are not limited.
+	Identities map[string]time.Time
+	// Schedule is the ramp: the number of messages an identity may send to
+	// one destination domain on each day of its warm-up, e.g. 50, 100, 200.
+	// After the last day the identity is warm. It is required.
+	Schedule []int64
+	// Identity returns the sending identity of a message, e.g. the name of
+	// the source address the delivery will use. Defaults to the domain of
+	// the envelope sender.
+	Identity func(ctx *brisa.Context) string
+	// Location is where days start. Defaults to time.UTC.
+	Location *time.Location
+	// Clock defaults to brisa.SystemClock.
+	Clock brisa.Clock
+}
+
+// WarmUp brings new sending IPs and domains online safely by capping their
+// daily volume per destination domain according to a ramp schedule. A
+// message over the cap of today is scheduled with DeferDelivery for the first
+// day with room left for all its recipient domains, so the delivery queue
+// sends the excess on later days instead of bursting.
+//
+// It runs in the Deliver chain of outbound mail. A message reserves its place
+// in the counters of the day it is scheduled for, so deferred messages do not
+// exceed the caps of later days.
+type WarmUp struct {
+	cfg        WarmUpConfig
+	identities map[string]time.Time
+}
+
+// NewWarmUp creates a new WarmUp instance.
+func NewWarmUp(cfg WarmUpConfig) (*WarmUp, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("warm-up store is required")
+	}
+	if len(cfg.Schedule) == 0 {
+		return nil, fmt.Errorf("warm-up schedule is required")
+	}
+	for i, n := range cfg.Schedule {
+		if n <= 0 {
+			return nil, fmt.Errorf("warm-up day %d: cap must be positive", i+1)
+		}
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = DefaultWarmUpKeyPrefix
+	}
+	if cfg.Identity == nil {
+		cfg.Identity = func(ctx *brisa.Context) string { return address.NormalizeDomain(address.Domain(ctx.From)) }
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = brisa.SystemClock
+	}
+	w := &WarmUp{cfg: cfg, identities: make(map[string]time.Time, len(cfg.Identities))}
+	for id, start := range cfg.Identities {
+		w.identities[id] = w.day(start)
+	}
+	return w, nil
+}
+
+// NewWarmUpHandler creates a new Deliver middleware handler capping the
+// volume of identities being warmed up.
+func NewWarmUpHandler(cfg WarmUpConfig) (brisa.Handler, error) {
+	w, err := NewWarmUp(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return w.Handle, nil
+}
+
+// Handle is the brisa.Handler of the middleware. It leaves the action
+// unchanged.
+func (w *WarmUp) Handle(ctx *brisa.Context) brisa.Action {
+	id := w.cfg.Identity(ctx)
+	start, ok := w.identities[id]
+	if !ok {
+		return ctx.Action
+	}
+	var domains []string
+	for _, rcpt := range ctx.To {
+		if d := address.NormalizeDomain(address.Domain(rcpt)); !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+
+	today := w.day(w.cfg.Clock.Now())
+	for day := today; ; day = day.AddDate(0, 0, 1) {
+		limit := w.limit(start, day)
+		if limit == 0 {
+			// The identity is warm by then.
+			w.schedule(ctx, id, today, day)
+			return ctx.Action
+		}
+		reserved, err := w.reserve(id, domains, day, limit)
+		if err != nil {
+			// Fail open: a broken Store must not hold mail back.
+			ctx.Logger.Error("failed to count warm-up volume", "identity", id, "error", err)
+			return ctx.Action
+		}
+		if reserved {
+			w.schedule(ctx, id, today, day)
+			return ctx.Action
+		}
+	}
+}
+
+// schedule defers the message of ctx to day if it is after today.
+func (w *WarmUp) schedule(ctx *brisa.Context, id string, today, day time.Time) {
+	if day.After(today) {
+		ctx.Logger.Info("delivery deferred for warm-up", "identity", id, "until", day)
+		DeferDelivery(ctx, day)
+	}
+}
+
+// reserve counts a message to domains on day, unless one of them already
+// reached limit.
+func (w *WarmUp) reserve(id string, domains []string, day time.Time, limit int64) (bool, error) {
+	// Keep the counters a day beyond the end of theirs.
+	ttl := day.AddDate(0, 0, 2).Sub(w.cfg.Clock.Now())
+	var keys []string
+	for _, d := range domains {
+		key := w.cfg.KeyPrefix + id + "|" + d + "|" + day.Format(time.DateOnly)
+		n, err := w.cfg.Store.Incr(key, 1, ttl)
+		if err != nil {
+			w.release(keys, ttl)
+			return false, err
+		}
+		keys = append(keys, key)
+		if n > limit {
+			w.release(keys, ttl)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// release takes back the counts of keys.
+func (w *WarmUp) release(keys []string, ttl time.Duration) {
+	for _, key := range keys {
+		w.cfg.Store.Incr(key, -1, ttl)
+	}
+}
+
+// limit returns the cap of an identity that started on start on day, or 0
+// if it is warm.
+func (w *WarmUp) limit(start, day time.Time) int64 {
+	n := 0
+	for d := start; d.Before(day); d = d.AddDate(0, 0, 1) {
+		if n++; n >= len(w.cfg.Schedule) {
+			return 0
+		}
+	}
+	return w.cfg.Schedule[n]
+}
+
+// day returns the start of the day of t.
+func (w *WarmUp) day(t time.Time) time.Time {
+	y, m, d := t.In(w.cfg.Location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, w.cfg.Location)
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/muzhy/brisa/brisatest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWarmUp(t *testing.T) {
+	_, err := NewWarmUp(WarmUpConfig{Schedule: []int64{10}})
+	require.Error(t, err)
+	_, err = NewWarmUp(WarmUpConfig{Store: brisa.NewMemoryStore()})
+	require.Error(t, err)
+	_, err = NewWarmUp(WarmUpConfig{Store: brisa.NewMemoryStore(), Schedule: []int64{10, 0}})
+	require.Error(t, err)
+}
+
+func TestWarmUp_Handle(t *testing.T) {
+	now := time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)
+	clock := brisatest.NewFakeClock(now)
+	w, err := NewWarmUp(WarmUpConfig{
+		Store:      brisa.NewMemoryStoreWithClock(clock),
+		Identities: map[string]time.Time{"new.example.com": now.Add(-20 * time.Hour)},
+		Schedule:   []int64{1, 2},
+		Clock:      clock,
+	})
+	require.NoError(t, err)
+
+	send := func(from string, to ...string) time.Time {
+		ctx := newTestContext(t, "")
+		ctx.From, ctx.To = from, to
+		ctx.Action = brisa.Deliver
+		assert.Equal(t, brisa.Deliver, w.Handle(ctx))
+		return DeliverAfter(ctx)
+	}
+	tomorrow := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	// Identities not warming up are not limited.
+	for range 3 {
+		assert.True(t, send("alice@old.example.com", "bob@gmail.com").IsZero())
+	}
+
+	// Day 2 of the ramp (the first one was yesterday): 2 per domain.
+	assert.True(t, send("alice@new.example.com", "bob@gmail.com").IsZero())
+	assert.True(t, send("alice@NEW.example.com", "carol@gmail.com").IsZero())
+	assert.Equal(t, tomorrow, send("alice@new.example.com", "dave@gmail.com"))
+	// The ramp is over tomorrow: no cap.
+	assert.Equal(t, tomorrow, send("alice@new.example.com", "erin@gmail.com"))
+
+	// Other domains have their own counters; a message waits for all its
+	// recipient domains and takes back what it counted.
+	assert.True(t, send("alice@new.example.com", "bob@yahoo.com").IsZero())
+	assert.Equal(t, tomorrow, send("alice@new.example.com", "carol@yahoo.com", "frank@gmail.com"))
+	assert.True(t, send("alice@new.example.com", "dave@yahoo.com").IsZero())
+
+	clock.Set(tomorrow.Add(time.Hour))
+	assert.True(t, send("alice@new.example.com", "bob@gmail.com").IsZero())
+}
+
+func TestWarmUp_Ramp(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := brisatest.NewFakeClock(start)
+	w, err := NewWarmUp(WarmUpConfig{
+		Store:      brisa.NewMemoryStoreWithClock(clock),
+		Identities: map[string]time.Time{"ip-1": start},
+		Schedule:   []int64{1, 1, 1},
+		Identity:   func(*brisa.Context) string { return "ip-1" },
+		Clock:      clock,
+	})
+	require.NoError(t, err)
+
+	// Deferred messages reserve the caps of the following days.
+	var got []time.Time
+	for range 5 {
+		ctx := newTestContext(t, "")
+		ctx.From, ctx.To = "alice@example.com", []string{"bob@gmail.com"}
+		w.Handle(ctx)
+		got = append(got, DeliverAfter(ctx))
+	}
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	assert.Equal(t, []time.Time{{}, day(2), day(3), day(4), day(4)}, got)
+}
+
+type failingStore struct{ brisa.Store }
+
+func (failingStore) Incr(string, int64, time.Duration) (int64, error) {
+	return 0, errors.New("store down")
+}
+
+func TestWarmUp_StoreError(t *testing.T) {
+	w, err := NewWarmUp(WarmUpConfig{
+		Store:      failingStore{},
+		Identities: map[string]time.Time{"example.com": time.Now()},
+		Schedule:   []int64{1},
+	})
+	require.NoError(t, err)
+	ctx := newTestContext(t, "")
+	ctx.From, ctx.To = "alice@example.com", []string{"bob@gmail.com"}
+	w.Handle(ctx)
+	assert.True(t, DeliverAfter(ctx).IsZero())
+}
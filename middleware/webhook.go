@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/muzhy/brisa"
+)
+
+const (
+	// DefaultWebhookQueueSize is the default number of callbacks waiting to
+	// be sent.
+	DefaultWebhookQueueSize = 1000
+	// DefaultWebhookTimeout is the default timeout of a callback request.
+	DefaultWebhookTimeout = 10 * time.Second
+	// DefaultWebhookRetries is the default number of retries of a failed
+	// callback.
+	DefaultWebhookRetries = 3
+	// DefaultWebhookRetryDelay is the default delay before the first retry;
+	// it doubles for every further one.
+	DefaultWebhookRetryDelay = time.Second
+)
+
+// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+// keyed with WebhookConfig.Secret, as "sha256=<hex>".
+const WebhookSignatureHeader = "X-Brisa-Signature"
+
+// WebhookConfig configures a Webhook.
+type WebhookConfig struct {
+	// URL receives the callbacks as JSON POST requests. It is required.
+	URL string
+	// Secret, if set, signs the requests with WebhookSignatureHeader.
+	Secret string
+	// QueueSize bounds the callbacks waiting to be sent; further ones are
+	// dropped. Defaults to DefaultWebhookQueueSize.
+	QueueSize int
+	// Timeout bounds each request. Defaults to DefaultWebhookTimeout.
+	Timeout time.Duration
+	// Retries is the number of times a failed callback is retried. Defaults to
+	// DefaultWebhookRetries; negative disables retries.
+	Retries int
+	// RetryDelay is the delay before the first retry. Defaults to
+	// DefaultWebhookRetryDelay.
+	RetryDelay time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Logger logs failed callbacks. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// WebhookPayload is the JSON body of a callback. Event is the delivery state:
+// "queued" when a message has been accepted, then "delivered", "deferred" or
+// "bounced" per recipient as reported by DeliveryStatus events.
+type WebhookPayload struct {
+	Event      brisa.DeliveryState `json:"event"`
+	MailID     string              `json:"mail_id"`
+	From       string              `json:"from,omitempty"`
+	Recipients []string            `json:"recipients"`
+	Detail     string              `json:"detail,omitempty"`
+	Time       time.Time           `json:"time"`
+}
+
+// Webhook sends HTTP callbacks for the delivery lifecycle of messages, keyed
+// by their mail ID, so that the application that submitted a message can
+// track its fate. It listens to MessageAccepted and DeliveryStatus events on
+// an event bus and sends the callbacks from a separate goroutine, retrying
+// failed ones.
+type Webhook struct {
+	cfg     WebhookConfig
+	queue   chan *WebhookPayload
+	done    chan struct{}
+	stop    chan struct{}
+	dropped atomic.Uint64
+
+	closeOnce sync.Once
+}
+
+// NewWebhook creates a Webhook and starts its sender. Close stops it.
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("webhook URL is required")
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultWebhookQueueSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultWebhookTimeout
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultWebhookRetries
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultWebhookRetryDelay
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	w := &Webhook{
+		cfg:   cfg,
+		queue: make(chan *WebhookPayload, cfg.QueueSize),
+		done:  make(chan struct{}),
+		stop:  make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Subscribe sends callbacks for the events published on bus until the
+// returned function is called.
+func (w *Webhook) Subscribe(bus *brisa.EventBus) (unsubscribe func()) {
+	unsubAccepted := brisa.Subscribe(bus, func(e brisa.MessageAccepted) {
+		w.Enqueue(&WebhookPayload{Event: brisa.DeliveryQueued, MailID: e.MailID, From: e.From, Recipients: e.To, Time: time.Now()})
+	})
+	unsubStatus := brisa.Subscribe(bus, func(e brisa.DeliveryStatus) {
+		w.Enqueue(&WebhookPayload{Event: e.State, MailID: e.MailID, Recipients: []string{e.Recipient}, Detail: e.Detail, Time: time.Now()})
+	})
+	return func() {
+		unsubAccepted()
+		unsubStatus()
+	}
+}
+
+// Enqueue queues a callback, or drops it if the queue is full.
+func (w *Webhook) Enqueue(p *WebhookPayload) {
+	select {
+	case w.queue <- p:
+	default:
+		w.dropped.Add(1)
+		w.cfg.Logger.Warn("webhook queue full, callback dropped", "mail_id", p.MailID, "event", string(p.Event))
+	}
+}
+
+// Dropped returns the number of callbacks dropped because the queue was full.
+func (w *Webhook) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+	for p := range w.queue {
+		w.deliver(p)
+	}
+}
+
+// deliver sends p, retrying with exponential backoff.
+func (w *Webhook) deliver(p *WebhookPayload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		w.cfg.Logger.Error("failed to encode webhook payload", "error", err)
+		return
+	}
+	delay := w.cfg.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.cfg.Retries {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+			return
+		}
+		delay *= 2
+	}
+	w.cfg.Logger.Error("webhook failed", "mail_id", p.MailID, "event", string(p.Event), "error", err)
+}
+
+func (w *Webhook) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops accepting callbacks and waits for the queued ones to be sent.
+// Retries still pending are abandoned. No callbacks may be enqueued after
+// Close.
+func (w *Webhook) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		close(w.queue)
+	})
+	<-w.done
+	return nil
+}
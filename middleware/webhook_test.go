@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muzhy/brisa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []WebhookPayload
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(WebhookSignatureHeader))
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p WebhookPayload
+		require.NoError(t, json.Unmarshal(body, &p))
+		payloads = append(payloads, p)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	wh, err := NewWebhook(WebhookConfig{URL: srv.URL, Secret: "s3cret", RetryDelay: time.Millisecond, Logger: logger})
+	require.NoError(t, err)
+
+	router := brisa.Router{}
+	router.OnDeliver(&brisa.Middleware{Handler: func(ctx *brisa.Context) brisa.Action {
+		for _, rcpt := range ctx.To {
+			ctx.Session.Events().Publish(brisa.DeliveryStatus{
+				MailID:    ctx.Session.MailID(),
+				Recipient: rcpt,
+				State:     brisa.DeliveryBounced,
+				Detail:    "550 5.1.1 No such user",
+			})
+		}
+		return brisa.Deliver
+	}})
+	b := brisa.New(logger)
+	b.UpdateRouter(&router)
+	unsubscribe := wh.Subscribe(b.Events())
+	defer unsubscribe()
+
+	b.Simulate(brisa.Envelope{From: "app@example.com", To: []string{"bob@example.org"}}, strings.NewReader("Subject: hi\r\n\r\nhi\r\n"))
+	// The first request fails and is retried.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(payloads) == 2
+	}, time.Second, time.Millisecond)
+	require.NoError(t, wh.Close())
+
+	// The deliver chain runs before the message counts as accepted.
+	bounced, queued := payloads[0], payloads[1]
+	assert.Equal(t, brisa.DeliveryBounced, bounced.Event)
+	assert.Equal(t, []string{"bob@example.org"}, bounced.Recipients)
+	assert.Equal(t, "550 5.1.1 No such user", bounced.Detail)
+	assert.Equal(t, brisa.DeliveryQueued, queued.Event)
+	assert.Equal(t, "app@example.com", queued.From)
+	assert.NotEmpty(t, queued.MailID)
+	assert.Equal(t, queued.MailID, bounced.MailID)
+}
+
+func TestWebhook_Drop(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-block }))
+	defer srv.Close()
+	defer close(block)
+
+	wh, err := NewWebhook(WebhookConfig{URL: srv.URL, QueueSize: 1, Retries: -1, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	require.NoError(t, err)
+	for range 5 {
+		wh.Enqueue(&WebhookPayload{Event: brisa.DeliveryQueued, MailID: "m"})
+	}
+	// One is being sent, one waits; the others are dropped.
+	assert.GreaterOrEqual(t, wh.Dropped(), uint64(3))
+}
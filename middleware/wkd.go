@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/muzhy/brisa/address"
+)
+
+// wkdMaxKeySize bounds the certificates read from a Web Key Directory.
+const wkdMaxKeySize = 256 << 10
+
+// WKDKeySource returns a PGPKeySource looking up the OpenPGP keys of
+// recipients in the Web Key Directory of their domain
+// (draft-koch-openpgp-webkey-service): with the advanced method at
+// openpgpkey.<domain>, and with the direct method at <domain> if that host
+// does not exist or has no key. Only certificates with a user ID of the
+// recipient are used. A nil client means one with a timeout of 10 seconds.
+func WKDKeySource(client *http.Client) PGPKeySource {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return func(rcpt string) (*PGPKey, error) {
+		local, domain := address.LocalPart(rcpt), domainOf(rcpt)
+		if local == "" || domain == "" {
+			return nil, nil
+		}
+		hash := sha1.Sum([]byte(strings.ToLower(local)))
+		path := "hu/" + zbase32(hash[:]) + "?l=" + url.QueryEscape(local)
+
+		data, err := wkdGet(client, "https://openpgpkey."+domain+"/.well-known/openpgpkey/"+domain+"/"+path)
+		var dnsErr *net.DNSError
+		if data == nil && (err == nil || errors.As(err, &dnsErr)) {
+			data, err = wkdGet(client, "https://"+domain+"/.well-known/openpgpkey/"+path)
+		}
+		if data == nil || err != nil {
+			return nil, err
+		}
+		return ParsePGPKey(data, rcpt)
+	}
+}
+
+// wkdGet returns the body of a GET of u, or nil if there is none.
+func wkdGet(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("wkd %s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, wkdMaxKeySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > wkdMaxKeySize {
+		return nil, fmt.Errorf("wkd %s: key larger than %d bytes", u, wkdMaxKeySize)
+	}
+	return data, nil
+}
+
+// zbase32 encodes data in z-base-32, as WKD hashes local parts.
+func zbase32(data []byte) string {
+	const alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+	var out strings.Builder
+	var acc, bits uint
+	for _, b := range data {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out.WriteByte(alphabet[acc>>bits&31])
+		}
+	}
+	if bits > 0 {
+		out.WriteByte(alphabet[acc<<(5-bits)&31])
+	}
+	return out.String()
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZBase32(t *testing.T) {
+	// The example of draft-koch-openpgp-webkey-service.
+	hash := sha1.Sum([]byte("joe.doe"))
+	assert.Equal(t, "iy9q119eutrkn8s1mk4r39qejnbu3n5q", zbase32(hash[:]))
+}
+
+func TestWKDKeySource(t *testing.T) {
+	hash := sha1.Sum([]byte("bob"))
+	hu := zbase32(hash[:])
+
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Host+r.URL.RequestURI())
+		mu.Unlock()
+		direct := strings.HasPrefix(r.URL.Path, "/.well-known/openpgpkey/hu/")
+		switch {
+		case direct && r.Host == "secure.example":
+			w.Write([]byte(testPGPCertificate))
+		case direct && r.Host == "broken.example":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// Every host resolves to the test server, whose certificate is for
+	// example.com.
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.ServerName = "example.com"
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	source := WKDKeySource(client)
+
+	// The advanced method has no key, the direct one has.
+	key, err := source("Bob@Secure.example")
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, "ba15308e5f9e8de987f7dda5e01fc982bb33be04", hex.EncodeToString(key.Fingerprint))
+	mu.Lock()
+	assert.Equal(t, []string{
+		"openpgpkey.secure.example/.well-known/openpgpkey/secure.example/hu/" + hu + "?l=Bob",
+		"secure.example/.well-known/openpgpkey/hu/" + hu + "?l=Bob",
+	}, requests)
+	mu.Unlock()
+
+	// The certificate served has no user ID of carol.
+	key, err = source("carol@secure.example")
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	// No key anywhere.
+	key, err = source("bob@other.example")
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	// Server errors are lookup failures.
+	_, err = source("bob@broken.example")
+	assert.Error(t, err)
+}
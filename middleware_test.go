@@ -1,8 +1,13 @@
 package brisa
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"log/slog"
+	"strings"
 	"testing"
+	"time"
 )
 
 // mockHandler creates a simple Handler that returns a specified Action and records whether it was called.
@@ -181,3 +186,264 @@ func TestMiddlewareChain_Execute(t *testing.T) {
 		})
 	}
 }
+
+func TestMiddlewareChain_Execute_Trace(t *testing.T) {
+	router := Router{}
+	router.OnConn(&Middleware{Name: "allow", Handler: func(ctx *Context) Action { return Pass }})
+	router.OnMailFrom(&Middleware{Name: "mark", Handler: func(ctx *Context) Action { return Quarantine }})
+	router.OnMailFrom(&Middleware{Name: "skipped", Handler: func(ctx *Context) Action { return Pass }, IgnoreFlags: DefaultIgnoreFlags})
+	router.OnRcptTo(&Middleware{Name: "refuse", Handler: func(ctx *Context) Action { return Reject }})
+
+	var rejectTrace []TraceStep
+	router.OnReject(&Middleware{Name: "log", Handler: func(ctx *Context) Action {
+		rejectTrace = ctx.Trace()
+		return Reject
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+	b.Simulate(Envelope{From: "a@example.com", To: []string{"b@example.com"}}, strings.NewReader(""))
+
+	// reject 链能看到之前执行过的所有中间件，包括被跳过的
+	want := []TraceStep{
+		{Chain: ChainConn, Middleware: "allow", Action: Pass},
+		{Chain: ChainMailFrom, Middleware: "mark", Action: Quarantine},
+		{Chain: ChainMailFrom, Middleware: "skipped", Action: Quarantine, Skipped: true},
+		{Chain: ChainRcptTo, Middleware: "refuse", Action: Reject},
+	}
+	if len(rejectTrace) != len(want) {
+		t.Fatalf("expected %d steps, got %+v", len(want), rejectTrace)
+	}
+	for i, step := range rejectTrace {
+		step.Duration = 0
+		if step != want[i] {
+			t.Errorf("step %d: expected %+v, got %+v", i, want[i], step)
+		}
+	}
+}
+
+func TestMiddlewareChain_Execute_TraceDuration(t *testing.T) {
+	chain := MiddlewareChain{
+		{Name: "skipped", Handler: func(ctx *Context) Action { return Pass }, Condition: func(ctx *Context) bool {
+			time.Sleep(50 * time.Millisecond)
+			return false
+		}},
+		{Name: "fast", Handler: func(ctx *Context) Action { return Pass }},
+	}
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	if _, err := chain.Execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 被跳过的中间件所用的时间不计入下一步
+	trace := ctx.Trace()
+	if len(trace) != 2 || trace[1].Middleware != "fast" {
+		t.Fatalf("unexpected trace %+v", trace)
+	}
+	if trace[1].Duration >= 50*time.Millisecond {
+		t.Errorf("expected the fast step to take less than 50ms, got %v", trace[1].Duration)
+	}
+}
+
+func TestMiddlewareChain_Execute_MaxScanBytes(t *testing.T) {
+	message := "Subject: hi\r\n\r\n" + strings.Repeat("x", 100)
+	var scanned int
+	var delivered string
+	chain := MiddlewareChain{
+		{Name: "spool", MaxScanBytes: 10, Handler: func(ctx *Context) Action {
+			sp, err := ctx.SpoolMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			scanned = int(sp.Len())
+			return Pass
+		}},
+		{Name: "untouched", MaxScanBytes: 5, Handler: func(ctx *Context) Action { return Pass }},
+		{Name: "full", Handler: func(ctx *Context) Action {
+			data, _ := io.ReadAll(ctx.Reader)
+			delivered = string(data)
+			return Pass
+		}},
+	}
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	ctx.Reader = strings.NewReader(message)
+	if _, err := chain.Execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 限制扫描的中间件只读到邮件开头，之后的中间件仍然读到完整邮件
+	if scanned != 10 {
+		t.Errorf("expected 10 bytes to be scanned, got %d", scanned)
+	}
+	if delivered != message {
+		t.Errorf("expected the complete message, got %q", delivered)
+	}
+}
+
+func TestMiddlewareChain_Execute_MaxScanBytes_Read(t *testing.T) {
+	message := "Subject: hi\r\n\r\n" + strings.Repeat("x", 100)
+	var delivered string
+	var spooled bool
+	chain := MiddlewareChain{
+		// Handlers that only read do not take the head from later middleware.
+		{Name: "read", MaxScanBytes: 20, Handler: func(ctx *Context) Action {
+			io.ReadAll(ctx.Reader)
+			return Pass
+		}},
+		{Name: "peek", MaxScanBytes: 20, Handler: func(ctx *Context) Action {
+			bufio.NewReader(ctx.Reader).ReadString('\n')
+			return Pass
+		}},
+		{Name: "rewrite", MaxScanBytes: 20, Handler: func(ctx *Context) Action {
+			ctx.Reader = io.MultiReader(strings.NewReader("X-Scanned: yes\r\n"), ctx.Reader)
+			return Pass
+		}},
+		{Name: "full", Handler: func(ctx *Context) Action {
+			data, _ := io.ReadAll(ctx.Reader)
+			delivered = string(data)
+			return Pass
+		}},
+	}
+	ctx := NewContext()
+	defer FreeContext(ctx)
+	ctx.Reader = strings.NewReader(message)
+	if _, err := chain.Execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "X-Scanned: yes\r\n" + message; delivered != want {
+		t.Errorf("expected %q, got %q", want, delivered)
+	}
+
+	// A spooled message is read from its spool again.
+	chain = MiddlewareChain{
+		{Name: "spool", Handler: func(ctx *Context) Action {
+			if _, err := ctx.SpoolMessage(); err != nil {
+				t.Fatal(err)
+			}
+			return Pass
+		}},
+		chain[0],
+		{Name: "full", Handler: func(ctx *Context) Action {
+			spooled = ctx.MessageSpool() != nil
+			data, _ := io.ReadAll(ctx.Reader)
+			delivered = string(data)
+			return Pass
+		}},
+	}
+	ctx.Reader = strings.NewReader(message)
+	if _, err := chain.Execute(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !spooled || delivered != message {
+		t.Errorf("expected the spooled message, got spooled %v and %q", spooled, delivered)
+	}
+}
+
+func TestContext_Trace_NewTransaction(t *testing.T) {
+	ctx := NewContext()
+	defer FreeContext(ctx)
+
+	ctx.chain = ChainConn
+	ctx.addTraceStep(TraceStep{Middleware: "conn"})
+	ctx.chain = ChainData
+	ctx.addTraceStep(TraceStep{Middleware: "data"})
+
+	// 新事务只保留会话的 conn 链
+	ctx.ResetMailFields()
+	if trace := ctx.Trace(); len(trace) != 1 || trace[0].Middleware != "conn" {
+		t.Errorf("expected only the conn step to remain, got %+v", trace)
+	}
+	ctx.Reset()
+	if trace := ctx.Trace(); len(trace) != 0 {
+		t.Errorf("expected empty trace after reset, got %+v", trace)
+	}
+}
+
+func TestContext_SessionKeys(t *testing.T) {
+	ctx := NewContext()
+	defer FreeContext(ctx)
+
+	ctx.SetSession("client.reputation", int64(3))
+	ctx.Set("spf.result", "pass")
+	ctx.Set("client.reputation", int64(-1))
+	if v, _ := ctx.Get("client.reputation"); v != int64(-1) {
+		t.Errorf("expected the transaction key to shadow the session key, got %v", v)
+	}
+
+	// RSET 只清除事务级别的键
+	ctx.ResetMailFields()
+	if _, ok := ctx.Get("spf.result"); ok {
+		t.Error("expected the transaction key to be cleared")
+	}
+	if v, _ := ctx.Get("client.reputation"); v != int64(3) {
+		t.Errorf("expected the session key to survive, got %v", v)
+	}
+	if v, _ := ctx.Detach().Get("client.reputation"); v != int64(3) {
+		t.Errorf("expected the detached copy to keep the session key, got %v", v)
+	}
+	ctx.Reset()
+	if _, ok := ctx.Get("client.reputation"); ok {
+		t.Error("expected Reset to clear the session keys")
+	}
+}
+
+// mustPanic 检查 f 引发 panic
+func mustPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: expected a panic", name)
+		}
+	}()
+	f()
+}
+
+func TestContext_UseAfterFree(t *testing.T) {
+	ctx := NewContext()
+	ctx.From = "alice@example.org"
+	ctx.Set("spf.result", "pass")
+	detached := ctx.Detach()
+	FreeContext(ctx)
+
+	mustPanic(t, "Get", func() { ctx.Get("spf.result") })
+	mustPanic(t, "HasFlag", func() { ctx.HasFlag(FlagTrusted) })
+	mustPanic(t, "FreeContext", func() { FreeContext(ctx) })
+
+	// 分离的副本在释放后仍然有效，且不进入池
+	if v, _ := detached.Get("spf.result"); v != "pass" || detached.From != "alice@example.org" {
+		t.Errorf("expected the detached copy to keep its data, got %v and %q", v, detached.From)
+	}
+	FreeContext(detached)
+	FreeContext(detached)
+
+	// 调试检查开启时，释放的上下文被毒化且不再复用
+	SetContextChecks(true)
+	defer SetContextChecks(false)
+	ctx = NewContext()
+	FreeContext(ctx)
+	if ctx.From != "<freed context>" {
+		t.Errorf("expected a poisoned sender, got %q", ctx.From)
+	}
+	mustPanic(t, "Reader", func() { ctx.Reader.Read(make([]byte, 1)) })
+	for range 10 {
+		if c := NewContext(); c == ctx {
+			t.Fatal("expected a poisoned context not to be reused")
+		}
+	}
+}
+
+func TestAction_String(t *testing.T) {
+	tests := map[Action]string{
+		Pass:               "pass",
+		Reject:             "reject",
+		0:                  "none",
+		DefaultIgnoreFlags: "deliver|quarantine|discard",
+		Deliver | 64:       "deliver|0x40",
+	}
+	for action, want := range tests {
+		if got := action.String(); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
@@ -1,10 +1,21 @@
 package brisa
 
-import "time"
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Observer defines an interface for components that wish to monitor the lifecycle
 // of SMTP sessions and middleware chain executions. This provides a non-intrusive
 // way to implement observability features like metrics and tracing.
+//
+// Callbacks run synchronously in the session. A panicking observer is
+// recovered and logged without affecting the session or the other observers;
+// wrap slow observers in an AsyncObserver.
 type Observer interface {
 	// OnSessionStart is called immediately after a new session is created and
 	// its context is initialized.
@@ -21,3 +32,241 @@ type Observer interface {
 	// It provides the final action of the chain and the total execution duration.
 	OnChainEnd(ctx *Context, chainType ChainType, duration time.Duration)
 }
+
+// LogObserver is an Observer that logs session boundaries and chain durations
+// with the session logger at debug level.
+type LogObserver struct{}
+
+// OnSessionStart implements Observer.
+func (LogObserver) OnSessionStart(ctx *Context) {
+	ctx.Logger.Debug("session started")
+}
+
+// OnSessionEnd implements Observer.
+func (LogObserver) OnSessionEnd(ctx *Context) {
+	ctx.Logger.Debug("session ended")
+}
+
+// OnChainStart implements Observer.
+func (LogObserver) OnChainStart(ctx *Context, chainType ChainType) {}
+
+// OnChainEnd implements Observer.
+func (LogObserver) OnChainEnd(ctx *Context, chainType ChainType, duration time.Duration) {
+	ctx.Logger.Debug("chain executed", "chain", string(chainType), "action", ctx.Action, "duration", duration)
+}
+
+// notify calls fn for each observer, recovering and logging panics so that a
+// broken observer cannot break the session.
+func notify(observers []Observer, ctx *Context, fn func(Observer)) {
+	for _, o := range observers {
+		callObserver(ctx.Logger, o, fn)
+	}
+}
+
+// callObserver calls fn with o and reports whether it panicked.
+func callObserver(logger *slog.Logger, o Observer, fn func(Observer)) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.Error("observer panicked", "observer", fmt.Sprintf("%T", o), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	fn(o)
+	return false
+}
+
+const (
+	// DefaultObserverQueueSize is the default number of events an
+	// AsyncObserver buffers.
+	DefaultObserverQueueSize = 1024
+	// DefaultObserverTimeout is the default time an AsyncObserver waits for
+	// a callback.
+	DefaultObserverTimeout = 5 * time.Second
+)
+
+// AsyncObserverConfig configures an AsyncObserver.
+type AsyncObserverConfig struct {
+	// QueueSize bounds the events waiting to be delivered; further events are
+	// dropped. Defaults to DefaultObserverQueueSize.
+	QueueSize int
+	// Timeout is the time a callback may take before the next event is
+	// delivered. Defaults to DefaultObserverTimeout.
+	Timeout time.Duration
+}
+
+// ObserverStats counts the events an AsyncObserver did not deliver normally.
+type ObserverStats struct {
+	// Dropped events were not delivered because the queue was full or a
+	// callback was still stuck.
+	Dropped uint64
+	// TimedOut callbacks exceeded the timeout.
+	TimedOut uint64
+	// Panics is the number of callbacks that panicked.
+	Panics uint64
+}
+
+// AsyncObserver delivers events to an Observer from a separate goroutine, so
+// that a slow observer, such as one pushing to a remote metrics backend,
+// cannot stall mail flow. Events are buffered in a bounded queue and dropped
+// when it is full.
+//
+// Callbacks receive a snapshot of the context taken when the event occurred:
+// changes to it are not seen by the session and its message reader is nil.
+// A callback exceeding the timeout is left to finish on its own, and events
+// are dropped until it does.
+type AsyncObserver struct {
+	inner   Observer
+	timeout time.Duration
+	events  chan observerEvent
+	done    chan struct{}
+
+	// stuck is closed when the callback that last timed out returns.
+	stuck    atomic.Pointer[chan struct{}]
+	dropped  atomic.Uint64
+	timedOut atomic.Uint64
+	panics   atomic.Uint64
+
+	closeOnce sync.Once
+}
+
+type observerEventType int
+
+const (
+	eventSessionStart observerEventType = iota
+	eventSessionEnd
+	eventChainStart
+	eventChainEnd
+)
+
+type observerEvent struct {
+	typ       observerEventType
+	ctx       *Context
+	chainType ChainType
+	duration  time.Duration
+}
+
+// deliver calls the callback of o matching the event.
+func (ev *observerEvent) deliver(o Observer) {
+	switch ev.typ {
+	case eventSessionStart:
+		o.OnSessionStart(ev.ctx)
+	case eventSessionEnd:
+		o.OnSessionEnd(ev.ctx)
+	case eventChainStart:
+		o.OnChainStart(ev.ctx, ev.chainType)
+	case eventChainEnd:
+		o.OnChainEnd(ev.ctx, ev.chainType, ev.duration)
+	}
+}
+
+// NewAsyncObserver starts delivering events to o. Close stops it.
+func NewAsyncObserver(o Observer, cfg AsyncObserverConfig) *AsyncObserver {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultObserverQueueSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultObserverTimeout
+	}
+	a := &AsyncObserver{
+		inner:   o,
+		timeout: cfg.Timeout,
+		events:  make(chan observerEvent, cfg.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// OnSessionStart implements Observer.
+func (a *AsyncObserver) OnSessionStart(ctx *Context) {
+	a.enqueue(observerEvent{typ: eventSessionStart, ctx: ctx})
+}
+
+// OnSessionEnd implements Observer.
+func (a *AsyncObserver) OnSessionEnd(ctx *Context) {
+	a.enqueue(observerEvent{typ: eventSessionEnd, ctx: ctx})
+}
+
+// OnChainStart implements Observer.
+func (a *AsyncObserver) OnChainStart(ctx *Context, chainType ChainType) {
+	a.enqueue(observerEvent{typ: eventChainStart, ctx: ctx, chainType: chainType})
+}
+
+// OnChainEnd implements Observer.
+func (a *AsyncObserver) OnChainEnd(ctx *Context, chainType ChainType, duration time.Duration) {
+	a.enqueue(observerEvent{typ: eventChainEnd, ctx: ctx, chainType: chainType, duration: duration})
+}
+
+// enqueue queues ev with a snapshot of its context, or drops it.
+func (a *AsyncObserver) enqueue(ev observerEvent) {
+	if a.isStuck() {
+		a.dropped.Add(1)
+		return
+	}
+	ev.ctx = ev.ctx.Detach()
+	select {
+	case a.events <- ev:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// isStuck reports whether a callback that timed out is still running.
+func (a *AsyncObserver) isStuck() bool {
+	finished := a.stuck.Load()
+	if finished == nil {
+		return false
+	}
+	select {
+	case <-*finished:
+		return false
+	default:
+		return true
+	}
+}
+
+func (a *AsyncObserver) run() {
+	defer close(a.done)
+	timer := time.NewTimer(a.timeout)
+	timer.Stop()
+	for ev := range a.events {
+		if a.isStuck() {
+			a.dropped.Add(1)
+			continue
+		}
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			if callObserver(ev.ctx.Logger, a.inner, ev.deliver) {
+				a.panics.Add(1)
+			}
+		}()
+		timer.Reset(a.timeout)
+		select {
+		case <-finished:
+			timer.Stop()
+		case <-timer.C:
+			a.timedOut.Add(1)
+			a.stuck.Store(&finished)
+			if ev.ctx.Logger != nil {
+				ev.ctx.Logger.Warn("observer timed out", "observer", fmt.Sprintf("%T", a.inner), "timeout", a.timeout)
+			}
+		}
+	}
+}
+
+// Stats returns the counts of dropped, timed out and panicked events.
+func (a *AsyncObserver) Stats() ObserverStats {
+	return ObserverStats{Dropped: a.dropped.Load(), TimedOut: a.timedOut.Load(), Panics: a.panics.Load()}
+}
+
+// Close stops accepting events and waits until the queued ones have been
+// delivered or dropped. No events may be sent after Close.
+func (a *AsyncObserver) Close() error {
+	a.closeOnce.Do(func() { close(a.events) })
+	<-a.done
+	return nil
+}
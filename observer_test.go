@@ -0,0 +1,145 @@
+package brisa
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type panicObserver struct{}
+
+func (panicObserver) OnSessionStart(ctx *Context)                    { panic("boom") }
+func (panicObserver) OnSessionEnd(ctx *Context)                      { panic("boom") }
+func (panicObserver) OnChainStart(ctx *Context, chainType ChainType) { panic("boom") }
+func (panicObserver) OnChainEnd(ctx *Context, chainType ChainType, duration time.Duration) {
+	panic("boom")
+}
+
+// chainRecorder 记录 OnChainEnd 时看到的链和发件人，可以阻塞回调
+type chainRecorder struct {
+	mu      sync.Mutex
+	chains  []ChainType
+	froms   []string
+	block   chan struct{}
+	entered chan struct{}
+}
+
+func (r *chainRecorder) OnSessionStart(ctx *Context)                    {}
+func (r *chainRecorder) OnSessionEnd(ctx *Context)                      {}
+func (r *chainRecorder) OnChainStart(ctx *Context, chainType ChainType) {}
+func (r *chainRecorder) OnChainEnd(ctx *Context, chainType ChainType, duration time.Duration) {
+	if r.entered != nil {
+		r.entered <- struct{}{}
+	}
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	r.chains = append(r.chains, chainType)
+	r.froms = append(r.froms, ctx.From)
+	r.mu.Unlock()
+}
+
+func newObserverTestBrisa(observers ...Observer) *Brisa {
+	router := Router{}
+	pass := func(ctx *Context) Action { return Pass }
+	router.OnMailFrom(&Middleware{Handler: pass})
+	router.OnData(&Middleware{Handler: pass})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)), observers...)
+	b.UpdateRouter(&router)
+	return b
+}
+
+var observerTestEnvelope = Envelope{
+	ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1")},
+	From:       "alice@example.com",
+	To:         []string{"bob@example.com"},
+}
+
+func TestObserver_PanicIsolated(t *testing.T) {
+	rec := &chainRecorder{}
+	b := newObserverTestBrisa(panicObserver{}, rec)
+
+	result := b.Simulate(observerTestEnvelope, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	if result.Err != nil || result.Action != Deliver {
+		t.Fatalf("expected delivery despite panicking observer, got %v %v", result.Action, result.Err)
+	}
+	// 其他观察者仍然收到事件
+	if len(rec.chains) != 2 {
+		t.Errorf("expected 2 chain events, got %v", rec.chains)
+	}
+}
+
+func TestAsyncObserver(t *testing.T) {
+	rec := &chainRecorder{}
+	a := NewAsyncObserver(rec, AsyncObserverConfig{})
+	b := newObserverTestBrisa(a)
+
+	b.Simulate(observerTestEnvelope, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	a.Close()
+
+	// 会话结束、上下文回收之后，快照仍然保留发件人
+	if len(rec.froms) != 2 || rec.froms[0] != "alice@example.com" || rec.froms[1] != "alice@example.com" {
+		t.Errorf("unexpected snapshots: %v", rec.froms)
+	}
+	if stats := a.Stats(); stats != (ObserverStats{}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestAsyncObserver_Drop(t *testing.T) {
+	rec := &chainRecorder{block: make(chan struct{}), entered: make(chan struct{}, 10)}
+	a := NewAsyncObserver(rec, AsyncObserverConfig{QueueSize: 1, Timeout: time.Hour})
+	ctx := NewContext()
+	defer FreeContext(ctx)
+
+	a.OnChainEnd(ctx, ChainData, 0)
+	<-rec.entered // 第一个事件正在处理
+	a.OnChainEnd(ctx, ChainData, 0)
+	a.OnChainEnd(ctx, ChainData, 0) // 队列已满
+	if got := a.Stats().Dropped; got != 1 {
+		t.Errorf("expected 1 dropped event, got %d", got)
+	}
+	close(rec.block)
+	a.Close()
+	if len(rec.chains) != 2 {
+		t.Errorf("expected 2 delivered events, got %d", len(rec.chains))
+	}
+}
+
+func TestAsyncObserver_Timeout(t *testing.T) {
+	rec := &chainRecorder{block: make(chan struct{}), entered: make(chan struct{}, 10)}
+	a := NewAsyncObserver(rec, AsyncObserverConfig{Timeout: 10 * time.Millisecond})
+	ctx := NewContext()
+	defer FreeContext(ctx)
+
+	a.OnChainEnd(ctx, ChainData, 0)
+	<-rec.entered
+	deadline := time.Now().Add(time.Second)
+	for a.Stats().TimedOut == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if a.Stats().TimedOut != 1 {
+		t.Fatalf("expected a timeout, got %+v", a.Stats())
+	}
+	// 回调卡住期间事件被丢弃
+	a.OnChainEnd(ctx, ChainData, 0)
+	if got := a.Stats().Dropped; got != 1 {
+		t.Errorf("expected 1 dropped event, got %d", got)
+	}
+
+	close(rec.block)
+	deadline = time.Now().Add(time.Second)
+	for a.isStuck() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	a.OnChainEnd(ctx, ChainData, 0)
+	a.Close()
+	if len(rec.chains) != 2 {
+		t.Errorf("expected 2 delivered events, got %d", len(rec.chains))
+	}
+}
@@ -0,0 +1,192 @@
+package brisa
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+const (
+	// DefaultPostQueueWorkers is the default number of goroutines processing
+	// the post-queue stage.
+	DefaultPostQueueWorkers = 4
+	// DefaultPostQueueSize is the default number of accepted messages waiting
+	// for the post-queue stage.
+	DefaultPostQueueSize = 100
+)
+
+// PostQueueConfig configures the post-queue stage.
+type PostQueueConfig struct {
+	// Workers is the number of messages processed concurrently. Defaults to
+	// DefaultPostQueueWorkers.
+	Workers int
+	// QueueSize is the number of accepted messages that can wait for a worker.
+	// When the queue is full, DATA is refused with ErrQueueFull. Defaults to
+	// DefaultPostQueueSize.
+	QueueSize int
+}
+
+// postQueue runs the post_queue chain of accepted messages in worker
+// goroutines, followed by the disposition chain of its final action.
+type postQueue struct {
+	logger *slog.Logger
+	events *EventBus
+	jobs   chan *postQueueJob
+	wg     sync.WaitGroup
+
+	// mu guards closed, so no message is sent on the closed jobs channel.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// postQueueJob is an accepted message waiting for the post-queue stage.
+type postQueueJob struct {
+	ctx        *Context
+	spool      *Spool
+	router     *compiledRouter
+	hookPool   *hookPool
+	id         string
+	mailID     string
+	listener   string
+	remoteAddr net.Addr
+}
+
+// StartPostQueue starts the post-queue stage: once the data chain decides to
+// deliver a message, sessions accept it right away and queue it, and workers
+// run the post_queue chain on it outside the SMTP transaction, then the
+// disposition chain of its final action, e.g. the deliver chain. Heavy
+// scanning can thus be moved out of the transaction. Messages are only queued
+// while the router has a post_queue chain. Without a started stage, the
+// chain runs within the transaction, as it does in Simulate.
+//
+// The queue is held in memory: messages still queued when the process exits
+// are lost. Stop the stage with StopPostQueue after the SMTP server.
+func (b *Brisa) StartPostQueue(cfg PostQueueConfig) {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultPostQueueWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultPostQueueSize
+	}
+	q := &postQueue{
+		logger: b.logger,
+		events: b.events,
+		jobs:   make(chan *postQueueJob, cfg.QueueSize),
+	}
+	for range cfg.Workers {
+		q.wg.Add(1)
+		go q.work()
+	}
+	if old := b.postQueue.Swap(q); old != nil {
+		go old.stop(context.Background())
+	}
+}
+
+// StopPostQueue stops queueing messages for new sessions and waits until the
+// queued messages are processed or ctx is done, returning its error then.
+func (b *Brisa) StopPostQueue(ctx context.Context) error {
+	q := b.postQueue.Swap(nil)
+	if q == nil {
+		return nil
+	}
+	return q.stop(ctx)
+}
+
+// enqueue spools the rest of the message of s and queues it with a copy of
+// the context of s. It returns ErrQueueFull if no room is left.
+func (q *postQueue) enqueue(s *Session) error {
+	sp := newSpool(s.spools)
+	if _, err := io.Copy(sp, s.ctx.Reader); err != nil {
+		sp.Close()
+		return err
+	}
+	job := &postQueueJob{
+		ctx:        s.ctx.Detach(),
+		spool:      sp,
+		router:     s.router,
+		hookPool:   s.hookPool,
+		id:         s.id,
+		mailID:     s.mailID,
+		listener:   s.listener,
+		remoteAddr: s.GetClientIP(),
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if !q.closed {
+		select {
+		case q.jobs <- job:
+			return nil
+		default:
+		}
+	}
+	sp.Close()
+	s.ctx.Logger.Warn("post-queue full, deferring message")
+	return ErrQueueFull
+}
+
+func (q *postQueue) stop(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *postQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		q.process(job)
+	}
+}
+
+// process runs the post-queue stage for job in a detached session with the
+// IDs of the session that accepted the message.
+func (q *postQueue) process(job *postQueueJob) {
+	ctx := job.ctx
+	ctx.Logger = withAttr(withAttr(q.logger, slog.String("session_id", job.id)), slog.String("mail_id", job.mailID))
+	ctx.Reader = job.spool.NewReader()
+	defer job.spool.Close()
+	ctx.rejectErr = nil
+	s := &Session{
+		ctx:        ctx,
+		id:         job.id,
+		mailID:     job.mailID,
+		listener:   job.listener,
+		remoteAddr: job.remoteAddr,
+		router:     job.router,
+		hookPool:   job.hookPool,
+		baseLogger: ctx.Logger,
+		events:     q.events,
+		postQueued: true,
+	}
+	ctx.Session = s
+	defer s.Logout()
+
+	if err := s.runPostQueueChain(); err != nil {
+		// The client was told the message was accepted; the reject chain has
+		// run and the rejection can only be logged.
+		ctx.Logger.Warn("message rejected after acceptance", "error", err)
+		return
+	}
+	if err := s.dispose(); err != nil {
+		ctx.Logger.Error("post-queue disposition failed", "action", ctx.Action, "error", err)
+		return
+	}
+	s.runHooks()
+}
@@ -0,0 +1,164 @@
+package brisa
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// newPostQueueSession 返回一个使用 b 的路由和 post-queue 阶段的分离会话。
+func newPostQueueSession(b *Brisa) *Session {
+	ctx := NewContext()
+	ctx.Logger = b.logger
+	s := NewDetachedSession(ctx, &net.TCPAddr{IP: net.ParseIP("198.51.100.1")})
+	s.router = b.router.Load()
+	s.events = b.events
+	s.postQueue = b.postQueue.Load()
+	return s
+}
+
+func sendMessage(t *testing.T, s *Session, message string) error {
+	t.Helper()
+	if err := s.Mail("alice@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatalf("MAIL FROM failed: %v", err)
+	}
+	if err := s.Rcpt("bob@example.com", &smtp.RcptOptions{}); err != nil {
+		t.Fatalf("RCPT TO failed: %v", err)
+	}
+	return s.Data(strings.NewReader(message))
+}
+
+func TestBrisa_PostQueue(t *testing.T) {
+	release := make(chan struct{})
+	type seen struct {
+		from, to, body, mailID string
+		key                    any
+	}
+	seenCh := make(chan seen, 1)
+	var delivered string
+	deliverRuns := 0
+
+	router := Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		ctx.Set("verdict", "clean")
+		return Pass
+	}})
+	router.OnPostQueue(&Middleware{Handler: func(ctx *Context) Action {
+		<-release
+		data, _ := io.ReadAll(ctx.Reader)
+		key, _ := ctx.Get("verdict")
+		seenCh <- seen{ctx.From, ctx.To[0], string(data), ctx.Session.MailID(), key}
+		ctx.Reader = strings.NewReader(string(data))
+		return Pass
+	}})
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		deliverRuns++
+		data, _ := io.ReadAll(ctx.Reader)
+		delivered = string(data)
+		return Deliver
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+	b.StartPostQueue(PostQueueConfig{Workers: 1})
+
+	var accepted []MessageAccepted
+	Subscribe(b.Events(), func(e MessageAccepted) { accepted = append(accepted, e) })
+
+	s := newPostQueueSession(b)
+	// 在 post-queue 链执行之前，消息已被接受。
+	if err := sendMessage(t, s, "Subject: hi\r\n\r\nhello\r\n"); err != nil {
+		t.Fatalf("expected message to be accepted, got %v", err)
+	}
+	mailID := s.MailID()
+	s.Logout()
+	if deliverRuns != 0 {
+		t.Fatal("deliver chain should not run in the session")
+	}
+
+	close(release)
+	if err := b.StopPostQueue(context.Background()); err != nil {
+		t.Fatalf("StopPostQueue failed: %v", err)
+	}
+	got := <-seenCh
+	if got.from != "alice@example.com" || got.to != "bob@example.com" || got.mailID != mailID || got.key != "clean" {
+		t.Errorf("unexpected post-queue context: %+v", got)
+	}
+	if !strings.Contains(got.body, "hello") || !strings.Contains(delivered, "hello") {
+		t.Errorf("expected the message in the post-queue and deliver chains, got %q and %q", got.body, delivered)
+	}
+	if deliverRuns != 1 {
+		t.Errorf("expected one delivery, got %d", deliverRuns)
+	}
+	// MessageAccepted 只在会话接受消息时发布一次。
+	if len(accepted) != 1 || accepted[0].MailID != mailID {
+		t.Errorf("expected one MessageAccepted event, got %+v", accepted)
+	}
+}
+
+func TestBrisa_PostQueueFull(t *testing.T) {
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	router := Router{}
+	router.OnPostQueue(&Middleware{Handler: func(ctx *Context) Action {
+		started <- struct{}{}
+		<-release
+		return Pass
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+	b.StartPostQueue(PostQueueConfig{Workers: 1, QueueSize: 1})
+
+	s := newPostQueueSession(b)
+	defer s.Logout()
+	// 第一封邮件由 worker 处理，第二封排队，第三封因队列已满被延迟。
+	if err := sendMessage(t, s, "\r\n"); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	<-started
+	if err := sendMessage(t, s, "\r\n"); err != nil {
+		t.Fatalf("second message: %v", err)
+	}
+	if err := sendMessage(t, s, "\r\n"); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+
+	close(release)
+	if err := b.StopPostQueue(context.Background()); err != nil {
+		t.Fatalf("StopPostQueue failed: %v", err)
+	}
+	// 停止后不再排队，post-queue 链在事务中执行。
+	s.postQueue = b.postQueue.Load()
+	if err := sendMessage(t, s, "\r\n"); err != nil {
+		t.Errorf("expected message to pass after stop, got %v", err)
+	}
+}
+
+func TestBrisa_PostQueueInline(t *testing.T) {
+	quarantined := false
+	router := Router{}
+	router.OnPostQueue(&Middleware{Handler: func(ctx *Context) Action {
+		return Quarantine
+	}})
+	router.OnQuarantine(&Middleware{Handler: func(ctx *Context) Action {
+		quarantined = true
+		return Quarantine
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+
+	// 未启动 post-queue 阶段时，Simulate 在事务中执行 post-queue 链。
+	env := Envelope{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")},
+		From:       "alice@example.com",
+		To:         []string{"bob@example.com"},
+	}
+	res := b.Simulate(env, strings.NewReader("\r\n"))
+	if res.Err != nil || res.Action != Quarantine || !quarantined {
+		t.Errorf("expected quarantine by the post-queue chain, got %+v", res)
+	}
+}
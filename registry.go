@@ -1,16 +1,25 @@
 package brisa
 
-import "sync"
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
 
 // MiddlewareFactory defines the function signature for creating a middleware Handler from a config map.
 // The config map is typically loaded by the user's application from any source (e.g., YAML, JSON, TOML).
 type MiddlewareFactory func(config map[string]any) (Handler, error)
 
-// Registry holds a collection of named middleware factories.
+// AuthenticatorFactory creates an Authenticator from a config map.
+type AuthenticatorFactory func(config map[string]any) (Authenticator, error)
+
+// Registry holds a collection of named middleware and authenticator factories.
 // It is safe for concurrent use.
 type Registry struct {
-	mu        sync.RWMutex
-	factories map[string]MiddlewareFactory
+	mu             sync.RWMutex
+	factories      map[string]MiddlewareFactory
+	authenticators map[string]AuthenticatorFactory
+	store          Store
 }
 
 // NewRegistry creates and returns a new Registry.
@@ -41,3 +50,118 @@ func (r *Registry) Get(name string) (MiddlewareFactory, bool) {
 	factory, ok := r.factories[name]
 	return factory, ok
 }
+
+// SetStore sets the Store shared by the middleware the registry builds.
+func (r *Registry) SetStore(s Store) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store = s
+}
+
+// Store returns the Store shared by the middleware the registry builds, or
+// nil. Factories of stateful middleware call it when they are invoked, which
+// for Serve is after the store settings have been applied; see StoreConfig.
+func (r *Registry) Store() Store {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.store
+}
+
+// RegisterAuthenticator adds an authenticator factory with a given name to the
+// registry, for the auth setting. If a factory with the same name
+// already exists, it will be overwritten.
+func (r *Registry) RegisterAuthenticator(name string, factory AuthenticatorFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.authenticators == nil {
+		r.authenticators = make(map[string]AuthenticatorFactory)
+	}
+	r.authenticators[name] = factory
+}
+
+// BuildAuthenticator creates the configured authenticator with the factories
+// of the registry.
+func (r *Registry) BuildAuthenticator(cfg AuthConfig) (Authenticator, error) {
+	r.mu.RLock()
+	factory, ok := r.authenticators[cfg.Name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown authenticator %q", cfg.Name)
+	}
+	a, err := factory(cfg.Config)
+	if err != nil {
+		return nil, fmt.Errorf("create authenticator %q: %w", cfg.Name, err)
+	}
+	return a, nil
+}
+
+// BuildRouter creates the middleware of the configured chains with the factories
+// of the registry. Middleware of the SMTP event chains default to
+// DefaultIgnoreFlags, those of the disposition chains to no flags, so that
+// they run for the action that selected the chain. Each middleware logs with
+// its name as LogComponentKey.
+func (r *Registry) BuildRouter(chains map[ChainType][]MiddlewareConfig) (*Router, error) {
+	router := Router{}
+	for chain, configs := range chains {
+		for i, mc := range configs {
+			factory, ok := r.Get(mc.Name)
+			if !ok {
+				return nil, fmt.Errorf("chains.%s[%d]: unknown middleware %q", chain, i, mc.Name)
+			}
+			handler, err := factory(mc.Config)
+			if err != nil {
+				return nil, fmt.Errorf("chains.%s[%d]: create middleware %q: %w", chain, i, mc.Name, err)
+			}
+			flags, err := mc.ignoreFlags(chain)
+			if err != nil {
+				return nil, fmt.Errorf("chains.%s[%d]: %w", chain, i, err)
+			}
+			cond, err := conditions(mc.OnlyIf, mc.SkipIf)
+			if err != nil {
+				return nil, fmt.Errorf("chains.%s[%d].%w", chain, i, err)
+			}
+			m := &Middleware{Name: mc.Name, Handler: withComponent(mc.Name, handler), IgnoreFlags: flags, Condition: cond, MaxScanBytes: mc.MaxScanBytes}
+			if mc.RejectMessage != "" {
+				if m.RejectMessage, err = NewReplyTemplate(mc.RejectMessage); err != nil {
+					return nil, fmt.Errorf("chains.%s[%d]: reject_message: %w", chain, i, err)
+				}
+			}
+			router.Use(chain, m)
+		}
+	}
+	return &router, nil
+}
+
+// withComponent makes the context logger name the middleware while handler
+// runs, so that per-component log levels apply to it.
+func withComponent(name string, handler Handler) Handler {
+	attrs := []slog.Attr{slog.String(LogComponentKey, name)}
+	return func(ctx *Context) Action {
+		logger := ctx.Logger
+		if logger != nil {
+			ctx.Logger = ctx.componentLogger(logger, name, attrs)
+			defer func() { ctx.Logger = logger }()
+		}
+		return handler(ctx)
+	}
+}
+
+// componentLogger returns the logger of the middleware name, derived from
+// base. It is built on the first call and reused by the later ones until the
+// context logger changes, e.g. for the next transaction.
+func (c *Context) componentLogger(base *slog.Logger, name string, attrs []slog.Attr) *slog.Logger {
+	if c.componentBase != base {
+		c.componentBase = base
+		clear(c.componentLoggers)
+	}
+	if logger, ok := c.componentLoggers[name]; ok {
+		return logger
+	}
+	if c.componentLoggers == nil {
+		c.componentLoggers = make(map[string]*slog.Logger)
+	}
+	logger := slog.New(base.Handler().WithAttrs(attrs))
+	c.componentLoggers[name] = logger
+	return logger
+}
@@ -0,0 +1,77 @@
+package brisa
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_BuildRouter(t *testing.T) {
+	r := NewRegistry()
+	r.Register("pass", func(config map[string]any) (Handler, error) {
+		return func(ctx *Context) Action { return Pass }, nil
+	})
+	r.Register("broken", func(config map[string]any) (Handler, error) {
+		return nil, errors.New("bad config")
+	})
+
+	router, err := r.BuildRouter(map[ChainType][]MiddlewareConfig{
+		ChainConn:    {{Name: "pass"}, {Name: "pass", IgnoreFlags: []string{}}},
+		ChainDeliver: {{Name: "pass"}, {Name: "pass", IgnoreFlags: []string{"Quarantine", "discard"}, MaxScanBytes: 4096}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conn := (*router)[ChainConn]
+	if len(conn) != 2 || conn[0].IgnoreFlags != DefaultIgnoreFlags || conn[1].IgnoreFlags != 0 {
+		t.Errorf("unexpected conn chain flags: %+v", conn)
+	}
+	// 处置链默认不跳过任何中间件
+	deliver := (*router)[ChainDeliver]
+	if len(deliver) != 2 || deliver[0].IgnoreFlags != 0 || deliver[1].IgnoreFlags != IgnoreQuarantine|IgnoreDiscard {
+		t.Errorf("unexpected deliver chain flags: %+v", deliver)
+	}
+	if deliver[0].MaxScanBytes != 0 || deliver[1].MaxScanBytes != 4096 {
+		t.Errorf("unexpected deliver chain scan limits: %+v", deliver)
+	}
+
+	// 中间件以其名称作为日志组件
+	r.Register("logging", func(config map[string]any) (Handler, error) {
+		return func(ctx *Context) Action {
+			ctx.Logger.Info("handled")
+			return Pass
+		}, nil
+	})
+	router, err = r.BuildRouter(map[ChainType][]MiddlewareConfig{ChainData: {{Name: "logging"}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	ctx := &Context{Logger: logger}
+	(*router)[ChainData][0].Handler(ctx)
+	if !strings.Contains(buf.String(), LogComponentKey+"=logging") {
+		t.Errorf("expected component attribute, got %q", buf.String())
+	}
+	if ctx.Logger != logger {
+		t.Error("expected context logger to be restored")
+	}
+	// 组件日志记录器只在上下文日志记录器变化时重新构建
+	quiet := withComponent("quiet", func(ctx *Context) Action { return Pass })
+	if allocs := testing.AllocsPerRun(100, func() { quiet(ctx) }); allocs != 0 {
+		t.Errorf("expected no allocations per call, got %v", allocs)
+	}
+
+	for name, chains := range map[string]map[ChainType][]MiddlewareConfig{
+		"unknown middleware": {ChainConn: {{Name: "missing"}}},
+		"factory error":      {ChainConn: {{Name: "broken"}}},
+		"invalid flag":       {ChainConn: {{Name: "pass", IgnoreFlags: []string{"reject"}}}},
+	} {
+		if _, err := r.BuildRouter(chains); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package brisa
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ReplyData is the data a ReplyTemplate is executed with.
+type ReplyData struct {
+	// Code and EnhancedCode are those of the reply, e.g. 554 and "5.7.1".
+	Code         int
+	EnhancedCode string
+	// Temporary is set for 4xx replies.
+	Temporary bool
+	// Message is the text the reply would have without the template.
+	Message   string
+	SessionID string
+	// MailID is empty before MAIL FROM.
+	MailID   string
+	ClientIP string
+	Chain    ChainType
+	// Middleware is the name of the middleware that rejected the command.
+	Middleware string
+}
+
+// ReplyTemplate is a text/template for the text of rejection replies, so
+// senders and support staff get actionable errors, e.g.
+//
+//	{{.Message}}. See https://example.com/mail-help?id={{.MailID}}
+//
+// It is executed with a ReplyData. The code of the reply is not changed.
+type ReplyTemplate struct {
+	tmpl *template.Template
+}
+
+// NewReplyTemplate parses text into a ReplyTemplate.
+func NewReplyTemplate(text string) (*ReplyTemplate, error) {
+	tmpl, err := template.New("reply").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplyTemplate{tmpl: tmpl}, nil
+}
+
+// Render returns reply with its text replaced by the template executed for
+// data filled from reply. Line breaks are replaced by spaces, as a reply text
+// must be a single line.
+func (t *ReplyTemplate) Render(reply *smtp.SMTPError, data ReplyData) (*smtp.SMTPError, error) {
+	data.Code = reply.Code
+	data.Temporary = reply.Temporary()
+	data.Message = reply.Message
+	if reply.EnhancedCode != smtp.NoEnhancedCode && reply.EnhancedCode != smtp.EnhancedCodeNotSet {
+		c := reply.EnhancedCode
+		data.EnhancedCode = fmt.Sprintf("%d.%d.%d", c[0], c[1], c[2])
+	}
+
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	text := strings.Join(strings.Fields(b.String()), " ")
+	if text == "" {
+		return nil, errors.New("reply template produced an empty text")
+	}
+	rendered := *reply
+	rendered.Message = text
+	return &rendered, nil
+}
+
+// reply returns the reply for a rejection of the command in chain, rendered
+// with the template of the rejecting middleware or, for the default policy
+// rejection, the default template of the server.
+func (s *Session) reply(reply *smtp.SMTPError, chain ChainType) *smtp.SMTPError {
+	tmpl := s.rejectMessage
+	var name string
+	if m := s.ctx.rejectedBy; m != nil {
+		name = m.Name
+		if m.RejectMessage != nil {
+			tmpl = m.RejectMessage
+		} else if reply != ErrRejectedByPolicy {
+			// A reply chosen by the middleware is kept as is.
+			tmpl = nil
+		}
+	}
+	if tmpl == nil {
+		return reply
+	}
+
+	data := ReplyData{SessionID: s.id, MailID: s.mailID, Chain: chain, Middleware: name}
+	if addr, ok := s.GetClientIP().(*net.TCPAddr); ok {
+		data.ClientIP = addr.IP.String()
+	}
+	rendered, err := tmpl.Render(reply, data)
+	if err != nil {
+		s.ctx.Logger.Error("failed to render reject message", "error", err)
+		return reply
+	}
+	return rendered
+}
@@ -0,0 +1,93 @@
+package brisa
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestReplyTemplate(t *testing.T) {
+	mustTemplate := func(text string) *ReplyTemplate {
+		tmpl, err := NewReplyTemplate(text)
+		if err != nil {
+			t.Fatalf("parse template: %v", err)
+		}
+		return tmpl
+	}
+	errNoUser := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+
+	router := Router{}
+	router.OnConn(&Middleware{Name: "allow", Handler: func(ctx *Context) Action { return Pass }})
+	router.OnRcptTo(&Middleware{
+		Name: "recipients",
+		Handler: func(ctx *Context) Action {
+			if ctx.To[len(ctx.To)-1] == "nobody@example.com" {
+				return ctx.RejectWith(errNoUser)
+			}
+			return Pass
+		},
+	})
+	router.OnRcptTo(&Middleware{
+		Name: "policy",
+		Handler: func(ctx *Context) Action {
+			if strings.HasPrefix(ctx.To[len(ctx.To)-1], "blocked") {
+				return Reject
+			}
+			return Pass
+		},
+	})
+	router.OnData(&Middleware{
+		Name:          "content",
+		Handler:       func(ctx *Context) Action { return ctx.RejectWith(ErrTryAgainLater) },
+		RejectMessage: mustTemplate("{{if .Temporary}}Deferred{{else}}Refused{{end}} by {{.Middleware}} ({{.EnhancedCode}}), ref {{.MailID}}"),
+	})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+	b.SetRejectMessage(mustTemplate("{{.Message}}.\nSee https://example.com/help?ip={{.ClientIP}}"))
+
+	env := Envelope{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")},
+		From:       "alice@example.com",
+		To:         []string{"bob@example.com", "nobody@example.com", "blocked@example.com"},
+	}
+	result := b.Simulate(env, strings.NewReader("Subject: hi\r\n\r\nhi\r\n"))
+
+	// 中间件用 RejectWith 选择的回复保持不变
+	if err := result.RcptErrors["nobody@example.com"]; err != errNoUser {
+		t.Errorf("expected the middleware reply, got %v", err)
+	}
+	// 默认的策略拒绝使用服务器模板，换行被替换为空格
+	var smtpErr *smtp.SMTPError
+	if !errors.As(result.RcptErrors["blocked@example.com"], &smtpErr) {
+		t.Fatalf("expected an SMTP error, got %v", result.RcptErrors["blocked@example.com"])
+	}
+	want := "Message rejected due to policy. See https://example.com/help?ip=198.51.100.1"
+	if smtpErr.Code != 554 || smtpErr.Message != want {
+		t.Errorf("expected 554 %q, got %d %q", want, smtpErr.Code, smtpErr.Message)
+	}
+	// 中间件自己的模板覆盖 RejectWith 的文本，但保留状态码
+	if !errors.As(result.Err, &smtpErr) {
+		t.Fatalf("expected an SMTP error, got %v", result.Err)
+	}
+	if smtpErr.Code != 421 || !strings.HasPrefix(smtpErr.Message, "Deferred by content (4.3.2), ref ") || strings.HasSuffix(smtpErr.Message, "ref ") {
+		t.Errorf("unexpected reply %d %q", smtpErr.Code, smtpErr.Message)
+	}
+	if ErrTryAgainLater.Message != "Service temporarily unavailable, please try again later" {
+		t.Error("rendering must not modify the original reply")
+	}
+}
+
+func TestNewReplyTemplate_Errors(t *testing.T) {
+	if _, err := NewReplyTemplate("{{.MailID"); err == nil {
+		t.Error("expected error for an invalid template")
+	}
+	tmpl, _ := NewReplyTemplate("{{.Unknown}}")
+	if _, err := tmpl.Render(ErrRejectedByPolicy, ReplyData{}); err == nil {
+		t.Error("expected error for an unknown field")
+	}
+}
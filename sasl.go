@@ -0,0 +1,241 @@
+package brisa
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// scramIterations is the PBKDF2 iteration count of SCRAM-SHA-256, the
+// minimum of RFC 7677. The salted password is derived for each attempt, as
+// the Secret of a SecretAuthenticator is the plain password.
+const scramIterations = 4096
+
+var errInvalidSASLResponse = &smtp.SMTPError{
+	Code:         501,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+	Message:      "Invalid authentication response",
+}
+
+// domain returns the domain the server announces, for CRAM-MD5 challenges.
+func (s *Session) domain() string {
+	if s.conn != nil && s.conn.Server().Domain != "" {
+		return s.conn.Server().Domain
+	}
+	return "localhost"
+}
+
+// cramMD5Server is the server side of the CRAM-MD5 mechanism (RFC 2195).
+type cramMD5Server struct {
+	challenge string
+	secret    func(username string) (string, error)
+	finish    func(username string, err error) error
+	sent      bool
+}
+
+func newCramMD5Server(domain string, secret func(string) (string, error), finish func(string, error) error) *cramMD5Server {
+	return &cramMD5Server{
+		challenge: fmt.Sprintf("<%s.%d@%s>", rand.Text(), time.Now().UnixNano(), domain),
+		secret:    secret,
+		finish:    finish,
+	}
+}
+
+// Next implements sasl.Server.
+func (c *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if !c.sent {
+		// CRAM-MD5 has no initial response.
+		if len(response) != 0 {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+		c.sent = true
+		return []byte(c.challenge), false, nil
+	}
+	username, digest, ok := strings.Cut(string(response), " ")
+	if !ok || username == "" {
+		return nil, true, errInvalidSASLResponse
+	}
+	secret, err := c.secret(username)
+	if err == nil {
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write([]byte(c.challenge))
+		if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(strings.ToLower(digest))) {
+			err = errors.New("invalid CRAM-MD5 digest")
+		}
+	}
+	return nil, true, c.finish(username, err)
+}
+
+// scramServer is the server side of the SCRAM-SHA-256 mechanism (RFC 5802,
+// RFC 7677) without channel binding.
+type scramServer struct {
+	secret func(username string) (string, error)
+	finish func(username string, err error) error
+
+	step            int
+	gs2Header       string
+	username        string
+	password        string
+	lookupErr       error
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	salt            []byte
+	serverSignature []byte
+}
+
+func newScramServer(secret func(string) (string, error), finish func(string, error) error) *scramServer {
+	return &scramServer{secret: secret, finish: finish}
+}
+
+// Next implements sasl.Server.
+func (s *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.step {
+	case 0:
+		if response == nil {
+			// No initial response; ask for the client-first-message.
+			s.step = 1
+			return []byte{}, false, nil
+		}
+		return s.clientFirst(string(response))
+	case 1:
+		return s.clientFirst(string(response))
+	case 2:
+		return s.clientFinal(string(response))
+	case 3:
+		// The client acknowledged the server-final-message.
+		s.step = 4
+		return nil, true, nil
+	}
+	return nil, true, sasl.ErrUnexpectedClientResponse
+}
+
+func (s *scramServer) clientFirst(msg string) ([]byte, bool, error) {
+	// gs2-header: channel binding flag, authzid, then the bare message.
+	flag, rest, ok := strings.Cut(msg, ",")
+	if !ok || (flag != "n" && flag != "y") {
+		// "p=" asks for channel binding, which is not offered.
+		return nil, true, errInvalidSASLResponse
+	}
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, true, errInvalidSASLResponse
+	}
+	s.gs2Header = flag + "," + authzid + ","
+	s.clientFirstBare = bare
+
+	attrs := scramAttributes(bare)
+	username, ok := scramUnescape(attrs["n"])
+	if !ok || username == "" || attrs["r"] == "" {
+		return nil, true, errInvalidSASLResponse
+	}
+	if authzid != "" {
+		if id, ok := scramUnescape(strings.TrimPrefix(authzid, "a=")); !ok || id != username {
+			return nil, true, s.finish(username, errors.New("authorization identity differs from user name"))
+		}
+	}
+	s.username = username
+
+	// Unknown users get a made-up salt, so that the reply does not tell them
+	// apart; the attempt fails with the proof.
+	s.password, s.lookupErr = s.secret(username)
+	s.salt = make([]byte, 16)
+	rand.Read(s.salt)
+	s.nonce = attrs["r"] + rand.Text()
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(s.salt) + ",i=" + strconv.Itoa(scramIterations)
+	s.step = 2
+	return []byte(s.serverFirst), false, nil
+}
+
+func (s *scramServer) clientFinal(msg string) ([]byte, bool, error) {
+	withoutProof, proof64, ok := strings.Cut(msg, ",p=")
+	if !ok {
+		return nil, true, errInvalidSASLResponse
+	}
+	attrs := scramAttributes(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attrs["r"] != s.nonce {
+		return nil, true, errInvalidSASLResponse
+	}
+	proof, err := base64.StdEncoding.DecodeString(proof64)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, true, errInvalidSASLResponse
+	}
+	if s.lookupErr != nil {
+		return nil, true, s.finish(s.username, s.lookupErr)
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, s.password, s.salt, scramIterations, sha256.Size)
+	if err != nil {
+		return nil, true, s.finish(s.username, err)
+	}
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientSignature[i]
+	}
+	if received := sha256.Sum256(proof); !hmac.Equal(received[:], storedKey[:]) {
+		return nil, true, s.finish(s.username, errors.New("invalid SCRAM proof"))
+	}
+	if err := s.finish(s.username, nil); err != nil {
+		return nil, true, err
+	}
+	// SMTP has no success data (RFC 4954), so the server-final-message is a
+	// challenge the client answers with an empty response.
+	s.serverSignature = hmacSHA256(hmacSHA256(salted, []byte("Server Key")), authMessage)
+	s.step = 3
+	return []byte("v=" + base64.StdEncoding.EncodeToString(s.serverSignature)), false, nil
+}
+
+// scramAttributes parses the comma separated key=value attributes of a SCRAM
+// message.
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(attr, "="); ok && len(k) == 1 {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// scramUnescape decodes a saslname, in which "=2C" stands for "," and "=3D"
+// for "=".
+func scramUnescape(name string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return b.String(), true
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
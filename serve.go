@@ -0,0 +1,543 @@
+package brisa
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa/address"
+)
+
+// DefaultShutdownTimeout is the default time Serve waits for open sessions to
+// finish on shutdown.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Serve runs an SMTP server for cfg until it receives SIGINT or SIGTERM. It
+// builds the routers from the registry, applies the server settings (including
+// TLS) to server.addr and every configured listener, logs through a logger
+// built from the log settings (slog.Default if there are none), installs a
+// LogObserver, gives the middleware a Store (see StoreConfig), serves the
+// debug endpoints if configured, starts the post-queue stage if a post_queue
+// chain has middleware and shuts down gracefully, waiting up to the
+// configured shutdown timeout for open sessions and queued messages.
+//
+// Embedding Brisa then only takes registering the middleware factories, the
+// built-in ones with middleware.Register and any of the program's own:
+//
+//	registry := brisa.NewRegistry()
+//	middleware.Register(registry)
+//	registry.Register("my_filter", newMyFilter)
+//	cfg, err := brisa.LoadConfig("brisa.yaml")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(brisa.Serve(cfg, registry))
+func Serve(cfg *Config, registry *Registry) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, cfg, registry, nil)
+}
+
+// ServeFile loads the configuration file at path and serves it like Serve. On
+// SIGHUP the file is loaded again and the middleware chains are replaced
+// without interrupting the server; a configuration that fails to load is
+// logged and ignored. The TLS certificates and spool settings, e.g. rotated
+// spool keys, are reloaded too; other changed server settings take effect on
+// restart. With debug endpoints and debug.access, a POST to
+// /debug/ops/reload reloads the file the same way.
+func ServeFile(path string, registry *Registry) error {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, cfg, registry, func() (*Config, error) { return LoadConfig(path) })
+}
+
+// newServeBrisa creates the Brisa instance of serve. Tests replace it to
+// inspect the instance after serve returns.
+var newServeBrisa = New
+
+// serve runs the server until ctx is done. If reload is not nil, SIGHUP and
+// the reload debug endpoint rebuild the router from the configuration it
+// returns.
+func serve(ctx context.Context, cfg *Config, registry *Registry, reload func() (*Config, error)) error {
+	logger := slog.Default()
+	if !cfg.Log.isZero() {
+		l, closer, err := NewLogger(cfg.Log)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+		logger = l
+	}
+
+	switch {
+	case registry.Store() != nil:
+		if cfg.Store.File != "" || cfg.Store.Redis.Addr != "" || cfg.Store.Gossip.Addr != "" {
+			logger.Warn("store settings ignored: the registry has a store of its own")
+		}
+	case cfg.Store.Redis.Addr != "":
+		store, err := cfg.Store.Redis.newRedisStore()
+		if err != nil {
+			return fmt.Errorf("store.redis: %w", err)
+		}
+		defer store.Close()
+		registry.SetStore(store)
+	default:
+		store := NewMemoryStore()
+		if cfg.Store.File != "" {
+			if err := store.LoadFile(cfg.Store.File); err != nil {
+				return fmt.Errorf("store: %w", err)
+			}
+			defer func() {
+				if err := store.SaveFile(cfg.Store.File); err != nil {
+					logger.Error("failed to save store", "file", cfg.Store.File, "error", err)
+				}
+			}()
+		}
+		interval := time.Duration(cfg.Store.SweepInterval)
+		if interval <= 0 {
+			interval = DefaultStoreSweepInterval
+		}
+		janitor := NewJanitor(logger)
+		janitor.Schedule("store", interval, store.SweepTask())
+		janitorCtx, stopJanitor := context.WithCancel(ctx)
+		defer stopJanitor()
+		go janitor.Run(janitorCtx)
+		if cfg.Store.Gossip.Addr == "" {
+			registry.SetStore(store)
+			break
+		}
+		gossip, err := cfg.Store.Gossip.newGossipStore(store, logger)
+		if err != nil {
+			return fmt.Errorf("store.gossip: %w", err)
+		}
+		defer gossip.Close()
+		registry.SetStore(gossip)
+		logger.Info("store gossip started", "address", gossip.Addr().String(), "peers", len(cfg.Store.Gossip.Peers))
+	}
+
+	routers, err := BuildRouters(registry, cfg)
+	if err != nil {
+		return err
+	}
+	SetContextChecks(cfg.Debug.CheckContexts)
+	observers := []Observer{LogObserver{}}
+	if cfg.Debug.Addr != "" {
+		observers = append(observers, ExpvarObserver{})
+	}
+	b := newServeBrisa(logger, observers...)
+	routers.apply(b, cfg)
+	b.SetDeferredRejection(cfg.Server.DeferReject)
+	b.SetProtocolLimits(cfg.Server.ProtocolLimits())
+	b.SetDataGate(cfg.Server.DataGate())
+	spool, err := cfg.Server.Spool()
+	if err != nil {
+		return fmt.Errorf("server.spool_key_files: %w", err)
+	}
+	b.SetSpool(spool)
+	if cfg.Server.RejectMessage != "" {
+		tmpl, err := NewReplyTemplate(cfg.Server.RejectMessage)
+		if err != nil {
+			return fmt.Errorf("server.reject_message: %w", err)
+		}
+		b.SetRejectMessage(tmpl)
+	}
+	if cfg.Auth.Name != "" {
+		a, err := registry.BuildAuthenticator(cfg.Auth)
+		if err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+		b.SetAuthenticator(a)
+	}
+	updateAuthMechanisms(b, cfg)
+	timeout := time.Duration(cfg.Server.ShutdownTimeout)
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	if cfg.hasPostQueue() {
+		b.StartPostQueue(PostQueueConfig{Workers: cfg.Server.PostQueueWorkers, QueueSize: cfg.Server.PostQueueSize})
+	}
+	b.StartHooks(HookConfig{Workers: cfg.Server.HookWorkers, QueueSize: cfg.Server.HookQueueSize})
+	// Returning on an error stops the workers too; after a graceful shutdown
+	// they are already stopped.
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := b.StopPostQueue(stopCtx); err != nil {
+			logger.Error("post-queue stopped before processing all messages", "error", err)
+		}
+		if err := b.StopHooks(stopCtx); err != nil {
+			logger.Error("hooks stopped before running all of them", "error", err)
+		}
+	}()
+
+	certs := new(Certificates)
+	tlsConfig, err := cfg.Server.TLS.LoadInto(certs)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		tlsConfig = b.FingerprintTLS(tlsConfig)
+	} else {
+		// Without TLS at start, there is nothing to reload.
+		certs = nil
+	}
+
+	// The server of server.addr has no listener name; the configured
+	// listeners follow it.
+	listeners := append([]ListenerConfig{{Addr: cfg.Server.Addr, ImplicitTLS: cfg.Server.TLS.Implicit}}, cfg.Listeners...)
+	servers := make([]*smtp.Server, 0, len(listeners))
+	closeAll := func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	}
+	errCh := make(chan error, len(listeners))
+	for i, lc := range listeners {
+		var s *smtp.Server
+		if i == 0 {
+			s = smtp.NewServer(b)
+		} else {
+			s = smtp.NewServer(b.Listener(lc.Name))
+		}
+		cfg.Server.Apply(s)
+		s.ErrorLog = slogErrorLog{logger}
+		s.Addr = lc.Addr
+		if lc.Hostname != "" {
+			s.Domain = lc.Hostname
+		}
+		if s.Addr == "" {
+			s.Addr = ":25"
+		}
+		s.TLSConfig = tlsConfig
+
+		var l net.Listener
+		if lc.ImplicitTLS {
+			l, err = tls.Listen("tcp", s.Addr, tlsConfig)
+		} else {
+			l, err = net.Listen("tcp", s.Addr)
+			if err == nil && cfg.Server.GreetDelay > 0 {
+				l = NewGreetListener(l, time.Duration(cfg.Server.GreetDelay))
+			}
+		}
+		if err != nil {
+			closeAll()
+			return err
+		}
+		servers = append(servers, s)
+		go func() { errCh <- s.Serve(l) }()
+		logger.Info("SMTP server started", "listener", lc.Name, "address", l.Addr().String(), "hostname", s.Domain, "tls", tlsConfig != nil, "implicit_tls", lc.ImplicitTLS)
+	}
+
+	reloads := make(chan chan error)
+	if cfg.Debug.Addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/", NewDebugHandler())
+		var handler http.Handler = mux
+		if len(cfg.Debug.Access) > 0 {
+			// The operations change state, so they are only served when
+			// clients must authenticate.
+			if reload != nil {
+				mux.Handle(debugOpsPath+"reload", debugReloadHandler(reloads))
+			}
+			mux.Handle(debugOpsPath+"purge", debugPurgeHandler(registry.Store(), logger))
+			if handler, err = NewDebugAuthHandler(handler, cfg.Debug.Access); err != nil {
+				closeAll()
+				return fmt.Errorf("debug endpoints: %w", err)
+			}
+		}
+		debugTLS, err := cfg.Debug.TLS.Load()
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("debug endpoints: %w", err)
+		}
+		dl, err := net.Listen("tcp", cfg.Debug.Addr)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("debug endpoints: %w", err)
+		}
+		if debugTLS != nil {
+			dl = tls.NewListener(dl, debugTLS)
+		}
+		debugServer := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		defer debugServer.Close()
+		go func() {
+			if err := debugServer.Serve(dl); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("debug endpoints stopped", "error", err)
+			}
+		}()
+		logger.Info("debug endpoints started", "address", dl.Addr().String(), "tls", debugTLS != nil, "access", len(cfg.Debug.Access))
+	}
+
+	hup := make(chan os.Signal, 1)
+	if reload != nil {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	for {
+		select {
+		case err := <-errCh:
+			closeAll()
+			return fmt.Errorf("smtp server: %w", err)
+		case <-hup:
+			if err := reloadRouter(b, registry, certs, reload); err != nil {
+				logger.Error("config reload failed, keeping current middleware chains", "error", err)
+			}
+		case done := <-reloads:
+			err := reloadRouter(b, registry, certs, reload)
+			if err != nil {
+				logger.Error("config reload failed, keeping current middleware chains", "error", err)
+			}
+			done <- err
+		case <-ctx.Done():
+			logger.Info("shutting down SMTP server", "timeout", timeout)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			shutdownErrs := make([]error, len(servers))
+			var wg sync.WaitGroup
+			for i, s := range servers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := s.Shutdown(shutdownCtx); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+						s.Close()
+						shutdownErrs[i] = err
+					}
+				}()
+			}
+			wg.Wait()
+			if err := errors.Join(shutdownErrs...); err != nil {
+				return err
+			}
+			// Accepted messages are still processed within the timeout.
+			if err := b.StopPostQueue(shutdownCtx); err != nil {
+				return fmt.Errorf("post-queue: %w", err)
+			}
+			// The post-queue stage schedules hooks too.
+			if err := b.StopHooks(shutdownCtx); err != nil {
+				return fmt.Errorf("hooks: %w", err)
+			}
+			return nil
+		}
+	}
+}
+
+// debugReloadHandler has the serve loop reload the configuration, as on
+// SIGHUP, and replies with the outcome.
+func debugReloadHandler(reloads chan<- chan error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		done := make(chan error, 1)
+		select {
+		case reloads <- done:
+		case <-r.Context().Done():
+			return
+		}
+		if err := <-done; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "reloaded")
+	})
+}
+
+// debugPurgeHandler removes the keys of the address of the "address" form
+// value from store; see PurgeAddress. The address is not logged.
+//
+// Only store keys are purged. Quarantined messages are handed to the
+// backend like delivered ones, so Brisa keeps no copy of them to remove, and
+// log records are left as written: chained logs cannot drop a record
+// without breaking the chain, so addresses are kept out of them with
+// redaction (see LogRedactConfig) rather than purged afterwards.
+func debugPurgeHandler(store Store, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		addr := r.FormValue("address")
+		if _, err := address.Parse(addr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, err := PurgeAddress(store, addr)
+		switch {
+		case errors.Is(err, ErrStoreNotScannable):
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("store keys of an address purged", "keys", n)
+		fmt.Fprintf(w, "purged %d keys\n", n)
+	})
+}
+
+// reloadRouter applies the chains, certificates and spool settings of the
+// reloaded configuration. Nothing is applied unless all of them can be.
+func reloadRouter(b *Brisa, registry *Registry, certs *Certificates, reload func() (*Config, error)) error {
+	cfg, err := reload()
+	if err != nil {
+		return err
+	}
+	routers, err := BuildRouters(registry, cfg)
+	if err != nil {
+		return err
+	}
+	spool, err := cfg.Server.Spool()
+	if err != nil {
+		return fmt.Errorf("server.spool_key_files: %w", err)
+	}
+	if certs != nil {
+		if err := certs.Load(&cfg.Server.TLS); err != nil {
+			return fmt.Errorf("server.tls: %w", err)
+		}
+	}
+	routers.apply(b, cfg)
+	updateAuthMechanisms(b, cfg)
+	b.SetSpool(spool)
+	return nil
+}
+
+// Routers are the routers of a configuration: the top-level one, those of
+// the listeners with chains of their own and those of the tenants.
+type Routers struct {
+	Router *Router
+	// Listeners holds the routers of the listeners with chains of their own.
+	Listeners map[string]*Router
+	// Tenants are the tenants of the configuration, in order.
+	Tenants []Tenant
+	table   *tenantTable
+}
+
+// BuildRouters builds all routers of cfg the way Serve does, so that they
+// are applied together or not at all.
+func BuildRouters(registry *Registry, cfg *Config) (*Routers, error) {
+	router, err := registry.BuildRouter(cfg.Chains)
+	if err != nil {
+		return nil, err
+	}
+	r := &Routers{Router: router, Listeners: make(map[string]*Router, len(cfg.Listeners))}
+	for i, l := range cfg.Listeners {
+		if l.Chains == nil {
+			continue
+		}
+		router, err := registry.BuildRouter(l.Chains)
+		if err != nil {
+			return nil, fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		r.Listeners[l.Name] = router
+	}
+	r.Tenants = make([]Tenant, 0, len(cfg.Tenants))
+	for i, t := range cfg.Tenants {
+		router, err := registry.BuildRouter(t.Chains)
+		if err != nil {
+			return nil, fmt.Errorf("tenants[%d]: %w", i, err)
+		}
+		r.Tenants = append(r.Tenants, Tenant{Name: t.Name, Domains: t.Domains, Router: router})
+	}
+	if r.table, err = compileTenants(r.Tenants); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// apply makes the routers those of new sessions of b. Listeners without
+// chains use the top-level router.
+func (r *Routers) apply(b *Brisa, cfg *Config) {
+	for _, l := range cfg.Listeners {
+		b.UpdateListenerRouter(l.Name, r.Listeners[l.Name])
+	}
+	b.tenants.Store(r.table)
+	b.UpdateRouter(r.Router)
+}
+
+// Check builds what Serve builds from cfg without listening: the routers and
+// tenants, the authenticator, the spool keys, the TLS settings of the server
+// and the TLS settings and access tokens of the debug endpoints, and the log
+// sinks, which it opens and closes again. Unless registry has a Store, the
+// middleware get a MemoryStore, so that no Redis server or gossip peer is
+// contacted.
+func Check(cfg *Config, registry *Registry) (*Routers, error) {
+	if !cfg.Log.isZero() {
+		_, closer, err := NewLogger(cfg.Log)
+		if err != nil {
+			return nil, fmt.Errorf("log: %w", err)
+		}
+		closer.Close()
+	}
+	if registry.Store() == nil {
+		registry.SetStore(NewMemoryStore())
+	}
+	routers, err := BuildRouters(registry, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server.RejectMessage != "" {
+		if _, err := NewReplyTemplate(cfg.Server.RejectMessage); err != nil {
+			return nil, fmt.Errorf("server.reject_message: %w", err)
+		}
+	}
+	if cfg.Auth.Name != "" {
+		if _, err := registry.BuildAuthenticator(cfg.Auth); err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	}
+	if _, err := cfg.Server.Spool(); err != nil {
+		return nil, fmt.Errorf("server.spool_key_files: %w", err)
+	}
+	if _, err := cfg.Server.TLS.Load(); err != nil {
+		return nil, fmt.Errorf("server.tls: %w", err)
+	}
+	if _, err := cfg.Debug.TLS.Load(); err != nil {
+		return nil, fmt.Errorf("debug.tls: %w", err)
+	}
+	if len(cfg.Debug.Access) > 0 {
+		if _, err := NewDebugAuthHandler(http.NotFoundHandler(), cfg.Debug.Access); err != nil {
+			return nil, fmt.Errorf("debug endpoints: %w", err)
+		}
+	}
+	return routers, nil
+}
+
+// updateAuthMechanisms applies the SASL mechanisms of server.addr and the
+// listeners of cfg to b.
+func updateAuthMechanisms(b *Brisa, cfg *Config) {
+	b.SetAuthMechanisms("", cfg.authMechanisms(ListenerConfig{}))
+	for _, l := range cfg.Listeners {
+		b.SetAuthMechanisms(l.Name, cfg.authMechanisms(l))
+	}
+}
+
+// slogErrorLog adapts a slog.Logger to the smtp.Logger interface of go-smtp.
+type slogErrorLog struct {
+	logger *slog.Logger
+}
+
+func (l slogErrorLog) Printf(format string, v ...any) {
+	l.logger.Error(fmt.Sprintf(format, v...))
+}
+
+func (l slogErrorLog) Println(v ...any) {
+	l.logger.Error(fmt.Sprint(v...))
+}
@@ -0,0 +1,523 @@
+package brisa
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestServe(t *testing.T) {
+	// 先占用一个空闲端口再释放，供服务器监听
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	registry := NewRegistry()
+	registry.Register("reject_all", func(config map[string]any) (Handler, error) {
+		return func(ctx *Context) Action { return Reject }, nil
+	})
+	cfg := &Config{
+		Server: ServerConfig{Addr: addr, Hostname: "mx.example.com", ShutdownTimeout: Duration(time.Second)},
+		Chains: map[ChainType][]MiddlewareConfig{ChainRcptTo: {{Name: "reject_all"}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, cfg, registry, nil) }()
+
+	var c *smtp.Client
+	for i := 0; i < 50; i++ {
+		if c, err = smtp.Dial(addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatalf("unexpected EHLO error: %v", err)
+	}
+	if err := c.Mail("a@example.org", nil); err != nil {
+		t.Fatalf("unexpected MAIL error: %v", err)
+	}
+	if err := c.Rcpt("b@example.com", nil); err == nil {
+		t.Error("expected RCPT to be rejected by the configured chain")
+	}
+	c.Quit()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+}
+
+func TestServe_Listeners(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+
+	registry := NewRegistry()
+	registry.Register("reject_all", func(config map[string]any) (Handler, error) {
+		return func(ctx *Context) Action { return Reject }, nil
+	})
+	// MX 端口拒绝所有收件人，submission 端口使用自己的空链。
+	cfg := &Config{
+		Server:    ServerConfig{Addr: addrs[0], Hostname: "mx.example.com", ShutdownTimeout: Duration(time.Second)},
+		Chains:    map[ChainType][]MiddlewareConfig{ChainRcptTo: {{Name: "reject_all"}}},
+		Listeners: []ListenerConfig{{Name: "submission", Addr: addrs[1], Hostname: "submit.example.com", Chains: map[ChainType][]MiddlewareConfig{}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, cfg, registry, nil) }()
+
+	rcpt := func(addr string) error {
+		var c *smtp.Client
+		var err error
+		for i := 0; i < 50; i++ {
+			if c, err = smtp.Dial(addr); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %v", addr, err)
+		}
+		defer c.Quit()
+		if err := c.Mail("a@example.org", nil); err != nil {
+			t.Fatalf("unexpected MAIL error: %v", err)
+		}
+		return c.Rcpt("b@example.com", nil)
+	}
+	if err := rcpt(addrs[0]); err == nil {
+		t.Error("expected RCPT to be rejected on the MX listener")
+	}
+	if err := rcpt(addrs[1]); err != nil {
+		t.Errorf("expected RCPT to be accepted on the submission listener, got %v", err)
+	}
+	// 每个监听器以自己的主机名问候
+	for i, want := range []string{"220 mx.example.com ", "220 submit.example.com "} {
+		conn, err := net.Dial("tcp", addrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		greeting, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if !strings.HasPrefix(greeting, want) {
+			t.Errorf("expected greeting %q..., got %q", want, greeting)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+}
+
+func TestServe_InvalidConfig(t *testing.T) {
+	cfg := &Config{Chains: map[ChainType][]MiddlewareConfig{ChainConn: {{Name: "missing"}}}}
+	if err := serve(context.Background(), cfg, NewRegistry(), nil); err == nil {
+		t.Error("expected error for unknown middleware")
+	}
+}
+
+func TestServe_StoreFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store.json")
+	// 每次连接递增计数器，返回本次运行看到的计数
+	run := func() int64 {
+		t.Helper()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+
+		var count atomic.Int64
+		registry := NewRegistry()
+		registry.Register("count", func(config map[string]any) (Handler, error) {
+			store := registry.Store()
+			return func(ctx *Context) Action {
+				n, _ := store.Incr("count", 1, time.Hour)
+				count.Store(n)
+				return Pass
+			}, nil
+		})
+		cfg := &Config{
+			Server: ServerConfig{Addr: addr, ShutdownTimeout: Duration(time.Second)},
+			Chains: map[ChainType][]MiddlewareConfig{ChainConn: {{Name: "count"}}},
+			Store:  StoreConfig{File: file},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- serve(ctx, cfg, registry, nil) }()
+
+		var c *smtp.Client
+		for i := 0; i < 50; i++ {
+			if c, err = smtp.Dial(addr); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		if err := c.Hello("client.example.org"); err != nil {
+			t.Fatalf("unexpected EHLO error: %v", err)
+		}
+		c.Quit()
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected serve error: %v", err)
+		}
+		return count.Load()
+	}
+
+	// 计数器在关闭时保存，重启时加载
+	if n := run(); n != 1 {
+		t.Fatalf("expected count 1, got %d", n)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("expected the store to be saved: %v", err)
+	}
+	if n := run(); n != 2 {
+		t.Errorf("expected count 2 after restart, got %d", n)
+	}
+}
+
+func TestServe_StoreBackends(t *testing.T) {
+	f, redisAddr := startFakeRedis(t, "secret")
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	secretFile := filepath.Join(dir, "secret")
+	os.WriteFile(passwordFile, []byte("secret\n"), 0o600)
+	os.WriteFile(secretFile, []byte("s3cret\n"), 0o600)
+
+	tests := []struct {
+		name  string
+		store StoreConfig
+		check func(t *testing.T, store Store)
+	}{
+		{"redis", StoreConfig{Redis: StoreRedisConfig{Addr: redisAddr, PasswordFile: passwordFile, KeyPrefix: "brisa:"}}, func(t *testing.T, store Store) {
+			if _, ok := store.(*RedisStore); !ok {
+				t.Fatalf("expected a RedisStore, got %T", store)
+			}
+			if _, ok, _ := f.store.Get("brisa:k"); !ok {
+				t.Error("expected the key on the Redis server")
+			}
+		}},
+		{"gossip", StoreConfig{Gossip: StoreGossipConfig{Addr: "127.0.0.1:0", SecretFile: secretFile}}, func(t *testing.T, store Store) {
+			if _, ok := store.(*GossipStore); !ok {
+				t.Fatalf("expected a GossipStore, got %T", store)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := l.Addr().String()
+			l.Close()
+
+			registry := NewRegistry()
+			stores := make(chan Store, 1)
+			registry.Register("store", func(config map[string]any) (Handler, error) {
+				store := registry.Store()
+				if err := store.Set("k", []byte("v"), time.Hour); err != nil {
+					return nil, err
+				}
+				stores <- store
+				return func(ctx *Context) Action { return Pass }, nil
+			})
+			cfg := &Config{
+				Server: ServerConfig{Addr: addr, ShutdownTimeout: Duration(time.Second)},
+				Chains: map[ChainType][]MiddlewareConfig{ChainConn: {{Name: "store"}}},
+				Store:  tt.store,
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- serve(ctx, cfg, registry, nil) }()
+			select {
+			case store := <-stores:
+				tt.check(t, store)
+			case err := <-done:
+				t.Fatalf("unexpected serve error: %v", err)
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Errorf("unexpected serve error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register("pass", func(config map[string]any) (Handler, error) {
+		return func(ctx *Context) Action { return Pass }, nil
+	})
+	cfg := &Config{
+		Listeners: []ListenerConfig{{Name: "submission", Addr: ":587", Chains: map[ChainType][]MiddlewareConfig{ChainData: {{Name: "pass"}}}}},
+		Tenants:   []TenantConfig{{Name: "acme", Domains: []string{"acme.example"}, Chains: map[ChainType][]MiddlewareConfig{ChainData: {{Name: "pass"}}}}},
+	}
+	routers, err := Check(cfg, registry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if routers.Listeners["submission"] == nil || len(routers.Tenants) != 1 || routers.Tenants[0].Router == nil {
+		t.Errorf("expected the routers of the listener and the tenant, got %+v", routers)
+	}
+	if registry.Store() == nil {
+		t.Error("expected the middleware to get a store")
+	}
+
+	// serve 启动前会失败的设置，Check 同样报错
+	for name, c := range map[string]*Config{
+		"middleware":    {Chains: map[ChainType][]MiddlewareConfig{ChainData: {{Name: "missing"}}}},
+		"tls":           {Server: ServerConfig{TLS: TLSConfig{CertFile: "missing.pem", KeyFile: "missing.key"}}},
+		"tenant":        {Tenants: []TenantConfig{{Name: "a", Domains: []string{"x.example"}}, {Name: "b", Domains: []string{"x.example"}}}},
+		"authenticator": {Auth: AuthConfig{Name: "missing"}},
+		"debug tls":     {Debug: DebugConfig{TLS: TLSConfig{CertFile: "missing.pem", KeyFile: "missing.key"}}},
+		"debug access":  {Debug: DebugConfig{Access: []DebugAccess{{Name: "ops", TokenFile: "missing", Role: DebugRoleViewer}}}},
+		"log":           {Log: LogConfig{Path: filepath.Join(t.TempDir(), "missing", "brisa.log")}},
+	} {
+		if _, err := Check(c, registry); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestReloadRouter_AllOrNothing(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register("pass", func(config map[string]any) (Handler, error) {
+		return func(ctx *Context) Action { return Pass }, nil
+	})
+	b := New(slog.New(slog.DiscardHandler))
+	cfg := &Config{Listeners: []ListenerConfig{{Name: "submission", Addr: ":587", Chains: map[ChainType][]MiddlewareConfig{ChainData: {{Name: "pass"}}}}}}
+	if err := reloadRouter(b, registry, nil, func() (*Config, error) { return cfg, nil }); err != nil {
+		t.Fatal(err)
+	}
+	submission := b.routerFor("submission")
+
+	// 租户的链无法构建时，监听器的路由也保持不变
+	broken := &Config{
+		Listeners: []ListenerConfig{{Name: "submission", Addr: ":587"}},
+		Tenants:   []TenantConfig{{Name: "acme", Domains: []string{"acme.example"}, Chains: map[ChainType][]MiddlewareConfig{ChainData: {{Name: "missing"}}}}},
+	}
+	if err := reloadRouter(b, registry, nil, func() (*Config, error) { return broken, nil }); err == nil {
+		t.Fatal("expected error for unknown middleware")
+	}
+	if b.routerFor("submission") != submission || b.tenants.Load() != nil {
+		t.Error("expected the failed reload to apply nothing")
+	}
+}
+
+func TestServe_ListenError(t *testing.T) {
+	// 端口已被占用时 serve 返回错误，并停止已启动的工作协程
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var b *Brisa
+	newServeBrisa = func(logger *slog.Logger, observers ...Observer) *Brisa {
+		b = New(logger, observers...)
+		return b
+	}
+	defer func() { newServeBrisa = New }()
+
+	registry := NewRegistry()
+	registry.Register("pass", func(config map[string]any) (Handler, error) {
+		return func(ctx *Context) Action { return Pass }, nil
+	})
+	cfg := &Config{
+		Server: ServerConfig{Addr: l.Addr().String(), HookWorkers: 8, PostQueueWorkers: 2},
+		Chains: map[ChainType][]MiddlewareConfig{ChainPostQueue: {{Name: "pass"}}},
+	}
+	if err := serve(context.Background(), cfg, registry, nil); err == nil {
+		t.Fatal("expected error for an address in use")
+	}
+	if b == nil {
+		t.Fatal("expected serve to create its instance")
+	}
+	if b.hooks.Load() != nil || b.postQueue.Load() != nil {
+		t.Error("expected the hook workers and the post-queue stage to be stopped")
+	}
+}
+
+func TestServe_DebugOps(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("op-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Server: ServerConfig{Addr: addrs[0], ShutdownTimeout: Duration(time.Second)},
+		Debug: DebugConfig{Addr: addrs[1], Access: []DebugAccess{
+			{Name: "ops", TokenFile: tokenFile, Role: DebugRoleOperator},
+		}},
+	}
+	var reloads atomic.Int32
+	reload := func() (*Config, error) {
+		reloads.Add(1)
+		return cfg, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, cfg, NewRegistry(), reload) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	}()
+
+	post := func(path string, form url.Values) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addrs[1]+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer op-token")
+		return http.DefaultClient.Do(req)
+	}
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = post("/debug/ops/reload", nil); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || reloads.Load() != 1 {
+		t.Errorf("expected a reload, got %d and %d reloads", resp.StatusCode, reloads.Load())
+	}
+
+	// 只接受 POST
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addrs[1]+"/debug/ops/reload", nil)
+	req.Header.Set("Authorization", "Bearer op-token")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || reloads.Load() != 1 {
+		t.Errorf("expected GET to be refused, got %d and %d reloads", resp.StatusCode, reloads.Load())
+	}
+
+	// 清除一个地址在存储中的数据
+	resp, err = post("/debug/ops/purge", url.Values{"address": {"bob@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "purged 0 keys\n" {
+		t.Errorf("unexpected purge response %d: %s", resp.StatusCode, body)
+	}
+
+	// 没有凭据的请求被拒绝
+	if resp, err = http.PostForm("http://"+addrs[1]+"/debug/ops/purge", url.Values{"address": {"bob@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+}
+
+func TestServe_DebugOpsWithoutAccess(t *testing.T) {
+	addrs := make([]string, 2)
+	for i := range addrs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = l.Addr().String()
+		l.Close()
+	}
+	cfg := &Config{
+		Server: ServerConfig{Addr: addrs[0], ShutdownTimeout: Duration(time.Second)},
+		Debug:  DebugConfig{Addr: addrs[1]},
+	}
+	reload := func() (*Config, error) { return cfg, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, cfg, NewRegistry(), reload) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	}()
+
+	// 没有 debug.access 时不提供会改变状态的操作
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = http.PostForm("http://"+addrs[1]+"/debug/ops/purge", url.Values{"address": {"bob@example.com"}}); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for purge, got %d", resp.StatusCode)
+	}
+	if resp, err = http.Post("http://"+addrs[1]+"/debug/ops/reload", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for reload, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,112 @@
+package brisa
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// testTLSConfig 生成自签名证书的 TLS 配置
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// testServerOptions 配置 startTestServer 启动的服务器
+type testServerOptions struct {
+	tls               *tls.Config
+	enableDSN         bool
+	enableSMTPUTF8    bool
+	allowInsecureAuth bool
+	// wrap 包装监听器，例如 NewGreetListener
+	wrap func(net.Listener) net.Listener
+}
+
+// startTestServer 在本地端口上启动以 b 为后端的 SMTP 服务器，返回其地址
+func startTestServer(t *testing.T, b *Brisa, opts testServerOptions) string {
+	t.Helper()
+	s := smtp.NewServer(b)
+	s.Domain = "mx.example.com"
+	s.TLSConfig = opts.tls
+	s.EnableDSN = opts.enableDSN
+	s.EnableSMTPUTF8 = opts.enableSMTPUTF8
+	s.AllowInsecureAuth = opts.allowInsecureAuth
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if opts.wrap != nil {
+		l = opts.wrap(l)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return addr
+}
+
+// dialTest 建立原始连接；ehlo 为 true 时读取问候并完成 EHLO
+func dialTest(t *testing.T, addr string, ehlo bool) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	if ehlo {
+		readReply(t, r)
+		io.WriteString(conn, "EHLO client.example.org\r\n")
+		readReply(t, r)
+	}
+	return conn, r
+}
+
+// readReply 读取一个（可能多行的）回复，返回最后一行
+func readReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ""
+		}
+		if len(line) < 4 || line[3] != '-' {
+			return strings.TrimRight(line, "\r\n")
+		}
+	}
+}
+
+// expectClosed 检查连接已被服务器关闭
+func expectClosed(t *testing.T, conn net.Conn, r *bufio.Reader) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(r); err != nil {
+		t.Errorf("expected the connection to be closed: %v", err)
+	}
+}
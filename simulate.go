@@ -0,0 +1,171 @@
+package brisa
+
+import (
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/muzhy/brisa/address"
+)
+
+// Envelope is the SMTP envelope of a simulated mail transaction.
+type Envelope struct {
+	// ClientAddr is the address the client connects from. Middleware that
+	// inspect the client IP expect a *net.TCPAddr.
+	ClientAddr net.Addr
+	// Listener is the name of the listener the client connects to; see
+	// Brisa.Listener.
+	Listener string
+	// TLS makes the session report an encrypted connection, as after STARTTLS.
+	TLS bool
+	// ClientCert is the verified client certificate the session reports; see
+	// Session.ClientCertificate. It implies TLS.
+	ClientCert *x509.Certificate
+	// TLSFingerprint is the JA3 hash of the ClientHello of a TLS session; see
+	// Fingerprint.TLS.
+	TLSFingerprint string
+	// EarlyTalker gives the session FlagEarlyTalker, as for a client that
+	// talked before the greeting.
+	EarlyTalker bool
+	// Username and Password, if Username is set, authenticate the client with
+	// AUTH PLAIN before MAIL FROM; see Brisa.SetAuthenticator.
+	Username string
+	Password string
+	From     string
+	To       []string
+	// SMTPUTF8 sends MAIL FROM with the SMTPUTF8 parameter. It is implied by
+	// addresses with a non-ASCII local part.
+	SMTPUTF8 bool
+}
+
+// SimulationResult is the outcome of a simulated mail transaction.
+type SimulationResult struct {
+	// Action is the final action of the transaction.
+	Action Action
+	// Chain is the event chain of the SMTP command that failed the
+	// transaction, if any.
+	Chain ChainType
+	// Err is the reply to the command that failed the transaction, or nil if
+	// the message was accepted.
+	Err error
+	// RcptErrors holds the replies to refused recipients.
+	RcptErrors map[string]error
+}
+
+// emptyRouter is the router of detached sessions.
+var emptyRouter = compileRouter(&Router{})
+
+// NewDetachedSession returns a session for ctx that is not bound to an SMTP
+// connection, with clientAddr as the client address, and links it to ctx. It
+// lets handlers that inspect the session run outside a server, for example in
+// tests. Its SMTP methods run no middleware.
+func NewDetachedSession(ctx *Context, clientAddr net.Addr) *Session {
+	return NewDetachedSessionWith(ctx, Envelope{ClientAddr: clientAddr})
+}
+
+// NewDetachedSessionWith is like NewDetachedSession, with the client address,
+// listener, TLS state and fingerprint and early talking of env. The envelope
+// addresses are not used.
+func NewDetachedSessionWith(ctx *Context, env Envelope) *Session {
+	s := &Session{
+		ctx:        ctx,
+		id:         uuid.NewString(),
+		remoteAddr: env.ClientAddr,
+		listener:   env.Listener,
+		tls:        env.TLS || env.ClientCert != nil,
+		clientCert: env.ClientCert,
+		router:     emptyRouter,
+		baseLogger: ctx.Logger,
+
+		lastCommand: time.Now(),
+	}
+	if s.tls {
+		s.fp.STARTTLS, s.fp.TLS = true, env.TLSFingerprint
+	}
+	ctx.Session = s
+	if env.EarlyTalker {
+		ctx.SetFlag(FlagEarlyTalker)
+	}
+	return s
+}
+
+// Simulate runs a mail transaction through the chains of the current router in
+// process, without a network connection: the conn chain for env.ClientAddr,
+// MAIL FROM, RCPT TO for each recipient and DATA with message, followed by
+// the disposition chain of the final action. If env has a user name, the
+// client authenticates before MAIL FROM. Observers are notified as for a
+// real session.
+func (b *Brisa) Simulate(env Envelope, message io.Reader) *SimulationResult {
+	ctx := NewContext()
+	s := NewDetachedSessionWith(ctx, env)
+	ctx.Logger = withAttr(b.logger, slog.String("session_id", s.id))
+	s.baseLogger = ctx.Logger
+	s.router = b.routerFor(env.Listener)
+	s.sessionRouter = s.router
+	s.tenants = b.tenantsFor(env.Listener)
+	s.observers = b.observers
+	s.events = b.events
+	s.rejectMessage = b.rejectMessage.Load()
+	s.deferReject = b.deferReject.Load()
+	s.startLimits(b)
+	if a := b.authenticator.Load(); a != nil {
+		s.authenticator = *a
+		s.allowedMechs = b.authMechanismsFor(env.Listener)
+	}
+	notify(b.observers, ctx, func(o Observer) { o.OnSessionStart(ctx) })
+	defer s.Logout()
+
+	result := &SimulationResult{}
+	fail := func(chain ChainType, err error) *SimulationResult {
+		result.Action, result.Chain, result.Err = Reject, chain, err
+		return result
+	}
+
+	if err := s.execute(chainConn); err != nil {
+		return fail(ChainConn, err)
+	}
+	s.publishSessionStarted()
+	if env.Username != "" {
+		if err := s.simulateAuth(env.Username, env.Password); err != nil {
+			return fail(ChainAuth, err)
+		}
+	}
+	utf8 := env.SMTPUTF8 || address.NeedsSMTPUTF8(env.From)
+	for _, to := range env.To {
+		utf8 = utf8 || address.NeedsSMTPUTF8(to)
+	}
+	if err := s.Mail(env.From, &smtp.MailOptions{UTF8: utf8}); err != nil {
+		return fail(ChainMailFrom, err)
+	}
+	for _, to := range env.To {
+		if err := s.Rcpt(to, &smtp.RcptOptions{}); err != nil {
+			if result.RcptErrors == nil {
+				result.RcptErrors = make(map[string]error)
+			}
+			result.RcptErrors[to] = err
+		}
+	}
+	if len(ctx.To) == 0 {
+		return fail(ChainRcptTo, &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 5, 1}, Message: "No valid recipients"})
+	}
+	if err := s.Data(message); err != nil {
+		return fail(ChainData, err)
+	}
+	result.Action = ctx.Action
+	return result
+}
+
+// simulateAuth authenticates the session with AUTH PLAIN.
+func (s *Session) simulateAuth(username, password string) error {
+	server, err := s.Auth(sasl.Plain)
+	if err != nil {
+		return err
+	}
+	_, _, err = server.Next([]byte("\x00" + username + "\x00" + password))
+	return err
+}
@@ -0,0 +1,191 @@
+package brisa
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestBrisa_Simulate(t *testing.T) {
+	var delivered string
+	router := Router{}
+	router.OnConn(&Middleware{Handler: func(ctx *Context) Action {
+		if ctx.Session.GetClientIP().(*net.TCPAddr).IP.Equal(net.ParseIP("192.0.2.1")) {
+			return Reject
+		}
+		return Pass
+	}})
+	router.OnRcptTo(&Middleware{Handler: func(ctx *Context) Action {
+		if ctx.To[len(ctx.To)-1] == "nobody@example.com" {
+			return ctx.RejectWith(&smtp.SMTPError{Code: 550, Message: "no such user"})
+		}
+		return Pass
+	}})
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		data, _ := io.ReadAll(ctx.Reader)
+		delivered = string(data)
+		return Deliver
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+
+	env := Envelope{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")},
+		From:       "alice@example.com",
+		To:         []string{"bob@example.com", "nobody@example.com"},
+	}
+	res := b.Simulate(env, strings.NewReader("Subject: hi\r\n\r\nhello\r\n"))
+	if res.Err != nil || res.Action != Deliver {
+		t.Fatalf("expected delivery, got %+v", res)
+	}
+	if len(res.RcptErrors) != 1 || res.RcptErrors["nobody@example.com"] == nil {
+		t.Errorf("expected one refused recipient, got %v", res.RcptErrors)
+	}
+	if !strings.Contains(delivered, "hello") {
+		t.Errorf("expected message to be delivered, got %q", delivered)
+	}
+
+	env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	res = b.Simulate(env, strings.NewReader("\r\n"))
+	if res.Action != Reject || res.Chain != ChainConn || res.Err != ErrRejectedByPolicy {
+		t.Errorf("expected rejection at connect, got %+v", res)
+	}
+
+	env.ClientAddr = &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}
+	env.To = []string{"nobody@example.com"}
+	res = b.Simulate(env, strings.NewReader("\r\n"))
+	if res.Action != Reject || res.Chain != ChainRcptTo {
+		t.Errorf("expected rejection without recipients, got %+v", res)
+	}
+}
+
+func TestBrisa_DeferredRejection(t *testing.T) {
+	var captured, capturedFrom string
+	var capturedReply *smtp.SMTPError
+	mailFromRuns := 0
+	router := Router{}
+	router.OnConn(&Middleware{Handler: func(ctx *Context) Action {
+		if ctx.Session.GetClientIP().(*net.TCPAddr).IP.Equal(net.ParseIP("192.0.2.1")) {
+			return Reject
+		}
+		return Pass
+	}})
+	router.OnMailFrom(&Middleware{Handler: func(ctx *Context) Action {
+		mailFromRuns++
+		if ctx.From == "spammer@example.com" {
+			return ctx.RejectWith(&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "sender blocked"})
+		}
+		return Pass
+	}})
+	router.OnReject(&Middleware{Handler: func(ctx *Context) Action {
+		if ctx.Reader != nil {
+			data, _ := io.ReadAll(ctx.Reader)
+			captured, capturedFrom, capturedReply = string(data), ctx.From, ctx.RejectError()
+		}
+		return Reject
+	}})
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&router)
+	b.SetDeferredRejection(true)
+
+	// conn 链的拒绝推迟到 DATA，之后的链不再执行，reject 链能读到完整邮件
+	env := Envelope{ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, From: "a@example.com", To: []string{"b@example.com"}}
+	result := b.Simulate(env, strings.NewReader("Subject: trap\r\n\r\nbody\r\n"))
+	if result.Chain != ChainData || result.Err != ErrRejectedByPolicy {
+		t.Errorf("expected the policy rejection at DATA, got %v at %s", result.Err, result.Chain)
+	}
+	if mailFromRuns != 0 {
+		t.Errorf("expected mail_from chain to be skipped, ran %d times", mailFromRuns)
+	}
+	if captured != "Subject: trap\r\n\r\nbody\r\n" || capturedFrom != "a@example.com" || capturedReply != ErrRejectedByPolicy {
+		t.Errorf("unexpected capture %q from %q with reply %v", captured, capturedFrom, capturedReply)
+	}
+
+	// mail_from 链的拒绝同样推迟，并保留中间件选择的回复
+	env = Envelope{ClientAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, From: "spammer@example.com", To: []string{"b@example.com"}}
+	result = b.Simulate(env, strings.NewReader("Subject: spam\r\n\r\n"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(result.Err, &smtpErr) || smtpErr.Code != 550 || result.Chain != ChainData {
+		t.Errorf("expected the 550 reply at DATA, got %v at %s", result.Err, result.Chain)
+	}
+	if captured != "Subject: spam\r\n\r\n" {
+		t.Errorf("unexpected capture %q", captured)
+	}
+}
+
+func TestSession_DeferredRejection_NewTransaction(t *testing.T) {
+	router := Router{}
+	router.OnMailFrom(&Middleware{Handler: func(ctx *Context) Action {
+		if ctx.From == "spammer@example.com" {
+			return Reject
+		}
+		return Pass
+	}})
+	ctx := NewContext()
+	ctx.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewDetachedSession(ctx, &net.TCPAddr{IP: net.ParseIP("198.51.100.1")})
+	s.router = compileRouter(&router)
+	s.deferReject = true
+	defer s.Logout()
+
+	if err := s.Mail("spammer@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatalf("expected MAIL FROM to be accepted, got %v", err)
+	}
+	// RSET 之后的新事务不受上一个事务的拒绝影响
+	s.Reset()
+	if err := s.Mail("alice@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Rcpt("b@example.com", &smtp.RcptOptions{})
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\n")); err != nil {
+		t.Errorf("expected the new transaction to be accepted, got %v", err)
+	}
+}
+
+func TestBrisa_SimulateListener(t *testing.T) {
+	reject := &Middleware{Handler: func(ctx *Context) Action { return Reject }}
+	mx := Router{}
+	mx.OnMailFrom(reject)
+	// submission 监听器只拒绝未认证的客户端。
+	cond, err := ParseCondition("listener:submission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submission := Router{}
+	submission.OnMailFrom(&Middleware{Condition: cond, Handler: func(ctx *Context) Action {
+		if !ctx.HasFlag(FlagAuthenticated) {
+			return Reject
+		}
+		return Pass
+	}})
+
+	b := New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.UpdateRouter(&mx)
+	b.UpdateListenerRouter("submission", &submission)
+	b.UpdateListenerRouter("relay", &Router{})
+
+	env := Envelope{ClientAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, From: "a@example.org", To: []string{"b@example.com"}}
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != ChainMailFrom {
+		t.Errorf("expected the MX router to reject, got %+v", res)
+	}
+	env.Listener = "relay"
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Err != nil {
+		t.Errorf("expected the relay router to accept, got %+v", res)
+	}
+	env.Listener = "submission"
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != ChainMailFrom {
+		t.Errorf("expected unauthenticated submission to be rejected, got %+v", res)
+	}
+
+	// 移除监听器的路由后，恢复使用默认路由。
+	b.UpdateListenerRouter("relay", nil)
+	env.Listener = "relay"
+	if res := b.Simulate(env, strings.NewReader("\r\n")); res.Chain != ChainMailFrom {
+		t.Errorf("expected the default router after removal, got %+v", res)
+	}
+}
@@ -0,0 +1,372 @@
+package brisa
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ErrInsufficientStorage is the reply to DATA when a message cannot be
+// spooled: the memory budget of the spools is used up and they may not
+// overflow to disk. It is temporary, as the budget frees up.
+var ErrInsufficientStorage = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+	Message:      "Insufficient system storage, please try again later",
+}
+
+// SpoolConfig configures the message spools of all sessions; see
+// Context.SpoolMessage.
+type SpoolConfig struct {
+	// MaxMemory is the ceiling of the bytes the spools of all sessions hold in
+	// memory. Zero means no ceiling.
+	MaxMemory int64
+	// Dir is the directory spools overflow to once MaxMemory is reached.
+	// Empty refuses the messages that do not fit with ErrInsufficientStorage
+	// instead.
+	Dir string
+	// Encrypt encrypts the spools in Dir with AES-256-GCM under a data key of
+	// their own, so that the files left on a stolen disk or by a crash cannot
+	// be read and changes to them are detected. Without Keys, the data keys
+	// are held only in memory.
+	Encrypt bool
+	// Keys, if set, wraps the data key of every spool into its file, so that
+	// the files left by a crash can be recovered with DecryptSpool. It
+	// implies Encrypt.
+	Keys SpoolKeys
+}
+
+// spoolBudget accounts the memory of the spools of a server. A nil budget
+// has no ceiling.
+type spoolBudget struct {
+	max  atomic.Int64
+	used atomic.Int64
+	cfg  atomic.Pointer[SpoolConfig]
+}
+
+// SetSpool sets the memory ceiling, overflow directory and encryption of the
+// spools. Spools already on disk stay there, under their keys.
+func (b *Brisa) SetSpool(cfg SpoolConfig) {
+	b.spools.max.Store(cfg.MaxMemory)
+	b.spools.cfg.Store(&cfg)
+}
+
+// SpoolMemory returns the bytes the spools of all sessions hold in memory.
+func (b *Brisa) SpoolMemory() int64 {
+	return b.spools.used.Load()
+}
+
+func (b *spoolBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if max := b.max.Load(); max > 0 && used+n > max {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+func (b *spoolBudget) release(n int64) {
+	if b != nil {
+		b.used.Add(-n)
+	}
+}
+
+// overflowDir returns the directory spools overflow to, if any.
+func (b *spoolBudget) overflowDir() (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	cfg := b.cfg.Load()
+	if cfg == nil || cfg.Dir == "" {
+		return "", false
+	}
+	return cfg.Dir, true
+}
+
+// encryption reports whether spools are encrypted, and the keys wrapping
+// their data keys.
+func (b *spoolBudget) encryption() (bool, SpoolKeys) {
+	if b == nil {
+		return false, nil
+	}
+	cfg := b.cfg.Load()
+	if cfg == nil {
+		return false, nil
+	}
+	return cfg.Encrypt || cfg.Keys != nil, cfg.Keys
+}
+
+// Spool holds a message in memory, within the budget of its server, or in a
+// temporary file beyond it. It is written once and then read as often as
+// needed.
+type Spool struct {
+	budget   *spoolBudget
+	mem      []byte
+	reserved int64
+	file     *os.File
+	size     int64
+	// cipher encrypts the file of an encrypted spool.
+	cipher *spoolCipher
+	// base and off are the spool and offset the bytes of a spliced spool
+	// continue from after mem; see Splice.
+	base *Spool
+	off  int64
+}
+
+// errSpliced is returned by writes to a spliced spool.
+var errSpliced = errors.New("brisa: write to a spliced spool")
+
+func newSpool(budget *spoolBudget) *Spool {
+	return &Spool{budget: budget}
+}
+
+// Write appends p to the spool. If p neither fits the memory budget nor may
+// overflow to disk, nothing is written and ErrInsufficientStorage returned.
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.base != nil {
+		return 0, errSpliced
+	}
+	if s.file == nil {
+		need := len(s.mem) + len(p)
+		if need <= cap(s.mem) {
+			s.mem = append(s.mem, p...)
+			s.size += int64(len(p))
+			return len(p), nil
+		}
+		// Account for the capacity append would allocate.
+		newCap := max(2*cap(s.mem), need, 4096)
+		if s.budget.reserve(int64(newCap) - s.reserved) {
+			mem := make([]byte, len(s.mem), newCap)
+			copy(mem, s.mem)
+			s.mem = append(mem, p...)
+			s.reserved = int64(newCap)
+			s.size += int64(len(p))
+			return len(p), nil
+		}
+		if err := s.overflow(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.writeFile(p)
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *Spool) writeFile(p []byte) (int, error) {
+	if s.cipher != nil {
+		return s.cipher.write(s.file, p)
+	}
+	return s.file.Write(p)
+}
+
+// overflow moves the spool from memory to a temporary file.
+func (s *Spool) overflow() error {
+	dir, ok := s.budget.overflowDir()
+	if !ok {
+		return ErrInsufficientStorage
+	}
+	var c *spoolCipher
+	if encrypt, keys := s.budget.encryption(); encrypt {
+		var err error
+		if c, err = newSpoolCipher(keys); err != nil {
+			return err
+		}
+	}
+	f, err := os.CreateTemp(dir, "brisa-spool-*")
+	if err != nil {
+		return err
+	}
+	s.file, s.cipher = f, c
+	if c != nil {
+		_, err = f.Write(c.header)
+	}
+	if err == nil {
+		_, err = s.writeFile(s.mem)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		s.file, s.cipher = nil, nil
+		return err
+	}
+	s.budget.release(s.reserved)
+	s.reserved = 0
+	s.mem = nil
+	return nil
+}
+
+// Splice returns a spool holding head followed by the bytes of s from off
+// on, e.g. the rewritten header of a spooled message followed by its body.
+// It shares those bytes with s rather than copying them, so it is only valid
+// while s is open, and it cannot be written to. head is held in memory
+// outside the budget of the spools.
+func (s *Spool) Splice(head []byte, off int64) *Spool {
+	off = min(max(off, 0), s.Len())
+	if s.base != nil && off >= int64(len(s.mem)) {
+		// Skip the head of s rather than stack the splices.
+		return s.base.Splice(head, s.off+off-int64(len(s.mem)))
+	}
+	return &Spool{mem: head, size: int64(len(head)) + s.Len() - off, base: s, off: off}
+}
+
+// Len returns the number of bytes written.
+func (s *Spool) Len() int64 {
+	return s.size
+}
+
+// OnDisk reports whether the spool overflowed to disk.
+func (s *Spool) OnDisk() bool {
+	if s.base != nil {
+		return s.base.OnDisk()
+	}
+	return s.file != nil
+}
+
+// NewReader returns a reader of the bytes written so far.
+func (s *Spool) NewReader() io.Reader {
+	return s.readerFrom(0)
+}
+
+// readerFrom returns a reader of the bytes of s from off on.
+func (s *Spool) readerFrom(off int64) io.Reader {
+	switch {
+	case s.base != nil:
+		if off < int64(len(s.mem)) {
+			return io.MultiReader(bytes.NewReader(s.mem[off:]), s.base.readerFrom(s.off))
+		}
+		return s.base.readerFrom(s.off + off - int64(len(s.mem)))
+	case s.file != nil:
+		if s.cipher != nil {
+			return s.cipher.reader(s.file, off, s.size-off)
+		}
+		return io.NewSectionReader(s.file, off, s.size-off)
+	}
+	return bytes.NewReader(s.mem[off:])
+}
+
+// Close releases the memory or removes the file of the spool. Closing a
+// spliced spool leaves the spool it was spliced from open.
+func (s *Spool) Close() error {
+	if s.base != nil {
+		s.mem, s.base = nil, nil
+		return nil
+	}
+	s.budget.release(s.reserved)
+	s.reserved = 0
+	s.mem = nil
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if rmErr := os.Remove(s.file.Name()); err == nil {
+		err = rmErr
+	}
+	s.file = nil
+	s.cipher = nil
+	return err
+}
+
+// spoolReader is the message reader installed by Context.SpoolMessage; it
+// records whether it was read.
+type spoolReader struct {
+	r     io.Reader
+	spool *Spool
+	read  bool
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	r.read = true
+	return r.r.Read(p)
+}
+
+// SpoolMessage reads the rest of the message into a Spool, accounted in the
+// memory budget of the server (see Brisa.SetSpool), and makes the context
+// reader read it from there, so that middleware can read the message as
+// often as needed. While the context reader has not been read since, later
+// calls return the same spool. The spool is closed with the transaction.
+//
+// If the message does not fit the budget, the reader is restored and
+// ErrInsufficientStorage returned; the message is then refused with it after
+// the data chain, whatever the middleware decide.
+func (c *Context) SpoolMessage() (*Spool, error) {
+	if sp := c.MessageSpool(); sp != nil {
+		return sp, nil
+	}
+	sp := c.NewSpool()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.Reader.Read(buf)
+		if n > 0 {
+			if _, werr := sp.Write(buf[:n]); werr != nil {
+				if werr == ErrInsufficientStorage {
+					c.spoolErr = werr
+				}
+				c.Reader = io.MultiReader(sp.NewReader(), bytes.NewReader(buf[:n]), c.Reader)
+				return nil, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Reader = io.MultiReader(sp.NewReader(), c.Reader)
+			return nil, err
+		}
+	}
+	c.Reader = &spoolReader{r: sp.NewReader(), spool: sp}
+	return sp, nil
+}
+
+// NewSpool returns an empty spool accounted in the memory budget of the
+// server, e.g. for a middleware to write a rewritten message to and pass it
+// to SetMessageSpool. It is closed with the transaction.
+func (c *Context) NewSpool() *Spool {
+	c.checkLive()
+	var budget *spoolBudget
+	if c.Session != nil {
+		budget = c.Session.spools
+	}
+	sp := newSpool(budget)
+	c.spools = append(c.spools, sp)
+	return sp
+}
+
+// MessageSpool returns the spool the context reader reads, if it was set by
+// SpoolMessage or SetMessageSpool and has not been read since, and nil
+// otherwise. Unlike SpoolMessage, it never spools the message.
+func (c *Context) MessageSpool() *Spool {
+	c.checkLive()
+	if r, ok := c.Reader.(*spoolReader); ok && !r.read {
+		return r.spool
+	}
+	return nil
+}
+
+// SetMessageSpool makes the context reader read the message from sp, so that
+// SpoolMessage returns sp while the reader has not been read since. sp must
+// stay open until the end of the transaction, as the spools of SpoolMessage
+// and those spliced from them do (see Spool.Splice).
+func (c *Context) SetMessageSpool(sp *Spool) {
+	c.checkLive()
+	c.Reader = &spoolReader{r: sp.NewReader(), spool: sp}
+}
+
+// closeSpools closes the spools of the transaction.
+func (c *Context) closeSpools() {
+	for _, sp := range c.spools {
+		sp.Close()
+	}
+	clear(c.spools)
+	c.spools = c.spools[:0]
+	c.spoolErr = nil
+}
@@ -0,0 +1,306 @@
+package brisa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted spool files start with spoolMagic, the ID of the key-encryption
+// key and the wrapped data key, each preceded by its length in two bytes;
+// both are empty when the data key is held only in memory. The message
+// follows in chunks of spoolChunkSize bytes, each sealed with AES-256-GCM
+// under the data key, with the chunk index as nonce and the header as
+// additional data, so that altered, reordered or truncated chunks are
+// detected. The last, partial chunk of a spool stays in memory.
+const spoolChunkSize = 32 * 1024
+
+var spoolMagic = []byte("BRISA-SPOOL-1\n")
+
+// errSpoolAuth is returned by readers of an encrypted spool whose file was
+// altered.
+var errSpoolAuth = errors.New("brisa: spool file failed authentication")
+
+// SpoolKeys wraps the data keys of encrypted spools with key-encryption
+// keys, e.g. those of a key management service, so that the files of the
+// spools can be read back with them; see DecryptSpool. Every spool has a
+// random data key of its own.
+type SpoolKeys interface {
+	// Wrap encrypts dataKey with the current key-encryption key and returns
+	// the ID of that key with the result.
+	Wrap(dataKey []byte) (id string, wrapped []byte, err error)
+	// Unwrap decrypts a data key wrapped by the key-encryption key id.
+	Unwrap(id string, wrapped []byte) ([]byte, error)
+}
+
+// SpoolKeyring is a SpoolKeys holding its key-encryption keys. The first key
+// wraps the data keys of new spools and the others unwrap those of older
+// files, so a key is rotated by putting a new one first and dropping the
+// oldest once no file needs it.
+type SpoolKeyring struct {
+	ids  []string
+	keys []cipher.AEAD
+}
+
+// NewSpoolKeyring returns a SpoolKeyring of keys, the current one first. A
+// key is a secret of at least 16 bytes; its SHA-256 hash is the AES-256 key
+// used.
+func NewSpoolKeyring(keys ...[]byte) (*SpoolKeyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("spool keyring without keys")
+	}
+	r := &SpoolKeyring{}
+	for i, key := range keys {
+		if len(key) < 16 {
+			return nil, fmt.Errorf("spool key %d is shorter than 16 bytes", i+1)
+		}
+		kek := sha256.Sum256(key)
+		aead, err := newSpoolAEAD(kek[:])
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256(kek[:])
+		r.ids = append(r.ids, hex.EncodeToString(id[:8]))
+		r.keys = append(r.keys, aead)
+	}
+	return r, nil
+}
+
+// LoadSpoolKeyring returns a SpoolKeyring of the keys in the files at paths,
+// the current one first.
+func LoadSpoolKeyring(paths ...string) (*SpoolKeyring, error) {
+	keys := make([][]byte, len(paths))
+	for i, path := range paths {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("spool key: %w", err)
+		}
+		keys[i] = key
+	}
+	return NewSpoolKeyring(keys...)
+}
+
+// Wrap implements SpoolKeys.
+func (r *SpoolKeyring) Wrap(dataKey []byte) (string, []byte, error) {
+	nonce := make([]byte, r.keys[0].NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return r.ids[0], r.keys[0].Seal(nonce, nonce, dataKey, []byte(r.ids[0])), nil
+}
+
+// Unwrap implements SpoolKeys.
+func (r *SpoolKeyring) Unwrap(id string, wrapped []byte) ([]byte, error) {
+	for i, kid := range r.ids {
+		if kid != id {
+			continue
+		}
+		n := r.keys[i].NonceSize()
+		if len(wrapped) < n {
+			break
+		}
+		key, err := r.keys[i].Open(nil, wrapped[:n], wrapped[n:], []byte(id))
+		if err != nil {
+			return nil, fmt.Errorf("spool key %s: %w", id, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown spool key %q", id)
+}
+
+func newSpoolAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func spoolNonce(chunk int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(chunk))
+	return nonce
+}
+
+// spoolCipher encrypts the file of a spool.
+type spoolCipher struct {
+	aead cipher.AEAD
+	// header starts the file and is authenticated with every chunk.
+	header []byte
+	// tail holds the bytes short of a full chunk.
+	tail   []byte
+	chunks int64
+}
+
+// newSpoolCipher returns the cipher of a spool under a new data key, wrapped
+// by keys if not nil.
+func newSpoolCipher(keys SpoolKeys) (*spoolCipher, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("spool key: %w", err)
+	}
+	var id string
+	var wrapped []byte
+	if keys != nil {
+		var err error
+		if id, wrapped, err = keys.Wrap(key); err != nil {
+			return nil, fmt.Errorf("spool key: %w", err)
+		}
+	}
+	aead, err := newSpoolAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("spool key: %w", err)
+	}
+	if len(id) > 0xffff || len(wrapped) > 0xffff {
+		return nil, errors.New("spool key: wrapped key too long")
+	}
+	header := append([]byte(nil), spoolMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(id)))
+	header = append(header, id...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	return &spoolCipher{aead: aead, header: header, tail: make([]byte, 0, spoolChunkSize)}, nil
+}
+
+// chunkOffset returns the offset of a chunk in the file.
+func (c *spoolCipher) chunkOffset(chunk int64) int64 {
+	return int64(len(c.header)) + chunk*int64(spoolChunkSize+c.aead.Overhead())
+}
+
+// write encrypts p to w, a chunk at a time.
+func (c *spoolCipher) write(w io.Writer, p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := min(len(p), spoolChunkSize-len(c.tail))
+		c.tail = append(c.tail, p[:k]...)
+		p = p[k:]
+		n += k
+		if len(c.tail) < spoolChunkSize {
+			continue
+		}
+		sealed := c.aead.Seal(nil, spoolNonce(c.chunks), c.tail, c.header)
+		c.tail = c.tail[:0]
+		if _, err := w.Write(sealed); err != nil {
+			return max(n-spoolChunkSize, 0), err
+		}
+		c.chunks++
+	}
+	return n, nil
+}
+
+// reader returns a reader of the n bytes of the spool from off on, with the
+// chunks read from f.
+func (c *spoolCipher) reader(f io.ReaderAt, off, n int64) io.Reader {
+	return &spoolCipherReader{c: c, f: f, chunk: off / spoolChunkSize, skip: int(off % spoolChunkSize), n: n}
+}
+
+type spoolCipherReader struct {
+	c     *spoolCipher
+	f     io.ReaderAt
+	chunk int64
+	skip  int
+	buf   []byte
+	n     int64
+	err   error
+}
+
+func (r *spoolCipherReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		if r.chunk < r.c.chunks {
+			sealed := make([]byte, spoolChunkSize+r.c.aead.Overhead())
+			if _, err := r.f.ReadAt(sealed, r.c.chunkOffset(r.chunk)); err != nil {
+				r.err = fmt.Errorf("spool: %w", err)
+				return 0, r.err
+			}
+			chunk, err := r.c.aead.Open(sealed[:0], spoolNonce(r.chunk), sealed, r.c.header)
+			if err != nil {
+				r.err = errSpoolAuth
+				return 0, r.err
+			}
+			r.buf = chunk
+		} else {
+			r.buf = r.c.tail
+		}
+		r.buf = r.buf[min(r.skip, len(r.buf)):]
+		r.skip = 0
+		r.chunk++
+		if len(r.buf) == 0 {
+			r.err = io.ErrUnexpectedEOF
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.buf[:min(int64(len(r.buf)), r.n)])
+	r.buf = r.buf[n:]
+	r.n -= int64(n)
+	return n, nil
+}
+
+// DecryptSpool writes the message in the encrypted spool file r to w, with
+// its data key unwrapped by keys, e.g. to recover the spools left by a crash.
+// Only the full chunks are on disk: the last up to 32 KiB of the message,
+// held in memory, are lost.
+func DecryptSpool(w io.Writer, r io.Reader, keys SpoolKeys) error {
+	magic := make([]byte, len(spoolMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != string(spoolMagic) {
+		return errors.New("not an encrypted spool file")
+	}
+	header := magic
+	field := func() ([]byte, error) {
+		var n [2]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		b := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		header = append(append(header, n[:]...), b...)
+		return b, nil
+	}
+	id, err := field()
+	if err != nil {
+		return fmt.Errorf("spool header: %w", err)
+	}
+	wrapped, err := field()
+	if err != nil {
+		return fmt.Errorf("spool header: %w", err)
+	}
+	if len(id) == 0 {
+		return errors.New("the spool key was held only in memory")
+	}
+	key, err := keys.Unwrap(string(id), wrapped)
+	if err != nil {
+		return err
+	}
+	aead, err := newSpoolAEAD(key)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, spoolChunkSize+aead.Overhead())
+	for chunk := int64(0); ; chunk++ {
+		if _, err := io.ReadFull(r, sealed); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("spool chunk %d: %w", chunk, err)
+		}
+		data, err := aead.Open(sealed[:0], spoolNonce(chunk), sealed, header)
+		if err != nil {
+			return fmt.Errorf("spool chunk %d: %w", chunk, errSpoolAuth)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
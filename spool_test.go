@@ -0,0 +1,262 @@
+package brisa
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpool_Budget(t *testing.T) {
+	b := New(nil)
+	b.SetSpool(SpoolConfig{MaxMemory: 8192, Dir: t.TempDir()})
+
+	small := newSpool(&b.spools)
+	io.WriteString(small, strings.Repeat("a", 3000))
+	if small.OnDisk() || b.SpoolMemory() == 0 {
+		t.Fatalf("expected the spool in memory, using %d bytes", b.SpoolMemory())
+	}
+
+	// 超出内存上限后溢出到磁盘，内容保持完整
+	large := newSpool(&b.spools)
+	message := strings.Repeat("b", 10000)
+	io.WriteString(large, message[:5000])
+	io.WriteString(large, message[5000:])
+	if !large.OnDisk() || large.Len() != int64(len(message)) {
+		t.Fatalf("expected the spool on disk, got on disk %v, %d bytes", large.OnDisk(), large.Len())
+	}
+	for range 2 {
+		if data, _ := io.ReadAll(large.NewReader()); string(data) != message {
+			t.Fatalf("unexpected spooled message of %d bytes", len(data))
+		}
+	}
+	name := large.file.Name()
+	large.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected the spool file to be removed, got %v", err)
+	}
+
+	small.Close()
+	if n := b.SpoolMemory(); n != 0 {
+		t.Errorf("expected the memory to be released, got %d bytes", n)
+	}
+}
+
+func TestSpool_Encrypt(t *testing.T) {
+	b := New(nil)
+	b.SetSpool(SpoolConfig{MaxMemory: 4096, Dir: t.TempDir(), Encrypt: true})
+
+	sp := newSpool(&b.spools)
+	defer sp.Close()
+	message := strings.Repeat("secret message\r\n", 5000)
+	io.WriteString(sp, message[:100])
+	io.WriteString(sp, message[100:])
+	if !sp.OnDisk() {
+		t.Fatal("expected the spool on disk")
+	}
+
+	// 磁盘上只有密文，读取时透明解密
+	raw, err := os.ReadFile(sp.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) == 0 || strings.Contains(string(raw), "secret") {
+		t.Errorf("expected only encrypted bytes on disk, got %d bytes", len(raw))
+	}
+	for range 2 {
+		if data, _ := io.ReadAll(sp.NewReader()); string(data) != message {
+			t.Fatalf("unexpected spooled message of %d bytes", len(data))
+		}
+	}
+
+	// Altered files are detected rather than read.
+	f, err := os.OpenFile(sp.file.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{raw[100] ^ 1}, 100)
+	f.Close()
+	if _, err := io.ReadAll(sp.NewReader()); !errors.Is(err, errSpoolAuth) {
+		t.Errorf("expected errSpoolAuth, got %v", err)
+	}
+}
+
+func TestSpool_Keys(t *testing.T) {
+	oldKey := []byte("old spool key, 32 bytes at least")
+	newKey := []byte("new spool key, 32 bytes at least")
+	keys, err := NewSpoolKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(nil)
+	b.SetSpool(SpoolConfig{MaxMemory: 4096, Dir: t.TempDir(), Keys: keys})
+
+	sp := newSpool(&b.spools)
+	defer sp.Close()
+	message := strings.Repeat("secret message\r\n", 5000)
+	io.WriteString(sp, message)
+	if data, _ := io.ReadAll(sp.NewReader()); string(data) != message {
+		t.Fatalf("unexpected spooled message of %d bytes", len(data))
+	}
+	// The spool starts within the second chunk.
+	if data, _ := io.ReadAll(sp.readerFrom(40000)); string(data) != message[40000:] {
+		t.Errorf("unexpected message tail of %d bytes", len(data))
+	}
+	raw, err := os.ReadFile(sp.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After a rotation, the files of the old key are still recovered; the
+	// tail of the message short of a chunk was only in memory.
+	rotated, err := NewSpoolKeyring(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := DecryptSpool(&out, strings.NewReader(string(raw)), rotated); err != nil {
+		t.Fatal(err)
+	}
+	if want := message[:len(message)/spoolChunkSize*spoolChunkSize]; out.String() != want {
+		t.Errorf("expected %d recovered bytes, got %d", len(want), out.Len())
+	}
+
+	dropped, _ := NewSpoolKeyring(newKey)
+	if err := DecryptSpool(io.Discard, strings.NewReader(string(raw)), dropped); err == nil {
+		t.Error("expected the file to need the old key")
+	}
+	if _, err := NewSpoolKeyring([]byte("short")); err == nil {
+		t.Error("expected short keys to be refused")
+	}
+}
+
+func TestSpool_Splice(t *testing.T) {
+	b := New(nil)
+	b.SetSpool(SpoolConfig{MaxMemory: 4096, Dir: t.TempDir(), Encrypt: true})
+	body := strings.Repeat("body line\r\n", 1000)
+
+	for _, size := range []int{100, 10000} {
+		sp := newSpool(&b.spools)
+		io.WriteString(sp, "Subject: hi\r\n\r\n"+body[:size])
+		used := b.SpoolMemory()
+
+		// A spliced spool shares the bytes of the spool, outside the budget.
+		spliced := sp.Splice([]byte("X-A: 1\r\nSubject: hi\r\n\r\n"), int64(len("Subject: hi\r\n\r\n")))
+		again := spliced.Splice([]byte("X-B: 2\r\n"), 0)
+		want := "X-B: 2\r\nX-A: 1\r\nSubject: hi\r\n\r\n" + body[:size]
+		if data, _ := io.ReadAll(again.NewReader()); string(data) != want || again.Len() != int64(len(want)) {
+			t.Errorf("%d: unexpected spliced message of %d bytes", size, len(data))
+		}
+		if again.OnDisk() != sp.OnDisk() || b.SpoolMemory() != used {
+			t.Errorf("%d: expected the spliced spool to share the spool", size)
+		}
+		if _, err := again.Write([]byte("x")); err == nil {
+			t.Errorf("%d: expected writes to a spliced spool to fail", size)
+		}
+		// A splice can start within the body.
+		tail := sp.Splice(nil, int64(len("Subject: hi\r\n\r\n")+50))
+		if data, _ := io.ReadAll(tail.NewReader()); string(data) != body[50:size] {
+			t.Errorf("%d: unexpected tail of %d bytes", size, len(data))
+		}
+		sp.Close()
+	}
+}
+
+func TestContext_SpoolMessage(t *testing.T) {
+	b := New(nil)
+	b.SetSpool(SpoolConfig{MaxMemory: 8192})
+	var spooled []*Spool
+	router := Router{}
+	router.OnData(&Middleware{Handler: func(ctx *Context) Action {
+		for range 2 {
+			sp, err := ctx.SpoolMessage()
+			if err != nil {
+				// 中间件放行，但邮件仍然被暂时拒绝
+				return Pass
+			}
+			spooled = append(spooled, sp)
+		}
+		return Pass
+	}})
+	var delivered string
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		data, _ := io.ReadAll(ctx.Reader)
+		delivered = string(data)
+		return Deliver
+	}})
+	b.UpdateRouter(&router)
+
+	send := func(message string) error {
+		s := newPostQueueSession(b)
+		s.spools = &b.spools
+		defer s.Logout()
+		return sendMessage(t, s, message)
+	}
+
+	message := "Subject: hi\r\n\r\n" + strings.Repeat("x", 1000) + "\r\n"
+	if err := send(message); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	if len(spooled) != 2 || spooled[0] != spooled[1] {
+		t.Errorf("expected the second call to reuse the spool, got %d spools", len(spooled))
+	}
+	if delivered != message {
+		t.Errorf("expected the spooled message to be delivered, got %d bytes", len(delivered))
+	}
+	if n := b.SpoolMemory(); n != 0 {
+		t.Errorf("expected the memory to be released with the transaction, got %d bytes", n)
+	}
+
+	// 没有溢出目录时，超出预算的邮件被暂时拒绝
+	delivered = ""
+	err := send("Subject: hi\r\n\r\n" + strings.Repeat("x", 20000) + "\r\n")
+	if !errors.Is(err, ErrInsufficientStorage) || delivered != "" {
+		t.Errorf("expected ErrInsufficientStorage, got %v", err)
+	}
+	if n := b.SpoolMemory(); n != 0 {
+		t.Errorf("expected the memory to be released, got %d bytes", n)
+	}
+}
+
+func TestContext_NewSpool(t *testing.T) {
+	b := New(nil)
+	b.SetSpool(SpoolConfig{MaxMemory: 8192})
+	rewritten := "Subject: rewritten\r\n\r\nbody\r\n"
+	var delivered string
+	var used int64
+	router := Router{}
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		sp := ctx.NewSpool()
+		if _, err := io.WriteString(sp, rewritten); err != nil {
+			t.Errorf("write: %v", err)
+		}
+		used = b.SpoolMemory()
+		ctx.SetMessageSpool(sp)
+		return Pass
+	}})
+	router.OnDeliver(&Middleware{Handler: func(ctx *Context) Action {
+		data, _ := io.ReadAll(ctx.Reader)
+		delivered = string(data)
+		return Deliver
+	}})
+	b.UpdateRouter(&router)
+
+	s := newPostQueueSession(b)
+	s.spools = &b.spools
+	err := sendMessage(t, s, "Subject: hi\r\n\r\nbody\r\n")
+	s.Logout()
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	if delivered != rewritten {
+		t.Errorf("expected the new spool to be delivered, got %q", delivered)
+	}
+	// 新的暂存计入预算，并随事务释放
+	if used < int64(len(rewritten)) {
+		t.Errorf("expected the new spool in the budget, got %d bytes", used)
+	}
+	if n := b.SpoolMemory(); n != 0 {
+		t.Errorf("expected the memory to be released with the transaction, got %d bytes", n)
+	}
+}
@@ -0,0 +1,470 @@
+package brisa
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muzhy/brisa/address"
+)
+
+// Store is a key-value store for state that outlives a single session, such as
+// classifier models, caches and counters. It is shared by all middleware of a
+// server, so implementations must be safe for concurrent use. Keys should be
+// prefixed with the name of the middleware that owns them.
+type Store interface {
+	// Get returns the value stored at key and whether it exists.
+	Get(key string) (value []byte, exists bool, err error)
+	// Set stores value at key. A ttl of zero or less means the key never expires.
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// Incr atomically adds delta to the integer stored at key and returns the
+	// new value. A missing key counts as zero; ttl applies only when the key is
+	// created by this call.
+	Incr(key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+// AddStore is implemented by Stores that can create a key atomically, so that
+// of several instances sharing the store, only one creates it.
+type AddStore interface {
+	Store
+	// Add stores value at key if key does not exist, and reports whether it
+	// did.
+	Add(key string, value []byte, ttl time.Duration) (bool, error)
+}
+
+// StoreAdd stores value at key if key does not exist, and reports whether it
+// did. It is atomic if s is an AddStore.
+func StoreAdd(s Store, key string, value []byte, ttl time.Duration) (bool, error) {
+	if a, ok := s.(AddStore); ok {
+		return a.Add(key, value, ttl)
+	}
+	_, exists, err := s.Get(key)
+	if err != nil || exists {
+		return false, err
+	}
+	return true, s.Set(key, value, ttl)
+}
+
+// ScanStore is implemented by Stores that can remove keys by their name
+// rather than one by one, such as all the keys of an address; see
+// PurgeAddress.
+type ScanStore interface {
+	Store
+	// DeleteFunc removes the keys for which match returns true, and returns
+	// their number.
+	DeleteFunc(match func(key string) bool) (int, error)
+}
+
+// ErrStoreNotScannable is returned by PurgeAddress for a Store that is not a
+// ScanStore.
+var ErrStoreNotScannable = errors.New("store cannot remove keys by name")
+
+// PurgeAddress removes the keys of s holding data of the email address addr,
+// e.g. to honor an erasure request, and returns their number. Middleware
+// keys the state of an address by its address.Key, so the keys holding it as
+// a field, between ':' or '|' separators, are removed, ignoring case. Keys
+// holding a hash of the address, or only its domain, are kept. It requires a
+// ScanStore.
+func PurgeAddress(s Store, addr string) (int, error) {
+	a, err := address.Parse(addr)
+	if err != nil {
+		return 0, err
+	}
+	scan, ok := s.(ScanStore)
+	if !ok {
+		return 0, ErrStoreNotScannable
+	}
+	return scan.DeleteFunc(func(k string) bool {
+		return hasKeyField(strings.ToLower(k), a.Key())
+	})
+}
+
+// hasKeyField reports whether field is one of the fields of key.
+func hasKeyField(key, field string) bool {
+	for i := 0; ; {
+		j := strings.Index(key[i:], field)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(field)
+		if (start == 0 || strings.IndexByte(":|", key[start-1]) >= 0) && (end == len(key) || strings.IndexByte(":|", key[end]) >= 0) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// DefaultStoreSweepInterval is the default interval at which Serve removes
+// the expired keys of its MemoryStore.
+const DefaultStoreSweepInterval = time.Minute
+
+// StoreConfig configures the Store of the middleware that Serve builds. Unless
+// the Registry already has one, Serve gives it a MemoryStore, or a RedisStore
+// if Redis.Addr is set; see Registry.Store.
+type StoreConfig struct {
+	// File keeps the content of the MemoryStore across restarts: Serve loads
+	// it on startup, if it exists, and saves it on shutdown.
+	File string `yaml:"file" json:"file" toml:"file"`
+	// SweepInterval is the interval at which the expired keys of the
+	// MemoryStore are removed, including those never read again. Defaults to
+	// DefaultStoreSweepInterval.
+	SweepInterval Duration `yaml:"sweep_interval" json:"sweep_interval" toml:"sweep_interval"`
+	// Redis keeps the state on a Redis server shared by all instances instead
+	// of in memory.
+	Redis StoreRedisConfig `yaml:"redis" json:"redis" toml:"redis"`
+	// Gossip pushes the changes of the MemoryStore to the other instances.
+	Gossip StoreGossipConfig `yaml:"gossip" json:"gossip" toml:"gossip"`
+}
+
+// StoreRedisConfig configures a RedisStore; see RedisConfig.
+type StoreRedisConfig struct {
+	Addr     string `yaml:"addr" json:"addr" toml:"addr"`
+	Username string `yaml:"username" json:"username" toml:"username"`
+	// PasswordFile holds the password of the connections.
+	PasswordFile string `yaml:"password_file" json:"password_file" toml:"password_file"`
+	DB           int    `yaml:"db" json:"db" toml:"db"`
+	// TLS encrypts the connections, verifying the certificate of the server
+	// against the system roots.
+	TLS       bool     `yaml:"tls" json:"tls" toml:"tls"`
+	Timeout   Duration `yaml:"timeout" json:"timeout" toml:"timeout"`
+	PoolSize  int      `yaml:"pool_size" json:"pool_size" toml:"pool_size"`
+	KeyPrefix string   `yaml:"key_prefix" json:"key_prefix" toml:"key_prefix"`
+}
+
+// StoreGossipConfig configures a GossipStore; see GossipConfig.
+type StoreGossipConfig struct {
+	Addr  string   `yaml:"addr" json:"addr" toml:"addr"`
+	Peers []string `yaml:"peers" json:"peers" toml:"peers"`
+	// SecretFile holds the secret shared by all instances.
+	SecretFile string   `yaml:"secret_file" json:"secret_file" toml:"secret_file"`
+	Prefixes   []string `yaml:"prefixes" json:"prefixes" toml:"prefixes"`
+}
+
+func (c *StoreConfig) validate() []error {
+	var errs []error
+	if c.SweepInterval < 0 {
+		errs = append(errs, fmt.Errorf("store.sweep_interval: must not be negative"))
+	}
+	if c.Redis.Addr != "" {
+		if c.File != "" || c.Gossip.Addr != "" {
+			errs = append(errs, fmt.Errorf("store.redis: excludes store.file and store.gossip"))
+		}
+		if c.Redis.DB < 0 || c.Redis.Timeout < 0 || c.Redis.PoolSize < 0 {
+			errs = append(errs, fmt.Errorf("store.redis: db, timeout and pool_size must not be negative"))
+		}
+	}
+	if c.Gossip.Addr != "" && c.Gossip.SecretFile == "" {
+		errs = append(errs, fmt.Errorf("store.gossip.secret_file: required"))
+	}
+	return errs
+}
+
+// newRedisStore creates the RedisStore of c.
+func (c *StoreRedisConfig) newRedisStore() (*RedisStore, error) {
+	cfg := RedisConfig{
+		Addr:      c.Addr,
+		Username:  c.Username,
+		DB:        c.DB,
+		Timeout:   time.Duration(c.Timeout),
+		PoolSize:  c.PoolSize,
+		KeyPrefix: c.KeyPrefix,
+	}
+	if c.PasswordFile != "" {
+		password, err := readKeyFile(c.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Password = string(password)
+	}
+	if c.TLS {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = &tls.Config{ServerName: host}
+	}
+	return NewRedisStore(cfg)
+}
+
+// newGossipStore creates the GossipStore of c on top of store.
+func (c *StoreGossipConfig) newGossipStore(store Store, logger *slog.Logger) (*GossipStore, error) {
+	secret, err := readKeyFile(c.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewGossipStore(GossipConfig{
+		Store:    store,
+		Addr:     c.Addr,
+		Peers:    c.Peers,
+		Secret:   secret,
+		Prefixes: c.Prefixes,
+		Logger:   logger,
+	})
+}
+
+// readKeyFile reads a secret key from path, without surrounding whitespace.
+func readKeyFile(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key in %s", path)
+	}
+	return key, nil
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time // zero means no expiry
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemoryStore is an in-process Store. It is not shared between instances, and
+// its content is lost on restart unless it is saved with Save and loaded back
+// with Load. Expired keys are removed lazily on access, and all at once by
+// Sweep; see SweepTask.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	clock   Clock
+}
+
+// NewMemoryStore creates and returns a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return NewMemoryStoreWithClock(SystemClock)
+}
+
+// NewMemoryStoreWithClock creates a MemoryStore that expires keys by the time
+// of clock.
+func NewMemoryStoreWithClock(clock Clock) *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]*memoryEntry),
+		clock:   clock,
+	}
+}
+
+// lookup returns the live entry for key, removing it if it has expired.
+// The caller must hold s.mu.
+func (s *MemoryStore) lookup(key string) *memoryEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(s.clock.Now()) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (s *MemoryStore) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return s.clock.Now().Add(ttl)
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(key)
+	if e == nil {
+		return nil, false, nil
+	}
+	return append([]byte(nil), e.value...), true, nil
+}
+
+// Set implements Store.
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = &memoryEntry{
+		value:     append([]byte(nil), value...),
+		expiresAt: s.expiry(ttl),
+	}
+	return nil
+}
+
+// Add implements AddStore.
+func (s *MemoryStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lookup(key) != nil {
+		return false, nil
+	}
+	s.entries[key] = &memoryEntry{
+		value:     append([]byte(nil), value...),
+		expiresAt: s.expiry(ttl),
+	}
+	return true, nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// Incr implements Store. Counters are stored as decimal strings.
+func (s *MemoryStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.lookup(key)
+	if e == nil {
+		e = &memoryEntry{value: []byte("0"), expiresAt: s.expiry(ttl)}
+		s.entries[key] = e
+	}
+
+	n, err := strconv.ParseInt(string(e.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value at key %s is not an integer", key)
+	}
+	n += delta
+	e.value = strconv.AppendInt(e.value[:0], n, 10)
+	return n, nil
+}
+
+// Sweep removes the expired keys and returns their number.
+func (s *MemoryStore) Sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	n := 0
+	for key, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// DeleteFunc implements ScanStore.
+func (s *MemoryStore) DeleteFunc(match func(key string) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for key := range s.entries {
+		if match(key) {
+			delete(s.entries, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SweepTask returns a RetentionTask sweeping the store for a Janitor. It
+// counts the removed keys in the expvar map "brisa" as store_keys_expired.
+func (s *MemoryStore) SweepTask() RetentionTask {
+	return func(ctx context.Context) (RetentionResult, error) {
+		n := int64(s.Sweep())
+		debugVars.Add("store_keys_expired", n)
+		return RetentionResult{Items: n}, nil
+	}
+}
+
+// memorySnapshotEntry is the saved form of a memoryEntry.
+type memorySnapshotEntry struct {
+	Key       string    `json:"key"`
+	Value     []byte    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Save writes the live keys with their expiry to w, so that counters and
+// bans survive a restart of a single instance.
+func (s *MemoryStore) Save(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	entries := make([]memorySnapshotEntry, 0, len(s.entries))
+	for key, e := range s.entries {
+		if !e.expired(now) {
+			entries = append(entries, memorySnapshotEntry{Key: key, Value: e.value, ExpiresAt: e.expiresAt})
+		}
+	}
+	// Encode while holding the lock: the values are shared with the entries.
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// SaveFile saves the store to the file at path with Save, replacing it
+// atomically.
+func (s *MemoryStore) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := s.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFile loads the file written by SaveFile at path, if it exists.
+func (s *MemoryStore) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Load(f)
+}
+
+// Load adds the keys saved by Save to the store, keeping their original
+// expiry. Keys that have expired in the meantime are skipped and existing keys
+// are overwritten.
+func (s *MemoryStore) Load(r io.Reader) error {
+	var entries []memorySnapshotEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return fmt.Errorf("failed to decode store snapshot: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	for _, se := range entries {
+		e := &memoryEntry{value: se.Value, expiresAt: se.ExpiresAt}
+		if !e.expired(now) {
+			s.entries[se.Key] = e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package brisa
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRedisAddr is the default address of the Redis server.
+	DefaultRedisAddr = "localhost:6379"
+	// DefaultRedisTimeout is the default timeout of connecting to Redis and
+	// of each command.
+	DefaultRedisTimeout = 2 * time.Second
+	// DefaultRedisPoolSize is the default number of idle connections kept.
+	DefaultRedisPoolSize = 16
+)
+
+// redisIncrScript adds to a counter and sets the expiry of a new one in a
+// single step, so that no instance sees a counter without expiry.
+const redisIncrScript = `local created = redis.call('EXISTS', KEYS[1]) == 0
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if created and tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n`
+
+// redisIncrSHA is the SHA1 of redisIncrScript, for EVALSHA.
+var redisIncrSHA = func() string {
+	sum := sha1.Sum([]byte(redisIncrScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisConfig configures a RedisStore.
+type RedisConfig struct {
+	// Addr defaults to DefaultRedisAddr.
+	Addr string
+	// Username and Password authenticate the connections if Password is set;
+	// without Username, with the legacy password of the server.
+	Username string
+	Password string
+	// DB is the number of the database.
+	DB int
+	// TLS, if not nil, encrypts the connections.
+	TLS *tls.Config
+	// Timeout defaults to DefaultRedisTimeout.
+	Timeout time.Duration
+	// PoolSize defaults to DefaultRedisPoolSize.
+	PoolSize int
+	// KeyPrefix is prepended to all keys, to share a server with other
+	// applications.
+	KeyPrefix string
+}
+
+// RedisStore is a Store on a Redis server, shared by all instances of a
+// cluster: counters, greylist triplets and reputations are the same whichever
+// instance a client reaches. Incr and Add are atomic on the server.
+type RedisStore struct {
+	cfg  RedisConfig
+	idle chan *redisConn
+}
+
+// NewRedisStore creates a RedisStore. It connects lazily.
+func NewRedisStore(cfg RedisConfig) (*RedisStore, error) {
+	if cfg.Timeout < 0 || cfg.PoolSize < 0 || cfg.DB < 0 {
+		return nil, fmt.Errorf("redis timeout, pool size and database must not be negative")
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = DefaultRedisAddr
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultRedisTimeout
+	}
+	if cfg.PoolSize == 0 {
+		cfg.PoolSize = DefaultRedisPoolSize
+	}
+	return &RedisStore{cfg: cfg, idle: make(chan *redisConn, cfg.PoolSize)}, nil
+}
+
+// Get implements Store.
+func (s *RedisStore) Get(key string) ([]byte, bool, error) {
+	reply, err := s.do("GET", s.cfg.KeyPrefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return value, true, nil
+}
+
+// Set implements Store.
+func (s *RedisStore) Set(key string, value []byte, ttl time.Duration) error {
+	args := []any{"SET", s.cfg.KeyPrefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", redisMillis(ttl))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// Add implements AddStore with SET NX.
+func (s *RedisStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	args := []any{"SET", s.cfg.KeyPrefix + key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", redisMillis(ttl))
+	}
+	reply, err := s.do(args...)
+	return reply != nil, err
+}
+
+// Delete implements Store.
+func (s *RedisStore) Delete(key string) error {
+	_, err := s.do("DEL", s.cfg.KeyPrefix+key)
+	return err
+}
+
+// DeleteFunc implements ScanStore, scanning the keys of the store with SCAN.
+// Keys written by others during the scan may be missed.
+func (s *RedisStore) DeleteFunc(match func(key string) bool) (int, error) {
+	pattern := redisGlobEscaper.Replace(s.cfg.KeyPrefix) + "*"
+	n := 0
+	for cursor := "0"; ; {
+		reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000)
+		if err != nil {
+			return n, err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return n, fmt.Errorf("redis: unexpected reply to SCAN: %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]any)
+		del := []any{"DEL"}
+		for _, k := range keys {
+			key, _ := k.([]byte)
+			if name, ok := strings.CutPrefix(string(key), s.cfg.KeyPrefix); ok && match(name) {
+				del = append(del, key)
+			}
+		}
+		if len(del) > 1 {
+			reply, err := s.do(del...)
+			if err != nil {
+				return n, err
+			}
+			deleted, _ := reply.(int64)
+			n += int(deleted)
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return n, nil
+		}
+	}
+}
+
+// redisGlobEscaper escapes the glob characters of a SCAN MATCH pattern.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Incr implements Store with a Lua script.
+func (s *RedisStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	key = s.cfg.KeyPrefix + key
+	ms := int64(0)
+	if ttl > 0 {
+		ms = redisMillis(ttl)
+	}
+	reply, err := s.do("EVALSHA", redisIncrSHA, 1, key, delta, ms)
+	var rerr redisError
+	if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		reply, err = s.do("EVAL", redisIncrScript, 1, key, delta, ms)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply to INCR: %v", reply)
+	}
+	return n, nil
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// redisMillis returns ttl in milliseconds, at least one.
+func redisMillis(ttl time.Duration) int64 {
+	return max(ttl.Milliseconds(), 1)
+}
+
+// do sends a command and returns its reply. Error replies are returned as
+// redisError; connections with other errors are dropped.
+func (s *RedisStore) do(args ...any) (any, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	c.conn.SetDeadline(time.Now().Add(s.cfg.Timeout))
+	reply, err := c.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.conn.Close()
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	s.release(c)
+	return reply, err
+}
+
+// conn returns an idle connection or a new one.
+func (s *RedisStore) conn() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+	d := &net.Dialer{Timeout: s.cfg.Timeout}
+	var nc net.Conn
+	var err error
+	if s.cfg.TLS != nil {
+		nc, err = tls.DialWithDialer(d, "tcp", s.cfg.Addr, s.cfg.TLS)
+	} else {
+		nc, err = d.Dial("tcp", s.cfg.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	c := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+	nc.SetDeadline(time.Now().Add(s.cfg.Timeout))
+	if err := s.setup(c); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return c, nil
+}
+
+// setup authenticates a new connection and selects the database.
+func (s *RedisStore) setup(c *redisConn) error {
+	if s.cfg.Password != "" {
+		args := []any{"AUTH", s.cfg.Password}
+		if s.cfg.Username != "" {
+			args = []any{"AUTH", s.cfg.Username, s.cfg.Password}
+		}
+		if _, err := c.do(args...); err != nil {
+			return err
+		}
+	}
+	if s.cfg.DB != 0 {
+		if _, err := c.do("SELECT", s.cfg.DB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release returns a connection to the pool, or closes it if the pool is full.
+func (s *RedisStore) release(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// redisError is an error reply of Redis.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn is a connection speaking RESP, the protocol of Redis.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// do sends a command and reads its reply.
+func (c *redisConn) do(args ...any) (any, error) {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		default:
+			return nil, fmt.Errorf("unsupported argument type %T", arg)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(b)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, b...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read reads a reply: a string, an int64, a []byte, nil or a []any.
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("malformed reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		// An error reply among the items is returned once all of them are
+		// read, so that the connection can be reused.
+		items := make([]any, n)
+		var replyErr error
+		for i := range items {
+			items[i], err = c.read()
+			var rerr redisError
+			if err != nil && !errors.As(err, &rerr) {
+				return nil, err
+			}
+			if err != nil && replyErr == nil {
+				replyErr = err
+			}
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+}
@@ -0,0 +1,336 @@
+package brisa
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis 是一个只支持 RedisStore 所用命令的 Redis 服务器
+type fakeRedis struct {
+	store    *MemoryStore
+	now      time.Time
+	password string
+
+	mu       sync.Mutex
+	scripts  map[string]bool
+	commands []string
+}
+
+// startFakeRedis 启动假 Redis 服务器，返回其地址
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	t.Helper()
+	f := &fakeRedis{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), password: password, scripts: map[string]bool{}}
+	f.store = NewMemoryStoreWithClock(ClockFunc(func() time.Time {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.now
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f, l.Addr().String()
+}
+
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.ToUpper(args[0]))
+		f.mu.Unlock()
+		if !authed && args[0] != "AUTH" {
+			io.WriteString(c, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		io.WriteString(c, f.exec(args, &authed))
+	}
+}
+
+// exec 执行一条命令并返回 RESP 格式的回复
+func (f *fakeRedis) exec(args []string, authed *bool) string {
+	switch args[0] {
+	case "AUTH":
+		if args[len(args)-1] != f.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok, _ := f.store.Get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch args[i] {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if nx {
+			if ok, _ := f.store.Add(args[1], []byte(args[2]), ttl); !ok {
+				return "$-1\r\n"
+			}
+			return "+OK\r\n"
+		}
+		f.store.Set(args[1], []byte(args[2]), ttl)
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok, _ := f.store.Get(key); ok {
+				n++
+			}
+			f.store.Delete(key)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SCAN":
+		// 每页按顺序返回两个键，游标是上一页最后一个键的十六进制编码
+		after, _ := hex.DecodeString(args[1])
+		var keys []string
+		f.store.mu.Lock()
+		for key := range f.store.entries {
+			if ok, _ := path.Match(args[3], key); ok && (args[1] == "0" || key > string(after)) {
+				keys = append(keys, key)
+			}
+		}
+		f.store.mu.Unlock()
+		sort.Strings(keys)
+		next := "0"
+		if len(keys) > 2 {
+			keys = keys[:2]
+			next = hex.EncodeToString([]byte(keys[1]))
+		}
+		reply := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, len(keys))
+		for _, key := range keys {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+		}
+		return reply
+	case "EVALSHA", "EVAL":
+		f.mu.Lock()
+		if args[0] == "EVAL" {
+			if args[1] != redisIncrScript {
+				f.mu.Unlock()
+				return "-ERR unknown script\r\n"
+			}
+			f.scripts[redisIncrSHA] = true
+		} else if !f.scripts[args[1]] {
+			f.mu.Unlock()
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		f.mu.Unlock()
+		delta, _ := strconv.ParseInt(args[4], 10, 64)
+		ms, _ := strconv.Atoi(args[5])
+		n, err := f.store.Incr(args[3], delta, time.Duration(ms)*time.Millisecond)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// readRESPCommand 读取一条 RESP 数组形式的命令
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	f, addr := startFakeRedis(t, "secret")
+	s, err := NewRedisStore(RedisConfig{Addr: addr, Password: "secret", KeyPrefix: "brisa:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Set("k", []byte("v\r\nw"), time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	value, ok, err := s.Get("k")
+	if err != nil || !ok || string(value) != "v\r\nw" {
+		t.Errorf("expected (v\\r\\nw, true, nil), got (%q, %v, %v)", value, ok, err)
+	}
+	if _, ok, _ := f.store.Get("brisa:k"); !ok {
+		t.Error("expected the key prefix to be applied")
+	}
+	f.advance(time.Minute)
+	if _, ok, _ := s.Get("k"); ok {
+		t.Error("expected key to expire after its ttl")
+	}
+
+	s.Set("d", []byte("v"), 0)
+	s.Delete("d")
+	if _, ok, _ := s.Get("d"); ok {
+		t.Error("expected deleted key to not exist")
+	}
+
+	// 只有第一次 Add 创建键
+	if added, err := s.Add("a", []byte("1"), time.Minute); !added || err != nil {
+		t.Errorf("expected the first Add to create the key, got (%v, %v)", added, err)
+	}
+	if added, err := s.Add("a", []byte("2"), time.Minute); added || err != nil {
+		t.Errorf("expected the second Add to keep the key, got (%v, %v)", added, err)
+	}
+
+	n, err := s.Incr("c", 2, time.Minute)
+	if err != nil || n != 2 {
+		t.Fatalf("expected (2, nil), got (%d, %v)", n, err)
+	}
+	n, _ = s.Incr("c", -5, time.Hour)
+	if n != -3 {
+		t.Errorf("expected -3, got %d", n)
+	}
+	f.advance(time.Minute)
+	if _, ok, _ := s.Get("c"); ok {
+		t.Error("expected the counter to expire after the ttl of its creation")
+	}
+	s.Set("s", []byte("x"), 0)
+	if _, err := s.Incr("s", 1, 0); err == nil {
+		t.Error("expected an error for a non-integer value")
+	}
+
+	// 脚本只在服务器没有缓存时才完整发送
+	f.mu.Lock()
+	evals := strings.Count(strings.Join(f.commands, " "), "EVAL ")
+	f.mu.Unlock()
+	if evals != 1 {
+		t.Errorf("expected the script to be sent once, got %d times", evals)
+	}
+}
+
+func TestRedisStore_DeleteFunc(t *testing.T) {
+	f, addr := startFakeRedis(t, "")
+	s, err := NewRedisStore(RedisConfig{Addr: addr, KeyPrefix: "brisa:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, key := range []string{"rep:bob@example.com", "limit|bob@example.com|1", "rep:alice@example.com", "seen:bob@example.com"} {
+		s.Set(key, []byte("1"), 0)
+	}
+	// 其他前缀的键不属于这个存储
+	f.store.Set("other:bob@example.com", []byte("1"), 0)
+
+	n, err := PurgeAddress(s, "Bob@example.com")
+	if err != nil || n != 3 {
+		t.Fatalf("expected (3, nil), got (%d, %v)", n, err)
+	}
+	if _, ok, _ := s.Get("rep:alice@example.com"); !ok {
+		t.Error("expected the keys of other addresses to be kept")
+	}
+	if _, ok, _ := f.store.Get("other:bob@example.com"); !ok {
+		t.Error("expected the keys outside the prefix to be kept")
+	}
+}
+
+func TestRedisStore_Errors(t *testing.T) {
+	_, addr := startFakeRedis(t, "secret")
+	s, _ := NewRedisStore(RedisConfig{Addr: addr, Password: "wrong"})
+	if _, _, err := s.Get("k"); err == nil {
+		t.Error("expected an error for a wrong password")
+	}
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	s, _ = NewRedisStore(RedisConfig{Addr: l.Addr().String(), Timeout: 100 * time.Millisecond})
+	if err := s.Set("k", nil, 0); err == nil {
+		t.Error("expected an error when the server is unreachable")
+	}
+	if _, err := NewRedisStore(RedisConfig{PoolSize: -1}); err == nil {
+		t.Error("expected an error for a negative pool size")
+	}
+}
+
+func TestRedisConn_ReadArrayError(t *testing.T) {
+	// An error reply within an array leaves the next reply of the connection
+	// in place.
+	c := &redisConn{r: bufio.NewReader(strings.NewReader("*3\r\n:1\r\n-ERR boom\r\n*1\r\n$3\r\nabc\r\n+OK\r\n"))}
+	if _, err := c.read(); err != redisError("ERR boom") {
+		t.Fatalf("expected the error reply, got %v", err)
+	}
+	if reply, err := c.read(); reply != "OK" || err != nil {
+		t.Errorf("expected the next reply, got (%v, %v)", reply, err)
+	}
+}
+
+func TestStoreAdd(t *testing.T) {
+	s := NewMemoryStore()
+	// 不实现 AddStore 的 Store 先查询再写入
+	var plain Store = struct{ Store }{s}
+	if added, _ := StoreAdd(plain, "k", []byte("1"), 0); !added {
+		t.Error("expected the key to be added")
+	}
+	if added, _ := StoreAdd(plain, "k", []byte("2"), 0); added {
+		t.Error("expected the existing key to be kept")
+	}
+	if added, _ := StoreAdd(s, "k", []byte("3"), 0); added {
+		t.Error("expected the existing key to be kept")
+	}
+	if v, _, _ := s.Get("k"); string(v) != "1" {
+		t.Errorf("expected 1, got %q", v)
+	}
+}
@@ -0,0 +1,163 @@
+package brisa
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewMemoryStoreWithClock(ClockFunc(func() time.Time { return now }))
+
+	t.Run("set and get", func(t *testing.T) {
+		if err := s.Set("k", []byte("v"), 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		value, ok, err := s.Get("k")
+		if err != nil || !ok || string(value) != "v" {
+			t.Errorf("expected (v, true, nil), got (%q, %v, %v)", value, ok, err)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		if _, ok, _ := s.Get("missing"); ok {
+			t.Error("expected missing key to not exist")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s.Set("d", []byte("v"), 0)
+		s.Delete("d")
+		if _, ok, _ := s.Get("d"); ok {
+			t.Error("expected deleted key to not exist")
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		s.Set("t", []byte("v"), time.Minute)
+		now = now.Add(59 * time.Second)
+		if _, ok, _ := s.Get("t"); !ok {
+			t.Error("expected key to exist before its ttl")
+		}
+		now = now.Add(time.Second)
+		if _, ok, _ := s.Get("t"); ok {
+			t.Error("expected key to expire after its ttl")
+		}
+	})
+
+	t.Run("incr", func(t *testing.T) {
+		n, err := s.Incr("c", 2, time.Minute)
+		if err != nil || n != 2 {
+			t.Fatalf("expected (2, nil), got (%d, %v)", n, err)
+		}
+		n, _ = s.Incr("c", -5, time.Hour)
+		if n != -3 {
+			t.Errorf("expected -3, got %d", n)
+		}
+		// The ttl is only set when the counter is created.
+		now = now.Add(time.Minute)
+		if _, ok, _ := s.Get("c"); ok {
+			t.Error("expected counter to expire with its original ttl")
+		}
+	})
+
+	t.Run("incr non-integer", func(t *testing.T) {
+		s.Set("s", []byte("abc"), 0)
+		if _, err := s.Incr("s", 1, 0); err == nil {
+			t.Error("expected error when incrementing a non-integer value")
+		}
+	})
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewMemoryStoreWithClock(ClockFunc(func() time.Time { return now }))
+	s.Set("forever", []byte("v"), 0)
+	s.Set("ban", []byte("1"), time.Hour)
+	s.Incr("counter", 3, time.Minute)
+
+	if n := s.Sweep(); n != 0 {
+		t.Errorf("expected nothing to expire yet, got %d", n)
+	}
+	// 过期的键即使不再读取也会被清除
+	now = now.Add(2 * time.Minute)
+	if n := s.Sweep(); n != 1 || len(s.entries) != 2 {
+		t.Errorf("expected the counter to be swept, got %d, %d keys left", n, len(s.entries))
+	}
+	now = now.Add(time.Hour)
+	if n := s.Sweep(); n != 1 || len(s.entries) != 1 {
+		t.Errorf("expected the ban to be swept, got %d, %d keys left", n, len(s.entries))
+	}
+}
+
+func TestPurgeAddress(t *testing.T) {
+	s := NewMemoryStore()
+	for _, key := range []string{
+		"greylist:t:192.0.2.0|bob@example.com|carol@example.org",
+		"bounce:sent:bob@example.com",
+		"quota:rcpt:day:Bob@Example.com",
+		"bounce:sent:alice.bob@example.com",
+		"greylist:known:example.com",
+	} {
+		s.Set(key, []byte("1"), 0)
+	}
+
+	// 只删除以该地址为字段的键，忽略大小写
+	n, err := PurgeAddress(s, "BOB@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || len(s.entries) != 2 {
+		t.Errorf("expected 3 keys purged, got %d, %d keys left", n, len(s.entries))
+	}
+	if _, ok, _ := s.Get("bounce:sent:alice.bob@example.com"); !ok {
+		t.Error("expected the key of another address to be kept")
+	}
+
+	if _, err := PurgeAddress(s, "not an address"); err == nil {
+		t.Error("expected error for an invalid address")
+	}
+	if _, err := PurgeAddress(struct{ Store }{s}, "bob@example.com"); !errors.Is(err, ErrStoreNotScannable) {
+		t.Errorf("expected ErrStoreNotScannable, got %v", err)
+	}
+}
+
+func TestMemoryStore_SaveLoad(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := ClockFunc(func() time.Time { return now })
+	s := NewMemoryStoreWithClock(clock)
+	s.Set("forever", []byte("v"), 0)
+	s.Set("ban", []byte("1"), time.Hour)
+	s.Incr("counter", 3, time.Minute)
+
+	var buf bytes.Buffer
+	if err := s.Save(&buf); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// 重启两分钟后加载：计数器已过期，其余保留原有过期时间
+	now = now.Add(2 * time.Minute)
+	restored := NewMemoryStoreWithClock(clock)
+	if err := restored.Load(&buf); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if v, ok, _ := restored.Get("forever"); !ok || string(v) != "v" {
+		t.Errorf("expected forever=v, got (%q, %v)", v, ok)
+	}
+	if _, ok, _ := restored.Get("counter"); ok {
+		t.Error("expected expired counter to be skipped")
+	}
+	if _, ok, _ := restored.Get("ban"); !ok {
+		t.Error("expected ban to be restored")
+	}
+	now = now.Add(time.Hour)
+	if _, ok, _ := restored.Get("ban"); ok {
+		t.Error("expected ban to keep its original expiry")
+	}
+
+	if err := restored.Load(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("expected error for a corrupt snapshot")
+	}
+}
@@ -0,0 +1,111 @@
+package brisa
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+	"github.com/muzhy/brisa/address"
+)
+
+// ErrOtherTenant is the reply to a recipient of another tenant than the
+// recipients before it in the transaction. Like too many recipients, it
+// makes the client send the recipient in another transaction.
+var ErrOtherTenant = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+	Message:      "Please send recipients of this domain in a separate transaction",
+}
+
+// Tenant is a hosted customer: a set of recipient domains with a policy of
+// its own. The first recipient of a transaction selects its tenant, whose
+// router then replaces the router of the session from the rcpt_to chain on,
+// so that the chains of each tenant only see its own messages. Recipients of
+// other tenants are deferred with ErrOtherTenant.
+type Tenant struct {
+	// Name identifies the tenant in logs (as "tenant"), metrics, events and
+	// the "tenant:<name>" condition. Middleware keeping state per tenant,
+	// such as quarantines or quotas, namespace it with Context.Tenant.
+	Name string
+	// Domains are the recipient domains of the tenant.
+	Domains []string
+	// Router holds the chains of the tenant. Its conn, auth and mail_from
+	// chains never run, as the tenant is not known before RCPT TO.
+	Router *Router
+}
+
+// compiledTenant is a Tenant ready for sessions.
+type compiledTenant struct {
+	name   string
+	router *compiledRouter
+}
+
+// tenantTable maps the normalized recipient domains to their tenants.
+type tenantTable map[string]*compiledTenant
+
+// SetTenants replaces the tenants of new transactions. Tenants apply to the
+// sessions of listeners using the router set with UpdateRouter, not to
+// those with a router of their own. Recipients outside the domains of all
+// tenants use the router of the session.
+func (b *Brisa) SetTenants(tenants []Tenant) error {
+	table, err := compileTenants(tenants)
+	if err != nil {
+		return err
+	}
+	b.tenants.Store(table)
+	return nil
+}
+
+// compileTenants returns the table of tenants, or nil if there are none.
+func compileTenants(tenants []Tenant) (*tenantTable, error) {
+	if len(tenants) == 0 {
+		return nil, nil
+	}
+	table := make(tenantTable)
+	names := make(map[string]bool, len(tenants))
+	for i, t := range tenants {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("tenants[%d]: name required", i)
+		case names[t.Name]:
+			return nil, fmt.Errorf("tenants[%d]: duplicate tenant %q", i, t.Name)
+		}
+		names[t.Name] = true
+		router := t.Router
+		if router == nil {
+			router = &Router{}
+		}
+		ct := &compiledTenant{name: t.Name, router: compileRouter(router)}
+		for _, d := range t.Domains {
+			d = address.NormalizeDomain(d)
+			if other, ok := table[d]; ok {
+				return nil, fmt.Errorf("tenants[%d]: domain %s already belongs to tenant %q", i, d, other.name)
+			}
+			table[d] = ct
+		}
+	}
+	return &table, nil
+}
+
+// tenantsFor returns the tenants of the sessions of listener, if any.
+func (b *Brisa) tenantsFor(listener string) tenantTable {
+	if routers := b.listenerRouters.Load(); routers != nil {
+		if _, ok := (*routers)[listener]; ok {
+			return nil
+		}
+	}
+	if t := b.tenants.Load(); t != nil {
+		return *t
+	}
+	return nil
+}
+
+// lookup returns the tenant of a recipient, or nil.
+func (t tenantTable) lookup(rcpt string) *compiledTenant {
+	return t[address.NormalizeDomain(address.Domain(rcpt))]
+}
+
+// Tenant returns the name of the tenant of the current transaction, or ""
+// if it has none; see Tenant.
+func (c *Context) Tenant() string {
+	return c.tenant
+}
@@ -0,0 +1,103 @@
+package brisa
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	var runs []string
+	record := func(name string) *Middleware {
+		return &Middleware{Handler: func(ctx *Context) Action {
+			runs = append(runs, name+":"+ctx.Tenant())
+			return Pass
+		}}
+	}
+	defaultRouter := Router{}
+	defaultRouter.OnRcptTo(record("default"))
+	defaultRouter.OnData(record("default"))
+	acme := Router{}
+	acme.OnRcptTo(record("acme"))
+	acme.OnData(record("acme"))
+	acme.OnData(&Middleware{Condition: mustCondition(t, "tenant:acme"), Handler: func(ctx *Context) Action { return Quarantine }})
+	globex := Router{}
+	globex.OnData(record("globex"))
+
+	b := New(nil)
+	b.UpdateRouter(&defaultRouter)
+	if err := b.SetTenants([]Tenant{
+		{Name: "acme", Domains: []string{"acme.example", "ACME.example.net"}, Router: &acme},
+		{Name: "globex", Domains: []string{"globex.example"}, Router: &globex},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newPostQueueSession(b)
+	s.sessionRouter, s.tenants = s.router, b.tenantsFor("")
+	defer s.Logout()
+	send := func(to ...string) error {
+		t.Helper()
+		runs = nil
+		if err := s.Mail("alice@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		for i, rcpt := range to {
+			err := s.Rcpt(rcpt, nil)
+			if i == 0 && err != nil {
+				t.Fatal(err)
+			}
+			if i > 0 && !errors.Is(err, ErrOtherTenant) {
+				t.Fatalf("expected %s to be deferred, got %v", rcpt, err)
+			}
+		}
+		return s.Data(strings.NewReader("\r\nhello\r\n"))
+	}
+
+	// 第一个收件人决定事务的租户，其他租户的收件人被推迟到另一个事务
+	if err := send("bob@acme.example.net", "carol@globex.example", "dave@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(runs, " "); got != "acme:acme acme:acme" || s.ctx.Action != Quarantine {
+		t.Errorf("unexpected runs %q, action %v", got, s.ctx.Action)
+	}
+
+	// 下一个事务重新选择租户
+	if err := send("carol@globex.example"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(runs, " "); got != "globex:globex" {
+		t.Errorf("unexpected runs %q", got)
+	}
+	if err := send("dave@example.com", "bob@acme.example"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(runs, " "); got != "default: default:" {
+		t.Errorf("unexpected runs %q", got)
+	}
+
+	// 有自己路由的监听器不使用租户
+	b.UpdateListenerRouter("submission", &Router{})
+	if b.tenantsFor("submission") != nil || b.tenantsFor("") == nil {
+		t.Error("expected tenants only for listeners of the default router")
+	}
+
+	for name, tenants := range map[string][]Tenant{
+		"missing name":     {{Domains: []string{"a.example"}}},
+		"duplicate name":   {{Name: "a"}, {Name: "a"}},
+		"duplicate domain": {{Name: "a", Domains: []string{"a.example"}}, {Name: "b", Domains: []string{"A.example."}}},
+	} {
+		if err := b.SetTenants(tenants); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func mustCondition(t *testing.T, expr string) Condition {
+	t.Helper()
+	cond, err := ParseCondition(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cond
+}